@@ -44,6 +44,14 @@ func usage(fset *flag.FlagSet) {
     Index And 1 Replica:
     cbindex -auth user:pass -type move -index 'def_airportname' -bucket default -with '{"nodes":["10.17.6.32:8091","10.17.6.33:8091"]}'
     (Move Index supports moving only 1 index (and its replicas) at a time)
+
+- Rebuild
+    cbindex -auth user:pass -type rebuild -index 'def_airportname' -bucket default
+
+- DDL History
+    cbindex -auth user:pass -type history
+    cbindex -auth user:pass -type history -bucket default -index abcd -event drop
+    cbindex -auth user:pass -type history -limit 20 -offset 20
     `)
 }
 
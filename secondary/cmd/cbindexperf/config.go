@@ -6,7 +6,9 @@ import (
 	"os"
 
 	c "github.com/couchbase/indexing/secondary/common"
+	qclient "github.com/couchbase/indexing/secondary/queryport/client"
 	"github.com/couchbase/indexing/secondary/stats"
+	"github.com/couchbase/indexing/secondary/tools/randdocs"
 )
 
 type ScanConfig struct {
@@ -24,15 +26,39 @@ type ScanConfig struct {
 	NInterval   uint32 // Stats dump nrequests interval
 	Consistency bool   // Use session consistency
 
+	// MultiScan, MultiScanCount and Scan3
+	Scans      qclient.Scans
+	Projection *qclient.IndexProjection
+	GroupAggr  *qclient.GroupAggr // Scan3 only
+	Distinct   bool
+	Reverse    bool
+	Offset     int64
+
 	iteration uint32
 }
 
+// InProcessConfig runs the scans against an indexer started in-process,
+// on documents generated as per Docs, instead of against a cluster.
+type InProcessConfig struct {
+	StorageDir       string
+	ScanPort         int
+	Indexes          []*c.IndexDefn // Bucket defaults to Docs.Bucket
+	Docs             randdocs.Config
+	SnapshotInterval uint64 // Milliseconds
+
+	// Writers update random documents while the scans run, at WriteRate
+	// mutations/sec each.  A WriteRate of 0 is unthrottled.
+	Writers   int
+	WriteRate int
+}
+
 type Config struct {
 	LatencyBuckets []int64
 	ScanSpecs      []*ScanConfig
 	Concurrency    int
 	Clients        int
 	ClientBootTime int
+	InProcess      *InProcessConfig
 }
 
 type ScanResult struct {
@@ -48,11 +74,19 @@ type ScanResult struct {
 	statsDuration int64
 }
 
+type WriteResult struct {
+	Mutations    uint64
+	Duration     int64
+	LatencyHisto stats.Histogram
+	ErrorCount   uint64
+}
+
 type Result struct {
 	ScanResults    []*ScanResult
 	Rows           uint64
 	Duration       float64
 	WarmupDuration float64
+	WriteResult    *WriteResult `json:",omitempty"`
 }
 
 func parseConfig(filepath string) (*Config, error) {
@@ -24,6 +24,42 @@ var (
 	requestCounter = uint64(0)
 )
 
+// Scanner is implemented by GsiClient for scans against a cluster, and by
+// localClient for scans against an in-process indexer.
+type Scanner interface {
+	ScanAll(defnID uint64, requestId string, limit int64,
+		cons c.Consistency, vector *qclient.TsConsistency,
+		callb qclient.ResponseHandler) error
+
+	Range(defnID uint64, requestId string, low, high c.SecondaryKey,
+		inclusion qclient.Inclusion, distinct bool, limit int64,
+		cons c.Consistency, vector *qclient.TsConsistency,
+		callb qclient.ResponseHandler) error
+
+	Lookup(defnID uint64, requestId string, values []c.SecondaryKey,
+		distinct bool, limit int64,
+		cons c.Consistency, vector *qclient.TsConsistency,
+		callb qclient.ResponseHandler) error
+
+	CountRange(defnID uint64, requestId string, low, high c.SecondaryKey,
+		inclusion qclient.Inclusion,
+		cons c.Consistency, vector *qclient.TsConsistency) (int64, error)
+
+	MultiScan(defnID uint64, requestId string, scans qclient.Scans, reverse,
+		distinct bool, projection *qclient.IndexProjection, offset, limit int64,
+		cons c.Consistency, vector *qclient.TsConsistency,
+		callb qclient.ResponseHandler) error
+
+	MultiScanCount(defnID uint64, requestId string, scans qclient.Scans, distinct bool,
+		cons c.Consistency, vector *qclient.TsConsistency) (int64, error)
+
+	Scan3(defnID uint64, requestId string, scans qclient.Scans, reverse,
+		distinct bool, projection *qclient.IndexProjection, offset, limit int64,
+		groupAggr *qclient.GroupAggr, indexOrder *qclient.IndexKeyOrder,
+		cons c.Consistency, vector *qclient.TsConsistency,
+		callb qclient.ResponseHandler) error
+}
+
 type Job struct {
 	spec   *ScanConfig
 	result *ScanResult
@@ -36,7 +72,7 @@ type JobResult struct {
 	dur  int64
 }
 
-func RunJob(client *qclient.GsiClient, job *Job, aggrQ chan *JobResult) {
+func RunJob(client Scanner, job *Job, aggrQ chan *JobResult) {
 	var err error
 	var rows int64
 
@@ -58,13 +94,18 @@ func RunJob(client *qclient.GsiClient, job *Job, aggrQ chan *JobResult) {
 			errFn(res.Error().Error())
 			return false
 		} else {
-			_, pkeys, err := res.GetEntries()
+			skeys, pkeys, err := res.GetEntries()
 			if err != nil {
 				errFn(err.Error())
 				return false
 			}
 
-			rows += int64(len(pkeys))
+			// Group aggregate rows have no primary keys
+			if len(pkeys) > len(skeys) {
+				rows += int64(len(pkeys))
+			} else {
+				rows += int64(len(skeys))
+			}
 		}
 
 		return true
@@ -91,6 +132,29 @@ func RunJob(client *qclient.GsiClient, job *Job, aggrQ chan *JobResult) {
 		requestID := os.Args[0] + uuid
 		err = client.Lookup(spec.DefnId, requestID, spec.Lookups, false,
 			spec.Limit, cons, nil, callb)
+	case "Count":
+		requestID := os.Args[0] + uuid
+		if _, err = client.CountRange(spec.DefnId, requestID, spec.Low, spec.High,
+			qclient.Inclusion(spec.Inclusion), cons, nil); err == nil {
+			rows = 1
+		}
+	case "MultiScan":
+		requestID := os.Args[0] + uuid
+		err = client.MultiScan(spec.DefnId, requestID, spec.Scans, spec.Reverse,
+			spec.Distinct, spec.Projection, spec.Offset, spec.Limit, cons, nil, callb)
+	case "MultiScanCount":
+		requestID := os.Args[0] + uuid
+		if _, err = client.MultiScanCount(spec.DefnId, requestID, spec.Scans,
+			spec.Distinct, cons, nil); err == nil {
+			rows = 1
+		}
+	case "Scan3":
+		requestID := os.Args[0] + uuid
+		err = client.Scan3(spec.DefnId, requestID, spec.Scans, spec.Reverse,
+			spec.Distinct, spec.Projection, spec.Offset, spec.Limit, spec.GroupAggr,
+			nil, cons, nil, callb)
+	default:
+		err = fmt.Errorf("unknown scan type %v", spec.Type)
 	}
 
 	if err != nil {
@@ -108,7 +172,7 @@ func RunJob(client *qclient.GsiClient, job *Job, aggrQ chan *JobResult) {
 	}
 }
 
-func Worker(jobQ chan *Job, c *qclient.GsiClient, aggrQ chan *JobResult, wg *sync.WaitGroup) {
+func Worker(jobQ chan *Job, c Scanner, aggrQ chan *JobResult, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for job := range jobQ {
@@ -145,14 +209,17 @@ func ResultAggregator(ch chan *JobResult, sw io.Writer, wg *sync.WaitGroup) {
 	}
 }
 
+func humanizeLatency(v int64) string {
+	if v == math.MinInt64 {
+		return "0"
+	} else if v == math.MaxInt64 {
+		return "inf"
+	}
+	return fmt.Sprint(time.Nanosecond * time.Duration(v))
+}
+
 func RunCommands(cluster string, cfg *Config, statsW io.Writer) (*Result, error) {
 	t0 := time.Now()
-	var result Result
-
-	var clients []*qclient.GsiClient
-	var jobQ chan *Job
-	var aggrQ chan *JobResult
-	var wg1, wg2 sync.WaitGroup
 
 	if len(cfg.LatencyBuckets) == 0 {
 		cfg.LatencyBuckets = defaultLatencyBuckets
@@ -173,7 +240,7 @@ func RunCommands(cluster string, cfg *Config, statsW io.Writer) (*Result, error)
 	}
 	defer client.Close()
 
-	clients = make([]*qclient.GsiClient, cfg.Clients)
+	clients := make([]Scanner, cfg.Clients)
 	for i := 0; i < cfg.Clients; i++ {
 		c, err := qclient.NewGsiClient(cluster, config)
 		if err != nil {
@@ -191,11 +258,31 @@ func RunCommands(cluster string, cfg *Config, statsW io.Writer) (*Result, error)
 		return nil, err
 	}
 
+	for _, spec := range cfg.ScanSpecs {
+		for _, index := range indexes {
+			if index.Definition.Bucket == spec.Bucket &&
+				index.Definition.Name == spec.Index {
+				spec.DefnId = uint64(index.Definition.DefnId)
+			}
+		}
+	}
+
+	return runScans(clients, cfg, statsW, t0), nil
+}
+
+// runScans runs the scan specs, whose DefnId is resolved, on the clients.
+func runScans(clients []Scanner, cfg *Config, statsW io.Writer, t0 time.Time) *Result {
+	var result Result
+
+	var jobQ chan *Job
+	var aggrQ chan *JobResult
+	var wg1, wg2 sync.WaitGroup
+
 	jobQ = make(chan *Job, cfg.Concurrency*1000)
 	aggrQ = make(chan *JobResult, cfg.Concurrency*1000)
 	for i := 0; i < cfg.Concurrency; i++ {
 		wg1.Add(1)
-		go Worker(jobQ, clients[i%cfg.Clients], aggrQ, &wg1)
+		go Worker(jobQ, clients[i%len(clients)], aggrQ, &wg1)
 	}
 
 	wg2.Add(1)
@@ -206,25 +293,9 @@ func RunCommands(cluster string, cfg *Config, statsW io.Writer) (*Result, error)
 			spec.Id = uint64(i)
 		}
 
-		for _, index := range indexes {
-			if index.Definition.Bucket == spec.Bucket &&
-				index.Definition.Name == spec.Index {
-				spec.DefnId = uint64(index.Definition.DefnId)
-			}
-		}
-
-		hFn := func(v int64) string {
-			if v == math.MinInt64 {
-				return "0"
-			} else if v == math.MaxInt64 {
-				return "inf"
-			}
-			return fmt.Sprint(time.Nanosecond * time.Duration(v))
-		}
-
 		res := new(ScanResult)
 		res.ErrorCount = 0
-		res.LatencyHisto.Init(cfg.LatencyBuckets, hFn)
+		res.LatencyHisto.Init(cfg.LatencyBuckets, humanizeLatency)
 		res.Id = spec.Id
 		result.ScanResults = append(result.ScanResults, res)
 	}
@@ -270,5 +341,5 @@ loop:
 	close(aggrQ)
 	wg2.Wait()
 
-	return &result, err
+	return &result
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	rnd "math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/indexer"
+	qclient "github.com/couchbase/indexing/secondary/queryport/client"
+	"github.com/couchbase/indexing/secondary/tools/randdocs"
+)
+
+var defaultScanPort = 9101
+
+// localClient scans an in-process indexer over its queryport.  Session
+// consistency is served by waiting for all the mutations applied so far.
+type localClient struct {
+	sc      *qclient.GsiScanClient
+	bench   *indexer.BenchIndexer
+	buckets map[uint64]string
+	primary map[uint64]bool
+}
+
+func (l *localClient) consistency(defnID uint64, cons c.Consistency,
+	vector *qclient.TsConsistency) (c.Consistency, *qclient.TsConsistency) {
+
+	if cons != c.SessionConsistency {
+		return cons, vector
+	}
+
+	ts := l.bench.Timestamp(l.buckets[defnID])
+	if ts == nil {
+		return c.AnyConsistency, nil
+	}
+
+	var vbnos []uint16
+	var seqnos, vbuuids []uint64
+	for vb, seqno := range ts.Seqnos {
+		if seqno != 0 {
+			vbnos = append(vbnos, uint16(vb))
+			seqnos = append(seqnos, seqno)
+			vbuuids = append(vbuuids, ts.Vbuuids[vb])
+		}
+	}
+	return c.QueryConsistency, qclient.NewTsConsistency(vbnos, seqnos, vbuuids)
+}
+
+// primaryKey returns the docid bound of a primary index range.
+func primaryKey(key c.SecondaryKey) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+	if s, ok := key[0].(string); ok {
+		return []byte(s)
+	}
+	return []byte(fmt.Sprint(key[0]))
+}
+
+func (l *localClient) ScanAll(defnID uint64, requestId string, limit int64,
+	cons c.Consistency, vector *qclient.TsConsistency,
+	callb qclient.ResponseHandler) error {
+
+	cons, vector = l.consistency(defnID, cons, vector)
+	err, _ := l.sc.ScanAll(defnID, requestId, limit, cons, vector, callb, 0, nil)
+	return err
+}
+
+func (l *localClient) Range(defnID uint64, requestId string, low, high c.SecondaryKey,
+	inclusion qclient.Inclusion, distinct bool, limit int64,
+	cons c.Consistency, vector *qclient.TsConsistency,
+	callb qclient.ResponseHandler) error {
+
+	var err error
+	cons, vector = l.consistency(defnID, cons, vector)
+	if l.primary[defnID] {
+		err, _ = l.sc.RangePrimary(defnID, requestId, primaryKey(low), primaryKey(high),
+			inclusion, distinct, limit, cons, vector, callb, 0, nil)
+	} else {
+		err, _ = l.sc.Range(defnID, requestId, low, high, inclusion, distinct, limit,
+			cons, vector, callb, 0, nil)
+	}
+	return err
+}
+
+func (l *localClient) Lookup(defnID uint64, requestId string, values []c.SecondaryKey,
+	distinct bool, limit int64,
+	cons c.Consistency, vector *qclient.TsConsistency,
+	callb qclient.ResponseHandler) error {
+
+	cons, vector = l.consistency(defnID, cons, vector)
+	err, _ := l.sc.Lookup(defnID, requestId, values, distinct, limit, cons, vector,
+		callb, 0, nil)
+	return err
+}
+
+func (l *localClient) CountRange(defnID uint64, requestId string, low, high c.SecondaryKey,
+	inclusion qclient.Inclusion,
+	cons c.Consistency, vector *qclient.TsConsistency) (int64, error) {
+
+	cons, vector = l.consistency(defnID, cons, vector)
+	if l.primary[defnID] {
+		return l.sc.CountRangePrimary(defnID, requestId, primaryKey(low), primaryKey(high),
+			inclusion, cons, vector, 0, nil)
+	}
+	return l.sc.CountRange(defnID, requestId, low, high, inclusion, cons, vector, 0, nil)
+}
+
+func (l *localClient) MultiScan(defnID uint64, requestId string, scans qclient.Scans, reverse,
+	distinct bool, projection *qclient.IndexProjection, offset, limit int64,
+	cons c.Consistency, vector *qclient.TsConsistency,
+	callb qclient.ResponseHandler) error {
+
+	var err error
+	cons, vector = l.consistency(defnID, cons, vector)
+	if l.primary[defnID] {
+		err, _ = l.sc.MultiScanPrimary(defnID, requestId, scans, reverse, distinct,
+			projection, offset, limit, cons, vector, callb, 0, nil)
+	} else {
+		err, _ = l.sc.MultiScan(defnID, requestId, scans, reverse, distinct,
+			projection, offset, limit, cons, vector, callb, 0, nil)
+	}
+	return err
+}
+
+func (l *localClient) MultiScanCount(defnID uint64, requestId string, scans qclient.Scans,
+	distinct bool, cons c.Consistency, vector *qclient.TsConsistency) (int64, error) {
+
+	cons, vector = l.consistency(defnID, cons, vector)
+	if l.primary[defnID] {
+		return l.sc.MultiScanCountPrimary(defnID, requestId, scans, distinct, cons, vector,
+			0, nil, "")
+	}
+	return l.sc.MultiScanCount(defnID, requestId, scans, distinct, cons, vector, 0, nil, "")
+}
+
+func (l *localClient) Scan3(defnID uint64, requestId string, scans qclient.Scans, reverse,
+	distinct bool, projection *qclient.IndexProjection, offset, limit int64,
+	groupAggr *qclient.GroupAggr, indexOrder *qclient.IndexKeyOrder,
+	cons c.Consistency, vector *qclient.TsConsistency,
+	callb qclient.ResponseHandler) error {
+
+	var err error
+	cons, vector = l.consistency(defnID, cons, vector)
+	if l.primary[defnID] {
+		err, _ = l.sc.Scan3Primary(defnID, requestId, scans, reverse, distinct,
+			projection, offset, limit, groupAggr, indexOrder != nil, cons, vector,
+			callb, 0, nil, nil, "", nil)
+	} else {
+		err, _ = l.sc.Scan3(defnID, requestId, scans, reverse, distinct,
+			projection, offset, limit, groupAggr, indexOrder != nil, cons, vector,
+			callb, 0, nil, nil, "", nil)
+	}
+	return err
+}
+
+func loadDocs(bench *indexer.BenchIndexer, cfg randdocs.Config) error {
+	var wg sync.WaitGroup
+	var errCount uint64
+
+	for thr := 0; thr < cfg.Threads; thr++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for i := 0; i < cfg.NumDocs/cfg.Threads; i++ {
+				docid := randdocs.DocId(cfg, i+offset)
+				doc, _ := json.Marshal(randdocs.GenerateDoc(cfg))
+				if err := bench.Upsert(cfg.Bucket, []byte(docid), doc); err != nil {
+					atomic.AddUint64(&errCount, 1)
+				}
+			}
+		}(thr * cfg.NumDocs / cfg.Threads)
+	}
+	wg.Wait()
+
+	if errCount != 0 {
+		return fmt.Errorf("%v documents failed to load", errCount)
+	}
+	bench.Snapshot()
+	return nil
+}
+
+// Writer updates random documents, at rate mutations/sec if non-zero,
+// until stopch is closed.
+func Writer(bench *indexer.BenchIndexer, cfg randdocs.Config, rate int,
+	result *WriteResult, stopch chan bool, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stopch:
+			return
+		default:
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stopch:
+				return
+			}
+		}
+
+		docid := randdocs.DocId(cfg, rnd.Intn(cfg.NumDocs))
+		doc, _ := json.Marshal(randdocs.GenerateDoc(cfg))
+
+		startTime := time.Now()
+		err := bench.Upsert(cfg.Bucket, []byte(docid), doc)
+		dur := time.Since(startTime).Nanoseconds()
+
+		if err != nil {
+			atomic.AddUint64(&result.ErrorCount, 1)
+			continue
+		}
+		atomic.AddUint64(&result.Mutations, 1)
+		atomic.AddInt64(&result.Duration, dur)
+		result.LatencyHisto.Add(dur)
+	}
+}
+
+// setLocalDefaults fills in the defaults of an in-process run.
+func setLocalDefaults(cfg *Config) {
+	ip := cfg.InProcess
+
+	if len(cfg.LatencyBuckets) == 0 {
+		cfg.LatencyBuckets = defaultLatencyBuckets
+	}
+
+	if cfg.Clients == 0 {
+		cfg.Clients = 1
+	}
+
+	if ip.ScanPort == 0 {
+		ip.ScanPort = defaultScanPort
+	}
+
+	if ip.Docs.Bucket == "" {
+		ip.Docs.Bucket = "default"
+	}
+
+	if ip.Docs.Threads == 0 {
+		ip.Docs.Threads = 1
+	}
+
+	for _, spec := range cfg.ScanSpecs {
+		if spec.Bucket == "" {
+			spec.Bucket = ip.Docs.Bucket
+		}
+	}
+}
+
+// localIndexDefn returns the definition of the i-th index of an
+// in-process run, with defaults.
+func localIndexDefn(i int, index *c.IndexDefn, bucket string) c.IndexDefn {
+	defn := *index
+	if defn.DefnId == 0 {
+		defn.DefnId = c.IndexDefnId(i + 1)
+	}
+	if defn.Bucket == "" {
+		defn.Bucket = bucket
+	}
+	if defn.Using == "" {
+		defn.Using = c.MemoryOptimized
+	}
+	return defn
+}
+
+// RunLocal runs the scans against an in-process indexer, as per
+// cfg.InProcess, with concurrent writers if configured.
+func RunLocal(cfg *Config, statsW io.Writer) (*Result, error) {
+	t0 := time.Now()
+	ip := cfg.InProcess
+
+	setLocalDefaults(cfg)
+
+	storageDir := ip.StorageDir
+	if storageDir == "" {
+		dir, err := ioutil.TempDir("", "cbindexperf")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		storageDir = dir
+	}
+
+	config := c.SystemConfig.SectionConfig("indexer.", true)
+	config.SetValue("scanPort", strconv.Itoa(ip.ScanPort))
+	config.SetValue("storage_dir", storageDir)
+
+	bench, err := indexer.NewBenchIndexer(config, ip.SnapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	defer bench.Close()
+
+	buckets := make(map[uint64]string)
+	primary := make(map[uint64]bool)
+	for i, index := range ip.Indexes {
+		defn := localIndexDefn(i, index, ip.Docs.Bucket)
+		if _, err := bench.CreateIndex(defn); err != nil {
+			return nil, fmt.Errorf("Create index %v failed: %v", defn.Name, err)
+		}
+		buckets[uint64(defn.DefnId)] = defn.Bucket
+		primary[uint64(defn.DefnId)] = defn.IsPrimary
+
+		for _, spec := range cfg.ScanSpecs {
+			if spec.Bucket == defn.Bucket && spec.Index == defn.Name {
+				spec.DefnId = uint64(defn.DefnId)
+			}
+		}
+	}
+
+	if err := loadDocs(bench, ip.Docs); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Loaded %d documents in %v\n", ip.Docs.NumDocs, time.Since(t0))
+
+	config = c.SystemConfig.SectionConfig("queryport.client.", true)
+	config.SetValue("settings.poolSize", int(cfg.Concurrency))
+	config.SetValue("readDeadline", 0)
+	config.SetValue("writeDeadline", 0)
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(ip.ScanPort))
+	clients := make([]Scanner, cfg.Clients)
+	for i := 0; i < cfg.Clients; i++ {
+		sc, err := qclient.NewGsiScanClient(addr, config)
+		if err != nil {
+			return nil, err
+		}
+
+		defer sc.Close()
+		clients[i] = &localClient{
+			sc:      sc,
+			bench:   bench,
+			buckets: buckets,
+			primary: primary,
+		}
+	}
+
+	var writeResult *WriteResult
+	var wg sync.WaitGroup
+	stopch := make(chan bool)
+	if ip.Writers > 0 && ip.Docs.NumDocs > 0 {
+		writeResult = new(WriteResult)
+		writeResult.LatencyHisto.Init(cfg.LatencyBuckets, humanizeLatency)
+		for i := 0; i < ip.Writers; i++ {
+			wg.Add(1)
+			go Writer(bench, ip.Docs, ip.WriteRate, writeResult, stopch, &wg)
+		}
+	}
+
+	result := runScans(clients, cfg, statsW, t0)
+
+	close(stopch)
+	wg.Wait()
+	result.WriteResult = writeResult
+
+	return result, nil
+}
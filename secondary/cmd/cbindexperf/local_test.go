@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/tools/randdocs"
+)
+
+func writeTestConfig(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "cbindexperf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestParseInProcessConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"Concurrency": 2,
+		"ScanSpecs": [
+			{"Index": "idx_field", "Type": "All", "Limit": 10, "Repeat": 3},
+			{"Bucket": "other", "Index": "idx_other", "Type": "Count"}
+		],
+		"InProcess": {
+			"SnapshotInterval": 100,
+			"Indexes": [
+				{"name": "idx_field", "secExprs": ["field"]},
+				{"name": "idx_other", "bucket": "other", "isPrimary": true, "using": "forestdb", "defnId": 7}
+			],
+			"Docs": {"NumDocs": 1000, "FieldSize": 8},
+			"Writers": 2,
+			"WriteRate": 500
+		}
+	}`)
+	defer os.Remove(path)
+
+	cfg, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := cfg.InProcess
+	if ip == nil || ip.SnapshotInterval != 100 || ip.Writers != 2 || ip.WriteRate != 500 ||
+		ip.Docs.NumDocs != 1000 || ip.Docs.FieldSize != 8 || len(ip.Indexes) != 2 {
+		t.Fatalf("unexpected in-process config %+v", ip)
+	}
+	if len(cfg.ScanSpecs) != 2 || cfg.ScanSpecs[0].Limit != 10 || cfg.ScanSpecs[0].Repeat != 3 {
+		t.Fatalf("unexpected scan specs %+v", cfg.ScanSpecs)
+	}
+
+	setLocalDefaults(cfg)
+	if cfg.Clients != 1 || len(cfg.LatencyBuckets) == 0 || ip.ScanPort != defaultScanPort ||
+		ip.Docs.Bucket != "default" || ip.Docs.Threads != 1 {
+		t.Errorf("unexpected defaults %+v %+v", cfg, ip)
+	}
+	if cfg.ScanSpecs[0].Bucket != "default" || cfg.ScanSpecs[1].Bucket != "other" {
+		t.Errorf("unexpected buckets of scan specs %v %v", cfg.ScanSpecs[0].Bucket, cfg.ScanSpecs[1].Bucket)
+	}
+
+	defn := localIndexDefn(0, ip.Indexes[0], ip.Docs.Bucket)
+	if defn.DefnId != 1 || defn.Bucket != "default" || defn.Using != c.MemoryOptimized ||
+		!reflect.DeepEqual(defn.SecExprs, []string{"field"}) {
+		t.Errorf("unexpected index %v", defn)
+	}
+	defn = localIndexDefn(1, ip.Indexes[1], ip.Docs.Bucket)
+	if defn.DefnId != 7 || defn.Bucket != "other" || defn.Using != c.ForestDB || !defn.IsPrimary {
+		t.Errorf("unexpected index %v", defn)
+	}
+	if ip.Indexes[0].DefnId != 0 || ip.Indexes[0].Bucket != "" {
+		t.Errorf("index of the config modified %v", ip.Indexes[0])
+	}
+}
+
+func TestPrimaryKey(t *testing.T) {
+	cases := []struct {
+		key    c.SecondaryKey
+		result []byte
+	}{
+		{nil, nil},
+		{c.SecondaryKey{"doc-1"}, []byte("doc-1")},
+		{c.SecondaryKey{10}, []byte("10")},
+	}
+
+	for _, tc := range cases {
+		if result := primaryKey(tc.key); !reflect.DeepEqual(result, tc.result) {
+			t.Errorf("primaryKey(%v) = %q, expected %q", tc.key, result, tc.result)
+		}
+	}
+}
+
+func TestRunLocal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts an in-process indexer")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	numDocs := 100
+	cfg := &Config{
+		Concurrency: 2,
+		ScanSpecs: []*ScanConfig{
+			{Index: "idx_field", Type: "All", Limit: 1000, Repeat: 2},
+			{Index: "idx_field", Type: "All", Limit: 1000, Repeat: 2, Consistency: true},
+		},
+		InProcess: &InProcessConfig{
+			ScanPort:         scanPort,
+			Indexes:          []*c.IndexDefn{{Name: "idx_field", SecExprs: []string{"`field`"}}},
+			Docs:             randdocs.Config{NumDocs: numDocs, FieldSize: 8, Threads: 2},
+			SnapshotInterval: 50,
+			Writers:          1,
+			WriteRate:        1000,
+		},
+	}
+
+	result, err := RunLocal(cfg, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writers update the loaded documents, every scan returns all of them
+	if len(result.ScanResults) != 2 {
+		t.Fatalf("unexpected results %+v", result.ScanResults)
+	}
+	for _, res := range result.ScanResults {
+		if res.ErrorCount != 0 || res.Rows != uint64(numDocs*3) {
+			t.Errorf("scan %v: %v rows %v errors, expected %v rows", res.Id, res.Rows, res.ErrorCount, numDocs*3)
+		}
+	}
+	if result.WriteResult == nil || result.WriteResult.ErrorCount != 0 {
+		t.Errorf("unexpected write result %+v", result.WriteResult)
+	}
+}
@@ -31,6 +31,9 @@ func main() {
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile := flag.String("memprofile", "", "write mem profile to file")
 	logLevel := flag.String("logLevel", "error", "Log Level")
+	replay := flag.String("replay", "", "Replay comma separated scan capture files")
+	replaySpeed := flag.Float64("replaySpeed", 1, "Replay speed, 0 is as fast as possible")
+	replayConcurrency := flag.Int("replayConcurrency", 100, "Maximum outstanding replay requests")
 
 	flag.Parse()
 
@@ -61,15 +64,37 @@ func main() {
 	}
 
 	runtime.GOMAXPROCS(*cpus)
-	up := strings.Split(*auth, ":")
-	_, err := cbauth.InternalRetryDefaultInit(*cluster, up[0], up[1])
-	if err != nil {
-		fmt.Printf("Failed to initialize cbauth: %s\n", err)
-		os.Exit(1)
+
+	cfg := new(Config)
+	if *replay == "" {
+		var err error
+		cfg, err = parseConfig(*config)
+		handleError(err)
 	}
 
-	cfg, err := parseConfig(*config)
-	handleError(err)
+	if cfg.InProcess == nil {
+		up := strings.Split(*auth, ":")
+		_, err := cbauth.InternalRetryDefaultInit(*cluster, up[0], up[1])
+		if err != nil {
+			fmt.Printf("Failed to initialize cbauth: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *replay != "" {
+		replayCfg := &ReplayConfig{
+			Files:       strings.Split(*replay, ","),
+			Speed:       *replaySpeed,
+			Concurrency: *replayConcurrency,
+		}
+		res, err := RunReplay(*cluster, replayCfg)
+		handleError(err)
+
+		printReplayResult(res)
+		os.Remove(*outfile)
+		handleError(writeReplayResult(res, *outfile))
+		return
+	}
 
 	var statsW io.Writer
 	if *statsfile != "" {
@@ -82,7 +107,13 @@ func main() {
 	}
 
 	t0 := time.Now()
-	res, err := RunCommands(*cluster, cfg, statsW)
+	var res *Result
+	var err error
+	if cfg.InProcess != nil {
+		res, err = RunLocal(cfg, statsW)
+	} else {
+		res, err = RunCommands(*cluster, cfg, statsW)
+	}
 	handleError(err)
 	dur := time.Now().Sub(t0)
 
@@ -97,6 +128,11 @@ func main() {
 
 	fmt.Printf("Throughput = %d rows/sec\n", rate)
 
+	if res.WriteResult != nil {
+		rate = int(float64(res.WriteResult.Mutations) / res.Duration)
+		fmt.Printf("Write Throughput = %d mutations/sec\n", rate)
+	}
+
 	os.Remove(*outfile)
 	err = writeResults(res, *outfile)
 	handleError(err)
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/couchbase/indexing/secondary/queryport"
+	qclient "github.com/couchbase/indexing/secondary/queryport/client"
+	"github.com/couchbase/indexing/secondary/stats"
+)
+
+// ReplayConfig for replaying requests captured by indexer queryport, see
+// indexer.settings.scan_capture.* settings.
+type ReplayConfig struct {
+	Files []string // capture files, in any order
+
+	// Speed scales the original inter-arrival time of requests, 2 replays
+	// twice as fast, 0 as fast as possible.
+	Speed float64
+
+	// Concurrency bounds the requests outstanding at a time.
+	Concurrency    int
+	ClientBootTime int
+	LatencyBuckets []int64
+}
+
+// LatencySummary of a set of latencies, in nanoseconds.
+type LatencySummary struct {
+	Mean int64
+	P50  int64
+	P90  int64
+	P99  int64
+	Max  int64
+}
+
+// ReplayLatency compares the captured and replayed latencies of requests
+// of a type on an index.
+type ReplayLatency struct {
+	Type          string
+	Bucket        string
+	Index         string
+	Requests      uint64
+	ErrorCount    uint64
+	Captured      LatencySummary
+	Replayed      LatencySummary
+	CapturedHisto stats.Histogram
+	ReplayedHisto stats.Histogram
+
+	mu       sync.Mutex
+	captured []int64
+	replayed []int64
+}
+
+type ReplayResult struct {
+	Requests   uint64
+	ErrorCount uint64
+	Skipped    uint64 // statistics requests, and requests on unknown indexes
+	Duplicates uint64 // partitioned requests captured on more than one node
+	Duration   float64
+	Speed      float64
+	Latencies  []*ReplayLatency
+}
+
+type replayIndex struct {
+	defnID  uint64
+	primary bool
+}
+
+// replayRequest is a captured request, decoded, with the index it is
+// replayed on.
+type replayRequest struct {
+	*queryport.CapturedRequest
+	req     interface{}
+	index   replayIndex
+	latency *ReplayLatency
+}
+
+func readCaptures(files []string) ([]*queryport.CapturedRequest, error) {
+	var captures []*queryport.CapturedRequest
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			r := new(queryport.CapturedRequest)
+			if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%v: %v", name, err)
+			}
+			captures = append(captures, r)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	sort.SliceStable(captures, func(i, j int) bool {
+		return captures[i].Time < captures[j].Time
+	})
+	return captures, nil
+}
+
+func replayValue(data []byte, primary bool) (interface{}, error) {
+	if primary {
+		return string(data), nil
+	}
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep large integers as captured
+	err := dec.Decode(&value)
+	return value, err
+}
+
+func replayKey(data []byte, primary bool) (c.SecondaryKey, error) {
+	if data == nil {
+		return nil, nil
+	} else if primary {
+		return c.SecondaryKey{string(data)}, nil
+	}
+	var key c.SecondaryKey
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&key)
+	return key, err
+}
+
+func replaySpan(span *protobuf.Span, primary bool) (low, high c.SecondaryKey,
+	equals []c.SecondaryKey, err error) {
+
+	for _, data := range span.GetEquals() {
+		key, err := replayKey(data, primary)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		equals = append(equals, key)
+	}
+	if low, err = replayKey(span.GetRange().GetLow(), primary); err != nil {
+		return nil, nil, nil, err
+	}
+	high, err = replayKey(span.GetRange().GetHigh(), primary)
+	return
+}
+
+func replayScans(scans []*protobuf.Scan, primary bool) (qclient.Scans, error) {
+	var err error
+
+	rscans := make(qclient.Scans, 0, len(scans))
+	for _, scan := range scans {
+		rscan := new(qclient.Scan)
+		for _, data := range scan.GetEquals() {
+			value, err := replayValue(data, primary)
+			if err != nil {
+				return nil, err
+			}
+			rscan.Seek = append(rscan.Seek, value)
+		}
+		for _, f := range scan.GetFilters() {
+			filter := &qclient.CompositeElementFilter{
+				Low:       c.MinUnbounded,
+				High:      c.MaxUnbounded,
+				Inclusion: qclient.Inclusion(f.GetInclusion()),
+			}
+			if f.Low != nil {
+				if filter.Low, err = replayValue(f.Low, primary); err != nil {
+					return nil, err
+				}
+			}
+			if f.High != nil {
+				if filter.High, err = replayValue(f.High, primary); err != nil {
+					return nil, err
+				}
+			}
+			if f.Pattern != nil {
+				filter.Pattern = string(f.Pattern)
+				filter.PatternType = c.PatternType(f.GetPatternType())
+			}
+			rscan.Filter = append(rscan.Filter, filter)
+		}
+		rscans = append(rscans, rscan)
+	}
+	return rscans, nil
+}
+
+func replayProjection(p *protobuf.IndexProjection) *qclient.IndexProjection {
+	if p == nil {
+		return nil
+	}
+	return &qclient.IndexProjection{
+		EntryKeys:  p.GetEntryKeys(),
+		PrimaryKey: p.GetPrimaryKey(),
+	}
+}
+
+func replayGroupAggr(g *protobuf.GroupAggr) *qclient.GroupAggr {
+	if g == nil {
+		return nil
+	}
+
+	groupAggr := &qclient.GroupAggr{
+		Name:               string(g.GetName()),
+		DependsOnIndexKeys: g.GetDependsOnIndexKeys(),
+	}
+	for _, key := range g.GetGroupKeys() {
+		groupAggr.Group = append(groupAggr.Group, &qclient.GroupKey{
+			EntryKeyId: key.GetEntryKeyId(),
+			KeyPos:     key.GetKeyPos(),
+			Expr:       string(key.GetExpr()),
+		})
+	}
+	for _, aggr := range g.GetAggrs() {
+		groupAggr.Aggrs = append(groupAggr.Aggrs, &qclient.Aggregate{
+			AggrFunc:   c.AggrFuncType(aggr.GetAggrFunc()),
+			EntryKeyId: aggr.GetEntryKeyId(),
+			KeyPos:     aggr.GetKeyPos(),
+			Expr:       string(aggr.GetExpr()),
+			Distinct:   aggr.GetDistinct(),
+		})
+	}
+	for _, name := range g.GetIndexKeyNames() {
+		groupAggr.IndexKeyNames = append(groupAggr.IndexKeyNames, string(name))
+	}
+	return groupAggr
+}
+
+func replayFilter(f *protobuf.IndexFilter) *qclient.IndexFilter {
+	if f == nil {
+		return nil
+	}
+
+	filter := &qclient.IndexFilter{
+		Expr:               string(f.GetExpr()),
+		DependsOnIndexKeys: f.GetDependsOnIndexKeys(),
+	}
+	for _, name := range f.GetIndexKeyNames() {
+		filter.IndexKeyNames = append(filter.IndexKeyNames, string(name))
+	}
+	return filter
+}
+
+// replayConsistency replays query consistency, whose vector is of the
+// captured cluster, as session consistency.
+func replayConsistency(cons uint32) c.Consistency {
+	switch c.Consistency(cons) {
+	case c.SessionConsistency, c.QueryConsistency:
+		return c.SessionConsistency
+	}
+	return c.AnyConsistency
+}
+
+// replayScan replays a scan as the GsiClient API that sent it, going by
+// the fields set in the request.
+func replayScan(client *qclient.GsiClient, requestId string, req *protobuf.ScanRequest,
+	index replayIndex, callb qclient.ResponseHandler) error {
+
+	defnID, primary := index.defnID, index.primary
+	cons := replayConsistency(req.GetCons())
+
+	if len(req.GetScans()) == 0 {
+		low, high, equals, err := replaySpan(req.GetSpan(), primary)
+		if err != nil {
+			return err
+		}
+		if len(equals) != 0 {
+			return client.Lookup(defnID, requestId, equals, req.GetDistinct(),
+				req.GetLimit(), cons, nil, callb)
+		}
+		inclusion := qclient.Inclusion(req.GetSpan().GetRange().GetInclusion())
+		return client.Range(defnID, requestId, low, high, inclusion,
+			req.GetDistinct(), req.GetLimit(), cons, nil, callb)
+	}
+
+	scans, err := replayScans(req.GetScans(), primary)
+	if err != nil {
+		return err
+	}
+
+	var indexOrder *qclient.IndexKeyOrder
+	if req.GetSorted() {
+		indexOrder = &qclient.IndexKeyOrder{}
+	}
+	projection := replayProjection(req.GetIndexprojection())
+	groupAggr := replayGroupAggr(req.GetGroupAggr())
+
+	if filter := replayFilter(req.GetFilter()); filter != nil {
+		return client.FilterScan3(defnID, requestId, scans, req.GetReverse(),
+			req.GetDistinct(), projection, req.GetOffset(), req.GetLimit(),
+			groupAggr, indexOrder, filter, cons, nil, callb)
+	}
+	return client.Scan3(defnID, requestId, scans, req.GetReverse(),
+		req.GetDistinct(), projection, req.GetOffset(), req.GetLimit(),
+		groupAggr, indexOrder, cons, nil, callb)
+}
+
+func replayCount(client *qclient.GsiClient, requestId string, req *protobuf.CountRequest,
+	index replayIndex) error {
+
+	defnID, primary := index.defnID, index.primary
+	cons := replayConsistency(req.GetCons())
+
+	if len(req.GetScans()) != 0 {
+		scans, err := replayScans(req.GetScans(), primary)
+		if err != nil {
+			return err
+		}
+		_, err = client.MultiScanCount(defnID, requestId, scans, req.GetDistinct(),
+			cons, nil)
+		return err
+	}
+
+	low, high, equals, err := replaySpan(req.GetSpan(), primary)
+	if err != nil {
+		return err
+	}
+	if len(equals) != 0 {
+		_, err = client.CountLookup(defnID, requestId, equals, cons, nil)
+		return err
+	}
+	inclusion := qclient.Inclusion(req.GetSpan().GetRange().GetInclusion())
+	_, err = client.CountRange(defnID, requestId, low, high, inclusion, cons, nil)
+	return err
+}
+
+func replay(client *qclient.GsiClient, r *replayRequest) error {
+	requestId := "replay-" + r.RequestId
+
+	var mu sync.Mutex
+	var resErr error
+	callb := func(res qclient.ResponseReader) bool {
+		if err := res.Error(); err != nil {
+			mu.Lock()
+			resErr = err
+			mu.Unlock()
+			return false
+		}
+		return true
+	}
+
+	switch req := r.req.(type) {
+	case *protobuf.ScanRequest:
+		if err := replayScan(client, requestId, req, r.index, callb); err != nil {
+			return err
+		}
+	case *protobuf.CountRequest:
+		return replayCount(client, requestId, req, r.index)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return resErr
+}
+
+func summarize(latencies []int64) (summary LatencySummary) {
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total int64
+	for _, lat := range latencies {
+		total += lat
+	}
+	percentile := func(p int) int64 {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+
+	summary.Mean = total / int64(len(latencies))
+	summary.P50 = percentile(50)
+	summary.P90 = percentile(90)
+	summary.P99 = percentile(99)
+	summary.Max = latencies[len(latencies)-1]
+	return
+}
+
+// RunReplay replays captured requests against the cluster, at the rate
+// they were captured scaled by cfg.Speed, comparing captured and replayed
+// latencies of each type of request on each index.
+func RunReplay(cluster string, cfg *ReplayConfig) (*ReplayResult, error) {
+	if len(cfg.LatencyBuckets) == 0 {
+		cfg.LatencyBuckets = defaultLatencyBuckets
+	}
+
+	if cfg.ClientBootTime == 0 {
+		cfg.ClientBootTime = clientBootTime
+	}
+
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 1
+	}
+
+	captures, err := readCaptures(cfg.Files)
+	if err != nil {
+		return nil, err
+	} else if len(captures) == 0 {
+		return nil, fmt.Errorf("no captured requests in %v", cfg.Files)
+	}
+
+	config := c.SystemConfig.SectionConfig("queryport.client.", true)
+	config.SetValue("settings.poolSize", cfg.Concurrency)
+	config.SetValue("readDeadline", 0)
+	config.SetValue("writeDeadline", 0)
+
+	client, err := qclient.NewGsiClient(cluster, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	time.Sleep(time.Second * time.Duration(cfg.ClientBootTime))
+	indexes, _, _, err := client.Refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]replayIndex)
+	byDefnID := make(map[uint64]replayIndex)
+	for _, index := range indexes {
+		defn := index.Definition
+		ri := replayIndex{defnID: uint64(defn.DefnId), primary: defn.IsPrimary}
+		byName[defn.Bucket+":"+defn.Name] = ri
+		byDefnID[uint64(defn.DefnId)] = ri
+	}
+
+	result := &ReplayResult{Speed: cfg.Speed}
+	latencies := make(map[string]*ReplayLatency)
+	seen := make(map[string]bool)
+
+	var requests []*replayRequest
+	for _, capture := range captures {
+		index, ok := byName[capture.Bucket+":"+capture.Index]
+		if !ok {
+			index, ok = byDefnID[capture.DefnId]
+		}
+		if !ok || capture.Type == "stats" {
+			result.Skipped++
+			continue
+		}
+
+		req, err := capture.Decode()
+		if err != nil {
+			return nil, fmt.Errorf("request %v: %v", capture.RequestId, err)
+		}
+
+		// GsiClient scatters a request on a partitioned index to all the
+		// nodes with its partitions, replay it once.
+		var partitioned bool
+		switch val := req.(type) {
+		case *protobuf.ScanRequest:
+			partitioned = len(val.GetPartitionIds()) != 0
+		case *protobuf.CountRequest:
+			partitioned = len(val.GetPartitionIds()) != 0
+		}
+		if partitioned && capture.RequestId != "" {
+			key := fmt.Sprintf("%v:%v:%v", capture.RequestId, capture.Type, capture.DefnId)
+			if seen[key] {
+				result.Duplicates++
+				continue
+			}
+			seen[key] = true
+		}
+
+		key := fmt.Sprintf("%v:%v:%v", capture.Type, capture.Bucket, capture.Index)
+		latency, ok := latencies[key]
+		if !ok {
+			latency = &ReplayLatency{
+				Type:   capture.Type,
+				Bucket: capture.Bucket,
+				Index:  capture.Index,
+			}
+			latency.CapturedHisto.Init(cfg.LatencyBuckets, humanizeLatency)
+			latency.ReplayedHisto.Init(cfg.LatencyBuckets, humanizeLatency)
+			latencies[key] = latency
+			result.Latencies = append(result.Latencies, latency)
+		}
+
+		requests = append(requests, &replayRequest{
+			CapturedRequest: capture,
+			req:             req,
+			index:           index,
+			latency:         latency,
+		})
+	}
+
+	fmt.Printf("Replaying %d requests ...\n", len(requests))
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, cfg.Concurrency)
+	t0 := time.Now()
+	for _, r := range requests {
+		if cfg.Speed > 0 {
+			due := time.Duration(float64(r.Time-requests[0].Time) / cfg.Speed)
+			if wait := due - time.Since(t0); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		sem <- true
+		wg.Add(1)
+		go func(r *replayRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			startTime := time.Now()
+			err := replay(client, r)
+			dur := time.Since(startTime).Nanoseconds()
+
+			latency := r.latency
+			atomic.AddUint64(&result.Requests, 1)
+			atomic.AddUint64(&latency.Requests, 1)
+			if err != nil {
+				fmt.Printf("REQ:%v replay error occured: %v\n", r.RequestId, err)
+				atomic.AddUint64(&result.ErrorCount, 1)
+				atomic.AddUint64(&latency.ErrorCount, 1)
+				return
+			}
+
+			latency.CapturedHisto.Add(r.Elapsed)
+			latency.ReplayedHisto.Add(dur)
+			latency.mu.Lock()
+			latency.captured = append(latency.captured, r.Elapsed)
+			latency.replayed = append(latency.replayed, dur)
+			latency.mu.Unlock()
+		}(r)
+	}
+	wg.Wait()
+	result.Duration = time.Since(t0).Seconds()
+
+	for _, latency := range result.Latencies {
+		latency.Captured = summarize(latency.captured)
+		latency.Replayed = summarize(latency.replayed)
+	}
+	return result, nil
+}
+
+func printReplayResult(res *ReplayResult) {
+	fmt.Printf("Replayed %d requests in %.2fs, %d errors, %d skipped, %d duplicates\n",
+		res.Requests, res.Duration, res.ErrorCount, res.Skipped, res.Duplicates)
+
+	lat := humanizeLatency
+	for _, l := range res.Latencies {
+		fmt.Printf("%v %v:%v requests:%d\n", l.Type, l.Bucket, l.Index, l.Requests)
+		fmt.Printf("  captured mean:%v p50:%v p90:%v p99:%v max:%v\n", lat(l.Captured.Mean),
+			lat(l.Captured.P50), lat(l.Captured.P90), lat(l.Captured.P99), lat(l.Captured.Max))
+		fmt.Printf("  replayed mean:%v p50:%v p90:%v p99:%v max:%v\n", lat(l.Replayed.Mean),
+			lat(l.Replayed.P50), lat(l.Replayed.P90), lat(l.Replayed.P99), lat(l.Replayed.Max))
+	}
+}
+
+func writeReplayResult(r *ReplayResult, filepath string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, data, 0666)
+}
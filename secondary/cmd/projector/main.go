@@ -26,6 +26,7 @@ var options struct {
 	loglevel    string
 	diagDir     string
 	isIPv6      bool
+	replayDir   string
 }
 
 func argParse() string {
@@ -39,6 +40,7 @@ func argParse() string {
 	fset.StringVar(&options.auth, "auth", "", "Auth user and password")
 	fset.StringVar(&options.diagDir, "diagDir", "./", "Directory for writing projector diagnostic information")
 	fset.BoolVar(&options.isIPv6, "ipv6", false, "IPV6 cluster")
+	fset.StringVar(&options.replayDir, "replayDir", "", "replay mutations from files in this directory instead of KV")
 
 	logging.Infof("Parsing the args")
 
@@ -86,6 +88,7 @@ func main() {
 	config.SetValue("projector.clusterAddr", cluster)
 	config.SetValue("projector.adminport.listenAddr", options.adminport)
 	config.SetValue("projector.diagnostics_dir", options.diagDir)
+	config.SetValue("projector.dcp.replayDir", options.replayDir)
 
 	if err := os.MkdirAll(options.diagDir, 0755); err != nil {
 		c.CrashOnError(err)
@@ -46,6 +46,9 @@ var ErrorNumberType = errors.New("collatejson.numberType")
 // ErrorOutputLen means output buffer has insufficient length.
 var ErrorOutputLen = errors.New("collatejson.outputLen")
 
+// ErrorNotString means the value to decode is not a string.
+var ErrorNotString = errors.New("collatejson.notString")
+
 // Length is an internal type used for prefixing length
 // of arrays and properties.
 type Length int64
@@ -170,6 +173,17 @@ func (codec *Codec) Decode(code, text []byte) ([]byte, error) {
 	return text, err
 }
 
+// DecodeString decodes a collated string value into `text`, the raw
+// string without json quoting and escapes. `text` is expected to have
+// the capacity of input `code`.
+func (codec *Codec) DecodeString(code, text []byte) ([]byte, error) {
+	if len(code) == 0 || code[0] != TypeString {
+		return nil, ErrorNotString
+	}
+	text, _, err := suffixDecodeString(code[1:], text[:0])
+	return text, err
+}
+
 // local function that encodes basic json types to binary representation.
 // composite types recursively call this function.
 func (codec *Codec) json2code(val interface{}, code []byte) ([]byte, error) {
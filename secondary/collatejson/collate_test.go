@@ -128,6 +128,34 @@ func TestSpecialString(t *testing.T) {
 	}
 }
 
+func TestDecodeString(t *testing.T) {
+	jsoncodec := NewCodec(16)
+	text := make([]byte, 0, 1024)
+	for _, str := range []string{"", "abc", `a\nb`, "<a & b>", `caf\u00e9`, `a\u0000b`} {
+		code, err := jsoncodec.Encode([]byte(`"`+str+`"`), make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected string
+		if err := json.Unmarshal([]byte(`"`+str+`"`), &expected); err != nil {
+			t.Fatal(err)
+		}
+		if text, err = jsoncodec.DecodeString(code, text); err != nil {
+			t.Errorf("decode failed for %q: %v", str, err)
+		} else if string(text) != expected {
+			t.Errorf("expected %q, got %q", expected, text)
+		}
+	}
+
+	code, err := jsoncodec.Encode([]byte(`10`), make([]byte, 0, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jsoncodec.DecodeString(code, text); err != ErrorNotString {
+		t.Errorf("expected %v, got %v", ErrorNotString, err)
+	}
+}
+
 func TestCodecNoLength(t *testing.T) {
 	var samples = [][2]string{
 		{"[]", `\b\x00`},
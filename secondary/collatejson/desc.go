@@ -203,3 +203,11 @@ func (codec *Codec) extractEncodedField(code []byte, fieldPos int) ([]byte, []by
 	}
 	return datum, remaining, err
 }
+
+//ExtractEncodedField returns the encoded datum of the field at
+//fieldPos (starting from 1) in an encoded array. The returned slice
+//shares the underlying buffer with code.
+func (codec *Codec) ExtractEncodedField(code []byte, fieldPos int) ([]byte, error) {
+	field, _, err := codec.extractEncodedField(code, fieldPos)
+	return field, err
+}
@@ -149,6 +149,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.evalBatchSize": ConfigValue{
+		64,
+		"maximum number of queued mutations evaluated by a vbucket worker " +
+			"in a batch, changing this value does not affect existing feeds.",
+		64,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.feedChanSize": ConfigValue{
 		100,
 		"channel size for feed's control path, " +
@@ -180,6 +188,31 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.backfillThrottle.topicPrefix": ConfigValue{
+		"INIT_STREAM_TOPIC",
+		"topics with this prefix are throttled as backfill topics, " +
+			"changing this value does not affect existing feeds.",
+		"INIT_STREAM_TOPIC",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.backfillThrottle.cpuHighMark": ConfigValue{
+		0.9,
+		"fraction of cpu capacity used by projector at which backfill " +
+			"topics are fully throttled, throttling starts at 3/4 of " +
+			"this mark. Use 0 to disable backfill throttling.",
+		0.9,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.backfillThrottle.maxEventDelay": ConfigValue{
+		100,
+		"delay, in microseconds, for each DCP event of backfill topics " +
+			"when fully throttled, delay is proportional to cpu pressure.",
+		100,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.kvstatTick": ConfigValue{
 		5 * 60 * 1000, // 5 minutes
 		"tick, in milliseconds, to log kvdata statistics",
@@ -269,6 +302,32 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.dcp.compression": ConfigValue{
+		false,
+		"negotiate snappy compressed document values with DCP producer, " +
+			"does not affect existing feeds.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.deletedUserXattrs": ConfigValue{
+		false,
+		"request user extended attributes and delete time of deleted " +
+			"documents from DCP producer, needs server support, " +
+			"does not affect existing feeds.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.replayDir": ConfigValue{
+		"",
+		"replay mutations from <replayDir>/<bucket>.jsonl or " +
+			"<replayDir>/<bucket>.dcp instead of streaming them from KV, " +
+			"meant for testing and backfill, does not affect existing feeds.",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
 	// projector adminport parameters
 	"projector.adminport.name": ConfigValue{
 		"projector.adminport",
@@ -323,6 +382,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.dataport.compression": ConfigValue{
+		false,
+		"snappy compress mutation packets sent to downstream indexer, " +
+			"does not affect existing feeds.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.dataport.keyChanSize": ConfigValue{
 		100000,
 		"channel size of dataport endpoints data input, " +
@@ -587,6 +654,30 @@ var SystemConfig = Config{
 		false,    // mutable
 		false,    // case-insensitive
 	},
+	"queryport.client.settings.backfillEncryption": ConfigValue{
+		false,
+		"encrypt rows spilled to backfill files with an ephemeral key " +
+			"generated for each request.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"queryport.client.scan.flowControl.rows": ConfigValue{
+		0,
+		"window of rows buffered by client for a scan stream, indexer stops " +
+			"sending rows until client grants credits. 0 disables.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"queryport.client.scan.flowControl.bytes": ConfigValue{
+		0,
+		"window of bytes buffered by client for a scan stream, indexer stops " +
+			"sending rows until client grants credits. 0 disables.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"queryport.client.scanLagPercent": ConfigValue{
 		0.2,
 		"allowed threshold on mutation lag from fastest replica during scan, " +
@@ -1299,6 +1390,57 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.build.throttle.enabled": ConfigValue{
+		true,
+		"Throttle INIT_STREAM of initial index builds when indexer is " +
+			"under memory, mutation queue or cpu pressure. " +
+			"MAINT_STREAM is never throttled.",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.build.throttle.interval": ConfigValue{
+		1000,
+		"Interval, in milliseconds, at which timekeeper recomputes the " +
+			"build throttle level, changing this value needs a restart.",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.build.throttle.memHighMark": ConfigValue{
+		0.9,
+		"Fraction of memory_quota used at which INIT_STREAM is fully " +
+			"throttled, throttling starts at 3/4 of this mark.",
+		0.9,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.build.throttle.queueHighMark": ConfigValue{
+		500000,
+		"Number of mutations waiting to be flushed, across buckets and " +
+			"streams, at which INIT_STREAM is fully throttled, throttling " +
+			"starts at 3/4 of this mark. Use 0 to ignore mutation queues.",
+		500000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.build.throttle.cpuHighMark": ConfigValue{
+		0.9,
+		"Fraction of cpu capacity used by indexer at which INIT_STREAM is " +
+			"fully throttled, throttling starts at 3/4 of this mark. " +
+			"Use 0 to ignore cpu.",
+		0.9,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.build.throttle.maxMutationDelay": ConfigValue{
+		200,
+		"Delay, in microseconds, for each INIT_STREAM mutation when fully " +
+			"throttled, delay is proportional to the throttle level.",
+		200,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.pause_if_memory_full": ConfigValue{
 		true,
 		"Indexer goes to Paused when memory_quota is exhausted(moi only)",
@@ -1442,6 +1584,38 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.compaction.policies": ConfigValue{
+		"",
+		"Per index compaction policies, JSON object keyed by bucket:index or bucket. " +
+			"Each policy has a mode (full, circular, time, size) and optional " +
+			"min_size, min_frag, period (minutes) and max_stale_size (bytes)",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.compaction.io_budget": ConfigValue{
+		uint64(0),
+		"Total size in MB of index files that can be compacted concurrently, " +
+			"0 compacts one index at a time",
+		uint64(0),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.compaction.defer_scan_rate": ConfigValue{
+		0,
+		"Defer compaction of an index while its scan rate (rows/sec) is at least " +
+			"this value, 0 disables",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.compaction.max_defer": ConfigValue{
+		60,
+		"Maximum time in minutes compaction of an index is deferred on scan rate",
+		60,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.persisted_snapshot.interval": ConfigValue{
 		uint64(5000), // keep in sync with index_settings_manager.erl
 		"Persisted snapshotting interval in milliseconds",
@@ -1514,6 +1688,42 @@ var SystemConfig = Config{
 		true,  // immutable
 		false, // case-insensitive
 	},
+	"indexer.settings.scan_capture.enable": ConfigValue{
+		false,
+		"Record incoming scan, count and statistics requests in capture files " +
+			"for replay by cbindexperf",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.scan_capture.dir": ConfigValue{
+		"",
+		"Directory for capture files, defaults to scan_capture under storage_dir",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.scan_capture.max_file_size": ConfigValue{
+		100,
+		"Size in MB at which the capture file is rotated",
+		100,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.scan_capture.max_files": ConfigValue{
+		5,
+		"Number of rotated capture files to keep",
+		5,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.scan_capture.redact_keys": ConfigValue{
+		false,
+		"Redact key values in captured requests, keeping their type and length",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.max_array_seckey_size": ConfigValue{
 		10240,
 		"Maximum size of secondary index key size for array index",
@@ -1535,6 +1745,28 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.prefix_compression.enable": ConfigValue{
+		false,
+		"Prefix compress the leading key field of secondary index entries " +
+			"(memdb entries of non-array indexes, forestdb back index entries)",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.prefix_compression.min_prefix_len": ConfigValue{
+		8,
+		"Minimum encoded length of the leading key field to be prefix compressed",
+		8,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.prefix_compression.max_dict_entries": ConfigValue{
+		65536,
+		"Maximum number of distinct prefixes in the dictionary of an index slice",
+		65536,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.send_buffer_size": ConfigValue{
 		1024,
 		"Buffer size for batching rows during scan result streaming",
@@ -1814,6 +2046,40 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.rebuild.dropDelay": ConfigValue{
+		10,
+		"wait time(in seconds) for scans on the old index instance to " +
+			"finish, after an online index rebuild has swapped scans to the " +
+			"new instance",
+		10,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.rebalance.peerTransfer.enable": ConfigValue{
+		false,
+		"copy persisted index files from the source indexer during rebalance, " +
+			"instead of rebuilding moved indexes from DCP. DCP rebuild is " +
+			"used as fallback if the transfer fails.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.rebalance.peerTransfer.rateLimit": ConfigValue{
+		50,
+		"max rate(in MB per second) at which a source indexer sends index " +
+			"files to its peers, 0 for no limit",
+		50,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.rebalance.peerTransfer.retries": ConfigValue{
+		3,
+		"number of times a file is downloaded again on error or checksum " +
+			"mismatch, before falling back to DCP rebuild",
+		3,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.storage_mode.disable_upgrade": ConfigValue{
 		false,
 		"Disable upgrading storage mode. This is checked on every indexer restart, " +
@@ -1830,6 +2096,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.build.max_concurrent": ConfigValue{
+		0,
+		"Maximum number of index instances built concurrently on a node, " +
+			"by background index build and build queue.  Use 0 for no limit other than batch size.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.build.background.disable": ConfigValue{
 		false,
 		"Disable background index build, except during upgrade",
@@ -1837,6 +2111,22 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.ddl_history.max_entries": ConfigValue{
+		10000,
+		"Maximum number of DDL history entries retained on an indexer node.  " +
+			"Oldest entries are removed first.  Use 0 for no limit on entries.",
+		10000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.ddl_history.max_age": ConfigValue{
+		90 * 24 * 3600,
+		"Maximum age, in seconds, of DDL history entries retained on an indexer node.  " +
+			"Use 0 for no limit on age.",
+		90 * 24 * 3600,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.scan.queue_size": ConfigValue{
 		100,
 		"When performing scan scattering in indexer, specify the queue size for the scatterer.",
@@ -1858,6 +2148,65 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.scan.resume.retainSnapshotTime": ConfigValue{
+		30,
+		"time (sec) to retain the snapshot of a resumable scan, so that next " +
+			"page can be scanned on the same snapshot. 0 to not retain snapshots.",
+		30,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.resume.maxRetainedSnapshots": ConfigValue{
+		256,
+		"maximum number of snapshots retained for resumable scans",
+		256,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.workload.enable": ConfigValue{
+		true,
+		"count scans by their shape, for index recommendations",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.workload.sampleInterval": ConfigValue{
+		10,
+		"count one scan out of this many, counts of shapes are scaled up accordingly",
+		10,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.flowControl.creditTimeout": ConfigValue{
+		60,
+		"time (sec) to wait for a flow controlled client to grant credits, " +
+			"scan is aborted and its snapshot released on timeout.",
+		60,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.session.maxTtl": ConfigValue{
+		600,
+		"maximum time (sec) a read session can pin index snapshots",
+		600,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.session.maxSessions": ConfigValue{
+		1024,
+		"maximum number of open read sessions",
+		1024,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.session.memQuota": ConfigValue{
+		uint64(256 * 1024 * 1024),
+		"memory (bytes) that can be held by snapshots pinned by read sessions, " +
+			"oldest sessions are expired when exceeded. 0 for no limit.",
+		uint64(256 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.planner.timeout": ConfigValue{
 		20,
 		"timeout (sec) on planner",
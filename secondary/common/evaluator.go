@@ -22,5 +22,18 @@ type Evaluator interface {
 
 	// TransformRoute will transform document consumable by
 	// downstream, returns data to be published to endpoints.
-	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte) ([]byte, error)
+	// `ctx` is shared by all evaluators of a bucket for the same
+	// mutation and can be nil.
+	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte, ctx EvaluatorContext) ([]byte, error)
+
+	// GetStatistics return evaluator statistics.
+	GetStatistics() map[string]interface{}
+}
+
+// EvaluatorContext is supplied by the caller of TransformRoute, to share
+// parsed document and evaluated expressions across evaluators of the
+// same mutation.
+type EvaluatorContext interface {
+	// Reset context before it is reused for another mutation.
+	Reset()
 }
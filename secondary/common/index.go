@@ -63,6 +63,33 @@ const (
 	SINGLE                 = "SINGLE"
 )
 
+// IndexPriority decides which memory optimized indexes are paused first
+// when they run out of memory.
+type IndexPriority string
+
+const (
+	INDEX_PRIORITY_LOW    IndexPriority = "low"
+	INDEX_PRIORITY_MEDIUM IndexPriority = "medium"
+	INDEX_PRIORITY_HIGH   IndexPriority = "high"
+)
+
+func (p IndexPriority) IsValid() bool {
+
+	switch p {
+	case "", INDEX_PRIORITY_LOW, INDEX_PRIORITY_MEDIUM, INDEX_PRIORITY_HIGH:
+		return true
+	}
+	return false
+}
+
+func (p IndexPriority) String() string {
+
+	if p == "" {
+		return string(INDEX_PRIORITY_MEDIUM)
+	}
+	return string(p)
+}
+
 type IndexState int
 
 const (
@@ -193,6 +220,16 @@ type IndexDefn struct {
 	PartitionKeys      []string `json:"partitionKeys,omitempty"`
 	RetainDeletedXATTR bool     `json:"retainDeletedXATTR,omitempty"`
 
+	// Precomputed group aggregates maintained along with the index
+	Aggregates []*IndexAggregate `json:"aggregates,omitempty"`
+
+	// Memory quota (bytes) and priority of memory optimized index
+	MemQuota uint64        `json:"memQuota,omitempty"`
+	Priority IndexPriority `json:"priority,omitempty"`
+
+	// User defined labels of the index, e.g. to select indexes on restore
+	Tags []string `json:"tags,omitempty"`
+
 	// Sizing info
 	NumDoc        uint64  `json:"numDoc,omitempty"`
 	SecKeySize    uint64  `json:"secKeySize,omitempty"`
@@ -211,6 +248,77 @@ type IndexDefn struct {
 	RealInstId    IndexInstId   `json:"realInstId,omitempty"`
 }
 
+// IndexAggregate is a group/aggregate table which is precomputed
+// and maintained by the indexer along with the index data
+type IndexAggregate struct {
+	Name  string         `json:"name,omitempty"`
+	Group []int32        `json:"group,omitempty"` //positions of group keys
+	Aggrs []AggregateKey `json:"aggrs,omitempty"`
+}
+
+// AggregateKey is an aggregate function over an index key position.
+// COUNT(*) is always maintained and need not be specified.
+type AggregateKey struct {
+	AggrFunc AggrFuncType `json:"aggrFunc"`
+	KeyPos   int32        `json:"keyPos"`
+}
+
+func (a IndexAggregate) String() string {
+	return fmt.Sprintf("Name: %v Group: %v Aggrs: %v", a.Name, a.Group, a.Aggrs)
+}
+
+func (a AggregateKey) String() string {
+	return fmt.Sprintf("%v(%v)", a.AggrFunc, a.KeyPos)
+}
+
+// Validate checks if the aggregate can be maintained for the given
+// index definition
+func (a *IndexAggregate) Validate(defn *IndexDefn) error {
+
+	if a.Name == "" {
+		return fmt.Errorf("Aggregate name is not specified")
+	}
+
+	if defn.IsPrimary || defn.IsArrayIndex {
+		return fmt.Errorf("Aggregates are not supported on primary or array index")
+	}
+
+	numKeys := int32(len(defn.SecExprs))
+	seen := make(map[int32]bool)
+	for _, pos := range a.Group {
+		if pos < 0 || pos >= numKeys {
+			return fmt.Errorf("Invalid group key position %v", pos)
+		}
+		if seen[pos] {
+			return fmt.Errorf("Duplicate group key position %v", pos)
+		}
+		seen[pos] = true
+	}
+
+	for _, ak := range a.Aggrs {
+		if ak.KeyPos < 0 || ak.KeyPos >= numKeys {
+			return fmt.Errorf("Invalid aggregate key position %v", ak.KeyPos)
+		}
+		switch ak.AggrFunc {
+		case AGG_MIN, AGG_MAX, AGG_SUM, AGG_COUNT, AGG_COUNTN:
+		default:
+			return fmt.Errorf("Unsupported aggregate function %v", ak.AggrFunc)
+		}
+	}
+
+	return nil
+}
+
+// FindAggregate returns the aggregate with the given name
+func (idx *IndexDefn) FindAggregate(name string) *IndexAggregate {
+	for _, a := range idx.Aggregates {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
 //IndexInst is an instance of an Index(aka replica)
 type IndexInst struct {
 	InstId         IndexInstId
@@ -227,6 +335,8 @@ type IndexInst struct {
 	StorageMode    string
 	OldStorageMode string
 	RealInstId     IndexInstId
+	Rebuild        bool //proxy rebuilding its real instance in its own files
+	Paused         bool //ingestion paused on memory quota
 }
 
 //IndexInstMap is a map from IndexInstanceId to IndexInstance
@@ -247,6 +357,15 @@ func (idx IndexDefn) String() string {
 	str += fmt.Sprintf("PartitionKeys: %v ", idx.PartitionKeys)
 	str += fmt.Sprintf("WhereExpr: %v ", logging.TagUD(idx.WhereExpr))
 	str += fmt.Sprintf("RetainDeletedXATTR: %v ", idx.RetainDeletedXATTR)
+	if len(idx.Aggregates) != 0 {
+		str += fmt.Sprintf("\n\t\tAggregates: %v ", idx.Aggregates)
+	}
+	if idx.MemQuota != 0 || idx.Priority != "" {
+		str += fmt.Sprintf("\n\t\tMemQuota: %v Priority: %v ", idx.MemQuota, idx.Priority)
+	}
+	if len(idx.Tags) != 0 {
+		str += fmt.Sprintf("\n\t\tTags: %v ", idx.Tags)
+	}
 	return str
 
 }
@@ -273,6 +392,10 @@ func (idx IndexDefn) Clone() *IndexDefn {
 		IsArrayIndex:       idx.IsArrayIndex,
 		NumReplica:         idx.NumReplica,
 		RetainDeletedXATTR: idx.RetainDeletedXATTR,
+		Aggregates:         idx.Aggregates,
+		MemQuota:           idx.MemQuota,
+		Priority:           idx.Priority,
+		Tags:               idx.Tags,
 		NumDoc:             idx.NumDoc,
 		SecKeySize:         idx.SecKeySize,
 		DocKeySize:         idx.DocKeySize,
@@ -307,6 +430,9 @@ func (idx IndexInst) String() string {
 	str += fmt.Sprintf("\tStream: %v\n", idx.Stream)
 	str += fmt.Sprintf("\tVersion: %v\n", idx.Version)
 	str += fmt.Sprintf("\tReplicaId: %v\n", idx.ReplicaId)
+	if idx.Paused {
+		str += fmt.Sprintf("\tPaused: %v\n", idx.Paused)
+	}
 	str += fmt.Sprintf("\tPartitionContainer: %v", idx.Pc)
 	return str
 
@@ -569,6 +695,57 @@ func IsEquivalentIndex(d1, d2 *IndexDefn) bool {
 	return true
 }
 
+//
+// IsPrefixIndex returns true if the keys of d1 are a prefix of the
+// keys of d2, so that d2 can serve the scans of d1.  Equivalent indexes
+// are prefix of each other.  An array index has an entry per array
+// element, it cannot serve the scans of an index that is not an array
+// index, nor the other way around.
+//
+func IsPrefixIndex(d1, d2 *IndexDefn) bool {
+
+	if d1.Bucket != d2.Bucket ||
+		d1.IsPrimary || d2.IsPrimary ||
+		d1.IsArrayIndex != d2.IsArrayIndex ||
+		d1.ExprType != d2.ExprType ||
+		d1.PartitionScheme != d2.PartitionScheme ||
+		d1.WhereExpr != d2.WhereExpr ||
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+
+		return false
+	}
+
+	if len(d1.SecExprs) > len(d2.SecExprs) {
+		return false
+	}
+
+	for i, s1 := range d1.SecExprs {
+		if s1 != d2.SecExprs[i] {
+			return false
+		}
+	}
+
+	if len(d1.PartitionKeys) != len(d2.PartitionKeys) {
+		return false
+	}
+
+	for i, s1 := range d1.PartitionKeys {
+		if s1 != d2.PartitionKeys[i] {
+			return false
+		}
+	}
+
+	for i := range d1.SecExprs {
+		desc1 := len(d1.Desc) > i && d1.Desc[i]
+		desc2 := len(d2.Desc) > i && d2.Desc[i]
+		if desc1 != desc2 {
+			return false
+		}
+	}
+
+	return true
+}
+
 //
 // IndexerError - Runtime Error between indexer and other modules
 //
@@ -609,6 +786,7 @@ type DDLRequestSource byte
 const (
 	DDLRequestSourceUser DDLRequestSource = iota
 	DDLRequestSourceRebalance
+	DDLRequestSourceRebuild
 )
 
 type MetadataRequestContext struct {
@@ -622,3 +800,7 @@ func NewRebalanceRequestContext() *MetadataRequestContext {
 func NewUserRequestContext() *MetadataRequestContext {
 	return &MetadataRequestContext{ReqSource: DDLRequestSourceUser}
 }
+
+func NewRebuildRequestContext() *MetadataRequestContext {
+	return &MetadataRequestContext{ReqSource: DDLRequestSourceRebuild}
+}
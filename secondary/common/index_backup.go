@@ -0,0 +1,65 @@
+// @copyright 2019 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// Backup of index data.
+//
+// Each indexer node copies the persisted snapshot of its index partitions
+// into <dir>/<nodeUUID>, on its local disk, and describes them in
+// <dir>/<nodeUUID>/manifest.json.
+
+const IndexBackupManifestName = "manifest.json"
+
+// IndexBackupFile is a file of a backed up index partition.
+type IndexBackupFile struct {
+	Name     string `json:"name"` // relative to partition path
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"` // crc32, Castagnoli
+}
+
+// IndexBackupPartition is the persisted snapshot of an index partition.
+type IndexBackupPartition struct {
+	InstId     IndexInstId       `json:"instId"`
+	PartnId    PartitionId       `json:"partnId"`
+	BucketUUID string            `json:"bucketUUID"`
+	Path       string            `json:"path"` // relative to node backup dir
+	Ts         *TsVbuuid         `json:"ts,omitempty"`
+	Files      []IndexBackupFile `json:"files,omitempty"`
+}
+
+// IndexBackupManifest describes index data backed up by an indexer node.
+type IndexBackupManifest struct {
+	NodeUUID    string                 `json:"nodeUUID"`
+	StorageMode string                 `json:"storageMode"`
+	Dir         string                 `json:"dir"`
+	Time        int64                  `json:"time"` // unix nanoseconds
+	Partitions  []IndexBackupPartition `json:"partitions,omitempty"`
+}
+
+// IndexRestorePartition is a backed up partition to install, and the
+// indexer node holding its backup in Dir.
+type IndexRestorePartition struct {
+	NodeUUID  string               `json:"nodeUUID"`
+	Dir       string               `json:"dir"`
+	Partition IndexBackupPartition `json:"partition"`
+}
+
+// IndexRestoreRequest asks an indexer node to install backed up
+// partitions of an index instance, before the instance is created.
+type IndexRestoreRequest struct {
+	Defn        IndexDefn               `json:"defn"` // InstId is the new instance id
+	StorageMode string                  `json:"storageMode"`
+	Partitions  []IndexRestorePartition `json:"partitions"`
+}
@@ -0,0 +1,41 @@
+package common
+
+import "testing"
+
+func TestIsPrefixIndex(t *testing.T) {
+	newDefn := func(secExprs ...string) *IndexDefn {
+		return &IndexDefn{Bucket: "default", SecExprs: secExprs}
+	}
+	arrayDefn := func(secExprs ...string) *IndexDefn {
+		defn := newDefn(secExprs...)
+		defn.IsArrayIndex = true
+		return defn
+	}
+	descDefn := func(secExprs ...string) *IndexDefn {
+		defn := newDefn(secExprs...)
+		defn.Desc = []bool{true}
+		return defn
+	}
+
+	array := "(distinct (array `v` for `v` in `arr` end))"
+	testcases := []struct {
+		name   string
+		d1, d2 *IndexDefn
+		prefix bool
+	}{
+		{"prefix", newDefn("`a`"), newDefn("`a`", "`b`"), true},
+		{"equivalent", newDefn("`a`", "`b`"), newDefn("`a`", "`b`"), true},
+		{"longer", newDefn("`a`", "`b`"), newDefn("`a`"), false},
+		{"other key", newDefn("`b`"), newDefn("`a`", "`b`"), false},
+		{"desc", newDefn("`a`"), descDefn("`a`", "`b`"), false},
+		{"array superset", newDefn("`a`"), arrayDefn("`a`", array), false},
+		{"array subset", arrayDefn("`a`", array), newDefn("`a`", array, "`b`"), false},
+		{"array", arrayDefn("`a`", array), arrayDefn("`a`", array, "`b`"), true},
+	}
+
+	for _, tc := range testcases {
+		if prefix := IsPrefixIndex(tc.d1, tc.d2); prefix != tc.prefix {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.prefix, prefix)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"unicode/utf8"
+)
+
+// PatternType of a pattern in composite element filter
+type PatternType uint32
+
+const (
+	PATTERN_NONE  PatternType = iota
+	PATTERN_LIKE              // N1QL LIKE, % and _ wildcards, \ escape
+	PATTERN_REGEX             // regular expression matching whole value
+	PATTERN_INVALID
+)
+
+func (p PatternType) String() string {
+
+	switch p {
+	case PATTERN_NONE:
+		return "NONE"
+	case PATTERN_LIKE:
+		return "LIKE"
+	case PATTERN_REGEX:
+		return "REGEX"
+	default:
+		return "PATTERN_UNKNOWN"
+	}
+}
+
+var ErrInvalidPatternType = errors.New("Invalid Pattern Type")
+
+// CompilePattern compiles `pattern` of type `typ` to a regular expression
+// matching whole strings. Also returns the literal prefix every matching
+// string starts with, and whether the pattern matches only the prefix.
+func CompilePattern(typ PatternType, pattern string) (*regexp.Regexp, string, bool, error) {
+
+	var expr string
+	switch typ {
+	case PATTERN_LIKE:
+		expr = likeToRegex(pattern)
+	case PATTERN_REGEX:
+		expr = pattern
+	default:
+		return nil, "", false, ErrInvalidPatternType
+	}
+
+	re, err := regexp.Compile("(?s)^(?:" + expr + ")$")
+	if err != nil {
+		return nil, "", false, err
+	}
+	prefix, complete := re.LiteralPrefix()
+	return re, prefix, complete, nil
+}
+
+func likeToRegex(pattern string) string {
+
+	var expr bytes.Buffer
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			expr.WriteString(".*")
+		case r == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		expr.WriteString(regexp.QuoteMeta("\\"))
+	}
+	return expr.String()
+}
+
+// PrefixSuccessor returns the smallest string greater than all strings
+// starting with `prefix`, false if there is no such string.
+func PrefixSuccessor(prefix string) (string, bool) {
+
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		r := runes[i] + 1
+		if r >= 0xD800 && r <= 0xDFFF { // skip surrogates
+			r = 0xE000
+		}
+		if r <= utf8.MaxRune {
+			runes[i] = r
+			return string(runes[:i+1]), true
+		}
+	}
+	return "", false
+}
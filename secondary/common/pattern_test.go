@@ -0,0 +1,61 @@
+package common
+
+import "testing"
+
+func TestCompilePattern(t *testing.T) {
+	testcases := []struct {
+		typ      PatternType
+		pattern  string
+		value    string
+		prefix   string
+		complete bool
+		match    bool
+	}{
+		{PATTERN_LIKE, "abc%", "abcdef", "abc", false, true},
+		{PATTERN_LIKE, "abc%", "xabc", "abc", false, false},
+		{PATTERN_LIKE, "a_c", "abc", "a", false, true},
+		{PATTERN_LIKE, "a\\%c%", "a%cd", "a%c", false, true},
+		{PATTERN_LIKE, "a.c", "abc", "a.c", true, false},
+		{PATTERN_LIKE, "a\\%c", "a%c", "a%c", true, true},
+		{PATTERN_LIKE, "%x", "a\nx", "", false, true},
+		{PATTERN_REGEX, "ab+c", "abbc", "ab", false, true},
+		{PATTERN_REGEX, "ab+c", "xabbc", "ab", false, false},
+		{PATTERN_REGEX, "abc", "abc", "abc", true, true},
+	}
+
+	for _, tc := range testcases {
+		re, prefix, complete, err := CompilePattern(tc.typ, tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix != tc.prefix || complete != tc.complete {
+			t.Errorf("%v %q: expected prefix %q complete %v, got %q %v",
+				tc.typ, tc.pattern, tc.prefix, tc.complete, prefix, complete)
+		}
+		if re.MatchString(tc.value) != tc.match {
+			t.Errorf("%v %q: expected match %v for %q", tc.typ, tc.pattern, tc.match, tc.value)
+		}
+	}
+
+	if _, _, _, err := CompilePattern(PATTERN_REGEX, "ab("); err == nil {
+		t.Fatal("expected invalid regex to fail")
+	}
+	if _, _, _, err := CompilePattern(PATTERN_INVALID, "abc"); err != ErrInvalidPatternType {
+		t.Fatalf("expected %v, got %v", ErrInvalidPatternType, err)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	if s, ok := PrefixSuccessor("abc"); !ok || s != "abd" {
+		t.Fatalf("expected abd, got %q", s)
+	}
+	if s, ok := PrefixSuccessor("a\U0010FFFF"); !ok || s != "b" {
+		t.Fatalf("expected b, got %q", s)
+	}
+	if s, ok := PrefixSuccessor("\uD7FF"); !ok || s != "\uE000" {
+		t.Fatalf("expected surrogates to be skipped, got %q", s)
+	}
+	if _, ok := PrefixSuccessor("\U0010FFFF"); ok {
+		t.Fatal("expected no successor")
+	}
+}
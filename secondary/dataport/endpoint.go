@@ -89,8 +89,10 @@ func NewRouterEndpoint(
 	}
 	endpoint.ch = make(chan []interface{}, endpoint.keyChSize)
 	endpoint.conn = conn
-	// TODO: add configuration params for transport flags.
 	flags := transport.TransportFlag(0).SetProtobuf()
+	if cv, ok := config["compression"]; ok && cv.Bool() {
+		flags = flags.SetSnappy()
+	}
 	maxPayload := config["maxPayload"].Int()
 	endpoint.pkt = transport.NewTransportPacket(maxPayload, flags)
 	endpoint.pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
@@ -137,7 +139,7 @@ func (endpoint *RouterEndpoint) ResetConfig(config c.Config) error {
 	return err
 }
 
-// Send KeyVersions to other end, asynchronous call.
+// Send KeyVersions, or a batch of them, to other end, asynchronous call.
 // Asynchronous call. Return ErrorChannelFull that can be used by caller.
 func (endpoint *RouterEndpoint) Send(data interface{}) error {
 	cmd := []interface{}{endpCmdSend, data}
@@ -247,19 +249,26 @@ loop:
 				respch <- []interface{}{true}
 
 			case endpCmdSend:
-				data, ok := msg[1].(*c.DataportKeyVersions)
-				if !ok {
+				var batch []*c.DataportKeyVersions
+				switch data := msg[1].(type) {
+				case *c.DataportKeyVersions:
+					batch = []*c.DataportKeyVersions{data}
+				case []*c.DataportKeyVersions: // batch of mutations
+					batch = data
+				default:
 					panic(fmt.Errorf("invalid data type %T\n", msg[1]))
 				}
 
-				kv := data.Kv
-				buffers.addKeyVersions(
-					data.Bucket, data.Vbno, data.Vbuuid, kv, endpoint)
-				logging.Tracef("%v added %v keyversions <%v:%v:%v> to %q\n",
-					endpoint.logPrefix, kv.Length(), data.Vbno, kv.Seqno,
-					kv.Commands, buffers.raddr)
+				for _, data := range batch {
+					kv := data.Kv
+					buffers.addKeyVersions(
+						data.Bucket, data.Vbno, data.Vbuuid, kv, endpoint)
+					logging.Tracef("%v added %v keyversions <%v:%v:%v> to %q\n",
+						endpoint.logPrefix, kv.Length(), data.Vbno, kv.Seqno,
+						kv.Commands, buffers.raddr)
 
-				messageCount++ // count queued up mutations.
+					messageCount++ // count queued up mutations.
+				}
 				if messageCount > endpoint.bufferSize {
 					if err := flushBuffers(); err != nil {
 						break loop
@@ -147,10 +147,16 @@ func TestLoopback(t *testing.T) {
 		nVbs, nMuts, nIndexes := maxvbuckets, 5, 5
 		dkvs := dataKeyVersions("default0", seqno, nVbs, nMuts, nIndexes)
 		dkvs = append(dkvs, dataKeyVersions("default1", seqno, nVbs, nMuts, nIndexes)...)
-		for _, dkv := range dkvs {
-			if err := endp.Send(dkv); err != nil {
+		if i%4 == 1 { // send as a batch
+			if err := endp.Send(dkvs); err != nil {
 				t.Fatal(err)
 			}
+		} else {
+			for _, dkv := range dkvs {
+				if err := endp.Send(dkv); err != nil {
+					t.Fatal(err)
+				}
+			}
 		}
 		seqno += nMuts
 
@@ -37,6 +37,34 @@ func TestPktKeyVersions(t *testing.T) {
 	}
 }
 
+func TestPktKeyVersionsSnappy(t *testing.T) {
+	seqno, nVbs, nMuts, nIndexes := 1, 20, 5, 5
+	vbsRef := constructVbKeyVersions("default", seqno, nVbs, nMuts, nIndexes)
+	tc := newTestConnection()
+	tc.reset()
+	flags := transport.TransportFlag(0).SetProtobuf().SetSnappy()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+	pkt.SetDecoder(transport.EncodingProtobuf, protobufDecode)
+
+	if err := pkt.Send(tc, vbsRef); err != nil { // Send reference
+		t.Fatal(err)
+	}
+	if payload, err := pkt.Receive(tc); err != nil { // Receive reference
+		t.Fatal(err)
+	} else { // compare both
+		vbs := protobuf2VbKeyVersions(payload.([]*protobuf.VbKeyVersions))
+		if len(vbsRef) != len(vbs) {
+			t.Fatal("Mismatch in length")
+		}
+		for i, vb := range vbs {
+			if vb.Equal(vbsRef[i]) == false {
+				t.Fatal("Mismatch in VbKeyVersions")
+			}
+		}
+	}
+}
+
 func TestPktVbmap(t *testing.T) {
 	vbmapRef := &c.VbConnectionMap{
 		Bucket:   "default",
@@ -15,6 +15,7 @@ import (
 	"github.com/couchbase/indexing/secondary/common/json"
 	"github.com/couchbase/indexing/secondary/dcp/transport"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/golang/snappy"
 )
 
 const dcpMutationExtraLen = 16
@@ -22,9 +23,15 @@ const bufferAckThreshold = 0.2
 const opaqueOpen = 0xBEAF0001
 const opaqueFailover = 0xDEADBEEF
 const opaqueGetseqno = 0xDEADBEEF
+const opaqueHello = 0xBEAF0002
 const openConnFlag = uint32(0x1)
 const includeXATTR = uint32(0x4)
+const includeDeleteTimes = uint32(0x20)
+const includeDeletedUserXATTR = uint32(0x100)
+const dcpDeletionV2ExtraLen = 21
+const dcpExpirationV2ExtraLen = 20
 const dcpJSON = uint8(0x1)
+const dcpSnappy = uint8(0x2)
 const dcpXATTR = uint8(0x4)
 
 // error codes
@@ -43,6 +50,11 @@ type DcpFeed struct {
 	name      string
 	outch     chan<- *DcpEvent      // Exported channel for receiving DCP events
 	vbstreams map[uint16]*DcpStream // vb->stream mapping
+	// snappy compression of document values
+	compression bool // requested via config
+	snappy      bool // negotiated with producer
+	// user xattrs and delete time of deleted documents, requested via config
+	deletedUserXattrs bool
 	// genserver
 	reqch     chan []interface{}
 	finch     chan bool
@@ -71,6 +83,12 @@ func NewDcpFeed(
 		logPrefix:  fmt.Sprintf("DCPT[%s]", name),
 		dcplatency: &Average{},
 	}
+	if val, ok := config["compression"]; ok && val != nil {
+		feed.compression = val.(bool)
+	}
+	if val, ok := config["deletedUserXattrs"]; ok && val != nil {
+		feed.deletedUserXattrs = val.(bool)
+	}
 
 	mc.Hijack()
 	feed.conn = mc
@@ -85,6 +103,12 @@ func (feed *DcpFeed) Name() string {
 	return feed.name
 }
 
+// IsSnappyEnabled return whether snappy compression of document values
+// was negotiated with the producer.
+func (feed *DcpFeed) IsSnappyEnabled() bool {
+	return feed.snappy
+}
+
 // DcpOpen to connect with a DCP producer.
 // Name: name of te DCP connection
 // sequence: sequence number for the connection
@@ -490,11 +514,66 @@ func (feed *DcpFeed) doDcpGetSeqnos(
 	return seqnos, nil
 }
 
+// negotiate snappy datatype with the producer, must be done before
+// opening the DCP connection. Producers that do not understand HELLO
+// or snappy will continue to send uncompressed values.
+func (feed *DcpFeed) doDcpHello(
+	name string, opaque uint16, rcvch chan []interface{}) error {
+
+	features := []transport.HelloFeature{
+		transport.FeatureXattr, transport.FeatureSnappy, transport.FeatureJSON,
+	}
+	rq := &transport.MCRequest{
+		Opcode: transport.HELLO,
+		Key:    []byte(name),
+		Opaque: opaqueHello,
+		Body:   make([]byte, 2*len(features)),
+	}
+	for i, feature := range features {
+		binary.BigEndian.PutUint16(rq.Body[2*i:], uint16(feature))
+	}
+
+	prefix := feed.logPrefix
+	if err := feed.conn.Transmit(rq); err != nil {
+		fmsg := "%v ##%x doDcpHello.Transmit(): %v"
+		logging.Errorf(fmsg, prefix, opaque, err)
+		return err
+	}
+	msg, ok := <-rcvch
+	if !ok {
+		logging.Errorf("%v ##%x doDcpHello.rcvch closed", prefix, opaque)
+		return ErrorConnection
+	}
+	pkt := msg[0].(*transport.MCRequest)
+	if pkt.Opcode != transport.HELLO {
+		logging.Errorf("%v ##%x unexpected #%v", prefix, opaque, pkt.Opcode)
+		return ErrorConnection
+	} else if status := transport.Status(pkt.VBucket); status != transport.SUCCESS {
+		fmsg := "%v ##%x doDcpHello response status %v, snappy disabled"
+		logging.Warnf(fmsg, prefix, opaque, status)
+		return nil
+	}
+
+	for body := pkt.Body; len(body) >= 2; body = body[2:] {
+		if transport.HelloFeature(binary.BigEndian.Uint16(body)) == transport.FeatureSnappy {
+			feed.snappy = true
+		}
+	}
+	logging.Infof("%v ##%x snappy negotiated: %v", prefix, opaque, feed.snappy)
+	return nil
+}
+
 func (feed *DcpFeed) doDcpOpen(
 	name string, sequence, flags, bufsize uint32,
 	opaque uint16,
 	rcvch chan []interface{}) error {
 
+	if feed.compression {
+		if err := feed.doDcpHello(name, opaque, rcvch); err != nil {
+			return err
+		}
+	}
+
 	rq := &transport.MCRequest{
 		Opcode: transport.DCP_OPEN,
 		Key:    []byte(name),
@@ -502,6 +581,9 @@ func (feed *DcpFeed) doDcpOpen(
 	}
 	rq.Extras = make([]byte, 8)
 	flags = flags | openConnFlag | includeXATTR
+	if feed.deletedUserXattrs {
+		flags = flags | includeDeleteTimes | includeDeletedUserXATTR
+	}
 	binary.BigEndian.PutUint32(rq.Extras[:4], sequence)
 	binary.BigEndian.PutUint32(rq.Extras[4:], flags) // we are consumer
 
@@ -832,6 +914,8 @@ type DcpEvent struct {
 	Expiry   uint32 // Item expiration time
 	LockTime uint32
 	Nru      byte
+	// deletion time of deletions and expirations, if requested
+	DeleteTime uint32
 	// snapshots
 	SnapstartSeq uint64 // start sequence number of this snapshot
 	SnapendSeq   uint64 // End sequence number of the snapshot
@@ -866,6 +950,20 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 	event.Key = make([]byte, len(rq.Key))
 	copy(event.Key, rq.Key)
 
+	// value, including extended attributes, is snappy compressed.
+	body := rq.Body
+	if (event.Datatype & dcpSnappy) != 0 {
+		event.Datatype &= ^dcpSnappy
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			arg1 := logging.TagStrUD(rq.Key)
+			logging.Errorf("Error decompressing value for %s: %v", arg1, err)
+			decoded = nil
+			event.Datatype &= ^(dcpXATTR | dcpJSON)
+		}
+		body = decoded
+	}
+
 	// 16 LSBits are used by client library to encode vbucket number.
 	// 16 MSBits are left for application to multiplex on opaque value.
 	event.Opaque = appOpaque(rq.Opaque)
@@ -882,9 +980,15 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 
 		case transport.DCP_DELETION:
 			event.RevSeqno = binary.BigEndian.Uint64(rq.Extras[8:])
+			if len(rq.Extras) >= dcpDeletionV2ExtraLen {
+				event.DeleteTime = binary.BigEndian.Uint32(rq.Extras[16:])
+			}
 
 		case transport.DCP_EXPIRATION:
 			event.RevSeqno = binary.BigEndian.Uint64(rq.Extras[8:])
+			if len(rq.Extras) >= dcpExpirationV2ExtraLen {
+				event.DeleteTime = binary.BigEndian.Uint32(rq.Extras[16:])
+			}
 		}
 
 	} else if len(rq.Extras) >= tapMutationExtraLen &&
@@ -896,9 +1000,10 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 	}
 
 	if (event.Opcode == transport.DCP_MUTATION ||
-		event.Opcode == transport.DCP_DELETION) && event.HasXATTR() {
-		xattrLen := int(binary.BigEndian.Uint32(rq.Body))
-		xattrData := rq.Body[4 : 4+xattrLen]
+		event.Opcode == transport.DCP_DELETION ||
+		event.Opcode == transport.DCP_EXPIRATION) && event.HasXATTR() {
+		xattrLen := int(binary.BigEndian.Uint32(body))
+		xattrData := body[4 : 4+xattrLen]
 		event.XATTR = make(map[string]interface{})
 		for len(xattrData) > 0 {
 			pairLen := binary.BigEndian.Uint32(xattrData[0:])
@@ -907,7 +1012,8 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 			xattrData = xattrData[pairLen:]
 			kvPair := bytes.Split(binaryPair, []byte{0x00})
 			key := string(kvPair[0])
-			var val map[string]interface{}
+			// system xattrs need not be JSON objects.
+			var val interface{}
 			if err := json.Unmarshal(kvPair[1], &val); err != nil {
 				arg1 := logging.TagUD(string(rq.Key))
 				logging.Errorf("Error parsing XATTR for %s: %v", arg1, err)
@@ -915,16 +1021,36 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 				event.XATTR[key] = val
 			}
 		}
-		event.Value = make([]byte, len(rq.Body)-(4+xattrLen))
-		copy(event.Value, rq.Body[4+xattrLen:])
+		event.Value = make([]byte, len(body)-(4+xattrLen))
+		copy(event.Value, body[4+xattrLen:])
 	} else {
-		event.Value = make([]byte, len(rq.Body))
-		copy(event.Value, rq.Body)
+		event.Value = make([]byte, len(body))
+		copy(event.Value, body)
 	}
 
 	return event
 }
 
+// DecodeDcpEvent construct a DcpEvent from a DCP packet, as sent by the
+// producer, for vbucket `vbno` and its `vbuuid`. Useful for replaying
+// captured DCP streams.
+func DecodeDcpEvent(
+	rq *transport.MCRequest, vbno uint16, vbuuid uint64) *DcpEvent {
+
+	event := newDcpEvent(rq, &DcpStream{Vbucket: vbno, Vbuuid: vbuuid})
+	if rq.Opcode == transport.DCP_SNAPSHOT && len(rq.Extras) >= 20 {
+		event.SnapstartSeq = binary.BigEndian.Uint64(rq.Extras[0:8])
+		event.SnapendSeq = binary.BigEndian.Uint64(rq.Extras[8:16])
+		event.SnapshotType = binary.BigEndian.Uint32(rq.Extras[16:20])
+	}
+	return event
+}
+
+// DecodeFailoverLog from the body of a stream-request response.
+func DecodeFailoverLog(body []byte) (*FailoverLog, error) {
+	return parseFailoverLog(body)
+}
+
 func (event *DcpEvent) IsJSON() bool {
 	return (event.Datatype & dcpJSON) != 0
 }
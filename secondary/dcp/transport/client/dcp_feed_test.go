@@ -0,0 +1,44 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+)
+
+func TestNewDcpEventDeleteTime(t *testing.T) {
+	stream := &DcpStream{Vbucket: 1, Vbuuid: 10}
+
+	// deletion v2: by_seqno, rev_seqno, delete_time, collection length.
+	extras := make([]byte, dcpDeletionV2ExtraLen)
+	binary.BigEndian.PutUint64(extras, 5)
+	binary.BigEndian.PutUint64(extras[8:], 2)
+	binary.BigEndian.PutUint32(extras[16:], 1000)
+	e := newDcpEvent(&transport.MCRequest{
+		Opcode: transport.DCP_DELETION, Key: []byte("k"), Extras: extras,
+	}, stream)
+	if e.Seqno != 5 || e.RevSeqno != 2 || e.DeleteTime != 1000 {
+		t.Errorf("unexpected deletion %+v", e)
+	}
+
+	// expiration v2: by_seqno, rev_seqno, delete_time.
+	extras = make([]byte, dcpExpirationV2ExtraLen)
+	binary.BigEndian.PutUint64(extras, 6)
+	binary.BigEndian.PutUint64(extras[8:], 3)
+	binary.BigEndian.PutUint32(extras[16:], 2000)
+	e = newDcpEvent(&transport.MCRequest{
+		Opcode: transport.DCP_EXPIRATION, Key: []byte("k"), Extras: extras,
+	}, stream)
+	if e.Seqno != 6 || e.RevSeqno != 3 || e.DeleteTime != 2000 {
+		t.Errorf("unexpected expiration %+v", e)
+	}
+
+	// v1 deletion carries no delete time.
+	e = newDcpEvent(&transport.MCRequest{
+		Opcode: transport.DCP_DELETION, Key: []byte("k"), Extras: extras[:18],
+	}, stream)
+	if e.Seqno != 6 || e.DeleteTime != 0 {
+		t.Errorf("unexpected v1 deletion %+v", e)
+	}
+}
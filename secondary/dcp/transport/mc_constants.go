@@ -84,11 +84,22 @@ const (
 	DCP_BUFFERACK   = CommandCode(0x5d) // DCP Buffer Acknowledgement
 	DCP_CONTROL     = CommandCode(0x5e) // Set flow control params
 
+	HELLO         = CommandCode(0x1f) // Negotiate connection features
 	SELECT_BUCKET = CommandCode(0x89) // Select bucket
 
 	OBSERVE = CommandCode(0x92)
 )
 
+// HelloFeature negotiated with HELLO command.
+type HelloFeature uint16
+
+const (
+	FeatureDatatype = HelloFeature(0x01)
+	FeatureXattr    = HelloFeature(0x06)
+	FeatureSnappy   = HelloFeature(0x0a)
+	FeatureJSON     = HelloFeature(0x0b)
+)
+
 // Status field for memcached response.
 type Status uint16
 
@@ -167,6 +178,7 @@ func init() {
 	CommandNames[RDECR] = "RDECR"
 	CommandNames[RDECRQ] = "RDECRQ"
 
+	CommandNames[HELLO] = "HELLO"
 	CommandNames[SASL_LIST_MECHS] = "SASL_LIST_MECHS"
 	CommandNames[SASL_AUTH] = "SASL_AUTH"
 	CommandNames[SASL_STEP] = "SASL_STEP"
@@ -0,0 +1,1339 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/collatejson"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/query/value"
+)
+
+// Precomputed aggregates of an index are maintained per slice in an
+// aggrTable.  Flusher applies every upsert and delete of the slice to the
+// table, retracting the previous contribution of the document.  Storage
+// manager publishes an immutable aggrSnapshot along with every slice
+// snapshot, which is used to serve the scans with matching GroupAggr.
+//
+// The index key of every document is kept in aggrDocs, a sorted slice
+// whose memory is accounted in the memory used by the index.  It is
+// written to a sidecar file in the slice directory along with every
+// persisted snapshot of the slice, and read back on restart if the file
+// is as of the latest persisted snapshot.
+//
+// A new table, or one discarded by rollback, is built in the background
+// from the next slice snapshot.  Mutations flushed while building are
+// logged and applied once the table is built.
+
+const aggrTableFile = "aggregates"
+
+// Build is abandoned if more mutations are flushed while building, and
+// retried from the next snapshot.
+const aggrTableMaxPending = 1 << 20
+
+const (
+	aggrTableEmpty    = iota //mutations are ignored
+	aggrTableBuilding        //mutations are logged
+	aggrTableReady
+)
+
+var errAggrTableFile = errors.New("Invalid aggregates file")
+
+type aggrTableKey struct {
+	instId  common.IndexInstId
+	partnId common.PartitionId
+	sliceId SliceId
+}
+
+type aggrTableRegistry struct {
+	mu     sync.RWMutex
+	tables map[aggrTableKey]*aggrTable
+	count  int32
+}
+
+var gAggrTables = &aggrTableRegistry{tables: make(map[aggrTableKey]*aggrTable)}
+
+type aggrTable struct {
+	mu      sync.Mutex
+	state   int
+	gen     uint64 //incremented when the table is discarded
+	path    string //sidecar file, empty if not persisted
+	writing bool   //sidecar file is being written
+
+	docs    *aggrDocs
+	pending []aggrMutation //flushed while building
+	states  []*aggrState
+	snap    *aggrSnapshot
+
+	buf, decbuf  []byte
+	cktmp, dktmp [][]byte
+}
+
+type aggrMutation struct {
+	docid []byte
+	key   []byte //nil for delete
+}
+
+// aggrDocs maps the docid of every document to its encoded index key.
+// Entries are kept in a slice sorted by docid, which is never modified
+// in place and can be written out while the table is updated.  Changes
+// are kept in a map till they are merged into a new slice.
+type aggrDocs struct {
+	sorted  []aggrDoc
+	changes map[string][]byte //nil key for deleted document
+	size    int64             //bytes of docids and keys
+}
+
+type aggrDoc struct {
+	docid string
+	key   []byte
+}
+
+// aggrState maintains the groups of an IndexAggregate
+type aggrState struct {
+	defn   *common.IndexAggregate
+	groups map[string]*aggrGroup
+	dirty  map[string]bool
+	//group positions in index key order
+	order []int
+
+	last map[string]*aggrGroupResult
+}
+
+type aggrGroup struct {
+	keys  [][]byte
+	count int64
+	accum []aggrAccum
+}
+
+type aggrAccum struct {
+	count int64 //non null values for COUNT, numbers for COUNTN and SUM
+	isum  int64
+	fsum  float64
+	vals  map[string]int64 //multiset of values for MIN and MAX
+}
+
+// aggrGroupResult is the published result of a group
+type aggrGroupResult struct {
+	keys   [][]byte      //encoded group keys, in order of IndexAggregate.Group
+	count  int64         //number of index entries in the group
+	values []interface{} //result of aggregates, in order of IndexAggregate.Aggrs
+}
+
+// aggrSnapshot is the immutable state of all aggregates of a slice
+type aggrSnapshot struct {
+	tables map[string]*aggrTableSnapshot
+}
+
+type aggrTableSnapshot struct {
+	defn   *common.IndexAggregate
+	order  []int
+	groups map[string]*aggrGroupResult
+
+	once   sync.Once
+	sorted []*aggrGroupResult
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// registry
+//
+/////////////////////////////////////////////////////////////////////////
+
+// sync creates and drops the aggregate tables as per the index definitions
+func (r *aggrTableRegistry) sync(instMap common.IndexInstMap, partnMap IndexPartnMap) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	valid := make(map[aggrTableKey]bool)
+	for instId, inst := range instMap {
+		if inst.State == common.INDEX_STATE_DELETED || len(inst.Defn.Aggregates) == 0 ||
+			inst.Defn.IsPrimary || inst.Defn.IsArrayIndex {
+			continue
+		}
+
+		for partnId, partnInst := range partnMap[instId] {
+			for _, slice := range partnInst.Sc.GetAllSlices() {
+				key := aggrTableKey{instId: instId, partnId: partnId, sliceId: slice.Id()}
+				valid[key] = true
+
+				t, ok := r.tables[key]
+				if !ok {
+					t = newAggrTable(len(inst.Defn.SecExprs), filepath.Join(slice.Path(), aggrTableFile))
+					r.tables[key] = t
+					logging.Infof("AggrTable::sync Added aggregate table for Index %v "+
+						"PartitionId %v SliceId %v", instId, partnId, slice.Id())
+				}
+				t.setAggregates(inst.Defn.Aggregates)
+				if !ok {
+					t.load(key, slice)
+				}
+			}
+		}
+	}
+
+	for key, t := range r.tables {
+		if !valid[key] {
+			t.reset()
+			delete(r.tables, key)
+			logging.Infof("AggrTable::sync Removed aggregate table for Index %v "+
+				"PartitionId %v SliceId %v", key.instId, key.partnId, key.sliceId)
+		}
+	}
+
+	atomic.StoreInt32(&r.count, int32(len(r.tables)))
+}
+
+func (r *aggrTableRegistry) get(key aggrTableKey) *aggrTable {
+
+	if atomic.LoadInt32(&r.count) == 0 {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tables[key]
+}
+
+// upsert applies the index key of a document
+func (r *aggrTableRegistry) upsert(instId common.IndexInstId, partnId common.PartitionId,
+	sliceId SliceId, key, docid []byte) {
+
+	if t := r.get(aggrTableKey{instId, partnId, sliceId}); t != nil {
+		t.upsert(key, docid)
+	}
+}
+
+// delete retracts the index key of a document
+func (r *aggrTableRegistry) delete(instId common.IndexInstId, partnId common.PartitionId,
+	sliceId SliceId, docid []byte) {
+
+	if t := r.get(aggrTableKey{instId, partnId, sliceId}); t != nil {
+		t.delete(docid)
+	}
+}
+
+// reset discards the state of all tables of an index.  The tables are
+// built again from the next snapshot.
+func (r *aggrTableRegistry) reset(instId common.IndexInstId) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for key, t := range r.tables {
+		if key.instId == instId {
+			t.reset()
+		}
+	}
+}
+
+// memUsed returns the bytes used by the tables of an index partition
+func (r *aggrTableRegistry) memUsed(instId common.IndexInstId, partnId common.PartitionId) int64 {
+
+	if atomic.LoadInt32(&r.count) == 0 {
+		return 0
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var size int64
+	for key, t := range r.tables {
+		if key.instId == instId && key.partnId == partnId {
+			size += t.memUsed()
+		}
+	}
+	return size
+}
+
+// snapshot returns the aggregates of the slice as of the given slice
+// snapshot, nil if the table is not built yet.  It must be called when
+// no flush is in progress for the index.  If `persist` is true, snap is
+// a persisted snapshot and the table is written to its sidecar file.
+func (r *aggrTableRegistry) snapshot(instId common.IndexInstId, partnId common.PartitionId,
+	slice Slice, snap Snapshot, desc []bool, persist bool) *aggrSnapshot {
+
+	key := aggrTableKey{instId, partnId, slice.Id()}
+	t := r.get(key)
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case aggrTableEmpty:
+		t.build(key, slice, snap, desc)
+		return nil
+
+	case aggrTableBuilding:
+		return nil
+	}
+
+	if persist {
+		t.persist(key, snap.Timestamp())
+	}
+	return t.snapshot()
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// table
+//
+/////////////////////////////////////////////////////////////////////////
+
+func newAggrTable(numKeys int, path string) *aggrTable {
+	return &aggrTable{
+		path:  path,
+		docs:  newAggrDocs(),
+		cktmp: make([][]byte, numKeys),
+		dktmp: make([][]byte, numKeys),
+	}
+}
+
+// setAggregates adds and removes aggregates.  A new aggregate of a ready
+// table is computed from the documents of the table.
+func (t *aggrTable) setAggregates(defns []*common.IndexAggregate) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := len(defns) != len(t.states)
+	states := make([]*aggrState, 0, len(defns))
+
+	for i, defn := range defns {
+		var state *aggrState
+		for _, s := range t.states {
+			if reflect.DeepEqual(s.defn, defn) {
+				state = s
+				break
+			}
+		}
+
+		if state == nil {
+			state = newAggrState(defn)
+			if t.state == aggrTableReady {
+				t.docs.each(func(key []byte) {
+					t.applyState(state, key, 1)
+				})
+			}
+		}
+
+		if changed || t.states[i] != state {
+			changed = true
+		}
+		states = append(states, state)
+	}
+
+	if changed {
+		t.states = states
+		t.snap = nil
+	}
+}
+
+func (t *aggrTable) upsert(key, docid []byte) {
+
+	buf := make([]byte, 0, 3*len(key)+MAX_KEY_EXTRABYTES_LEN+collatejson.MinBufferSize)
+	entry, err := NewSecondaryIndexEntry(key, docid, false, 1, nil, buf)
+	if err != nil {
+		t.delete(docid)
+		return
+	}
+	newKey := []byte(entry[:entry.lenKey()])
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mutate(docid, newKey)
+}
+
+func (t *aggrTable) delete(docid []byte) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mutate(docid, nil)
+}
+
+// mutate applies or logs the index key of a document, nil key for
+// delete.  Caller must hold the mutex.
+func (t *aggrTable) mutate(docid, key []byte) {
+
+	switch t.state {
+	case aggrTableBuilding:
+		if len(t.pending) >= aggrTableMaxPending {
+			logging.Warnf("AggrTable::mutate Abandoned building aggregates, %v mutations "+
+				"flushed while building.  Retry from next snapshot.", len(t.pending))
+			t.clear()
+			return
+		}
+		docid = append([]byte(nil), docid...)
+		t.pending = append(t.pending, aggrMutation{docid: docid, key: key})
+
+	case aggrTableReady:
+		t.applyDoc(docid, key)
+	}
+}
+
+// applyDoc replaces the index key of a document, nil key for delete
+func (t *aggrTable) applyDoc(docid, key []byte) {
+
+	oldKey, ok := t.docs.get(docid)
+	if ok {
+		if bytes.Equal(oldKey, key) {
+			return
+		}
+		t.apply(oldKey, -1)
+	}
+
+	if key != nil {
+		t.docs.set(docid, key)
+		t.apply(key, 1)
+	} else if ok {
+		t.docs.set(docid, nil)
+	}
+}
+
+func (t *aggrTable) reset() {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clear()
+}
+
+// clear discards the state of the table and any build in progress
+func (t *aggrTable) clear() {
+
+	t.state = aggrTableEmpty
+	t.gen++
+	t.docs = newAggrDocs()
+	t.pending = nil
+	for i, s := range t.states {
+		t.states[i] = newAggrState(s.defn)
+	}
+	t.snap = nil
+}
+
+func (t *aggrTable) memUsed() int64 {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.docs.size
+}
+
+// build starts building the table from all entries of the slice
+// snapshot.  Caller must hold the mutex.
+func (t *aggrTable) build(key aggrTableKey, slice Slice, snap Snapshot, desc []bool) {
+
+	if err := snap.Open(); err != nil {
+		return
+	}
+
+	hasDesc := false
+	for _, d := range desc {
+		hasDesc = hasDesc || d
+	}
+
+	read := func() (*aggrDocs, error) {
+		defer snap.Close()
+
+		ctx := slice.GetReaderContext()
+		ctx.Init()
+		defer ctx.Done()
+
+		docs := newAggrDocs()
+		var docid []byte
+		fn := func(entry []byte) error {
+			e := secondaryIndexEntry(entry)
+			docid, _ = e.ReadDocId(docid[:0])
+
+			key := append([]byte(nil), entry[:e.lenKey()]...)
+			if hasDesc {
+				key = jsonEncoder.ReverseCollate(key, desc)
+			}
+			docs.set(docid, key)
+			return nil
+		}
+
+		if err := snap.All(ctx, fn); err != nil {
+			return nil, err
+		}
+		return docs, nil
+	}
+
+	t.start(key, "built", read)
+}
+
+// load starts reading the table from its sidecar file, if the file is
+// as of the latest persisted snapshot of the slice.
+func (t *aggrTable) load(key aggrTableKey, slice Slice) {
+
+	if _, err := os.Stat(t.path); err != nil {
+		return
+	}
+
+	var snapTs *common.TsVbuuid
+	if infos, err := slice.GetSnapshots(); err == nil {
+		if latest := NewSnapshotInfoContainer(infos).GetLatest(); latest != nil {
+			snapTs = latest.Timestamp()
+		}
+	}
+
+	read := func() (*aggrDocs, error) {
+		ts, docs, err := readAggrDocs(t.path)
+		if err != nil {
+			return nil, err
+		}
+		if snapTs == nil || len(snapTs.Vbuuids) != len(ts.Vbuuids) ||
+			len(snapTs.Snapshots) != len(ts.Snapshots) || !snapTs.Equal(ts) {
+			return nil, errors.New("aggregates file is not as of latest snapshot")
+		}
+		return docs, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.start(key, "loaded", read)
+}
+
+// start reading the documents of the table in the background, the table
+// is ready once they are applied along with the mutations flushed in the
+// meantime.  Caller must hold the mutex.
+func (t *aggrTable) start(key aggrTableKey, how string, read func() (*aggrDocs, error)) {
+
+	t.state = aggrTableBuilding
+	t.pending = nil
+	gen := t.gen
+
+	go func() {
+		start := time.Now()
+		docs, err := read()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if gen != t.gen {
+			return
+		}
+
+		if err != nil {
+			logging.Errorf("AggrTable::start Error reading aggregates for Index %v "+
+				"PartitionId %v SliceId %v. Error %v", key.instId, key.partnId, key.sliceId, err)
+			t.clear()
+			return
+		}
+
+		t.install(docs)
+		logging.Infof("AggrTable::start Aggregates %v for Index %v PartitionId %v "+
+			"SliceId %v Docs %v Elapsed %v", how, key.instId, key.partnId, key.sliceId,
+			t.docs.len(), time.Since(start))
+	}()
+}
+
+// install the documents read by a build and apply the mutations
+// flushed while building.  Caller must hold the mutex.
+func (t *aggrTable) install(docs *aggrDocs) {
+
+	docs.merge()
+	t.docs = docs
+	for i, s := range t.states {
+		t.states[i] = newAggrState(s.defn)
+	}
+	docs.each(func(key []byte) {
+		t.apply(key, 1)
+	})
+
+	for _, m := range t.pending {
+		t.applyDoc(m.docid, m.key)
+	}
+	t.pending = nil
+	t.state = aggrTableReady
+	t.snap = nil
+}
+
+// persist writes the documents of the table, as of snapshot `ts`, to the
+// sidecar file in the background.  Caller must hold the mutex.
+func (t *aggrTable) persist(key aggrTableKey, ts *common.TsVbuuid) {
+
+	if t.path == "" || t.writing || ts == nil {
+		return
+	}
+
+	t.docs.merge()
+	sorted, ts := t.docs.sorted, ts.Copy()
+	t.writing = true
+
+	go func() {
+		err := writeAggrDocs(t.path, ts, sorted)
+
+		t.mu.Lock()
+		t.writing = false
+		t.mu.Unlock()
+
+		if err != nil {
+			logging.Errorf("AggrTable::persist Error writing aggregates for Index %v "+
+				"PartitionId %v SliceId %v. Error %v", key.instId, key.partnId, key.sliceId, err)
+		}
+	}()
+}
+
+// apply adds (delta 1) or retracts (delta -1) an index key
+func (t *aggrTable) apply(key []byte, delta int64) {
+
+	for _, state := range t.states {
+		t.applyState(state, key, delta)
+	}
+}
+
+func (t *aggrTable) applyState(state *aggrState, key []byte, delta int64) {
+
+	if len(key)+1024 > cap(t.buf) {
+		t.buf = make([]byte, 0, len(key)+1024)
+		t.decbuf = make([]byte, len(key)+1024)
+	}
+
+	ck, dk, err := jsonEncoder.ExplodeArray2(key, t.buf[:0], t.decbuf, t.cktmp, t.dktmp)
+	if err != nil {
+		logging.Errorf("AggrTable::apply Error exploding key %v. Error %v", logging.TagUD(key), err)
+		return
+	}
+
+	state.apply(ck, dk, delta)
+}
+
+func (t *aggrTable) snapshot() *aggrSnapshot {
+
+	if t.docs.needsMerge() {
+		t.docs.merge()
+	}
+
+	changed := t.snap == nil
+	for _, state := range t.states {
+		if len(state.dirty) != 0 {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return t.snap
+	}
+
+	snap := &aggrSnapshot{tables: make(map[string]*aggrTableSnapshot)}
+	for _, state := range t.states {
+		snap.tables[state.defn.Name] = state.snapshot()
+	}
+	t.snap = snap
+	return snap
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// documents
+//
+/////////////////////////////////////////////////////////////////////////
+
+func newAggrDocs() *aggrDocs {
+	return &aggrDocs{changes: make(map[string][]byte)}
+}
+
+func (d *aggrDocs) find(docid []byte) ([]byte, bool) {
+
+	i := sort.Search(len(d.sorted), func(i int) bool {
+		return d.sorted[i].docid >= string(docid)
+	})
+	if i < len(d.sorted) && d.sorted[i].docid == string(docid) {
+		return d.sorted[i].key, true
+	}
+	return nil, false
+}
+
+func (d *aggrDocs) get(docid []byte) ([]byte, bool) {
+
+	if key, ok := d.changes[string(docid)]; ok {
+		return key, key != nil
+	}
+	return d.find(docid)
+}
+
+// set the index key of a document, nil key deletes the document
+func (d *aggrDocs) set(docid, key []byte) {
+
+	if oldKey, ok := d.get(docid); ok {
+		d.size -= int64(len(docid) + len(oldKey))
+	}
+	if key != nil {
+		d.size += int64(len(docid) + len(key))
+	}
+
+	if _, ok := d.find(docid); !ok && key == nil {
+		delete(d.changes, string(docid))
+		return
+	}
+	d.changes[string(docid)] = key
+}
+
+func (d *aggrDocs) len() int {
+	d.merge()
+	return len(d.sorted)
+}
+
+// needsMerge returns true if changes are large enough to be merged
+func (d *aggrDocs) needsMerge() bool {
+	return len(d.changes) > 1024 && len(d.changes) > len(d.sorted)/8
+}
+
+// merge changes into a new sorted slice
+func (d *aggrDocs) merge() {
+
+	if len(d.changes) == 0 {
+		return
+	}
+
+	docids := make([]string, 0, len(d.changes))
+	for docid := range d.changes {
+		docids = append(docids, docid)
+	}
+	sort.Strings(docids)
+
+	merged := make([]aggrDoc, 0, len(d.sorted)+len(docids))
+	i := 0
+	for _, docid := range docids {
+		for i < len(d.sorted) && d.sorted[i].docid < docid {
+			merged = append(merged, d.sorted[i])
+			i++
+		}
+		if i < len(d.sorted) && d.sorted[i].docid == docid {
+			i++
+		}
+		if key := d.changes[docid]; key != nil {
+			merged = append(merged, aggrDoc{docid: docid, key: key})
+		}
+	}
+	merged = append(merged, d.sorted[i:]...)
+
+	d.sorted = merged
+	d.changes = make(map[string][]byte)
+}
+
+func (d *aggrDocs) each(fn func(key []byte)) {
+
+	d.merge()
+	for _, doc := range d.sorted {
+		fn(doc.key)
+	}
+}
+
+// writeAggrDocs writes the documents as of snapshot `ts` to `path`.  File
+// has a header with the timestamp, followed by length prefixed docid and
+// key of every document, and the crc32 of all of it.
+func writeAggrDocs(path string, ts *common.TsVbuuid, sorted []aggrDoc) error {
+
+	header, err := json.Marshal(ts)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	var lenbuf [binary.MaxVarintLen64]byte
+	writeBytes := func(data []byte) {
+		n := binary.PutUvarint(lenbuf[:], uint64(len(data)))
+		buf.Write(lenbuf[:n])
+		buf.Write(data)
+	}
+
+	writeBytes(header)
+	n := binary.PutUvarint(lenbuf[:], uint64(len(sorted)))
+	buf.Write(lenbuf[:n])
+	for _, doc := range sorted {
+		writeBytes([]byte(doc.docid))
+		writeBytes(doc.key)
+	}
+	binary.BigEndian.PutUint32(lenbuf[:4], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(lenbuf[:4])
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readAggrDocs reads the documents and their snapshot timestamp written
+// by writeAggrDocs.
+func readAggrDocs(path string) (*common.TsVbuuid, *aggrDocs, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil, errAggrTableFile
+	}
+	crc := binary.BigEndian.Uint32(data[len(data)-4:])
+	data = data[:len(data)-4]
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, nil, errAggrTableFile
+	}
+
+	readBytes := func() ([]byte, error) {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, errAggrTableFile
+		}
+		b := data[n : n+int(l)]
+		data = data[n+int(l):]
+		return b, nil
+	}
+
+	header, err := readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	ts := &common.TsVbuuid{}
+	if err := json.Unmarshal(header, ts); err != nil {
+		return nil, nil, err
+	}
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, errAggrTableFile
+	}
+	data = data[n:]
+
+	docs := newAggrDocs()
+	docs.sorted = make([]aggrDoc, 0, count)
+	for i := uint64(0); i < count; i++ {
+		docid, err := readBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		docs.sorted = append(docs.sorted, aggrDoc{docid: string(docid), key: key})
+		docs.size += int64(len(docid) + len(key))
+	}
+	return ts, docs, nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// aggregate state
+//
+/////////////////////////////////////////////////////////////////////////
+
+func newAggrState(defn *common.IndexAggregate) *aggrState {
+
+	state := &aggrState{
+		defn:   defn,
+		groups: make(map[string]*aggrGroup),
+		dirty:  make(map[string]bool),
+		last:   make(map[string]*aggrGroupResult),
+	}
+
+	state.order = make([]int, len(defn.Group))
+	for i := range state.order {
+		state.order[i] = i
+	}
+	sort.Slice(state.order, func(i, j int) bool {
+		return defn.Group[state.order[i]] < defn.Group[state.order[j]]
+	})
+
+	return state
+}
+
+func (s *aggrState) apply(ck, dk [][]byte, delta int64) {
+
+	var gkey []byte
+	for _, i := range s.order {
+		gkey = append(gkey, ck[s.defn.Group[i]]...)
+	}
+
+	g, ok := s.groups[string(gkey)]
+	if !ok {
+		if delta < 0 {
+			return
+		}
+		g = &aggrGroup{
+			keys:  make([][]byte, len(s.defn.Group)),
+			accum: make([]aggrAccum, len(s.defn.Aggrs)),
+		}
+		for i, pos := range s.defn.Group {
+			g.keys[i] = append([]byte(nil), ck[pos]...)
+		}
+		s.groups[string(gkey)] = g
+	}
+
+	g.count += delta
+	for i, ak := range s.defn.Aggrs {
+		g.accum[i].apply(ak.AggrFunc, ck[ak.KeyPos], dk[ak.KeyPos], delta)
+	}
+
+	if g.count <= 0 {
+		delete(s.groups, string(gkey))
+	}
+	s.dirty[string(gkey)] = true
+}
+
+func (a *aggrAccum) apply(typ common.AggrFuncType, raw, dec []byte, delta int64) {
+
+	switch typ {
+
+	case common.AGG_COUNT:
+		if raw[0] != collatejson.TypeMissing && raw[0] != collatejson.TypeNull {
+			a.count += delta
+		}
+
+	case common.AGG_COUNTN:
+		if raw[0] == collatejson.TypeNumber {
+			a.count += delta
+		}
+
+	case common.AGG_SUM:
+		if raw[0] != collatejson.TypeNumber {
+			return
+		}
+		v, err := unmarshalValue(dec)
+		if err != nil {
+			return
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return
+		}
+		a.count += delta
+		//integers are summed separately to avoid drift on retraction
+		if f == math.Trunc(f) && math.Abs(f) < (1<<53) {
+			a.isum += delta * int64(f)
+		} else {
+			a.fsum += float64(delta) * f
+		}
+		if a.count == 0 {
+			a.isum, a.fsum = 0, 0
+		}
+
+	case common.AGG_MIN, common.AGG_MAX:
+		if raw[0] == collatejson.TypeMissing || raw[0] == collatejson.TypeNull {
+			return
+		}
+		if a.vals == nil {
+			a.vals = make(map[string]int64)
+		}
+		if n := a.vals[string(raw)] + delta; n > 0 {
+			a.vals[string(raw)] = n
+		} else {
+			delete(a.vals, string(raw))
+		}
+	}
+}
+
+func (a *aggrAccum) value(typ common.AggrFuncType) interface{} {
+
+	switch typ {
+
+	case common.AGG_COUNT, common.AGG_COUNTN:
+		return a.count
+
+	case common.AGG_SUM:
+		if a.count == 0 {
+			return nil
+		}
+		return float64(a.isum) + a.fsum
+
+	case common.AGG_MIN, common.AGG_MAX:
+		var res string
+		found := false
+		for v := range a.vals {
+			if !found || (typ == common.AGG_MIN && v < res) ||
+				(typ == common.AGG_MAX && v > res) {
+				res = v
+				found = true
+			}
+		}
+		if !found {
+			return encodedNull
+		}
+		return []byte(res)
+	}
+
+	return nil
+}
+
+// snapshot publishes the dirty groups.  Unchanged groups are shared
+// with the previous snapshot.
+func (s *aggrState) snapshot() *aggrTableSnapshot {
+
+	if len(s.dirty) != 0 {
+		last := make(map[string]*aggrGroupResult, len(s.groups))
+		for k, v := range s.last {
+			last[k] = v
+		}
+
+		for k := range s.dirty {
+			g, ok := s.groups[k]
+			if !ok {
+				delete(last, k)
+				continue
+			}
+
+			res := &aggrGroupResult{
+				keys:   g.keys,
+				count:  g.count,
+				values: make([]interface{}, len(s.defn.Aggrs)),
+			}
+			for i, ak := range s.defn.Aggrs {
+				res.values[i] = g.accum[i].value(ak.AggrFunc)
+			}
+			last[k] = res
+		}
+
+		s.last = last
+		s.dirty = make(map[string]bool)
+	}
+
+	return &aggrTableSnapshot{
+		defn:   s.defn,
+		order:  s.order,
+		groups: s.last,
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// snapshot
+//
+/////////////////////////////////////////////////////////////////////////
+
+// Sorted returns the groups in index order
+func (s *aggrTableSnapshot) Sorted(desc []bool) []*aggrGroupResult {
+
+	s.once.Do(func() {
+		s.sorted = make([]*aggrGroupResult, 0, len(s.groups))
+		for _, g := range s.groups {
+			s.sorted = append(s.sorted, g)
+		}
+		sortAggrGroups(s.sorted, s.defn, s.order, desc)
+	})
+
+	return s.sorted
+}
+
+func sortAggrGroups(groups []*aggrGroupResult, defn *common.IndexAggregate, order []int, desc []bool) {
+
+	sort.Slice(groups, func(i, j int) bool {
+		for _, k := range order {
+			cmp := bytes.Compare(groups[i].keys[k], groups[j].keys[k])
+			if cmp == 0 {
+				continue
+			}
+			if pos := defn.Group[k]; int(pos) < len(desc) && desc[pos] {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
+
+// mergeAggrSnapshots combines the groups of an aggregate across
+// partitions
+func mergeAggrSnapshots(snaps []*aggrTableSnapshot, desc []bool) []*aggrGroupResult {
+
+	if len(snaps) == 1 {
+		return snaps[0].Sorted(desc)
+	}
+
+	defn := snaps[0].defn
+	merged := make(map[string]*aggrGroupResult)
+
+	for _, snap := range snaps {
+		for k, g := range snap.groups {
+			m, ok := merged[k]
+			if !ok {
+				m = &aggrGroupResult{
+					keys:   g.keys,
+					count:  g.count,
+					values: append([]interface{}(nil), g.values...),
+				}
+				merged[k] = m
+				continue
+			}
+
+			m.count += g.count
+			for i, ak := range defn.Aggrs {
+				m.values[i] = mergeAggrValue(ak.AggrFunc, m.values[i], g.values[i])
+			}
+		}
+	}
+
+	groups := make([]*aggrGroupResult, 0, len(merged))
+	for _, g := range merged {
+		groups = append(groups, g)
+	}
+	sortAggrGroups(groups, defn, snaps[0].order, desc)
+	return groups
+}
+
+func mergeAggrValue(typ common.AggrFuncType, v1, v2 interface{}) interface{} {
+
+	switch typ {
+
+	case common.AGG_COUNT, common.AGG_COUNTN:
+		return v1.(int64) + v2.(int64)
+
+	case common.AGG_SUM:
+		if v1 == nil {
+			return v2
+		} else if v2 == nil {
+			return v1
+		}
+		return v1.(float64) + v2.(float64)
+
+	case common.AGG_MIN, common.AGG_MAX:
+		b1, b2 := v1.([]byte), v2.([]byte)
+		if isEncodedNull(b1) {
+			return b2
+		} else if isEncodedNull(b2) {
+			return b1
+		}
+		if cmp := bytes.Compare(b1, b2); (typ == common.AGG_MIN && cmp > 0) ||
+			(typ == common.AGG_MAX && cmp < 0) {
+			return b2
+		}
+		return b1
+	}
+
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// scan
+//
+/////////////////////////////////////////////////////////////////////////
+
+// aggrScan serves the GroupAggr of a scan request from a precomputed
+// aggregate
+type aggrScan struct {
+	snaps  []*aggrTableSnapshot
+	groups []int //aggregate group of each requested group
+	aggrs  []int //aggregate of each requested aggregate, -1 for COUNT(*)
+}
+
+// newAggrScan returns nil if the request cannot be served from the
+// precomputed aggregates of the slice snapshots
+func newAggrScan(r *ScanRequest, snapshots []SliceSnapshot) *aggrScan {
+
+	ga := r.GroupAggr
+	if ga == nil || r.isPrimary || r.Filter != nil || r.Resumable || r.resumeEntries != nil ||
+		ga.DependsOnPrimaryKey || len(snapshots) == 0 || len(r.IndexInst.Defn.Aggregates) == 0 ||
+		r.Indexprojection == nil || !r.Indexprojection.projectSecKeys || !isFullScan(r) {
+		return nil
+	}
+
+	for _, defn := range r.IndexInst.Defn.Aggregates {
+		if ga.Name != "" && ga.Name != defn.Name {
+			continue
+		}
+
+		as := matchAggregate(ga, defn)
+		if as == nil {
+			continue
+		}
+
+		for _, ss := range snapshots {
+			aggr := ss.Aggregates()
+			if aggr == nil {
+				return nil
+			}
+			snap, ok := aggr.tables[defn.Name]
+			if !ok || !reflect.DeepEqual(snap.defn, defn) {
+				return nil
+			}
+			as.snaps = append(as.snaps, snap)
+		}
+		return as
+	}
+
+	return nil
+}
+
+func matchAggregate(ga *GroupAggr, defn *common.IndexAggregate) *aggrScan {
+
+	if len(ga.Group) != len(defn.Group) {
+		return nil
+	}
+
+	as := &aggrScan{
+		groups: make([]int, len(ga.Group)),
+		aggrs:  make([]int, len(ga.Aggrs)),
+	}
+
+	matched := make(map[int]bool)
+	for i, gk := range ga.Group {
+		as.groups[i] = -1
+		for j, pos := range defn.Group {
+			if gk.KeyPos >= 0 && gk.KeyPos == pos {
+				as.groups[i] = j
+				matched[j] = true
+			}
+		}
+		if as.groups[i] < 0 {
+			return nil
+		}
+	}
+	if len(matched) != len(defn.Group) {
+		return nil
+	}
+
+	for i, ak := range ga.Aggrs {
+		if ak.Distinct && ak.AggrFunc != common.AGG_MIN && ak.AggrFunc != common.AGG_MAX {
+			return nil
+		}
+
+		if ak.KeyPos < 0 {
+			//COUNT(*) is the number of entries in the group
+			if ak.AggrFunc != common.AGG_COUNT || ak.ExprValue == nil ||
+				ak.ExprValue.Type() == value.NULL || ak.ExprValue.Type() == value.MISSING {
+				return nil
+			}
+			as.aggrs[i] = -1
+			continue
+		}
+
+		found := false
+		for j, dk := range defn.Aggrs {
+			if dk.AggrFunc == ak.AggrFunc && dk.KeyPos == ak.KeyPos {
+				as.aggrs[i] = j
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	return as
+}
+
+// isFullScan returns true if the scan covers all the entries of the index
+func isFullScan(r *ScanRequest) bool {
+
+	if len(r.Scans) != 1 {
+		return false
+	}
+
+	scan := r.Scans[0]
+	if scan.ScanType == AllReq {
+		return true
+	}
+
+	if len(scan.Filters) != 1 {
+		return false
+	}
+
+	for i, cf := range scan.Filters[0].CompositeFilters {
+		if cf.Pattern != nil || cf.High != MaxIndexKey {
+			return false
+		}
+		if cf.Low == MinIndexKey {
+			continue
+		}
+		//entries with missing leading key are not indexed
+		if i != 0 || !isEncodedNull(cf.Low.Bytes()) || (cf.Inclusion != Low && cf.Inclusion != Both) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// row returns the group in the form projected by the scan pipeline
+func (as *aggrScan) row(ga *GroupAggr, g *aggrGroupResult) *aggrRow {
+
+	row := &aggrRow{
+		groups: make([]*groupKey, len(ga.Group)),
+		aggrs:  make([]*aggrVal, len(ga.Aggrs)),
+		flush:  true,
+	}
+
+	for i, gk := range ga.Group {
+		row.groups[i] = &groupKey{raw: g.keys[as.groups[i]], projectId: gk.EntryKeyId}
+	}
+
+	for i, ak := range ga.Aggrs {
+		fn := &aggrFuncValue{typ: ak.AggrFunc}
+		if as.aggrs[i] < 0 {
+			fn.val = g.count
+		} else {
+			fn.val = g.values[as.aggrs[i]]
+		}
+		row.aggrs[i] = &aggrVal{fn: fn, projectId: ak.EntryKeyId}
+	}
+
+	return row
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+// aggrFuncValue
+//
+/////////////////////////////////////////////////////////////////////////
+
+// aggrFuncValue is a precomputed aggregate which is projected
+// like the ones computed during scan
+type aggrFuncValue struct {
+	typ common.AggrFuncType
+	val interface{}
+}
+
+func (a *aggrFuncValue) Type() common.AggrFuncType {
+	return a.typ
+}
+
+func (a *aggrFuncValue) AddDelta(delta interface{}) {
+}
+
+func (a *aggrFuncValue) AddDeltaObj(delta value.Value) {
+}
+
+func (a *aggrFuncValue) AddDeltaRaw(delta []byte) {
+}
+
+func (a *aggrFuncValue) Value() interface{} {
+	return a.val
+}
+
+func (a *aggrFuncValue) Distinct() bool {
+	return false
+}
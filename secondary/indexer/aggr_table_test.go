@@ -0,0 +1,217 @@
+package indexer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func encodeAggrTestKey(t *testing.T, key string) []byte {
+	buf := make([]byte, 0, 1024)
+	code, err := jsonEncoder.Encode([]byte(key), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestAggrTableRetraction(t *testing.T) {
+	defn := &c.IndexAggregate{
+		Name:  "byCity",
+		Group: []int32{0},
+		Aggrs: []c.AggregateKey{
+			{AggrFunc: c.AGG_SUM, KeyPos: 1},
+			{AggrFunc: c.AGG_MIN, KeyPos: 2},
+			{AggrFunc: c.AGG_MAX, KeyPos: 2},
+			{AggrFunc: c.AGG_COUNT, KeyPos: 2},
+			{AggrFunc: c.AGG_COUNTN, KeyPos: 1},
+		},
+	}
+
+	table := newAggrTable(3, "")
+	table.setAggregates([]*c.IndexAggregate{defn})
+	table.state = aggrTableReady
+
+	table.upsert([]byte(`["x",10,"b"]`), []byte("doc1"))
+	table.upsert([]byte(`["x",5,"a"]`), []byte("doc2"))
+	table.upsert([]byte(`["y",1.5,null]`), []byte("doc3"))
+
+	snap1 := table.snapshot().tables["byCity"]
+	groups := snap1.Sorted(nil)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", len(groups))
+	}
+
+	x, y := groups[0], groups[1]
+	if !bytes.Equal(x.keys[0], encodeAggrTestKey(t, `"x"`)) || x.count != 2 {
+		t.Fatalf("unexpected group %v count %v", x.keys, x.count)
+	}
+	if x.values[0] != 15.0 || x.values[3] != int64(2) || x.values[4] != int64(2) {
+		t.Errorf("unexpected SUM/COUNT/COUNTN %v", x.values)
+	}
+	if !bytes.Equal(x.values[1].([]byte), encodeAggrTestKey(t, `"a"`)) ||
+		!bytes.Equal(x.values[2].([]byte), encodeAggrTestKey(t, `"b"`)) {
+		t.Errorf("unexpected MIN/MAX %v", x.values)
+	}
+	if y.values[0] != 1.5 || !isEncodedNull(y.values[1].([]byte)) || y.values[3] != int64(0) {
+		t.Errorf("null values should be ignored, got %v", y.values)
+	}
+
+	// update moves doc1 to group y, delete empties group x
+	table.upsert([]byte(`["y",2,"c"]`), []byte("doc1"))
+	table.delete([]byte("doc2"))
+
+	groups = table.snapshot().tables["byCity"].Sorted(nil)
+	if len(groups) != 1 || groups[0].count != 2 {
+		t.Fatalf("expected a single group with 2 entries, got %v", groups)
+	}
+	y = groups[0]
+	if y.values[0] != 3.5 || y.values[3] != int64(1) {
+		t.Errorf("unexpected SUM/COUNT %v", y.values)
+	}
+	if !bytes.Equal(y.values[1].([]byte), encodeAggrTestKey(t, `"c"`)) ||
+		!bytes.Equal(y.values[2].([]byte), encodeAggrTestKey(t, `"c"`)) {
+		t.Errorf("unexpected MIN/MAX %v", y.values)
+	}
+
+	// earlier snapshot is immutable
+	if len(snap1.groups) != 2 || snap1.groups[string(encodeAggrTestKey(t, `"x"`))].count != 2 {
+		t.Errorf("earlier snapshot was modified")
+	}
+
+	// descending order of group key
+	groups = mergeAggrSnapshots([]*aggrTableSnapshot{snap1, snap1}, []bool{true, false, false})
+	if len(groups) != 2 || groups[0].count != 2 || groups[1].count != 4 ||
+		!bytes.Equal(groups[0].keys[0], encodeAggrTestKey(t, `"y"`)) {
+		t.Fatalf("unexpected merged groups %v", groups)
+	}
+	if groups[0].values[0] != 3.0 || groups[1].values[0] != 30.0 {
+		t.Errorf("unexpected merged SUM %v %v", groups[0].values, groups[1].values)
+	}
+}
+
+func TestAggrDocs(t *testing.T) {
+	docs := newAggrDocs()
+	docs.set([]byte("b"), []byte("kb"))
+	docs.set([]byte("a"), []byte("ka"))
+	docs.merge()
+
+	// changes shadow the sorted slice till merged
+	docs.set([]byte("a"), nil)
+	docs.set([]byte("c"), []byte("kc"))
+	docs.set([]byte("d"), nil)
+	if _, ok := docs.get([]byte("a")); ok {
+		t.Errorf("expected a to be deleted")
+	}
+	if key, ok := docs.get([]byte("b")); !ok || string(key) != "kb" {
+		t.Errorf("expected kb, got %s", key)
+	}
+	if _, ok := docs.changes["d"]; ok {
+		t.Errorf("expected delete of missing document to be dropped")
+	}
+
+	sorted := docs.sorted
+	if docs.len() != 2 || docs.sorted[0].docid != "b" || docs.sorted[1].docid != "c" {
+		t.Errorf("unexpected documents %v", docs.sorted)
+	}
+	if len(sorted) != 2 || sorted[0].docid != "a" {
+		t.Errorf("earlier slice was modified %v", sorted)
+	}
+	if docs.size != 6 {
+		t.Errorf("expected 6 bytes, got %v", docs.size)
+	}
+}
+
+func TestAggrDocsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, aggrTableFile)
+
+	ts := c.NewTsVbuuid("default", 4)
+	ts.Seqnos[1], ts.Vbuuids[1] = 10, 1234
+	docs := newAggrDocs()
+	docs.set([]byte("doc1"), []byte("key1"))
+	docs.set([]byte("doc2"), []byte("key2"))
+	docs.merge()
+
+	if err := writeAggrDocs(path, ts, docs.sorted); err != nil {
+		t.Fatal(err)
+	}
+	rts, rdocs, err := readAggrDocs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(rts) {
+		t.Errorf("expected timestamp %v, got %v", ts, rts)
+	}
+	if rdocs.len() != 2 || rdocs.size != docs.size {
+		t.Fatalf("unexpected documents %v", rdocs.sorted)
+	}
+	if key, ok := rdocs.get([]byte("doc2")); !ok || string(key) != "key2" {
+		t.Errorf("expected key2, got %s", key)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readAggrDocs(path); err != errAggrTableFile {
+		t.Errorf("expected %v, got %v", errAggrTableFile, err)
+	}
+}
+
+func TestAggrTableInstall(t *testing.T) {
+	defn := &c.IndexAggregate{
+		Name:  "byCity",
+		Group: []int32{0},
+		Aggrs: []c.AggregateKey{{AggrFunc: c.AGG_SUM, KeyPos: 1}},
+	}
+
+	table := newAggrTable(2, "")
+	table.setAggregates([]*c.IndexAggregate{defn})
+
+	// mutations are ignored till the table is built
+	table.upsert([]byte(`["x",100]`), []byte("doc0"))
+	if len(table.pending) != 0 || table.docs.len() != 0 {
+		t.Fatalf("expected mutation to be ignored")
+	}
+
+	// mutations flushed while building are applied on install
+	table.state = aggrTableBuilding
+	table.upsert([]byte(`["x",5]`), []byte("doc2"))
+	table.delete([]byte("doc1"))
+	if len(table.pending) != 2 {
+		t.Fatalf("expected 2 pending mutations, got %v", len(table.pending))
+	}
+
+	docs := newAggrDocs()
+	for docid, key := range map[string]string{"doc1": `["x",10]`, "doc2": `["x",1]`} {
+		docs.set([]byte(docid), encodeAggrTestKey(t, key))
+	}
+	table.install(docs)
+
+	groups := table.snapshot().tables["byCity"].Sorted(nil)
+	if table.state != aggrTableReady || len(groups) != 1 {
+		t.Fatalf("expected a ready table with 1 group, got %v", groups)
+	}
+	if groups[0].count != 1 || groups[0].values[0] != 5.0 {
+		t.Errorf("unexpected group count %v SUM %v", groups[0].count, groups[0].values)
+	}
+
+	// reset discards the table
+	table.reset()
+	if table.state != aggrTableEmpty || table.docs.len() != 0 || len(table.snapshot().tables["byCity"].Sorted(nil)) != 0 {
+		t.Errorf("expected an empty table")
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+// BenchIndexer runs the storage and the scan pipeline of an indexer
+// in-process, along with its queryport server, without cluster manager,
+// projector or KV.  Documents are indexed by evaluating the index
+// expressions locally, the way projector does, and applying the keys to
+// the slices, the way flusher does.  Snapshots are created on Snapshot()
+// and, if configured, periodically.
+//
+// It is meant for benchmarks of scans and mutations.  Scans are served
+// with AnyConsistency, or QueryConsistency against Timestamp().  Only one
+// BenchIndexer can run in a process, since the scan coordinator
+// registers its REST handlers globally.
+
+var ErrBenchIndexExists = errors.New("Index already exists")
+
+// benchVbuuid is the vbuuid of every vbucket.  It is non-zero for
+// QueryConsistency to compare sequence numbers.
+const benchVbuuid = 1
+
+type benchIndex struct {
+	inst    common.IndexInst
+	exprs   []interface{}
+	whExpr  []interface{}
+	partnId common.PartitionId
+	slice   Slice
+}
+
+type BenchIndexer struct {
+	config common.Config
+	stats  *IndexerStats
+
+	scanCoord  ScanCoordinator
+	scanCmdch  MsgChannel
+	scanMsgch  MsgChannel
+	snapNotify chan IndexSnapshot
+
+	// Writers hold the read lock and snapshots the write lock, so that
+	// no slice has pending mutations while a snapshot is created.
+	wrlock sync.RWMutex
+
+	mu      sync.Mutex
+	indexes map[common.IndexInstId]*benchIndex
+	seqnos  map[string]*common.TsVbuuid
+	snaps   map[common.IndexInstId]IndexSnapshot
+	waiters map[common.IndexInstId][]*snapshotWaiter
+	dirty   bool
+	nextId  uint64
+
+	donech chan bool
+	wg     sync.WaitGroup
+}
+
+// NewBenchIndexer starts the scan coordinator listening on scanPort of
+// the indexer config.  Slices are created in storage_dir.  A non-zero
+// snapInterval, in milliseconds, creates snapshots periodically.
+func NewBenchIndexer(config common.Config, snapInterval uint64) (*BenchIndexer, error) {
+
+	b := &BenchIndexer{
+		config:     config,
+		stats:      NewIndexerStats(),
+		scanCmdch:  make(MsgChannel),
+		scanMsgch:  make(MsgChannel),
+		snapNotify: make(chan IndexSnapshot, 100),
+		indexes:    make(map[common.IndexInstId]*benchIndex),
+		seqnos:     make(map[string]*common.TsVbuuid),
+		snaps:      make(map[common.IndexInstId]IndexSnapshot),
+		waiters:    make(map[common.IndexInstId][]*snapshotWaiter),
+		nextId:     uint64(time.Now().UnixNano()),
+		donech:     make(chan bool),
+	}
+
+	storageDir := config["storage_dir"].String()
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return nil, err
+	}
+
+	scanCoord, msg := NewScanCoordinator(b.scanCmdch, b.scanMsgch, config, b.snapNotify)
+	if msg.GetMsgType() == MSG_ERROR {
+		return nil, msg.(*MsgError).GetError().cause
+	}
+	b.scanCoord = scanCoord
+
+	b.wg.Add(1)
+	go b.run()
+
+	if err := b.sendToScanCoord(&MsgIndexerState{mType: INDEXER_RESUME}); err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	if snapInterval != 0 {
+		b.wg.Add(1)
+		go b.snapshotLoop(time.Duration(snapInterval) * time.Millisecond)
+	}
+
+	logging.Infof("BenchIndexer: Started on scanPort %v storage_dir %v",
+		config["scanPort"].String(), storageDir)
+
+	return b, nil
+}
+
+// CreateIndex creates and activates an index.  Partitioned and array
+// indexes are not supported.
+func (b *BenchIndexer) CreateIndex(defn common.IndexDefn) (common.IndexInstId, error) {
+
+	if common.IsPartitioned(defn.PartitionScheme) {
+		return 0, errors.New("Partitioned index is not supported")
+	}
+	if defn.IsArrayIndex {
+		return 0, errors.New("Array index is not supported")
+	}
+
+	b.wrlock.Lock()
+	defer b.wrlock.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, index := range b.indexes {
+		if index.inst.Defn.Bucket == defn.Bucket && index.inst.Defn.Name == defn.Name {
+			return 0, ErrBenchIndexExists
+		}
+	}
+
+	b.nextId++
+	if defn.DefnId == 0 {
+		defn.DefnId = common.IndexDefnId(b.nextId)
+	}
+	defn.PartitionScheme = common.SINGLE
+	if defn.ExprType == "" {
+		defn.ExprType = common.N1QL
+	}
+
+	index := &benchIndex{partnId: common.NON_PARTITION_ID}
+	var err error
+	if !defn.IsPrimary {
+		if index.exprs, err = protobuf.CompileN1QLExpression(defn.SecExprs); err != nil {
+			return 0, err
+		}
+	}
+	if defn.WhereExpr != "" {
+		if index.whExpr, err = protobuf.CompileN1QLExpression([]string{defn.WhereExpr}); err != nil {
+			return 0, err
+		}
+	}
+
+	numVbuckets := b.config["numVbuckets"].Int()
+	pc := common.NewKeyPartitionContainer(numVbuckets, 1, defn.PartitionScheme)
+	pc.AddPartition(index.partnId, common.KeyPartitionDefn{Id: index.partnId})
+
+	index.inst = common.IndexInst{
+		InstId:      common.IndexInstId(b.nextId),
+		Defn:        defn,
+		State:       common.INDEX_STATE_ACTIVE,
+		RState:      common.REBAL_ACTIVE,
+		Stream:      common.MAINT_STREAM,
+		Pc:          pc,
+		StorageMode: string(defn.Using),
+	}
+	instId := index.inst.InstId
+
+	b.stats.AddPartition(instId, defn.Bucket, defn.Name, 0, index.partnId)
+	idxStats := b.stats.GetPartitionStats(instId, index.partnId)
+
+	path := filepath.Join(b.config["storage_dir"].String(),
+		IndexPath(&index.inst, index.partnId, SliceId(0)))
+
+	switch defn.Using {
+	case common.MemDB, common.MemoryOptimized:
+		index.slice, err = NewMemDBSlice(path, SliceId(0), defn, instId, defn.IsPrimary, false,
+			b.config, idxStats)
+	case common.ForestDB:
+		index.slice, err = NewForestDBSlice(path, SliceId(0), defn, instId, defn.IsPrimary,
+			b.config, idxStats)
+	case common.PlasmaDB:
+		index.slice, err = NewPlasmaSlice(path, SliceId(0), defn, instId, defn.IsPrimary,
+			b.config, idxStats)
+	default:
+		err = fmt.Errorf("Unsupported storage %v", defn.Using)
+	}
+	if err != nil {
+		b.stats.RemoveIndex(instId)
+		return 0, err
+	}
+
+	b.indexes[instId] = index
+	if _, ok := b.seqnos[defn.Bucket]; !ok {
+		ts := common.NewTsVbuuid(defn.Bucket, numVbuckets)
+		for vb := range ts.Vbuuids {
+			ts.Vbuuids[vb] = benchVbuuid
+		}
+		b.seqnos[defn.Bucket] = ts
+	}
+
+	if err := b.updateMapsLOCKED(); err != nil {
+		return 0, err
+	}
+
+	// An empty index is scanned right away.
+	b.snapshotLOCKED(index)
+
+	logging.Infof("BenchIndexer: Created Index %v Instance %v Storage %v",
+		defn.Name, instId, defn.Using)
+
+	return instId, nil
+}
+
+// DropIndex drops an index and destroys its slice.
+func (b *BenchIndexer) DropIndex(instId common.IndexInstId) error {
+
+	b.wrlock.Lock()
+	defer b.wrlock.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	index, ok := b.indexes[instId]
+	if !ok {
+		return common.ErrIndexNotFound
+	}
+
+	delete(b.indexes, instId)
+	if err := b.updateMapsLOCKED(); err != nil {
+		return err
+	}
+
+	b.dropIndexLOCKED(index)
+	b.stats.RemoveIndex(instId)
+	return nil
+}
+
+func (b *BenchIndexer) dropIndexLOCKED(index *benchIndex) {
+
+	instId := index.inst.InstId
+	for _, w := range b.waiters[instId] {
+		w.Error(common.ErrIndexNotFound)
+	}
+	delete(b.waiters, instId)
+
+	DestroyIndexSnapshot(b.snaps[instId])
+	delete(b.snaps, instId)
+
+	index.slice.Close()
+	index.slice.Destroy()
+}
+
+// Upsert indexes a JSON document of the bucket in all its indexes.
+func (b *BenchIndexer) Upsert(bucket string, docid, doc []byte) error {
+
+	b.wrlock.RLock()
+	defer b.wrlock.RUnlock()
+
+	indexes, meta := b.mutation(bucket, docid)
+	docmeta := map[string]interface{}{"id": string(docid)}
+
+	for _, index := range indexes {
+		key, err := index.evaluate(docid, doc, docmeta)
+		if err != nil {
+			return err
+		}
+
+		instId, sliceId := index.inst.InstId, index.slice.Id()
+		if key == nil {
+			if err := index.slice.Delete(docid, meta); err != nil {
+				return err
+			}
+			gAggrTables.delete(instId, index.partnId, sliceId, docid)
+			continue
+		}
+
+		if err := index.slice.Insert(key, docid, meta); err != nil {
+			logging.Errorf("BenchIndexer::Upsert Error indexing docid: %s in Index %v. Error: %v",
+				logging.TagStrUD(docid), instId, err)
+			index.slice.Delete(docid, meta)
+			gAggrTables.delete(instId, index.partnId, sliceId, docid)
+		} else {
+			gAggrTables.upsert(instId, index.partnId, sliceId, key, docid)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a document of the bucket from all its indexes.
+func (b *BenchIndexer) Delete(bucket string, docid []byte) error {
+
+	b.wrlock.RLock()
+	defer b.wrlock.RUnlock()
+
+	indexes, meta := b.mutation(bucket, docid)
+	for _, index := range indexes {
+		if err := index.slice.Delete(docid, meta); err != nil {
+			return err
+		}
+		gAggrTables.delete(index.inst.InstId, index.partnId, index.slice.Id(), docid)
+	}
+
+	return nil
+}
+
+// mutation returns the indexes of the bucket and the metadata of the
+// next mutation of the document.
+func (b *BenchIndexer) mutation(bucket string, docid []byte) ([]*benchIndex, *MutationMeta) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var indexes []*benchIndex
+	for _, index := range b.indexes {
+		if index.inst.Defn.Bucket == bucket {
+			indexes = append(indexes, index)
+		}
+	}
+
+	meta := NewMutationMeta()
+	meta.bucket = bucket
+
+	if ts, ok := b.seqnos[bucket]; ok {
+		vb := int(crc32.ChecksumIEEE(docid)) % len(ts.Seqnos)
+		ts.Seqnos[vb]++
+		meta.SetVBId(vb)
+		meta.vbuuid = benchVbuuid
+		meta.seqno = Seqno(ts.Seqnos[vb])
+	}
+	b.dirty = b.dirty || len(indexes) != 0
+
+	return indexes, meta
+}
+
+// evaluate returns the JSON secondary key of a document, or nil if the
+// document is not indexed.
+func (index *benchIndex) evaluate(docid, doc []byte,
+	meta map[string]interface{}) ([]byte, error) {
+
+	if index.whExpr != nil {
+		out, _, err := protobuf.N1QLTransform(nil, doc, index.whExpr, meta, nil)
+		if err != nil || string(out) != "true" {
+			return nil, err
+		}
+	}
+
+	if index.inst.Defn.IsPrimary {
+		return []byte(`["` + string(docid) + `"]`), nil
+	}
+
+	key, _, err := protobuf.N1QLTransform(docid, doc, index.exprs, meta, nil)
+	return key, err
+}
+
+// Timestamp returns the sequence numbers of the mutations applied to the
+// indexes of the bucket so far.  Scans with QueryConsistency on it wait
+// for a snapshot having all of them.
+func (b *BenchIndexer) Timestamp(bucket string) *common.TsVbuuid {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ts, ok := b.seqnos[bucket]; ok {
+		return ts.Copy()
+	}
+	return nil
+}
+
+// Snapshot creates a snapshot of every index with mutations since the
+// last snapshot and publishes it to the scan coordinator.
+func (b *BenchIndexer) Snapshot() {
+
+	b.wrlock.Lock()
+	defer b.wrlock.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.dirty {
+		return
+	}
+
+	for _, index := range b.indexes {
+		b.snapshotLOCKED(index)
+	}
+	b.dirty = false
+}
+
+func (b *BenchIndexer) snapshotLOCKED(index *benchIndex) {
+
+	instId := index.inst.InstId
+	ts := b.seqnos[index.inst.Defn.Bucket].Copy()
+
+	info, err := index.slice.NewSnapshot(ts, false)
+	if err != nil {
+		logging.Errorf("BenchIndexer::snapshot Error creating snapshot for Index %v. Error %v",
+			instId, err)
+		return
+	}
+
+	snap, err := index.slice.OpenSnapshot(info)
+	if err != nil {
+		logging.Errorf("BenchIndexer::snapshot Error opening snapshot for Index %v. Error %v",
+			instId, err)
+		return
+	}
+
+	ss := &sliceSnapshot{
+		id:   index.slice.Id(),
+		snap: snap,
+		aggr: gAggrTables.snapshot(instId, index.partnId, index.slice, snap, index.inst.Defn.Desc, false),
+	}
+	ps := &partitionSnapshot{
+		id:     index.partnId,
+		slices: map[SliceId]SliceSnapshot{ss.id: ss},
+	}
+	is := &indexSnapshot{
+		instId: instId,
+		ts:     ts,
+		partns: map[common.PartitionId]PartitionSnapshot{index.partnId: ps},
+	}
+
+	DestroyIndexSnapshot(b.snaps[instId])
+	b.snaps[instId] = is
+	b.snapNotify <- CloneIndexSnapshot(is)
+
+	idxStats := b.stats.indexes[instId]
+	idxStats.numSnapshots.Add(1)
+
+	var waiters []*snapshotWaiter
+	now := time.Now()
+	for _, w := range b.waiters[instId] {
+		if !w.expired.IsZero() && now.After(w.expired) {
+			w.Error(common.ErrScanTimedOut)
+			idxStats.numSnapshotWaiters.Add(-1)
+		} else if isSnapshotConsistent(is, w.cons, w.ts) {
+			w.Notify(CloneIndexSnapshot(is))
+			idxStats.numSnapshotWaiters.Add(-1)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	b.waiters[instId] = waiters
+}
+
+func (b *BenchIndexer) snapshotLoop(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.Snapshot()
+		case <-b.donech:
+			return
+		}
+	}
+}
+
+// run serves the snapshot requests of the scan coordinator.
+func (b *BenchIndexer) run() {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case msg := <-b.scanMsgch:
+			if req, ok := msg.(*MsgIndexSnapRequest); ok {
+				b.handleSnapRequest(req)
+			} else {
+				logging.Warnf("BenchIndexer: Ignored message %v", msg)
+			}
+		case <-b.donech:
+			return
+		}
+	}
+}
+
+func (b *BenchIndexer) handleSnapRequest(req *MsgIndexSnapRequest) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	instId := req.GetIndexId()
+	if _, ok := b.indexes[instId]; !ok {
+		req.respch <- common.ErrIndexNotFound
+		return
+	}
+
+	if is := b.snaps[instId]; is != nil && isSnapshotConsistent(is, req.GetConsistency(), req.GetTS()) {
+		req.respch <- CloneIndexSnapshot(is)
+		return
+	}
+
+	b.stats.indexes[instId].numSnapshotWaiters.Add(1)
+	b.waiters[instId] = append(b.waiters[instId], newSnapshotWaiter(instId, req.GetTS(),
+		req.GetConsistency(), req.GetReplyChannel(), req.GetExpiredTime()))
+}
+
+func (b *BenchIndexer) updateMapsLOCKED() error {
+
+	instMap := make(common.IndexInstMap)
+	partnMap := make(IndexPartnMap)
+	for instId, index := range b.indexes {
+		instMap[instId] = index.inst
+		partnMap[instId] = PartitionInstMap{
+			index.partnId: PartitionInst{
+				Defn: common.KeyPartitionDefn{Id: index.partnId},
+				Sc:   b.newSliceContainer(index.slice),
+			},
+		}
+	}
+
+	gAggrTables.sync(instMap, partnMap)
+
+	if err := b.sendToScanCoord(&MsgUpdateInstMap{indexInstMap: instMap, stats: b.stats.Clone()}); err != nil {
+		return err
+	}
+	return b.sendToScanCoord(&MsgUpdatePartnMap{indexPartnMap: partnMap})
+}
+
+func (b *BenchIndexer) newSliceContainer(slice Slice) SliceContainer {
+	sc := NewHashedSliceContainer()
+	sc.AddSlice(slice.Id(), slice)
+	return sc
+}
+
+func (b *BenchIndexer) sendToScanCoord(msg Message) error {
+
+	b.scanCmdch <- msg
+	resp, ok := <-b.scanCmdch
+	if !ok {
+		return ErrFatalComm
+	}
+	if resp.GetMsgType() == MSG_ERROR {
+		return resp.(*MsgError).GetError().cause
+	}
+	return nil
+}
+
+// Close shuts down the scan coordinator and destroys all indexes.
+func (b *BenchIndexer) Close() {
+
+	b.scanCmdch <- &MsgGeneral{mType: SCAN_COORD_SHUTDOWN}
+	<-b.scanCmdch
+
+	close(b.donech)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for instId, index := range b.indexes {
+		b.dropIndexLOCKED(index)
+		delete(b.indexes, instId)
+	}
+	gAggrTables.sync(nil, nil)
+
+	logging.Infof("BenchIndexer: Stopped")
+}
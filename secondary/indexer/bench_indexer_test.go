@@ -0,0 +1,162 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func benchSnapshotCount(t *testing.T, b *BenchIndexer, instId c.IndexInstId) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var count uint64
+	for _, ps := range b.snaps[instId].Partitions() {
+		for _, ss := range ps.Slices() {
+			n, err := ss.Snapshot().CountTotal(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count += n
+		}
+	}
+	return count
+}
+
+func TestBenchIndexer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dir, err := ioutil.TempDir("", "bench_indexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("scanPort", strconv.Itoa(scanPort))
+	conf.SetValue("storage_dir", dir)
+
+	b, err := NewBenchIndexer(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	defn := c.IndexDefn{
+		Bucket:    "default",
+		Name:      "idx_age",
+		Using:     c.MemoryOptimized,
+		SecExprs:  []string{"`age`"},
+		WhereExpr: "`age` >= 18",
+	}
+	instId, err := b.CreateIndex(defn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.CreateIndex(defn); err != ErrBenchIndexExists {
+		t.Errorf("expected %v, got %v", ErrBenchIndexExists, err)
+	}
+	partitioned := defn
+	partitioned.Name = "idx_partitioned"
+	partitioned.PartitionScheme = c.KEY
+	if _, err := b.CreateIndex(partitioned); err == nil {
+		t.Errorf("expected error creating partitioned index")
+	}
+
+	// an empty index is scanned right away
+	if count := benchSnapshotCount(t, b, instId); count != 0 {
+		t.Errorf("unexpected count %v of empty index", count)
+	}
+
+	docs := map[string]string{
+		"doc1": `{"age": 10}`,
+		"doc2": `{"age": 20}`,
+		"doc3": `{"age": 30}`,
+		"doc4": `{"name": "x"}`,
+	}
+	for docid, doc := range docs {
+		if err := b.Upsert("default", []byte(docid), []byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Upsert("other", []byte("doc1"), []byte(`{"age": 40}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a scan with QueryConsistency waits for a snapshot with all the
+	// mutations applied so far
+	ts := b.Timestamp("default")
+	var seqnos uint64
+	for _, seqno := range ts.Seqnos {
+		seqnos += seqno
+	}
+	if seqnos != uint64(len(docs)) {
+		t.Errorf("unexpected timestamp with %v mutations", seqnos)
+	}
+	if b.Timestamp("other") != nil {
+		t.Errorf("unexpected timestamp of bucket without index")
+	}
+
+	respch := make(chan interface{}, 1)
+	b.scanMsgch <- &MsgIndexSnapRequest{
+		ts:        ts,
+		cons:      c.QueryConsistency,
+		idxInstId: instId,
+		respch:    respch,
+	}
+	select {
+	case resp := <-respch:
+		t.Fatalf("unexpected response %v before snapshot", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.Snapshot()
+	select {
+	case resp := <-respch:
+		is, ok := resp.(IndexSnapshot)
+		if !ok {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		if !is.Timestamp().Equal(ts) {
+			t.Errorf("unexpected snapshot timestamp %v", is.Timestamp())
+		}
+		DestroyIndexSnapshot(is)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no snapshot after Snapshot()")
+	}
+
+	// documents filtered out by the where clause or missing the key are
+	// not indexed
+	if count := benchSnapshotCount(t, b, instId); count != 2 {
+		t.Errorf("unexpected count %v, expected 2", count)
+	}
+
+	if err := b.Delete("default", []byte("doc2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Upsert("default", []byte("doc3"), []byte(`{"age": 5}`)); err != nil {
+		t.Fatal(err)
+	}
+	b.Snapshot()
+	if count := benchSnapshotCount(t, b, instId); count != 0 {
+		t.Errorf("unexpected count %v after delete, expected 0", count)
+	}
+
+	if err := b.DropIndex(instId); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DropIndex(instId); err != c.ErrIndexNotFound {
+		t.Errorf("expected %v, got %v", c.ErrIndexNotFound, err)
+	}
+}
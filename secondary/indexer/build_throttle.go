@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//Initial build of an index streams the whole bucket through
+//INIT_STREAM as fast as DCP can deliver it. Timekeeper periodically
+//measures the pressure on indexer (memory used relative to memory_quota,
+//length of the mutation queues drained by flusher and cpu utilization)
+//and derives a throttle level from it. Stream workers of INIT_STREAM
+//delay each mutation in proportion to the throttle level. A delayed
+//worker backs up the INIT_STREAM dataport connection, which in turn
+//slows down projector and the DCP backfill. MAINT_STREAM has its own
+//reader and workers and is never delayed, a backlog in maintenance
+//queues only increases the throttling of INIT_STREAM.
+
+//pressure from a signal starts at this fraction of its ceiling and
+//reaches full throttling at the ceiling
+const throttleRampStart = 0.75
+
+//minimum delay accumulated by a stream worker before it sleeps
+const minThrottleSleep = time.Millisecond
+
+//default and shortest interval of recomputing the throttle level
+const defaultThrottleInterval = time.Second
+const minThrottleInterval = 10 * time.Millisecond
+
+var gBuildThrottle buildThrottle
+
+type buildThrottle struct {
+	level int64 //throttle level in percent, 0 is not throttled
+	delay int64 //delay in nanoseconds per mutation
+}
+
+func (t *buildThrottle) Level() int64 {
+	return atomic.LoadInt64(&t.level)
+}
+
+func (t *buildThrottle) Delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.delay))
+}
+
+func (t *buildThrottle) set(level int64, delay time.Duration) {
+	atomic.StoreInt64(&t.level, level)
+	atomic.StoreInt64(&t.delay, int64(delay))
+}
+
+//buildPressure computes the throttle level, in percent, from the
+//pressure signals and returns the signal which determined it.
+//memUsed/memQuota are in bytes, queued is the number of mutations
+//waiting to be flushed and cpu is the fraction of cpu capacity used.
+func buildPressure(config common.Config, memUsed, memQuota uint64,
+	queued int64, cpu float64) (int64, string) {
+
+	ramp := func(value, ceiling float64) float64 {
+		if ceiling <= 0 {
+			return 0
+		}
+		start := ceiling * throttleRampStart
+		if value <= start {
+			return 0
+		} else if value >= ceiling {
+			return 1
+		}
+		return (value - start) / (ceiling - start)
+	}
+
+	var pressure float64
+	var reason string
+
+	if memQuota > 0 {
+		p := ramp(float64(memUsed)/float64(memQuota), config["build.throttle.memHighMark"].Float64())
+		if p > pressure {
+			pressure, reason = p, "memory"
+		}
+	}
+
+	p := ramp(float64(queued), float64(config["build.throttle.queueHighMark"].Int()))
+	if p > pressure {
+		pressure, reason = p, "mutation_queue"
+	}
+
+	p = ramp(cpu, config["build.throttle.cpuHighMark"].Float64())
+	if p > pressure {
+		pressure, reason = p, "cpu"
+	}
+
+	return int64(pressure*100 + 0.5), reason
+}
+
+//throttleDelay returns the delay per mutation for a throttle level
+func throttleDelay(config common.Config, level int64) time.Duration {
+	maxDelay := time.Duration(config["build.throttle.maxMutationDelay"].Int()) * time.Microsecond
+	return maxDelay * time.Duration(level) / 100
+}
+
+//throttleInterval is the configured interval of recomputing the throttle
+//level, the default if it is not positive, and at least minThrottleInterval.
+func throttleInterval(config common.Config) time.Duration {
+	interval := time.Duration(config["build.throttle.interval"].Int()) * time.Millisecond
+	if interval <= 0 {
+		logging.Warnf("Invalid build.throttle.interval %v, using %v", interval, defaultThrottleInterval)
+		return defaultThrottleInterval
+	} else if interval < minThrottleInterval {
+		return minThrottleInterval
+	}
+	return interval
+}
@@ -0,0 +1,58 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestBuildPressure(t *testing.T) {
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("build.throttle.memHighMark", 0.8)
+	conf.SetValue("build.throttle.queueHighMark", 1000)
+	conf.SetValue("build.throttle.cpuHighMark", 0.8)
+	conf.SetValue("build.throttle.maxMutationDelay", 200)
+
+	// below 3/4 of every mark
+	if level, _ := buildPressure(conf, 50, 100, 100, 0.5); level != 0 {
+		t.Fatalf("expected no throttling, got level %v", level)
+	}
+
+	// half way between 3/4 of memory mark and the mark
+	level, reason := buildPressure(conf, 70, 100, 100, 0.5)
+	if level != 50 || reason != "memory" {
+		t.Fatalf("expected level 50 for memory, got %v for %v", level, reason)
+	}
+
+	// signal with the highest pressure wins
+	level, reason = buildPressure(conf, 70, 100, 2000, 0.5)
+	if level != 100 || reason != "mutation_queue" {
+		t.Fatalf("expected level 100 for mutation_queue, got %v for %v", level, reason)
+	}
+	level, reason = buildPressure(conf, 0, 0, 0, 0.9)
+	if level != 100 || reason != "cpu" {
+		t.Fatalf("expected level 100 for cpu, got %v for %v", level, reason)
+	}
+
+	if delay := throttleDelay(conf, 50); delay != 100*time.Microsecond {
+		t.Fatalf("expected delay of 100us, got %v", delay)
+	}
+}
+
+func TestThrottleInterval(t *testing.T) {
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+
+	intervals := map[int]time.Duration{
+		500: 500 * time.Millisecond,
+		1:   minThrottleInterval,
+		0:   defaultThrottleInterval,
+		-10: defaultThrottleInterval,
+	}
+	for value, expected := range intervals {
+		conf.SetValue("build.throttle.interval", value)
+		if interval := throttleInterval(conf); interval != expected {
+			t.Errorf("interval %v: expected %v, got %v", value, expected, interval)
+		}
+	}
+}
@@ -162,6 +162,9 @@ func (c *clustMgrAgent) handleSupvervisorCommands(cmd Message) {
 	case CLUST_MGR_MERGE_PARTITION:
 		c.handleMergePartition(cmd)
 
+	case CLUST_MGR_SWAP_INDEX_INST:
+		c.handleSwapIndexInst(cmd)
+
 	default:
 		logging.Errorf("ClusterMgrAgent::handleSupvervisorCommands Unknown Message %v", cmd)
 	}
@@ -263,6 +266,22 @@ func (c *clustMgrAgent) handleMergePartition(cmd Message) {
 	c.supvCmdch <- &MsgSuccess{}
 }
 
+func (c *clustMgrAgent) handleSwapIndexInst(cmd Message) {
+
+	logging.Infof("ClustMgr:handleSwapIndexInst%v", cmd)
+
+	defnId := cmd.(*MsgClustMgrSwapIndexInst).GetDefnId()
+	instId := cmd.(*MsgClustMgrSwapIndexInst).GetInstId()
+	newInstId := cmd.(*MsgClustMgrSwapIndexInst).GetNewInstId()
+	respch := cmd.(*MsgClustMgrSwapIndexInst).GetRespch()
+
+	go func() {
+		respch <- c.mgr.SwapIndexInstance(defnId, instId, newInstId)
+	}()
+
+	c.supvCmdch <- &MsgSuccess{}
+}
+
 func (c *clustMgrAgent) handleResetIndex(cmd Message) {
 
 	logging.Infof("ClustMgr:handleResetIndex %v", cmd)
@@ -380,6 +399,7 @@ func (c *clustMgrAgent) handleGetGlobalTopology(cmd Message) {
 				OldStorageMode: inst.OldStorageMode,
 				Pc:             pc,
 				RealInstId:     common.IndexInstId(inst.RealInstId),
+				Rebuild:        inst.Rebuild,
 			}
 
 			indexInstMap[idxInst.InstId] = idxInst
@@ -554,6 +574,11 @@ func (meta *metaNotifier) OnIndexCreate(indexDefn *common.IndexDefn, instId comm
 		idxInst.RState = common.REBAL_PENDING
 	}
 
+	// proxy rebuilding its real instance
+	if realInstId != 0 && reqCtx != nil && reqCtx.ReqSource == common.DDLRequestSourceRebuild {
+		idxInst.Rebuild = true
+	}
+
 	respCh := make(MsgChannel)
 
 	meta.adminCh <- &MsgCreateIndex{mType: CLUST_MGR_CREATE_INDEX_DDL,
@@ -738,6 +763,95 @@ func (meta *metaNotifier) OnPartitionPrune(instId common.IndexInstId, partitions
 	return nil
 }
 
+func (meta *metaNotifier) OnIndexAggregates(defnId common.IndexDefnId, aggregates []*common.IndexAggregate) error {
+
+	logging.Infof("clustMgrAgent::OnIndexAggregates Notification "+
+		"Received for Update Aggregates IndexId %v %v", defnId, aggregates)
+
+	respCh := make(MsgChannel)
+
+	meta.adminCh <- &MsgClustMgrUpdateAggregates{
+		defnId:     defnId,
+		aggregates: aggregates,
+		respCh:     respCh}
+
+	//wait for response
+	if res, ok := <-respCh; ok {
+
+		switch res.GetMsgType() {
+
+		case MSG_SUCCESS:
+			logging.Infof("clustMgrAgent::OnIndexAggregates Success "+
+				"for IndexId %v", defnId)
+			return nil
+
+		case MSG_ERROR:
+			logging.Errorf("clustMgrAgent::OnIndexAggregates Error "+
+				"for IndexId %v. Error %v", defnId, res)
+			err := res.(*MsgError).GetError()
+			return &common.IndexerError{Reason: err.String(), Code: err.convertError()}
+
+		default:
+			logging.Fatalf("clustMgrAgent::OnIndexAggregates Unknown Response "+
+				"Received for IndexId %v. Response %v", defnId, res)
+			common.CrashOnError(errors.New("Unknown Response"))
+
+		}
+
+	} else {
+		logging.Fatalf("clustMgrAgent::OnIndexAggregates Unexpected Channel Close "+
+			"for IndexId %v", defnId)
+		common.CrashOnError(errors.New("Unknown Response"))
+	}
+
+	return nil
+}
+
+func (meta *metaNotifier) OnIndexMemQuota(defnId common.IndexDefnId, memQuota uint64, priority common.IndexPriority) error {
+
+	logging.Infof("clustMgrAgent::OnIndexMemQuota Notification "+
+		"Received for Update Memory Quota IndexId %v %v %v", defnId, memQuota, priority)
+
+	respCh := make(MsgChannel)
+
+	meta.adminCh <- &MsgClustMgrUpdateMemQuota{
+		defnId:   defnId,
+		memQuota: memQuota,
+		priority: priority,
+		respCh:   respCh}
+
+	//wait for response
+	if res, ok := <-respCh; ok {
+
+		switch res.GetMsgType() {
+
+		case MSG_SUCCESS:
+			logging.Infof("clustMgrAgent::OnIndexMemQuota Success "+
+				"for IndexId %v", defnId)
+			return nil
+
+		case MSG_ERROR:
+			logging.Errorf("clustMgrAgent::OnIndexMemQuota Error "+
+				"for IndexId %v. Error %v", defnId, res)
+			err := res.(*MsgError).GetError()
+			return &common.IndexerError{Reason: err.String(), Code: err.convertError()}
+
+		default:
+			logging.Fatalf("clustMgrAgent::OnIndexMemQuota Unknown Response "+
+				"Received for IndexId %v. Response %v", defnId, res)
+			common.CrashOnError(errors.New("Unknown Response"))
+
+		}
+
+	} else {
+		logging.Fatalf("clustMgrAgent::OnIndexMemQuota Unexpected Channel Close "+
+			"for IndexId %v", defnId)
+		common.CrashOnError(errors.New("Unknown Response"))
+	}
+
+	return nil
+}
+
 func (meta *metaNotifier) OnFetchStats() error {
 
 	go meta.fetchStats()
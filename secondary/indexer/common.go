@@ -111,6 +111,9 @@ type IndexStorageStats struct {
 	Name    string
 	Bucket  string
 	Stats   StorageStatistics
+
+	// average scan rate of the index (rows/sec)
+	ScanRate int64
 }
 
 func (s IndexStorageStats) String() string {
@@ -11,7 +11,9 @@ package indexer
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -27,6 +29,7 @@ type compactionManager struct {
 	config    common.Config
 	supvMsgCh MsgChannel
 	supvCmdCh MsgChannel
+	cd        *compactionDaemon
 }
 
 type compactionDaemon struct {
@@ -37,6 +40,15 @@ type compactionDaemon struct {
 	config       common.ConfigHolder
 	clusterAddr  string
 	lastCheckDay int32
+
+	// compaction I/O budget and policy decisions
+	mu          sync.Mutex
+	cond        *sync.Cond
+	inFlight    int64 // size of index files being compacted
+	running     int
+	decisions   map[common.IndexInstId]*compactionDecision
+	lastCompact map[common.IndexInstId]time.Time
+	deferSince  map[common.IndexInstId]time.Time
 }
 
 func (cd *compactionDaemon) Start() {
@@ -86,7 +98,7 @@ func (cd *compactionDaemon) ResetConfig(c common.Config) {
 	}
 }
 
-func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.Config, checkTime time.Time, abortTime time.Time) bool {
+func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.Config, checkTime time.Time, abortTime time.Time) (bool, string) {
 
 	mode := strings.ToLower(config["compaction_mode"].String())
 	logging.Infof("CompactionDaemon: Checking fragmentation: %s, mode : %s", is.String(), mode)
@@ -97,9 +109,14 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 		// 2) check min_frag
 		if uint64(is.Stats.DiskSize) > config["min_size"].Uint64() {
 			if is.GetFragmentation() >= float64(config["min_frag"].Int()) {
-				return true
+				return true, fmt.Sprintf("fragmentation %.1f%% is at least min_frag %v%%",
+					is.GetFragmentation(), config["min_frag"].Int())
 			}
+			return false, fmt.Sprintf("fragmentation %.1f%% is below min_frag %v%%",
+				is.GetFragmentation(), config["min_frag"].Int())
 		}
+		return false, fmt.Sprintf("disk size %v is not over min_size %v",
+			is.Stats.DiskSize, config["min_size"].Uint64())
 	} else {
 
 		// if circular compaction, then
@@ -117,25 +134,25 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 			if start_hr < 0 || start_hr > 23 {
 				common.Console(cd.clusterAddr, "Compaction setting misconfigured.  Invalid start hour %v.", start_hr)
 				logging.Errorf("Compaction setting misconfigured.  Invalid start hour %v.", start_hr)
-				return false
+				return false, "compaction interval is misconfigured"
 			}
 
 			if end_hr < 0 || end_hr > 23 {
 				common.Console(cd.clusterAddr, "Compaction setting misconfigured.  Invalid end hour %v.", end_hr)
 				logging.Errorf("Compaction setting misconfigured.  Invalid end hour %v.", end_hr)
-				return false
+				return false, "compaction interval is misconfigured"
 			}
 
 			if start_min < 0 || start_min > 59 {
 				common.Console(cd.clusterAddr, "Compaction setting misconfigured.  Invalid start min %v.", start_min)
 				logging.Errorf("Compaction setting misconfigured.  Invalid start min %v.", start_min)
-				return false
+				return false, "compaction interval is misconfigured"
 			}
 
 			if end_min < 0 || end_min > 59 {
 				common.Console(cd.clusterAddr, "Compaction setting misconfigured.  Invalid end min %v.", end_min)
 				logging.Errorf("Compaction setting misconfigured.  Invalid end min %v.", end_min)
-				return false
+				return false, "compaction interval is misconfigured"
 			}
 
 			start_min += start_hr * 60
@@ -159,7 +176,7 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 
 				// if past 24 hours, then stop this run.
 				if abort && time.Now().After(abortTime) {
-					return false
+					return false, "compaction run exceeded 24 hours"
 				}
 
 				if abort && end_min != 0 {
@@ -192,7 +209,7 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 
 		if !isCompactionInterval {
 			logging.Infof("CompactionDaemon: Compaction attempt skipped since compaction interval is configured for %v", interval)
-			return false
+			return false, fmt.Sprintf("outside of compaction interval %v", interval)
 		}
 
 		hasDaysOfWeek := false
@@ -200,17 +217,17 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 		today := strings.ToLower(checkTime.Weekday().String())
 		for _, day := range days {
 			if strings.ToLower(strings.TrimSpace(day)) == today {
-				return true
+				return true, fmt.Sprintf("in compaction interval %v on %v", interval, checkTime.Weekday())
 			}
 			hasDaysOfWeek = true
 		}
 
 		if hasDaysOfWeek {
 			logging.Infof("CompactionDaemon: Compaction attempt skipped since compaction day is configured for %v", days)
+			return false, fmt.Sprintf("compaction days are %v", days)
 		}
+		return false, "no compaction day is configured"
 	}
-
-	return false
 }
 
 func (cd *compactionDaemon) loop() {
@@ -235,51 +252,22 @@ loop:
 					abortTime := time.Now().Add(time.Duration(24) * time.Hour)
 					checkTime := time.Now()
 
-					mode := strings.ToLower(conf["compaction_mode"].String())
-					if mode == "circular" {
-						// if circular compaction, run full compaction at most once a day.
-						if atomic.LoadInt32(&cd.lastCheckDay) != int32(checkTime.Weekday()) {
-							hasStartedToday = false
-							atomic.StoreInt32(&cd.lastCheckDay, int32(checkTime.Weekday()))
-						}
-
-						if hasStartedToday {
-							dur := time.Second * time.Duration(conf["check_period"].Int())
-							cd.timer.Reset(dur)
-							continue
-						}
+					// if circular compaction, run full compaction at most once a day.
+					if atomic.LoadInt32(&cd.lastCheckDay) != int32(checkTime.Weekday()) {
+						hasStartedToday = false
+						atomic.StoreInt32(&cd.lastCheckDay, int32(checkTime.Weekday()))
 					}
 
-					for _, is := range stats {
-						conf = cd.config.Load() // refresh to get up-to-date settings
-						needUpgrade := is.Stats.NeedUpgrade
-						if needUpgrade || cd.needsCompaction(is, conf, checkTime, abortTime) {
-							hasStartedToday = true
-
-							errch := make(chan error)
-							compactReq := &MsgIndexCompact{
-								instId:    is.InstId,
-								errch:     errch,
-								abortTime: abortTime,
-							}
-							logging.Infof("CompactionDaemon: Compacting index instance:%v", is.InstId)
-							if needUpgrade {
-								common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", is.Bucket, is.Name)
-							}
-							cd.msgch <- compactReq
-							err := <-errch
-							if err == nil {
-								logging.Infof("CompactionDaemon: Finished compacting index instance:%v", is.InstId)
-								if needUpgrade {
-									common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", is.Bucket, is.Name)
-								}
-							} else {
-								logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", is.InstId, err)
-								if needUpgrade {
-									common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", is.Bucket, is.Name, err)
-								}
-							}
-						}
+					policies, err := parseCompactionPolicies(conf["policies"].String())
+					if err != nil {
+						logging.Errorf("CompactionDaemon: Invalid compaction policies - %v", err)
+					}
+
+					insts := mergePartitionStorageStats(stats)
+					cd.pruneDecisions(insts)
+
+					if cd.compactIndexes(insts, policies, hasStartedToday, checkTime, abortTime) {
+						hasStartedToday = true
 					}
 				}
 			}
@@ -294,6 +282,95 @@ loop:
 	}
 }
 
+// compactIndexes runs a compaction pass over the indexes, and waits for
+// the compactions to finish.  Indexes in circular mode are skipped if
+// circular compaction has already started today, as per startedToday.
+// It returns true if the pass started a circular compaction.
+func (cd *compactionDaemon) compactIndexes(insts []IndexStorageStats,
+	policies map[string]*compactionPolicy, startedToday bool,
+	checkTime time.Time, abortTime time.Time) bool {
+
+	started := false
+	for _, is := range insts {
+		conf := cd.config.Load() // refresh to get up-to-date settings
+		policy := findCompactionPolicy(policies, is.Bucket, is.Name)
+		mode := policy.getMode(conf)
+
+		needUpgrade := is.Stats.NeedUpgrade
+		compact, reason := true, "index needs upgrade"
+		if !needUpgrade {
+			if mode == "circular" && startedToday {
+				compact, reason = false, "circular compaction already ran today"
+			} else {
+				compact, reason = cd.checkPolicy(is, policy, conf, checkTime, abortTime)
+			}
+		}
+
+		if !compact {
+			cd.setDecision(is, mode, COMPACTION_SKIP, reason)
+			continue
+		}
+
+		if !needUpgrade {
+			deferred, why := cd.deferCompaction(is, conf, checkTime)
+			if deferred {
+				cd.setDecision(is, mode, COMPACTION_DEFERRED, why)
+				continue
+			}
+			if why != "" {
+				reason += "; " + why
+			}
+		}
+
+		if mode == "circular" {
+			started = true
+		}
+		cd.compact(is, mode, reason, needUpgrade, abortTime, conf)
+	}
+
+	// wait for compactions of this pass to finish
+	cd.waitForCompactions()
+	return started
+}
+
+// compact compacts an index instance once the compaction I/O budget
+// allows it, without waiting for the compaction to finish.
+func (cd *compactionDaemon) compact(is IndexStorageStats, mode string, reason string,
+	needUpgrade bool, abortTime time.Time, conf common.Config) {
+
+	size := is.Stats.DiskSize
+	cd.waitForBudget(size, int64(conf["io_budget"].Uint64()*1024*1024))
+	cd.setDecision(is, mode, COMPACTION_RUNNING, reason)
+
+	go func() {
+		errch := make(chan error)
+		compactReq := &MsgIndexCompact{
+			instId:    is.InstId,
+			errch:     errch,
+			abortTime: abortTime,
+		}
+		logging.Infof("CompactionDaemon: Compacting index instance:%v (%v)", is.InstId, reason)
+		if needUpgrade {
+			common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", is.Bucket, is.Name)
+		}
+		cd.msgch <- compactReq
+		err := <-errch
+		if err == nil {
+			logging.Infof("CompactionDaemon: Finished compacting index instance:%v", is.InstId)
+			if needUpgrade {
+				common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", is.Bucket, is.Name)
+			}
+			cd.doneCompaction(is, mode, COMPACTION_DONE, reason, size)
+		} else {
+			logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", is.InstId, err)
+			if needUpgrade {
+				common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", is.Bucket, is.Name, err)
+			}
+			cd.doneCompaction(is, mode, COMPACTION_FAILED, err.Error(), size)
+		}
+	}()
+}
+
 func NewCompactionManager(supvCmdCh MsgChannel, supvMsgCh MsgChannel,
 	config common.Config) (CompactionManager, Message) {
 	cm := &compactionManager{
@@ -302,12 +379,14 @@ func NewCompactionManager(supvCmdCh MsgChannel, supvMsgCh MsgChannel,
 		supvMsgCh: supvMsgCh,
 		logPrefix: "CompactionManager",
 	}
+	cm.cd = cm.newCompactionDaemon()
+	http.HandleFunc("/compactionStatus", cm.cd.handleCompactionStatus)
 	go cm.run()
 	return cm, &MsgSuccess{}
 }
 
 func (cm *compactionManager) run() {
-	cd := cm.newCompactionDaemon()
+	cd := cm.cd
 	cd.Start()
 loop:
 	for {
@@ -344,7 +423,11 @@ func (cm *compactionManager) newCompactionDaemon() *compactionDaemon {
 		msgch:        cm.supvMsgCh,
 		clusterAddr:  clusterAddr,
 		lastCheckDay: -1,
+		decisions:    make(map[common.IndexInstId]*compactionDecision),
+		lastCompact:  make(map[common.IndexInstId]time.Time),
+		deferSince:   make(map[common.IndexInstId]time.Time),
 	}
+	cd.cond = sync.NewCond(&cd.mu)
 	cd.config.Store(cfg)
 
 	return cd
@@ -0,0 +1,441 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Per index compaction policies.
+//
+// Setting compaction.policies is a JSON object of policies keyed by
+// "bucket:index", or by "bucket" for all indexes of a bucket, e.g.
+//
+//   {"default:idx1": {"mode": "time", "period": 60},
+//    "travel": {"mode": "full", "min_frag": 50}}
+//
+// Indexes without a policy follow compaction_mode. Modes are
+//
+//   full     - fragmentation is at least min_frag and the file is larger
+//              than min_size (defaults to the node settings).
+//   circular - the compaction interval and days_of_week of the node.
+//   time     - every period minutes, if there is stale data.
+//   size     - stale data (disk size over data size) is at least
+//              max_stale_size bytes.
+//
+// Indexes are compacted concurrently as long as the total size of the
+// files being compacted stays within compaction.io_budget (MB). Compaction
+// of an index is deferred while its scan rate is at least
+// compaction.defer_scan_rate rows/sec, for up to compaction.max_defer
+// minutes. The latest decision for each index, and its reason, is
+// served on /compactionStatus.
+
+const (
+	COMPACTION_SKIP     = "skip"
+	COMPACTION_DEFERRED = "deferred"
+	COMPACTION_RUNNING  = "running"
+	COMPACTION_DONE     = "done"
+	COMPACTION_FAILED   = "failed"
+)
+
+type compactionPolicy struct {
+	Mode         string `json:"mode"`
+	MinSize      uint64 `json:"min_size,omitempty"`
+	MinFrag      int    `json:"min_frag,omitempty"`
+	Period       int    `json:"period,omitempty"`         // minutes
+	MaxStaleSize uint64 `json:"max_stale_size,omitempty"` // bytes
+}
+
+// compactionDecision is the latest compaction decision for an index.
+type compactionDecision struct {
+	InstId         common.IndexInstId `json:"instId"`
+	Bucket         string             `json:"bucket"`
+	Name           string             `json:"name"`
+	Mode           string             `json:"mode"`
+	Action         string             `json:"action"`
+	Reason         string             `json:"reason"`
+	DiskSize       int64              `json:"diskSize"`
+	DataSize       int64              `json:"dataSize"`
+	Fragmentation  float64            `json:"fragmentation"`
+	ScanRate       int64              `json:"scanRate"`
+	Time           time.Time          `json:"time"`
+	LastCompaction *time.Time         `json:"lastCompaction,omitempty"`
+}
+
+type compactionStatus struct {
+	Mode      string                `json:"mode"`
+	IOBudget  uint64                `json:"ioBudget"`
+	InFlight  int64                 `json:"inFlight"`
+	Running   int                   `json:"running"`
+	Decisions []*compactionDecision `json:"decisions"`
+}
+
+func parseCompactionPolicies(value string) (map[string]*compactionPolicy, error) {
+
+	policies := make(map[string]*compactionPolicy)
+	if strings.TrimSpace(value) == "" {
+		return policies, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &policies); err != nil {
+		return nil, err
+	}
+
+	for key, policy := range policies {
+		if policy == nil {
+			return nil, fmt.Errorf("Compaction policy of %v is not specified", key)
+		}
+		policy.Mode = strings.ToLower(policy.Mode)
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("Compaction policy of %v: %v", key, err)
+		}
+	}
+
+	return policies, nil
+}
+
+func (p *compactionPolicy) validate() error {
+
+	switch p.Mode {
+	case "full", "circular":
+	case "time":
+		if p.Period <= 0 {
+			return fmt.Errorf("period must be a positive number of minutes")
+		}
+	case "size":
+		if p.MaxStaleSize == 0 {
+			return fmt.Errorf("max_stale_size must be a positive number of bytes")
+		}
+	default:
+		return fmt.Errorf("mode must be one of (full, circular, time, size)")
+	}
+
+	if p.MinFrag < 0 || p.MinFrag > 100 {
+		return fmt.Errorf("min_frag must be a percentage")
+	}
+
+	return nil
+}
+
+// findCompactionPolicy returns the policy of an index, nil if it
+// follows the compaction mode of the node.
+func findCompactionPolicy(policies map[string]*compactionPolicy, bucket, name string) *compactionPolicy {
+
+	if p, ok := policies[bucket+":"+name]; ok {
+		return p
+	}
+	return policies[bucket]
+}
+
+func (p *compactionPolicy) getMode(config common.Config) string {
+
+	if p == nil {
+		return strings.ToLower(config["compaction_mode"].String())
+	}
+	return p.Mode
+}
+
+// mergePartitionStorageStats sums up the storage stats of the
+// partitions of each index instance.
+func mergePartitionStorageStats(stats []IndexStorageStats) []IndexStorageStats {
+
+	var merged []IndexStorageStats
+	pos := make(map[common.IndexInstId]int)
+
+	for _, is := range stats {
+		i, ok := pos[is.InstId]
+		if !ok {
+			pos[is.InstId] = len(merged)
+			merged = append(merged, IndexStorageStats{
+				InstId:   is.InstId,
+				Name:     is.Name,
+				Bucket:   is.Bucket,
+				ScanRate: is.ScanRate,
+			})
+			i = len(merged) - 1
+		}
+
+		st := &merged[i].Stats
+		st.DataSize += is.Stats.DataSize
+		st.DiskSize += is.Stats.DiskSize
+		st.ExtraSnapDataSize += is.Stats.ExtraSnapDataSize
+		st.NeedUpgrade = st.NeedUpgrade || is.Stats.NeedUpgrade
+	}
+
+	return merged
+}
+
+func staleDataSize(is IndexStorageStats) int64 {
+
+	if is.Stats.DiskSize > is.Stats.DataSize {
+		return is.Stats.DiskSize - is.Stats.DataSize
+	}
+	return 0
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  compaction daemon
+//
+/////////////////////////////////////////////////////////////////////////
+
+// checkPolicy checks if an index needs compaction as per its policy,
+// and returns the reason.
+func (cd *compactionDaemon) checkPolicy(is IndexStorageStats, policy *compactionPolicy,
+	config common.Config, checkTime time.Time, abortTime time.Time) (bool, string) {
+
+	switch policy.getMode(config) {
+	case "time":
+		return cd.checkTimePolicy(is, policy, checkTime)
+
+	case "size":
+		stale := staleDataSize(is)
+		if uint64(stale) >= policy.MaxStaleSize {
+			return true, fmt.Sprintf("stale data %v is at least max_stale_size %v", stale, policy.MaxStaleSize)
+		}
+		return false, fmt.Sprintf("stale data %v is below max_stale_size %v", stale, policy.MaxStaleSize)
+	}
+
+	if policy != nil {
+		config = config.Clone()
+		config.SetValue("compaction_mode", policy.Mode)
+		if policy.MinSize != 0 {
+			config.SetValue("min_size", policy.MinSize)
+		}
+		if policy.MinFrag != 0 {
+			config.SetValue("min_frag", policy.MinFrag)
+		}
+	}
+
+	return cd.needsCompaction(is, config, checkTime, abortTime)
+}
+
+func (cd *compactionDaemon) checkTimePolicy(is IndexStorageStats, policy *compactionPolicy,
+	checkTime time.Time) (bool, string) {
+
+	cd.mu.Lock()
+	last, ok := cd.lastCompact[is.InstId]
+	if !ok {
+		// first period starts when the index is first seen
+		last = checkTime
+		cd.lastCompact[is.InstId] = last
+	}
+	cd.mu.Unlock()
+
+	period := time.Duration(policy.Period) * time.Minute
+	if elapsed := checkTime.Sub(last); elapsed < period {
+		return false, fmt.Sprintf("last compaction %v ago, period is %v", elapsed.Truncate(time.Second), period)
+	}
+
+	if staleDataSize(is) == 0 {
+		return false, "no stale data"
+	}
+
+	return true, fmt.Sprintf("period %v has elapsed since last compaction", period)
+}
+
+// deferCompaction defers compaction of an index during scan heavy
+// periods.  If compaction is not deferred, the reason is given if it
+// had been deferred before.
+func (cd *compactionDaemon) deferCompaction(is IndexStorageStats, config common.Config,
+	checkTime time.Time) (bool, string) {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	rate := int64(config["defer_scan_rate"].Int())
+	if rate <= 0 || is.ScanRate < rate {
+		delete(cd.deferSince, is.InstId)
+		return false, ""
+	}
+
+	since, ok := cd.deferSince[is.InstId]
+	if !ok {
+		since = checkTime
+		cd.deferSince[is.InstId] = since
+	}
+
+	maxDefer := time.Duration(config["max_defer"].Int()) * time.Minute
+	if elapsed := checkTime.Sub(since); elapsed >= maxDefer {
+		return false, fmt.Sprintf("deferred on scan rate for %v, max_defer is %v",
+			elapsed.Truncate(time.Second), maxDefer)
+	}
+
+	return true, fmt.Sprintf("scan rate %v rows/sec is at least defer_scan_rate %v", is.ScanRate, rate)
+}
+
+// waitForBudget waits until an index file of the given size can be
+// compacted within the I/O budget, and reserves it.  One index is
+// always allowed to compact.  A zero budget compacts one index at a time.
+func (cd *compactionDaemon) waitForBudget(size int64, budget int64) {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	for cd.running > 0 && (budget <= 0 || cd.inFlight+size > budget) {
+		cd.cond.Wait()
+	}
+
+	cd.inFlight += size
+	cd.running++
+}
+
+func (cd *compactionDaemon) waitForCompactions() {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	for cd.running > 0 {
+		cd.cond.Wait()
+	}
+}
+
+func (cd *compactionDaemon) doneCompaction(is IndexStorageStats, mode string, action string,
+	reason string, size int64) {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	cd.inFlight -= size
+	cd.running--
+	if action == COMPACTION_DONE {
+		cd.lastCompact[is.InstId] = time.Now()
+		delete(cd.deferSince, is.InstId)
+	}
+	cd.setDecisionLOCKED(is, mode, action, reason)
+	cd.cond.Broadcast()
+}
+
+func (cd *compactionDaemon) setDecision(is IndexStorageStats, mode string, action string, reason string) {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	cd.setDecisionLOCKED(is, mode, action, reason)
+}
+
+func (cd *compactionDaemon) setDecisionLOCKED(is IndexStorageStats, mode string, action string, reason string) {
+
+	decision := &compactionDecision{
+		InstId:        is.InstId,
+		Bucket:        is.Bucket,
+		Name:          is.Name,
+		Mode:          mode,
+		Action:        action,
+		Reason:        reason,
+		DiskSize:      is.Stats.DiskSize,
+		DataSize:      is.Stats.DataSize,
+		Fragmentation: is.GetFragmentation(),
+		ScanRate:      is.ScanRate,
+		Time:          time.Now(),
+	}
+	if last, ok := cd.lastCompact[is.InstId]; ok {
+		decision.LastCompaction = &last
+	}
+
+	logging.Debugf("CompactionDaemon: Index %v.%v (%v) %v: %v", is.Bucket, is.Name, is.InstId, action, reason)
+	cd.decisions[is.InstId] = decision
+}
+
+// pruneDecisions forgets about dropped indexes.
+func (cd *compactionDaemon) pruneDecisions(stats []IndexStorageStats) {
+
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	current := make(map[common.IndexInstId]bool)
+	for _, is := range stats {
+		current[is.InstId] = true
+	}
+
+	for instId := range cd.decisions {
+		if !current[instId] {
+			delete(cd.decisions, instId)
+		}
+	}
+	for instId := range cd.lastCompact {
+		if !current[instId] {
+			delete(cd.lastCompact, instId)
+		}
+	}
+	for instId := range cd.deferSince {
+		if !current[instId] {
+			delete(cd.deferSince, instId)
+		}
+	}
+}
+
+func (cd *compactionDaemon) handleCompactionStatus(w http.ResponseWriter, r *http.Request) {
+
+	creds, valid, err := common.IsAuthValid(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 Unauthorized\n"))
+		return
+	}
+
+	if !common.IsAllowed(creds, []string{"cluster.admin.internal.index!read"}, w) {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unsupported method\n"))
+		return
+	}
+
+	config := cd.config.Load()
+
+	cd.mu.Lock()
+	status := &compactionStatus{
+		Mode:     strings.ToLower(config["compaction_mode"].String()),
+		IOBudget: config["io_budget"].Uint64(),
+		InFlight: cd.inFlight,
+		Running:  cd.running,
+	}
+	for _, decision := range cd.decisions {
+		status.Decisions = append(status.Decisions, decision)
+	}
+	sort.Slice(status.Decisions, func(i, j int) bool {
+		di, dj := status.Decisions[i], status.Decisions[j]
+		if di.Bucket != dj.Bucket {
+			return di.Bucket < dj.Bucket
+		}
+		if di.Name != dj.Name {
+			return di.Name < dj.Name
+		}
+		return di.InstId < dj.InstId
+	})
+	buf, err := json.Marshal(status)
+	cd.mu.Unlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,164 @@
+package indexer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestCompactionPolicy(t *testing.T) {
+	policies, err := parseCompactionPolicies(`{"default:idx1": {"mode": "Time", "period": 10},
+		"default": {"mode": "size", "max_stale_size": 1000}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := findCompactionPolicy(policies, "default", "idx1"); p == nil || p.Mode != "time" {
+		t.Errorf("unexpected policy %v for default:idx1", p)
+	}
+	if p := findCompactionPolicy(policies, "default", "idx2"); p == nil || p.Mode != "size" {
+		t.Errorf("unexpected policy %v for default:idx2", p)
+	}
+	if p := findCompactionPolicy(policies, "travel", "idx1"); p != nil {
+		t.Errorf("unexpected policy %v for travel:idx1", p)
+	}
+
+	for _, value := range []string{`{"default": {"mode": "time"}}`,
+		`{"default": {"mode": "size"}}`, `{"default": {"mode": "none"}}`,
+		`{"default": {"mode": "full", "min_frag": 200}}`, `[]`} {
+		if _, err := parseCompactionPolicies(value); err == nil {
+			t.Errorf("expected error for %v", value)
+		}
+	}
+
+	cd := &compactionDaemon{
+		lastCompact: make(map[c.IndexInstId]time.Time),
+		deferSince:  make(map[c.IndexInstId]time.Time),
+	}
+	now := time.Now()
+	is := IndexStorageStats{InstId: 1, Bucket: "default", Name: "idx1"}
+	is.Stats.DiskSize = 3000
+	is.Stats.DataSize = 1500
+
+	// period starts when the index is first seen
+	p := policies["default:idx1"]
+	if ok, reason := cd.checkPolicy(is, p, nil, now, now); ok {
+		t.Errorf("unexpected compaction: %v", reason)
+	}
+	if ok, reason := cd.checkPolicy(is, p, nil, now.Add(10*time.Minute), now); !ok {
+		t.Errorf("expected compaction: %v", reason)
+	}
+
+	p = policies["default"]
+	if ok, reason := cd.checkPolicy(is, p, nil, now, now); !ok {
+		t.Errorf("expected compaction: %v", reason)
+	}
+	is.Stats.DataSize = 2500
+	if ok, reason := cd.checkPolicy(is, p, nil, now, now); ok {
+		t.Errorf("unexpected compaction: %v", reason)
+	}
+
+	// compaction is deferred on scan rate up to max_defer
+	config := c.SystemConfig.SectionConfig("indexer.settings.compaction.", true)
+	config.SetValue("defer_scan_rate", 100)
+	config.SetValue("max_defer", 5)
+	is.ScanRate = 200
+	if deferred, _ := cd.deferCompaction(is, config, now); !deferred {
+		t.Errorf("expected compaction to be deferred")
+	}
+	if deferred, _ := cd.deferCompaction(is, config, now.Add(5*time.Minute)); deferred {
+		t.Errorf("unexpected deferral past max_defer")
+	}
+	is.ScanRate = 50
+	if deferred, _ := cd.deferCompaction(is, config, now); deferred {
+		t.Errorf("unexpected deferral on low scan rate")
+	}
+}
+
+func TestCompactionPass(t *testing.T) {
+	now := time.Now()
+	config := c.SystemConfig.SectionConfig("indexer.settings.compaction.", true)
+	config.SetValue("compaction_mode", "circular")
+	config.SetValue("days_of_week", strings.ToLower(now.Weekday().String()))
+	config.SetValue("io_budget", 0)
+
+	msgch := make(MsgChannel)
+	defer close(msgch)
+	cd := &compactionDaemon{
+		msgch:       msgch,
+		decisions:   make(map[c.IndexInstId]*compactionDecision),
+		lastCompact: make(map[c.IndexInstId]time.Time),
+		deferSince:  make(map[c.IndexInstId]time.Time),
+	}
+	cd.cond = sync.NewCond(&cd.mu)
+	cd.config.Store(config)
+
+	var mu sync.Mutex
+	var compacted []int
+	go func() {
+		for msg := range msgch {
+			req := msg.(*MsgIndexCompact)
+			mu.Lock()
+			compacted = append(compacted, int(req.instId))
+			mu.Unlock()
+			req.errch <- nil
+		}
+	}()
+	pass := func(policies map[string]*compactionPolicy, startedToday bool,
+		insts ...IndexStorageStats) (bool, []int) {
+
+		mu.Lock()
+		compacted = nil
+		mu.Unlock()
+
+		started := cd.compactIndexes(insts, policies, startedToday, now, now.Add(time.Hour))
+
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Ints(compacted)
+		return started, compacted
+	}
+
+	var insts []IndexStorageStats
+	for i := 1; i <= 3; i++ {
+		is := IndexStorageStats{InstId: c.IndexInstId(i), Bucket: "default", Name: "idx" + string('0'+rune(i))}
+		is.Stats.DiskSize = 3000
+		is.Stats.DataSize = 1000
+		insts = append(insts, is)
+	}
+
+	// all indexes of the pass are compacted, not only the first one
+	started, result := pass(nil, false, insts...)
+	if !started || len(result) != 3 {
+		t.Errorf("expected circular compaction of all indexes, got %v %v", started, result)
+	}
+
+	// circular compaction runs once a day, other policies still compact
+	policies := map[string]*compactionPolicy{"default:idx2": {Mode: "size", MaxStaleSize: 100}}
+	started, result = pass(policies, true, insts...)
+	if started || len(result) != 1 || result[0] != 2 {
+		t.Errorf("unexpected compaction after circular compaction ran, got %v %v", started, result)
+	}
+	for _, instId := range []c.IndexInstId{1, 3} {
+		if d := cd.decisions[instId]; d == nil || d.Action != COMPACTION_SKIP {
+			t.Errorf("unexpected decision %+v of circular index", d)
+		}
+	}
+
+	// a pass starting no circular compaction does not count for the day
+	started, result = pass(policies, false, insts[1])
+	if started || len(result) != 1 {
+		t.Errorf("unexpected pass of size policy, got %v %v", started, result)
+	}
+
+	// an index needing upgrade is compacted anyway
+	insts[2].Stats.NeedUpgrade = true
+	started, result = pass(nil, true, insts...)
+	if !started || len(result) != 1 || result[0] != 3 {
+		t.Errorf("unexpected compaction for upgrade, got %v %v", started, result)
+	}
+}
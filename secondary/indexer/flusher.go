@@ -445,6 +445,9 @@ func (f *flusher) processUpsert(mut *Mutation, docid []byte, meta *MutationMeta)
 				logging.Errorf("Flusher::processUpsert Error removing entry due to error %v Key: %s "+
 					"docid: %s in Slice: %v. Error: %v", err, logging.TagUD(mut.key), logging.TagStrUD(docid), slice.Id(), err2)
 			}
+			gAggrTables.delete(mut.uuid, partnId, slice.Id(), docid)
+		} else {
+			gAggrTables.upsert(mut.uuid, partnId, slice.Id(), mut.key, docid)
 		}
 	} else {
 		logging.LazyDebug(func() string {
@@ -471,6 +474,7 @@ func (f *flusher) processDelete(mut *Mutation, docid []byte, meta *MutationMeta)
 			logging.Errorf("Flusher::processDelete Error Deleting DocId: %v "+
 				"from Slice: %v", logging.TagStrUD(docid), slice.Id())
 		}
+		gAggrTables.delete(mut.uuid, partnInst.Defn.GetPartitionId(), slice.Id(), docid)
 	}
 }
 
@@ -499,6 +503,7 @@ func (f *flusher) processDeletionAfterUpsert(mut *Mutation, docid []byte, meta *
 				logging.Errorf("Flusher::processDelete Error Deleting DocId: %v "+
 					"from Slice: %v", docid, slice.Id())
 			}
+			gAggrTables.delete(mut.uuid, id, slice.Id(), docid)
 		}
 	}
 }
@@ -11,6 +11,7 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,7 +31,9 @@ import (
 )
 
 var (
-	snapshotMetaListKey = []byte("snapshots-list")
+	snapshotMetaListKey     = []byte("snapshots-list")
+	prefixDictMetaKey       = []byte("prefix-dictionary")
+	prefixSavedBytesMetaKey = []byte("prefix-saved-bytes")
 )
 
 //NewForestDBSlice initiailizes a new slice with forestdb backend.
@@ -147,6 +150,19 @@ retry:
 		return nil, err
 	}
 
+	// Back index values are prefix compressed. Main index keys are
+	// stored as is to retain the forestdb key ordering.
+	slice.prefixCompression = !isPrimary && sysconf["settings.prefix_compression.enable"].Bool()
+	slice.prefixDict = newPrefixDictionary(sysconf["settings.prefix_compression.min_prefix_len"].Int(),
+		sysconf["settings.prefix_compression.max_dict_entries"].Int())
+	if !isPrimary {
+		if err = slice.loadPrefixDictionary(); err != nil {
+			return nil, err
+		}
+		slice.compressBuf = make([][]byte, slice.numWriters)
+		slice.backSavings = make([]int64, slice.numWriters)
+	}
+
 	sliceBufSize := sysconf["settings.sliceBufSize"].Uint64()
 	slice.cmdCh = make(chan interface{}, sliceBufSize)
 	slice.workerDone = make([]chan bool, slice.numWriters)
@@ -245,6 +261,13 @@ type fdbSlice struct {
 	// Array processing
 	arrayExprPosition int
 	isArrayDistinct   bool
+
+	// Prefix compression of back index entries
+	prefixDict        *prefixDictionary
+	prefixCompression bool
+	compressBuf       [][]byte
+	// bytes saved by the back index entry last read by a writer
+	backSavings []int64
 }
 
 func (fdb *fdbSlice) IncrRef() {
@@ -436,7 +459,7 @@ func (fdb *fdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) (nmu
 		// we need to remove back index entry corresponding to the previous "existing" value.
 		if key == nil {
 			t0 := time.Now()
-			if err = fdb.back[workerId].DeleteKV(docid); err != nil {
+			if err = fdb.deleteBackIndexEntry(docid, workerId); err != nil {
 				fdb.checkFatalDbError(err)
 				logging.Errorf("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Error deleting "+
 					"entry from back index %v", fdb.id, fdb.idxInstId, err)
@@ -457,7 +480,7 @@ func (fdb *fdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) (nmu
 
 	//set the back index entry <docid, encodedkey>
 	t0 := time.Now()
-	if err = fdb.back[workerId].SetKV(docid, key); err != nil {
+	if err = fdb.setBackIndexEntry(docid, key, workerId); err != nil {
 		fdb.checkFatalDbError(err)
 		logging.Errorf("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Error in Back Index Set. "+
 			"Skipped Key %s. Value %v. Error %v", fdb.id, fdb.idxInstId, logging.TagStrUD(docid), logging.TagStrUD(key), err)
@@ -636,7 +659,7 @@ func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte
 	// we need to remove back index entry corresponding to the previous "existing" value.
 	if key == nil {
 		t0 := time.Now()
-		if err = fdb.back[workerId].DeleteKV(docid); err != nil {
+		if err = fdb.deleteBackIndexEntry(docid, workerId); err != nil {
 			fdb.checkFatalDbError(err)
 			logging.Errorf("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Error deleting "+
 				"entry from back index %v", fdb.id, fdb.idxInstId, err)
@@ -652,7 +675,7 @@ func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte
 			jsonEncoder.ReverseCollate(key, fdb.idxDefn.Desc)
 		}
 
-		if err = fdb.back[workerId].SetKV(docid, key); err != nil {
+		if err = fdb.setBackIndexEntry(docid, key, workerId); err != nil {
 			fdb.checkFatalDbError(err)
 			logging.Errorf("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Error in Back Index Set. "+
 				"Skipped Key %s. Value %v. Error %v", fdb.id, fdb.idxInstId, logging.TagStrUD(docid), logging.TagStrUD(key), err)
@@ -749,7 +772,7 @@ func (fdb *fdbSlice) deleteSecIndex(docid []byte, workerId int) (nmut int) {
 
 	//delete from the back index
 	t0 = time.Now()
-	if err = fdb.back[workerId].DeleteKV(docid); err != nil {
+	if err = fdb.deleteBackIndexEntry(docid, workerId); err != nil {
 		fdb.checkFatalDbError(err)
 		logging.Errorf("ForestDBSlice::delete \n\tSliceId %v IndexInstId %v. Error deleting "+
 			"entry from back index for Doc %s. Error %v", fdb.id, fdb.idxInstId, logging.TagStrUD(docid), err)
@@ -841,7 +864,7 @@ func (fdb *fdbSlice) deleteSecArrayIndex(docid []byte, workerId int) (nmut int)
 
 	//delete from the back index
 	t0 = time.Now()
-	if err = fdb.back[workerId].DeleteKV(docid); err != nil {
+	if err = fdb.deleteBackIndexEntry(docid, workerId); err != nil {
 		fdb.checkFatalDbError(err)
 		logging.Errorf("ForestDBSlice::delete \n\tSliceId %v IndexInstId %v. Error deleting "+
 			"entry from back index for Doc %s. Error %v", fdb.id, fdb.idxInstId, logging.TagStrUD(docid), err)
@@ -874,9 +897,51 @@ func (fdb *fdbSlice) getBackIndexEntry(docid []byte, workerId int) ([]byte, erro
 		return nil, err
 	}
 
+	//return the key in original encoding. Savings are remembered
+	//till the entry is overwritten or deleted by this writer.
+	fdb.backSavings[workerId] = fdb.prefixDict.savings(kbytes)
+	if fdb.backSavings[workerId] != 0 {
+		kbytes = fdb.prefixDict.Expand(kbytes, nil)
+	}
+
 	return kbytes, nil
 }
 
+//setBackIndexEntry sets the back index entry <docid, encodedkey>.
+//Encoded key is prefix compressed if enabled. Should be preceded by
+//getBackIndexEntry for the same docid.
+func (fdb *fdbSlice) setBackIndexEntry(docid []byte, key []byte, workerId int) error {
+
+	val := key
+	if fdb.prefixCompression {
+		val = fdb.prefixDict.Compress(key, fdb.compressBuf[workerId])
+		if len(val) != 0 && val[0] == prefixCompressedMarker {
+			fdb.compressBuf[workerId] = val[:0]
+		}
+	}
+
+	if err := fdb.back[workerId].SetKV(docid, val); err != nil {
+		return err
+	}
+
+	fdb.prefixDict.addSavings(fdb.prefixDict.savings(val) - fdb.backSavings[workerId])
+	fdb.backSavings[workerId] = 0
+	return nil
+}
+
+//deleteBackIndexEntry deletes the back index entry for docid.
+//Should be preceded by getBackIndexEntry for the same docid.
+func (fdb *fdbSlice) deleteBackIndexEntry(docid []byte, workerId int) error {
+
+	if err := fdb.back[workerId].DeleteKV(docid); err != nil {
+		return err
+	}
+
+	fdb.prefixDict.addSavings(-fdb.backSavings[workerId])
+	fdb.backSavings[workerId] = 0
+	return nil
+}
+
 //checkFatalDbError checks if the error returned from DB
 //is fatal and stores it. This error will be returned
 //to caller on next DB operation
@@ -999,6 +1064,12 @@ func (fdb *fdbSlice) Rollback(info SnapshotInfo) error {
 				"Back Index to Snapshot %v. Error %v", fdb.id, fdb.idxInstId, info, err)
 			return err
 		}
+
+		//dictionary is append only, reload to pickup the saved bytes
+		//as of the rolled back meta store
+		if err = fdb.loadPrefixDictionary(); err != nil {
+			return err
+		}
 	}
 
 	// Update valid snapshot list and commit
@@ -1044,6 +1115,7 @@ func (fdb *fdbSlice) RollbackToZero() error {
 				"Back Index to Zero. Error %v", fdb.id, fdb.idxInstId, err)
 			return err
 		}
+		fdb.prefixDict.setSavings(0)
 	}
 
 	return nil
@@ -1142,6 +1214,12 @@ func (fdb *fdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotInfo
 
 		// Meta update should be done before commit
 		// Otherwise, metadata will not be atomically updated along with disk commit.
+		if !fdb.isPrimary {
+			if err = fdb.updatePrefixDictionaryMeta(); err != nil {
+				return nil, err
+			}
+		}
+
 		err = fdb.updateSnapshotsMeta(sic.List())
 		if err != nil {
 			return nil, err
@@ -1419,6 +1497,8 @@ func (fdb *fdbSlice) Statistics() (StorageStatistics, error) {
 	sts.GetBytes = atomic.LoadInt64(&fdb.get_bytes)
 	sts.InsertBytes = atomic.LoadInt64(&fdb.insert_bytes)
 	sts.DeleteBytes = atomic.LoadInt64(&fdb.delete_bytes)
+	sts.PrefixDictSize = fdb.prefixDict.Size()
+	sts.PrefixSavedBytes = fdb.prefixDict.SavedBytes()
 
 	if logging.IsEnabled(logging.Timing) {
 		fdb.statFdLock.Lock()
@@ -1523,6 +1603,66 @@ handle_err:
 	return snapList, errors.New("Failed to retrieve snapshots list -" + err.Error())
 }
 
+func (fdb *fdbSlice) updatePrefixDictionaryMeta() error {
+	fdb.metaLock.Lock()
+	defer fdb.metaLock.Unlock()
+
+	var t0 time.Time
+	var err error
+	var savedBytes [8]byte
+
+	if fdb.prefixDict.isDirty() {
+		val, count := fdb.prefixDict.Bytes()
+		t0 = time.Now()
+		if err = fdb.meta.SetKV(prefixDictMetaKey, val); err != nil {
+			goto handle_err
+		}
+		fdb.idxStats.Timings.stKVMetaSet.Put(time.Now().Sub(t0))
+		fdb.prefixDict.setPersisted(count)
+	}
+
+	binary.LittleEndian.PutUint64(savedBytes[:], uint64(fdb.prefixDict.SavedBytes()))
+	t0 = time.Now()
+	if err = fdb.meta.SetKV(prefixSavedBytesMetaKey, savedBytes[:]); err != nil {
+		goto handle_err
+	}
+	fdb.idxStats.Timings.stKVMetaSet.Put(time.Now().Sub(t0))
+
+	return nil
+
+handle_err:
+	return errors.New("Failed to update prefix dictionary -" + err.Error())
+}
+
+func (fdb *fdbSlice) loadPrefixDictionary() error {
+	fdb.metaLock.Lock()
+	defer fdb.metaLock.Unlock()
+
+	t0 := time.Now()
+	data, err := fdb.meta.GetKV(prefixDictMetaKey)
+	if err != nil && err != forestdb.FDB_RESULT_KEY_NOT_FOUND {
+		return err
+	}
+	fdb.idxStats.Timings.stKVMetaGet.Put(time.Now().Sub(t0))
+
+	if err == nil {
+		if err = fdb.prefixDict.Load(data); err != nil {
+			return err
+		}
+	}
+
+	data, err = fdb.meta.GetKV(prefixSavedBytesMetaKey)
+	if err == nil && len(data) == 8 {
+		fdb.prefixDict.setSavings(int64(binary.LittleEndian.Uint64(data)))
+	} else if err == nil || err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+		fdb.prefixDict.setSavings(0)
+	} else {
+		return err
+	}
+
+	return nil
+}
+
 func tryDeleteFdbSlice(fdb *fdbSlice) {
 	logging.Infof("ForestDBSlice::Destroy Destroying Slice Id %v, IndexInstId %v, "+
 		"IndexDefnId %v", fdb.id, fdb.idxInstId, fdb.idxDefnId)
@@ -0,0 +1,651 @@
+// @copyright 2019 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	forestdb "github.com/couchbase/indexing/secondary/fdb"
+	l "github.com/couchbase/indexing/secondary/logging"
+)
+
+// Backup and restore of index data.
+//
+// Backup copies the latest persisted snapshot of each active index
+// partition into <dir>/<nodeUUID> on the local disk, with a checksum
+// per file, and the timestamp of the snapshot. Files are staged the
+// same way as for peer transfer during rebalance, so that data of
+// plasma indexes, whose files cannot be staged, is not backed up. Their
+// indexes are restored as deferred indexes.
+//
+//   POST /backupLocalIndexData?dir=&bucket=      -> manifest
+//   GET  /backupFile?dir=&node=&path=&name=      -> file + crc32 in trailer
+//   POST /restoreLocalIndexData[?cancel=true]    <- restore request
+//
+// On restore, manager places the indexes and asks each destination
+// indexer to install the backed up partitions at the index path of the
+// new index instance, before the instance is created. Files are copied
+// from the local backup dir if it has the same backup of the source
+// node, else they are downloaded from the source node. On build, the
+// index catches up from DCP from the restored snapshot. If the vbucket
+// uuids of the snapshot do not match anymore, the stream rolls back and
+// the index is built again.
+
+const RestoredIndexTag = "RestoredIndexes"
+
+const backupTmpSuffix = ".tmp"
+
+// Staging is retried if a snapshot is persisted while staging files.
+const backupStageAttempts = 5
+const restoreTmpSuffix = ".restore"
+
+type indexBackupSnapshot struct {
+	inst    c.IndexInst
+	partnId c.PartitionId
+	ts      *c.TsVbuuid
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  backup
+//
+/////////////////////////////////////////////////////////////////////////
+
+func (m *ServiceMgr) handleBackupLocalIndexData(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleBackupLocalIndexData Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!write"}, w) {
+		return
+	}
+
+	if r.Method != "POST" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	dir := r.FormValue("dir")
+	if !filepath.IsAbs(dir) {
+		m.writeError(w, fmt.Errorf("Backup dir %v must be an absolute path", dir))
+		return
+	}
+
+	t0 := time.Now()
+	manifest, err := m.backupIndexData(filepath.Clean(dir), r.FormValue("bucket"))
+	if err != nil {
+		l.Errorf("ServiceMgr::handleBackupLocalIndexData Error backing up to %v %v", dir, err)
+		m.writeError(w, err)
+		return
+	}
+
+	l.Infof("ServiceMgr::handleBackupLocalIndexData Backed up %v partitions to %v. Took %v",
+		len(manifest.Partitions), dir, time.Since(t0))
+
+	out, err := json.Marshal(manifest)
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	m.writeJson(w, out)
+}
+
+// backupIndexData copies the latest persisted snapshot of partitions
+// of active indexes of `bucket` into <dir>/<nodeUUID>, replacing any
+// previous backup of this node in `dir`.
+func (m *ServiceMgr) backupIndexData(dir, bucket string) (*c.IndexBackupManifest, error) {
+
+	m.backupMu.Lock()
+	defer m.backupMu.Unlock()
+
+	snapshots := m.backupSnapshots(bucket, 0, 0)
+
+	storageDir := m.config.Load()["storage_dir"].String()
+	nodeUUID := string(m.nodeInfo.NodeID)
+	target := filepath.Join(dir, nodeUUID)
+	tmpdir := target + backupTmpSuffix
+	os.RemoveAll(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest := &c.IndexBackupManifest{
+		NodeUUID:    nodeUUID,
+		StorageMode: c.GetStorageMode().String(),
+		Dir:         dir,
+		Time:        time.Now().UnixNano(),
+	}
+	for _, snap := range snapshots {
+		partn, err := m.backupIndexPartition(storageDir, tmpdir, snap)
+		if err == ErrPeerTransferNoSnapshot {
+			continue
+		} else if err == ErrPeerTransferUnsupported {
+			l.Warnf("ServiceMgr::backupIndexData Skipped index %v PartitionId %v. Data of "+
+				"storage mode %v is not backed up", snap.inst.InstId, snap.partnId, c.GetStorageMode())
+			continue
+		} else if err != nil {
+			os.RemoveAll(tmpdir)
+			return nil, err
+		}
+		manifest.Partitions = append(manifest.Partitions, *partn)
+	}
+
+	out, err := json.Marshal(manifest)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(tmpdir, c.IndexBackupManifestName), out, 0644)
+	}
+	if err == nil {
+		os.RemoveAll(target)
+		err = os.Rename(tmpdir, target)
+	}
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// backupSnapshots returns the latest persisted snapshot of partitions of
+// active indexes of `bucket`, or of partition `partnId` of index `instId`
+// alone if `instId` is not 0.
+func (m *ServiceMgr) backupSnapshots(bucket string, instId c.IndexInstId,
+	partnId c.PartitionId) []indexBackupSnapshot {
+
+	respch := make(chan []indexBackupSnapshot, 1)
+	m.supvMsgch <- &MsgIndexBackupSnapshot{
+		bucket:  bucket,
+		instId:  instId,
+		partnId: partnId,
+		respch:  respch,
+	}
+	return <-respch
+}
+
+// backupIndexPartition copies the persisted files of a partition into
+// `dir`. Files are staged first, so that they are not removed by
+// storage engine while being copied. The staged files are of the latest
+// persisted snapshot if it is the same before and after staging, data
+// of a snapshot being persisted meanwhile is ignored on recovery.
+// Otherwise, or if the files changed while being staged, the files are
+// staged again.
+func (m *ServiceMgr) backupIndexPartition(storageDir, dir string,
+	snap indexBackupSnapshot) (*c.IndexBackupPartition, error) {
+
+	name := IndexPath(&snap.inst, snap.partnId, SliceId(0))
+
+	var staged *peerSnapshotManifest
+	for attempt := 1; ; attempt++ {
+		var err error
+		if staged, err = m.peerServer.stage(storageDir, name); err != nil && err != ErrPeerTransferChanged {
+			return nil, err
+		}
+
+		latest := m.backupSnapshots(snap.inst.Defn.Bucket, snap.inst.InstId, snap.partnId)
+		if err == nil && len(latest) == 1 && latest[0].ts.Equal(snap.ts) {
+			break
+		}
+
+		if err == nil {
+			m.peerServer.unstage(storageDir, staged.Id)
+		}
+		if len(latest) != 1 {
+			return nil, ErrPeerTransferNoSnapshot
+		}
+		if attempt == backupStageAttempts {
+			return nil, fmt.Errorf("Index %v PartitionId %v changed while staging files, "+
+				"%v attempts", snap.inst.InstId, snap.partnId, attempt)
+		}
+		snap.ts = latest[0].ts
+	}
+	defer m.peerServer.unstage(storageDir, staged.Id)
+
+	partn := &c.IndexBackupPartition{
+		InstId:     snap.inst.InstId,
+		PartnId:    snap.partnId,
+		BucketUUID: snap.inst.Defn.BucketUUID,
+		Path:       name,
+		Ts:         snap.ts,
+	}
+	src := filepath.Join(storageDir, peerStagingDir, staged.Id)
+	for _, file := range staged.Files {
+		checksum, err := copyIndexFile(filepath.Join(src, file.Name),
+			filepath.Join(dir, name, file.Name), file.Size)
+		if err != nil {
+			return nil, err
+		}
+		partn.Files = append(partn.Files, c.IndexBackupFile{
+			Name:     file.Name,
+			Size:     file.Size,
+			Checksum: checksum,
+		})
+	}
+	return partn, nil
+}
+
+// copyIndexFile copies the first `size` bytes of `src` into `dst`.
+// Returns their checksum.
+func copyIndexFile(src, dst string, size int64) (uint32, error) {
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, err
+	}
+	hash := crc32.New(crc32Table)
+	n, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(in, size))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	} else if n != size {
+		return 0, fmt.Errorf("Expected %v bytes for %v, got %v", size, filepath.Base(src), n)
+	}
+	return hash.Sum32(), nil
+}
+
+func readBackupManifest(dir, nodeUUID string) (*c.IndexBackupManifest, error) {
+
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, nodeUUID, c.IndexBackupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(c.IndexBackupManifest)
+	if err := json.Unmarshal(bytes, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// findBackupPartition return the partition in `manifest` that is
+// identical to `partn`, including checksums of its files.
+func findBackupPartition(manifest *c.IndexBackupManifest,
+	partn *c.IndexBackupPartition) *c.IndexBackupPartition {
+
+	for i, p := range manifest.Partitions {
+		if p.InstId == partn.InstId && p.PartnId == partn.PartnId &&
+			p.Path == partn.Path && reflect.DeepEqual(p.Files, partn.Files) {
+			return &manifest.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// validBackupName return true if `name` is a single path element.
+func validBackupName(name string) bool {
+	return validPeerPath(name) && filepath.Base(name) == name
+}
+
+func (m *ServiceMgr) handleBackupFile(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleBackupFile Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!read"}, w) {
+		return
+	}
+
+	if r.Method != "GET" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	dir, node := r.FormValue("dir"), r.FormValue("node")
+	path, name := r.FormValue("path"), r.FormValue("name")
+	if !filepath.IsAbs(dir) || !validBackupName(node) || !validBackupName(path) || !validPeerPath(name) {
+		m.writeError(w, fmt.Errorf("Invalid file %v/%v", path, name))
+		return
+	}
+
+	// only files listed in a backup manifest are served.
+	manifest, err := readBackupManifest(dir, node)
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	size := int64(-1)
+	for _, partn := range manifest.Partitions {
+		if partn.Path == path {
+			for _, file := range partn.Files {
+				if file.Name == name {
+					size = file.Size
+				}
+			}
+		}
+	}
+	if size < 0 {
+		m.writeError(w, fmt.Errorf("File %v/%v not found in backup", path, name))
+		return
+	}
+
+	fd, err := os.Open(filepath.Join(dir, node, path, name))
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	defer fd.Close()
+
+	cfg := m.config.Load()
+	m.peerServer.limiter.setRate(int64(cfg["rebalance.peerTransfer.rateLimit"].Int()) * 1024 * 1024)
+
+	if err := sendIndexFile(w, fd, size, &m.peerServer.limiter); err != nil {
+		l.Errorf("ServiceMgr::handleBackupFile Error sending %v/%v %v", path, name, err)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  restore
+//
+/////////////////////////////////////////////////////////////////////////
+
+func (m *ServiceMgr) handleRestoreLocalIndexData(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleRestoreLocalIndexData Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!write"}, w) {
+		return
+	}
+
+	if r.Method != "POST" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	req := new(c.IndexRestoreRequest)
+	if err := json.Unmarshal(bytes, req); err != nil {
+		m.writeError(w, err)
+		return
+	}
+	if req.Defn.InstId == 0 {
+		m.writeError(w, fmt.Errorf("Invalid restore request for index %v", req.Defn.Name))
+		return
+	}
+
+	if r.FormValue("cancel") == "true" {
+		err = m.cancelRestoreIndexData(req)
+	} else {
+		t0 := time.Now()
+		if err = m.restoreIndexData(req); err == nil {
+			l.Infof("ServiceMgr::handleRestoreLocalIndexData Restored %v partitions of %v:%v "+
+				"as instance %v. Took %v", len(req.Partitions), req.Defn.Bucket, req.Defn.Name,
+				req.Defn.InstId, time.Since(t0))
+		}
+	}
+	if err != nil {
+		l.Errorf("ServiceMgr::handleRestoreLocalIndexData Index %v:%v Error %v",
+			req.Defn.Bucket, req.Defn.Name, err)
+		m.writeError(w, err)
+		return
+	}
+	m.writeBytes(w, []byte("OK"))
+}
+
+// restoreIndexData installs the backed up partitions of index instance
+// in request. On error, partitions installed so far are removed.
+func (m *ServiceMgr) restoreIndexData(req *c.IndexRestoreRequest) error {
+
+	if req.StorageMode != c.GetStorageMode().String() {
+		return fmt.Errorf("Storage mode of backup %v does not match %v", req.StorageMode, c.GetStorageMode())
+	}
+
+	cfg := m.config.Load()
+	storageDir := cfg["storage_dir"].String()
+	inst := c.IndexInst{InstId: req.Defn.InstId, Defn: req.Defn}
+
+	var done []string
+	cleanup := func() {
+		for _, path := range done {
+			os.RemoveAll(path)
+		}
+	}
+
+	for _, rp := range req.Partitions {
+		name := IndexPath(&inst, rp.Partition.PartnId, SliceId(0))
+		if err := m.restoreIndexPartition(cfg, &rp, name); err != nil {
+			cleanup()
+			return err
+		}
+		done = append(done, filepath.Join(storageDir, name))
+	}
+
+	respch := make(chan error)
+	m.supvMsgch <- &MsgIndexRestored{instIds: []c.IndexInstId{inst.InstId}, respch: respch}
+	if err := <-respch; err != nil {
+		cleanup()
+		return err
+	}
+	return nil
+}
+
+// restoreIndexPartition copies backed up files of a partition to index
+// path `name`, verifying their checksum.
+func (m *ServiceMgr) restoreIndexPartition(cfg c.Config, rp *c.IndexRestorePartition,
+	name string) error {
+
+	dir, partn := rp.Dir, &rp.Partition
+	if !filepath.IsAbs(dir) || !validBackupName(rp.NodeUUID) || !validBackupName(partn.Path) {
+		return fmt.Errorf("Invalid partition %v of node %v in backup", partn.Path, rp.NodeUUID)
+	}
+
+	path := filepath.Join(cfg["storage_dir"].String(), name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Index path %v already exists", path)
+	}
+
+	// copy from local dir if it has the same backup of the source node.
+	var addr string
+	manifest, err := readBackupManifest(dir, rp.NodeUUID)
+	local := err == nil && findBackupPartition(manifest, partn) != nil
+	if !local {
+		addr, err = getIndexerAddrByNodeUUID(cfg["clusterAddr"].String(), rp.NodeUUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpdir := path + restoreTmpSuffix
+	os.RemoveAll(tmpdir)
+	for _, file := range partn.Files {
+		if !validPeerPath(file.Name) {
+			os.RemoveAll(tmpdir)
+			return fmt.Errorf("Invalid file %v in backup", file.Name)
+		}
+
+		var checksum uint32
+		target := filepath.Join(tmpdir, file.Name)
+		if local {
+			checksum, err = copyIndexFile(filepath.Join(dir, rp.NodeUUID, partn.Path, file.Name),
+				target, file.Size)
+		} else {
+			params := url.Values{}
+			params.Set("dir", dir)
+			params.Set("node", rp.NodeUUID)
+			params.Set("path", partn.Path)
+			params.Set("name", file.Name)
+			checksum, err = downloadIndexFile(addr+"/backupFile?"+params.Encode(), file.Size, target)
+		}
+		if err == nil && checksum != file.Checksum {
+			err = ErrPeerTransferChecksum
+		}
+		if err != nil {
+			os.RemoveAll(tmpdir)
+			return fmt.Errorf("%v: %v", file.Name, err)
+		}
+	}
+
+	if err := os.Rename(tmpdir, path); err != nil {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+	return nil
+}
+
+// cancelRestoreIndexData removes partitions installed for an index
+// instance that could not be created.
+func (m *ServiceMgr) cancelRestoreIndexData(req *c.IndexRestoreRequest) error {
+
+	respch := make(chan error)
+	m.supvMsgch <- &MsgIndexRestored{
+		instIds: []c.IndexInstId{req.Defn.InstId},
+		cancel:  true,
+		respch:  respch,
+	}
+	if err := <-respch; err != nil {
+		return err
+	}
+
+	storageDir := m.config.Load()["storage_dir"].String()
+	inst := c.IndexInst{InstId: req.Defn.InstId, Defn: req.Defn}
+	for _, rp := range req.Partitions {
+		os.RemoveAll(filepath.Join(storageDir, IndexPath(&inst, rp.Partition.PartnId, SliceId(0))))
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  indexer
+//
+/////////////////////////////////////////////////////////////////////////
+
+// recoverRestoreState loads the index instances restored from a backup,
+// that have not been built yet.
+func (idx *indexer) recoverRestoreState() {
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_GET_LOCAL,
+		key:   RestoredIndexTag,
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	resp := respMsg.(*MsgClustMgrLocal)
+
+	if err := resp.GetError(); err != nil {
+		if !strings.Contains(err.Error(), forestdb.FDB_RESULT_KEY_NOT_FOUND.Error()) {
+			l.Errorf("Indexer::recoverRestoreState Error Fetching %v From Local "+
+				"Meta Storage. Err %v", RestoredIndexTag, err)
+		}
+		return
+	}
+
+	var instIds []c.IndexInstId
+	if err := json.Unmarshal([]byte(resp.GetValue()), &instIds); err != nil {
+		l.Errorf("Indexer::recoverRestoreState Error Unmarshalling %v %v", RestoredIndexTag, err)
+		return
+	}
+	for _, instId := range instIds {
+		idx.restoredInsts[instId] = true
+	}
+
+	l.Infof("Indexer::recoverRestoreState Restored Indexes %v", instIds)
+}
+
+func (idx *indexer) handleIndexRestored(msg Message) {
+
+	req := msg.(*MsgIndexRestored)
+	respch := req.GetRespCh()
+
+	for _, instId := range req.GetInstIds() {
+		if req.IsCancel() {
+			if _, ok := idx.indexInstMap[instId]; ok {
+				respch <- fmt.Errorf("Index instance %v already exists", instId)
+				return
+			}
+			delete(idx.restoredInsts, instId)
+		} else {
+			idx.restoredInsts[instId] = true
+		}
+	}
+
+	respch <- idx.saveRestoredInsts()
+}
+
+// takeRestoredInsts return true if any index in instIdList has been
+// restored from a backup, and forgets about them.
+func (idx *indexer) takeRestoredInsts(instIdList []c.IndexInstId) bool {
+
+	restored := false
+	for _, instId := range instIdList {
+		if idx.restoredInsts[instId] {
+			delete(idx.restoredInsts, instId)
+			restored = true
+		}
+	}
+
+	if restored {
+		if err := idx.saveRestoredInsts(); err != nil {
+			l.Errorf("Indexer::takeRestoredInsts Error saving %v %v", RestoredIndexTag, err)
+		}
+	}
+	return restored
+}
+
+func (idx *indexer) saveRestoredInsts() error {
+
+	instIds := make([]c.IndexInstId, 0, len(idx.restoredInsts))
+	for instId := range idx.restoredInsts {
+		instIds = append(instIds, instId)
+	}
+	value, err := json.Marshal(instIds)
+	if err != nil {
+		return err
+	}
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_SET_LOCAL,
+		key:   RestoredIndexTag,
+		value: string(value),
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	return respMsg.(*MsgClustMgrLocal).GetError()
+}
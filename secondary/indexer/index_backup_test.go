@@ -0,0 +1,146 @@
+package indexer
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestBackupIndexFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "data.fdb")
+	if err := ioutil.WriteFile(src, []byte("abcdefgh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the persisted size of append only files is copied.
+	node := "6c0c3d4b2fa37e1a"
+	path := "default_idx_1_0.index"
+	checksum, err := copyIndexFile(src, filepath.Join(dir, node, path, "data.fdb"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != crc32.Checksum([]byte("abcd"), crc32Table) {
+		t.Errorf("unexpected checksum %v", checksum)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, node, path, "data.fdb"))
+	if err != nil || string(data) != "abcd" {
+		t.Errorf("unexpected copy %q %v", data, err)
+	}
+	if _, err := copyIndexFile(src, filepath.Join(dir, "short"), 16); err == nil {
+		t.Errorf("expected error copying past end of file")
+	}
+
+	partn := c.IndexBackupPartition{
+		InstId:  1,
+		PartnId: 0,
+		Path:    path,
+		Files:   []c.IndexBackupFile{{Name: "data.fdb", Size: 4, Checksum: checksum}},
+	}
+	out, err := json.Marshal(&c.IndexBackupManifest{NodeUUID: node, Partitions: []c.IndexBackupPartition{partn}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, node, c.IndexBackupManifestName), out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readBackupManifest(dir, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findBackupPartition(manifest, &partn) == nil {
+		t.Errorf("expected partition in backup")
+	}
+	partn.Files[0].Checksum++
+	if findBackupPartition(manifest, &partn) != nil {
+		t.Errorf("partition from a different backup should not match")
+	}
+}
+
+func TestValidBackupName(t *testing.T) {
+	testcases := map[string]bool{
+		"default_idx_1_0.index": true,
+		"6c0c3d4b2fa37e1a":      true,
+		"snapshot.1/data":       false,
+		"..":                    false,
+		"":                      false,
+	}
+	for name, valid := range testcases {
+		if validBackupName(name) != valid {
+			t.Errorf("%q: expected valid %v", name, valid)
+		}
+	}
+}
+
+func TestBackupIndexPartitionStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storageDir, backupDir := filepath.Join(dir, "data"), filepath.Join(dir, "backup")
+
+	inst := c.IndexInst{InstId: 1, Defn: c.IndexDefn{Bucket: "default", Name: "idx"}}
+	name := IndexPath(&inst, 0, SliceId(0))
+	if err := os.MkdirAll(filepath.Join(storageDir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storageDir, name, "data.fdb"), []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newTs := func(seqno uint64) *c.TsVbuuid {
+		ts := c.NewTsVbuuid("default", 4)
+		ts.Seqnos[0] = seqno
+		return ts
+	}
+
+	// storage manager lists a newer snapshot after the first staging.
+	replies := []*c.TsVbuuid{newTs(20), newTs(20)}
+	supvMsgch := make(MsgChannel)
+	go func() {
+		for msg := range supvMsgch {
+			req := msg.(*MsgIndexBackupSnapshot)
+			if req.GetInstId() != inst.InstId || req.GetPartitionId() != 0 {
+				t.Errorf("unexpected request for %v/%v", req.GetInstId(), req.GetPartitionId())
+			}
+			ts := replies[0]
+			replies = replies[1:]
+			req.GetReplyChannel() <- []indexBackupSnapshot{{inst: inst, ts: ts}}
+		}
+	}()
+	defer close(supvMsgch)
+
+	m := &ServiceMgr{supvMsgch: supvMsgch, peerServer: newPeerTransferServer(storageDir)}
+	partn, err := m.backupIndexPartition(storageDir, backupDir, indexBackupSnapshot{inst: inst, ts: newTs(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partn.Ts.Equal(newTs(20)) {
+		t.Errorf("expected timestamp of staged snapshot, got %v", partn.Ts)
+	}
+	if len(partn.Files) != 1 || partn.Files[0].Size != 4 {
+		t.Errorf("unexpected files %v", partn.Files)
+	}
+	if staged, _ := ioutil.ReadDir(filepath.Join(storageDir, peerStagingDir)); len(staged) != 0 {
+		t.Errorf("expected staged files to be removed, got %v", len(staged))
+	}
+
+	// data of plasma indexes is not backed up
+	defer c.SetStorageMode(c.GetStorageMode())
+	c.SetStorageMode(c.PLASMA)
+	if _, err := m.backupIndexPartition(storageDir, backupDir, indexBackupSnapshot{inst: inst, ts: newTs(20)}); err != ErrPeerTransferUnsupported {
+		t.Errorf("expected %v, got %v", ErrPeerTransferUnsupported, err)
+	}
+}
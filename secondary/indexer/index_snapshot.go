@@ -38,6 +38,7 @@ type PartitionSnapshot interface {
 type SliceSnapshot interface {
 	SliceId() SliceId
 	Snapshot() Snapshot
+	Aggregates() *aggrSnapshot
 }
 
 type indexSnapshot struct {
@@ -79,6 +80,7 @@ func (ps *partitionSnapshot) Slices() map[SliceId]SliceSnapshot {
 type sliceSnapshot struct {
 	id   SliceId
 	snap Snapshot
+	aggr *aggrSnapshot
 }
 
 func (ss *sliceSnapshot) SliceId() SliceId {
@@ -89,6 +91,10 @@ func (ss *sliceSnapshot) Snapshot() Snapshot {
 	return ss.snap
 }
 
+func (ss *sliceSnapshot) Aggregates() *aggrSnapshot {
+	return ss.aggr
+}
+
 func DestroyIndexSnapshot(is IndexSnapshot) error {
 	if is == nil {
 		return nil
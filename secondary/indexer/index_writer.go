@@ -24,6 +24,11 @@ type StorageStatistics struct {
 	InsertBytes int64
 	DeleteBytes int64
 
+	// Prefix compression dictionary size and bytes saved by
+	// prefix compressed entries
+	PrefixDictSize   int64
+	PrefixSavedBytes int64
+
 	NeedUpgrade bool
 
 	InternalData []string
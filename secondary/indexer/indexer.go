@@ -148,9 +148,12 @@ type indexer struct {
 
 	rebalanceRunning   bool
 	rebalanceToken     *RebalanceToken
+	restoredInsts      map[common.IndexInstId]bool
 	mergePartitionList []mergeSpec
 	prunePartitionList []pruneSpec
 
+	pausedRebuildMemUsed map[common.IndexInstId]int64 //memory used by aborted rebuild of paused index
+
 	bootstrapStorageMode common.StorageMode
 }
 
@@ -201,6 +204,9 @@ func NewIndexer(config common.Config) (Indexer, Message) {
 
 		indexInstMap:  make(common.IndexInstMap),
 		indexPartnMap: make(IndexPartnMap),
+		restoredInsts: make(map[common.IndexInstId]bool),
+
+		pausedRebuildMemUsed: make(map[common.IndexInstId]int64),
 
 		streamBucketStatus:           make(map[common.StreamId]BucketStatus),
 		streamBucketFlushInProgress:  make(map[common.StreamId]BucketFlushInProgressMap),
@@ -901,7 +907,8 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 		//fwd the message to kv_sender
 		idx.sendMsgToKVSender(msg)
 
-	case STORAGE_STATS:
+	case STORAGE_STATS,
+		STORAGE_INDEX_BACKUP_SNAPSHOT:
 		idx.storageMgrCmdCh <- msg
 		<-idx.storageMgrCmdCh
 
@@ -960,6 +967,15 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 	case INDEXER_CANCEL_MERGE_PARTITION:
 		idx.handleCancelMergePartition(msg)
 
+	case INDEXER_INDEX_RESTORED:
+		idx.handleIndexRestored(msg)
+
+	case INDEXER_SWAP_INDEX_INST:
+		idx.handleSwapIndexInst(msg)
+
+	case INDEXER_CHECK_MEM_QUOTA:
+		idx.handleCheckIndexMemQuota(msg)
+
 	default:
 		logging.Fatalf("Indexer::handleWorkerMsgs Unknown Message %+v", msg)
 		common.CrashOnError(errors.New("Unknown Msg On Worker Channel"))
@@ -1100,6 +1116,12 @@ func (idx *indexer) handleAdminMsgs(msg Message) {
 	case CLUST_MGR_PRUNE_PARTITION:
 		idx.handlePrunePartition(msg)
 
+	case CLUST_MGR_UPDATE_AGGREGATES:
+		idx.handleUpdateAggregates(msg)
+
+	case CLUST_MGR_UPDATE_MEM_QUOTA:
+		idx.handleUpdateMemQuota(msg)
+
 	case MSG_ERROR:
 
 		logging.Fatalf("Indexer::handleAdminMsgs Fatal Error On Admin Channel %+v", msg)
@@ -1188,7 +1210,7 @@ func (idx *indexer) handleCreateIndex(msg Message) {
 
 		reqCtx := msg.(*MsgCreateIndex).GetRequestCtx()
 
-		if reqCtx != nil && reqCtx.ReqSource == common.DDLRequestSourceUser {
+		if reqCtx != nil && reqCtx.ReqSource != common.DDLRequestSourceRebalance {
 
 			errStr := fmt.Sprintf("Indexer Cannot Process Create Index - Rebalance In Progress")
 			logging.Errorf("Indexer::handleCreateIndex %v", errStr)
@@ -1227,7 +1249,7 @@ func (idx *indexer) handleCreateIndex(msg Message) {
 	}
 
 	//check if this is duplicate index instance
-	if ok := idx.checkDuplicateIndex(indexInst, clientCh); !ok {
+	if ok := idx.checkDuplicateIndex(indexInst, msg.(*MsgCreateIndex).GetRequestCtx(), clientCh); !ok {
 		return
 	}
 
@@ -1785,6 +1807,41 @@ func (idx *indexer) handlePrunePartition(msg Message) {
 	respch <- &MsgSuccess{}
 }
 
+//
+// Update the precomputed aggregates of all instances of an index.
+// Storage manager maintains the aggregate tables as per the new
+// index definition.
+//
+func (idx *indexer) handleUpdateAggregates(msg Message) {
+
+	defnId := msg.(*MsgClustMgrUpdateAggregates).GetDefnId()
+	aggregates := msg.(*MsgClustMgrUpdateAggregates).GetAggregates()
+	respch := msg.(*MsgClustMgrUpdateAggregates).GetRespCh()
+
+	updated := false
+	for instId, inst := range idx.indexInstMap {
+		if inst.Defn.DefnId == defnId {
+			inst.Defn.Aggregates = aggregates
+			idx.indexInstMap[instId] = inst
+			updated = true
+		}
+	}
+
+	if updated {
+		logging.Infof("Indexer::handleUpdateAggregates Index %v Aggregates %v", defnId, aggregates)
+
+		msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+		msgUpdateIndexPartnMap := &MsgUpdatePartnMap{indexPartnMap: idx.indexPartnMap}
+		if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, msgUpdateIndexPartnMap); err != nil {
+			common.CrashOnError(err)
+		}
+	} else {
+		logging.Warnf("Indexer::handleUpdateAggregates Index %v not found. Skip", defnId)
+	}
+
+	respch <- &MsgSuccess{}
+}
+
 func (idx *indexer) prunePartitions() {
 
 	// Do not merge when indexer is not active
@@ -2101,8 +2158,12 @@ func (idx *indexer) handleBuildIndex(msg Message) {
 			common.CrashOnError(err)
 		}
 
+		//indexes transferred from a peer during rebalance catch up from
+		//the transferred snapshot
+		restartTs := idx.makeBuildRestartTs(instIdList)
+
 		//send Stream Update to workers
-		idx.sendStreamUpdateForBuildIndex(instIdList, buildStream, bucket, buildTs, clientCh)
+		idx.sendStreamUpdateForBuildIndex(instIdList, buildStream, bucket, buildTs, restartTs, clientCh)
 
 		idx.stateLock.Lock()
 		if _, ok := idx.streamBucketStatus[buildStream]; !ok {
@@ -2204,11 +2265,12 @@ func (idx *indexer) handleDropIndex(msg Message) {
 
 	idx.stats.RemoveIndex(indexInst.InstId)
 
-	//if the index state is Created/Ready/Deleted, only data cleanup is
-	//required. No stream updates are required.
+	//if the index state is Created/Ready/Deleted, or its ingestion is
+	//paused, only data cleanup is required. No stream updates are required.
 	if indexInst.State == common.INDEX_STATE_CREATED ||
 		indexInst.State == common.INDEX_STATE_READY ||
-		indexInst.State == common.INDEX_STATE_DELETED {
+		indexInst.State == common.INDEX_STATE_DELETED ||
+		(indexInst.Paused && indexInst.Stream == common.NIL_STREAM) {
 
 		idx.cleanupIndexData(indexInst, clientCh)
 		logging.Infof("Indexer::handleDropIndex Cleanup Successful for "+
@@ -2697,8 +2759,8 @@ func (idx *indexer) cleanupIndex(indexInst common.IndexInst,
 		return
 	}
 
-	// if it is a proxy
-	if indexInst.RealInstId != 0 && indexInst.RealInstId != indexInst.InstId {
+	// if it is a proxy (other than one rebuilding its real instance)
+	if indexInst.RealInstId != 0 && indexInst.RealInstId != indexInst.InstId && !indexInst.Rebuild {
 		// build for proxy is done.   The projector could be sending mutations to the real index inst on proxy partitions.
 		if indexInst.State == common.INDEX_STATE_CATCHUP || indexInst.State == common.INDEX_STATE_ACTIVE {
 			if realInst, ok := idx.indexInstMap[indexInst.RealInstId]; ok {
@@ -2833,7 +2895,8 @@ func (idx *indexer) Shutdown() Message {
 }
 
 func (idx *indexer) sendStreamUpdateForBuildIndex(instIdList []common.IndexInstId,
-	buildStream common.StreamId, bucket string, buildTs Timestamp, clientCh MsgChannel) bool {
+	buildStream common.StreamId, bucket string, buildTs Timestamp,
+	restartTs *common.TsVbuuid, clientCh MsgChannel) bool {
 
 	var cmd Message
 	var indexList []common.IndexInst
@@ -2852,7 +2915,7 @@ func (idx *indexer) sendStreamUpdateForBuildIndex(instIdList []common.IndexInstI
 		indexList:    indexList,
 		buildTs:      buildTs,
 		respCh:       respCh,
-		restartTs:    nil,
+		restartTs:    restartTs,
 		rollbackTime: idx.bucketRollbackTimes[bucket]}
 
 	//send stream update to timekeeper
@@ -2926,6 +2989,18 @@ func (idx *indexer) sendStreamUpdateForBuildIndex(instIdList []common.IndexInstI
 					}
 
 				case INDEXER_ROLLBACK:
+					//a build restarting from a transferred snapshot can get
+					//rollback, if the snapshot is not valid on this node.
+					if restartTs != nil {
+						logging.Infof("Indexer::sendStreamUpdateForBuildIndex Rollback from "+
+							"Projector For Stream %v Bucket %v", buildStream, bucket)
+						rollbackTs := resp.(*MsgRollback).GetRollbackTs()
+						idx.internalRecvCh <- &MsgRecovery{mType: INDEXER_INIT_PREP_RECOVERY,
+							streamId:  buildStream,
+							bucket:    bucket,
+							restartTs: rollbackTs}
+						break retryloop
+					}
 					//an initial build request should never receive rollback message
 					logging.Errorf("Indexer::sendStreamUpdateForBuildIndex Unexpected Rollback from "+
 						"Projector during Initial Stream Request %v", resp)
@@ -3265,7 +3340,7 @@ func (idx *indexer) initStreamTopicName() {
 //checkDuplicateIndex checks if an index with the given indexInstId
 // or name already exists
 func (idx *indexer) checkDuplicateIndex(indexInst common.IndexInst,
-	respCh MsgChannel) bool {
+	reqCtx *common.MetadataRequestContext, respCh MsgChannel) bool {
 
 	//if the indexInstId already exists, return error
 	if index, ok := idx.indexInstMap[indexInst.InstId]; ok {
@@ -3283,10 +3358,17 @@ func (idx *indexer) checkDuplicateIndex(indexInst common.IndexInst,
 	}
 
 	//if the index name already exists for the same bucket,
-	//return error
+	//return error. An index being rebuilt has another
+	//instance of the same index.
 	if !common.IsPartitioned(indexInst.Defn.PartitionScheme) {
+		isRebuild := reqCtx != nil && reqCtx.ReqSource == common.DDLRequestSourceRebuild
+
 		for _, index := range idx.indexInstMap {
 
+			if isRebuild && index.Defn.DefnId == indexInst.Defn.DefnId {
+				continue
+			}
+
 			if index.Defn.Name == indexInst.Defn.Name &&
 				index.Defn.Bucket == indexInst.Defn.Bucket &&
 				index.State != common.INDEX_STATE_DELETED {
@@ -3485,8 +3567,10 @@ func (idx *indexer) handleInitialBuildDone(msg Message) {
 	// If index is a proxy, add the real index instance to the list.  This will
 	// also update the partition list of the real index instance in projector.
 	// Note that the real inst should be active or being built at the same time as the proxy.
+	// A proxy rebuilding its real instance has partitions of its own.
 	for _, index := range indexList {
-		if common.IsPartitioned(index.Defn.PartitionScheme) && index.RealInstId != 0 && index.InstId != index.RealInstId {
+		if common.IsPartitioned(index.Defn.PartitionScheme) && index.RealInstId != 0 && index.InstId != index.RealInstId &&
+			!index.Rebuild {
 			if realInst, ok := idx.indexInstMap[index.RealInstId]; ok {
 				indexList = append(indexList, realInst)
 			} else {
@@ -4148,6 +4232,7 @@ func (idx *indexer) bootstrap(snapshotNotifych chan IndexSnapshot) (bool, error)
 	idx.closeAllStreams()
 
 	idx.recoverRebalanceState()
+	idx.recoverRestoreState()
 
 	//recover indexes from local metadata
 	needsRestart, err := idx.initFromPersistedState()
@@ -4155,6 +4240,8 @@ func (idx *indexer) bootstrap(snapshotNotifych chan IndexSnapshot) (bool, error)
 		return needsRestart, err
 	}
 
+	idx.recoverMemQuotaState()
+
 	//Start Storage Manager
 	var res Message
 	idx.storageMgr, res = NewStorageManager(idx.storageMgrCmdCh, idx.wrkrRecvCh,
@@ -4825,6 +4912,37 @@ func (idx *indexer) startStreams() bool {
 
 }
 
+//makeBuildRestartTs returns the timestamp to restart the stream from,
+//for indexes whose data has been transferred from a peer indexer
+//during rebalance or restored from a backup. Returns nil if the
+//indexes need an initial build.
+func (idx *indexer) makeBuildRestartTs(instIdList []common.IndexInstId) *common.TsVbuuid {
+
+	restored := idx.takeRestoredInsts(instIdList)
+	if !restored {
+		if !idx.rebalanceRunning && idx.rebalanceToken == nil {
+			return nil
+		}
+		if !idx.config["rebalance.peerTransfer.enable"].Bool() {
+			return nil
+		}
+	}
+
+	respch := make(chan *common.TsVbuuid, 1)
+	idx.storageMgrCmdCh <- &MsgIndexOpenSnapshot{
+		instIds: instIdList,
+		respch:  respch,
+	}
+	<-idx.storageMgrCmdCh
+
+	restartTs := <-respch
+	if restartTs != nil {
+		logging.Infof("Indexer::makeBuildRestartTs Indexes %v restart from snapshot %v. "+
+			"Restored from backup %v", instIdList, restartTs, restored)
+	}
+	return restartTs
+}
+
 func (idx *indexer) makeRestartTs(streamId common.StreamId) map[string]*common.TsVbuuid {
 
 	restartTs := make(map[string]*common.TsVbuuid)
@@ -5578,8 +5696,16 @@ func (idx *indexer) monitorMemUsage() {
 			switch idx.getIndexerState() {
 
 			case common.INDEXER_ACTIVE:
-				if float64(mem_used) > (high_mem_mark*float64(memory_quota)) &&
-					!canResume && mem_used > min_oom_mem {
+				highMem := float64(mem_used) > (high_mem_mark*float64(memory_quota)) &&
+					mem_used > min_oom_mem
+
+				//pause ingestion of indexes over their quota, and of
+				//low priority indexes first if memory is running out
+				if idx.checkIndexMemQuota(mem_used, highMem) {
+					highMem = false
+				}
+
+				if highMem && !canResume {
 					idx.internalRecvCh <- &MsgIndexerState{mType: INDEXER_PAUSE}
 					canResume = true
 				}
@@ -5783,6 +5909,13 @@ func (idx *indexer) memoryUsed(forceRefresh bool) (uint64, uint64) {
 		gMemstatCacheLastUpdated = time.Now()
 	}
 
+	return memstatsMemoryUsed(&ms)
+}
+
+//memstatsMemoryUsed returns total and idle memory used by indexer
+//for the given memstats
+func memstatsMemoryUsed(ms *runtime.MemStats) (uint64, uint64) {
+
 	mem_used := ms.HeapInuse + ms.HeapIdle - ms.HeapReleased + ms.GCSys + forestdb.BufferCacheUsed()
 	mode := common.GetStorageMode()
 	if mode == common.MOI || mode == common.PLASMA {
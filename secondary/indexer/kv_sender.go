@@ -1135,7 +1135,7 @@ func convertIndexListToProto(cfg c.Config, cinfo *c.ClusterInfoCache, indexList
 	}
 
 	for _, index := range indexList {
-		if c.IsPartitioned(index.Defn.PartitionScheme) && index.RealInstId != 0 {
+		if c.IsPartitioned(index.Defn.PartitionScheme) && index.RealInstId != 0 && !index.Rebuild {
 			for _, protoInst := range protoList {
 				if protoInst.IndexInstance.GetInstId() == uint64(index.RealInstId) {
 					addPartnInfoToProtoInst(cfg, cinfo, index, streamId, protoInst.IndexInstance)
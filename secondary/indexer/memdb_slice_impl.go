@@ -43,6 +43,8 @@ const (
 
 const tmpDirName = ".tmp"
 
+const prefixDictFileName = "prefix.dict"
+
 type indexMutation struct {
 	op    int
 	key   []byte
@@ -90,6 +92,12 @@ func nodeEquality(p unsafe.Pointer, entry []byte) bool {
 	return bytes.Equal(docid1, docid2)
 }
 
+func nodeItemBytes(p unsafe.Pointer) []byte {
+	node := (*skiplist.Node)(p)
+	itm := (*memdb.Item)(node.Item())
+	return itm.Bytes()
+}
+
 func byteItemCompare(a, b []byte) int {
 	return bytes.Compare(a, b)
 }
@@ -171,6 +179,11 @@ type memdbSlice struct {
 
 	encodeBuf [][]byte
 	arrayBuf  [][]byte
+
+	// Prefix compression of non-array secondary index entries
+	prefixDict        *prefixDictionary
+	prefixCompression bool
+	compressBuf       [][]byte
 }
 
 func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
@@ -208,6 +221,7 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 
 	slice.encodeBuf = make([][]byte, slice.numWriters)
 	slice.arrayBuf = make([][]byte, slice.numWriters)
+	slice.compressBuf = make([][]byte, slice.numWriters)
 	slice.cmdCh = make([]chan indexMutation, slice.numWriters)
 
 	for i := 0; i < slice.numWriters; i++ {
@@ -220,6 +234,10 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 
 	slice.isPrimary = isPrimary
 	slice.hasPersistence = hasPersistance
+	slice.prefixCompression = !isPrimary && !idxDefn.IsArrayIndex &&
+		sysconf["settings.prefix_compression.enable"].Bool()
+	slice.prefixDict = newPrefixDictionary(sysconf["settings.prefix_compression.min_prefix_len"].Int(),
+		sysconf["settings.prefix_compression.max_dict_entries"].Int())
 	slice.initStores()
 
 	// Array related initialization
@@ -251,7 +269,14 @@ func (slice *memdbSlice) initStores() {
 		cfg.UseDeltaInterleaving()
 	}
 
-	cfg.SetKeyComparator(byteItemCompare)
+	if slice.isPrimary {
+		cfg.SetKeyComparator(byteItemCompare)
+	} else {
+		// Entries may be prefix compressed. Comparator is always required
+		// as entries persisted with compression enabled can be recovered
+		// after it is disabled.
+		cfg.SetKeyComparator(slice.prefixDict.Compare)
+	}
 	slice.mainstore = memdb.NewWithConfig(cfg)
 	slice.main = make([]*memdb.Writer, slice.numWriters)
 	for i := 0; i < slice.numWriters; i++ {
@@ -397,14 +422,21 @@ func (mdb *memdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) in
 		return mdb.deleteSecIndex(docid, workerId)
 	}
 
+	if mdb.prefixCompression {
+		mdb.compressBuf[workerId] = resizeEncodeBuf(mdb.compressBuf[workerId], len(entry), true)
+		entry = mdb.prefixDict.Compress(entry, mdb.compressBuf[workerId])
+	}
+
 	newNode := mdb.main[workerId].Put2(entry)
 	mdb.idxStats.Timings.stKVSet.Put(time.Now().Sub(t0))
 	atomic.AddInt64(&mdb.insert_bytes, int64(len(docid)+len(entry)))
 
 	// Insert succeeded. Failure means same entry already exist.
 	if newNode != nil {
+		mdb.prefixDict.trackInsert(entry)
 		if updated, oldNode := mdb.back[workerId].Update(entry, unsafe.Pointer(newNode)); updated {
 			t0 := time.Now()
+			mdb.prefixDict.trackDelete(nodeItemBytes(oldNode))
 			mdb.main[workerId].DeleteNode((*skiplist.Node)(oldNode))
 			mdb.idxStats.Timings.stKVDelete.Put(time.Since(t0))
 			atomic.AddInt64(&mdb.delete_bytes, int64(len(docid)))
@@ -572,6 +604,7 @@ func (mdb *memdbSlice) deleteSecIndex(docid []byte, workerId int) int {
 		mdb.idxStats.Timings.stKVDelete.Put(time.Since(t0))
 		atomic.AddInt64(&mdb.delete_bytes, int64(len(docid)))
 		t0 = time.Now()
+		mdb.prefixDict.trackDelete(nodeItemBytes(node))
 		mdb.main[workerId].DeleteNode((*skiplist.Node)(node))
 		mdb.idxStats.Timings.stKVDelete.Put(time.Since(t0))
 	}
@@ -698,6 +731,12 @@ func (mdb *memdbSlice) doPersistSnapshot(s *memdbSnapshot) {
 
 		mdb.confLock.RUnlock()
 		err := mdb.mainstore.StoreToDisk(tmpdir, s.info.MainSnap, concurrency, nil)
+		if err == nil && !mdb.isPrimary && mdb.prefixDict.Count() > 0 {
+			// Dictionary is append only. Its current version covers
+			// all the entries in the snapshot.
+			bs, _ := mdb.prefixDict.Bytes()
+			err = ioutil.WriteFile(filepath.Join(tmpdir, prefixDictFileName), bs, 0755)
+		}
 		if err == nil {
 			var fd *os.File
 			var bs []byte
@@ -817,6 +856,9 @@ func (mdb *memdbSlice) resetStores() {
 		}
 	}
 
+	// Savings are tracked again for the entries of the snapshot loaded
+	// into the new stores
+	mdb.prefixDict.setSavings(0)
 	mdb.initStores()
 }
 
@@ -878,6 +920,21 @@ func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) (err error) {
 	logging.Infof("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v reading %v",
 		mdb.id, mdb.idxInstId, snapInfo.dataPath)
 
+	// Prefix dictionary is required by the comparator during recovery
+	if !mdb.isPrimary {
+		var bs []byte
+		dictFile := filepath.Join(snapInfo.dataPath, prefixDictFileName)
+		if bs, err = ioutil.ReadFile(dictFile); err == nil {
+			err = mdb.prefixDict.Load(bs)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
 	t0 := time.Now()
 	if !mdb.isPrimary {
 		for wId := 0; wId < mdb.numWriters; wId++ {
@@ -888,6 +945,7 @@ func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) (err error) {
 				for entry := range partShardCh[i] {
 					if !mdb.isPrimary {
 						entryBytes := entry.Item().Bytes()
+						mdb.prefixDict.trackInsert(entryBytes)
 						if updated, oldPtr := mdb.back[i].Update(entryBytes, unsafe.Pointer(entry.Node())); updated {
 							oldNode := (*skiplist.Node)(oldPtr)
 							entry.Node().SetLink(oldNode)
@@ -1126,8 +1184,10 @@ func (mdb *memdbSlice) Statistics() (StorageStatistics, error) {
 
 	sts.InternalData = internalData
 	sts.DataSize = mdb.mainstore.MemoryInUse()
-	sts.MemUsed = mdb.mainstore.MemoryInUse() + ntMemUsed
+	sts.MemUsed = mdb.mainstore.MemoryInUse() + ntMemUsed + mdb.prefixDict.Size()
 	sts.DiskSize = mdb.diskSize()
+	sts.PrefixDictSize = mdb.prefixDict.Size()
+	sts.PrefixSavedBytes = mdb.prefixDict.SavedBytes()
 	return sts, nil
 }
 
@@ -1446,6 +1506,7 @@ func (s *memdbSnapshot) Iterate(ctx IndexReaderContext, low, high IndexKey, incl
 	cmpFn CmpEntry, callback EntryCallback) error {
 	var entry IndexEntry
 	var err error
+	var expandBuf []byte
 	t0 := time.Now()
 	it := s.info.MainSnap.NewIterator()
 	defer it.Close()
@@ -1467,7 +1528,7 @@ func (s *memdbSnapshot) Iterate(ctx IndexReaderContext, low, high IndexKey, incl
 
 loop:
 	for it.Valid() {
-		itm := it.Get()
+		itm := s.expandItem(it.Get(), &expandBuf)
 		s.newIndexEntry(itm, &entry)
 
 		// Iterator has reached past the high key, no need to scan further
@@ -1498,6 +1559,17 @@ func (s *memdbSnapshot) isPrimary() bool {
 	return s.slice.isPrimary
 }
 
+// Returns the item in original encoding. Prefix compressed items
+// are expanded into buf.
+func (s *memdbSnapshot) expandItem(itm []byte, buf *[]byte) []byte {
+	if s.slice.isPrimary || len(itm) == 0 || itm[0] != prefixCompressedMarker {
+		return itm
+	}
+
+	*buf = s.slice.prefixDict.Expand(itm, *buf)
+	return *buf
+}
+
 func (s *memdbSnapshot) newIndexEntry(b []byte, entry *IndexEntry) {
 	var err error
 
@@ -1514,8 +1586,9 @@ func (s *memdbSnapshot) iterEqualKeys(k IndexKey, it *memdb.Iterator,
 	var err error
 
 	var entry IndexEntry
+	var expandBuf []byte
 	for ; it.Valid(); it.Next() {
-		itm := it.Get()
+		itm := s.expandItem(it.Get(), &expandBuf)
 		s.newIndexEntry(itm, &entry)
 		if cmpFn(k, entry) == 0 {
 			if callback != nil {
@@ -3,7 +3,10 @@ package indexer
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"testing"
@@ -172,3 +175,93 @@ func TestMemDBInsertionPerf(t *testing.T) {
 		}
 	}
 }
+
+func TestMemDBSlicePrefixSavingsRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdbslice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := &IndexStats{}
+	stats.Init()
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("numSliceWriters", 1)
+	cfg.SetValue("settings.prefix_compression.enable", true)
+	cfg.SetValue("settings.prefix_compression.min_prefix_len", 4)
+	idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(1), SecExprs: []string{"`tenant`", "`n`"}}
+	slice, err := NewMemDBSlice(filepath.Join(dir, "slice"), SliceId(0), idxDefn,
+		common.IndexInstId(1), false, true, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slice.Destroy()
+	defer slice.Close()
+
+	for i := 0; i < 100; i++ {
+		meta := NewMutationMeta()
+		meta.vbucket = Vbucket(0)
+		key := []byte(fmt.Sprintf(`["tenant-000001",%d]`, i))
+		if err := slice.Insert(key, []byte(fmt.Sprintf("doc-%d", i)), meta); err != nil {
+			t.Fatal(err)
+		}
+		meta.Free()
+	}
+
+	savedBytes := func() int64 {
+		sts, err := slice.Statistics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sts.PrefixSavedBytes
+	}
+
+	ts := common.NewTsVbuuid("default", cfg["numVbuckets"].Int())
+	info, err := slice.NewSnapshot(ts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slice.OpenSnapshot(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := savedBytes()
+	if saved <= 0 {
+		t.Fatalf("expected prefix savings, got %v", saved)
+	}
+
+	// wait for the snapshot to be persisted
+	var infos []SnapshotInfo
+	for i := 0; len(infos) == 0; i++ {
+		if i == 100 {
+			t.Fatal("snapshot not persisted")
+		}
+		time.Sleep(100 * time.Millisecond)
+		infos, _ = slice.GetSnapshots()
+	}
+	snap.Close()
+
+	for i := 0; i < 2; i++ {
+		// snapshot info is loaded afresh from disk, as on recovery
+		infos, _ = slice.GetSnapshots()
+		if err := slice.Rollback(infos[0]); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := slice.OpenSnapshot(infos[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap.Close()
+
+		if s := savedBytes(); s != saved {
+			t.Errorf("expected %v saved bytes after rollback %v, got %v", saved, i, s)
+		}
+	}
+
+	if err := slice.RollbackToZero(); err != nil {
+		t.Fatal(err)
+	}
+	if s := savedBytes(); s != 0 {
+		t.Errorf("expected no saved bytes after rollback to zero, got %v", s)
+	}
+}
@@ -0,0 +1,424 @@
+// @copyright 2019 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package indexer
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	forestdb "github.com/couchbase/indexing/secondary/fdb"
+	l "github.com/couchbase/indexing/secondary/logging"
+)
+
+// Memory quota and priority of memory optimized indexes.
+//
+// An index can be given a memory quota, for each node hosting it, and a
+// priority (low, medium, high) with the WITH clause of CREATE INDEX or
+// with ALTER INDEX. Along with the memory check of the indexer, ingestion
+// of an index is paused, on its own, when
+//
+//   - it uses more memory than its quota, unless it has high priority.
+//     The quota of a high priority index is only reported in stats.
+//   - the indexer runs out of memory. Low priority indexes are paused
+//     one at a time, the largest first, before the indexer pauses
+//     ingestion of all indexes.
+//
+// A paused index is removed from the maintenance stream, so that it does
+// not hold up the shared mutation queue. Its data stays at its last
+// snapshot, and scans on it fail as the data is stale. As it is stopped,
+// the memory used by a paused index does not change: it is rebuilt online
+// once it fits in its quota, after ALTER INDEX raised or removed the quota
+// or made it high priority, and the indexer has room to build it. An index
+// paused on indexer memory fits in its quota, and it is rebuilt as soon as
+// the indexer has room. The proxy rebuilding the index is checked against
+// the quota of the index too, the rebuild is aborted if it gets over it.
+// The paused index then needs a larger quota, the memory used by the
+// aborted proxy, to be rebuilt again.
+
+const PausedIndexTag = "PausedIndexes"
+
+// memQuotaDecision is the outcome of a memory quota check.
+type memQuotaDecision struct {
+	pause   []c.IndexInstId // instances over their quota to pause
+	evict   c.IndexInstId   // low priority instance to pause on high memory
+	rebuild []c.IndexInstId // paused instances to rebuild
+	abort   []c.IndexInstId // proxies rebuilding an index over its quota
+}
+
+// decideIndexMemQuota checks the memory used by each index instance
+// against its quota, and the memory used by the indexer against its
+// quota if highMem is set. rebuildUsed is the memory used by the aborted
+// rebuilds of paused instances.
+func decideIndexMemQuota(indexInstMap c.IndexInstMap, memUsed, rebuildUsed map[c.IndexInstId]int64,
+	nodeMemUsed, nodeMemQuota uint64, lowMemMark float64, highMem bool) *memQuotaDecision {
+
+	decision := &memQuotaDecision{}
+
+	instIds := make([]c.IndexInstId, 0, len(indexInstMap))
+	for instId := range indexInstMap {
+		instIds = append(instIds, instId)
+	}
+	sort.Slice(instIds, func(i, j int) bool { return instIds[i] < instIds[j] })
+
+	for _, instId := range instIds {
+		inst := indexInstMap[instId]
+		if inst.State == c.INDEX_STATE_DELETED {
+			continue
+		}
+
+		used := memUsed[instId]
+		quota := int64(inst.Defn.MemQuota)
+		priority := inst.Defn.Priority
+		fits := func(used int64) bool {
+			return priority == c.INDEX_PRIORITY_HIGH || quota == 0 || used <= quota
+		}
+
+		if inst.IsProxy() {
+			if inst.Rebuild && !fits(used) {
+				decision.abort = append(decision.abort, instId)
+			}
+			continue
+		}
+
+		if inst.RState != c.REBAL_ACTIVE {
+			continue
+		}
+
+		if inst.Paused {
+			size := used
+			if rebuildUsed[instId] > size {
+				size = rebuildUsed[instId]
+			}
+			// room for the index being rebuilt, next to the paused one
+			room := float64(nodeMemUsed+uint64(size)) < lowMemMark*float64(nodeMemQuota)
+			if fits(size) && room && inst.State == c.INDEX_STATE_ACTIVE {
+				decision.rebuild = append(decision.rebuild, instId)
+			}
+			continue
+		}
+
+		if inst.State != c.INDEX_STATE_ACTIVE || inst.Stream != c.MAINT_STREAM {
+			continue
+		}
+
+		if !fits(used) {
+			decision.pause = append(decision.pause, instId)
+		} else if highMem && priority == c.INDEX_PRIORITY_LOW && used > memUsed[decision.evict] {
+			decision.evict = instId
+		}
+	}
+
+	return decision
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  indexer
+//
+/////////////////////////////////////////////////////////////////////////
+
+// checkIndexMemQuota runs the memory quota check of indexes from the
+// memory monitor. It returns true if a low priority index has been
+// paused as the indexer is running out of memory.
+func (idx *indexer) checkIndexMemQuota(nodeMemUsed uint64, highMem bool) bool {
+
+	replych := make(chan []IndexStorageStats)
+	idx.wrkrRecvCh <- &MsgIndexStorageStats{respch: replych}
+	stats := <-replych
+
+	memUsed := make(map[c.IndexInstId]int64)
+	for _, st := range stats {
+		memUsed[st.InstId] += st.Stats.MemUsed
+	}
+
+	respch := make(chan bool)
+	idx.internalRecvCh <- &MsgCheckIndexMemQuota{
+		memUsed:     memUsed,
+		nodeMemUsed: nodeMemUsed,
+		highMem:     highMem,
+		respch:      respch,
+	}
+	return <-respch
+}
+
+func (idx *indexer) handleCheckIndexMemQuota(msg Message) {
+
+	req := msg.(*MsgCheckIndexMemQuota)
+	respch := req.GetRespCh()
+	memUsed := req.GetMemUsed()
+
+	for instId := range idx.pausedRebuildMemUsed {
+		if inst, ok := idx.indexInstMap[instId]; !ok || !inst.Paused {
+			delete(idx.pausedRebuildMemUsed, instId)
+		}
+	}
+
+	decision := decideIndexMemQuota(idx.indexInstMap, memUsed, idx.pausedRebuildMemUsed,
+		req.GetNodeMemUsed(), idx.config["settings.memory_quota"].Uint64(),
+		idx.config["low_mem_mark"].Float64(), req.IsHighMem())
+
+	pause := decision.pause
+	if decision.evict != 0 {
+		pause = append(pause, decision.evict)
+	}
+
+	var stopped []c.IndexInst
+	evicted := false
+	for _, instId := range pause {
+		inst := idx.indexInstMap[instId]
+
+		// left to the next check while the stream is busy
+		if idx.getStreamBucketState(inst.Stream, inst.Defn.Bucket) != STREAM_ACTIVE ||
+			idx.streamBucketFlushInProgress[inst.Stream][inst.Defn.Bucket] {
+			continue
+		}
+
+		stopped = append(stopped, inst)
+		evicted = evicted || instId == decision.evict
+
+		inst.Paused = true
+		inst.Stream = c.NIL_STREAM
+		idx.indexInstMap[instId] = inst
+
+		l.Warnf("Indexer::handleCheckIndexMemQuota Pause ingestion of index %v:%v (%v). "+
+			"MemoryUsed %v Quota %v Priority %v IndexerOutOfMemory %v", inst.Defn.Bucket,
+			inst.DisplayName(), instId, memUsed[instId], inst.Defn.MemQuota,
+			inst.Defn.Priority, instId == decision.evict)
+	}
+
+	if len(stopped) != 0 {
+		if err := idx.savePausedInsts(); err != nil {
+			l.Errorf("Indexer::handleCheckIndexMemQuota Error saving %v %v", PausedIndexTag, err)
+		}
+
+		msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+		msgUpdateIndexPartnMap := &MsgUpdatePartnMap{indexPartnMap: idx.indexPartnMap}
+		if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, msgUpdateIndexPartnMap); err != nil {
+			c.CrashOnError(err)
+		}
+
+		for _, inst := range stopped {
+			idx.stopIndexIngestion(inst)
+		}
+	}
+
+	// The paused instance needs room for the aborted rebuild to be rebuilt again.
+	for _, instId := range decision.abort {
+		proxy := idx.indexInstMap[instId]
+		if memUsed[instId] > idx.pausedRebuildMemUsed[proxy.RealInstId] {
+			idx.pausedRebuildMemUsed[proxy.RealInstId] = memUsed[instId]
+		}
+
+		l.Warnf("Indexer::handleCheckIndexMemQuota Abort rebuild of index %v:%v (%v) by instance %v. "+
+			"MemoryUsed %v Quota %v", proxy.Defn.Bucket, proxy.DisplayName(), proxy.RealInstId,
+			instId, memUsed[instId], proxy.Defn.MemQuota)
+
+		idx.rebalMgrCmdCh <- &MsgRebuildIndex{
+			defnId:      proxy.Defn.DefnId,
+			instId:      proxy.RealInstId,
+			abortInstId: instId,
+		}
+		<-idx.rebalMgrCmdCh
+	}
+
+	// The rebuilt instance replaces the paused one when it has caught up.
+	for _, instId := range decision.rebuild {
+		idx.rebalMgrCmdCh <- &MsgRebuildIndex{
+			defnId: idx.indexInstMap[instId].Defn.DefnId,
+			instId: instId,
+		}
+		<-idx.rebalMgrCmdCh
+	}
+
+	for instId, inst := range idx.indexInstMap {
+		if idxStats, ok := idx.stats.indexes[instId]; ok {
+			idxStats.memoryQuota.Set(int64(inst.Defn.MemQuota))
+			if inst.Paused {
+				idxStats.ingestionPaused.Set(1)
+			} else {
+				idxStats.ingestionPaused.Set(0)
+			}
+		}
+	}
+
+	respch <- evicted
+}
+
+// stopIndexIngestion removes an instance paused on memory quota from the
+// stream it was in, so that projector stops sending its mutations.
+func (idx *indexer) stopIndexIngestion(inst c.IndexInst) {
+
+	//if this is the last index for the bucket in MaintStream and the bucket exists
+	//in InitStream, the bucket is kept in MaintStream for merge to happen.
+	if !idx.checkBucketExistsInStream(inst.Defn.Bucket, c.MAINT_STREAM, false) &&
+		idx.checkBucketExistsInStream(inst.Defn.Bucket, c.INIT_STREAM, false) {
+		l.Infof("Indexer::stopIndexIngestion Pre-Catchup Index Found for %v "+
+			"%v. Stream Cleanup Skipped.", inst.Stream, inst.Defn.Bucket)
+		return
+	}
+
+	idx.sendStreamUpdateForDropIndex(inst, nil)
+}
+
+// handleUpdateMemQuota updates the memory quota and priority of all
+// instances of an index. The next memory quota check acts on it.
+func (idx *indexer) handleUpdateMemQuota(msg Message) {
+
+	req := msg.(*MsgClustMgrUpdateMemQuota)
+	defnId := req.GetDefnId()
+	respch := req.GetRespCh()
+
+	updated := false
+	for instId, inst := range idx.indexInstMap {
+		if inst.Defn.DefnId == defnId {
+			inst.Defn.MemQuota = req.GetMemQuota()
+			inst.Defn.Priority = req.GetPriority()
+			idx.indexInstMap[instId] = inst
+			updated = true
+		}
+	}
+
+	if updated {
+		l.Infof("Indexer::handleUpdateMemQuota Index %v MemoryQuota %v Priority %v",
+			defnId, req.GetMemQuota(), req.GetPriority())
+
+		msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+		msgUpdateIndexPartnMap := &MsgUpdatePartnMap{indexPartnMap: idx.indexPartnMap}
+		if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, msgUpdateIndexPartnMap); err != nil {
+			c.CrashOnError(err)
+		}
+	} else {
+		l.Warnf("Indexer::handleUpdateMemQuota Index %v not found. Skip", defnId)
+	}
+
+	respch <- &MsgSuccess{}
+}
+
+// recoverMemQuotaState pauses again the ingestion of index instances
+// which were paused before restart. They are kept out of the streams
+// started on bootstrap.
+func (idx *indexer) recoverMemQuotaState() {
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_GET_LOCAL,
+		key:   PausedIndexTag,
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	resp := respMsg.(*MsgClustMgrLocal)
+
+	if err := resp.GetError(); err != nil {
+		if !strings.Contains(err.Error(), forestdb.FDB_RESULT_KEY_NOT_FOUND.Error()) {
+			l.Errorf("Indexer::recoverMemQuotaState Error Fetching %v From Local "+
+				"Meta Storage. Err %v", PausedIndexTag, err)
+		}
+		return
+	}
+
+	var instIds []c.IndexInstId
+	if err := json.Unmarshal([]byte(resp.GetValue()), &instIds); err != nil {
+		l.Errorf("Indexer::recoverMemQuotaState Error Unmarshalling %v %v", PausedIndexTag, err)
+		return
+	}
+	for _, instId := range instIds {
+		if inst, ok := idx.indexInstMap[instId]; ok {
+			inst.Paused = true
+			inst.Stream = c.NIL_STREAM
+			idx.indexInstMap[instId] = inst
+		}
+	}
+
+	l.Infof("Indexer::recoverMemQuotaState Paused Indexes %v", instIds)
+}
+
+func (idx *indexer) savePausedInsts() error {
+
+	var instIds []c.IndexInstId
+	for instId, inst := range idx.indexInstMap {
+		if inst.Paused && inst.State != c.INDEX_STATE_DELETED {
+			instIds = append(instIds, instId)
+		}
+	}
+	value, err := json.Marshal(instIds)
+	if err != nil {
+		return err
+	}
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_SET_LOCAL,
+		key:   PausedIndexTag,
+		value: string(value),
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	return respMsg.(*MsgClustMgrLocal).GetError()
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  service manager
+//
+/////////////////////////////////////////////////////////////////////////
+
+// handleRebuildPausedIndex rebuilds an index whose ingestion has been
+// paused, unless it is being rebuilt already, or aborts its rebuild.
+func (m *ServiceMgr) handleRebuildPausedIndex(cmd Message) {
+
+	req := cmd.(*MsgRebuildIndex)
+	m.supvCmdch <- &MsgSuccess{}
+
+	m.mu.Lock()
+	running := m.rebuilds[req.GetInstId()]
+	m.mu.Unlock()
+
+	if abortInstId := req.GetAbortInstId(); abortInstId != 0 {
+		// the rebuild fails once its proxy is dropped
+		if running {
+			go m.abortRebuildIndexInst(req.GetDefnId(), abortInstId)
+		}
+		return
+	}
+
+	if running {
+		return
+	}
+
+	go func() {
+		l.Infof("ServiceMgr::handleRebuildPausedIndex Rebuild index %v paused instance %v",
+			req.GetDefnId(), req.GetInstId())
+		if err := m.rebuildLocalIndex(req.GetDefnId()); err != nil {
+			l.Warnf("ServiceMgr::handleRebuildPausedIndex Index %v: %v", req.GetDefnId(), err)
+		}
+	}()
+}
+
+// abortRebuildIndexInst drops the proxy instance rebuilding an index.
+func (m *ServiceMgr) abortRebuildIndexInst(defnId c.IndexDefnId, instId c.IndexInstId) {
+
+	localMeta, err := m.getLocalIndexMetadata()
+	if err != nil {
+		l.Errorf("ServiceMgr::abortRebuildIndexInst Error getting local metadata %v", err)
+		return
+	}
+
+	for _, defn := range localMeta.IndexDefinitions {
+		if defn.DefnId == defnId {
+			l.Infof("ServiceMgr::abortRebuildIndexInst Drop index %v instance %v", defnId, instId)
+			m.dropRebuildIndexInst(defn, instId)
+			return
+		}
+	}
+}
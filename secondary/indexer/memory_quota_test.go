@@ -0,0 +1,103 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestDecideIndexMemQuota(t *testing.T) {
+	newInst := func(instId c.IndexInstId, quota uint64, priority c.IndexPriority, paused bool) c.IndexInst {
+		inst := c.IndexInst{
+			InstId: instId,
+			Defn:   c.IndexDefn{DefnId: c.IndexDefnId(instId), MemQuota: quota, Priority: priority},
+			State:  c.INDEX_STATE_ACTIVE,
+			Stream: c.MAINT_STREAM,
+			RState: c.REBAL_ACTIVE,
+			Paused: paused,
+		}
+		if paused {
+			inst.Stream = c.NIL_STREAM
+		}
+		return inst
+	}
+	newProxy := func(instId, realInstId c.IndexInstId, quota uint64, rebuild bool) c.IndexInst {
+		inst := newInst(instId, quota, "", false)
+		inst.RealInstId = realInstId
+		inst.Rebuild = rebuild
+		inst.RState = c.REBAL_PENDING
+		return inst
+	}
+
+	insts := c.IndexInstMap{
+		1: newInst(1, 100, "", false),
+		2: newInst(2, 100, c.INDEX_PRIORITY_HIGH, false),
+		3: newInst(3, 0, c.INDEX_PRIORITY_LOW, false),
+		4: newInst(4, 0, c.INDEX_PRIORITY_LOW, false),
+		5: newInst(5, 1000, "", true),
+		6: newInst(6, 100, "", true),
+		7: newInst(7, 1000, "", true),
+		8: newProxy(8, 7, 1000, true),
+		9: newProxy(9, 1, 100, false),
+	}
+	building := newInst(10, 100, "", false)
+	building.Stream = c.INIT_STREAM
+	insts[10] = building
+
+	memUsed := map[c.IndexInstId]int64{1: 200, 2: 200, 3: 50, 4: 80, 5: 200, 6: 150, 7: 200, 8: 1100, 9: 200, 10: 200}
+	rebuildUsed := map[c.IndexInstId]int64{5: 100, 7: 1200}
+
+	// over quota, high priority quota is soft, a building instance is
+	// left to build throttling
+	d := decideIndexMemQuota(insts, memUsed, rebuildUsed, 1000, 10000, 0.8, false)
+	if !reflect.DeepEqual(d.pause, []c.IndexInstId{1}) || d.evict != 0 {
+		t.Errorf("unexpected pause %v evict %v", d.pause, d.evict)
+	}
+	// instance 6 is stopped over its quota, the rebuild of instance 7 was
+	// aborted over its quota
+	if !reflect.DeepEqual(d.rebuild, []c.IndexInstId{5}) {
+		t.Errorf("unexpected rebuild %v", d.rebuild)
+	}
+	// the proxy of a rebalance is not checked
+	if !reflect.DeepEqual(d.abort, []c.IndexInstId{8}) {
+		t.Errorf("unexpected abort %v", d.abort)
+	}
+
+	// largest low priority instance is paused on high memory, and
+	// nothing is rebuilt
+	d = decideIndexMemQuota(insts, memUsed, rebuildUsed, 9500, 10000, 0.8, true)
+	if !reflect.DeepEqual(d.pause, []c.IndexInstId{1}) || d.evict != 4 {
+		t.Errorf("unexpected pause %v evict %v", d.pause, d.evict)
+	}
+	if len(d.rebuild) != 0 {
+		t.Errorf("unexpected rebuild %v", d.rebuild)
+	}
+
+	// a paused instance is rebuilt once its quota is raised, or removed
+	inst := insts[6]
+	inst.Defn.MemQuota = 150
+	insts[6] = inst
+	inst = insts[7]
+	inst.Defn.MemQuota = 0
+	insts[7] = inst
+	delete(insts, 8)
+	d = decideIndexMemQuota(insts, memUsed, rebuildUsed, 1000, 10000, 0.8, false)
+	if !reflect.DeepEqual(d.rebuild, []c.IndexInstId{5, 6, 7}) {
+		t.Errorf("unexpected rebuild %v", d.rebuild)
+	}
+
+	// an instance evicted on high memory fits in its quota, it is rebuilt
+	// once the indexer has room
+	inst = insts[4]
+	inst.Paused = true
+	inst.Stream = c.NIL_STREAM
+	insts[4] = inst
+	if d = decideIndexMemQuota(insts, memUsed, nil, 7950, 10000, 0.8, false); len(d.rebuild) != 0 {
+		t.Errorf("unexpected rebuild %v", d.rebuild)
+	}
+	d = decideIndexMemQuota(insts, memUsed, nil, 7900, 10000, 0.8, false)
+	if !reflect.DeepEqual(d.rebuild, []c.IndexInstId{4}) {
+		t.Errorf("unexpected rebuild %v", d.rebuild)
+	}
+}
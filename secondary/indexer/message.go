@@ -68,6 +68,8 @@ const (
 	STORAGE_SNAP_DONE
 	STORAGE_INDEX_MERGE_SNAPSHOT
 	STORAGE_INDEX_PRUNE_SNAPSHOT
+	STORAGE_INDEX_OPEN_SNAPSHOT
+	STORAGE_INDEX_BACKUP_SNAPSHOT
 
 	//KVSender
 	KV_SENDER_SHUTDOWN
@@ -99,6 +101,9 @@ const (
 	CLUST_MGR_DROP_INSTANCE
 	CLUST_MGR_MERGE_PARTITION
 	CLUST_MGR_PRUNE_PARTITION
+	CLUST_MGR_UPDATE_AGGREGATES
+	CLUST_MGR_SWAP_INDEX_INST
+	CLUST_MGR_UPDATE_MEM_QUOTA
 
 	//CBQ_BRIDGE_SHUTDOWN
 	CBQ_BRIDGE_SHUTDOWN
@@ -126,6 +131,10 @@ const (
 	INDEXER_UPDATE_RSTATE
 	INDEXER_MERGE_PARTITION
 	INDEXER_CANCEL_MERGE_PARTITION
+	INDEXER_INDEX_RESTORED
+	INDEXER_SWAP_INDEX_INST
+	INDEXER_CHECK_MEM_QUOTA
+	INDEXER_REBUILD_INDEX
 
 	//SCAN COORDINATOR
 	SCAN_COORD_SHUTDOWN
@@ -897,6 +906,114 @@ func (m *MsgClustMgrPrunePartition) GetString() string {
 	return str
 }
 
+// CLUST_MGR_UPDATE_AGGREGATES
+type MsgClustMgrUpdateAggregates struct {
+	defnId     common.IndexDefnId
+	aggregates []*common.IndexAggregate
+	respCh     MsgChannel
+}
+
+func (m *MsgClustMgrUpdateAggregates) GetMsgType() MsgType {
+	return CLUST_MGR_UPDATE_AGGREGATES
+}
+
+func (m *MsgClustMgrUpdateAggregates) GetDefnId() common.IndexDefnId {
+	return m.defnId
+}
+
+func (m *MsgClustMgrUpdateAggregates) GetAggregates() []*common.IndexAggregate {
+	return m.aggregates
+}
+
+func (m *MsgClustMgrUpdateAggregates) GetRespCh() MsgChannel {
+	return m.respCh
+}
+
+func (m *MsgClustMgrUpdateAggregates) GetString() string {
+
+	str := "\n\tMessage: MsgClustMgrUpdateAggregates"
+	str += fmt.Sprintf("\n\tType: %v", CLUST_MGR_UPDATE_AGGREGATES)
+	str += fmt.Sprintf("\n\tdefn Id: %v", m.defnId)
+	str += fmt.Sprintf("\n\taggregates: %v", m.aggregates)
+	return str
+}
+
+// CLUST_MGR_UPDATE_MEM_QUOTA
+type MsgClustMgrUpdateMemQuota struct {
+	defnId   common.IndexDefnId
+	memQuota uint64
+	priority common.IndexPriority
+	respCh   MsgChannel
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetMsgType() MsgType {
+	return CLUST_MGR_UPDATE_MEM_QUOTA
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetDefnId() common.IndexDefnId {
+	return m.defnId
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetMemQuota() uint64 {
+	return m.memQuota
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetPriority() common.IndexPriority {
+	return m.priority
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetRespCh() MsgChannel {
+	return m.respCh
+}
+
+func (m *MsgClustMgrUpdateMemQuota) GetString() string {
+
+	str := "\n\tMessage: MsgClustMgrUpdateMemQuota"
+	str += fmt.Sprintf("\n\tType: %v", CLUST_MGR_UPDATE_MEM_QUOTA)
+	str += fmt.Sprintf("\n\tdefn Id: %v", m.defnId)
+	str += fmt.Sprintf("\n\tmemory quota: %v", m.memQuota)
+	str += fmt.Sprintf("\n\tpriority: %v", m.priority)
+	return str
+}
+
+// CLUST_MGR_SWAP_INDEX_INST
+type MsgClustMgrSwapIndexInst struct {
+	defnId    common.IndexDefnId
+	instId    common.IndexInstId
+	newInstId common.IndexInstId
+	respch    chan error
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetMsgType() MsgType {
+	return CLUST_MGR_SWAP_INDEX_INST
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetDefnId() common.IndexDefnId {
+	return m.defnId
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetNewInstId() common.IndexInstId {
+	return m.newInstId
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetRespch() chan error {
+	return m.respch
+}
+
+func (m *MsgClustMgrSwapIndexInst) GetString() string {
+
+	str := "\n\tMessage: MsgClustMgrSwapIndexInst"
+	str += fmt.Sprintf("\n\tType: %v", CLUST_MGR_SWAP_INDEX_INST)
+	str += fmt.Sprintf("\n\tdefn Id: %v", m.defnId)
+	str += fmt.Sprintf("\n\tinst Id: %v", m.instId)
+	str += fmt.Sprintf("\n\tnew inst Id: %v", m.newInstId)
+	return str
+}
+
 // INDEXER_CANCEL_MERGE_PARTITION
 //CLUST_MGR_BUILD_INDEX_DDL
 type MsgBuildIndex struct {
@@ -1259,6 +1376,55 @@ func (m *MsgIndexPruneSnapshot) GetPartitions() []common.PartitionId {
 	return m.partitions
 }
 
+//Open snapshots of indexes with data transferred from a peer indexer.
+//Restart timestamp is sent on respch, nil if indexes need to be built
+//from scratch.
+type MsgIndexOpenSnapshot struct {
+	instIds []common.IndexInstId
+	respch  chan *common.TsVbuuid
+}
+
+func (m *MsgIndexOpenSnapshot) GetMsgType() MsgType {
+	return STORAGE_INDEX_OPEN_SNAPSHOT
+}
+
+func (m *MsgIndexOpenSnapshot) GetInstIds() []common.IndexInstId {
+	return m.instIds
+}
+
+func (m *MsgIndexOpenSnapshot) GetReplyChannel() chan *common.TsVbuuid {
+	return m.respch
+}
+
+//List the latest persisted snapshot of all partitions of active
+//indexes of bucket (all buckets if empty), to backup their data.
+type MsgIndexBackupSnapshot struct {
+	bucket  string
+	instId  common.IndexInstId //0 for all indexes of bucket
+	partnId common.PartitionId
+	respch  chan []indexBackupSnapshot
+}
+
+func (m *MsgIndexBackupSnapshot) GetMsgType() MsgType {
+	return STORAGE_INDEX_BACKUP_SNAPSHOT
+}
+
+func (m *MsgIndexBackupSnapshot) GetBucket() string {
+	return m.bucket
+}
+
+func (m *MsgIndexBackupSnapshot) GetInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgIndexBackupSnapshot) GetPartitionId() common.PartitionId {
+	return m.partnId
+}
+
+func (m *MsgIndexBackupSnapshot) GetReplyChannel() chan []indexBackupSnapshot {
+	return m.respch
+}
+
 type MsgIndexStorageStats struct {
 	respch chan []IndexStorageStats
 }
@@ -1484,6 +1650,106 @@ func (m *MsgCheckDDLInProgress) GetRespCh() chan bool {
 	return m.respCh
 }
 
+//Index instances whose data has been restored from a backup, before
+//they are created. They catch up from the restored snapshot on build.
+type MsgIndexRestored struct {
+	instIds []common.IndexInstId
+	cancel  bool
+	respch  chan error
+}
+
+func (m *MsgIndexRestored) GetMsgType() MsgType {
+	return INDEXER_INDEX_RESTORED
+}
+
+func (m *MsgIndexRestored) GetInstIds() []common.IndexInstId {
+	return m.instIds
+}
+
+func (m *MsgIndexRestored) IsCancel() bool {
+	return m.cancel
+}
+
+func (m *MsgIndexRestored) GetRespCh() chan error {
+	return m.respch
+}
+
+// INDEXER_SWAP_INDEX_INST
+type MsgSwapIndexInst struct {
+	instId    common.IndexInstId
+	newInstId common.IndexInstId
+	respch    chan error
+}
+
+func (m *MsgSwapIndexInst) GetMsgType() MsgType {
+	return INDEXER_SWAP_INDEX_INST
+}
+
+func (m *MsgSwapIndexInst) GetInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgSwapIndexInst) GetNewInstId() common.IndexInstId {
+	return m.newInstId
+}
+
+func (m *MsgSwapIndexInst) GetRespCh() chan error {
+	return m.respch
+}
+
+// INDEXER_CHECK_MEM_QUOTA
+// Memory used by each index instance, and by the indexer.  highMem is
+// set if the indexer is running out of memory.
+type MsgCheckIndexMemQuota struct {
+	memUsed     map[common.IndexInstId]int64
+	nodeMemUsed uint64
+	highMem     bool
+	respch      chan bool
+}
+
+func (m *MsgCheckIndexMemQuota) GetMsgType() MsgType {
+	return INDEXER_CHECK_MEM_QUOTA
+}
+
+func (m *MsgCheckIndexMemQuota) GetMemUsed() map[common.IndexInstId]int64 {
+	return m.memUsed
+}
+
+func (m *MsgCheckIndexMemQuota) GetNodeMemUsed() uint64 {
+	return m.nodeMemUsed
+}
+
+func (m *MsgCheckIndexMemQuota) IsHighMem() bool {
+	return m.highMem
+}
+
+func (m *MsgCheckIndexMemQuota) GetRespCh() chan bool {
+	return m.respch
+}
+
+// INDEXER_REBUILD_INDEX
+type MsgRebuildIndex struct {
+	defnId      common.IndexDefnId
+	instId      common.IndexInstId
+	abortInstId common.IndexInstId //proxy rebuilding instId, to drop
+}
+
+func (m *MsgRebuildIndex) GetMsgType() MsgType {
+	return INDEXER_REBUILD_INDEX
+}
+
+func (m *MsgRebuildIndex) GetDefnId() common.IndexDefnId {
+	return m.defnId
+}
+
+func (m *MsgRebuildIndex) GetInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgRebuildIndex) GetAbortInstId() common.IndexInstId {
+	return m.abortInstId
+}
+
 type MsgUpdateIndexRState struct {
 	instId common.IndexInstId
 	respch chan error
@@ -1633,6 +1899,14 @@ func (m MsgType) String() string {
 		return "INDEXER_MERGE_PARTITION"
 	case INDEXER_CANCEL_MERGE_PARTITION:
 		return "INDEXER_CANCEL_MERGE_PARTITION"
+	case INDEXER_INDEX_RESTORED:
+		return "INDEXER_INDEX_RESTORED"
+	case INDEXER_SWAP_INDEX_INST:
+		return "INDEXER_SWAP_INDEX_INST"
+	case INDEXER_CHECK_MEM_QUOTA:
+		return "INDEXER_CHECK_MEM_QUOTA"
+	case INDEXER_REBUILD_INDEX:
+		return "INDEXER_REBUILD_INDEX"
 
 	case SCAN_COORD_SHUTDOWN:
 		return "SCAN_COORD_SHUTDOWN"
@@ -1692,6 +1966,12 @@ func (m MsgType) String() string {
 		return "CLUST_MGR_MERGE_PARTITION"
 	case CLUST_MGR_PRUNE_PARTITION:
 		return "CLUST_MGR_PRUNE_PARTITION"
+	case CLUST_MGR_UPDATE_AGGREGATES:
+		return "CLUST_MGR_UPDATE_AGGREGATES"
+	case CLUST_MGR_SWAP_INDEX_INST:
+		return "CLUST_MGR_SWAP_INDEX_INST"
+	case CLUST_MGR_UPDATE_MEM_QUOTA:
+		return "CLUST_MGR_UPDATE_MEM_QUOTA"
 
 	case CBQ_CREATE_INDEX_DDL:
 		return "CBQ_CREATE_INDEX_DDL"
@@ -1710,6 +1990,10 @@ func (m MsgType) String() string {
 		return "STORAGE_INDEX_MERGE_SNAPSHOT"
 	case STORAGE_INDEX_PRUNE_SNAPSHOT:
 		return "STORAGE_INDEX_PRUNE_SNAPSHOT"
+	case STORAGE_INDEX_OPEN_SNAPSHOT:
+		return "STORAGE_INDEX_OPEN_SNAPSHOT"
+	case STORAGE_INDEX_BACKUP_SNAPSHOT:
+		return "STORAGE_INDEX_BACKUP_SNAPSHOT"
 
 	case CONFIG_SETTINGS_UPDATE:
 		return "CONFIG_SETTINGS_UPDATE"
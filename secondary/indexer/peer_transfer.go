@@ -0,0 +1,627 @@
+// @copyright 2019 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	c "github.com/couchbase/indexing/secondary/common"
+	l "github.com/couchbase/indexing/secondary/logging"
+)
+
+// Peer-to-peer transfer of index files during rebalance.
+//
+// For transfer tokens with TokenBuildSourcePeer, destination indexer
+// copies the persisted files of the index from the source indexer,
+// instead of rebuilding the index from DCP.
+//
+//   dest                                   source
+//    | GET  /rebalance/snapshotManifest ->  | hard link latest persisted
+//    | <- {id, storageMode, files}          | files into a staging dir
+//    | GET  /rebalance/snapshotFile     ->  | stream file, throttled,
+//    | <- file + crc32 in trailer           | checksum in trailer
+//    | POST /rebalance/snapshotDone     ->  | remove staging dir
+//
+// Files are downloaded next to the index path and moved in place once
+// all checksums are verified, before the index is created on the
+// destination. On build, the index catches up from the timestamp of
+// the transferred snapshot. Any failure falls back to DCP rebuild.
+//
+// Only files that do not change once persisted can be staged by hard
+// links: the on-disk snapshots of memory optimized indexes, and forestdb
+// files which are append only. Plasma cleans its log files in place,
+// punching holes in and trimming live files, which would show through
+// the links while they are transferred. Plasma indexes are rebuilt from
+// DCP.
+
+const peerStagingDir = ".peer_transfer"
+const peerChecksumTrailer = "X-Index-Checksum"
+const peerStagingExpiry = 24 * time.Hour
+const peerChunkSize = 64 * 1024
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrPeerTransferNoSnapshot = errors.New("No persisted snapshot to transfer")
+var ErrPeerTransferChecksum = errors.New("Checksum mismatch in transferred file")
+var ErrPeerTransferUnsupported = errors.New("Storage mode does not support transfer of index files")
+var ErrPeerTransferChanged = errors.New("Index files changed while being staged")
+
+type peerSnapshotFile struct {
+	Name string `json:"name"` // relative to index path
+	Size int64  `json:"size"`
+}
+
+type peerSnapshotManifest struct {
+	Id          string             `json:"id"`
+	StorageMode string             `json:"storageMode"`
+	Files       []peerSnapshotFile `json:"files"`
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  source side
+//
+/////////////////////////////////////////////////////////////////////////
+
+type peerTransferServer struct {
+	mu      sync.Mutex
+	staged  map[string]time.Time // staging id -> creation time
+	limiter rateLimiter
+}
+
+func newPeerTransferServer(storageDir string) *peerTransferServer {
+	// staging links from previous runs are not in use anymore.
+	os.RemoveAll(filepath.Join(storageDir, peerStagingDir))
+	return &peerTransferServer{staged: make(map[string]time.Time)}
+}
+
+// peerStagingSupported returns true if persisted files of indexes of
+// storage `mode` can be staged by hard links.
+func peerStagingSupported(mode c.StorageMode) bool {
+	return mode != c.PLASMA
+}
+
+// stage hard links the latest persisted files of index path `name`,
+// so that they are not removed by storage engine while being
+// transferred. If the set of forestdb files changes while they are
+// linked, e.g. on compaction, the staged files are removed and
+// ErrPeerTransferChanged is returned.
+func (ps *peerTransferServer) stage(storageDir, name string) (*peerSnapshotManifest, error) {
+
+	mode := c.GetStorageMode()
+	if !peerStagingSupported(mode) {
+		return nil, ErrPeerTransferUnsupported
+	}
+
+	src := filepath.Join(storageDir, name)
+	files, err := persistedIndexFiles(src, mode)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrPeerTransferNoSnapshot
+	}
+
+	uuid, err := c.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	id := uuid.Str()
+	dst := filepath.Join(storageDir, peerStagingDir, id)
+
+	manifest := &peerSnapshotManifest{
+		Id:          id,
+		StorageMode: mode.String(),
+	}
+	for _, file := range files {
+		target := filepath.Join(dst, file)
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = os.Link(filepath.Join(src, file), target)
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(target)
+		}
+		if err != nil {
+			os.RemoveAll(dst)
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, peerSnapshotFile{Name: file, Size: info.Size()})
+	}
+
+	// a snapshot of memory optimized index is immutable once listed.
+	if mode != c.MOI {
+		current, err := persistedIndexFiles(src, mode)
+		if err == nil && !reflect.DeepEqual(current, files) {
+			err = ErrPeerTransferChanged
+		}
+		if err != nil {
+			os.RemoveAll(dst)
+			return nil, err
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// cleanup staging dirs abandoned by destination indexers.
+	for sid, created := range ps.staged {
+		if time.Since(created) > peerStagingExpiry {
+			os.RemoveAll(filepath.Join(storageDir, peerStagingDir, sid))
+			delete(ps.staged, sid)
+		}
+	}
+	ps.staged[id] = time.Now()
+	return manifest, nil
+}
+
+func (ps *peerTransferServer) isStaged(id string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	_, ok := ps.staged[id]
+	return ok
+}
+
+func (ps *peerTransferServer) unstage(storageDir, id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.staged[id]; ok {
+		os.RemoveAll(filepath.Join(storageDir, peerStagingDir, id))
+		delete(ps.staged, id)
+	}
+}
+
+// persistedIndexFiles return files, relative to index path, that make
+// up the latest persisted state of the index. For memory optimized
+// indexes this is the latest on-disk snapshot, which is immutable.
+// Forestdb files are append only, a copy of their current size is
+// recovered like after a crash. Files of other storage modes may not
+// be copied while in use, see peerStagingSupported.
+func persistedIndexFiles(path string, mode c.StorageMode) ([]string, error) {
+
+	root := path
+	if mode == c.MOI {
+		manifests, _ := filepath.Glob(filepath.Join(path, "snapshot.*", "manifest.json"))
+		if len(manifests) == 0 {
+			return nil, nil
+		}
+		sort.Strings(manifests)
+		root = filepath.Dir(manifests[len(manifests)-1])
+	}
+
+	var files []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == tmpDirName {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(path, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// validPeerPath return true if `name` is a relative path that does
+// not escape its parent directory.
+func validPeerPath(name string) bool {
+	clean := filepath.Clean(name)
+	return name != "" && !filepath.IsAbs(clean) &&
+		clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+func (m *ServiceMgr) handleSnapshotManifest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleSnapshotManifest Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!read"}, w) {
+		return
+	}
+
+	if r.Method != "GET" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	name := r.FormValue("path")
+	if !validPeerPath(name) || filepath.Base(name) != name || !strings.HasSuffix(name, ".index") {
+		m.writeError(w, fmt.Errorf("Invalid index path %v", name))
+		return
+	}
+
+	storageDir := m.config.Load()["storage_dir"].String()
+	manifest, err := m.peerServer.stage(storageDir, name)
+	if err != nil {
+		l.Errorf("ServiceMgr::handleSnapshotManifest Error staging %v %v", name, err)
+		m.writeError(w, err)
+		return
+	}
+
+	l.Infof("ServiceMgr::handleSnapshotManifest Staged %v files of %v as %v",
+		len(manifest.Files), name, manifest.Id)
+
+	out, err := json.Marshal(manifest)
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	m.writeJson(w, out)
+}
+
+func (m *ServiceMgr) handleSnapshotFile(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleSnapshotFile Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!read"}, w) {
+		return
+	}
+
+	if r.Method != "GET" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	id, name := r.FormValue("id"), r.FormValue("name")
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || !m.peerServer.isStaged(id) || !validPeerPath(id) || !validPeerPath(name) {
+		m.writeError(w, fmt.Errorf("Invalid file %v/%v", id, name))
+		return
+	}
+
+	cfg := m.config.Load()
+	file := filepath.Join(cfg["storage_dir"].String(), peerStagingDir, id, name)
+	fd, err := os.Open(file)
+	if err != nil {
+		m.writeError(w, err)
+		return
+	}
+	defer fd.Close()
+
+	m.peerServer.limiter.setRate(int64(cfg["rebalance.peerTransfer.rateLimit"].Int()) * 1024 * 1024)
+
+	// only `size` bytes, as listed in the manifest, are sent. Append only
+	// files can grow after they are staged.
+	if err := sendIndexFile(w, fd, size, &m.peerServer.limiter); err != nil {
+		l.Errorf("ServiceMgr::handleSnapshotFile Error sending %v %v", name, err)
+	}
+}
+
+// sendIndexFile streams the first `size` bytes of `fd`, paced by
+// `limiter`, with their checksum in the trailer.
+func sendIndexFile(w http.ResponseWriter, fd io.Reader, size int64, limiter *rateLimiter) error {
+
+	w.Header().Set("Trailer", peerChecksumTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	hash := crc32.New(crc32Table)
+	src := io.TeeReader(io.LimitReader(fd, size), hash)
+	buf := make([]byte, peerChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			limiter.wait(n)
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	w.Header().Set(peerChecksumTrailer, strconv.FormatUint(uint64(hash.Sum32()), 10))
+	return nil
+}
+
+func (m *ServiceMgr) handleSnapshotDone(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleSnapshotDone Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!write"}, w) {
+		return
+	}
+
+	if r.Method != "POST" {
+		m.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+
+	id := r.FormValue("id")
+	if !validPeerPath(id) {
+		m.writeError(w, fmt.Errorf("Invalid staging id %v", id))
+		return
+	}
+	m.peerServer.unstage(m.config.Load()["storage_dir"].String(), id)
+	m.writeBytes(w, []byte("OK"))
+}
+
+// rateLimiter paces data sent by all concurrent transfers.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64     // bytes per second, 0 for no limit
+	next time.Time // time at which next byte can be sent
+}
+
+func (rl *rateLimiter) setRate(rate int64) {
+	rl.mu.Lock()
+	rl.rate = rate
+	rl.mu.Unlock()
+}
+
+func (rl *rateLimiter) wait(n int) {
+	rl.mu.Lock()
+	if rl.rate <= 0 {
+		rl.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(int64(n) * int64(time.Second) / rl.rate))
+	rl.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  destination side
+//
+/////////////////////////////////////////////////////////////////////////
+
+// transferIndexFromPeer copies persisted files of all partitions of the
+// index in transfer token from its source indexer. On error, files
+// copied so far are removed.
+func (r *Rebalancer) transferIndexFromPeer(ttid string, tt *c.TransferToken) error {
+
+	cfg := r.config.Load()
+	storageDir := cfg["storage_dir"].String()
+	retries := cfg["rebalance.peerTransfer.retries"].Int()
+
+	addr, err := getIndexerAddrByNodeUUID(cfg["clusterAddr"].String(), tt.SourceId)
+	if err != nil {
+		return err
+	}
+
+	inst := tt.IndexInst
+	inst.InstId = tt.InstId
+	inst.RealInstId = tt.RealInstId
+	mode := c.IndexTypeToStorageMode(inst.Defn.Using)
+
+	var done []string
+	for _, partnId := range inst.Defn.Partitions {
+		name := IndexPath(&inst, partnId, SliceId(0))
+		t0 := time.Now()
+		if err = transferIndexPath(addr, storageDir, name, mode, retries); err != nil {
+			l.Errorf("Rebalancer::transferIndexFromPeer Error transferring %v from %v %v",
+				name, addr, err)
+			for _, path := range done {
+				os.RemoveAll(path)
+			}
+			return err
+		}
+		done = append(done, filepath.Join(storageDir, name))
+		l.Infof("Rebalancer::transferIndexFromPeer Transferred %v from %v for %v. Took %v",
+			name, addr, ttid, time.Since(t0))
+	}
+	return nil
+}
+
+// transferIndexPath copies index path `name` from source indexer at
+// `addr` into `storageDir`.
+func transferIndexPath(addr, storageDir, name string, mode c.StorageMode, retries int) error {
+
+	path := filepath.Join(storageDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Index path %v already exists", path)
+	}
+
+	resp, err := getWithAuth(addr + "/rebalance/snapshotManifest?path=" + url.QueryEscape(name))
+	if err != nil {
+		return err
+	}
+	manifest := new(peerSnapshotManifest)
+	err = convertPeerResponse(resp, manifest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		resp, err := postWithAuth(addr+"/rebalance/snapshotDone?id="+manifest.Id, "text/plain", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	if manifest.StorageMode != mode.String() {
+		return fmt.Errorf("Storage mode of source %v does not match %v", manifest.StorageMode, mode)
+	}
+
+	tmpdir := path + ".peer"
+	os.RemoveAll(tmpdir)
+	for _, file := range manifest.Files {
+		if !validPeerPath(file.Name) {
+			os.RemoveAll(tmpdir)
+			return fmt.Errorf("Invalid file %v in manifest", file.Name)
+		}
+		for i := 0; ; i++ {
+			err = downloadPeerFile(addr, manifest.Id, file, filepath.Join(tmpdir, file.Name))
+			if err == nil {
+				break
+			} else if i >= retries {
+				os.RemoveAll(tmpdir)
+				return err
+			}
+			l.Warnf("Rebalancer::transferIndexPath Error downloading %v %v. Retrying (%d)",
+				file.Name, err, i+1)
+		}
+	}
+
+	if err := os.Rename(tmpdir, path); err != nil {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+	return nil
+}
+
+func downloadPeerFile(addr, id string, file peerSnapshotFile, target string) error {
+
+	params := url.Values{}
+	params.Set("id", id)
+	params.Set("name", file.Name)
+	params.Set("size", strconv.FormatInt(file.Size, 10))
+
+	_, err := downloadIndexFile(addr+"/rebalance/snapshotFile?"+params.Encode(), file.Size, target)
+	return err
+}
+
+// downloadIndexFile saves the file sent by sendIndexFile at `u` into
+// `target`, verifying its size and checksum. Returns the checksum.
+func downloadIndexFile(u string, size int64, target string) (uint32, error) {
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(u, "http://") {
+		u = "http://" + u
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := cbauth.SetRequestAuthVia(req, nil); err != nil {
+		return 0, err
+	}
+	// no timeout, large files are expected to take long at rate limit.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("%v %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	fd, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, err
+	}
+	hash := crc32.New(crc32Table)
+	n, err := io.Copy(io.MultiWriter(fd, hash), resp.Body)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	} else if n != size {
+		return 0, fmt.Errorf("Expected %v bytes for %v, got %v", size, filepath.Base(target), n)
+	}
+
+	// trailer is available only after body is read.
+	checksum := resp.Trailer.Get(peerChecksumTrailer)
+	if checksum != strconv.FormatUint(uint64(hash.Sum32()), 10) {
+		return 0, ErrPeerTransferChecksum
+	}
+	return hash.Sum32(), nil
+}
+
+func convertPeerResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %s", resp.Status, strings.TrimSpace(string(bytes)))
+	}
+	return json.Unmarshal(bytes, out)
+}
+
+// getIndexerAddrByNodeUUID return the http address of the indexer
+// node identified by `nodeUUID`.
+func getIndexerAddrByNodeUUID(clusterAddr, nodeUUID string) (string, error) {
+
+	url, err := c.ClusterAuthUrl(clusterAddr)
+	if err != nil {
+		return "", err
+	}
+	cinfo, err := c.NewClusterInfoCache(url, DEFAULT_POOL)
+	if err != nil {
+		return "", err
+	}
+	if err := cinfo.Fetch(); err != nil {
+		return "", err
+	}
+
+	for _, nid := range cinfo.GetNodesByServiceType(c.INDEX_HTTP_SERVICE) {
+		addr, err := cinfo.GetServiceAddress(nid, c.INDEX_HTTP_SERVICE)
+		if err != nil {
+			continue
+		}
+		resp, err := getWithAuth(addr + "/nodeuuid")
+		if err != nil {
+			continue
+		}
+		bytes, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(bytes) == nodeUUID {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find indexer node %v", nodeUUID)
+}
@@ -0,0 +1,206 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestValidPeerPath(t *testing.T) {
+	testcases := map[string]bool{
+		"default_idx_1_0.index":             true,
+		"snapshot.2019-01-01/manifest.json": true,
+		"":                                  false,
+		"..":                                false,
+		"../default_idx_1_0.index":          false,
+		"a/../../b":                         false,
+		"/etc/passwd":                       false,
+	}
+	for name, valid := range testcases {
+		if validPeerPath(name) != valid {
+			t.Errorf("%q: expected valid %v", name, valid)
+		}
+	}
+}
+
+func TestPersistedIndexFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer_transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string) {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("snapshot.2019-01-01.10:00:00.000/manifest.json")
+	write("snapshot.2019-01-01.10:00:00.000/data/shard-0")
+	write("snapshot.2019-01-01.11:00:00.000/manifest.json")
+	write("snapshot.2019-01-01.11:00:00.000/data/shard-0")
+	write("snapshot.2019-01-01.12:00:00.000/data/shard-0") // incomplete
+	write(".tmp/data/shard-0")
+
+	files, err := persistedIndexFiles(dir, c.MOI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	expected := []string{
+		"snapshot.2019-01-01.11:00:00.000/data/shard-0",
+		"snapshot.2019-01-01.11:00:00.000/manifest.json",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+
+	files, err = persistedIndexFiles(dir, c.FORESTDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("expected 5 files, got %v", files)
+	}
+}
+
+func TestPeerTransferStage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer_transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer c.SetStorageMode(c.GetStorageMode())
+
+	name := "default_idx_1_0.index"
+	file := filepath.Join(dir, name, "data.fdb.1")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ps := newPeerTransferServer(dir)
+	c.SetStorageMode(c.FORESTDB)
+	manifest, err := ps.stage(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []peerSnapshotFile{{Name: "data.fdb.1", Size: 4}}
+	if !reflect.DeepEqual(manifest.Files, expected) || manifest.StorageMode != c.StorageMode(c.FORESTDB).String() {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	// data appended after staging is not sent
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("efgh"))
+	f.Close()
+
+	staged, err := os.Open(filepath.Join(dir, peerStagingDir, manifest.Id, "data.fdb.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Close()
+	w := httptest.NewRecorder()
+	var rl rateLimiter
+	if err := sendIndexFile(w, staged, manifest.Files[0].Size, &rl); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); body != "abcd" {
+		t.Errorf("expected staged size to be sent, got %q", body)
+	}
+
+	ps.unstage(dir, manifest.Id)
+	if _, err := os.Stat(filepath.Join(dir, peerStagingDir, manifest.Id)); !os.IsNotExist(err) {
+		t.Errorf("expected staged files to be removed")
+	}
+
+	// plasma files are cleaned in place, they are not staged
+	c.SetStorageMode(c.PLASMA)
+	if _, err := ps.stage(dir, name); err != ErrPeerTransferUnsupported {
+		t.Errorf("expected %v, got %v", ErrPeerTransferUnsupported, err)
+	}
+	if staged, _ := ioutil.ReadDir(filepath.Join(dir, peerStagingDir)); len(staged) != 0 {
+		t.Errorf("unexpected staged files of plasma index")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var rl rateLimiter
+	rl.setRate(1024 * 1024)
+
+	t0 := time.Now()
+	for i := 0; i < 8; i++ {
+		rl.wait(64 * 1024)
+	}
+	// first chunk is not delayed, remaining 7 are paced at 1MB/s.
+	if elapsed := time.Since(t0); elapsed < 400*time.Millisecond {
+		t.Errorf("expected transfer to be throttled, took %v", elapsed)
+	}
+
+	rl.setRate(0)
+	t0 = time.Now()
+	rl.wait(1024 * 1024 * 1024)
+	if elapsed := time.Since(t0); elapsed > 100*time.Millisecond {
+		t.Errorf("expected no throttling, took %v", elapsed)
+	}
+}
+
+func TestMinRestartTs(t *testing.T) {
+	newTs := func(seqnos, vbuuids []uint64) *c.TsVbuuid {
+		ts := c.NewTsVbuuid("default", len(seqnos))
+		copy(ts.Seqnos, seqnos)
+		copy(ts.Vbuuids, vbuuids)
+		for i, seqno := range seqnos {
+			ts.Snapshots[i] = [2]uint64{seqno, seqno}
+		}
+		return ts
+	}
+
+	// vbucket 0 leads in partition 1, vbucket 1 leads in partition 2.
+	partn1 := newTs([]uint64{100, 10, 0}, []uint64{1, 2, 0})
+	partn2 := newTs([]uint64{50, 80, 5}, []uint64{1, 2, 3})
+	restartTs := minRestartTs([]*c.TsVbuuid{partn1, partn2})
+	if restartTs == nil {
+		t.Fatal("expected restart timestamp")
+	}
+	if expected := []uint64{50, 10, 0}; !reflect.DeepEqual(restartTs.Seqnos, expected) {
+		t.Errorf("expected seqnos %v, got %v", expected, restartTs.Seqnos)
+	}
+	if expected := []uint64{1, 2, 0}; !reflect.DeepEqual(restartTs.Vbuuids, expected) {
+		t.Errorf("expected vbuuids %v, got %v", expected, restartTs.Vbuuids)
+	}
+	if restartTs.Snapshots[0] != [2]uint64{50, 50} || restartTs.Snapshots[1] != [2]uint64{10, 10} {
+		t.Errorf("unexpected snapshots %v", restartTs.Snapshots)
+	}
+	if restartTs.Crc64 != c.HashVbuuid(restartTs.Vbuuids) {
+		t.Errorf("crc64 not updated")
+	}
+	if partn1.Seqnos[0] != 100 {
+		t.Errorf("input timestamp modified")
+	}
+
+	// partitions on different branches of vbucket 1.
+	partn3 := newTs([]uint64{100, 10, 0}, []uint64{1, 7, 0})
+	if ts := minRestartTs([]*c.TsVbuuid{partn1, partn3}); ts != nil {
+		t.Errorf("expected nil for mismatching vbuuids, got %v", ts)
+	}
+	if ts := minRestartTs(nil); ts != nil {
+		t.Errorf("expected nil without snapshots, got %v", ts)
+	}
+}
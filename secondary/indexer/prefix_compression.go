@@ -0,0 +1,352 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/collatejson"
+)
+
+// Prefix compressed storage encoding for secondary index entries
+//
+// Composite index keys whose leading field repeats heavily (tenant, type etc)
+// spend most of their storage on the same leading bytes. When prefix
+// compression is enabled, the encoded array header and the leading field
+// of an entry are replaced by an id into a per-slice prefix dictionary.
+// Format:
+// [0xff][uvarint_prefix_id][remaining_encoded_bytes]
+//
+// The remaining bytes retain the original tail ([docid][count][len_of_docid])
+// so that docid based lookups work on compressed entries without expansion.
+// A collatejson encoded key always starts with TypeArray, hence the marker
+// byte cannot collide with an uncompressed secondary entry.
+//
+// Dictionary ids are never reassigned. Entries can be expanded back to the
+// original encoding using the dictionary and compressed entries compare
+// exactly as their expanded forms.
+
+const prefixCompressedMarker byte = 0xff
+
+const prefixDictChunkSize = 1024
+
+var ErrPrefixDictCorrupted = errors.New("Prefix dictionary is corrupted")
+
+type prefixDictChunk [prefixDictChunkSize][]byte
+
+type prefixDictionary struct {
+	lock sync.RWMutex
+	ids  map[string]uint32
+
+	// Lock free lookup of prefix by id for comparators and readers.
+	// A chunk slot is published before any entry referring to it
+	// is made visible to readers.
+	chunks []unsafe.Pointer
+	count  uint32
+
+	minPrefixLen int
+	maxEntries   int
+
+	dictSize     int64
+	savedBytes   int64
+	persistedCnt uint32
+}
+
+func newPrefixDictionary(minPrefixLen, maxEntries int) *prefixDictionary {
+	if maxEntries <= 0 {
+		maxEntries = prefixDictChunkSize
+	}
+
+	numChunks := (maxEntries + prefixDictChunkSize - 1) / prefixDictChunkSize
+	return &prefixDictionary{
+		ids:          make(map[string]uint32),
+		chunks:       make([]unsafe.Pointer, numChunks),
+		minPrefixLen: minPrefixLen,
+		maxEntries:   numChunks * prefixDictChunkSize,
+	}
+}
+
+func (d *prefixDictionary) Count() int {
+	return int(atomic.LoadUint32(&d.count))
+}
+
+func (d *prefixDictionary) Size() int64 {
+	return atomic.LoadInt64(&d.dictSize)
+}
+
+// Number of bytes saved by compressed entries which are currently live
+func (d *prefixDictionary) SavedBytes() int64 {
+	return atomic.LoadInt64(&d.savedBytes)
+}
+
+func (d *prefixDictionary) get(id uint32) ([]byte, bool) {
+	if id >= atomic.LoadUint32(&d.count) {
+		return nil, false
+	}
+
+	chunk := (*prefixDictChunk)(atomic.LoadPointer(&d.chunks[id/prefixDictChunkSize]))
+	return chunk[id%prefixDictChunkSize], true
+}
+
+// Caller should hold the write lock
+func (d *prefixDictionary) add(prefix []byte) (uint32, bool) {
+	id := atomic.LoadUint32(&d.count)
+	if int(id) >= d.maxEntries {
+		return 0, false
+	}
+
+	cid := id / prefixDictChunkSize
+	chunk := (*prefixDictChunk)(atomic.LoadPointer(&d.chunks[cid]))
+	if chunk == nil {
+		chunk = new(prefixDictChunk)
+		atomic.StorePointer(&d.chunks[cid], unsafe.Pointer(chunk))
+	}
+
+	p := append([]byte(nil), prefix...)
+	chunk[id%prefixDictChunkSize] = p
+	d.ids[string(p)] = id
+	atomic.AddInt64(&d.dictSize, int64(len(p)))
+	atomic.StoreUint32(&d.count, id+1)
+	return id, true
+}
+
+func (d *prefixDictionary) lookupOrAdd(prefix []byte) (uint32, bool) {
+	d.lock.RLock()
+	id, ok := d.ids[string(prefix)]
+	d.lock.RUnlock()
+	if ok {
+		return id, true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if id, ok = d.ids[string(prefix)]; ok {
+		return id, true
+	}
+	return d.add(prefix)
+}
+
+// Length of the encoded array header and the leading field
+func leadingPrefixLen(key []byte) int {
+	if len(key) < 2 || key[0] != collatejson.TypeArray {
+		return 0
+	}
+
+	field, err := jsonEncoder.ExtractEncodedField(key, 1)
+	if err != nil || len(field) == 0 || cap(key)-cap(field) != 1 {
+		return 0
+	}
+
+	return 1 + len(field)
+}
+
+// Compress returns the prefix compressed form of an encoded key or
+// secondary index entry in buf. The input is returned unchanged if the
+// leading prefix is too small to benefit or the dictionary is full.
+func (d *prefixDictionary) Compress(entry []byte, buf []byte) []byte {
+	plen := leadingPrefixLen(entry)
+	if plen < d.minPrefixLen || plen >= len(entry) {
+		return entry
+	}
+
+	id, ok := d.lookupOrAdd(entry[:plen])
+	if !ok {
+		return entry
+	}
+
+	var hdr [binary.MaxVarintLen32 + 1]byte
+	hdr[0] = prefixCompressedMarker
+	n := binary.PutUvarint(hdr[1:], uint64(id))
+	if 1+n >= plen {
+		return entry
+	}
+
+	buf = append(buf[:0], hdr[:1+n]...)
+	buf = append(buf, entry[plen:]...)
+	return buf
+}
+
+// split returns the dictionary prefix and remaining suffix of a compressed
+// entry. Prefix is nil for uncompressed entries.
+func (d *prefixDictionary) split(entry []byte) ([]byte, []byte) {
+	if len(entry) == 0 || entry[0] != prefixCompressedMarker {
+		return nil, entry
+	}
+
+	id, n := binary.Uvarint(entry[1:])
+	if n <= 0 {
+		panic(ErrPrefixDictCorrupted)
+	}
+
+	prefix, ok := d.get(uint32(id))
+	if !ok {
+		panic(fmt.Errorf("%v (unknown prefix id %v)", ErrPrefixDictCorrupted, id))
+	}
+
+	return prefix, entry[1+n:]
+}
+
+// Expand returns the original encoding of entry. Uncompressed entries
+// are returned as is, without copy.
+func (d *prefixDictionary) Expand(entry []byte, buf []byte) []byte {
+	prefix, suffix := d.split(entry)
+	if prefix == nil {
+		return entry
+	}
+
+	buf = append(buf[:0], prefix...)
+	buf = append(buf, suffix...)
+	return buf
+}
+
+// Number of bytes saved by the compressed form of an entry
+func (d *prefixDictionary) savings(entry []byte) int64 {
+	prefix, suffix := d.split(entry)
+	if prefix == nil {
+		return 0
+	}
+	return int64(len(prefix) + len(suffix) - len(entry))
+}
+
+func (d *prefixDictionary) addSavings(n int64) {
+	if n != 0 {
+		atomic.AddInt64(&d.savedBytes, n)
+	}
+}
+
+func (d *prefixDictionary) setSavings(n int64) {
+	atomic.StoreInt64(&d.savedBytes, n)
+}
+
+func (d *prefixDictionary) trackInsert(entry []byte) {
+	d.addSavings(d.savings(entry))
+}
+
+func (d *prefixDictionary) trackDelete(entry []byte) {
+	d.addSavings(-d.savings(entry))
+}
+
+// Compare compressed or uncompressed entries by their expanded form
+func (d *prefixDictionary) Compare(a, b []byte) int {
+	ap, as := d.split(a)
+	bp, bs := d.split(b)
+	if ap == nil && bp == nil {
+		return bytes.Compare(a, b)
+	}
+
+	return compareSplitBytes(ap, as, bp, bs)
+}
+
+// Compare a1+a2 with b1+b2 without concatenation
+func compareSplitBytes(a1, a2, b1, b2 []byte) int {
+	for {
+		if len(a1) == 0 {
+			a1, a2 = a2, nil
+		}
+		if len(b1) == 0 {
+			b1, b2 = b2, nil
+		}
+
+		if len(a1) == 0 || len(b1) == 0 {
+			if len(a1) == len(b1) {
+				return 0
+			} else if len(a1) == 0 {
+				return -1
+			}
+			return 1
+		}
+
+		n := len(a1)
+		if len(b1) < n {
+			n = len(b1)
+		}
+
+		if r := bytes.Compare(a1[:n], b1[:n]); r != 0 {
+			return r
+		}
+
+		a1, b1 = a1[n:], b1[n:]
+	}
+}
+
+// Binary encoding of the dictionary
+// [uint32_count]([uvarint_len][prefix_bytes])*
+// Returns the encoded bytes along with the number of entries encoded.
+func (d *prefixDictionary) Bytes() ([]byte, uint32) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	count := atomic.LoadUint32(&d.count)
+	buf := make([]byte, 4, 4+int(d.Size())+int(count)*2)
+	binary.LittleEndian.PutUint32(buf, count)
+
+	var lbuf [binary.MaxVarintLen32]byte
+	for id := uint32(0); id < count; id++ {
+		prefix, _ := d.get(id)
+		n := binary.PutUvarint(lbuf[:], uint64(len(prefix)))
+		buf = append(buf, lbuf[:n]...)
+		buf = append(buf, prefix...)
+	}
+
+	return buf, count
+}
+
+// Load merges a persisted dictionary. Ids are never reassigned, hence any
+// id already known should map to the same prefix. Ids beyond the current
+// count are appended.
+func (d *prefixDictionary) Load(bs []byte) error {
+	if len(bs) < 4 {
+		return ErrPrefixDictCorrupted
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	count := binary.LittleEndian.Uint32(bs[:4])
+	bs = bs[4:]
+	for id := uint32(0); id < count; id++ {
+		l, n := binary.Uvarint(bs)
+		if n <= 0 || uint64(len(bs)-n) < l {
+			return ErrPrefixDictCorrupted
+		}
+		prefix := bs[n : n+int(l)]
+		bs = bs[n+int(l):]
+
+		if curr, ok := d.get(id); ok {
+			if !bytes.Equal(curr, prefix) {
+				return fmt.Errorf("%v (prefix id %v mismatch)", ErrPrefixDictCorrupted, id)
+			}
+			continue
+		}
+
+		if _, ok := d.add(prefix); !ok {
+			return fmt.Errorf("%v (exceeds max entries %v)", ErrPrefixDictCorrupted, d.maxEntries)
+		}
+	}
+
+	atomic.StoreUint32(&d.persistedCnt, count)
+	return nil
+}
+
+// Returns true if there are dictionary entries added after the last
+// persisted or loaded version.
+func (d *prefixDictionary) isDirty() bool {
+	return atomic.LoadUint32(&d.count) != atomic.LoadUint32(&d.persistedCnt)
+}
+
+func (d *prefixDictionary) setPersisted(count uint32) {
+	atomic.StoreUint32(&d.persistedCnt, count)
+}
@@ -0,0 +1,113 @@
+package indexer
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestPrefixCompressEntry(t *testing.T) {
+	dict := newPrefixDictionary(4, 1024)
+	buf := make([]byte, 0, 1024)
+	cbuf := make([]byte, 0, 1024)
+
+	e, err := NewSecondaryIndexEntry([]byte(`["tenant-000001","order",10]`), []byte("doc-1"),
+		false, 1, nil, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := append([]byte(nil), e...)
+
+	c := dict.Compress(e, cbuf)
+	if c[0] != prefixCompressedMarker {
+		t.Fatalf("Expected compressed entry, received %v", c)
+	}
+	if len(c) >= len(orig) {
+		t.Errorf("Expected compressed size < %v, received %v", len(orig), len(c))
+	}
+
+	if !bytes.Equal(docIdFromEntryBytes(c), []byte("doc-1")) {
+		t.Errorf("Expected docid doc-1 from compressed entry, received %s", docIdFromEntryBytes(c))
+	}
+
+	exp := dict.Expand(c, nil)
+	if !bytes.Equal(exp, orig) {
+		t.Errorf("Expected %v, received %v", orig, exp)
+	}
+
+	if dict.Compare(c, orig) != 0 {
+		t.Errorf("Expected compressed entry to compare equal to original")
+	}
+
+	if s := dict.savings(c); s != int64(len(orig)-len(c)) {
+		t.Errorf("Expected savings %v, received %v", len(orig)-len(c), s)
+	}
+
+	// Short leading field is not compressed
+	e, _ = NewSecondaryIndexEntry([]byte(`[1,"order"]`), []byte("doc-2"), false, 1, nil, buf)
+	dict.minPrefixLen = 16
+	if c := dict.Compress(e, cbuf); c[0] == prefixCompressedMarker {
+		t.Errorf("Expected uncompressed entry for short prefix")
+	}
+}
+
+func TestPrefixCompressOrdering(t *testing.T) {
+	dict := newPrefixDictionary(2, 1024)
+	keys := []string{
+		`["b-tenant","x"]`, `["a-tenant","z"]`, `["a-tenant","a"]`,
+		`["c","y"]`, `["b-tenant","b"]`, `["a-tenant-long","a"]`,
+	}
+
+	var raw, compressed [][]byte
+	for i, k := range keys {
+		e, err := NewSecondaryIndexEntry([]byte(k), []byte{byte('a' + i)}, false, 1, nil, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw = append(raw, append([]byte(nil), e...))
+		compressed = append(compressed, append([]byte(nil), dict.Compress(e, nil)...))
+	}
+
+	sort.Slice(raw, func(i, j int) bool { return bytes.Compare(raw[i], raw[j]) < 0 })
+	sort.Slice(compressed, func(i, j int) bool { return dict.Compare(compressed[i], compressed[j]) < 0 })
+
+	for i := range raw {
+		if exp := dict.Expand(compressed[i], nil); !bytes.Equal(exp, raw[i]) {
+			t.Errorf("Order mismatch at %v: expected %v, received %v", i, raw[i], exp)
+		}
+	}
+}
+
+func TestPrefixDictionaryLoad(t *testing.T) {
+	dict := newPrefixDictionary(2, 1024)
+	e, _ := NewSecondaryIndexEntry([]byte(`["tenant-1","v"]`), []byte("doc-1"), false, 1, nil, make([]byte, 0, 1024))
+	orig := append([]byte(nil), e...)
+	c := append([]byte(nil), dict.Compress(e, nil)...)
+
+	bs, count := dict.Bytes()
+	if count != 1 {
+		t.Errorf("Expected 1 dictionary entry, received %v", count)
+	}
+
+	dict2 := newPrefixDictionary(2, 1024)
+	if err := dict2.Load(bs); err != nil {
+		t.Fatal(err)
+	}
+	if exp := dict2.Expand(c, nil); !bytes.Equal(exp, orig) {
+		t.Errorf("Expected %v, received %v", orig, exp)
+	}
+
+	// Loading an older version of the same dictionary is a no-op
+	e, _ = NewSecondaryIndexEntry([]byte(`["tenant-2","v"]`), []byte("doc-2"), false, 1, nil, make([]byte, 0, 1024))
+	dict2.Compress(e, nil)
+	if err := dict2.Load(bs); err != nil || dict2.Count() != 2 {
+		t.Errorf("Expected 2 entries after reload, received %v (%v)", dict2.Count(), err)
+	}
+
+	// Conflicting dictionary
+	dict3 := newPrefixDictionary(2, 1024)
+	dict3.Compress(e, nil)
+	if err := dict3.Load(bs); err == nil {
+		t.Errorf("Expected error on loading conflicting dictionary")
+	}
+}
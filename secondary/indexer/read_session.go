@@ -0,0 +1,292 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Read sessions.
+//
+// A read session pins the snapshot of one or more index instances for
+// a bounded ttl, so that scans carrying the session id read the same
+// snapshot. A pinned snapshot holds back garbage collection in storage,
+// retaining the growth in memory used by its index since it was pinned.
+// Snapshots of an index pinned by several sessions retain that memory
+// once, it is charged to the session holding the oldest snapshot. Sessions
+// are expired on ttl, and oldest sessions holding memory are forcibly
+// expired when the memory retained by all sessions exceeds
+// scan.session.memQuota.
+
+var (
+	ErrReadSessionNotFound = errors.New("Read session not found or expired")
+	ErrReadSessionNotIndex = errors.New("Index snapshot not pinned by read session")
+	ErrReadSessionLimit    = errors.New("Too many open read sessions")
+)
+
+type pinnedSnapshot struct {
+	is      IndexSnapshot
+	memUsed int64 // memory used by index when pinned
+}
+
+type readSession struct {
+	id      string
+	created time.Time
+	expiry  time.Time
+	snaps   map[common.IndexInstId]*pinnedSnapshot
+	charge  int64
+}
+
+type readSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*readSession
+	finch    chan bool
+	closed   bool
+
+	sco     *scanCoordinator
+	memUsed func(common.IndexInstId) int64
+}
+
+func newReadSessions(sco *scanCoordinator) *readSessions {
+	rs := &readSessions{
+		sessions: make(map[string]*readSession),
+		finch:    make(chan bool),
+		sco:      sco,
+		memUsed:  sco.indexMemUsed,
+	}
+	go rs.expire()
+	return rs
+}
+
+// pin a clone of snapshot `is` in session `id`, creating the session if
+// it does not exist. ttl of the session is extended to `ttl`.
+func (rs *readSessions) pin(id string, is IndexSnapshot, ttl time.Duration) error {
+	cfg := rs.sco.config.Load()
+	if maxTtl := time.Duration(cfg["scan.session.maxTtl"].Int()) * time.Second; ttl <= 0 || ttl > maxTtl {
+		ttl = maxTtl
+	}
+	memUsed := rs.memUsed(is.IndexInstId())
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	sess, ok := rs.sessions[id]
+	if !ok {
+		if rs.closed || len(rs.sessions) >= cfg["scan.session.maxSessions"].Int() {
+			return ErrReadSessionLimit
+		}
+		sess = &readSession{
+			id:      id,
+			created: time.Now(),
+			snaps:   make(map[common.IndexInstId]*pinnedSnapshot),
+		}
+		rs.sessions[id] = sess
+	}
+
+	// snapshot is pinned once per session, later requests for the
+	// same index (other partitions) read the snapshot pinned first.
+	if _, ok := sess.snaps[is.IndexInstId()]; !ok {
+		sess.snaps[is.IndexInstId()] = &pinnedSnapshot{
+			is:      CloneIndexSnapshot(is),
+			memUsed: memUsed,
+		}
+	}
+	if expiry := time.Now().Add(ttl); expiry.After(sess.expiry) {
+		sess.expiry = expiry
+	}
+	return nil
+}
+
+// get return a clone of snapshot of `instId` pinned by session `id`.
+func (rs *readSessions) get(id string, instId common.IndexInstId) (IndexSnapshot, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	sess, ok := rs.sessions[id]
+	if !ok {
+		return nil, ErrReadSessionNotFound
+	}
+	snap, ok := sess.snaps[instId]
+	if !ok {
+		return nil, ErrReadSessionNotIndex
+	}
+	return CloneIndexSnapshot(snap.is), nil
+}
+
+// close session `id`, releasing its pinned snapshots.
+func (rs *readSessions) close(id string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if sess, ok := rs.sessions[id]; ok {
+		rs.destroy(sess)
+	}
+}
+
+// release snapshots of index instance `instId` pinned by any session,
+// on index drop or rollback.
+func (rs *readSessions) release(instId common.IndexInstId) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, sess := range rs.sessions {
+		if snap, ok := sess.snaps[instId]; ok {
+			DestroyIndexSnapshot(snap.is)
+			delete(sess.snaps, instId)
+		}
+	}
+}
+
+func (rs *readSessions) destroy(sess *readSession) {
+	for _, snap := range sess.snaps {
+		DestroyIndexSnapshot(snap.is)
+	}
+	delete(rs.sessions, sess.id)
+}
+
+// closeAll stops expiring sessions and releases all pinned snapshots,
+// on shutdown.
+func (rs *readSessions) closeAll() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return
+	}
+	rs.closed = true
+	close(rs.finch)
+	for _, sess := range rs.sessions {
+		rs.destroy(sess)
+	}
+}
+
+func (rs *readSessions) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			rs.expireSessions(now)
+		case <-rs.finch:
+			return
+		}
+	}
+}
+
+func (rs *readSessions) expireSessions(now time.Time) {
+	quota := int64(rs.sco.config.Load()["scan.session.memQuota"].Uint64())
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, sess := range rs.sessions {
+		if now.After(sess.expiry) {
+			logging.Infof("ScanCoordinator: Read session %v expired", sess.id)
+			rs.destroy(sess)
+		}
+	}
+
+	// force expiry of oldest sessions holding memory to bring the
+	// memory retained within quota.
+	memUsed := make(map[common.IndexInstId]int64)
+	total := rs.chargeSessions(memUsed)
+	var forced int64
+	for quota > 0 && total > quota {
+		var oldest *readSession
+		for _, sess := range rs.sessions {
+			if sess.charge > 0 && (oldest == nil || sess.created.Before(oldest.created)) {
+				oldest = sess
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		logging.Warnf("ScanCoordinator: Force expiring read session %v holding %v bytes, "+
+			"read sessions hold %v bytes over quota %v", oldest.id, oldest.charge, total, quota)
+		rs.destroy(oldest)
+		forced++
+		total = rs.chargeSessions(memUsed)
+	}
+
+	if stats := rs.sco.stats.Get(); stats != nil {
+		stats.numReadSessions.Set(int64(len(rs.sessions)))
+		stats.readSessionMemUsed.Set(total)
+		stats.numReadSessionsExpired.Add(forced)
+	}
+}
+
+// chargeSessions computes the memory retained by snapshots pinned by
+// sessions, each index charging the growth since its oldest pinned
+// snapshot to the session holding it. Returns memory retained by all
+// sessions, `memUsed` caches memory used by indexes.
+func (rs *readSessions) chargeSessions(memUsed map[common.IndexInstId]int64) int64 {
+	oldest := make(map[common.IndexInstId]*readSession)
+	for _, sess := range rs.sessions {
+		sess.charge = 0
+		for instId, snap := range sess.snaps {
+			if other, ok := oldest[instId]; !ok || snap.memUsed < other.snaps[instId].memUsed {
+				oldest[instId] = sess
+			}
+		}
+	}
+
+	var total int64
+	for instId, sess := range oldest {
+		used, ok := memUsed[instId]
+		if !ok {
+			used = rs.memUsed(instId)
+			memUsed[instId] = used
+		}
+		if growth := used - sess.snaps[instId].memUsed; growth > 0 {
+			sess.charge += growth
+			total += growth
+		}
+	}
+	return total
+}
+
+// indexMemUsed return memory used by all local partitions of index
+// instance `instId`.
+func (s *scanCoordinator) indexMemUsed(instId common.IndexInstId) int64 {
+	stats := s.stats.Get()
+	if stats == nil {
+		return 0
+	}
+	if idxStats, ok := stats.indexes[instId]; ok {
+		return idxStats.partnInt64Stats(func(ss *IndexStats) int64 {
+			return ss.memUsed.Value()
+		})
+	}
+	return 0
+}
+
+func (s *scanCoordinator) handleSessionRequest(req *ScanRequest, w ScanResponseWriter,
+	is IndexSnapshot) {
+
+	ttl := time.Duration(req.sessionTtl) * time.Second
+	err := s.readSessions.pin(req.SessionId, is, ttl)
+	if err == nil {
+		logging.Infof("%s Read session %v pinned snapshot of %v", req.LogPrefix,
+			req.SessionId, req.IndexInstId)
+	}
+	s.handleError(req.LogPrefix, w.Session(err))
+}
+
+func (s *scanCoordinator) handleCloseSessionRequest(req *ScanRequest, w ScanResponseWriter) {
+	s.readSessions.close(req.SessionId)
+	logging.Infof("%s Read session %v closed", req.LogPrefix, req.SessionId)
+	s.handleError(req.LogPrefix, w.Session(nil))
+}
@@ -0,0 +1,136 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestReadSessions(t *testing.T, memQuota uint64, memUsed map[c.IndexInstId]int64) *readSessions {
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("scan.session.maxSessions", 3)
+	conf.SetValue("scan.session.memQuota", memQuota)
+	sco := &scanCoordinator{}
+	sco.config.Store(conf)
+
+	rs := newReadSessions(sco)
+	rs.memUsed = func(instId c.IndexInstId) int64 { return memUsed[instId] }
+	return rs
+}
+
+func TestReadSessionPin(t *testing.T) {
+	memUsed := map[c.IndexInstId]int64{1: 100, 2: 100}
+	rs := newTestReadSessions(t, 0, memUsed)
+	defer rs.closeAll()
+
+	snap1, snap2 := &indexSnapshot{instId: 1}, &indexSnapshot{instId: 2}
+	if err := rs.pin("s1", snap1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.pin("s1", snap2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// later snapshots of an index do not replace the pinned one.
+	if err := rs.pin("s1", &indexSnapshot{instId: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if is, err := rs.get("s1", 1); err != nil || is != snap1 {
+		t.Errorf("expected pinned snapshot, got %v %v", is, err)
+	}
+	if _, err := rs.get("s1", 3); err != ErrReadSessionNotIndex {
+		t.Errorf("expected %v, got %v", ErrReadSessionNotIndex, err)
+	}
+	if _, err := rs.get("s2", 1); err != ErrReadSessionNotFound {
+		t.Errorf("expected %v, got %v", ErrReadSessionNotFound, err)
+	}
+
+	for _, id := range []string{"s2", "s3"} {
+		if err := rs.pin(id, snap1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.pin("s4", snap1, time.Minute); err != ErrReadSessionLimit {
+		t.Errorf("expected %v, got %v", ErrReadSessionLimit, err)
+	}
+
+	rs.release(1)
+	if _, err := rs.get("s1", 1); err != ErrReadSessionNotIndex {
+		t.Errorf("expected released snapshot, got %v", err)
+	}
+	rs.close("s1")
+	if _, err := rs.get("s1", 2); err != ErrReadSessionNotFound {
+		t.Errorf("expected closed session, got %v", err)
+	}
+
+	rs.closeAll()
+	if err := rs.pin("s5", snap1, time.Minute); err != ErrReadSessionLimit {
+		t.Errorf("expected no session opened after close, got %v", err)
+	}
+}
+
+func TestReadSessionExpire(t *testing.T) {
+	rs := newTestReadSessions(t, 0, map[c.IndexInstId]int64{})
+	defer rs.closeAll()
+
+	if err := rs.pin("s1", &indexSnapshot{instId: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.pin("s2", &indexSnapshot{instId: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	rs.expireSessions(time.Now().Add(2 * time.Minute))
+	if _, err := rs.get("s1", 1); err != ErrReadSessionNotFound {
+		t.Errorf("expected s1 to expire, got %v", err)
+	}
+	if _, err := rs.get("s2", 1); err != nil {
+		t.Errorf("expected s2 to be open, got %v", err)
+	}
+}
+
+func TestReadSessionMemQuota(t *testing.T) {
+	memUsed := map[c.IndexInstId]int64{1: 100, 2: 100}
+	rs := newTestReadSessions(t, 150, memUsed)
+	defer rs.closeAll()
+
+	// s1 and s2 pin index 1 at 100 and 200, s3 pins index 2 at 100.
+	if err := rs.pin("s1", &indexSnapshot{instId: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	memUsed[1] = 200
+	if err := rs.pin("s2", &indexSnapshot{instId: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := rs.pin("s3", &indexSnapshot{instId: 2}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// index growth is charged once, to the oldest snapshot.
+	memUsed[1] = 250
+	rs.expireSessions(time.Now())
+	if total := rs.chargeSessions(make(map[c.IndexInstId]int64)); total != 150 {
+		t.Errorf("expected 150 bytes retained, got %v", total)
+	}
+	if ch := rs.sessions["s1"].charge; ch != 150 {
+		t.Errorf("expected s1 to be charged 150, got %v", ch)
+	}
+	if ch := rs.sessions["s2"].charge; ch != 0 {
+		t.Errorf("expected s2 not to be charged, got %v", ch)
+	}
+
+	// over quota, s1 is expired and s2 is charged from its snapshot.
+	memUsed[2] = 120
+	rs.expireSessions(time.Now())
+	if _, ok := rs.sessions["s1"]; ok {
+		t.Errorf("expected s1 to be force expired")
+	}
+	if ch := rs.sessions["s2"].charge; ch != 50 {
+		t.Errorf("expected s2 to be charged 50, got %v", ch)
+	}
+	if _, ok := rs.sessions["s3"]; !ok {
+		t.Errorf("expected s3 to be open")
+	}
+}
@@ -74,6 +74,12 @@ type ServiceMgr struct {
 	localhttp string
 
 	moveStatusCh chan error
+
+	peerServer *peerTransferServer
+
+	backupMu sync.Mutex //serializes backup of index data
+
+	rebuilds map[c.IndexInstId]bool //index instances being rebuilt
 }
 
 type rebalanceContext struct {
@@ -120,6 +126,7 @@ func NewRebalanceMgr(supvCmdch MsgChannel, supvMsgch MsgChannel, config c.Config
 		supvCmdch:    supvCmdch,
 		supvMsgch:    supvMsgch,
 		moveStatusCh: make(chan error),
+		rebuilds:     make(map[c.IndexInstId]bool),
 	}
 
 	mgr.config.Store(config)
@@ -148,6 +155,7 @@ func NewRebalanceMgr(supvCmdch MsgChannel, supvMsgch MsgChannel, config c.Config
 	mgr.rebalanceRunning = rebalanceRunning
 	mgr.rebalanceToken = rebalanceToken
 	mgr.localhttp = mgr.getLocalHttpAddr()
+	mgr.peerServer = newPeerTransferServer(config["storage_dir"].String())
 
 	go mgr.recoverRebalance()
 	go mgr.run()
@@ -170,6 +178,15 @@ func (m *ServiceMgr) initService() {
 	http.HandleFunc("/moveIndex", m.handleMoveIndex)
 	http.HandleFunc("/moveIndexInternal", m.handleMoveIndexInternal)
 	http.HandleFunc("/nodeuuid", m.handleNodeuuid)
+	http.HandleFunc("/rebalance/snapshotManifest", m.handleSnapshotManifest)
+	http.HandleFunc("/rebalance/snapshotFile", m.handleSnapshotFile)
+	http.HandleFunc("/rebalance/snapshotDone", m.handleSnapshotDone)
+	http.HandleFunc("/backupLocalIndexData", m.handleBackupLocalIndexData)
+	http.HandleFunc("/backupFile", m.handleBackupFile)
+	http.HandleFunc("/restoreLocalIndexData", m.handleRestoreLocalIndexData)
+	http.HandleFunc("/rebuildIndex", m.handleRebuildIndex)
+	http.HandleFunc("/rebuildIndexInternal", m.handleRebuildIndexInternal)
+	http.HandleFunc("/rebuildLocalIndex", m.handleRebuildLocalIndex)
 }
 
 //update node list after restart
@@ -231,6 +248,9 @@ func (m *ServiceMgr) handleSupervisorCommands(cmd Message) {
 	case CONFIG_SETTINGS_UPDATE:
 		m.handleConfigUpdate(cmd)
 
+	case INDEXER_REBUILD_INDEX:
+		m.handleRebuildPausedIndex(cmd)
+
 	default:
 		l.Fatalf("ServiceMgr::handleSupervisorCommands Unknown Message %+v", cmd)
 		c.CrashOnError(errors.New("Unknown Msg On Supv Channel"))
@@ -648,6 +668,17 @@ func (m *ServiceMgr) startRebalance(change service.TopologyChange) error {
 		}
 		elapsed := time.Since(start)
 		l.Infof("ServiceMgr::startRebalance Planner Time Taken %v", elapsed)
+
+		if cfg["rebalance.peerTransfer.enable"].Bool() {
+			for ttid, tt := range transferTokens {
+				mode := c.IndexTypeToStorageMode(tt.IndexInst.Defn.Using)
+				if tt.TransferMode == c.TokenTransferModeMove && tt.SourceId != "" &&
+					peerStagingSupported(mode) {
+					tt.BuildSource = c.TokenBuildSourcePeer
+					l.Infof("ServiceMgr::startRebalance Transfer index files from peer for %v", ttid)
+				}
+			}
+		}
 	}
 
 	ctx := &rebalanceContext{
@@ -734,6 +765,10 @@ func (m *ServiceMgr) checkExistingGlobalRToken() (*RebalanceToken, error) {
 
 func (m *ServiceMgr) initPreparePhaseRebalance() error {
 
+	if m.checkRebuildRunning() {
+		return errors.New("Cannot Process Rebalance - Rebuild Index In Progress")
+	}
+
 	err := m.registerRebalanceRunning(true)
 	if err != nil {
 		return err
@@ -1198,6 +1233,10 @@ func (m *ServiceMgr) rebalanceJanitor() {
 					l.Errorf("ServiceMgr::rebalanceJanitor Error Cleaning Transfer Tokens %v", err)
 				}
 			}
+
+			if !m.checkRebuildRunning() {
+				m.recoverRebuildLOCKED()
+			}
 		}
 		m.mu.Unlock()
 	}
@@ -2256,6 +2295,10 @@ func (m *ServiceMgr) initMoveIndex(req *manager.IndexRequest, nodes []string) (e
 		return errors.New("Cannot Process Move Index - Rebalance/MoveIndex In Progress"), false
 	}
 
+	if m.checkRebuildRunning() {
+		return errors.New("Cannot Process Move Index - Rebuild Index In Progress"), false
+	}
+
 	if err := m.genMoveIndexToken(); err != nil {
 		m.rebalanceToken = nil
 		return err, false
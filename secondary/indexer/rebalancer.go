@@ -423,48 +423,22 @@ func (r *Rebalancer) processTokenAsDest(ttid string, tt *c.TransferToken) bool {
 	switch tt.State {
 	case c.TransferTokenCreated:
 
-		indexDefn := tt.IndexInst.Defn
-		indexDefn.Nodes = nil
-		indexDefn.Deferred = true
-		indexDefn.InstId = tt.InstId
-		indexDefn.RealInstId = tt.RealInstId
-
-		ir := manager.IndexRequest{Index: indexDefn}
-		body, err := json.Marshal(&ir)
-		if err != nil {
-			l.Errorf("Rebalancer::processTokenAsDest Error marshal clone index %v", err)
-			r.setTransferTokenError(ttid, tt, err.Error())
-			return true
-		}
-
-		bodybuf := bytes.NewBuffer(body)
-
-		url := "/createIndexRebalance"
-		resp, err := postWithAuth(r.localaddr+url, "application/json", bodybuf)
-		if err != nil {
-			l.Errorf("Rebalancer::processTokenAsDest Error register clone index on %v %v", r.localaddr+url, err)
-			r.setTransferTokenError(ttid, tt, err.Error())
-			return true
-		}
-
-		response := new(manager.IndexResponse)
-		if err := convertResponse(resp, response); err != nil {
-			l.Errorf("Rebalancer::processTokenAsDest Error unmarshal response %v %v", r.localaddr+url, err)
-			r.setTransferTokenError(ttid, tt, err.Error())
-			return true
-		}
-		if response.Code == manager.RESP_ERROR {
-			l.Errorf("Rebalancer::processTokenAsDest Error cloning index %v %v", r.localaddr+url, response.Error)
-			r.setTransferTokenError(ttid, tt, response.Error)
+		if tt.BuildSource == c.TokenBuildSourcePeer {
+			if !r.addToWaitGroup() {
+				return true
+			}
+			go func() {
+				defer r.wg.Done()
+				if err := r.transferIndexFromPeer(ttid, tt); err != nil {
+					l.Warnf("Rebalancer::processTokenAsDest Falling back to DCP build for %v. "+
+						"Peer transfer error %v", ttid, err)
+					tt.BuildSource = c.TokenBuildSourceDcp
+				}
+				r.createIndexAsDest(ttid, tt)
+			}()
 			return true
 		}
-
-		tt.State = c.TransferTokenAccepted
-		setTransferTokenInMetakv(ttid, tt)
-
-		r.mu.Lock()
-		r.acceptedTokens[ttid] = tt
-		r.mu.Unlock()
+		r.createIndexAsDest(ttid, tt)
 
 	case c.TransferTokenInitate:
 
@@ -506,6 +480,54 @@ func (r *Rebalancer) processTokenAsDest(ttid string, tt *c.TransferToken) bool {
 	return true
 }
 
+// createIndexAsDest creates a deferred index for the transfer token
+// and marks the token as accepted.
+func (r *Rebalancer) createIndexAsDest(ttid string, tt *c.TransferToken) {
+
+	indexDefn := tt.IndexInst.Defn
+	indexDefn.Nodes = nil
+	indexDefn.Deferred = true
+	indexDefn.InstId = tt.InstId
+	indexDefn.RealInstId = tt.RealInstId
+
+	ir := manager.IndexRequest{Index: indexDefn}
+	body, err := json.Marshal(&ir)
+	if err != nil {
+		l.Errorf("Rebalancer::createIndexAsDest Error marshal clone index %v", err)
+		r.setTransferTokenError(ttid, tt, err.Error())
+		return
+	}
+
+	bodybuf := bytes.NewBuffer(body)
+
+	url := "/createIndexRebalance"
+	resp, err := postWithAuth(r.localaddr+url, "application/json", bodybuf)
+	if err != nil {
+		l.Errorf("Rebalancer::createIndexAsDest Error register clone index on %v %v", r.localaddr+url, err)
+		r.setTransferTokenError(ttid, tt, err.Error())
+		return
+	}
+
+	response := new(manager.IndexResponse)
+	if err := convertResponse(resp, response); err != nil {
+		l.Errorf("Rebalancer::createIndexAsDest Error unmarshal response %v %v", r.localaddr+url, err)
+		r.setTransferTokenError(ttid, tt, err.Error())
+		return
+	}
+	if response.Code == manager.RESP_ERROR {
+		l.Errorf("Rebalancer::createIndexAsDest Error cloning index %v %v", r.localaddr+url, response.Error)
+		r.setTransferTokenError(ttid, tt, response.Error)
+		return
+	}
+
+	tt.State = c.TransferTokenAccepted
+	setTransferTokenInMetakv(ttid, tt)
+
+	r.mu.Lock()
+	r.acceptedTokens[ttid] = tt
+	r.mu.Unlock()
+}
+
 func (r *Rebalancer) checkValidNotifyStateDest(ttid string, tt *c.TransferToken) bool {
 
 	r.mu.Lock()
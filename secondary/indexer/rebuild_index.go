@@ -0,0 +1,720 @@
+// @copyright 2019 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	l "github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+// Online rebuild of an index.
+//
+// Each indexer node hosting the index creates a proxy of every active
+// instance of the index, with the same replica id and partitions, and a
+// higher instance version. Unlike the proxy of a partition moved by
+// rebalance, the proxy of a rebuild has its own files (see IndexPath), and
+// it is not merged into its real instance. The proxy stays in REBAL_PENDING
+// state, hidden from clients and scans, while it is built from DCP. Once it
+// has caught up with the mutation stream of its real instance, indexer
+// swaps them atomically: the proxy becomes a REBAL_ACTIVE instance of its
+// own and the real instance REBAL_PENDING_DELETE, in memory and in
+// metadata. The old instance is dropped after rebuild.dropDelay seconds,
+// to let scans already running on it finish.
+//
+//   POST /rebuildIndex             <- {"bucket":, "index":}
+//   POST /rebuildIndexInternal     <- IndexRequest with IndexIds
+//   POST /rebuildLocalIndex        <- IndexRequest with IndexIds
+
+var RebuildIndexStarted = "Rebuild Index has started. Check Indexes UI for progress and Logs UI for any error"
+
+var ErrRebuildNotCaughtUp = errors.New("Rebuilt index instance has not caught up with mutations")
+
+const rebuildSwapRetryInterval = time.Second
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  REST
+//
+/////////////////////////////////////////////////////////////////////////
+
+func (m *ServiceMgr) handleRebuildIndex(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleRebuildIndex Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if r.Method != "POST" {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Unsupported method")
+		return
+	}
+
+	bytes, _ := ioutil.ReadAll(r.Body)
+	in := make(map[string]interface{})
+	if err := json.Unmarshal(bytes, &in); err != nil {
+		send(http.StatusBadRequest, w, err.Error())
+		return
+	}
+
+	bucket, ok := in["bucket"].(string)
+	if !ok {
+		send(http.StatusBadRequest, w, "Bad Request - Bucket Information Missing")
+		return
+	}
+
+	index, ok := in["index"].(string)
+	if !ok {
+		send(http.StatusBadRequest, w, "Bad Request - Index Information Missing")
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", bucket)
+	if !c.IsAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	topology, err := m.getGlobalTopology()
+	if err != nil {
+		send(http.StatusInternalServerError, w, err.Error())
+		return
+	}
+
+	var defn *manager.IndexDefnDistribution
+	for _, localMeta := range topology.Metadata {
+		bTopology := findTopologyByBucket(localMeta.IndexTopologies, bucket)
+		if bTopology != nil {
+			defn = bTopology.FindIndexDefinition(bucket, index)
+		}
+		if defn != nil {
+			break
+		}
+	}
+	if defn == nil {
+		err := fmt.Errorf("Fail to find index definition for bucket %v index %v.", bucket, index)
+		l.Errorf("ServiceMgr::handleRebuildIndex %v", err)
+		send(http.StatusInternalServerError, w, err.Error())
+		return
+	}
+
+	code, errStr := m.doHandleRebuildIndex(c.IndexDefnId(defn.DefnId), topology)
+	if errStr != "" {
+		sendIndexResponseWithError(code, w, errStr)
+	} else {
+		sendIndexResponseMsg(w, RebuildIndexStarted)
+	}
+}
+
+func (m *ServiceMgr) handleRebuildIndexInternal(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleRebuildIndexInternal Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if r.Method != "POST" {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Unsupported method")
+		return
+	}
+
+	req, err := readRebuildIndexRequest(r)
+	if err != nil {
+		l.Errorf("ServiceMgr::handleRebuildIndexInternal %v", err)
+		sendIndexResponseWithError(http.StatusBadRequest, w, err.Error())
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", req.Index.Bucket)
+	if !c.IsAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	topology, err := m.getGlobalTopology()
+	if err != nil {
+		sendIndexResponseWithError(http.StatusInternalServerError, w, err.Error())
+		return
+	}
+
+	code, errStr := m.doHandleRebuildIndex(c.IndexDefnId(req.IndexIds.DefnIds[0]), topology)
+	if errStr != "" {
+		sendIndexResponseWithError(code, w, errStr)
+	} else {
+		sendIndexResponseMsg(w, RebuildIndexStarted)
+	}
+}
+
+func (m *ServiceMgr) handleRebuildLocalIndex(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := m.validateAuth(w, r)
+	if !ok {
+		l.Errorf("ServiceMgr::handleRebuildLocalIndex Validation Failure for Request %v", l.TagUD(r))
+		return
+	}
+
+	if r.Method != "POST" {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Unsupported method")
+		return
+	}
+
+	req, err := readRebuildIndexRequest(r)
+	if err != nil {
+		l.Errorf("ServiceMgr::handleRebuildLocalIndex %v", err)
+		sendIndexResponseWithError(http.StatusBadRequest, w, err.Error())
+		return
+	}
+
+	if !c.IsAllowed(creds, []string{"cluster.admin.internal.index!write"}, w) {
+		return
+	}
+
+	if err := m.rebuildLocalIndex(c.IndexDefnId(req.IndexIds.DefnIds[0])); err != nil {
+		l.Errorf("ServiceMgr::handleRebuildLocalIndex %v", err)
+		sendIndexResponseWithError(http.StatusInternalServerError, w, err.Error())
+		return
+	}
+
+	sendIndexResponseMsg(w, RebuildIndexStarted)
+}
+
+func readRebuildIndexRequest(r *http.Request) (*manager.IndexRequest, error) {
+
+	bytes, _ := ioutil.ReadAll(r.Body)
+	req := new(manager.IndexRequest)
+	if err := json.Unmarshal(bytes, req); err != nil {
+		return nil, err
+	}
+
+	if len(req.IndexIds.DefnIds) != 1 {
+		return nil, errors.New("Bad Request - Rebuild Index takes a single index")
+	}
+
+	return req, nil
+}
+
+// doHandleRebuildIndex starts the rebuild of the index on every indexer
+// node hosting it.
+func (m *ServiceMgr) doHandleRebuildIndex(defnId c.IndexDefnId,
+	topology *manager.ClusterIndexMetadata) (int, string) {
+
+	l.Infof("ServiceMgr::doHandleRebuildIndex Index %v", defnId)
+
+	m.mu.RLock()
+	rebalanceRunning := m.checkRebalanceRunning()
+	m.mu.RUnlock()
+	if rebalanceRunning {
+		return http.StatusInternalServerError, "Cannot Process Rebuild Index - Rebalance/MoveIndex In Progress"
+	}
+
+	var nodes []string
+	for _, localMeta := range topology.Metadata {
+		for _, t := range localMeta.IndexTopologies {
+			if defn := t.FindIndexDefinitionById(defnId); defn != nil {
+				nodes = append(nodes, localMeta.NodeUUID)
+				break
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return http.StatusBadRequest, fmt.Sprintf("Fail to find index definition %v", defnId)
+	}
+
+	clusterAddr := m.config.Load()["clusterAddr"].String()
+
+	req := manager.IndexRequest{IndexIds: client.IndexIdList{DefnIds: []uint64{uint64(defnId)}}}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	var errStr string
+	for _, nodeUUID := range nodes {
+
+		var err error
+		if nodeUUID == string(m.nodeInfo.NodeID) {
+			err = m.rebuildLocalIndex(defnId)
+		} else {
+			err = postRebuildLocalIndex(clusterAddr, nodeUUID, body)
+		}
+
+		if err != nil {
+			l.Errorf("ServiceMgr::doHandleRebuildIndex Error rebuilding index %v on node %v %v", defnId, nodeUUID, err)
+			errStr += fmt.Sprintf("Node %v: %v\n", nodeUUID, err)
+		}
+	}
+
+	if errStr != "" {
+		return http.StatusInternalServerError, errStr
+	}
+	return http.StatusOK, ""
+}
+
+func postRebuildLocalIndex(clusterAddr, nodeUUID string, body []byte) error {
+
+	addr, err := getIndexerAddrByNodeUUID(clusterAddr, nodeUUID)
+	if err != nil {
+		return err
+	}
+
+	url := "/rebuildLocalIndex"
+	resp, err := postWithAuth(addr+url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	response := new(manager.IndexResponse)
+	if err := convertResponse(resp, response); err != nil {
+		return err
+	}
+	if response.Code == manager.RESP_ERROR {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  rebuild
+//
+/////////////////////////////////////////////////////////////////////////
+
+// rebuildLocalIndex starts the rebuild of the active instances of an
+// index on this node.
+func (m *ServiceMgr) rebuildLocalIndex(defnId c.IndexDefnId) error {
+
+	localMeta, err := m.getLocalIndexMetadata()
+	if err != nil {
+		return err
+	}
+
+	var defn *c.IndexDefn
+	for i, d := range localMeta.IndexDefinitions {
+		if d.DefnId == defnId {
+			defn = &localMeta.IndexDefinitions[i]
+			break
+		}
+	}
+	if defn == nil {
+		return fmt.Errorf("Index %v does not exist on this node", defnId)
+	}
+
+	topology := findTopologyByBucket(localMeta.IndexTopologies, defn.Bucket)
+	if topology == nil {
+		return fmt.Errorf("Topology Information Missing for %v Bucket", defn.Bucket)
+	}
+
+	insts, err := rebuildIndexInsts(defn, topology.FindIndexDefinitionById(defnId))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.checkRebalanceRunning() {
+		return errors.New("Cannot Process Rebuild Index - Rebalance/MoveIndex In Progress")
+	}
+	for _, inst := range insts {
+		if m.rebuilds[c.IndexInstId(inst.InstId)] {
+			return fmt.Errorf("Index %v.%v is already being rebuilt", defn.Bucket, defn.Name)
+		}
+	}
+
+	// drop the leftovers of a previous rebuild first
+	m.recoverRebuildIndex(localMeta, defnId)
+
+	for _, inst := range insts {
+		m.rebuilds[c.IndexInstId(inst.InstId)] = true
+		go m.rebuildIndexInst(*defn, inst)
+	}
+
+	return nil
+}
+
+func (m *ServiceMgr) checkRebuildRunning() bool {
+	return len(m.rebuilds) != 0
+}
+
+// rebuildIndexInsts returns the instances of an index to rebuild: the
+// active instances which are not proxies.
+func rebuildIndexInsts(defn *c.IndexDefn, defnDist *manager.IndexDefnDistribution) ([]manager.IndexInstDistribution, error) {
+
+	if defnDist == nil {
+		return nil, fmt.Errorf("Index %v does not exist on this node", defn.DefnId)
+	}
+
+	var insts []manager.IndexInstDistribution
+	for _, inst := range defnDist.Instances {
+		if inst.IsProxy() || c.RebalanceState(inst.RState) != c.REBAL_ACTIVE ||
+			c.IndexState(inst.State) == c.INDEX_STATE_DELETED {
+			continue
+		}
+		if c.IndexState(inst.State) != c.INDEX_STATE_ACTIVE {
+			return nil, fmt.Errorf("Index %v.%v is not built", defn.Bucket, defn.Name)
+		}
+		insts = append(insts, inst)
+	}
+
+	if len(insts) == 0 {
+		return nil, fmt.Errorf("Index %v does not exist on this node", defn.DefnId)
+	}
+	return insts, nil
+}
+
+// rebuildIndexInst builds a proxy of inst, and swaps them once the proxy
+// has caught up.
+func (m *ServiceMgr) rebuildIndexInst(defn c.IndexDefn, inst manager.IndexInstDistribution) {
+
+	instId := c.IndexInstId(inst.InstId)
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.rebuilds, instId)
+		m.mu.Unlock()
+	}()
+
+	t0 := time.Now()
+
+	newInstId, err := m.createRebuildIndexInst(defn, inst)
+	if err == nil {
+		err = m.buildRebuildIndexInst(defn, newInstId)
+		if err == nil {
+			err = m.swapRebuildIndexInst(defn, instId, newInstId)
+		}
+
+		if err != nil {
+			m.dropRebuildIndexInst(defn, newInstId)
+		}
+	}
+
+	if err != nil {
+		clusterAddr := m.config.Load()["clusterAddr"].String()
+		l.Errorf("ServiceMgr::rebuildIndexInst Rebuild of index %v instance %v failed: %v", defn.DefnId, instId, err)
+		c.Console(clusterAddr, fmt.Sprintf("Rebuild Index %v.%v failed: %v", defn.Bucket, defn.Name, err))
+		return
+	}
+
+	l.Infof("ServiceMgr::rebuildIndexInst Index %v instance %v swapped with rebuilt instance %v. Took %v",
+		defn.DefnId, instId, newInstId, time.Since(t0))
+
+	// let running scans on the old instance finish before dropping it
+	dropDelay := m.config.Load()["rebuild.dropDelay"].Int()
+	time.Sleep(time.Duration(dropDelay) * time.Second)
+
+	m.dropRebuildIndexInst(defn, instId)
+}
+
+func (m *ServiceMgr) createRebuildIndexInst(defn c.IndexDefn,
+	inst manager.IndexInstDistribution) (c.IndexInstId, error) {
+
+	newInstId, err := c.NewIndexInstId()
+	if err != nil {
+		return 0, err
+	}
+
+	defn.Nodes = nil
+	defn.Deferred = true
+	defn.InstId = newInstId
+	defn.RealInstId = c.IndexInstId(inst.InstId)
+	defn.ReplicaId = int(inst.ReplicaId)
+	defn.InstVersion = int(inst.Version) + 1
+	defn.NumPartitions = inst.NumPartitions
+	defn.Partitions = nil
+	defn.Versions = nil
+	for _, partn := range inst.Partitions {
+		defn.Partitions = append(defn.Partitions, c.PartitionId(partn.PartId))
+		defn.Versions = append(defn.Versions, int(partn.Version))
+	}
+
+	l.Infof("ServiceMgr::createRebuildIndexInst Index %v instance %v proxy instance %v",
+		defn.DefnId, inst.InstId, newInstId)
+
+	if err := m.postIndexRequest("/createIndexRebuild", &manager.IndexRequest{Index: defn}); err != nil {
+		return 0, err
+	}
+
+	return newInstId, nil
+}
+
+func (m *ServiceMgr) buildRebuildIndexInst(defn c.IndexDefn, newInstId c.IndexInstId) error {
+
+	// only the proxy instance of the index is in READY state
+	idList := client.IndexIdList{DefnIds: []uint64{uint64(defn.DefnId)}}
+	if err := m.postIndexRequest("/buildIndex", &manager.IndexRequest{IndexIds: idList}); err != nil {
+		return err
+	}
+
+	for {
+		time.Sleep(time.Second)
+
+		localMeta, err := m.getLocalIndexMetadata()
+		if err != nil {
+			l.Errorf("ServiceMgr::buildRebuildIndexInst Error getting local metadata %v", err)
+			continue
+		}
+
+		topology := findTopologyByBucket(localMeta.IndexTopologies, defn.Bucket)
+		if topology == nil {
+			return fmt.Errorf("Topology Information Missing for %v Bucket", defn.Bucket)
+		}
+
+		state, errStr := topology.GetStatusByInst(defn.DefnId, newInstId)
+		if errStr != "" {
+			return errors.New(errStr)
+		}
+		if state == c.INDEX_STATE_NIL || state == c.INDEX_STATE_DELETED {
+			return fmt.Errorf("Index instance %v has been dropped", newInstId)
+		}
+		if state == c.INDEX_STATE_ACTIVE {
+			return nil
+		}
+	}
+}
+
+// swapRebuildIndexInst waits for the proxy instance to catch up with the
+// mutation stream of its real instance, and swaps them.
+func (m *ServiceMgr) swapRebuildIndexInst(defn c.IndexDefn, instId, newInstId c.IndexInstId) error {
+
+	for {
+		respch := make(chan error, 1)
+		m.supvMsgch <- &MsgSwapIndexInst{
+			instId:    instId,
+			newInstId: newInstId,
+			respch:    respch,
+		}
+
+		err := <-respch
+		if err != ErrRebuildNotCaughtUp {
+			return err
+		}
+
+		time.Sleep(rebuildSwapRetryInterval)
+	}
+}
+
+func (m *ServiceMgr) dropRebuildIndexInst(defn c.IndexDefn, instId c.IndexInstId) {
+
+	defn.InstId = instId
+	defn.RealInstId = instId
+	if err := m.cleanupIndex(defn); err != nil {
+		l.Errorf("ServiceMgr::dropRebuildIndexInst Error dropping index %v instance %v %v",
+			defn.DefnId, instId, err)
+	}
+}
+
+// recoverRebuildIndex drops the instances left over by an interrupted
+// rebuild: a proxy which has not been swapped yet, or an old instance
+// which has been swapped but not dropped. Only indexes of defnId are
+// recovered, or all indexes if defnId is 0.
+func (m *ServiceMgr) recoverRebuildIndex(localMeta *manager.LocalIndexMetadata, defnId c.IndexDefnId) {
+
+	for _, defn := range localMeta.IndexDefinitions {
+		if defnId != 0 && defn.DefnId != defnId {
+			continue
+		}
+
+		topology := findTopologyByBucket(localMeta.IndexTopologies, defn.Bucket)
+		if topology == nil {
+			continue
+		}
+		defnDist := topology.FindIndexDefinitionById(defn.DefnId)
+		if defnDist == nil {
+			continue
+		}
+
+		for _, inst := range rebuildLeftovers(defnDist, m.rebuilds) {
+			l.Infof("ServiceMgr::recoverRebuildIndex Drop index %v instance %v in %v state",
+				defn.DefnId, inst.InstId, c.RebalanceState(inst.RState))
+			m.dropRebuildIndexInst(defn, c.IndexInstId(inst.InstId))
+		}
+	}
+}
+
+// rebuildLeftovers returns the instances of an index left over by an
+// interrupted rebuild, given the instances being rebuilt.  A proxy
+// rebuilding an instance is left over if the instance is not being
+// rebuilt.  An instance pending delete is left over if it is not being
+// rebuilt, and another active instance of its replica exists.
+func rebuildLeftovers(defnDist *manager.IndexDefnDistribution,
+	rebuilds map[c.IndexInstId]bool) []manager.IndexInstDistribution {
+
+	var leftovers []manager.IndexInstDistribution
+	for _, inst := range defnDist.Instances {
+
+		if inst.IsProxy() {
+			if inst.Rebuild && !rebuilds[c.IndexInstId(inst.RealInstId)] {
+				leftovers = append(leftovers, inst)
+			}
+			continue
+		}
+
+		if c.RebalanceState(inst.RState) != c.REBAL_PENDING_DELETE || rebuilds[c.IndexInstId(inst.InstId)] {
+			continue
+		}
+
+		for _, active := range defnDist.Instances {
+			if active.InstId != inst.InstId && active.ReplicaId == inst.ReplicaId &&
+				!active.IsProxy() && c.RebalanceState(active.RState) == c.REBAL_ACTIVE {
+				leftovers = append(leftovers, inst)
+				break
+			}
+		}
+	}
+
+	return leftovers
+}
+
+// recoverRebuildLOCKED drops the leftovers of rebuilds interrupted by
+// a restart of indexer, or which failed to drop an instance.
+func (m *ServiceMgr) recoverRebuildLOCKED() {
+
+	localMeta, err := m.getLocalIndexMetadata()
+	if err != nil {
+		l.Errorf("ServiceMgr::recoverRebuild Error getting local metadata %v", err)
+		return
+	}
+
+	m.recoverRebuildIndex(localMeta, 0)
+}
+
+func (m *ServiceMgr) getLocalIndexMetadata() (*manager.LocalIndexMetadata, error) {
+
+	url := "/getLocalIndexMetadata"
+	resp, err := getWithAuth(m.localhttp + url)
+	if err != nil {
+		return nil, err
+	}
+
+	localMeta := new(manager.LocalIndexMetadata)
+	if err := convertResponse(resp, localMeta); err != nil {
+		return nil, err
+	}
+	return localMeta, nil
+}
+
+func (m *ServiceMgr) postIndexRequest(url string, req *manager.IndexRequest) error {
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := postWithAuth(m.localhttp+url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	response := new(manager.IndexResponse)
+	if err := convertResponse(resp, response); err != nil {
+		return err
+	}
+	if response.Code == manager.RESP_ERROR {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  indexer
+//
+/////////////////////////////////////////////////////////////////////////
+
+// handleSwapIndexInst makes the rebuilt instance active in place of the
+// old instance of the index, once it has caught up with the stream of
+// the old instance. Swapping again an already swapped pair only
+// updates metadata, which may have failed the first time.
+func (idx *indexer) handleSwapIndexInst(msg Message) {
+
+	req := msg.(*MsgSwapIndexInst)
+	respch := req.GetRespCh()
+
+	old, ok := idx.indexInstMap[req.GetInstId()]
+	if !ok {
+		respch <- fmt.Errorf("Index instance %v not found", req.GetInstId())
+		return
+	}
+	inst, ok := idx.indexInstMap[req.GetNewInstId()]
+	if !ok || inst.Defn.DefnId != old.Defn.DefnId {
+		respch <- fmt.Errorf("Index instance %v not found", req.GetNewInstId())
+		return
+	}
+
+	swapped, err := checkSwapIndexInst(old, inst)
+	if err != nil {
+		l.Errorf("Indexer::handleSwapIndexInst Cannot swap instance %v %v with %v %v: %v",
+			old.InstId, old.RState, inst.InstId, inst.RState, err)
+		respch <- err
+		return
+	}
+
+	if !swapped {
+		// the old instance is out of the stream if its ingestion is paused
+		if inst.State != c.INDEX_STATE_ACTIVE || inst.Stream != c.MAINT_STREAM ||
+			idx.getStreamBucketState(inst.Stream, inst.Defn.Bucket) != STREAM_ACTIVE {
+			respch <- ErrRebuildNotCaughtUp
+			return
+		}
+
+		// the proxy keeps its own files once it is no longer a proxy
+		inst.RealInstId = 0
+		inst.Rebuild = false
+		inst.RState = c.REBAL_ACTIVE
+		old.RState = c.REBAL_PENDING_DELETE
+		idx.indexInstMap[inst.InstId] = inst
+		idx.indexInstMap[old.InstId] = old
+
+		msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+		if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, nil); err != nil {
+			c.CrashOnError(err)
+		}
+
+		l.Infof("Indexer::handleSwapIndexInst Swapped index instance %v with %v", old.InstId, inst.InstId)
+	}
+
+	if err := idx.sendMsgToClusterMgr(&MsgClustMgrSwapIndexInst{
+		defnId:    inst.Defn.DefnId,
+		instId:    old.InstId,
+		newInstId: inst.InstId,
+		respch:    respch,
+	}); err != nil {
+		respch <- err
+	}
+}
+
+// checkSwapIndexInst checks that inst is a proxy rebuilding old, which
+// can be swapped with it, or that they have already been swapped.
+func checkSwapIndexInst(old, inst c.IndexInst) (bool, error) {
+
+	if !inst.IsProxy() && inst.RState == c.REBAL_ACTIVE && old.RState == c.REBAL_PENDING_DELETE {
+		return true, nil
+	}
+
+	if inst.RealInstId != old.InstId || !inst.Rebuild ||
+		inst.RState != c.REBAL_PENDING || old.RState != c.REBAL_ACTIVE {
+		return false, ErrInconsistentState
+	}
+
+	return false, nil
+}
@@ -0,0 +1,125 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/manager"
+)
+
+func TestRebuildIndexPath(t *testing.T) {
+	defn := c.IndexDefn{Bucket: "b1", Name: "idx1"}
+
+	inst := &c.IndexInst{InstId: 11, Defn: defn}
+	if path := IndexPath(inst, 1, 0); path != "b1_idx1_11_1.index" {
+		t.Errorf("unexpected path %v of instance", path)
+	}
+
+	// a proxy moved by rebalance shares the files of its real instance
+	proxy := &c.IndexInst{InstId: 12, RealInstId: 11, Defn: defn}
+	if path := IndexPath(proxy, 1, 0); path != "b1_idx1_11_1.index" {
+		t.Errorf("unexpected path %v of proxy", path)
+	}
+
+	// a proxy rebuilding its real instance has its own files
+	proxy.Rebuild = true
+	if path := IndexPath(proxy, 1, 0); path != "b1_idx1_12_1.index" {
+		t.Errorf("unexpected path %v of rebuild proxy", path)
+	}
+}
+
+func TestCheckSwapIndexInst(t *testing.T) {
+	old := c.IndexInst{InstId: 11, RState: c.REBAL_ACTIVE}
+	proxy := c.IndexInst{InstId: 12, RealInstId: 11, Rebuild: true, RState: c.REBAL_PENDING}
+
+	if swapped, err := checkSwapIndexInst(old, proxy); swapped || err != nil {
+		t.Errorf("expected proxy to be swappable, got %v %v", swapped, err)
+	}
+
+	// swapped: the proxy is an instance of its own
+	swappedOld, swappedInst := old, proxy
+	swappedOld.RState = c.REBAL_PENDING_DELETE
+	swappedInst.RealInstId, swappedInst.Rebuild, swappedInst.RState = 0, false, c.REBAL_ACTIVE
+	if swapped, err := checkSwapIndexInst(swappedOld, swappedInst); !swapped || err != nil {
+		t.Errorf("expected instances to be swapped, got %v %v", swapped, err)
+	}
+
+	other := proxy
+	other.RealInstId = 13
+	rebalance := proxy
+	rebalance.Rebuild = false
+	active := proxy
+	active.RState = c.REBAL_ACTIVE
+	for _, inst := range []c.IndexInst{other, rebalance, active, swappedInst} {
+		if _, err := checkSwapIndexInst(old, inst); err != ErrInconsistentState {
+			t.Errorf("expected %+v not to be swappable, got %v", inst, err)
+		}
+	}
+}
+
+func TestRebuildIndexInsts(t *testing.T) {
+	defn := &c.IndexDefn{DefnId: 1, Bucket: "b1", Name: "idx1"}
+	defnDist := &manager.IndexDefnDistribution{
+		Instances: []manager.IndexInstDistribution{
+			{InstId: 11, State: uint32(c.INDEX_STATE_ACTIVE), RState: uint32(c.REBAL_ACTIVE)},
+			{InstId: 12, State: uint32(c.INDEX_STATE_ACTIVE), RState: uint32(c.REBAL_ACTIVE), ReplicaId: 1},
+			{InstId: 13, State: uint32(c.INDEX_STATE_ACTIVE), RState: uint32(c.REBAL_PENDING), RealInstId: 11},
+			{InstId: 14, State: uint32(c.INDEX_STATE_DELETED), RState: uint32(c.REBAL_ACTIVE)},
+		},
+	}
+
+	insts, err := rebuildIndexInsts(defn, defnDist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 2 || insts[0].InstId != 11 || insts[1].InstId != 12 {
+		t.Errorf("unexpected instances %+v", insts)
+	}
+
+	defnDist.Instances[1].State = uint32(c.INDEX_STATE_INITIAL)
+	if _, err := rebuildIndexInsts(defn, defnDist); err == nil {
+		t.Errorf("expected error for index not built")
+	}
+
+	if _, err := rebuildIndexInsts(defn, nil); err == nil {
+		t.Errorf("expected error for no instance")
+	}
+}
+
+func TestRebuildLeftovers(t *testing.T) {
+	defnDist := &manager.IndexDefnDistribution{
+		Instances: []manager.IndexInstDistribution{
+			// replica 0 is being rebuilt by a proxy
+			{InstId: 11, RState: uint32(c.REBAL_ACTIVE)},
+			{InstId: 21, RState: uint32(c.REBAL_PENDING), RealInstId: 11, Rebuild: true},
+			// replica 1 has been swapped
+			{InstId: 12, RState: uint32(c.REBAL_PENDING_DELETE), ReplicaId: 1},
+			{InstId: 22, RState: uint32(c.REBAL_ACTIVE), ReplicaId: 1},
+			// replica 2 is being moved by rebalance
+			{InstId: 13, RState: uint32(c.REBAL_ACTIVE), ReplicaId: 2},
+			{InstId: 23, RState: uint32(c.REBAL_PENDING), ReplicaId: 2, RealInstId: 13},
+		},
+	}
+
+	leftovers := func(rebuilds map[c.IndexInstId]bool) []uint64 {
+		var result []uint64
+		for _, inst := range rebuildLeftovers(defnDist, rebuilds) {
+			result = append(result, inst.InstId)
+		}
+		return result
+	}
+
+	if result := leftovers(nil); !reflect.DeepEqual(result, []uint64{21, 12}) {
+		t.Errorf("unexpected leftovers %v", result)
+	}
+	if result := leftovers(map[c.IndexInstId]bool{11: true, 12: true}); len(result) != 0 {
+		t.Errorf("unexpected leftovers %v of running rebuilds", result)
+	}
+
+	// an instance pending delete is kept if it is the only one of its replica
+	defnDist.Instances[3].RState = uint32(c.REBAL_PENDING)
+	if result := leftovers(map[c.IndexInstId]bool{11: true}); len(result) != 0 {
+		t.Errorf("unexpected leftovers %v", result)
+	}
+}
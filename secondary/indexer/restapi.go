@@ -2,6 +2,7 @@ package indexer
 
 import json "github.com/couchbase/indexing/secondary/common/json"
 import "io/ioutil"
+import "net"
 import "net/http"
 import "strings"
 import "strconv"
@@ -67,6 +68,16 @@ func (api *testServer) validateAuth(w http.ResponseWriter, r *http.Request) (cba
 	return creds, valid
 }
 
+// ddlRequester identifies the user of a DDL request, to be recorded in
+// DDL history of the indexer nodes.
+func ddlRequester(creds cbauth.Creds, r *http.Request) *mclient.DDLRequester {
+	source := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+	return &mclient.DDLRequester{User: creds.Name(), Source: source}
+}
+
 func (api *testServer) authorize(w http.ResponseWriter, creds cbauth.Creds) bool {
 
 	indexes, _, _, err := api.client.Refresh()
@@ -144,14 +155,14 @@ func (api *testServer) handleIndexes(
 	q := request.URL.Query()
 	if _, ok := q["create"]; ok {
 		if request.Method == "POST" {
-			api.doCreate(w, request)
+			api.doCreate(w, request, ddlRequester(creds, request))
 		} else {
 			msg := `invalid method, expected POST`
 			http.Error(w, jsonstr(msg), http.StatusMethodNotAllowed)
 		}
 	} else if _, ok := q["build"]; ok {
 		if request.Method == "PUT" {
-			api.doBuildMany(w, request)
+			api.doBuildMany(w, request, ddlRequester(creds, request))
 		} else {
 			msg := `invalid method, expected PUT`
 			http.Error(w, jsonstr(msg), http.StatusMethodNotAllowed)
@@ -190,7 +201,7 @@ func (api *testServer) handleIndex(
 		q, _ := request.URL.Query(), segs[3]
 		if _, ok := q["build"]; ok {
 			if request.Method == "PUT" {
-				api.doBuildOne(w, request)
+				api.doBuildOne(w, request, ddlRequester(creds, request))
 			} else {
 				msg := `invalid method, expected PUT`
 				http.Error(w, jsonstr(msg), http.StatusMethodNotAllowed)
@@ -240,7 +251,7 @@ func (api *testServer) handleIndex(
 		} else if request.Method == "GET" {
 			api.doGet(w, request)
 		} else if request.Method == "DELETE" {
-			api.doDrop(w, request)
+			api.doDrop(w, request, ddlRequester(creds, request))
 		} else {
 			msg := `invalid request, missing api argument`
 			http.Error(w, jsonstr(msg), http.StatusBadRequest)
@@ -252,7 +263,8 @@ func (api *testServer) handleIndex(
 }
 
 // POST /internal/indexes?create=true
-func (api *testServer) doCreate(w http.ResponseWriter, request *http.Request) {
+func (api *testServer) doCreate(w http.ResponseWriter, request *http.Request,
+	requester *mclient.DDLRequester) {
 
 	var params map[string]interface{}
 
@@ -377,7 +389,7 @@ func (api *testServer) doCreate(w http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	defnId, err := api.client.CreateIndex3(
+	defnId, err := api.client.CreateIndexWithRequester(requester,
 		indexname, bucket, using, exprtype, whereExpr, secExprs,
 		desc, isPrimary, partnScheme, partnExprs, with)
 	if err != nil {
@@ -393,7 +405,7 @@ func (api *testServer) doCreate(w http.ResponseWriter, request *http.Request) {
 
 // PUT  /internal/indexes?build=true
 func (api *testServer) doBuildMany(
-	w http.ResponseWriter, request *http.Request) {
+	w http.ResponseWriter, request *http.Request, requester *mclient.DDLRequester) {
 
 	var params []interface{}
 
@@ -414,7 +426,7 @@ func (api *testServer) doBuildMany(
 		defnIDs = append(defnIDs, id)
 	}
 
-	err = api.client.BuildIndexes(defnIDs)
+	err = api.client.BuildIndexesWithRequester(requester, defnIDs)
 
 	// make response
 	if err != nil {
@@ -427,7 +439,8 @@ func (api *testServer) doBuildMany(
 }
 
 //PUT    /internal/index/{id}?build=true
-func (api *testServer) doBuildOne(w http.ResponseWriter, request *http.Request) {
+func (api *testServer) doBuildOne(w http.ResponseWriter, request *http.Request,
+	requester *mclient.DDLRequester) {
 	defnId, err := urlPath2IndexId(request.URL.Path)
 	if err != nil {
 		msg := `invalid index id, ParseUint failed %v`
@@ -435,7 +448,7 @@ func (api *testServer) doBuildOne(w http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	err = api.client.BuildIndexes([]uint64{defnId})
+	err = api.client.BuildIndexesWithRequester(requester, []uint64{defnId})
 
 	// make response
 	if err != nil {
@@ -488,7 +501,8 @@ func (api *testServer) doGetAll(w http.ResponseWriter, request *http.Request) {
 }
 
 //DELETE /internal/index/{id}
-func (api *testServer) doDrop(w http.ResponseWriter, request *http.Request) {
+func (api *testServer) doDrop(w http.ResponseWriter, request *http.Request,
+	requester *mclient.DDLRequester) {
 	defnId, err := urlPath2IndexId(request.URL.Path)
 	if err != nil {
 		msg := `invalid index id, ParseUint failed %v`
@@ -496,7 +510,7 @@ func (api *testServer) doDrop(w http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	err = api.client.DropIndex(defnId)
+	err = api.client.DropIndexWithRequester(requester, defnId)
 
 	// make response
 	if err != nil {
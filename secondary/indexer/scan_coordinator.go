@@ -13,6 +13,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,6 +37,7 @@ var (
 	ErrUnsupportedRequest = errors.New("Unsupported query request")
 	ErrVbuuidMismatch     = errors.New("Mismatch in session vbuuids")
 	ErrNotMyPartition     = errors.New("Not my partition")
+	ErrIndexPaused        = errors.New("Index ingestion paused on memory quota")
 )
 
 var secKeyBufPool *common.BytesBufPool
@@ -68,6 +71,10 @@ type scanCoordinator struct {
 	stats IndexerStatsHolder
 
 	indexerState atomic.Value
+
+	resumeSnaps  *resumeSnapshots
+	readSessions *readSessions
+	workload     *scanWorkload
 }
 
 // NewScanCoordinator returns an instance of scanCoordinator or err message
@@ -86,10 +93,13 @@ func NewScanCoordinator(supvCmdch MsgChannel, supvMsgch MsgChannel,
 		snapshotNotifych: snapshotNotifych,
 		logPrefix:        "ScanCoordinator",
 		reqCounter:       0,
+		resumeSnaps:      newResumeSnapshots(),
+		workload:         newScanWorkload(config),
 	}
 
 	s.config.Store(config)
 	s.initRollbackInProgress()
+	s.readSessions = newReadSessions(s)
 
 	addr := net.JoinHostPort("", config["scanPort"].String())
 	queryportCfg := config.SectionConfig("queryport.", true)
@@ -106,6 +116,9 @@ func NewScanCoordinator(supvCmdch MsgChannel, supvMsgch MsgChannel,
 	}
 
 	s.setIndexerState(common.INDEXER_BOOTSTRAP)
+	s.updateCapture(config)
+
+	http.HandleFunc("/getLocalScanWorkload", s.handleScanWorkloadReq)
 
 	// main loop
 	go s.run()
@@ -124,6 +137,8 @@ loop:
 				if cmd.GetMsgType() == SCAN_COORD_SHUTDOWN {
 					logging.Infof("ScanCoordinator: Shutting Down")
 					s.serv.Close()
+					s.resumeSnaps.close()
+					s.readSessions.closeAll()
 					s.supvCmdch <- &MsgSuccess{}
 					break loop
 				}
@@ -151,6 +166,9 @@ func (s *scanCoordinator) listenSnapshot() {
 
 			if ss.Timestamp() != nil {
 				s.lastSnapshot[ss.IndexInstId()] = ss
+			} else {
+				s.resumeSnaps.release(ss.IndexInstId())
+				s.readSessions.release(ss.IndexInstId())
 			}
 
 		}(snapshot)
@@ -207,8 +225,15 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 	req, err := NewScanRequest(protoReq, cancelCh, s)
 	atime := time.Now()
 	w := NewProtoWriter(req.ScanType, conn)
+	if fconn, ok := conn.(queryport.FlowControlled); ok {
+		timeout := s.config.Load()["scan.flowControl.creditTimeout"].Int()
+		w.FlowControl(fconn.Credits(), time.Duration(timeout)*time.Second, cancelCh)
+	}
 	defer func() {
 		s.handleError(req.LogPrefix, w.Done())
+		if req.Stats != nil && w.CreditWait() > 0 {
+			req.Stats.creditWaitDuration.Add(w.CreditWait().Nanoseconds())
+		}
 		req.Done()
 	}()
 
@@ -217,6 +242,11 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 		return
 	}
 
+	if req.ScanType == SessionReq && req.closeSession {
+		s.handleCloseSessionRequest(req, w)
+		return
+	}
+
 	logging.LazyVerbose(func() string {
 		return fmt.Sprintf("%s REQUEST %s", req.LogPrefix, logging.TagStrUD(req))
 	})
@@ -246,6 +276,8 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 		req.Stats.scanReqInitDuration.Add(time.Now().Sub(ttime).Nanoseconds())
 	}
 
+	s.workload.record(req)
+
 	t0 := time.Now()
 	is, err := s.getRequestedIndexSnapshot(req)
 	if s.tryRespondWithError(w, req, err) {
@@ -293,6 +325,8 @@ func (s *scanCoordinator) processRequest(req *ScanRequest, w ScanResponseWriter,
 		s.handleMultiScanCountRequest(req, w, is, t0)
 	case StatsReq:
 		s.handleStatsRequest(req, w, is)
+	case SessionReq:
+		s.handleSessionRequest(req, w, is)
 	}
 }
 
@@ -315,6 +349,18 @@ func (s *scanCoordinator) handleScanRequest(req *ScanRequest, w ScanResponseWrit
 	err := scanPipeline.Execute()
 	scanTime := time.Now().Sub(t0)
 
+	if err == nil && req.Resumable {
+		var token []byte
+		if t := scanPipeline.ResumeToken(); t != nil {
+			token, err = s.encodeResumeToken(req, t, is)
+		}
+		if err == nil {
+			w.Resumable(token)
+		} else {
+			w.Error(err)
+		}
+	}
+
 	if req.Stats != nil {
 		req.Stats.numRowsReturned.Add(int64(scanPipeline.RowsReturned()))
 		req.Stats.scanBytesRead.Add(int64(scanPipeline.BytesRead()))
@@ -451,6 +497,13 @@ func (s *scanCoordinator) handleStatsRequest(req *ScanRequest, w ScanResponseWri
 // will block wait.
 // This mechanism can be used to implement RYOW.
 func (s *scanCoordinator) getRequestedIndexSnapshot(r *ScanRequest) (snap IndexSnapshot, err error) {
+	if r.SessionId != "" && r.ScanType != SessionReq {
+		return s.readSessions.get(r.SessionId, r.IndexInstId)
+	}
+	if r.resume != nil && r.SameSnapshot {
+		return s.getResumeSnapshot(r)
+	}
+
 	snapshot, err := func() (IndexSnapshot, error) {
 		s.mu.RLock()
 		defer s.mu.RUnlock()
@@ -693,6 +746,7 @@ func (s *scanCoordinator) handleUpdateIndexInstMap(cmd Message) {
 	indexInstMap := req.GetIndexInstMap()
 	s.stats.Set(req.GetStatsObject())
 	s.indexInstMap = common.CopyIndexInstMap(indexInstMap)
+	s.workload.prune(s.indexInstMap)
 
 	if len(req.GetRollbackTimes()) != 0 {
 		logging.Infof("ScanCoordinator::initialize rollback times on new index inst map: %v", req.GetRollbackTimes())
@@ -716,9 +770,48 @@ func (s *scanCoordinator) handleUpdateIndexPartnMap(cmd Message) {
 func (s *scanCoordinator) handleConfigUpdate(cmd Message) {
 	cfgUpdate := cmd.(*MsgConfigUpdate)
 	s.config.Store(cfgUpdate.GetConfig())
+	s.workload.setConfig(cfgUpdate.GetConfig())
+	s.updateCapture(cfgUpdate.GetConfig())
 	s.supvCmdch <- &MsgSuccess{}
 }
 
+// updateCapture starts or stops capturing scan requests in the queryport
+// server as per indexer.settings.scan_capture.* settings.
+func (s *scanCoordinator) updateCapture(config common.Config) {
+	if !config["settings.scan_capture.enable"].Bool() {
+		s.serv.SetCapture(nil, nil)
+		return
+	}
+
+	dir := config["settings.scan_capture.dir"].String()
+	if dir == "" {
+		dir = filepath.Join(config["storage_dir"].String(), "scan_capture")
+	}
+	captureCfg := &queryport.CaptureConfig{
+		Dir:         dir,
+		MaxFileSize: int64(config["settings.scan_capture.max_file_size"].Int()) * 1024 * 1024,
+		MaxFiles:    config["settings.scan_capture.max_files"].Int(),
+		RedactKeys:  config["settings.scan_capture.redact_keys"].Bool(),
+	}
+	if err := s.serv.SetCapture(captureCfg, s.resolveIndex); err != nil {
+		logging.Errorf("%v: Unable to capture scan requests: %v", s.logPrefix, err)
+	}
+}
+
+// resolveIndex returns the bucket and name of an index definition, for
+// captured scan requests.
+func (s *scanCoordinator) resolveIndex(defnID uint64) (string, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, inst := range s.indexInstMap {
+		if uint64(inst.Defn.DefnId) == defnID {
+			return inst.Defn.Bucket, inst.Defn.Name
+		}
+	}
+	return "", ""
+}
+
 func (s *scanCoordinator) handleIndexerPause(cmd Message) {
 	s.setIndexerState(common.INDEXER_PAUSED)
 	s.supvCmdch <- &MsgSuccess{}
@@ -936,17 +1029,26 @@ func (s *scanCoordinator) findIndexInstance(
 
 	hasIndex := false
 	isPartition := false
-	ctx := make([]IndexReaderContext, len(partitionIds))
 	missing := make(map[common.IndexInstId][]common.PartitionId)
+
+	// Data of an index whose ingestion is paused is stale.
+	paused := false
+
 	for _, inst := range s.indexInstMap {
 		if inst.State != common.INDEX_STATE_ACTIVE || (inst.RState != common.REBAL_ACTIVE && inst.RState != common.REBAL_PENDING) {
 			continue
 		}
+		// An index being rebuilt is scanned on its real instance until
+		// the proxy rebuilding it is swapped in.
+		if inst.IsProxy() && inst.Rebuild {
+			continue
+		}
 		if inst.Defn.DefnId == common.IndexDefnId(defnID) {
 			hasIndex = true
 			isPartition = common.IsPartitioned(inst.Defn.PartitionScheme)
 			if pmap, ok := s.indexPartnMap[inst.InstId]; ok {
 				found := true
+				ctx := make([]IndexReaderContext, len(partitionIds))
 				for i, partnId := range partitionIds {
 					if partition, ok := pmap[partnId]; ok {
 						ctx[i] = partition.Sc.GetSliceById(0).GetReaderContext()
@@ -956,13 +1058,19 @@ func (s *scanCoordinator) findIndexInstance(
 					}
 				}
 
-				if found {
+				if found && inst.Paused {
+					paused = true
+				} else if found {
 					return &inst, ctx, nil
 				}
 			}
 		}
 	}
 
+	if paused {
+		return nil, nil, ErrIndexPaused
+	}
+
 	if hasIndex {
 		if isPartition {
 			if content, err := json.Marshal(&missing); err == nil {
@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 
 	"github.com/couchbase/indexing/secondary/collatejson"
 	c "github.com/couchbase/indexing/secondary/common"
@@ -40,6 +41,8 @@ type ScanPipeline struct {
 
 	rowsReturned uint64
 	bytesRead    uint64
+
+	resumeToken *scanResumeToken
 }
 
 func (p *ScanPipeline) Cancel(err error) {
@@ -58,6 +61,12 @@ func (p ScanPipeline) BytesRead() uint64 {
 	return p.bytesRead
 }
 
+// ResumeToken return the token to resume a scan that stopped on limit,
+// nil if the scan is exhausted.
+func (p ScanPipeline) ResumeToken() *scanResumeToken {
+	return p.resumeToken
+}
+
 func NewScanPipeline(req *ScanRequest, w ScanResponseWriter, is IndexSnapshot, cfg c.Config) *ScanPipeline {
 	scanPipeline := new(ScanPipeline)
 	scanPipeline.req = req
@@ -118,6 +127,9 @@ func (s *IndexScanSource) Routine() error {
 	buf2 := secKeyBufPool.Get() //Tracking for distinct
 	r.keyBufList = append(r.keyBufList, buf2)
 	previousRow := (*buf2)[:0]
+	if checkDistinct && r.resume != nil {
+		previousRow = append(previousRow, r.resume.Distinct...)
+	}
 	buf3 := secKeyBufPool.Get() //Decoding in ExplodeArray2
 	r.keyBufList = append(r.keyBufList, buf3)
 	docidbuf := make([]byte, 1024)
@@ -146,6 +158,10 @@ func (s *IndexScanSource) Routine() error {
 
 	}
 
+	if r.Filter != nil && dktmp == nil {
+		dktmp = make([][]byte, len(s.p.req.IndexInst.Defn.SecExprs))
+	}
+
 	hasDesc := s.p.req.IndexInst.Defn.HasDescending()
 
 	iterCount := 0
@@ -155,6 +171,14 @@ func (s *IndexScanSource) Routine() error {
 		}
 		iterCount++
 
+		rawEntry, skipDups := entry, 0
+		if r.resume != nil {
+			var skip bool
+			if skip, skipDups = r.resumeSkip(entry); skip {
+				return nil
+			}
+		}
+
 		skipRow := false
 		var ck, dk [][]byte
 
@@ -173,7 +197,7 @@ func (s *IndexScanSource) Routine() error {
 				*buf = make([]byte, 0, len(entry)+1024)
 				*buf3 = make([]byte, len(entry)+1024)
 			}
-			getDecoded := (r.GroupAggr != nil && r.GroupAggr.NeedDecode)
+			getDecoded := (r.GroupAggr != nil && r.GroupAggr.NeedDecode) || r.Filter != nil
 			skipRow, ck, dk, err = filterScanRow2(entry, currentScan,
 				(*buf)[:0], *buf3, getDecoded, cktmp, dktmp, r, &cachedEntry)
 			if err != nil {
@@ -185,6 +209,37 @@ func (s *IndexScanSource) Routine() error {
 			return nil
 		}
 
+		if r.Filter != nil {
+			if dk == nil && !r.isPrimary {
+				if len(entry) > cap(*buf) {
+					*buf = make([]byte, 0, len(entry)+1024)
+					*buf3 = make([]byte, len(entry)+1024)
+				}
+				ck, dk, err = explodeEntry(entry, (*buf)[:0], *buf3, true,
+					cktmp, dktmp, r, &cachedEntry)
+				if err != nil {
+					return err
+				}
+			}
+
+			var docid []byte
+			if r.isPrimary {
+				docid = entry
+			} else if r.Filter.DependsOnPrimaryKey {
+				docid, err = secondaryIndexEntry(entry).ReadDocId((docidbuf)[:0]) //docid for N1QLExpr evaluation for Filter
+				if err != nil {
+					return err
+				}
+			}
+
+			match, err := r.Filter.evaluate(dk, docid)
+			if err != nil {
+				return err
+			} else if !match {
+				return nil
+			}
+		}
+
 		if !r.isPrimary {
 			e := secondaryIndexEntry(entry)
 			count = e.Count()
@@ -235,9 +290,10 @@ func (s *IndexScanSource) Routine() error {
 			if len(previousRow) != 0 && distinctCompare(entry, previousRow) {
 				return nil // Ignore the entry as it is same as previous entry
 			}
+			previousRow = append(previousRow[:0], entry...)
 		}
 
-		for i := 0; i < count; i++ {
+		for i := skipDups; i < count; i++ {
 			if r.Distinct && i > 0 {
 				break
 			}
@@ -248,6 +304,13 @@ func (s *IndexScanSource) Routine() error {
 					return wrErr
 				}
 				if s.p.rowsReturned == uint64(r.Limit) {
+					if r.Resumable {
+						dups := i + 1
+						if dups == count || r.Distinct {
+							dups = 0
+						}
+						r.recordResume(rawEntry, dups)
+					}
 					return ErrLimitReached
 				}
 			} else {
@@ -255,8 +318,8 @@ func (s *IndexScanSource) Routine() error {
 			}
 		}
 
-		if checkDistinct {
-			previousRow = append(previousRow[:0], entry...)
+		if r.Resumable {
+			r.recordResume(rawEntry, 0)
 		}
 
 		return nil
@@ -267,6 +330,10 @@ func (s *IndexScanSource) Routine() error {
 		return err1
 	}
 
+	if as := newAggrScan(r, sliceSnapshots); as != nil {
+		return s.scanAggregates(as, buf)
+	}
+
 	if r.GroupAggr != nil {
 		if r.GroupAggr.IsLeadingGroup {
 			s.p.aggrRes.SetMaxRows(1)
@@ -275,8 +342,15 @@ func (s *IndexScanSource) Routine() error {
 		}
 	}
 
+	if r.resumeEntries != nil && len(sliceSnapshots) != len(r.resumePartns) {
+		return ErrResumeTokenInvalid
+	}
+
 loop:
-	for _, scan := range r.Scans {
+	for i, scan := range r.Scans {
+		if r.resumeEntries != nil && !r.startResumeScan(i) {
+			continue
+		}
 		currentScan = scan
 		err = scatter(r, scan, sliceSnapshots, fn, s.p.config)
 		switch err {
@@ -289,6 +363,14 @@ loop:
 		}
 	}
 
+	if r.Resumable && err == ErrLimitReached {
+		var distinct []byte
+		if checkDistinct {
+			distinct = previousRow
+		}
+		s.p.resumeToken = r.makeResumeToken(distinct)
+	}
+
 	if r.GroupAggr != nil && err == nil {
 
 		for _, r := range s.p.aggrRes.rows {
@@ -348,6 +430,53 @@ loop:
 	return nil
 }
 
+//scanAggregates returns the groups of a precomputed aggregate
+func (s *IndexScanSource) scanAggregates(as *aggrScan, buf *[]byte) error {
+
+	r := s.p.req
+	currOffset := int64(0)
+
+	for _, g := range mergeAggrSnapshots(as.snaps, r.IndexInst.Defn.Desc) {
+
+		s.p.aggrRes.rows = append(s.p.aggrRes.rows[:0], as.row(r.GroupAggr, g))
+		entry, err := projectGroupAggr((*buf)[:0], r.Indexprojection, s.p.aggrRes, false)
+		if err != nil {
+			return err
+		}
+
+		if currOffset >= r.Offset {
+			s.p.rowsReturned++
+			wrErr := s.WriteItem(entry)
+			if wrErr != nil {
+				return wrErr
+			}
+			if s.p.rowsReturned == uint64(r.Limit) {
+				return ErrLimitReached
+			}
+		} else {
+			currOffset++
+		}
+	}
+
+	if s.p.rowsReturned == 0 {
+
+		//handle special group rules
+		entry, err := projectEmptyResult((*buf)[:0], r.Indexprojection, r.GroupAggr)
+		if err != nil {
+			return err
+		}
+
+		if entry == nil {
+			return nil
+		}
+
+		s.p.rowsReturned++
+		return s.WriteItem(entry)
+	}
+
+	return nil
+}
+
 func (d *IndexScanDecoder) Routine() error {
 	defer d.CloseWrite()
 	defer d.CloseRead()
@@ -481,7 +610,7 @@ func filterScanRow(key []byte, scan Scan, buf []byte) (bool, [][]byte, error) {
 			err = errors.New("There are more ranges than number of composite elements in the index")
 			return false, nil, err
 		}
-		filtermatch = applyFilter(compositekeys, filtercollection.CompositeFilters)
+		filtermatch = applyFilter(compositekeys, filtercollection.CompositeFilters, buf)
 		if filtermatch {
 			return false, compositekeys, nil
 		}
@@ -494,6 +623,33 @@ func filterScanRow(key []byte, scan Scan, buf []byte) (bool, [][]byte, error) {
 func filterScanRow2(key []byte, scan Scan, buf, decbuf []byte, getDecoded bool,
 	cktmp, dktmp [][]byte, r *ScanRequest, cachedEntry *entryCache) (bool, [][]byte, [][]byte, error) {
 
+	compositekeys, decodedkeys, err := explodeEntry(key, buf, decbuf, getDecoded,
+		cktmp, dktmp, r, cachedEntry)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	var filtermatch bool
+	for _, filtercollection := range scan.Filters {
+		if len(filtercollection.CompositeFilters) > len(compositekeys) {
+			// There cannot be more ranges than number of composite keys
+			err = errors.New("There are more ranges than number of composite elements in the index")
+			return false, nil, nil, err
+		}
+		filtermatch = applyFilter(compositekeys, filtercollection.CompositeFilters, buf)
+		if filtermatch {
+			return false, compositekeys, decodedkeys, nil
+		}
+	}
+
+	return true, compositekeys, decodedkeys, nil
+}
+
+// Explode the key into composite keys, and decoded keys if getDecoded,
+// reusing the cached entry if it is the same key
+func explodeEntry(key []byte, buf, decbuf []byte, getDecoded bool,
+	cktmp, dktmp [][]byte, r *ScanRequest, cachedEntry *entryCache) ([][]byte, [][]byte, error) {
+
 	var compositekeys, decodedkeys [][]byte
 	var err error
 
@@ -509,7 +665,7 @@ func filterScanRow2(key []byte, scan Scan, buf, decbuf []byte, getDecoded bool,
 	if compositekeys == nil {
 		compositekeys, decodedkeys, err = jsonEncoder.ExplodeArray2(key, buf, decbuf, cktmp, dktmp)
 		if err != nil {
-			return false, nil, nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -520,24 +676,12 @@ func filterScanRow2(key []byte, scan Scan, buf, decbuf []byte, getDecoded bool,
 		cachedEntry.Update(key, compositekeys, decodedkeys)
 	}
 
-	var filtermatch bool
-	for _, filtercollection := range scan.Filters {
-		if len(filtercollection.CompositeFilters) > len(compositekeys) {
-			// There cannot be more ranges than number of composite keys
-			err = errors.New("There are more ranges than number of composite elements in the index")
-			return false, nil, nil, err
-		}
-		filtermatch = applyFilter(compositekeys, filtercollection.CompositeFilters)
-		if filtermatch {
-			return false, compositekeys, decodedkeys, nil
-		}
-	}
-
-	return true, compositekeys, decodedkeys, nil
+	return compositekeys, decodedkeys, nil
 }
 
-// Return true if filter matches the composite keys
-func applyFilter(compositekeys [][]byte, compositefilters []CompositeElementFilter) bool {
+// Return true if filter matches the composite keys, `buf` is scratch
+// space for pattern matching, free once the keys are exploded.
+func applyFilter(compositekeys [][]byte, compositefilters []CompositeElementFilter, buf []byte) bool {
 
 	for i, filter := range compositefilters {
 		ck := compositekeys[i]
@@ -594,11 +738,25 @@ func applyFilter(compositekeys [][]byte, compositefilters []CompositeElementFilt
 				}
 			}
 		}
+
+		if filter.Pattern != nil && !matchPattern(filter.Pattern, ck, buf) {
+			return false
+		}
 	}
 
 	return true
 }
 
+// Return true if the composite key is a string matching the pattern,
+// the string is decoded into buf.
+func matchPattern(pattern *regexp.Regexp, ck, buf []byte) bool {
+	str, err := jsonEncoder.DecodeString(ck, buf)
+	if err != nil {
+		return false
+	}
+	return pattern.Match(str)
+}
+
 // Compare secondary entries and return true
 // if the secondary keys of entries are equal
 func distinctCompare(entryBytes1, entryBytes2 []byte) bool {
@@ -885,6 +1043,21 @@ func evaluateN1QLExpresssion(groupAggr *GroupAggr, expr expression.Expression,
 	return scalar, nil
 }
 
+//evaluate returns true if the filter expression evaluates to true
+//for the row
+func (f *IndexFilter) evaluate(decodedkeys [][]byte, docid []byte) (bool, error) {
+
+	for i := range f.values {
+		f.values[i] = nil
+	}
+
+	scalar, err := evaluateN1QLExpresssion(f.cover, f.Expr, decodedkeys, f.values, docid)
+	if err != nil {
+		return false, err
+	}
+	return scalar.Truth(), nil
+}
+
 func (ar *aggrResult) AddNewGroup(groups []*groupKey, aggrs []*aggrVal, cacheValid bool) error {
 
 	var err error
@@ -14,8 +14,10 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	p "github.com/couchbase/indexing/secondary/pipeline"
 	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/couchbase/indexing/secondary/queryport"
 	"github.com/golang/protobuf/proto"
 	"net"
+	"time"
 )
 
 type ScanResponseWriter interface {
@@ -26,6 +28,8 @@ type ScanResponseWriter interface {
 	Row(pk, sk []byte) error
 	Done() error
 	Helo() error
+	Resumable(token []byte)
+	Session(err error) error
 }
 
 type protoResponseWriter struct {
@@ -35,6 +39,18 @@ type protoResponseWriter struct {
 	rowBuf     *[]byte
 	rowEntries []*protobuf.IndexEntry
 	rowSize    int
+
+	resumable   bool
+	resumeToken []byte
+
+	// flow control
+	credits       *queryport.Credits
+	creditTimeout time.Duration
+	quitch        <-chan bool
+	creditWait    time.Duration
+	rowBytes      int // bytes of rows in current batch
+	batchRows     int
+	batchBytes    int
 }
 
 func NewProtoWriter(t ScanReqType, conn net.Conn) *protoResponseWriter {
@@ -46,6 +62,62 @@ func NewProtoWriter(t ScanReqType, conn net.Conn) *protoResponseWriter {
 	}
 }
 
+// FlowControl sends rows only when client has granted credits for
+// them, response batches are sized by the measured round trip time of
+// the stream.
+func (w *protoResponseWriter) FlowControl(credits *queryport.Credits,
+	timeout time.Duration, quitch <-chan bool) {
+
+	w.credits = credits
+	w.creditTimeout = timeout
+	w.quitch = quitch
+	w.resizeBatch()
+}
+
+// CreditWait return the time spent waiting for client to grant credits.
+func (w *protoResponseWriter) CreditWait() time.Duration {
+	return w.creditWait
+}
+
+func (w *protoResponseWriter) resizeBatch() {
+	rows, bytes := w.credits.BatchSize(int64(len(*w.rowBuf)))
+	w.batchRows, w.batchBytes = int(rows), int(bytes)
+}
+
+func (w *protoResponseWriter) batchFull() bool {
+	if w.credits == nil {
+		return false
+	}
+	return (w.batchRows > 0 && len(w.rowEntries) >= w.batchRows) ||
+		w.rowBytes >= w.batchBytes
+}
+
+func (w *protoResponseWriter) flushRows() error {
+	if w.credits != nil {
+		blocked, err := w.credits.Acquire(int64(len(w.rowEntries)),
+			int64(w.rowBytes), w.creditTimeout, w.quitch)
+		w.creditWait += blocked
+		if err == queryport.ErrorCreditQuit {
+			return common.ErrClientCancel
+		} else if err != nil {
+			return err
+		}
+	}
+
+	res := &protobuf.ResponseStream{IndexEntries: w.rowEntries}
+	if err := protobuf.EncodeAndWrite(w.conn, *w.encBuf, res); err != nil {
+		return err
+	}
+
+	w.rowSize = 0
+	w.rowBytes = 0
+	w.rowEntries = nil
+	if w.credits != nil {
+		w.resizeBatch()
+	}
+	return nil
+}
+
 func (w *protoResponseWriter) writeLen(l int) error {
 	binary.LittleEndian.PutUint16((*w.encBuf)[:2], uint16(l))
 	_, err := w.conn.Write((*w.rowBuf)[:2])
@@ -59,6 +131,8 @@ func (w *protoResponseWriter) Error(err error) error {
 	// Drop all collected rows
 	w.rowEntries = nil
 	w.rowSize = 0
+	w.rowBytes = 0
+	w.resumable = false
 
 	switch w.scanType {
 	case StatsReq:
@@ -73,6 +147,10 @@ func (w *protoResponseWriter) Error(err error) error {
 		res = &protobuf.ResponseStream{
 			Err: protoErr,
 		}
+	case SessionReq:
+		res = &protobuf.SessionResponse{
+			Err: protoErr,
+		}
 	}
 
 	return protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
@@ -93,12 +171,20 @@ func (w *protoResponseWriter) Stats(rows, unique uint64, min, max []byte) error
 
 func (w *protoResponseWriter) Helo() error {
 	res := &protobuf.HeloResponse{
-		Version: proto.Uint32(common.INDEXER_CUR_VERSION),
+		Version:  proto.Uint32(common.INDEXER_CUR_VERSION),
+		Features: proto.Uint32(protobuf.ScanFeatures),
 	}
 
 	return protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
 }
 
+func (w *protoResponseWriter) Session(err error) error {
+	if err != nil {
+		return w.Error(err)
+	}
+	return protobuf.EncodeAndWrite(w.conn, *w.encBuf, &protobuf.SessionResponse{})
+}
+
 func (w *protoResponseWriter) Count(c uint64) error {
 	res := &protobuf.CountResponse{
 		Count: proto.Int64(int64(c)),
@@ -119,15 +205,10 @@ func (w *protoResponseWriter) RawBytes(b []byte) error {
 
 func (w *protoResponseWriter) Row(pk, sk []byte) error {
 
-	if w.rowSize != 0 && w.rowSize+len(pk)+len(sk) > len(*w.rowBuf) {
-		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries}
-		err := protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
-		if err != nil {
+	if w.rowSize != 0 && (w.rowSize+len(pk)+len(sk) > len(*w.rowBuf) || w.batchFull()) {
+		if err := w.flushRows(); err != nil {
 			return err
 		}
-
-		w.rowSize = 0
-		w.rowEntries = nil
 	}
 
 	if w.rowSize == 0 && len(pk)+len(sk) > cap(*w.rowBuf) {
@@ -149,21 +230,32 @@ func (w *protoResponseWriter) Row(pk, sk []byte) error {
 
 	// TODO: remove below line
 	w.rowSize += len(sk) + len(pk)
+	w.rowBytes += len(sk) + len(pk)
 	w.rowEntries = append(w.rowEntries, row)
 	return nil
 }
 
+// Resumable ends the response with a StreamEndResponse carrying
+// resume token, nil token if the scan is exhausted.
+func (w *protoResponseWriter) Resumable(token []byte) {
+	w.resumable = true
+	w.resumeToken = token
+}
+
 func (w *protoResponseWriter) Done() error {
 	defer p.PutBlock(w.encBuf)
 	defer p.PutBlock(w.rowBuf)
 
 	if (w.scanType == ScanReq || w.scanType == ScanAllReq) && w.rowSize > 0 {
-		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries}
-		err := protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
-		if err != nil {
+		if err := w.flushRows(); err != nil {
 			return err
 		}
 	}
 
+	if w.resumable {
+		res := &protobuf.StreamEndResponse{ResumeToken: w.resumeToken}
+		return protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
+	}
+
 	return nil
 }
@@ -11,8 +11,10 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -37,6 +39,7 @@ const (
 	ScanAllReq                    = "scanAll"
 	HeloReq                       = "helo"
 	MultiScanCountReq             = "multiscancount"
+	SessionReq                    = "session"
 )
 
 type ScanRequest struct {
@@ -76,9 +79,28 @@ type ScanRequest struct {
 
 	GroupAggr *GroupAggr
 
+	//filter expression on index keys
+	Filter *IndexFilter
+
 	// New parameters for partitioned index
 	Sorted bool
 
+	// Resumable scans
+	Resumable     bool
+	SameSnapshot  bool
+	resume        *scanResumeToken     // token to continue from
+	resumePartns  []common.PartitionId // partition of each scanned slice
+	resumeScan    int                  // position of scan in progress
+	resumeSlice   int                  // slice of entry being gathered
+	resumeEntries [][]byte             // last entry returned from each slice
+	resumeDups    []int                // rows returned of that entry, 0 if all
+	resumeSkips   []bool               // first entry of slice yet to be gathered
+
+	// Read session
+	SessionId    string
+	sessionTtl   uint32 // seconds
+	closeSession bool
+
 	// Rollback Time
 	rollbackTime int64
 
@@ -149,6 +171,11 @@ type CompositeElementFilter struct {
 	Low       IndexKey
 	High      IndexKey
 	Inclusion Inclusion
+
+	// LIKE or regex pattern applied to string values within the range
+	Pattern         *regexp.Regexp
+	patternPrefix   string // literal prefix of every match
+	patternComplete bool   // prefix is the only match
 }
 
 // A point in index and the corresponding filter
@@ -203,6 +230,26 @@ type GroupAggr struct {
 	groups      []*groupKey
 }
 
+//Filter pushdown
+
+type IndexFilter struct {
+	Expr                expression.Expression // filter expression
+	DependsOnIndexKeys  []int32               // Filter depends on List of index keys positions
+	IndexKeyNames       []string              // Index key names used in expression
+	DependsOnPrimaryKey bool
+
+	//For caching values
+	cover  *GroupAggr    // cover values used by evaluateN1QLExpresssion
+	values []interface{} // decoded index keys of current row
+}
+
+func (f IndexFilter) String() string {
+	str := fmt.Sprintf("Expr %v", f.Expr)
+	str += fmt.Sprintf(" DependsOnIndexKeys %v", f.DependsOnIndexKeys)
+	str += fmt.Sprintf(" IndexKeyNames %v", f.IndexKeyNames)
+	return str
+}
+
 func (ga GroupAggr) String() string {
 	str := "Groups: "
 	for _, g := range ga.Group {
@@ -293,6 +340,7 @@ func NewScanRequest(protoReq interface{},
 		r.ScanType = CountReq
 		r.Incl = Inclusion(req.GetSpan().GetRange().GetInclusion())
 		r.Sorted = true
+		r.SessionId = req.GetSessionId()
 
 		if isBootstrapMode {
 			err = common.ErrIndexerInBootstrap
@@ -342,6 +390,7 @@ func NewScanRequest(protoReq interface{},
 			r.Distinct = req.GetDistinct()
 		}
 		r.Offset = req.GetOffset()
+		r.SessionId = req.GetSessionId()
 		if isBootstrapMode {
 			err = common.ErrIndexerInBootstrap
 			return
@@ -383,6 +432,42 @@ func NewScanRequest(protoReq interface{},
 		if err = r.fillGroupAggr(req.GetGroupAggr()); err != nil {
 			return
 		}
+		if err = r.fillFilter(req.GetFilter()); err != nil {
+			return
+		}
+		err = r.setResume(req.GetResumable(), req.GetResumeToken(), req.GetSameSnapshot())
+		if err != nil {
+			return
+		}
+
+	case *protobuf.SessionRequest:
+		r.ScanType = SessionReq
+		r.SessionId = req.GetSessionId()
+		r.RequestId = req.GetRequestId()
+		r.closeSession = req.GetClose()
+		if r.closeSession {
+			return
+		}
+
+		r.DefnID = req.GetDefnID()
+		r.rollbackTime = req.GetRollbackTime()
+		r.PartitionIds = makePartitionIds(req.GetPartitionIds())
+		r.sessionTtl = req.GetTtl()
+		cons := common.Consistency(req.GetCons())
+		vector := req.GetVector()
+
+		if isBootstrapMode {
+			err = common.ErrIndexerInBootstrap
+			return
+		}
+
+		if err = r.setIndexParams(); err != nil {
+			return
+		}
+
+		if err = r.setConsistency(cons, vector); err != nil {
+			return
+		}
 
 	case *protobuf.ScanAllRequest:
 		r.DefnID = req.GetDefnID()
@@ -519,7 +604,8 @@ func (r *ScanRequest) joinKeys(keys [][]byte) ([]byte, error) {
 func (r *ScanRequest) areFiltersNil(protoScan *protobuf.Scan) bool {
 	areFiltersNil := true
 	for _, filter := range protoScan.Filters {
-		if !r.isNil(filter.Low) || !r.isNil(filter.High) {
+		if !r.isNil(filter.Low) || !r.isNil(filter.High) ||
+			filter.GetPatternType() != uint32(common.PATTERN_NONE) {
 			areFiltersNil = false
 			break
 		}
@@ -530,6 +616,10 @@ func (r *ScanRequest) areFiltersNil(protoScan *protobuf.Scan) bool {
 // Compute the overall low, high for a Filter
 // based on composite filter ranges
 func (r *ScanRequest) fillFilterLowHigh(compFilters []CompositeElementFilter, filter *Filter) error {
+	if err := r.fillPatternRanges(compFilters); err != nil {
+		return err
+	}
+
 	if !r.IndexInst.Defn.HasDescending() {
 		var lows, highs [][]byte
 		var e error
@@ -656,6 +746,50 @@ func (r *ScanRequest) fillFilterLowHigh(compFilters []CompositeElementFilter, fi
 	return nil
 }
 
+// Derive range of composite filters with a pattern and no range from
+// the literal prefix of the pattern, values matching the pattern are
+// strings starting with the prefix. Pattern matching only its prefix
+// is an equality on the prefix and is not evaluated on values.
+func (r *ScanRequest) fillPatternRanges(compFilters []CompositeElementFilter) error {
+	for i := range compFilters {
+		f := &compFilters[i]
+		if f.Pattern == nil || (f.patternPrefix == "" && !f.patternComplete) ||
+			f.Low != MinIndexKey || f.High != MaxIndexKey {
+			continue
+		}
+
+		low, err := json.Marshal(f.patternPrefix)
+		if err != nil {
+			return err
+		}
+		if f.patternComplete {
+			if f.Low, err = r.newLowKey(low); err != nil {
+				return err
+			}
+			if f.High, err = r.newHighKey(low); err != nil {
+				return err
+			}
+			f.Inclusion, f.Pattern = Both, nil
+			continue
+		}
+		if f.Low, err = r.newLowKey(low); err != nil {
+			return err
+		}
+		f.Inclusion = Low
+
+		if successor, ok := common.PrefixSuccessor(f.patternPrefix); ok {
+			high, err := json.Marshal(successor)
+			if err != nil {
+				return err
+			}
+			if f.High, err = r.newHighKey(high); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (r *ScanRequest) fillFilterEquals(protoScan *protobuf.Scan, filter *Filter) error {
 	var e error
 	var equals [][]byte
@@ -756,7 +890,8 @@ func (r *ScanRequest) composeScans(points []IndexPoint, filters []Filter) []Scan
 		}
 
 		if scans[i].ScanType == FilterRangeReq && len(scans[i].Filters) == 1 &&
-			len(scans[i].Filters[0].CompositeFilters) == 1 {
+			len(scans[i].Filters[0].CompositeFilters) == 1 &&
+			scans[i].Filters[0].CompositeFilters[0].Pattern == nil {
 			// Flip inclusion if first element is descending
 			scans[i].Incl = flipInclusion(scans[i].Filters[0].CompositeFilters[0].Inclusion, r.IndexInst.Defn.Desc)
 			scans[i].ScanType = RangeReq
@@ -903,6 +1038,10 @@ func (r *ScanRequest) fillScans(protoScans []*protobuf.Scan) (localErr error) {
 			}
 
 			fl := protoScan.Filters[0]
+			if fl.GetPatternType() != uint32(common.PATTERN_NONE) {
+				localErr = errors.New("Pattern filters are not supported on primary index")
+				return
+			}
 			if l, localErr = r.newLowKey(fl.Low); localErr != nil {
 				localErr = fmt.Errorf("Invalid low key %s (%s)", logging.TagStrUD(fl.Low), localErr)
 				return
@@ -998,6 +1137,16 @@ func (r *ScanRequest) fillScans(protoScans []*protobuf.Scan) (localErr error) {
 					High:      h,
 					Inclusion: Inclusion(fl.GetInclusion()),
 				}
+				if fl.GetPatternType() != uint32(common.PATTERN_NONE) {
+					typ := common.PatternType(fl.GetPatternType())
+					compfil.Pattern, compfil.patternPrefix, compfil.patternComplete, localErr =
+						common.CompilePattern(typ, string(fl.GetPattern()))
+					if localErr != nil {
+						localErr = fmt.Errorf("Invalid %v pattern %s (%s)", typ,
+							logging.TagStrUD(fl.GetPattern()), localErr)
+						return
+					}
+				}
 				compFilters = append(compFilters, compfil)
 			}
 
@@ -1368,6 +1517,124 @@ func (r *ScanRequest) hasAllEqualFilters(keyPos int) bool {
 	return found
 }
 
+func (r *ScanRequest) fillFilter(protoFilter *protobuf.IndexFilter) (err error) {
+
+	if protoFilter == nil {
+		return nil
+	}
+
+	if string(protoFilter.GetExpr()) == "" {
+		return errors.New("Filter expression is empty")
+	}
+
+	expr, err := compileN1QLExpression(string(protoFilter.GetExpr()))
+	if err != nil {
+		return err
+	}
+
+	r.Filter = &IndexFilter{Expr: expr}
+
+	for _, d := range protoFilter.GetDependsOnIndexKeys() {
+		r.Filter.DependsOnIndexKeys = append(r.Filter.DependsOnIndexKeys, d)
+		if !r.isPrimary && int(d) == len(r.IndexInst.Defn.SecExprs) {
+			r.Filter.DependsOnPrimaryKey = true
+		}
+	}
+
+	for _, d := range protoFilter.GetIndexKeyNames() {
+		r.Filter.IndexKeyNames = append(r.Filter.IndexKeyNames, string(d))
+	}
+
+	if err = r.validateFilter(); err != nil {
+		return
+	}
+
+	cv := value.NewScopeValue(make(map[string]interface{}), nil)
+	r.Filter.cover = &GroupAggr{
+		DependsOnIndexKeys: r.Filter.DependsOnIndexKeys,
+		IndexKeyNames:      r.Filter.IndexKeyNames,
+		IsPrimary:          r.isPrimary,
+		cv:                 cv,
+		av:                 value.NewAnnotatedValue(cv),
+		exprContext:        expression.NewIndexContext(),
+	}
+	r.Filter.values = make([]interface{}, len(r.IndexInst.Defn.SecExprs))
+
+	return
+}
+
+//validateFilter checks that the filter expression depends only on
+//keys of the index, position len(SecExprs) being the primary key, and
+//that the key names used in the expression are those keys
+func (r *ScanRequest) validateFilter() error {
+
+	numKeys := len(r.IndexInst.Defn.SecExprs)
+	if r.isPrimary {
+		numKeys = 0
+	}
+
+	for _, k := range r.Filter.DependsOnIndexKeys {
+		if k < 0 || int(k) > numKeys {
+			err := fmt.Errorf("Invalid KeyPos In Filter DependsOnIndexKeys %v", k)
+			logging.Errorf("ScanRequest::validateFilter %v", err)
+			return err
+		}
+		if int(k) >= len(r.Filter.IndexKeyNames) || r.Filter.IndexKeyNames[k] == "" {
+			err := fmt.Errorf("Missing Index Key Name In Filter For KeyPos %v", k)
+			logging.Errorf("ScanRequest::validateFilter %v", err)
+			return err
+		}
+
+		key := metaIdKey
+		if int(k) < numKeys {
+			key = r.IndexInst.Defn.SecExprs[k]
+		}
+		if !isIndexKeyName(r.Filter.IndexKeyNames[k], key) {
+			err := fmt.Errorf("Index Key Name %v In Filter Does Not Match Index Key At KeyPos %v",
+				logging.TagUD(r.Filter.IndexKeyNames[k]), k)
+			logging.Errorf("ScanRequest::validateFilter %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+const metaIdKey = "meta().id"
+
+var keyspaceAliasRegexp = regexp.MustCompile("`((?:[^`]|``)+)`")
+
+//isIndexKeyName returns true if `name`, as used by query in an
+//expression over index keys, eg. (`b`.`age`), is index key `key`, eg.
+//`age`, qualified by the keyspace alias of the query. Alias is one of
+//the identifiers in name.
+func isIndexKeyName(name, key string) bool {
+
+	nameExpr, err := parser.Parse(name)
+	if err != nil {
+		return false
+	}
+
+	tried := make(map[string]bool)
+	for _, match := range keyspaceAliasRegexp.FindAllStringSubmatch(name, -1) {
+		alias := strings.Replace(match[1], "``", "`", -1)
+		if tried[alias] {
+			continue
+		}
+		tried[alias] = true
+
+		keyExpr, err := parser.Parse(key)
+		if err != nil {
+			return false
+		}
+		keyExpr, err = expression.NewFormalizer(alias, nil).Map(keyExpr)
+		if err == nil && keyExpr.EquivalentTo(nameExpr) {
+			return true
+		}
+	}
+	return false
+}
+
 func compileN1QLExpression(expr string) (expression.Expression, error) {
 
 	cExpr, err := parser.Parse(expr)
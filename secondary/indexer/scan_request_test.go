@@ -0,0 +1,88 @@
+package indexer
+
+import (
+	"testing"
+
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+)
+
+func TestFillFilter(t *testing.T) {
+	newRequest := func() *ScanRequest {
+		r := &ScanRequest{DefnID: 100}
+		r.IndexInst.Defn.SecExprs = []string{"`age`", "`name`"}
+		return r
+	}
+	names := [][]byte{[]byte("(`b`.`age`)"), []byte("(`b`.`name`)"), []byte("(meta(`b`).`id`)")}
+
+	r := newRequest()
+	err := r.fillFilter(&protobuf.IndexFilter{
+		Expr:               []byte("cover ((`b`.`age`)) % 2 = 0 AND cover ((meta(`b`).`id`)) LIKE \"user%\""),
+		DependsOnIndexKeys: []int32{0, 2},
+		IndexKeyNames:      names,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !r.Filter.DependsOnPrimaryKey {
+		t.Fatal("expected filter to depend on primary key")
+	}
+
+	match, err := r.Filter.evaluate([][]byte{[]byte("30"), []byte(`"abc"`)}, []byte("user1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !match {
+		t.Fatal("expected row to match filter")
+	}
+	match, err = r.Filter.evaluate([][]byte{[]byte("31"), []byte(`"abc"`)}, []byte("user1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if match {
+		t.Fatal("expected row not to match filter")
+	}
+
+	// key name of another index key
+	r = newRequest()
+	err = r.fillFilter(&protobuf.IndexFilter{
+		Expr:               []byte("cover ((`b`.`name`)) > 10"),
+		DependsOnIndexKeys: []int32{0},
+		IndexKeyNames:      [][]byte{[]byte("(`b`.`name`)")},
+	})
+	if err == nil {
+		t.Fatal("expected mismatched key name to fail")
+	}
+
+	// key position beyond the index keys
+	r = newRequest()
+	err = r.fillFilter(&protobuf.IndexFilter{
+		Expr:               []byte("cover ((`b`.`age`)) > 10"),
+		DependsOnIndexKeys: []int32{3},
+		IndexKeyNames:      names,
+	})
+	if err == nil {
+		t.Fatal("expected invalid key position to fail")
+	}
+
+	// empty expression
+	r = newRequest()
+	if err = r.fillFilter(&protobuf.IndexFilter{}); err == nil {
+		t.Fatal("expected empty expression to fail")
+	}
+}
+
+func TestIsIndexKeyName(t *testing.T) {
+	tests := []struct {
+		name, key string
+		match     bool
+	}{
+		{"(`d`.`age`)", "`age`", true},
+		{"lower((`d`.`name`))", "lower(`name`)", true},
+		{"(meta(`d`).`id`)", metaIdKey, true},
+		{"(`d`.`name`)", "`age`", false},
+		{"(`d`.`age`) + 1", "`age`", false},
+		{"(`d`.", "`age`", false},
+	}
+	for _, test := range tests {
+		if match := isIndexKeyName(test.name, test.key); match != test.match {
+			t.Errorf("%v as %v: expected %v, got %v", test.name, test.key, test.match, match)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc64"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Resumable scans.
+//
+// A scan request with `resumable` set, that stops on reaching its
+// limit, ends with a StreamEndResponse carrying a resume token. The
+// token is opaque to the client and records, for each partition, the
+// last storage entry returned, key and docid, and how many of its
+// duplicate rows were returned if not all of them. It also records the
+// position of the scan in the request, the last row of a distinct scan
+// and the snapshot scanned. A scan request carrying the token continues
+// exactly after those rows. If the request asks for the same
+// snapshot, the scan is served from the snapshot retained when the
+// token was generated, or fails if the snapshot has expired.
+
+var (
+	ErrResumeTokenInvalid    = errors.New("Invalid resume token for scan request")
+	ErrResumeNotSupported    = errors.New("Resumable scan is not supported for group/aggregate requests")
+	ErrResumeSnapshotExpired = errors.New("Snapshot of resume token is no longer retained")
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+type scanResumeToken struct {
+	DefnId   uint64        `json:"defnId"`
+	Scan     int           `json:"scan"` // position of scan in request
+	Partns   []resumePartn `json:"partns"`
+	SnapTs   uint64        `json:"snapTs"` // checksum of snapshot timestamp
+	SnapId   string        `json:"snapId,omitempty"`
+	Distinct []byte        `json:"distinct,omitempty"` // last row of distinct scan
+}
+
+type resumePartn struct {
+	PartnId common.PartitionId `json:"partnId"`
+	Entry   []byte             `json:"entry,omitempty"` // nil if none returned
+	Dups    int                `json:"dups,omitempty"`  // rows of entry returned, 0 if all
+}
+
+// setResume validates resume parameters of a scan request, must be
+// called after scans are parsed.
+func (r *ScanRequest) setResume(resumable bool, token []byte, sameSnapshot bool) error {
+	if !resumable && token == nil {
+		return nil
+	}
+	if r.GroupAggr != nil {
+		return ErrResumeNotSupported
+	}
+
+	r.Resumable = resumable
+	r.SameSnapshot = sameSnapshot
+
+	// slices are scanned in order of requested partitions, older
+	// clients do not send partitions for non-partitioned indexes.
+	r.resumePartns = r.PartitionIds
+	if len(r.resumePartns) == 0 {
+		if common.IsPartitioned(r.IndexInst.Defn.PartitionScheme) {
+			return ErrResumeTokenInvalid
+		}
+		r.resumePartns = []common.PartitionId{common.PartitionId(0)}
+	}
+	r.resumeEntries = make([][]byte, len(r.resumePartns))
+	r.resumeDups = make([]int, len(r.resumePartns))
+	r.resumeSkips = make([]bool, len(r.resumePartns))
+
+	if token == nil {
+		return nil
+	}
+
+	t := new(scanResumeToken)
+	if err := json.Unmarshal(token, t); err != nil {
+		return ErrResumeTokenInvalid
+	}
+	// token can be used with any replica, entries are stored alike.
+	if t.DefnId != r.DefnID || t.Scan < 0 || t.Scan > len(r.Scans) || len(t.Partns) != len(r.resumePartns) {
+		return ErrResumeTokenInvalid
+	}
+	for i, partnId := range r.resumePartns {
+		if t.Partns[i].PartnId != partnId {
+			return ErrResumeTokenInvalid
+		}
+	}
+	r.resume = t
+	return nil
+}
+
+// startResumeScan is called before scanning Scans[pos], and return
+// false if the scan has been completed by a previous request.
+func (r *ScanRequest) startResumeScan(pos int) bool {
+	if r.resume != nil && pos < r.resume.Scan {
+		return false
+	}
+	r.resumeScan = pos
+	for i := range r.resumeEntries {
+		r.resumeEntries[i], r.resumeDups[i], r.resumeSkips[i] = r.resumeEntries[i][:0], 0, false
+		if r.resume != nil && pos == r.resume.Scan && r.resume.Partns[i].Entry != nil {
+			r.resumeEntries[i] = append(r.resumeEntries[i], r.resume.Partns[i].Entry...)
+			r.resumeDups[i] = r.resume.Partns[i].Dups
+			r.resumeSkips[i] = true
+		}
+	}
+	return true
+}
+
+// resumeFrom return the entry after which slice at `pos` should be
+// scanned, for the current scan.
+func (r *ScanRequest) resumeFrom(pos int) []byte {
+	if r.resume == nil || r.resumeScan != r.resume.Scan || pos >= len(r.resume.Partns) {
+		return nil
+	}
+	return r.resume.Partns[pos].Entry
+}
+
+// resumeSkip is called for entries gathered from the slice being
+// gathered, and returns the number of rows of `entry` already returned
+// by the previous request, skip is true if all of them were.
+func (r *ScanRequest) resumeSkip(entry []byte) (skip bool, dups int) {
+	pos := r.resumeSlice
+	if pos >= len(r.resumeSkips) || !r.resumeSkips[pos] {
+		return false, 0
+	}
+	// entries before the resume entry are not gathered, so that only
+	// the first entry of a slice can be the resume entry.
+	r.resumeSkips[pos] = false
+	if !bytes.Equal(entry, r.resumeEntries[pos]) {
+		return false, 0
+	}
+	return r.resumeDups[pos] == 0, r.resumeDups[pos]
+}
+
+// recordResume remembers `entry` as the last entry returned from the
+// slice being gathered, `dups` is the number of its rows returned if
+// not all of them were.
+func (r *ScanRequest) recordResume(entry []byte, dups int) {
+	if pos := r.resumeSlice; pos < len(r.resumeEntries) {
+		r.resumeEntries[pos] = append(r.resumeEntries[pos][:0], entry...)
+		r.resumeDups[pos] = dups
+		r.resumeSkips[pos] = false
+	}
+}
+
+// makeResumeToken for the current scan, `distinct` is the last row
+// returned by a distinct scan.
+func (r *ScanRequest) makeResumeToken(distinct []byte) *scanResumeToken {
+	t := &scanResumeToken{
+		DefnId: r.DefnID,
+		Scan:   r.resumeScan,
+		Partns: make([]resumePartn, len(r.resumePartns)),
+	}
+	if len(distinct) > 0 {
+		t.Distinct = append([]byte(nil), distinct...)
+	}
+	for i, partnId := range r.resumePartns {
+		t.Partns[i] = resumePartn{PartnId: partnId}
+		if len(r.resumeEntries[i]) > 0 {
+			t.Partns[i].Entry = append([]byte(nil), r.resumeEntries[i]...)
+			t.Partns[i].Dups = r.resumeDups[i]
+		}
+	}
+	return t
+}
+
+// resumeSliceScan scans snapshot `snap` for `scan`, only for entries
+// stored from entry `from`, which is skipped by the scan pipeline if
+// all its rows were returned.
+func resumeSliceScan(request *ScanRequest, scan Scan, ctx IndexReaderContext, snap Snapshot,
+	from []byte, callb EntryCallback) error {
+
+	// storage entries are ordered by key and then by docid, seek to the
+	// key of last entry and skip entries before that entry.
+	skip := true
+	handler := func(entry []byte) error {
+		if skip {
+			if bytes.Compare(entry, from) < 0 {
+				return nil
+			}
+			skip = false
+		}
+		return callb(entry)
+	}
+
+	if scan.ScanType == LookupReq {
+		return snap.Lookup(ctx, scan.Equals, handler)
+	}
+
+	var low IndexKey
+	if request.isPrimary {
+		k := primaryKey(append([]byte(nil), from...))
+		low = &k
+	} else {
+		e := secondaryIndexEntry(from)
+		k := secondaryKey(append([]byte(nil), from[:e.lenKey()]...))
+		low = &k
+	}
+
+	high, incl := scan.High, scan.Incl
+	if scan.ScanType == AllReq {
+		high, incl = MaxIndexKey, Both
+	}
+	if incl == Neither {
+		incl = Low
+	} else if incl == High {
+		incl = Both
+	}
+	return snap.Range(ctx, low, high, incl, handler)
+}
+
+func tsChecksum(ts *common.TsVbuuid) uint64 {
+	if ts == nil {
+		return 0
+	}
+	buf := make([]byte, 8*len(ts.Seqnos))
+	for i, seqno := range ts.Seqnos {
+		binary.BigEndian.PutUint64(buf[i*8:], seqno)
+	}
+	return crc64.Checksum(buf, crc64Table)
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  retained snapshots
+//
+/////////////////////////////////////////////////////////////////////////
+
+type retainedSnapshot struct {
+	is     IndexSnapshot
+	expiry time.Time
+}
+
+type resumeSnapshots struct {
+	mu     sync.Mutex
+	snaps  map[string]*retainedSnapshot
+	finch  chan bool
+	closed bool
+}
+
+func newResumeSnapshots() *resumeSnapshots {
+	rs := &resumeSnapshots{
+		snaps: make(map[string]*retainedSnapshot),
+		finch: make(chan bool),
+	}
+	go rs.expire()
+	return rs
+}
+
+// retain a clone of snapshot `is` for `ttl`, return the id of retained
+// snapshot or "" if snapshot could not be retained.
+func (rs *resumeSnapshots) retain(is IndexSnapshot, ttl time.Duration, max int) string {
+	if ttl <= 0 || is == nil {
+		return ""
+	}
+
+	uuid, err := common.NewUUID()
+	if err != nil {
+		return ""
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed || len(rs.snaps) >= max {
+		return ""
+	}
+	id := uuid.Str()
+	rs.snaps[id] = &retainedSnapshot{is: CloneIndexSnapshot(is), expiry: time.Now().Add(ttl)}
+	return id
+}
+
+// get return a clone of retained snapshot `id` and extends its
+// retention by `ttl`.
+func (rs *resumeSnapshots) get(id string, ttl time.Duration) IndexSnapshot {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if snap, ok := rs.snaps[id]; ok {
+		snap.expiry = time.Now().Add(ttl)
+		return CloneIndexSnapshot(snap.is)
+	}
+	return nil
+}
+
+// release all retained snapshots of index instance `instId`.
+func (rs *resumeSnapshots) release(instId common.IndexInstId) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for id, snap := range rs.snaps {
+		if snap.is.IndexInstId() == instId {
+			DestroyIndexSnapshot(snap.is)
+			delete(rs.snaps, id)
+		}
+	}
+}
+
+// close stops expiring snapshots and releases all retained snapshots.
+func (rs *resumeSnapshots) close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.closed {
+		return
+	}
+	rs.closed = true
+	close(rs.finch)
+	for id, snap := range rs.snaps {
+		DestroyIndexSnapshot(snap.is)
+		delete(rs.snaps, id)
+	}
+}
+
+func (rs *resumeSnapshots) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			rs.mu.Lock()
+			for id, snap := range rs.snaps {
+				if now.After(snap.expiry) {
+					logging.Debugf("ScanCoordinator: Releasing resume snapshot %v of %v",
+						id, snap.is.IndexInstId())
+					DestroyIndexSnapshot(snap.is)
+					delete(rs.snaps, id)
+				}
+			}
+			rs.mu.Unlock()
+
+		case <-rs.finch:
+			return
+		}
+	}
+}
+
+// getResumeSnapshot return the retained snapshot for request resuming
+// on the same snapshot.
+func (s *scanCoordinator) getResumeSnapshot(r *ScanRequest) (IndexSnapshot, error) {
+	ttl := time.Duration(s.config.Load()["scan.resume.retainSnapshotTime"].Int()) * time.Second
+	is := s.resumeSnaps.get(r.resume.SnapId, ttl)
+	if is == nil {
+		return nil, ErrResumeSnapshotExpired
+	}
+	if is.IndexInstId() != r.IndexInstId || tsChecksum(is.Timestamp()) != r.resume.SnapTs {
+		DestroyIndexSnapshot(is)
+		return nil, ErrResumeTokenInvalid
+	}
+	return is, nil
+}
+
+// encodeResumeToken completes resume token `t` for snapshot `is`,
+// retaining the snapshot for subsequent requests.
+func (s *scanCoordinator) encodeResumeToken(r *ScanRequest, t *scanResumeToken,
+	is IndexSnapshot) ([]byte, error) {
+
+	cfg := s.config.Load()
+	ttl := time.Duration(cfg["scan.resume.retainSnapshotTime"].Int()) * time.Second
+
+	t.SnapTs = tsChecksum(is.Timestamp())
+	if r.resume != nil && r.SameSnapshot {
+		t.SnapId = r.resume.SnapId
+	} else {
+		t.SnapId = s.resumeSnaps.retain(is, ttl, cfg["scan.resume.maxRetainedSnapshots"].Int())
+	}
+	return json.Marshal(t)
+}
@@ -0,0 +1,110 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestScanResumeToken(t *testing.T) {
+	newRequest := func() *ScanRequest {
+		r := &ScanRequest{DefnID: 100, Scans: make([]Scan, 3)}
+		r.IndexInst.Defn.PartitionScheme = c.SINGLE
+		return r
+	}
+
+	r := newRequest()
+	if err := r.setResume(true, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !r.startResumeScan(0) || r.resumeFrom(0) != nil {
+		t.Fatalf("expected fresh scan to start from beginning")
+	}
+	r.startResumeScan(1)
+	r.recordResume([]byte("entry0"), 0)
+	r.recordResume([]byte("entry1"), 2) // limit reached on 2nd duplicate
+	token, err := json.Marshal(r.makeResumeToken([]byte("row1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = newRequest()
+	if err := r.setResume(true, token, false); err != nil {
+		t.Fatal(err)
+	}
+	if r.startResumeScan(0) {
+		t.Errorf("expected completed scan to be skipped")
+	}
+	if !r.startResumeScan(1) || !bytes.Equal(r.resumeFrom(0), []byte("entry1")) {
+		t.Errorf("expected scan to resume after entry1, got %s", r.resumeFrom(0))
+	}
+	if !bytes.Equal(r.resume.Distinct, []byte("row1")) {
+		t.Errorf("expected distinct row1, got %s", r.resume.Distinct)
+	}
+	if skip, dups := r.resumeSkip([]byte("entry1")); skip || dups != 2 {
+		t.Errorf("expected to skip 2 rows of entry1, got %v %v", skip, dups)
+	}
+	if skip, dups := r.resumeSkip([]byte("entry1")); skip || dups != 0 {
+		t.Errorf("expected resume entry to be skipped only once, got %v %v", skip, dups)
+	}
+	if !r.startResumeScan(2) || r.resumeFrom(0) != nil {
+		t.Errorf("expected next scan to start from beginning")
+	}
+
+	r = newRequest()
+	r.DefnID = 200
+	if err := r.setResume(true, token, false); err != ErrResumeTokenInvalid {
+		t.Errorf("expected %v for token of another index, got %v", ErrResumeTokenInvalid, err)
+	}
+
+	r = newRequest()
+	r.GroupAggr = &GroupAggr{}
+	if err := r.setResume(true, nil, false); err != ErrResumeNotSupported {
+		t.Errorf("expected %v, got %v", ErrResumeNotSupported, err)
+	}
+}
+
+func TestScanResumeEntry(t *testing.T) {
+	r := &ScanRequest{DefnID: 100, Scans: make([]Scan, 1)}
+	r.IndexInst.Defn.PartitionScheme = c.SINGLE
+	if err := r.setResume(true, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	r.startResumeScan(0)
+	entry := []byte("entry1")
+	r.recordResume(entry, 0)
+	entry[0] = 'x' // storage may reuse entry buffers
+	token, err := json.Marshal(r.makeResumeToken(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r2 := &ScanRequest{DefnID: 100, Scans: make([]Scan, 1)}
+	r2.IndexInst.Defn.PartitionScheme = c.SINGLE
+	if err := r2.setResume(true, token, false); err != nil {
+		t.Fatal(err)
+	}
+	r2.startResumeScan(0)
+	if skip, _ := r2.resumeSkip([]byte("entry1")); !skip {
+		t.Errorf("expected fully returned entry to be skipped")
+	}
+	r2.startResumeScan(0)
+	if skip, dups := r2.resumeSkip([]byte("entry2")); skip || dups != 0 {
+		t.Errorf("expected entry after resume entry to be returned")
+	}
+	if r2.resume.Distinct != nil {
+		t.Errorf("unexpected distinct row %s", r2.resume.Distinct)
+	}
+}
+
+func TestResumeSnapshotsClose(t *testing.T) {
+	rs := newResumeSnapshots()
+	rs.close()
+	rs.close()
+	if id := rs.retain(&indexSnapshot{}, time.Minute, 10); id != "" {
+		t.Errorf("expected no snapshot retained after close, got %v", id)
+	}
+}
@@ -70,7 +70,7 @@ func scanMultiple(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb
 	// run scatter
 	for i, snap := range snapshots {
 		wg.Add(1)
-		go scanSingleSlice(request, scan, request.Ctxs[i], snap, queues[i], &wg, errch, nil)
+		go scanSingleSlice(request, scan, request.Ctxs[i], snap, request.resumeFrom(i), queues[i], &wg, errch, nil)
 	}
 
 	// wait for scatter to be done
@@ -107,7 +107,8 @@ func scanMultiple(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb
 func scanOne(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb EntryCallback) (err error) {
 
 	errch := make(chan error, 1)
-	count := scanSingleSlice(request, scan, request.Ctxs[0], snapshots[0], nil, nil, errch, cb)
+	request.resumeSlice = 0
+	count := scanSingleSlice(request, scan, request.Ctxs[0], snapshots[0], request.resumeFrom(0), nil, nil, errch, cb)
 
 	logging.Debugf("scan_scatter:scanOnce: scan done. Count %v", count)
 
@@ -122,8 +123,8 @@ func scanOne(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb Entr
 	return
 }
 
-func scanSingleSlice(request *ScanRequest, scan Scan, ctx IndexReaderContext, snap SliceSnapshot, queue *Queue,
-	wg *sync.WaitGroup, errch chan error, cb EntryCallback) (count int) {
+func scanSingleSlice(request *ScanRequest, scan Scan, ctx IndexReaderContext, snap SliceSnapshot, from []byte,
+	queue *Queue, wg *sync.WaitGroup, errch chan error, cb EntryCallback) (count int) {
 
 	defer func() {
 		if wg != nil {
@@ -156,7 +157,9 @@ func scanSingleSlice(request *ScanRequest, scan Scan, ctx IndexReaderContext, sn
 	}
 
 	var err error
-	if scan.ScanType == AllReq {
+	if from != nil {
+		err = resumeSliceScan(request, scan, ctx, snap.Snapshot(), from, handler)
+	} else if scan.ScanType == AllReq {
 		err = snap.Snapshot().All(ctx, handler)
 	} else if scan.ScanType == LookupReq {
 		err = snap.Snapshot().Lookup(ctx, scan.Equals, handler)
@@ -470,6 +473,7 @@ func gather(request *ScanRequest, queues []*Queue, donech chan bool, notifych ch
 		}
 
 		if queues[id].Dequeue(&rows[id]) {
+			request.resumeSlice = id
 			if err := cb(rows[id].key); err != nil {
 				errch <- err
 
@@ -509,6 +513,7 @@ func forward(request *ScanRequest, queues []*Queue, donech chan bool, notifych c
 				found = true
 
 				if queues[i].Dequeue(&rows[i]) {
+					request.resumeSlice = i
 					if err := cb(rows[i].key); err != nil {
 						errch <- err
 
@@ -0,0 +1,306 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+// Scan workload.
+//
+// The scan coordinator counts scans by their shape: the index instance,
+// the key positions carrying equality and range filters, the keys
+// projected, and the use of limit and group/aggregate. Filter values are
+// not recorded. The shapes are served on /getLocalScanWorkload, from
+// which the index manager derives index recommendations.
+//
+// Counting is off the scan path as much as possible: one scan out of
+// indexer.scan.workload.sampleInterval is counted, shapes are sharded by
+// index instance, and counts of known shapes are incremented atomically
+// under a read lock.
+
+// maxScanShapes bounds the number of distinct shapes kept. Scans of new
+// shapes are not counted beyond it.
+const maxScanShapes = 10000
+
+const scanWorkloadShards = 16
+
+type scanWorkload struct {
+	seq       uint64 // scans seen, for sampling
+	interval  uint64 // count one scan out of interval
+	numShapes int64
+	enabled   int32
+
+	shards [scanWorkloadShards]scanWorkloadShard
+}
+
+type scanWorkloadShard struct {
+	mu     sync.RWMutex
+	shapes map[string]*scanShapeCount
+}
+
+type scanShapeCount struct {
+	count uint64
+	shape *client.ScanShape
+}
+
+func newScanWorkload(config common.Config) *scanWorkload {
+	w := &scanWorkload{}
+	for i := range w.shards {
+		w.shards[i].shapes = make(map[string]*scanShapeCount)
+	}
+	w.setConfig(config)
+	return w
+}
+
+func (w *scanWorkload) setConfig(config common.Config) {
+	enabled := int32(0)
+	if config["scan.workload.enable"].Bool() {
+		enabled = 1
+	}
+	interval := config["scan.workload.sampleInterval"].Int()
+	if interval < 1 {
+		interval = 1
+	}
+	atomic.StoreUint64(&w.interval, uint64(interval))
+	atomic.StoreInt32(&w.enabled, enabled)
+}
+
+func (w *scanWorkload) shard(instId common.IndexInstId) *scanWorkloadShard {
+	return &w.shards[uint64(instId)%scanWorkloadShards]
+}
+
+// getScanShape returns the shape of a scan request.
+func getScanShape(r *ScanRequest) *client.ScanShape {
+
+	shape := &client.ScanShape{
+		DefnId:    common.IndexDefnId(r.DefnID),
+		InstId:    r.IndexInstId,
+		Bucket:    r.Bucket,
+		Name:      r.IndexName,
+		Limit:     r.Limit > 0 && r.Limit < math.MaxInt64,
+		GroupAggr: r.GroupAggr != nil,
+	}
+
+	// A key is an equality filter if every filter on it is a point,
+	// e.g. IN lists, and a range filter otherwise.
+	filtered := make(map[int]bool)
+	isRange := make(map[int]bool)
+
+	if len(r.Scans) != 0 {
+		for _, scan := range r.Scans {
+			for _, filter := range scan.Filters {
+				for pos, cf := range filter.CompositeFilters {
+					if cf.Low == MinIndexKey && cf.High == MaxIndexKey && cf.Pattern == nil {
+						continue
+					}
+					filtered[pos] = true
+					if cf.Low == MinIndexKey || cf.High == MaxIndexKey || cf.Pattern != nil ||
+						cf.Inclusion != Both || cf.Low.CompareIndexKey(cf.High) != 0 {
+						isRange[pos] = true
+					}
+				}
+			}
+		}
+	} else if r.ScanType != ScanAllReq {
+		// Older requests filter on the whole key, counted on the leading key.
+		filtered[0] = true
+		if len(r.Keys) == 0 {
+			isRange[0] = true
+		}
+	}
+
+	for pos := range filtered {
+		if isRange[pos] {
+			shape.Range = append(shape.Range, pos)
+		} else {
+			shape.Equality = append(shape.Equality, pos)
+		}
+	}
+	sort.Ints(shape.Equality)
+	sort.Ints(shape.Range)
+
+	if p := r.Indexprojection; p != nil && p.projectSecKeys {
+		shape.Projection = make([]int, 0, len(p.projectionKeys))
+		for pos, projected := range p.projectionKeys {
+			if projected {
+				shape.Projection = append(shape.Projection, pos)
+			}
+		}
+	}
+
+	return shape
+}
+
+func scanShapeKey(shape *client.ScanShape) string {
+
+	appendInts := func(buf []byte, ints []int) []byte {
+		buf = append(buf, '[')
+		for i, n := range ints {
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = strconv.AppendInt(buf, int64(n), 10)
+		}
+		return append(buf, ']')
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = strconv.AppendUint(buf, uint64(shape.InstId), 10)
+	buf = append(buf, ':')
+	buf = appendInts(buf, shape.Equality)
+	buf = append(buf, ':')
+	buf = appendInts(buf, shape.Range)
+	buf = append(buf, ':')
+	if shape.Projection != nil {
+		buf = appendInts(buf, shape.Projection)
+	} else {
+		buf = append(buf, '*')
+	}
+	buf = append(buf, ':')
+	buf = strconv.AppendBool(buf, shape.Limit)
+	buf = append(buf, ':')
+	buf = strconv.AppendBool(buf, shape.GroupAggr)
+	return string(buf)
+}
+
+func (w *scanWorkload) record(r *ScanRequest) {
+
+	if atomic.LoadInt32(&w.enabled) == 0 {
+		return
+	}
+
+	switch r.ScanType {
+	case ScanReq, ScanAllReq, CountReq, MultiScanCountReq:
+	default:
+		return
+	}
+
+	interval := atomic.LoadUint64(&w.interval)
+	if interval > 1 && atomic.AddUint64(&w.seq, 1)%interval != 0 {
+		return
+	}
+
+	shape := getScanShape(r)
+	key := scanShapeKey(shape)
+	shard := w.shard(shape.InstId)
+
+	shard.mu.RLock()
+	current, ok := shard.shapes[key]
+	shard.mu.RUnlock()
+	if ok {
+		atomic.AddUint64(&current.count, interval)
+		return
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if current, ok := shard.shapes[key]; ok {
+		atomic.AddUint64(&current.count, interval)
+		return
+	}
+
+	if atomic.AddInt64(&w.numShapes, 1) > maxScanShapes {
+		atomic.AddInt64(&w.numShapes, -1)
+		return
+	}
+
+	shard.shapes[key] = &scanShapeCount{count: interval, shape: shape}
+}
+
+// prune forgets about the shapes of dropped index instances.
+func (w *scanWorkload) prune(indexInstMap common.IndexInstMap) {
+
+	for i := range w.shards {
+		shard := &w.shards[i]
+
+		shard.mu.Lock()
+		for key, current := range shard.shapes {
+			if _, ok := indexInstMap[current.shape.InstId]; !ok {
+				delete(shard.shapes, key)
+				atomic.AddInt64(&w.numShapes, -1)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (w *scanWorkload) list() []*client.ScanShape {
+
+	shapes := make([]*client.ScanShape, 0)
+	for i := range w.shards {
+		shard := &w.shards[i]
+
+		shard.mu.RLock()
+		for _, current := range shard.shapes {
+			sh := *current.shape
+			sh.Count = atomic.LoadUint64(&current.count)
+			shapes = append(shapes, &sh)
+		}
+		shard.mu.RUnlock()
+	}
+
+	sort.Slice(shapes, func(i, j int) bool {
+		if shapes[i].InstId != shapes[j].InstId {
+			return shapes[i].InstId < shapes[j].InstId
+		}
+		return shapes[i].Count > shapes[j].Count
+	})
+
+	return shapes
+}
+
+func (s *scanCoordinator) handleScanWorkloadReq(w http.ResponseWriter, r *http.Request) {
+
+	creds, valid, err := common.IsAuthValid(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 Unauthorized\n"))
+		return
+	}
+
+	if !common.IsAllowed(creds, []string{"cluster.admin.internal.index!read"}, w) {
+		return
+	}
+
+	resp := &client.ScanWorkloadResponse{
+		Code:   manager.RESP_SUCCESS,
+		Shapes: s.workload.list(),
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logging.Errorf("ScanCoordinator::handleScanWorkloadReq Error marshalling response %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
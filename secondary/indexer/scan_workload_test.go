@@ -0,0 +1,108 @@
+package indexer
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestScanWorkload(enable bool, sampleInterval int) *scanWorkload {
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("scan.workload.enable", enable)
+	conf.SetValue("scan.workload.sampleInterval", sampleInterval)
+	return newScanWorkload(conf)
+}
+
+func TestScanShape(t *testing.T) {
+	key := func(s string) IndexKey {
+		k, err := NewSecondaryKey([]byte(s), make([]byte, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	// equality on key 1, range on key 2, key 0 unfiltered
+	r := &ScanRequest{
+		ScanType: ScanReq,
+		Limit:    10,
+		Scans: []Scan{{Filters: []Filter{{CompositeFilters: []CompositeElementFilter{
+			{Low: MinIndexKey, High: MaxIndexKey, Inclusion: Both},
+			{Low: key(`["a"]`), High: key(`["a"]`), Inclusion: Both},
+			{Low: key(`[10]`), High: MaxIndexKey, Inclusion: Low},
+		}}}}},
+		Indexprojection: &Projection{projectSecKeys: true, projectionKeys: []bool{true, false, false}},
+	}
+
+	shape := getScanShape(r)
+	if !reflect.DeepEqual(shape.Equality, []int{1}) || !reflect.DeepEqual(shape.Range, []int{2}) {
+		t.Errorf("unexpected equality %v range %v", shape.Equality, shape.Range)
+	}
+	if !reflect.DeepEqual(shape.Projection, []int{0}) || !shape.Limit || shape.GroupAggr {
+		t.Errorf("unexpected projection %v limit %v groupAggr %v", shape.Projection, shape.Limit, shape.GroupAggr)
+	}
+
+	// scans with a different filter value have the same shape
+	w := newTestScanWorkload(true, 1)
+	w.record(r)
+	r.Scans[0].Filters[0].CompositeFilters[1] = CompositeElementFilter{Low: key(`["b"]`), High: key(`["b"]`), Inclusion: Both}
+	w.record(r)
+
+	// no limit and all keys projected
+	r.Limit = math.MaxInt64
+	r.Indexprojection = nil
+	w.record(r)
+
+	shapes := w.list()
+	if len(shapes) != 2 || shapes[0].Count != 2 || shapes[1].Count != 1 {
+		t.Fatalf("unexpected shapes %v", shapes)
+	}
+	if shapes[1].Limit || shapes[1].Projection != nil {
+		t.Errorf("unexpected limit %v projection %v", shapes[1].Limit, shapes[1].Projection)
+	}
+}
+
+func TestScanWorkloadSampling(t *testing.T) {
+	r := &ScanRequest{ScanType: ScanAllReq, IndexInstId: 11}
+
+	// counts of sampled scans are scaled up
+	w := newTestScanWorkload(true, 4)
+	for i := 0; i < 9; i++ {
+		w.record(r)
+	}
+	shapes := w.list()
+	if len(shapes) != 1 || shapes[0].Count != 8 || shapes[0].InstId != 11 {
+		t.Fatalf("unexpected shapes %v", shapes)
+	}
+
+	// shapes of dropped instances are pruned
+	w.prune(c.IndexInstMap{12: c.IndexInst{InstId: 12}})
+	if shapes := w.list(); len(shapes) != 0 {
+		t.Fatalf("unexpected shapes %v", shapes)
+	}
+
+	// the number of shapes is bounded
+	w = newTestScanWorkload(true, 1)
+	for i := 1; i <= maxScanShapes+1; i++ {
+		w.record(&ScanRequest{ScanType: ScanAllReq, IndexInstId: c.IndexInstId(i)})
+	}
+	if shapes := w.list(); len(shapes) != maxScanShapes {
+		t.Fatalf("unexpected number of shapes %v", len(shapes))
+	}
+
+	// nothing is counted when disabled, until enabled again
+	w = newTestScanWorkload(false, 1)
+	w.record(r)
+	if shapes := w.list(); len(shapes) != 0 {
+		t.Fatalf("unexpected shapes %v", shapes)
+	}
+	conf := c.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("scan.workload.sampleInterval", 1)
+	w.setConfig(conf)
+	w.record(r)
+	if shapes := w.list(); len(shapes) != 1 || shapes[0].Count != 1 {
+		t.Fatalf("unexpected shapes %v", shapes)
+	}
+}
@@ -426,6 +426,12 @@ func validateSettings(value []byte, current common.Config, internal bool) error
 		}
 	}
 
+	if val, ok := newConfig["indexer.settings.compaction.policies"]; ok {
+		if _, err := parseCompactionPolicies(val.String()); err != nil {
+			return err
+		}
+	}
+
 	if !internal {
 		if val, ok := newConfig["indexer.settings.storage_mode"]; ok {
 			if len(val.String()) != 0 {
@@ -105,6 +105,7 @@ type IndexStats struct {
 	insertBytes           stats.Int64Val
 	numDocsPending        stats.Int64Val
 	scanWaitDuration      stats.Int64Val
+	creditWaitDuration    stats.Int64Val
 	numDocsIndexed        stats.Int64Val
 	numDocsProcessed      stats.Int64Val
 	numRequests           stats.Int64Val
@@ -117,6 +118,8 @@ type IndexStats struct {
 	numDocsQueued         stats.Int64Val
 	deleteBytes           stats.Int64Val
 	dataSize              stats.Int64Val
+	prefixDictSize        stats.Int64Val
+	prefixSavedBytes      stats.Int64Val
 	scanBytesRead         stats.Int64Val
 	getBytes              stats.Int64Val
 	itemsCount            stats.Int64Val
@@ -150,6 +153,8 @@ type IndexStats struct {
 	progressStatTime      stats.TimeVal
 	residentPercent       stats.Int64Val
 	cacheHitPercent       stats.Int64Val
+	memoryQuota           stats.Int64Val
+	ingestionPaused       stats.Int64Val
 
 	Timings IndexTimingStats
 }
@@ -174,6 +179,7 @@ func (s *IndexStats) Init() {
 	s.insertBytes.Init()
 	s.numDocsPending.Init()
 	s.scanWaitDuration.Init()
+	s.creditWaitDuration.Init()
 	s.numDocsIndexed.Init()
 	s.numDocsProcessed.Init()
 	s.numRequests.Init()
@@ -186,6 +192,8 @@ func (s *IndexStats) Init() {
 	s.numDocsQueued.Init()
 	s.deleteBytes.Init()
 	s.dataSize.Init()
+	s.prefixDictSize.Init()
+	s.prefixSavedBytes.Init()
 	s.fragPercent.Init()
 	s.scanBytesRead.Init()
 	s.getBytes.Init()
@@ -219,6 +227,8 @@ func (s *IndexStats) Init() {
 	s.progressStatTime.Init()
 	s.residentPercent.Init()
 	s.cacheHitPercent.Init()
+	s.memoryQuota.Init()
+	s.ingestionPaused.Init()
 
 	s.Timings.Init()
 
@@ -316,6 +326,13 @@ type IndexerStats struct {
 	statsResponse     stats.TimingStat
 	notFoundError     stats.Int64Val
 
+	numReadSessions        stats.Int64Val
+	readSessionMemUsed     stats.Int64Val
+	numReadSessionsExpired stats.Int64Val
+
+	buildThrottleLevel    stats.Int64Val
+	buildThrottleDuration stats.Int64Val
+
 	indexerState stats.Int64Val
 }
 
@@ -331,6 +348,11 @@ func (s *IndexerStats) Init() {
 	s.statsResponse.Init()
 	s.indexerState.Init()
 	s.notFoundError.Init()
+	s.numReadSessions.Init()
+	s.readSessionMemUsed.Init()
+	s.numReadSessionsExpired.Init()
+	s.buildThrottleLevel.Init()
+	s.buildThrottleDuration.Init()
 }
 
 func (s *IndexerStats) Reset() {
@@ -423,6 +445,11 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 	addStat("uptime", fmt.Sprintf("%s", time.Since(uptime)))
 	addStat("num_connections", is.numConnections.Value())
 	addStat("index_not_found_errcount", is.notFoundError.Value())
+	addStat("num_read_sessions", is.numReadSessions.Value())
+	addStat("read_session_memory_used", is.readSessionMemUsed.Value())
+	addStat("num_read_sessions_force_expired", is.numReadSessionsExpired.Value())
+	addStat("build_throttle_level", is.buildThrottleLevel.Value())
+	addStat("build_throttle_duration", is.buildThrottleDuration.Value())
 	addStat("memory_quota", is.memoryQuota.Value())
 	addStat("memory_used", is.memoryUsed.Value())
 	addStat("memory_used_storage", is.memoryUsedStorage.Value())
@@ -480,6 +507,10 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 			s.int64Stats(func(ss *IndexStats) int64 {
 				return ss.scanWaitDuration.Value()
 			}))
+		addStat("scan_credit_wait_duration",
+			s.int64Stats(func(ss *IndexStats) int64 {
+				return ss.creditWaitDuration.Value()
+			}))
 		// partition stats
 		addStat("num_docs_indexed",
 			s.partnInt64Stats(func(ss *IndexStats) int64 {
@@ -534,6 +565,16 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 				return ss.dataSize.Value()
 			}))
 		// partition stats
+		addStat("prefix_dict_size",
+			s.partnInt64Stats(func(ss *IndexStats) int64 {
+				return ss.prefixDictSize.Value()
+			}))
+		// partition stats
+		addStat("prefix_saved_bytes",
+			s.partnInt64Stats(func(ss *IndexStats) int64 {
+				return ss.prefixSavedBytes.Value()
+			}))
+		// partition stats
 		addStat("frag_percent",
 			s.partnAvgInt64Stats(func(ss *IndexStats) int64 {
 				return ss.fragPercent.Value()
@@ -653,6 +694,8 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 			s.partnAvgInt64Stats(func(ss *IndexStats) int64 {
 				return ss.cacheHitPercent.Value()
 			}))
+		addStat("memory_quota", s.memoryQuota.Value())
+		addStat("ingestion_paused", s.ingestionPaused.Value())
 
 		addStat("timings/dcp_getseqs",
 			s.partnTimingStats(func(ss *IndexStats) *stats.TimingStat {
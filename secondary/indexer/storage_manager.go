@@ -194,6 +194,12 @@ func (s *storageMgr) handleSupvervisorCommands(cmd Message) {
 
 	case STORAGE_INDEX_PRUNE_SNAPSHOT:
 		s.handleIndexPruneSnapshot(cmd)
+
+	case STORAGE_INDEX_OPEN_SNAPSHOT:
+		s.handleIndexOpenSnapshot(cmd)
+
+	case STORAGE_INDEX_BACKUP_SNAPSHOT:
+		s.handleIndexBackupSnapshot(cmd)
 	}
 }
 
@@ -364,6 +370,7 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 							ss := &sliceSnapshot{
 								id:   slice.Id(),
 								snap: newSnapshot,
+								aggr: gAggrTables.snapshot(idxInstId, partnId, slice, newSnapshot, idxInst.Defn.Desc, needsCommit),
 							}
 							sliceSnaps[slice.Id()] = ss
 						} else {
@@ -372,6 +379,7 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 							ss := &sliceSnapshot{
 								id:   slice.Id(),
 								snap: latestSnapshot,
+								aggr: gAggrTables.snapshot(idxInstId, partnId, slice, latestSnapshot, idxInst.Defn.Desc, false),
 							}
 							sliceSnaps[slice.Id()] = ss
 							logging.Warnf("StorageMgr::handleCreateSnapshot Skipped Creating New Snapshot for Index %v "+
@@ -506,6 +514,9 @@ func (sm *storageMgr) handleRollback(cmd Message) {
 			idxInst.Stream == streamId &&
 			idxInst.State != common.INDEX_STATE_DELETED {
 
+			//aggregates are built again from the next snapshot
+			gAggrTables.reset(idxInstId)
+
 			//for all partitions managed by this indexer
 			for _, partnInst := range partnMap {
 				partnId := partnInst.Defn.GetPartitionId()
@@ -712,6 +723,8 @@ func (s *storageMgr) handleUpdateIndexPartnMap(cmd Message) {
 	indexPartnMap := cmd.(*MsgUpdatePartnMap).GetIndexPartnMap()
 	s.indexPartnMap = CopyIndexPartnMap(indexPartnMap)
 
+	gAggrTables.sync(s.indexInstMap, s.indexPartnMap)
+
 	s.supvCmdch <- &MsgSuccess{}
 }
 
@@ -789,8 +802,10 @@ func (s *storageMgr) handleStats(cmd Message) {
 		// This nil check is a workaround to avoid indexer crashes for now.
 		if idxStats != nil {
 			idxStats.diskSize.Set(st.Stats.DiskSize)
-			idxStats.memUsed.Set(st.Stats.MemUsed)
+			idxStats.memUsed.Set(st.Stats.MemUsed + gAggrTables.memUsed(st.InstId, st.PartnId))
 			idxStats.dataSize.Set(st.Stats.DataSize)
+			idxStats.prefixDictSize.Set(st.Stats.PrefixDictSize)
+			idxStats.prefixSavedBytes.Set(st.Stats.PrefixSavedBytes)
 			if common.GetStorageMode() != common.MOI {
 				idxStats.fragPercent.Set(int64(st.GetFragmentation()))
 			}
@@ -825,6 +840,8 @@ func (s *storageMgr) getIndexStorageStats() []IndexStorageStats {
 	var err error
 	var sts StorageStatistics
 
+	indexerStats := s.stats.Get()
+
 	for idxInstId, partnMap := range s.indexPartnMap {
 
 		inst, ok := s.indexInstMap[idxInstId]
@@ -837,6 +854,7 @@ func (s *storageMgr) getIndexStorageStats() []IndexStorageStats {
 			var internalData []string
 			var dataSz, memUsed, diskSz, extraSnapDataSize int64
 			var getBytes, insertBytes, deleteBytes int64
+			var prefixDictSz, prefixSavedBytes int64
 			var nslices int64
 			var needUpgrade = false
 
@@ -854,6 +872,8 @@ func (s *storageMgr) getIndexStorageStats() []IndexStorageStats {
 				getBytes += sts.GetBytes
 				insertBytes += sts.InsertBytes
 				deleteBytes += sts.DeleteBytes
+				prefixDictSz += sts.PrefixDictSize
+				prefixSavedBytes += sts.PrefixSavedBytes
 				extraSnapDataSize += sts.ExtraSnapDataSize
 				internalData = append(internalData, sts.InternalData...)
 
@@ -873,11 +893,18 @@ func (s *storageMgr) getIndexStorageStats() []IndexStorageStats {
 						GetBytes:          getBytes,
 						InsertBytes:       insertBytes,
 						DeleteBytes:       deleteBytes,
+						PrefixDictSize:    prefixDictSz,
+						PrefixSavedBytes:  prefixSavedBytes,
 						ExtraSnapDataSize: extraSnapDataSize,
 						NeedUpgrade:       needUpgrade,
 						InternalData:      internalData,
 					},
 				}
+				if indexerStats != nil {
+					if idxStats, ok := indexerStats.indexes[idxInstId]; ok {
+						stat.ScanRate = idxStats.avgScanRate.Value()
+					}
+				}
 
 				stats = append(stats, stat)
 			}
@@ -1049,6 +1076,155 @@ func (s *storageMgr) handleIndexPruneSnapshot(cmd Message) {
 	s.supvCmdch <- &MsgSuccess{}
 }
 
+//handleIndexOpenSnapshot opens the latest snapshot of indexes whose
+//data has been transferred from a peer indexer. If any slice has
+//no snapshot, or slices are on different vbucket branches, all the
+//indexes are rolled back to zero so that they can be built together
+//from scratch.
+func (s *storageMgr) handleIndexOpenSnapshot(cmd Message) {
+	req := cmd.(*MsgIndexOpenSnapshot)
+	respch := req.GetReplyChannel()
+
+	indexPartnMap := make(IndexPartnMap)
+	var tss []*common.TsVbuuid
+	complete := true
+
+	for _, instId := range req.GetInstIds() {
+		partnMap, ok := s.indexPartnMap[instId]
+		if !ok {
+			continue
+		}
+		indexPartnMap[instId] = partnMap
+
+		for partnId, partnInst := range partnMap {
+			for _, slice := range partnInst.Sc.GetAllSlices() {
+				infos, err := slice.GetSnapshots()
+				if err != nil {
+					logging.Errorf("StorageMgr::handleIndexOpenSnapshot Index: %v PartitionId: %v "+
+						"Error reading snapinfo %v", instId, partnId, err)
+					complete = false
+					continue
+				}
+				latest := NewSnapshotInfoContainer(infos).GetLatest()
+				if latest == nil {
+					complete = false
+					continue
+				}
+				tss = append(tss, latest.Timestamp())
+			}
+		}
+	}
+
+	restartTs := minRestartTs(tss)
+	if len(tss) > 0 && restartTs == nil {
+		logging.Errorf("StorageMgr::handleIndexOpenSnapshot Indexes %v have snapshots "+
+			"with mismatching vbuuids", req.GetInstIds())
+		complete = false
+	}
+
+	if len(tss) > 0 && !complete {
+		for instId, partnMap := range indexPartnMap {
+			for partnId, partnInst := range partnMap {
+				for _, slice := range partnInst.Sc.GetAllSlices() {
+					if err := slice.RollbackToZero(); err != nil {
+						logging.Errorf("StorageMgr::handleIndexOpenSnapshot Index: %v PartitionId: %v "+
+							"Error rollback to zero %v", instId, partnId, err)
+					}
+				}
+			}
+			gAggrTables.reset(instId)
+		}
+		restartTs = nil
+	}
+
+	if restartTs != nil {
+		s.updateIndexSnapMap(indexPartnMap, common.ALL_STREAMS, "")
+		logging.Infof("StorageMgr::handleIndexOpenSnapshot Opened snapshots for %v",
+			req.GetInstIds())
+	}
+
+	respch <- restartTs
+	s.supvCmdch <- &MsgSuccess{}
+}
+
+//minRestartTs returns the timestamp to restart a stream feeding all
+//the slices whose latest snapshot is at one of `tss`, that is the least
+//seqno of each vbucket across the snapshots. Returns nil if there are
+//no snapshots or if snapshots disagree on the vbuuid of a vbucket.
+func minRestartTs(tss []*common.TsVbuuid) *common.TsVbuuid {
+	if len(tss) == 0 {
+		return nil
+	}
+
+	restartTs := tss[0].Copy()
+	for _, ts := range tss[1:] {
+		if ts.Bucket != restartTs.Bucket || len(ts.Seqnos) != len(restartTs.Seqnos) {
+			return nil
+		}
+		for i, seqno := range ts.Seqnos {
+			if seqno > 0 && restartTs.Seqnos[i] > 0 &&
+				ts.Vbuuids[i] != restartTs.Vbuuids[i] {
+				return nil
+			}
+			if seqno < restartTs.Seqnos[i] {
+				restartTs.Seqnos[i] = seqno
+				restartTs.Vbuuids[i] = ts.Vbuuids[i]
+				restartTs.Snapshots[i] = ts.Snapshots[i]
+			}
+		}
+	}
+	restartTs.Crc64 = common.HashVbuuid(restartTs.Vbuuids)
+	return restartTs
+}
+
+//handleIndexBackupSnapshot returns the timestamp of the latest persisted
+//snapshot of each partition of active indexes. Partitions without any
+//persisted snapshot are skipped.
+func (s *storageMgr) handleIndexBackupSnapshot(cmd Message) {
+	req := cmd.(*MsgIndexBackupSnapshot)
+	respch := req.GetReplyChannel()
+	bucket := req.GetBucket()
+
+	var snapshots []indexBackupSnapshot
+	for instId, partnMap := range s.indexPartnMap {
+		inst, ok := s.indexInstMap[instId]
+		if !ok || inst.State != common.INDEX_STATE_ACTIVE || inst.IsProxy() {
+			continue
+		}
+		if bucket != "" && inst.Defn.Bucket != bucket {
+			continue
+		}
+		if req.GetInstId() != 0 && instId != req.GetInstId() {
+			continue
+		}
+
+		for partnId, partnInst := range partnMap {
+			if req.GetInstId() != 0 && partnId != req.GetPartitionId() {
+				continue
+			}
+			slice := partnInst.Sc.GetSliceById(0)
+			infos, err := slice.GetSnapshots()
+			if err != nil {
+				logging.Errorf("StorageMgr::handleIndexBackupSnapshot Index: %v PartitionId: %v "+
+					"Error reading snapinfo %v", instId, partnId, err)
+				continue
+			}
+			latest := NewSnapshotInfoContainer(infos).GetLatest()
+			if latest == nil {
+				continue
+			}
+			snapshots = append(snapshots, indexBackupSnapshot{
+				inst:    inst,
+				partnId: partnId,
+				ts:      latest.Timestamp().Copy(),
+			})
+		}
+	}
+
+	respch <- snapshots
+	s.supvCmdch <- &MsgSuccess{}
+}
+
 func (s *storageMgr) deepCloneIndexSnapshot(is IndexSnapshot, partnIds []common.PartitionId) IndexSnapshot {
 
 	snap := is.(*indexSnapshot)
@@ -1082,6 +1258,7 @@ func (s *storageMgr) deepCloneIndexSnapshot(is IndexSnapshot, partnIds []common.
 				ps.slices[sliceId] = &sliceSnapshot{
 					id:   sliceSnap.SliceId(),
 					snap: sliceSnap.Snapshot(),
+					aggr: sliceSnap.Aggregates(),
 				}
 			}
 
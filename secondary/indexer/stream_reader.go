@@ -456,6 +456,7 @@ type streamWorker struct {
 	snapType     uint32
 	snapStart    uint64
 	snapEnd      uint64
+	throttleDue  time.Duration //delay accumulated for build throttling
 
 	workerId int
 	streamId common.StreamId
@@ -490,6 +491,9 @@ func (w *streamWorker) start() {
 		case vb := <-w.workerch:
 			w.handleKeyVersions(vb.GetBucketname(), Vbucket(vb.GetVbucket()),
 				Vbuuid(vb.GetVbuuid()), vb.GetKvs())
+			if w.streamId == common.INIT_STREAM {
+				w.throttle(len(vb.GetKvs()))
+			}
 
 		case <-w.workerStopCh:
 			return
@@ -500,6 +504,35 @@ func (w *streamWorker) start() {
 
 }
 
+//throttle delays the worker for numKvs mutations as per the current
+//build throttle level. Delay is accumulated until it is long enough
+//to sleep for.
+func (w *streamWorker) throttle(numKvs int) {
+
+	delay := gBuildThrottle.Delay()
+	if delay == 0 {
+		w.throttleDue = 0
+		return
+	}
+
+	w.throttleDue += delay * time.Duration(numKvs)
+	if w.throttleDue < minThrottleSleep {
+		return
+	}
+
+	start := time.Now()
+	select {
+	case <-time.After(w.throttleDue):
+	case <-w.workerStopCh:
+	}
+	w.throttleDue = 0
+
+	stats := w.reader.stats.Get()
+	if stats != nil {
+		stats.buildThrottleDuration.Add(int64(time.Since(start)))
+	}
+}
+
 func (w *streamWorker) handleKeyVersions(bucket string, vbucket Vbucket, vbuuid Vbuuid,
 	kvs []*protobuf.KeyVersions) {
 
@@ -104,11 +104,17 @@ func NewTimekeeper(supvCmdch MsgChannel, supvRespch MsgChannel,
 //from it supervisor(indexer)
 func (tk *timekeeper) run() {
 
+	throttleTicker := time.NewTicker(throttleInterval(tk.config))
+	defer throttleTicker.Stop()
+
 	//main timekeeper loop
 loop:
 	for {
 		select {
 
+		case <-throttleTicker.C:
+			tk.updateBuildThrottle()
+
 		case cmd, ok := <-tk.supvCmdch:
 			if ok {
 				if cmd.GetMsgType() == TK_SHUTDOWN {
@@ -3180,3 +3186,58 @@ func (tk *timekeeper) setNeedsCommit(streamId common.StreamId,
 	}
 
 }
+
+//updateBuildThrottle computes the throttle level of INIT_STREAM from
+//the current memory, mutation queue and cpu pressure on indexer
+func (tk *timekeeper) updateBuildThrottle() {
+
+	stats := tk.stats.Get()
+	if stats == nil {
+		return
+	}
+
+	var level int64
+	var reason string
+
+	if tk.config["build.throttle.enabled"].Bool() && tk.hasActiveInitStream() {
+
+		gMemstatLock.RLock()
+		ms := gMemstatCache
+		gMemstatLock.RUnlock()
+		total, idle := memstatsMemoryUsed(&ms)
+		memQuota := tk.config["settings.memory_quota"].Uint64()
+
+		var queued int64
+		for _, bstats := range stats.buckets {
+			queued += bstats.mutationQueueSize.Value()
+		}
+
+		cpu := getCpuPercent() / float64(100*num_cpu_core)
+
+		level, reason = buildPressure(tk.config, total-idle, memQuota, queued, cpu)
+	}
+
+	prevLevel := gBuildThrottle.Level()
+	gBuildThrottle.set(level, throttleDelay(tk.config, level))
+	stats.buildThrottleLevel.Set(level)
+
+	if level != 0 && prevLevel == 0 {
+		logging.Infof("Timekeeper::updateBuildThrottle Throttling INIT_STREAM "+
+			"Level %v Reason %v", level, reason)
+	} else if level == 0 && prevLevel != 0 {
+		logging.Infof("Timekeeper::updateBuildThrottle Stopped throttling INIT_STREAM")
+	}
+}
+
+func (tk *timekeeper) hasActiveInitStream() bool {
+
+	tk.lock.RLock()
+	defer tk.lock.RUnlock()
+
+	for _, status := range tk.ss.streamBucketStatus[common.INIT_STREAM] {
+		if status == STREAM_ACTIVE {
+			return true
+		}
+	}
+	return false
+}
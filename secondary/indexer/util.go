@@ -69,9 +69,11 @@ func GetLocalIP() (net.IP, error) {
 	return nil, errors.New("cannot find local IP address")
 }
 
+// IndexPath is the file name of a partition of an index instance.  A proxy
+// shares the files of its real instance, except a proxy rebuilding it.
 func IndexPath(inst *common.IndexInst, partnId common.PartitionId, sliceId SliceId) string {
 	instId := inst.InstId
-	if inst.IsProxy() {
+	if inst.IsProxy() && !inst.Rebuild {
 		instId = inst.RealInstId
 	}
 	return fmt.Sprintf("%s_%s_%d_%d.index", inst.Defn.Bucket, inst.Defn.Name, instId, partnId)
@@ -0,0 +1,563 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+//////////////////////////////////////////////////////////////
+// Lifecycle Mgr - build queue
+//
+// Indexes can be queued for build on an indexer node, instead of
+// being built immediately.  Queued indexes are built in order of
+// priority (higher first), then in order of enqueue time, only
+// within their build window (if any), and subject to the number
+// of index builds allowed to run concurrently on the node.
+//
+// Pause stops queued indexes from being dispatched for build, either
+// for the whole queue or for individual indexes.  Builds that have
+// already been dispatched run to completion.  A build that fails, or
+// does not start, is retried with exponential backoff, and is given up
+// after a number of attempts until the index is queued again.  The
+// queue is persisted in the local metadata repository and survives
+// indexer restart.
+//////////////////////////////////////////////////////////////
+
+const (
+	BUILD_QUEUE_KEY = "BuildQueue"
+
+	BUILD_QUEUE_STATE_QUEUED   = "queued"
+	BUILD_QUEUE_STATE_BUILDING = "building"
+	BUILD_QUEUE_STATE_RETRY    = "retry"
+	BUILD_QUEUE_STATE_FAILED   = "failed"
+)
+
+// Dispatched build that does not start within this time has failed.
+const buildQueueStartTimeout = time.Minute * 5
+
+// Failed builds are retried after buildQueueRetryBackoff, doubled on
+// every failure up to buildQueueMaxRetryBackoff, and given up after
+// buildQueueMaxAttempts.
+const (
+	buildQueueRetryBackoff    = time.Minute * 5
+	buildQueueMaxRetryBackoff = time.Minute * 30
+	buildQueueMaxAttempts     = 5
+)
+
+type buildQueue struct {
+	manager *LifecycleMgr
+
+	mutex    sync.Mutex
+	once     sync.Once
+	paused   bool
+	entries  map[uint64]*client.BuildQueueEntry
+	progress map[string]float64 // bucket:index -> build progress
+}
+
+type buildQueueState struct {
+	Paused  bool                      `json:"paused,omitempty"`
+	Entries []*client.BuildQueueEntry `json:"entries,omitempty"`
+}
+
+func newBuildQueue(mgr *LifecycleMgr) *buildQueue {
+	return &buildQueue{
+		manager:  mgr,
+		entries:  make(map[uint64]*client.BuildQueueEntry),
+		progress: make(map[string]float64),
+	}
+}
+
+// load the persisted queue, once the metadata repository is available.
+func (q *buildQueue) load() {
+
+	q.once.Do(func() {
+		value, err := q.manager.repo.GetLocalValue(BUILD_QUEUE_KEY)
+		if err != nil || len(value) == 0 {
+			return
+		}
+
+		state := new(buildQueueState)
+		if err := json.Unmarshal([]byte(value), state); err != nil {
+			logging.Errorf("buildQueue: Unable to unmarshall build queue.  Error = %v.  Build queue is reset.", err)
+			return
+		}
+
+		q.paused = state.Paused
+		for _, entry := range state.Entries {
+			q.entries[entry.DefnId] = entry
+		}
+		logging.Infof("buildQueue: Loaded build queue with %v indexes, paused %v", len(q.entries), q.paused)
+	})
+}
+
+// save the queue to the local metadata repository.  Caller must hold the mutex.
+func (q *buildQueue) save() error {
+
+	state := &buildQueueState{Paused: q.paused}
+	for _, entry := range q.entries {
+		state.Entries = append(state.Entries, entry)
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := q.manager.repo.SetLocalValue(BUILD_QUEUE_KEY, string(buf)); err != nil {
+		logging.Errorf("buildQueue: Unable to persist build queue.  Error = %v", err)
+		return err
+	}
+	return nil
+}
+
+//
+// Handle build queue request.  This is called from the lifecycle manager
+// request processing loop, and returns the build queue status.
+//
+func (q *buildQueue) handleRequest(content []byte) ([]byte, error) {
+
+	request, err := client.UnmarshallBuildQueueRequest(content)
+	if err != nil {
+		logging.Errorf("buildQueue.handleRequest() : Unable to unmarshall request.  Reason = %v", err)
+		return nil, err
+	}
+
+	q.load()
+
+	if err := q.update(request); err != nil {
+		logging.Errorf("buildQueue.handleRequest() : %v request fails.  Reason = %v", request.Op, err)
+		return nil, err
+	}
+
+	return client.MarshallBuildQueueStatus(q.getStatus())
+}
+
+func (q *buildQueue) update(request *client.BuildQueueRequest) error {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	switch request.Op {
+	case client.BUILD_QUEUE_LIST:
+		return nil
+
+	case client.BUILD_QUEUE_ENQUEUE:
+		for _, id := range request.DefnIds {
+			if err := q.enqueue(id, request.Priority, request.Window); err != nil {
+				return err
+			}
+		}
+
+	case client.BUILD_QUEUE_PAUSE, client.BUILD_QUEUE_RESUME:
+		paused := request.Op == client.BUILD_QUEUE_PAUSE
+		if len(request.DefnIds) == 0 {
+			q.paused = paused
+		}
+		for _, id := range request.DefnIds {
+			if entry, ok := q.entries[id]; ok {
+				entry.Paused = paused
+			}
+		}
+
+	case client.BUILD_QUEUE_CANCEL:
+		for _, id := range request.DefnIds {
+			if entry, ok := q.entries[id]; ok {
+				if entry.State == BUILD_QUEUE_STATE_BUILDING {
+					return fmt.Errorf("Index %v is being built and cannot be removed from build queue.", entry.Name)
+				}
+				delete(q.entries, id)
+				logging.Infof("buildQueue: Removed index (%v, %v) from build queue", entry.Bucket, entry.Name)
+			}
+		}
+
+	case client.BUILD_QUEUE_PRIORITY:
+		for _, id := range request.DefnIds {
+			if entry, ok := q.entries[id]; ok {
+				entry.Priority = request.Priority
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unknown build queue operation %v", request.Op)
+	}
+
+	return q.save()
+}
+
+// enqueue index `id`, or update the priority and window of a queued
+// index.  Caller must hold the mutex.
+func (q *buildQueue) enqueue(id uint64, priority int, window *client.BuildWindow) error {
+
+	defn, err := q.manager.repo.GetIndexDefnById(common.IndexDefnId(id))
+	if err != nil {
+		return err
+	}
+	if defn == nil {
+		return fmt.Errorf("Index %v not found", id)
+	}
+
+	insts, err := q.manager.FindAllLocalIndexInst(defn.Bucket, defn.DefnId)
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return fmt.Errorf("Index %v is not hosted by this node", defn.Name)
+	}
+	for _, inst := range insts {
+		if inst.State != uint32(common.INDEX_STATE_READY) {
+			return fmt.Errorf("Index %v is not in deferred state and cannot be queued for build.", defn.Name)
+		}
+	}
+
+	if entry, ok := q.entries[id]; ok {
+		entry.Priority = priority
+		entry.Window = window
+		if entry.State == BUILD_QUEUE_STATE_FAILED || entry.State == BUILD_QUEUE_STATE_RETRY {
+			entry.State, entry.Attempts, entry.RetryAt, entry.Error = BUILD_QUEUE_STATE_QUEUED, 0, 0, ""
+		}
+		return nil
+	}
+
+	q.entries[id] = &client.BuildQueueEntry{
+		DefnId:   id,
+		Bucket:   defn.Bucket,
+		Name:     defn.Name,
+		Priority: priority,
+		Window:   window,
+		State:    BUILD_QUEUE_STATE_QUEUED,
+		Enqueued: time.Now().UnixNano(),
+	}
+	logging.Infof("buildQueue: Queued index (%v, %v) for build with priority %v, window %v",
+		defn.Bucket, defn.Name, priority, window)
+
+	return nil
+}
+
+// getStatus return the queue in dispatch order.
+func (q *buildQueue) getStatus() *client.BuildQueueStatus {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	status := &client.BuildQueueStatus{
+		Paused:        q.paused,
+		MaxConcurrent: int(q.manager.builder.maxConcurrentBuilds()),
+	}
+	if indexerId, err := q.manager.repo.GetLocalIndexerId(); err == nil {
+		status.IndexerId = string(indexerId)
+	}
+
+	for _, entry := range q.sorted() {
+		e := *entry
+		if e.State == BUILD_QUEUE_STATE_BUILDING {
+			e.Progress = q.progress[e.Bucket+":"+e.Name]
+		}
+		status.Entries = append(status.Entries, &e)
+	}
+
+	return status
+}
+
+// sorted entries, by descending priority and then enqueue time.
+// Caller must hold the mutex.
+func (q *buildQueue) sorted() []*client.BuildQueueEntry {
+
+	entries := make([]*client.BuildQueueEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].Enqueued < entries[j].Enqueued
+	})
+	return entries
+}
+
+// updateProgress from the stats broadcast by indexer.
+func (q *buildQueue) updateProgress(stats common.Statistics) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.entries) == 0 {
+		return
+	}
+
+	for key, value := range stats {
+		if strings.HasSuffix(key, ":build_progress") {
+			if progress, ok := value.(float64); ok {
+				q.progress[strings.TrimSuffix(key, ":build_progress")] = progress
+			}
+		}
+	}
+}
+
+func (q *buildQueue) run() {
+
+	q.load()
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.refresh()
+			q.dispatch()
+
+		case <-q.manager.killch:
+			logging.Infof("buildQueue: Build queue terminates.")
+			return
+		}
+	}
+}
+
+//
+// refresh removes entries of indexes that are dropped or built, and queues
+// again the entries whose build has not started after dispatch.
+//
+func (q *buildQueue) refresh() {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	changed := false
+	for id, entry := range q.entries {
+
+		defn, err := q.manager.repo.GetIndexDefnById(common.IndexDefnId(id))
+		if err != nil {
+			continue
+		}
+
+		insts, err := q.manager.FindAllLocalIndexInst(entry.Bucket, common.IndexDefnId(id))
+		if err != nil {
+			continue
+		}
+
+		if defn == nil || len(insts) == 0 {
+			logging.Infof("buildQueue: Index (%v, %v) no longer exists.  Removed from build queue.", entry.Bucket, entry.Name)
+			delete(q.entries, id)
+			changed = true
+			continue
+		}
+
+		ready, built := 0, 0
+		for _, inst := range insts {
+			if inst.State == uint32(common.INDEX_STATE_READY) && !inst.Scheduled {
+				ready++
+			} else if inst.State == uint32(common.INDEX_STATE_ACTIVE) {
+				built++
+			}
+		}
+
+		if built == len(insts) {
+			logging.Infof("buildQueue: Index (%v, %v) is built.  Removed from build queue.", entry.Bucket, entry.Name)
+			delete(q.entries, id)
+			delete(q.progress, entry.Bucket+":"+entry.Name)
+			changed = true
+
+		} else if entry.State == BUILD_QUEUE_STATE_BUILDING && ready == len(insts) &&
+			time.Since(time.Unix(0, entry.Started)) > buildQueueStartTimeout {
+
+			reason := "build did not start"
+			for _, inst := range insts {
+				if inst.Error != "" {
+					reason = inst.Error
+				}
+			}
+			retryBuild(entry, reason, time.Now())
+			changed = true
+		}
+	}
+
+	if changed {
+		q.save()
+	}
+}
+
+//
+// dispatch the queued indexes that can be built now.  Indexes of a bucket
+// are built together in a single build request, and only one bucket can
+// be built at a time.
+//
+func (q *buildQueue) dispatch() {
+
+	// batch size of -1 is no limit
+	quota, building := q.manager.builder.getQuota()
+	limited := atomic.LoadInt32(&q.manager.builder.batchSize) >= 0 ||
+		q.manager.builder.maxConcurrentBuilds() > 0
+	if limited && quota <= 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	if q.paused {
+		q.mutex.Unlock()
+		return
+	}
+
+	numInsts := func(entry *client.BuildQueueEntry) (int, error) {
+		insts, err := q.manager.FindAllLocalIndexInst(entry.Bucket, common.IndexDefnId(entry.DefnId))
+		return len(insts), err
+	}
+	buckets, buildMap := selectBuilds(q.sorted(), time.Now(), limited, quota,
+		len(building) != 0, q.manager.canBuildIndex, numInsts)
+	q.mutex.Unlock()
+
+	for _, bucket := range buckets {
+
+		idList := &client.IndexIdList{DefnIds: buildMap[bucket]}
+		key := fmt.Sprintf("%d", idList.DefnIds[0])
+		content, err := client.MarshallIndexIdList(idList)
+		if err != nil {
+			logging.Warnf("buildQueue: Failed to marshall index defnIds during index build.  Error = %v. Retry later.", err)
+			continue
+		}
+
+		logging.Infof("buildQueue: Build index for bucket %v. Index %v", bucket, idList)
+
+		// Mark the entries before making the request, so that the entries are not
+		// dispatched again while the request is processed.
+		q.setState(idList.DefnIds, BUILD_QUEUE_STATE_BUILDING)
+
+		// Build failure due to recoverable error will be retried by builder.
+		if err := q.manager.requestServer.MakeRequest(client.OPCODE_BUILD_INDEX_RETRY, key, content); err != nil {
+			logging.Warnf("buildQueue: Failed to build index.  Error = %v.", err)
+			q.setFailed(idList.DefnIds, err.Error())
+		}
+	}
+}
+
+// selectBuilds picks the entries to dispatch, in the given order, from a
+// single bucket.  When the builds are limited, an entry counts one unit of
+// quota for each of its local instances, and an entry that does not fit in
+// the remaining quota is skipped.  Nevertheless an entry that exceeds the
+// whole quota is dispatched alone if nothing is building, otherwise it
+// would never be built.
+func selectBuilds(entries []*client.BuildQueueEntry, now time.Time, limited bool,
+	quota int32, building bool, canBuild func(bucket string) bool,
+	numInsts func(entry *client.BuildQueueEntry) (int, error)) ([]string, map[string][]uint64) {
+
+	buildMap := make(map[string][]uint64)
+	buckets := ([]string)(nil)
+
+	for _, entry := range entries {
+		if limited && quota <= 0 {
+			break
+		}
+
+		if !canDispatch(entry, now) || entry.Paused || !entry.Window.IsOpen(now) {
+			continue
+		}
+
+		_, ok := buildMap[entry.Bucket]
+		if !ok && (len(buckets) != 0 || !canBuild(entry.Bucket)) {
+			continue
+		}
+
+		n, err := numInsts(entry)
+		if err != nil {
+			continue
+		}
+
+		if limited && int32(n) > quota && (building || len(buckets) != 0) {
+			continue
+		}
+
+		if !ok {
+			buckets = append(buckets, entry.Bucket)
+		}
+		buildMap[entry.Bucket] = append(buildMap[entry.Bucket], entry.DefnId)
+		quota = quota - int32(n)
+	}
+
+	return buckets, buildMap
+}
+
+// canDispatch returns true if entry is queued, or is due for retry.
+func canDispatch(entry *client.BuildQueueEntry, now time.Time) bool {
+	switch entry.State {
+	case BUILD_QUEUE_STATE_QUEUED:
+		return true
+	case BUILD_QUEUE_STATE_RETRY:
+		return now.UnixNano() >= entry.RetryAt
+	}
+	return false
+}
+
+// retryBuild of entry whose build failed for `reason`, after a backoff,
+// or give up after buildQueueMaxAttempts.
+func retryBuild(entry *client.BuildQueueEntry, reason string, now time.Time) {
+
+	entry.Attempts++
+	entry.Started = 0
+	entry.Error = reason
+
+	if entry.Attempts >= buildQueueMaxAttempts {
+		logging.Errorf("buildQueue: Build of index (%v, %v) failed %v times.  Error = %v.  Index has to be queued again.",
+			entry.Bucket, entry.Name, entry.Attempts, reason)
+		entry.State = BUILD_QUEUE_STATE_FAILED
+		entry.RetryAt = 0
+		return
+	}
+
+	backoff := buildQueueRetryBackoff << uint(entry.Attempts-1)
+	if backoff > buildQueueMaxRetryBackoff {
+		backoff = buildQueueMaxRetryBackoff
+	}
+	logging.Warnf("buildQueue: Build of index (%v, %v) failed.  Error = %v.  Retry in %v.",
+		entry.Bucket, entry.Name, reason, backoff)
+	entry.State = BUILD_QUEUE_STATE_RETRY
+	entry.RetryAt = now.Add(backoff).UnixNano()
+}
+
+func (q *buildQueue) setFailed(defnIds []uint64, reason string) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	for _, id := range defnIds {
+		if entry, ok := q.entries[id]; ok && entry.State == BUILD_QUEUE_STATE_BUILDING {
+			retryBuild(entry, reason, now)
+		}
+	}
+	q.save()
+}
+
+func (q *buildQueue) setState(defnIds []uint64, state string) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, id := range defnIds {
+		if entry, ok := q.entries[id]; ok {
+			entry.State = state
+			if state == BUILD_QUEUE_STATE_BUILDING {
+				entry.Started = time.Now().UnixNano()
+			}
+		}
+	}
+	q.save()
+}
@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+func TestBuildQueueSorted(t *testing.T) {
+	q := &buildQueue{entries: map[uint64]*client.BuildQueueEntry{
+		1: {DefnId: 1, Priority: 0, Enqueued: 10},
+		2: {DefnId: 2, Priority: 5, Enqueued: 30},
+		3: {DefnId: 3, Priority: 5, Enqueued: 20},
+		4: {DefnId: 4, Priority: 0, Enqueued: 5},
+	}}
+
+	expected := []uint64{3, 2, 4, 1}
+	entries := q.sorted()
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %v entries, got %v", len(expected), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.DefnId != expected[i] {
+			t.Errorf("entry %v: expected index %v, got %v", i, expected[i], entry.DefnId)
+		}
+	}
+}
+
+func TestBuildQueueRetry(t *testing.T) {
+	now := time.Now()
+	entry := &client.BuildQueueEntry{DefnId: 1, State: BUILD_QUEUE_STATE_BUILDING, Started: now.UnixNano()}
+
+	backoffs := []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 30 * time.Minute}
+	for i, backoff := range backoffs {
+		retryBuild(entry, "build failed", now)
+		if entry.State != BUILD_QUEUE_STATE_RETRY || entry.Attempts != i+1 ||
+			entry.Started != 0 || entry.Error != "build failed" {
+			t.Fatalf("attempt %v: unexpected entry %+v", i+1, entry)
+		}
+		if retryAt := time.Unix(0, entry.RetryAt); !retryAt.Equal(now.Add(backoff)) {
+			t.Errorf("attempt %v: expected retry after %v, got %v", i+1, backoff, retryAt.Sub(now))
+		}
+		if canDispatch(entry, now) {
+			t.Errorf("attempt %v: expected no dispatch before backoff", i+1)
+		}
+		if !canDispatch(entry, now.Add(backoff)) {
+			t.Errorf("attempt %v: expected dispatch after backoff", i+1)
+		}
+		entry.State = BUILD_QUEUE_STATE_BUILDING
+	}
+
+	retryBuild(entry, "build failed", now)
+	if entry.State != BUILD_QUEUE_STATE_FAILED || entry.Attempts != buildQueueMaxAttempts {
+		t.Fatalf("expected build to fail after %v attempts, got %+v", buildQueueMaxAttempts, entry)
+	}
+	if canDispatch(entry, now.Add(24*time.Hour)) {
+		t.Errorf("expected failed build not to be dispatched")
+	}
+}
+
+func TestBuildQueueSelect(t *testing.T) {
+	now := time.Now()
+	queued := func(id uint64, bucket string) *client.BuildQueueEntry {
+		return &client.BuildQueueEntry{DefnId: id, Bucket: bucket, State: BUILD_QUEUE_STATE_QUEUED}
+	}
+	insts := map[uint64]int{1: 1, 2: 8, 3: 2, 4: 1}
+	numInsts := func(entry *client.BuildQueueEntry) (int, error) {
+		return insts[entry.DefnId], nil
+	}
+	canBuild := func(bucket string) bool { return true }
+
+	tests := []struct {
+		name     string
+		entries  []*client.BuildQueueEntry
+		limited  bool
+		quota    int32
+		building bool
+		expected []uint64
+	}{
+		{"unlimited", []*client.BuildQueueEntry{queued(1, "a"), queued(2, "a"), queued(3, "a")},
+			false, -1, true, []uint64{1, 2, 3}},
+		{"skip partitioned over quota", []*client.BuildQueueEntry{queued(2, "a"), queued(3, "a"), queued(4, "a")},
+			true, 3, true, []uint64{3, 4}},
+		{"partitioned alone when idle", []*client.BuildQueueEntry{queued(2, "a"), queued(3, "a")},
+			true, 4, false, []uint64{2}},
+		{"partitioned after others when idle", []*client.BuildQueueEntry{queued(1, "a"), queued(2, "a"), queued(4, "a")},
+			true, 4, false, []uint64{1, 4}},
+		{"single bucket", []*client.BuildQueueEntry{queued(1, "a"), queued(3, "b"), queued(4, "a")},
+			true, 4, false, []uint64{1, 4}},
+		{"skipped bucket", []*client.BuildQueueEntry{queued(2, "a"), queued(3, "b")},
+			true, 2, true, []uint64{3}},
+	}
+
+	for _, test := range tests {
+		buckets, buildMap := selectBuilds(test.entries, now, test.limited, test.quota, test.building, canBuild, numInsts)
+		if len(buckets) != 1 {
+			t.Errorf("%v: expected a single bucket, got %v", test.name, buckets)
+			continue
+		}
+		if !reflect.DeepEqual(buildMap[buckets[0]], test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, buildMap[buckets[0]])
+		}
+	}
+}
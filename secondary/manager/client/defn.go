@@ -11,10 +11,14 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/couchbase/gometa/common"
 	c "github.com/couchbase/indexing/secondary/common"
 	logging "github.com/couchbase/indexing/secondary/logging"
 	mc "github.com/couchbase/indexing/secondary/manager/common"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 /////////////////////////////////////////////////////////////////////////
@@ -44,6 +48,12 @@ const (
 	OPCODE_COMMIT_CREATE_INDEX                    = OPCODE_PREPARE_CREATE_INDEX + 1
 	OPCODE_REBALANCE_RUNNING                      = OPCODE_COMMIT_CREATE_INDEX + 1
 	OPCODE_CREATE_INDEX_DEFER_BUILD               = OPCODE_REBALANCE_RUNNING + 1
+	OPCODE_BUILD_QUEUE                            = OPCODE_CREATE_INDEX_DEFER_BUILD + 1
+	OPCODE_UPDATE_AGGREGATE                       = OPCODE_BUILD_QUEUE + 1
+	OPCODE_CREATE_INDEX_REBUILD                   = OPCODE_UPDATE_AGGREGATE + 1
+	OPCODE_SWAP_INDEX_INST                        = OPCODE_CREATE_INDEX_REBUILD + 1
+	OPCODE_UPDATE_MEM_QUOTA                       = OPCODE_SWAP_INDEX_INST + 1
+	OPCODE_DDL_REQUESTER                          = OPCODE_UPDATE_MEM_QUOTA + 1
 )
 
 /////////////////////////////////////////////////////////////////////////
@@ -107,12 +117,307 @@ type CommitCreateRequest struct {
 	DefnId      c.IndexDefnId                 `json:"defnId,omitempty"`
 	RequesterId string                        `json:"requesterId,omitempty"`
 	Definitions map[c.IndexerId][]c.IndexDefn `json:"definitions,omitempty"`
+	Requester   *DDLRequester                 `json:"requester,omitempty"`
 }
 
 type CommitCreateResponse struct {
 	Accept bool `json:"accept,omitempty"`
 }
 
+/////////////////////////////////////////////////////////////////////////
+// Build Queue
+////////////////////////////////////////////////////////////////////////
+
+type BuildQueueOp string
+
+const (
+	BUILD_QUEUE_ENQUEUE  BuildQueueOp = "enqueue"
+	BUILD_QUEUE_PAUSE    BuildQueueOp = "pause"
+	BUILD_QUEUE_RESUME   BuildQueueOp = "resume"
+	BUILD_QUEUE_CANCEL   BuildQueueOp = "cancel"
+	BUILD_QUEUE_PRIORITY BuildQueueOp = "priority"
+	BUILD_QUEUE_LIST     BuildQueueOp = "list"
+)
+
+// BuildQueueRequest operates on the build queue of an indexer.  Pause
+// and resume without DefnIds applies to the whole queue.
+type BuildQueueRequest struct {
+	Op       BuildQueueOp `json:"op,omitempty"`
+	DefnIds  []uint64     `json:"defnIds,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	Window   *BuildWindow `json:"window,omitempty"`
+}
+
+// BuildWindow is the time of day, in the local time of indexer node,
+// during which a queued index can be built.  Window can wrap around
+// midnight, e.g. 22:00-02:00.
+type BuildWindow struct {
+	Start string `json:"start,omitempty"` // HH:MM
+	End   string `json:"end,omitempty"`   // HH:MM
+}
+
+type BuildQueueEntry struct {
+	DefnId   uint64       `json:"defnId,omitempty"`
+	Bucket   string       `json:"bucket,omitempty"`
+	Name     string       `json:"name,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	Window   *BuildWindow `json:"window,omitempty"`
+	State    string       `json:"state,omitempty"`
+	Paused   bool         `json:"paused,omitempty"`
+	Enqueued int64        `json:"enqueued,omitempty"`
+	Started  int64        `json:"started,omitempty"`
+	Progress float64      `json:"progress,omitempty"`
+	Attempts int          `json:"attempts,omitempty"` // failed builds
+	RetryAt  int64        `json:"retryAt,omitempty"`  // next build after failure
+	Error    string       `json:"error,omitempty"`    // error of last failed build
+}
+
+type BuildQueueStatus struct {
+	IndexerId     string             `json:"indexerId,omitempty"`
+	NodeAddr      string             `json:"nodeAddr,omitempty"`
+	Paused        bool               `json:"paused,omitempty"`
+	MaxConcurrent int                `json:"maxConcurrent,omitempty"`
+	Entries       []*BuildQueueEntry `json:"entries,omitempty"`
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Aggregates
+////////////////////////////////////////////////////////////////////////
+
+type AggregateOp string
+
+const (
+	AGGREGATE_CREATE AggregateOp = "create"
+	AGGREGATE_DROP   AggregateOp = "drop"
+)
+
+// AggregateRequest creates or drops a precomputed group aggregate of
+// an index.  Drop only requires the name of the aggregate.
+type AggregateRequest struct {
+	Op        AggregateOp       `json:"op,omitempty"`
+	DefnId    c.IndexDefnId     `json:"defnId,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Aggregate *c.IndexAggregate `json:"aggregate,omitempty"`
+}
+
+// MemQuotaRequest sets the memory quota (bytes) and priority of a
+// memory optimized index.  A zero quota removes the quota.
+type MemQuotaRequest struct {
+	DefnId   c.IndexDefnId   `json:"defnId,omitempty"`
+	MemQuota uint64          `json:"memQuota,omitempty"`
+	Priority c.IndexPriority `json:"priority,omitempty"`
+}
+
+/////////////////////////////////////////////////////////////////////////
+// DDL History
+////////////////////////////////////////////////////////////////////////
+
+type DDLEvent string
+
+const (
+	DDL_EVENT_CREATE  DDLEvent = "create"
+	DDL_EVENT_BUILD   DDLEvent = "build"
+	DDL_EVENT_DROP    DDLEvent = "drop"
+	DDL_EVENT_MOVE    DDLEvent = "move"
+	DDL_EVENT_ALTER   DDLEvent = "alter"
+	DDL_EVENT_REBUILD DDLEvent = "rebuild"
+)
+
+// DDLHistoryEntry records a DDL event processed by an indexer node.
+// Before and After are the index definitions on that node before and
+// after the event.  User and Source are known for requests made
+// through the REST API, and for requests from the metadata client that
+// carry a DDLRequester.  Requests from the metadata client also carry
+// the id of the client in RequesterId.
+type DDLHistoryEntry struct {
+	Seqno       uint64        `json:"seqno,omitempty"`
+	Timestamp   int64         `json:"timestamp,omitempty"`
+	Event       DDLEvent      `json:"event,omitempty"`
+	DefnId      c.IndexDefnId `json:"defnId,omitempty"`
+	Bucket      string        `json:"bucket,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	User        string        `json:"user,omitempty"`
+	Source      string        `json:"source,omitempty"`
+	RequesterId string        `json:"requesterId,omitempty"`
+	Node        string        `json:"node,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Before      *c.IndexDefn  `json:"before,omitempty"`
+	After       *c.IndexDefn  `json:"after,omitempty"`
+}
+
+// DDLRequester identifies the user of a DDL request made through the
+// metadata client.  It is sent to the indexer nodes ahead of the
+// request on indexes DefnIds.
+type DDLRequester struct {
+	DefnIds []c.IndexDefnId `json:"defnIds,omitempty"`
+	User    string          `json:"user,omitempty"`
+	Source  string          `json:"source,omitempty"`
+}
+
+// DDLHistoryRequest selects a page of DDL history, newest first.
+// Empty fields match all entries.
+type DDLHistoryRequest struct {
+	Bucket string        `json:"bucket,omitempty"`
+	Name   string        `json:"name,omitempty"`
+	DefnId c.IndexDefnId `json:"defnId,omitempty"`
+	Event  DDLEvent      `json:"event,omitempty"`
+	Offset int           `json:"offset,omitempty"`
+	Limit  int           `json:"limit,omitempty"`
+}
+
+type DDLHistoryResponse struct {
+	Code        string             `json:"code,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	FailedNodes []string           `json:"failedNodes,omitempty"`
+	Total       int                `json:"total"`
+	Offset      int                `json:"offset"`
+	Entries     []*DDLHistoryEntry `json:"entries,omitempty"`
+}
+
+func (r *DDLHistoryRequest) Match(entry *DDLHistoryEntry) bool {
+	if len(r.Bucket) != 0 && r.Bucket != entry.Bucket {
+		return false
+	}
+	if len(r.Name) != 0 && r.Name != entry.Name {
+		return false
+	}
+	if r.DefnId != 0 && r.DefnId != entry.DefnId {
+		return false
+	}
+	if len(r.Event) != 0 && r.Event != entry.Event {
+		return false
+	}
+	return true
+}
+
+// Values encodes the request as url query parameters.
+func (r *DDLHistoryRequest) Values() url.Values {
+	values := url.Values{}
+	if len(r.Bucket) != 0 {
+		values.Set("bucket", r.Bucket)
+	}
+	if len(r.Name) != 0 {
+		values.Set("index", r.Name)
+	}
+	if r.DefnId != 0 {
+		values.Set("defnId", fmt.Sprintf("%v", r.DefnId))
+	}
+	if len(r.Event) != 0 {
+		values.Set("event", string(r.Event))
+	}
+	if r.Offset != 0 {
+		values.Set("offset", strconv.Itoa(r.Offset))
+	}
+	if r.Limit != 0 {
+		values.Set("limit", strconv.Itoa(r.Limit))
+	}
+	return values
+}
+
+func ParseDDLHistoryRequest(values url.Values) (*DDLHistoryRequest, error) {
+
+	request := &DDLHistoryRequest{
+		Bucket: values.Get("bucket"),
+		Name:   values.Get("index"),
+		Event:  DDLEvent(values.Get("event")),
+	}
+
+	if v := values.Get("defnId"); len(v) != 0 {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid defnId %v", v)
+		}
+		request.DefnId = c.IndexDefnId(id)
+	}
+
+	if v := values.Get("offset"); len(v) != 0 {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid offset %v", v)
+		}
+		request.Offset = offset
+	}
+
+	if v := values.Get("limit"); len(v) != 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("Invalid limit %v", v)
+		}
+		request.Limit = limit
+	}
+
+	switch request.Event {
+	case "", DDL_EVENT_CREATE, DDL_EVENT_BUILD, DDL_EVENT_DROP, DDL_EVENT_MOVE, DDL_EVENT_ALTER, DDL_EVENT_REBUILD:
+	default:
+		return nil, fmt.Errorf("Invalid event %v", request.Event)
+	}
+
+	return request, nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Scan Workload
+////////////////////////////////////////////////////////////////////////
+
+// ScanShape is the anonymized shape of scans on an index instance.
+// Equality and Range are the positions of index keys filtered on, and
+// Projection the positions of the keys returned, nil if all keys are
+// returned.  Filter values are not recorded.
+type ScanShape struct {
+	DefnId     c.IndexDefnId `json:"defnId,omitempty"`
+	InstId     c.IndexInstId `json:"instId,omitempty"`
+	Bucket     string        `json:"bucket,omitempty"`
+	Name       string        `json:"name,omitempty"`
+	Equality   []int         `json:"equality,omitempty"`
+	Range      []int         `json:"range,omitempty"`
+	Projection []int         `json:"projection"`
+	Limit      bool          `json:"limit,omitempty"`
+	GroupAggr  bool          `json:"groupAggr,omitempty"`
+	Count      uint64        `json:"count"`
+}
+
+type ScanWorkloadResponse struct {
+	Code   string       `json:"code,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Shapes []*ScanShape `json:"shapes,omitempty"`
+}
+
+type RecommendationType string
+
+const (
+	RECOMMEND_COVERING  RecommendationType = "covering"
+	RECOMMEND_REORDER   RecommendationType = "reorder"
+	RECOMMEND_REDUNDANT RecommendationType = "redundant"
+	RECOMMEND_REPLICA   RecommendationType = "replica"
+)
+
+// IndexRecommendation suggests an index to add (covering, reorder) or
+// to remove (redundant, replica).  ScanShare is the share of scans of
+// the index with the shape, or served by the replica, behind the
+// recommendation.  For a redundant index, it is its share of the scans
+// of both indexes.  MemUsage and DataSize are the estimated size of the
+// index to add, or the estimated saving of the index to remove.
+type IndexRecommendation struct {
+	Type      RecommendationType `json:"type"`
+	Bucket    string             `json:"bucket"`
+	Name      string             `json:"name"`
+	DefnId    c.IndexDefnId      `json:"defnId"`
+	ReplicaId int                `json:"replicaId,omitempty"`
+	SecExprs  []string           `json:"secExprs,omitempty"`
+	Statement string             `json:"statement,omitempty"`
+	Reason    string             `json:"reason"`
+	ScanShare float64            `json:"scanShare"`
+	MemUsage  uint64             `json:"memUsage"`
+	DataSize  uint64             `json:"dataSize"`
+}
+
+type IndexRecommendationResponse struct {
+	Code            string                 `json:"code,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+	FailedNodes     []string               `json:"failedNodes,omitempty"`
+	Recommendations []*IndexRecommendation `json:"recommendations,omitempty"`
+}
+
 /////////////////////////////////////////////////////////////////////////
 // marshalling/unmarshalling
 ////////////////////////////////////////////////////////////////////////
@@ -309,3 +614,158 @@ func MarshallCommitCreateResponse(commitCreateResponse *CommitCreateResponse) ([
 
 	return buf, nil
 }
+
+func UnmarshallBuildQueueRequest(data []byte) (*BuildQueueRequest, error) {
+
+	request := new(BuildQueueRequest)
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func MarshallBuildQueueRequest(request *BuildQueueRequest) ([]byte, error) {
+
+	buf, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func UnmarshallBuildQueueStatus(data []byte) (*BuildQueueStatus, error) {
+
+	status := new(BuildQueueStatus)
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func MarshallBuildQueueStatus(status *BuildQueueStatus) ([]byte, error) {
+
+	buf, err := json.Marshal(&status)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func UnmarshallAggregateRequest(data []byte) (*AggregateRequest, error) {
+
+	request := new(AggregateRequest)
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func MarshallAggregateRequest(request *AggregateRequest) ([]byte, error) {
+
+	buf, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func UnmarshallMemQuotaRequest(data []byte) (*MemQuotaRequest, error) {
+
+	request := new(MemQuotaRequest)
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func MarshallMemQuotaRequest(request *MemQuotaRequest) ([]byte, error) {
+
+	buf, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func UnmarshallDDLRequester(data []byte) (*DDLRequester, error) {
+
+	requester := new(DDLRequester)
+	if err := json.Unmarshal(data, requester); err != nil {
+		return nil, err
+	}
+
+	return requester, nil
+}
+
+func MarshallDDLRequester(requester *DDLRequester) ([]byte, error) {
+
+	buf, err := json.Marshal(&requester)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Build Window
+////////////////////////////////////////////////////////////////////////
+
+// ParseBuildWindow parses window of the form "HH:MM-HH:MM".
+func ParseBuildWindow(window string) (*BuildWindow, error) {
+
+	var sh, sm, eh, em int
+	if n, err := fmt.Sscanf(window, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil || n != 4 {
+		return nil, fmt.Errorf("Invalid build window %q, expected HH:MM-HH:MM", window)
+	}
+	if sh < 0 || sh > 23 || eh < 0 || eh > 23 || sm < 0 || sm > 59 || em < 0 || em > 59 {
+		return nil, fmt.Errorf("Invalid build window %q, expected HH:MM-HH:MM", window)
+	}
+	if sh == eh && sm == em {
+		return nil, fmt.Errorf("Invalid build window %q, start and end are the same", window)
+	}
+
+	return &BuildWindow{
+		Start: fmt.Sprintf("%02d:%02d", sh, sm),
+		End:   fmt.Sprintf("%02d:%02d", eh, em),
+	}, nil
+}
+
+func (w *BuildWindow) minutes(hhmm string) int {
+	var h, m int
+	fmt.Sscanf(hhmm, "%d:%d", &h, &m)
+	return h*60 + m
+}
+
+// IsOpen returns true if `now` falls within the window.  A nil window
+// is always open.
+func (w *BuildWindow) IsOpen(now time.Time) bool {
+
+	if w == nil {
+		return true
+	}
+
+	start, end := w.minutes(w.Start), w.minutes(w.End)
+	cur := now.Hour()*60 + now.Minute()
+
+	if start <= end {
+		return cur >= start && cur < end
+	}
+	// window wraps around midnight
+	return cur >= start || cur < end
+}
+
+func (w *BuildWindow) String() string {
+	if w == nil {
+		return ""
+	}
+	return w.Start + "-" + w.End
+}
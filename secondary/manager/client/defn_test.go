@@ -0,0 +1,68 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBuildWindow(t *testing.T) {
+	valid := map[string]string{
+		"01:30-05:00": "01:30-05:00",
+		"1:5-23:59":   "01:05-23:59",
+		"22:00-02:00": "22:00-02:00",
+	}
+	for window, expected := range valid {
+		w, err := ParseBuildWindow(window)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", window, err)
+		} else if w.String() != expected {
+			t.Errorf("%v: expected %v, got %v", window, expected, w)
+		}
+	}
+
+	invalid := []string{"", "01:00", "0100-0200", "24:00-01:00", "01:60-02:00", "-1:00-02:00", "03:00-03:00"}
+	for _, window := range invalid {
+		if w, err := ParseBuildWindow(window); err == nil {
+			t.Errorf("%v: expected error, got %v", window, w)
+		}
+	}
+}
+
+func TestBuildWindowIsOpen(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 6, 1, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window string
+		now    time.Time
+		open   bool
+	}{
+		{"01:00-05:00", at(0, 59), false},
+		{"01:00-05:00", at(1, 0), true},
+		{"01:00-05:00", at(4, 59), true},
+		{"01:00-05:00", at(5, 0), false},
+		// wraps past midnight
+		{"22:00-02:00", at(21, 59), false},
+		{"22:00-02:00", at(23, 30), true},
+		{"22:00-02:00", at(0, 0), true},
+		{"22:00-02:00", at(1, 0), true},
+		{"22:00-02:00", at(2, 0), false},
+		{"22:00-02:00", at(3, 0), false},
+	}
+	for _, test := range tests {
+		w, err := ParseBuildWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if open := w.IsOpen(test.now); open != test.open {
+			t.Errorf("%v at %v: expected open %v, got %v",
+				test.window, test.now.Format("15:04"), test.open, open)
+		}
+	}
+
+	var w *BuildWindow
+	if !w.IsOpen(at(12, 0)) {
+		t.Errorf("expected nil window to be open")
+	}
+}
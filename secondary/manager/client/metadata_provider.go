@@ -171,7 +171,8 @@ type watcherCallback func(string, c.IndexerId, c.IndexerId)
 var REQUEST_CHANNEL_COUNT = 1000
 
 var VALID_PARAM_NAMES = []string{"nodes", "defer_build", "retain_deleted_xattr", "immutable",
-	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio"}
+	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio",
+	"memory_quota", "priority"}
 
 ///////////////////////////////////////////////////////
 // Public function : MetadataProvider
@@ -365,6 +366,20 @@ func (o *MetadataProvider) CreateIndexWithPlan(
 	scheme c.PartitionScheme, partitionKeys []string,
 	plan map[string]interface{}) (c.IndexDefnId, error, bool) {
 
+	return o.CreateIndexWithRequester(name, bucket, using, exprType, whereExpr, secExprs, desc,
+		isPrimary, scheme, partitionKeys, plan, nil)
+}
+
+//
+// CreateIndexWithRequester creates an index on behalf of `requester`, who is
+// recorded in DDL history of the indexer nodes.
+//
+func (o *MetadataProvider) CreateIndexWithRequester(
+	name, bucket, using, exprType, whereExpr string,
+	secExprs []string, desc []bool, isPrimary bool,
+	scheme c.PartitionScheme, partitionKeys []string,
+	plan map[string]interface{}, requester *DDLRequester) (c.IndexDefnId, error, bool) {
+
 	// FindIndexByName will only return valid index
 	if o.findIndexByName(name, bucket) != nil {
 		return c.IndexDefnId(0), errors.New(fmt.Sprintf("Index %s already exists.", name)), false
@@ -379,11 +394,11 @@ func (o *MetadataProvider) CreateIndexWithPlan(
 
 	clusterVersion := o.GetClusterVersion()
 	if clusterVersion < c.INDEXER_55_VERSION {
-		if err := o.createIndex(idxDefn, plan); err != nil {
+		if err := o.createIndex(idxDefn, plan, requester); err != nil {
 			return c.IndexDefnId(0), err, false
 		}
 	} else {
-		if err := o.recoverableCreateIndex(idxDefn, plan); err != nil {
+		if err := o.recoverableCreateIndex(idxDefn, plan, requester); err != nil {
 			return c.IndexDefnId(0), err, false
 		}
 	}
@@ -517,7 +532,7 @@ func (o *MetadataProvider) cancelPrepareIndexRequest(idxDefn *c.IndexDefn, watch
 // This function makes a call to create index using new protocol (vulcan).
 //
 func (o *MetadataProvider) makeCommitIndexRequest(idxDefn *c.IndexDefn, layout map[int]map[c.IndexerId][]c.PartitionId,
-	watcherMap map[c.IndexerId]int) error {
+	watcherMap map[c.IndexerId]int, requester *DDLRequester) error {
 
 	definitions := make(map[c.IndexerId][]c.IndexDefn)
 	for replicaId, indexerPartitionMap := range layout {
@@ -542,6 +557,7 @@ func (o *MetadataProvider) makeCommitIndexRequest(idxDefn *c.IndexDefn, layout m
 		DefnId:      idxDefn.DefnId,
 		RequesterId: o.providerId,
 		Definitions: definitions,
+		Requester:   requester,
 	}
 
 	requestMsg, err := MarshallCommitCreateRequest(request)
@@ -657,7 +673,8 @@ func (o *MetadataProvider) makeCommitIndexRequest(idxDefn *c.IndexDefn, layout m
 //
 // This function create index using new protocol (vulcan).
 //
-func (o *MetadataProvider) recoverableCreateIndex(idxDefn *c.IndexDefn, plan map[string]interface{}) error {
+func (o *MetadataProvider) recoverableCreateIndex(idxDefn *c.IndexDefn, plan map[string]interface{},
+	requester *DDLRequester) error {
 
 	//
 	// Prepare Phase.  This is to seek full quorum from all the indexers.
@@ -703,7 +720,7 @@ func (o *MetadataProvider) recoverableCreateIndex(idxDefn *c.IndexDefn, plan map
 	// The first indexer that responds with success will create a token so that it can roll forward even if this
 	// metadata provider has died.  Other indexer will observe the token and proceed with the request.
 	//
-	err = o.makeCommitIndexRequest(idxDefn, layout, watcherMap)
+	err = o.makeCommitIndexRequest(idxDefn, layout, watcherMap, requester)
 	if err != nil {
 		logging.Errorf("Fail to create index: %v", err)
 		return err
@@ -812,7 +829,8 @@ func (o *MetadataProvider) createLayoutWithRoundRobin(idxDefn *c.IndexDefn, inde
 //
 // This function create index using old protocol (spock).
 //
-func (o *MetadataProvider) createIndex(idxDefn *c.IndexDefn, plan map[string]interface{}) error {
+func (o *MetadataProvider) createIndex(idxDefn *c.IndexDefn, plan map[string]interface{},
+	requester *DDLRequester) error {
 
 	// For non-partitioned index, this will return nodes with fewest indexes.  The number of nodes match the number of replica.
 	// For partitioned index, it return all healthy nodes.
@@ -836,13 +854,14 @@ func (o *MetadataProvider) createIndex(idxDefn *c.IndexDefn, plan map[string]int
 
 	layout := o.createLayoutWithRoundRobin(idxDefn, indexerIds)
 
-	return o.makeCreateIndexRequest(idxDefn, layout)
+	return o.makeCreateIndexRequest(idxDefn, layout, requester)
 }
 
 //
 // This function makes a call to create index using old protocol (spock).
 //
-func (o *MetadataProvider) makeCreateIndexRequest(idxDefn *c.IndexDefn, layout map[int]map[c.IndexerId][]c.PartitionId) error {
+func (o *MetadataProvider) makeCreateIndexRequest(idxDefn *c.IndexDefn, layout map[int]map[c.IndexerId][]c.PartitionId,
+	requester *DDLRequester) error {
 
 	defnID := idxDefn.DefnId
 	wait := !idxDefn.Deferred
@@ -870,6 +889,10 @@ func (o *MetadataProvider) makeCreateIndexRequest(idxDefn *c.IndexDefn, layout m
 			idxDefn.Partitions = partitions
 			idxDefn.Versions = make([]int, len(partitions))
 
+			if watcher, err := o.findWatcherByIndexerId(indexerId); err == nil {
+				o.sendDDLRequester(watcher, []c.IndexDefnId{defnID}, requester)
+			}
+
 			if err := o.SendCreateIndexRequest(indexerId, idxDefn, scheduled); err != nil {
 				errMap[err.Error()] = true
 			}
@@ -1019,6 +1042,9 @@ func (o *MetadataProvider) PrepareIndexDefn(
 	var docKeySize uint64 = 0
 	var arrSize uint64 = 0
 	var residentRatio float64 = 0
+	var memQuota uint64 = 0
+	var priority c.IndexPriority
+	var tags []string
 
 	version := o.GetIndexerVersion()
 	clusterVersion := o.GetClusterVersion()
@@ -1152,6 +1178,21 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		if err != nil {
 			return nil, err, retry
 		}
+
+		memQuota, err, retry = o.getMemQuotaParam(plan, 0)
+		if err != nil {
+			return nil, err, retry
+		}
+
+		priority, err, retry = o.getPriorityParam(plan, "")
+		if err != nil {
+			return nil, err, retry
+		}
+
+		tags, err, retry = o.getTagsParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
 	}
 
 	logging.Debugf("MetadataProvider:CreateIndex(): deferred_build %v nodes %v", deferred, nodes)
@@ -1225,6 +1266,9 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		DocKeySize:         docKeySize,
 		ArrSize:            arrSize,
 		ResidentRatio:      residentRatio,
+		MemQuota:           memQuota,
+		Priority:           priority,
+		Tags:               tags,
 	}
 
 	return idxDefn, nil, false
@@ -1757,6 +1801,70 @@ func (o *MetadataProvider) getResidentRatioParam(plan map[string]interface{}) (f
 	return residentRatio, nil, false
 }
 
+// getMemQuotaParam returns the memory quota of index in bytes.  The
+// parameter memory_quota is specified in MB.
+func (o *MetadataProvider) getMemQuotaParam(plan map[string]interface{}, memQuota uint64) (uint64, error, bool) {
+
+	memQuota2, ok := plan["memory_quota"].(float64)
+	if !ok {
+		memQuota_str, ok := plan["memory_quota"].(string)
+		if ok {
+			var err error
+			memQuota3, err := strconv.ParseInt(memQuota_str, 10, 64)
+			if err != nil || memQuota3 < 0 {
+				return 0, errors.New("Parameter memory_quota must be a positive integer value (MB)."), false
+			}
+			memQuota = uint64(memQuota3) * 1024 * 1024
+
+		} else if _, ok := plan["memory_quota"]; ok {
+			return 0, errors.New("Parameter memory_quota must be a positive integer value (MB)."), false
+		}
+	} else {
+		if memQuota2 < 0 {
+			return 0, errors.New("Parameter memory_quota must be a positive integer value (MB)."), false
+		}
+		memQuota = uint64(memQuota2) * 1024 * 1024
+	}
+
+	return memQuota, nil, false
+}
+
+func (o *MetadataProvider) getPriorityParam(plan map[string]interface{}, priority c.IndexPriority) (c.IndexPriority, error, bool) {
+
+	if _, ok := plan["priority"]; ok {
+		priority_str, ok := plan["priority"].(string)
+		if !ok || !c.IndexPriority(strings.ToLower(priority_str)).IsValid() {
+			return "", errors.New("Parameter priority must be one of (low, medium, high)."), false
+		}
+		priority = c.IndexPriority(strings.ToLower(priority_str))
+	}
+
+	return priority, nil, false
+}
+
+func (o *MetadataProvider) getTagsParam(plan map[string]interface{}) ([]string, error, bool) {
+
+	var tags []string = nil
+
+	switch ts := plan["tags"].(type) {
+	case nil:
+	case string:
+		tags = []string{ts}
+	case []interface{}:
+		for _, t := range ts {
+			tag, ok := t.(string)
+			if !ok || len(tag) == 0 {
+				return nil, errors.New(fmt.Sprintf("Fails to create index.  Tags '%v' is not valid", plan["tags"])), false
+			}
+			tags = append(tags, tag)
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Fails to create index.  Tags '%v' is not valid", plan["tags"])), false
+	}
+
+	return tags, nil, false
+}
+
 func (o *MetadataProvider) findWatchersWithRetry(nodes []string, numReplica int, partitioned bool) ([]*watcher, error, bool) {
 
 	var watchers []*watcher
@@ -1838,6 +1946,14 @@ RETRY1:
 }
 
 func (o *MetadataProvider) DropIndex(defnID c.IndexDefnId) error {
+	return o.DropIndexWithRequester(defnID, nil)
+}
+
+//
+// DropIndexWithRequester drops an index on behalf of `requester`, who is
+// recorded in DDL history of the indexer nodes.
+//
+func (o *MetadataProvider) DropIndexWithRequester(defnID c.IndexDefnId, requester *DDLRequester) error {
 
 	// place token for recovery.  Even if the index does not exist, the delete token will
 	// be cleaned up during rebalance.  By placing the delete token, it will make sure that the
@@ -1867,6 +1983,7 @@ func (o *MetadataProvider) DropIndex(defnID c.IndexDefnId) error {
 	key := fmt.Sprintf("%d", defnID)
 	errMap := make(map[string]bool)
 	for _, watcher := range watchers {
+		o.sendDDLRequester(watcher, []c.IndexDefnId{defnID}, requester)
 		_, err = watcher.makeRequest(OPCODE_DROP_INDEX, key, []byte(""))
 		if err != nil {
 			errMap[err.Error()] = true
@@ -1890,6 +2007,14 @@ func (o *MetadataProvider) DropIndex(defnID c.IndexDefnId) error {
 }
 
 func (o *MetadataProvider) BuildIndexes(defnIDs []c.IndexDefnId) error {
+	return o.BuildIndexesWithRequester(defnIDs, nil)
+}
+
+//
+// BuildIndexesWithRequester builds indexes on behalf of `requester`, who is
+// recorded in DDL history of the indexer nodes.
+//
+func (o *MetadataProvider) BuildIndexesWithRequester(defnIDs []c.IndexDefnId, requester *DDLRequester) error {
 
 	watcherIndexMap := make(map[c.IndexerId][]c.IndexDefnId)
 	watcherNodeMap := make(map[c.IndexerId]string)
@@ -1961,6 +2086,9 @@ func (o *MetadataProvider) BuildIndexes(defnIDs []c.IndexDefnId) error {
 	// send request
 	errMap := make(map[string]bool)
 	for indexerId, idList := range watcherIndexMap {
+		if watcher, err := o.findAliveWatcherByIndexerId(indexerId); err == nil {
+			o.sendDDLRequester(watcher, idList, requester)
+		}
 		if err := o.SendBuildIndexRequest(indexerId, idList, watcherNodeMap[indexerId]); err != nil {
 			errMap[err.Error()] = true
 		}
@@ -1977,6 +2105,31 @@ func (o *MetadataProvider) BuildIndexes(defnIDs []c.IndexDefnId) error {
 	return nil
 }
 
+//
+// sendDDLRequester sends the user of a DDL request on indexes `ids` to the
+// indexer of the watcher, ahead of the request.  Failure is only logged, as
+// the request is processed without the user.
+//
+func (o *MetadataProvider) sendDDLRequester(watcher *watcher, ids []c.IndexDefnId, requester *DDLRequester) {
+
+	if requester == nil {
+		return
+	}
+
+	r := *requester
+	r.DefnIds = ids
+
+	content, err := MarshallDDLRequester(&r)
+	if err != nil {
+		logging.Warnf("MetadataProvider: Fail to marshall DDL requester.  Error=%v", err)
+		return
+	}
+
+	if _, err := watcher.makeRequest(OPCODE_DDL_REQUESTER, "DDL Requester", content); err != nil {
+		logging.Warnf("MetadataProvider: Fail to send DDL requester to %v.  Error=%v", watcher.getAdminAddr(), err)
+	}
+}
+
 func (o *MetadataProvider) SendBuildIndexRequest(indexerId c.IndexerId, idList []c.IndexDefnId, addr string) error {
 
 	watcher, err := o.findAliveWatcherByIndexerId(indexerId)
@@ -1999,6 +2152,216 @@ func (o *MetadataProvider) SendBuildIndexRequest(indexerId c.IndexerId, idList [
 	return nil
 }
 
+//
+// UpdateBuildQueue sends a build queue request to the indexers hosting
+// the requested indexes, or to all indexers if the request has no index.
+// Returns the build queue of each indexer the request is sent to.
+//
+func (o *MetadataProvider) UpdateBuildQueue(request *BuildQueueRequest) ([]*BuildQueueStatus, error) {
+
+	watcherIndexMap := make(map[c.IndexerId][]uint64)
+	watcherMap := make(map[c.IndexerId]*watcher)
+
+	if len(request.DefnIds) == 0 {
+		switch request.Op {
+		case BUILD_QUEUE_PAUSE, BUILD_QUEUE_RESUME, BUILD_QUEUE_LIST:
+		default:
+			return nil, fmt.Errorf("Build queue operation %v requires a list of indexes", request.Op)
+		}
+
+		for _, watcher := range o.getAllWatchers() {
+			watcherIndexMap[watcher.getIndexerId()] = nil
+			watcherMap[watcher.getIndexerId()] = watcher
+		}
+	}
+
+	for _, id := range request.DefnIds {
+
+		meta := o.findIndex(c.IndexDefnId(id))
+		if meta == nil || len(meta.Instances) == 0 {
+			return nil, errors.New("Index Definition not found or index is currently being rebalanced.")
+		}
+
+		if request.Op == BUILD_QUEUE_ENQUEUE {
+			for _, inst := range meta.Instances {
+				if inst.State == c.INDEX_STATE_INITIAL || inst.State == c.INDEX_STATE_CATCHUP {
+					return nil, fmt.Errorf("Index %s is being built .", meta.Definition.Name)
+				}
+				if inst.State == c.INDEX_STATE_ACTIVE {
+					return nil, fmt.Errorf("Index %s is already built .", meta.Definition.Name)
+				}
+			}
+		}
+
+		watchers, err := o.findWatchersByDefnIdIgnoreStatus(c.IndexDefnId(id))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot locate cluster node hosting Index %s.", meta.Definition.Name)
+		}
+
+		for _, watcher := range watchers {
+			indexerId := watcher.getIndexerId()
+			watcherIndexMap[indexerId] = append(watcherIndexMap[indexerId], id)
+			watcherMap[indexerId] = watcher
+		}
+	}
+
+	var result []*BuildQueueStatus
+	errMap := make(map[string]bool)
+
+	for indexerId, idList := range watcherIndexMap {
+
+		watcher := watcherMap[indexerId]
+		req := *request
+		req.DefnIds = idList
+
+		content, err := MarshallBuildQueueRequest(&req)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err = watcher.makeRequest(OPCODE_BUILD_QUEUE, "Build Queue", content)
+		if err != nil {
+			errMap[fmt.Sprintf("Node %v: %v", watcher.getNodeAddr(), err)] = true
+			continue
+		}
+
+		status, err := UnmarshallBuildQueueStatus(content)
+		if err != nil {
+			errMap[fmt.Sprintf("Node %v: %v", watcher.getNodeAddr(), err)] = true
+			continue
+		}
+		status.NodeAddr = watcher.getNodeAddr()
+		result = append(result, status)
+	}
+
+	if len(errMap) != 0 {
+		errStr := ""
+		for msg, _ := range errMap {
+			errStr += msg + "\n"
+		}
+		return result, errors.New(errStr)
+	}
+
+	return result, nil
+}
+
+func (o *MetadataProvider) UpdateAggregate(request *AggregateRequest) error {
+
+	meta := o.findIndex(request.DefnId)
+	if meta == nil || len(meta.Instances) == 0 {
+		return errors.New("Index Definition not found or index is currently being rebalanced.")
+	}
+
+	switch request.Op {
+	case AGGREGATE_CREATE:
+		if request.Aggregate == nil {
+			return errors.New("Aggregate is not specified.")
+		}
+		if err := request.Aggregate.Validate(meta.Definition); err != nil {
+			return err
+		}
+		if meta.Definition.FindAggregate(request.Aggregate.Name) != nil {
+			return fmt.Errorf("Aggregate %v already exists on index %v.", request.Aggregate.Name, meta.Definition.Name)
+		}
+		request.Name = request.Aggregate.Name
+
+	case AGGREGATE_DROP:
+		if meta.Definition.FindAggregate(request.Name) == nil {
+			return fmt.Errorf("Aggregate %v does not exist on index %v.", request.Name, meta.Definition.Name)
+		}
+
+	default:
+		return fmt.Errorf("Unknown aggregate operation %v", request.Op)
+	}
+
+	watchers, err := o.findWatchersByDefnIdIgnoreStatus(request.DefnId)
+	if err != nil {
+		return fmt.Errorf("Cannot locate cluster node hosting Index %s.", meta.Definition.Name)
+	}
+
+	content, err := MarshallAggregateRequest(request)
+	if err != nil {
+		return err
+	}
+
+	errMap := make(map[string]bool)
+	for _, watcher := range watchers {
+		if _, err := watcher.makeRequest(OPCODE_UPDATE_AGGREGATE, "Update Aggregate", content); err != nil {
+			errMap[fmt.Sprintf("Node %v: %v", watcher.getNodeAddr(), err)] = true
+		}
+	}
+
+	if len(errMap) != 0 {
+		errStr := ""
+		for msg, _ := range errMap {
+			errStr += msg + "\n"
+		}
+		return errors.New(errStr)
+	}
+
+	return nil
+}
+
+// UpdateMemQuota changes the memory quota and priority of an index, as
+// given by parameters memory_quota and priority.  Parameters not given
+// are left unchanged.
+func (o *MetadataProvider) UpdateMemQuota(defnId c.IndexDefnId, plan map[string]interface{}) error {
+
+	meta := o.findIndex(defnId)
+	if meta == nil || len(meta.Instances) == 0 {
+		return errors.New("Index Definition not found or index is currently being rebalanced.")
+	}
+
+	_, hasQuota := plan["memory_quota"]
+	_, hasPriority := plan["priority"]
+	if !hasQuota && !hasPriority {
+		return errors.New("Parameter memory_quota or priority is not specified.")
+	}
+
+	memQuota, err, _ := o.getMemQuotaParam(plan, meta.Definition.MemQuota)
+	if err != nil {
+		return err
+	}
+
+	priority, err, _ := o.getPriorityParam(plan, meta.Definition.Priority)
+	if err != nil {
+		return err
+	}
+
+	watchers, err := o.findWatchersByDefnIdIgnoreStatus(defnId)
+	if err != nil {
+		return fmt.Errorf("Cannot locate cluster node hosting Index %s.", meta.Definition.Name)
+	}
+
+	request := &MemQuotaRequest{
+		DefnId:   defnId,
+		MemQuota: memQuota,
+		Priority: priority,
+	}
+
+	content, err := MarshallMemQuotaRequest(request)
+	if err != nil {
+		return err
+	}
+
+	errMap := make(map[string]bool)
+	for _, watcher := range watchers {
+		if _, err := watcher.makeRequest(OPCODE_UPDATE_MEM_QUOTA, "Update Memory Quota", content); err != nil {
+			errMap[fmt.Sprintf("Node %v: %v", watcher.getNodeAddr(), err)] = true
+		}
+	}
+
+	if len(errMap) != 0 {
+		errStr := ""
+		for msg, _ := range errMap {
+			errStr += msg + "\n"
+		}
+		return errors.New(errStr)
+	}
+
+	return nil
+}
+
 func (o *MetadataProvider) ListIndex() ([]*IndexMetadata, uint64) {
 
 	indices, version := o.repo.listDefnWithValidInst()
@@ -48,6 +48,7 @@ type IndexInstDistribution struct {
 	StorageMode    string                  `json:"storageMode,omitempty"`
 	OldStorageMode string                  `json:"oldStorageMode,omitempty"`
 	RealInstId     uint64                  `json:"realInstId,omitempty"`
+	Rebuild        bool                    `json:"rebuild,omitempty"`
 }
 
 type IndexPartDistribution struct {
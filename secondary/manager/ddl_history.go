@@ -0,0 +1,508 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gometaC "github.com/couchbase/gometa/common"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+//////////////////////////////////////////////////////////////
+// Lifecycle Mgr - DDL history
+//
+// Every create, build, drop, move, alter and rebuild request processed
+// by the lifecycle manager is recorded in the local metadata repository,
+// together with the index definition before and after the request.
+// Index created or dropped on the node by rebalance is recorded as a
+// move, and index instance created, swapped or dropped by an online
+// rebuild as a rebuild.  Each entry is persisted under its own key, so recording an
+// event does not rewrite the history.  History is trimmed to the
+// configured number of entries and age.
+//////////////////////////////////////////////////////////////
+
+const (
+	DDL_HISTORY_KEY       = "DDLHistory"
+	DDL_HISTORY_ENTRY_KEY = "DDLHistory/"
+
+	// Default number of entries returned in a page of DDL history.
+	DDL_HISTORY_PAGE_SIZE = 100
+
+	// Requester of a DDL request that has not arrived by then is dropped.
+	DDL_REQUESTER_TIMEOUT = 10 * time.Minute
+)
+
+type ddlHistory struct {
+	manager *LifecycleMgr
+
+	mutex      sync.Mutex
+	once       sync.Once
+	first      uint64
+	next       uint64
+	entries    []*client.DDLHistoryEntry // oldest first
+	requesters map[common.IndexDefnId]*ddlRequester
+
+	maxEntries int64
+	maxAge     int64 // seconds
+}
+
+type ddlHistoryState struct {
+	First uint64 `json:"first,omitempty"`
+	Next  uint64 `json:"next,omitempty"`
+}
+
+// ddlRequester identifies the user of a DDL request made through
+// the REST API or the metadata client.
+type ddlRequester struct {
+	user    string
+	source  string
+	expires time.Time
+}
+
+// ddlEvent is a DDL request being processed by the lifecycle manager.
+type ddlEvent struct {
+	event       client.DDLEvent
+	ids         []common.IndexDefnId
+	defns       map[common.IndexDefnId]*common.IndexDefn // from request
+	before      map[common.IndexDefnId]*common.IndexDefn
+	requester   *ddlRequester
+	requesterId string
+}
+
+func newDDLHistory(mgr *LifecycleMgr) *ddlHistory {
+	return &ddlHistory{
+		manager:    mgr,
+		requesters: make(map[common.IndexDefnId]*ddlRequester),
+		maxEntries: int64(common.SystemConfig["indexer.settings.ddl_history.max_entries"].Int()),
+		maxAge:     int64(common.SystemConfig["indexer.settings.ddl_history.max_age"].Int()),
+	}
+}
+
+func ddlHistoryEntryKey(seqno uint64) string {
+	return fmt.Sprintf("%v%d", DDL_HISTORY_ENTRY_KEY, seqno)
+}
+
+func (h *ddlHistory) configUpdate(config *common.Config) {
+	atomic.StoreInt64(&h.maxEntries, int64((*config)["settings.ddl_history.max_entries"].Int()))
+	atomic.StoreInt64(&h.maxAge, int64((*config)["settings.ddl_history.max_age"].Int()))
+}
+
+// load the persisted history, once the metadata repository is available.
+// Caller must hold the mutex.
+func (h *ddlHistory) load() {
+
+	h.once.Do(func() {
+		value, err := h.manager.repo.GetLocalValue(DDL_HISTORY_KEY)
+		if err != nil || len(value) == 0 {
+			return
+		}
+
+		state := new(ddlHistoryState)
+		if err := json.Unmarshal([]byte(value), state); err != nil {
+			logging.Errorf("ddlHistory: Unable to unmarshall DDL history.  Error = %v.  DDL history is reset.", err)
+			return
+		}
+
+		h.first = state.First
+		h.next = state.Next
+		for seqno := state.First; seqno < state.Next; seqno++ {
+			value, err := h.manager.repo.GetLocalValue(ddlHistoryEntryKey(seqno))
+			if err != nil || len(value) == 0 {
+				continue
+			}
+
+			entry := new(client.DDLHistoryEntry)
+			if err := json.Unmarshal([]byte(value), entry); err != nil {
+				logging.Errorf("ddlHistory: Unable to unmarshall DDL history entry %v.  Error = %v.  Entry is skipped.", seqno, err)
+				continue
+			}
+			h.entries = append(h.entries, entry)
+		}
+		logging.Infof("ddlHistory: Loaded DDL history with %v entries", len(h.entries))
+	})
+}
+
+// save the range of persisted entries.  Caller must hold the mutex.
+func (h *ddlHistory) save() error {
+
+	buf, err := json.Marshal(&ddlHistoryState{First: h.first, Next: h.next})
+	if err != nil {
+		return err
+	}
+
+	return h.manager.repo.SetLocalValue(DDL_HISTORY_KEY, string(buf))
+}
+
+// expired returns the number of oldest entries beyond retention limits.
+// Limit of 0 on entries or age means no limit.  Caller must hold the
+// mutex.
+func (h *ddlHistory) expired(now time.Time) int {
+
+	maxEntries := atomic.LoadInt64(&h.maxEntries)
+	maxAge := atomic.LoadInt64(&h.maxAge)
+	expiry := now.Add(-time.Duration(maxAge) * time.Second).UnixNano()
+
+	n := 0
+	for n < len(h.entries) {
+		if (maxEntries <= 0 || int64(len(h.entries)-n) <= maxEntries) &&
+			(maxAge <= 0 || h.entries[n].Timestamp >= expiry) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// trim entries beyond retention limits.  Caller must hold the mutex.
+func (h *ddlHistory) trim() {
+
+	n := h.expired(time.Now())
+
+	last := h.next
+	if n < len(h.entries) {
+		last = h.entries[n].Seqno
+	}
+	h.entries = h.entries[n:]
+
+	for ; h.first < last; h.first++ {
+		if err := h.manager.repo.DeleteLocalValue(ddlHistoryEntryKey(h.first)); err != nil {
+			logging.Debugf("ddlHistory: Unable to delete DDL history entry %v.  Error = %v", h.first, err)
+		}
+	}
+}
+
+func (h *ddlHistory) add(entry *client.DDLHistoryEntry) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.load()
+
+	entry.Seqno = h.next
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		logging.Errorf("ddlHistory: Unable to marshall DDL history entry.  Error = %v", err)
+		return
+	}
+
+	if err := h.manager.repo.SetLocalValue(ddlHistoryEntryKey(entry.Seqno), string(buf)); err != nil {
+		logging.Errorf("ddlHistory: Unable to persist DDL history entry.  Error = %v", err)
+		return
+	}
+
+	h.next++
+	h.entries = append(h.entries, entry)
+	h.trim()
+
+	if err := h.save(); err != nil {
+		logging.Errorf("ddlHistory: Unable to persist DDL history.  Error = %v", err)
+	}
+}
+
+// Register the requester of a DDL request, before the request is
+// processed by the lifecycle manager.  The returned function removes the
+// registration if the request is not processed.  Registrations that are
+// never removed, e.g. when the request from the metadata client fails to
+// arrive, expire after DDL_REQUESTER_TIMEOUT.
+func (h *ddlHistory) expect(ids []common.IndexDefnId, user string, source string) func() {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	for id, r := range h.requesters {
+		if now.After(r.expires) {
+			delete(h.requesters, id)
+		}
+	}
+
+	requester := &ddlRequester{user: user, source: source, expires: now.Add(DDL_REQUESTER_TIMEOUT)}
+	for _, id := range ids {
+		h.requesters[id] = requester
+	}
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		for _, id := range ids {
+			if h.requesters[id] == requester {
+				delete(h.requesters, id)
+			}
+		}
+	}
+}
+
+// Register the requester sent by the metadata client ahead of a DDL
+// request.
+func (h *ddlHistory) handleRequester(content []byte) error {
+
+	requester, err := client.UnmarshallDDLRequester(content)
+	if err != nil {
+		return err
+	}
+
+	h.expect(requester.DefnIds, requester.User, requester.Source)
+	return nil
+}
+
+func (h *ddlHistory) takeRequester(ids []common.IndexDefnId) *ddlRequester {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var requester *ddlRequester
+	for _, id := range ids {
+		if r, ok := h.requesters[id]; ok {
+			if time.Now().Before(r.expires) {
+				requester = r
+			}
+			delete(h.requesters, id)
+		}
+	}
+	return requester
+}
+
+// Start recording a request.  Return nil if the request is not a DDL
+// request.
+func (h *ddlHistory) begin(op gometaC.OpCode, key string, content []byte, fid string) *ddlEvent {
+
+	evt := &ddlEvent{
+		defns:  make(map[common.IndexDefnId]*common.IndexDefn),
+		before: make(map[common.IndexDefnId]*common.IndexDefn),
+	}
+
+	addDefn := func(defn *common.IndexDefn) {
+		evt.ids = append(evt.ids, defn.DefnId)
+		evt.defns[defn.DefnId] = defn
+	}
+
+	switch op {
+	case client.OPCODE_CREATE_INDEX, client.OPCODE_CREATE_INDEX_DEFER_BUILD, client.OPCODE_CREATE_INDEX_REBAL:
+		evt.event = client.DDL_EVENT_CREATE
+		if op == client.OPCODE_CREATE_INDEX_REBAL {
+			evt.event = client.DDL_EVENT_MOVE
+		}
+		if defn, err := common.UnmarshallIndexDefn(content); err == nil {
+			addDefn(defn)
+		}
+
+	case client.OPCODE_COMMIT_CREATE_INDEX:
+		evt.event = client.DDL_EVENT_CREATE
+		if request, err := client.UnmarshallCommitCreateRequest(content); err == nil {
+			evt.ids = append(evt.ids, request.DefnId)
+			if r := request.Requester; r != nil {
+				evt.requester = &ddlRequester{user: r.User, source: r.Source}
+			}
+		}
+
+	case client.OPCODE_BUILD_INDEX, client.OPCODE_BUILD_INDEX_RETRY, client.OPCODE_BUILD_INDEX_REBAL:
+		evt.event = client.DDL_EVENT_BUILD
+		if list, err := client.UnmarshallIndexIdList(content); err == nil {
+			for _, id := range list.DefnIds {
+				evt.ids = append(evt.ids, common.IndexDefnId(id))
+			}
+		}
+
+	case client.OPCODE_DROP_INDEX, client.OPCODE_DROP_INDEX_REBAL:
+		evt.event = client.DDL_EVENT_DROP
+		if op == client.OPCODE_DROP_INDEX_REBAL {
+			evt.event = client.DDL_EVENT_MOVE
+		}
+		if id, err := indexDefnId(key); err == nil {
+			evt.ids = append(evt.ids, id)
+		}
+
+	case client.OPCODE_DROP_OR_PRUNE_INSTANCE:
+		evt.event = client.DDL_EVENT_MOVE
+		change := new(dropInstance)
+		if err := json.Unmarshal(content, change); err == nil {
+			addDefn(&change.Defn)
+
+			// instance replaced by online rebuild, or proxy of a failed rebuild
+			inst, err := h.manager.FindLocalIndexInst(change.Defn.Bucket, change.Defn.DefnId, change.Defn.InstId)
+			if err == nil && inst != nil && (inst.Rebuild || (inst.RealInstId == 0 &&
+				common.RebalanceState(inst.RState) == common.REBAL_PENDING_DELETE)) {
+				evt.event = client.DDL_EVENT_REBUILD
+			}
+		}
+
+	case client.OPCODE_UPDATE_AGGREGATE:
+		evt.event = client.DDL_EVENT_ALTER
+		if request, err := client.UnmarshallAggregateRequest(content); err == nil {
+			evt.ids = append(evt.ids, request.DefnId)
+		}
+
+	case client.OPCODE_UPDATE_MEM_QUOTA:
+		evt.event = client.DDL_EVENT_ALTER
+		if request, err := client.UnmarshallMemQuotaRequest(content); err == nil {
+			evt.ids = append(evt.ids, request.DefnId)
+		}
+
+	case client.OPCODE_CREATE_INDEX_REBUILD:
+		evt.event = client.DDL_EVENT_REBUILD
+		if defn, err := common.UnmarshallIndexDefn(content); err == nil {
+			addDefn(defn)
+		}
+
+	case client.OPCODE_SWAP_INDEX_INST:
+		evt.event = client.DDL_EVENT_REBUILD
+		change := new(swapIndexInst)
+		if err := json.Unmarshal(content, change); err == nil {
+			evt.ids = append(evt.ids, common.IndexDefnId(change.DefnId))
+		}
+
+	default:
+		return nil
+	}
+
+	if len(evt.ids) == 0 {
+		return nil
+	}
+
+	for _, id := range evt.ids {
+		if defn, err := h.manager.repo.GetIndexDefnById(id); err == nil && defn != nil {
+			evt.before[id] = defn
+		}
+	}
+
+	if requester := h.takeRequester(evt.ids); requester != nil {
+		evt.requester = requester
+	}
+	if fid != "internal" {
+		evt.requesterId = fid
+	}
+
+	return evt
+}
+
+// Finish recording a request.  An entry is added for each index of the
+// request that exists on this node before or after the request, or for
+// which the request fails.
+func (h *ddlHistory) end(evt *ddlEvent, err error) {
+
+	if evt == nil {
+		return
+	}
+
+	node := h.getNode()
+	now := time.Now().UnixNano()
+
+	for _, id := range evt.ids {
+		before := evt.before[id]
+		after, _ := h.manager.repo.GetIndexDefnById(id)
+
+		if before == nil && after == nil && err == nil {
+			continue
+		}
+
+		entry := &client.DDLHistoryEntry{
+			Timestamp:   now,
+			Event:       evt.event,
+			DefnId:      id,
+			RequesterId: evt.requesterId,
+			Node:        node,
+			Before:      before,
+			After:       after,
+		}
+
+		if evt.requester != nil {
+			entry.User = evt.requester.user
+			entry.Source = evt.requester.source
+		}
+
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		// Definition is unchanged, e.g. build.
+		if before != nil && after != nil && reflect.DeepEqual(before, after) {
+			entry.Before = nil
+		}
+
+		for _, defn := range []*common.IndexDefn{after, before, evt.defns[id]} {
+			if defn != nil {
+				entry.Bucket = defn.Bucket
+				entry.Name = defn.Name
+				break
+			}
+		}
+
+		h.add(entry)
+	}
+}
+
+func (h *ddlHistory) getNode() string {
+
+	cinfo := h.manager.cinfo
+	cinfo.Lock()
+	defer cinfo.Unlock()
+
+	node, err := cinfo.GetLocalHostAddress()
+	if err != nil {
+		logging.Debugf("ddlHistory: Unable to find local node address.  Error = %v", err)
+	}
+	return node
+}
+
+// Return the history entries matching the request, newest first.
+func (h *ddlHistory) query(request *client.DDLHistoryRequest) []*client.DDLHistoryEntry {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.load()
+
+	var result []*client.DDLHistoryEntry
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if request.Match(h.entries[i]) {
+			result = append(result, h.entries[i])
+		}
+	}
+	return result
+}
+
+// Sort entries from multiple nodes, newest first.
+func sortDDLHistory(entries []*client.DDLHistoryEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp > entries[j].Timestamp
+		}
+		if entries[i].Node != entries[j].Node {
+			return entries[i].Node < entries[j].Node
+		}
+		return entries[i].Seqno > entries[j].Seqno
+	})
+}
+
+// Return the page of entries specified by offset and limit.  Limit 0
+// returns all entries after offset.
+func pageDDLHistory(entries []*client.DDLHistoryEntry, offset int, limit int) []*client.DDLHistoryEntry {
+
+	if offset >= len(entries) {
+		return nil
+	}
+	entries = entries[offset:]
+
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+func TestDDLHistoryExpired(t *testing.T) {
+	now := time.Now()
+	h := &ddlHistory{}
+	for i := 0; i < 5; i++ {
+		age := time.Duration(5-i) * time.Hour
+		h.entries = append(h.entries, &client.DDLHistoryEntry{Seqno: uint64(i), Timestamp: now.Add(-age).UnixNano()})
+	}
+
+	cases := []struct {
+		maxEntries, maxAge int64
+		expired            int
+	}{
+		{0, 0, 0},          // no limits
+		{10, 0, 0},         // within limits
+		{2, 0, 3},          // entries
+		{0, 3*3600 + 1, 2}, // age
+		{4, 3*3600 + 1, 2},
+		{1, 3*3600 + 1, 4},
+	}
+	for _, tc := range cases {
+		h.maxEntries, h.maxAge = tc.maxEntries, tc.maxAge
+		if n := h.expired(now); n != tc.expired {
+			t.Errorf("max entries %v age %v: expected %v expired, got %v",
+				tc.maxEntries, tc.maxAge, tc.expired, n)
+		}
+	}
+}
+
+func TestDDLHistoryRequester(t *testing.T) {
+	h := &ddlHistory{requesters: make(map[common.IndexDefnId]*ddlRequester)}
+
+	// registration removed by REST handler is not taken.
+	cancel := h.expect([]common.IndexDefnId{1}, "admin", "10.0.0.1")
+	cancel()
+	if r := h.takeRequester([]common.IndexDefnId{1}); r != nil {
+		t.Errorf("expected no requester, got %+v", r)
+	}
+
+	// requester sent by metadata client ahead of a build.
+	content, err := client.MarshallDDLRequester(&client.DDLRequester{
+		DefnIds: []common.IndexDefnId{2, 3}, User: "alice", Source: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.handleRequester(content); err != nil {
+		t.Fatal(err)
+	}
+	r := h.takeRequester([]common.IndexDefnId{2, 3})
+	if r == nil || r.user != "alice" || r.source != "10.0.0.2" {
+		t.Fatalf("unexpected requester %+v", r)
+	}
+	if len(h.requesters) != 0 {
+		t.Errorf("expected requesters to be taken, got %v", h.requesters)
+	}
+
+	// expired registration is neither taken nor kept.
+	h.expect([]common.IndexDefnId{4}, "bob", "10.0.0.3")
+	h.requesters[4].expires = time.Now().Add(-time.Second)
+	h.expect([]common.IndexDefnId{5}, "carol", "10.0.0.4")
+	if _, ok := h.requesters[4]; ok {
+		t.Errorf("expected expired requester to be dropped")
+	}
+	h.requesters[5].expires = time.Now().Add(-time.Second)
+	if r := h.takeRequester([]common.IndexDefnId{5}); r != nil {
+		t.Errorf("expected expired requester not to be taken, got %+v", r)
+	}
+}
+
+func TestDDLHistoryPage(t *testing.T) {
+	entries := []*client.DDLHistoryEntry{
+		{Seqno: 1, Timestamp: 10, Node: "b"},
+		{Seqno: 2, Timestamp: 20, Node: "b"},
+		{Seqno: 1, Timestamp: 20, Node: "a"},
+		{Seqno: 3, Timestamp: 20, Node: "b"},
+	}
+	sortDDLHistory(entries)
+
+	expected := []struct {
+		node  string
+		seqno uint64
+	}{{"a", 1}, {"b", 3}, {"b", 2}, {"b", 1}}
+	for i, e := range expected {
+		if entries[i].Node != e.node || entries[i].Seqno != e.seqno {
+			t.Errorf("entry %v: expected %v/%v, got %v/%v", i, e.node, e.seqno, entries[i].Node, entries[i].Seqno)
+		}
+	}
+
+	if page := pageDDLHistory(entries, 1, 2); len(page) != 2 || page[0] != entries[1] {
+		t.Errorf("unexpected page %v", page)
+	}
+	if page := pageDDLHistory(entries, 2, 0); len(page) != 2 {
+		t.Errorf("expected rest of entries, got %v", page)
+	}
+	if page := pageDDLHistory(entries, 4, 1); page != nil {
+		t.Errorf("expected empty page, got %v", page)
+	}
+}
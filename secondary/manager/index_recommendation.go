@@ -0,0 +1,552 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager/client"
+	"github.com/couchbase/indexing/secondary/planner"
+)
+
+//////////////////////////////////////////////////////////////
+// Index Recommendations
+//
+// Recommendations are derived from the scan workload of all indexer
+// nodes, see ScanShape, and the index layout of the cluster:
+//
+//   covering  - a scan shape with a large enough share of the scans of
+//               an index filters or returns only some of its keys, in an
+//               order other than the index keys.  The suggested index has
+//               the equality keys first, then the range keys, then the
+//               returned keys.
+//   reorder   - same as covering, where the suggested index keeps all
+//               the keys of the index.
+//   redundant - the keys of an index are a prefix of the keys of another
+//               index, which can serve its scans.  Of equivalent indexes,
+//               the one with fewer scans is reported.
+//   replica   - a replica serves a negligible share of the scans of its
+//               index.
+//
+// Sizes come from the planner sizing, using the live stats of the index
+// the recommendation is made for.  Key size of a suggested index is
+// scaled by its number of keys.
+//////////////////////////////////////////////////////////////
+
+const (
+	RECOMMEND_MIN_SHARE     = 0.1
+	RECOMMEND_REPLICA_SHARE = 0.05
+	RECOMMEND_MIN_SCANS     = 1000
+)
+
+type recommendationParams struct {
+	bucket       string
+	minShare     float64 // share of scans of a shape to suggest an index
+	replicaShare float64 // share of scans below which a replica is negligible
+	minScans     uint64  // scans of an index to make scan based recommendations
+}
+
+// indexScans is the index layout and the scan workload of an index.
+type indexScans struct {
+	defn     *common.IndexDefn
+	usages   []*planner.IndexUsage
+	replicas map[int][]*planner.IndexUsage
+	total    uint64
+	insts    map[common.IndexInstId]uint64
+	shapes   map[string]*client.ScanShape
+}
+
+func parseRecommendationParams(values url.Values) (*recommendationParams, error) {
+
+	params := &recommendationParams{
+		bucket:       values.Get("bucket"),
+		minShare:     RECOMMEND_MIN_SHARE,
+		replicaShare: RECOMMEND_REPLICA_SHARE,
+		minScans:     RECOMMEND_MIN_SCANS,
+	}
+
+	parseShare := func(name string, share *float64) error {
+		if v := values.Get(name); len(v) != 0 {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("Invalid %v %v", name, v)
+			}
+			*share = f
+		}
+		return nil
+	}
+
+	if err := parseShare("minShare", &params.minShare); err != nil {
+		return nil, err
+	}
+
+	if err := parseShare("replicaShare", &params.replicaShare); err != nil {
+		return nil, err
+	}
+
+	if v := values.Get("minScans"); len(v) != 0 {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid minScans %v", v)
+		}
+		params.minScans = n
+	}
+
+	return params, nil
+}
+
+//
+// GET returns index recommendations for the indexes of the cluster.
+// Query parameter bucket selects the indexes of a bucket.  Parameters
+// minShare, replicaShare and minScans tune scan based recommendations.
+//
+func (m *requestHandlerContext) handleIndexRecommendationRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	params, err := parseRecommendationParams(r.URL.Query())
+	if err != nil {
+		sendHttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shapes, failedNodes, err := m.getScanWorkload()
+	if err != nil {
+		resp := &client.IndexRecommendationResponse{Code: RESP_ERROR, Error: err.Error()}
+		send(http.StatusInternalServerError, w, resp)
+		return
+	}
+
+	plan, err := planner.RetrievePlanFromCluster(m.clusterUrl, nil)
+	if err != nil {
+		resp := &client.IndexRecommendationResponse{Code: RESP_ERROR, Error: err.Error()}
+		send(http.StatusInternalServerError, w, resp)
+		return
+	}
+
+	var indexes []*planner.IndexUsage
+	for _, indexer := range plan.Placement {
+		for _, index := range indexer.Indexes {
+			if index.Instance == nil {
+				continue
+			}
+
+			if len(params.bucket) != 0 && params.bucket != index.Bucket {
+				continue
+			}
+
+			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!list", index.Bucket)
+			if isAllowed(creds, []string{permission}, nil) {
+				indexes = append(indexes, index)
+			}
+		}
+	}
+
+	// Share of scans of a replica is only known with the workload of all nodes.
+	if len(failedNodes) != 0 {
+		params.replicaShare = 0
+	}
+
+	resp := &client.IndexRecommendationResponse{
+		Code:            RESP_SUCCESS,
+		FailedNodes:     failedNodes,
+		Recommendations: recommendIndexes(indexes, shapes, params, planner.NewSizingMethod()),
+	}
+	send(http.StatusOK, w, resp)
+}
+
+func (m *requestHandlerContext) getScanWorkload() ([]*client.ScanShape, []string, error) {
+
+	cinfo := m.mgr.cinfoClient.GetClusterInfoCache()
+	if cinfo == nil {
+		return nil, nil, errors.New("ClusterInfoCache unavailable in IndexManager")
+	}
+
+	cinfo.RLock()
+	defer cinfo.RUnlock()
+
+	var shapes []*client.ScanShape
+	failedNodes := make([]string, 0)
+
+	nids := cinfo.GetNodesByServiceType(common.INDEX_HTTP_SERVICE)
+	for _, nid := range nids {
+
+		addr, err := cinfo.GetServiceAddress(nid, common.INDEX_HTTP_SERVICE)
+		if err != nil {
+			logging.Debugf("RequestHandler::getScanWorkload: Error from GetServiceAddress for node id %v. Error = %v", nid, err)
+			continue
+		}
+
+		resp, err := getWithAuth(addr + "/getLocalScanWorkload")
+		if err != nil {
+			logging.Debugf("RequestHandler::getScanWorkload: Error while retrieving %v with auth %v", addr+"/getLocalScanWorkload", err)
+			failedNodes = append(failedNodes, addr)
+			continue
+		}
+		defer resp.Body.Close()
+
+		workload := new(client.ScanWorkloadResponse)
+		status := convertResponse(resp, workload)
+		if status == RESP_ERROR || workload.Code == RESP_ERROR {
+			logging.Debugf("RequestHandler::getScanWorkload: Error from convertResponse for node %v: %v", addr, workload.Error)
+			failedNodes = append(failedNodes, addr)
+			continue
+		}
+
+		shapes = append(shapes, workload.Shapes...)
+	}
+
+	return shapes, failedNodes, nil
+}
+
+// recommendIndexes makes recommendations for the given indexes, one
+// IndexUsage per partition of each index instance.
+func recommendIndexes(indexes []*planner.IndexUsage, shapes []*client.ScanShape,
+	params *recommendationParams, sizing planner.SizingMethod) []*client.IndexRecommendation {
+
+	scans := make(map[common.IndexDefnId]*indexScans)
+	for _, index := range indexes {
+		is, ok := scans[index.DefnId]
+		if !ok {
+			is = &indexScans{
+				defn:     &index.Instance.Defn,
+				replicas: make(map[int][]*planner.IndexUsage),
+				insts:    make(map[common.IndexInstId]uint64),
+				shapes:   make(map[string]*client.ScanShape),
+			}
+			scans[index.DefnId] = is
+		}
+		is.usages = append(is.usages, index)
+		is.replicas[index.Instance.ReplicaId] = append(is.replicas[index.Instance.ReplicaId], index)
+	}
+
+	// Scans of replicas, or of partitions on different nodes, add up by
+	// shape for the index.
+	for _, shape := range shapes {
+		is, ok := scans[shape.DefnId]
+		if !ok {
+			continue
+		}
+		is.total += shape.Count
+		is.insts[shape.InstId] += shape.Count
+
+		merged := *shape
+		merged.InstId = 0
+		key := fmt.Sprintf("%v:%v:%v:%v:%v:%v", merged.Equality, merged.Range, merged.Projection == nil,
+			merged.Projection, merged.Limit, merged.GroupAggr)
+		if current, ok := is.shapes[key]; ok {
+			current.Count += shape.Count
+		} else {
+			is.shapes[key] = &merged
+		}
+	}
+
+	defnIds := make([]common.IndexDefnId, 0, len(scans))
+	for defnId := range scans {
+		defnIds = append(defnIds, defnId)
+	}
+	sort.Slice(defnIds, func(i, j int) bool { return defnIds[i] < defnIds[j] })
+
+	var recommendations []*client.IndexRecommendation
+	for _, defnId := range defnIds {
+		is := scans[defnId]
+		recommendations = append(recommendations, recommendKeys(is, scans, params, sizing)...)
+		recommendations = append(recommendations, recommendRedundant(is, scans, sizing)...)
+		recommendations = append(recommendations, recommendReplicas(is, params, sizing)...)
+	}
+
+	return recommendations
+}
+
+// recommendKeys suggests indexes with the keys filtered and returned by
+// the main scan shapes of an index, in the order that best serves them.
+func recommendKeys(is *indexScans, scans map[common.IndexDefnId]*indexScans,
+	params *recommendationParams, sizing planner.SizingMethod) []*client.IndexRecommendation {
+
+	if is.defn.IsPrimary || is.total == 0 || is.total < params.minScans {
+		return nil
+	}
+
+	var recommendations []*client.IndexRecommendation
+	suggested := make(map[string]bool)
+
+	for _, shape := range is.shapes {
+		share := float64(shape.Count) / float64(is.total)
+		if share < params.minShare {
+			continue
+		}
+
+		positions := suggestKeyPositions(len(is.defn.SecExprs), shape)
+		if len(positions) == 0 || isKeyPrefix(positions) {
+			continue
+		}
+
+		defn := is.defn.Clone()
+		defn.Name = is.defn.Name + "_adv"
+		defn.Deferred = false
+		defn.Nodes = nil
+		defn.SecExprs = make([]string, len(positions))
+		defn.Desc = nil
+		for i, pos := range positions {
+			defn.SecExprs[i] = is.defn.SecExprs[pos]
+			if len(is.defn.Desc) > pos && is.defn.Desc[pos] {
+				if defn.Desc == nil {
+					defn.Desc = make([]bool, len(positions))
+				}
+				defn.Desc[i] = true
+			}
+		}
+
+		key := strings.Join(defn.SecExprs, ",")
+		if suggested[key] || servedByIndex(defn, scans) {
+			continue
+		}
+		suggested[key] = true
+
+		typ := client.RECOMMEND_COVERING
+		reason := fmt.Sprintf("%.1f%% of scans filter on keys %v and %v and return %v",
+			share*100, shape.Equality, shape.Range, describeProjection(shape))
+		if len(positions) == len(is.defn.SecExprs) {
+			typ = client.RECOMMEND_REORDER
+		}
+
+		memUsage, dataSize := estimateIndexSize(sizing, is.usages, len(positions), len(is.defn.SecExprs))
+		recommendations = append(recommendations, &client.IndexRecommendation{
+			Type:      typ,
+			Bucket:    is.defn.Bucket,
+			Name:      is.defn.Name,
+			DefnId:    is.defn.DefnId,
+			SecExprs:  defn.SecExprs,
+			Statement: common.IndexStatement(*defn, false),
+			Reason:    reason,
+			ScanShare: share,
+			MemUsage:  memUsage,
+			DataSize:  dataSize,
+		})
+	}
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		return recommendations[i].ScanShare > recommendations[j].ScanShare
+	})
+
+	return recommendations
+}
+
+// suggestKeyPositions orders the keys used by a scan shape: equality
+// keys, then range keys, then the keys returned.
+func suggestKeyPositions(numKeys int, shape *client.ScanShape) []int {
+
+	var positions []int
+	used := make(map[int]bool)
+	add := func(pos int) {
+		if pos < numKeys && !used[pos] {
+			used[pos] = true
+			positions = append(positions, pos)
+		}
+	}
+
+	for _, pos := range shape.Equality {
+		add(pos)
+	}
+	for _, pos := range shape.Range {
+		add(pos)
+	}
+
+	// group/aggregate shapes do not tell which keys are used
+	if shape.Projection == nil || shape.GroupAggr {
+		for pos := 0; pos < numKeys; pos++ {
+			add(pos)
+		}
+	} else {
+		for _, pos := range shape.Projection {
+			add(pos)
+		}
+	}
+
+	return positions
+}
+
+// isKeyPrefix returns true if the positions are a prefix of the index
+// keys, which the index serves already.
+func isKeyPrefix(positions []int) bool {
+
+	for i, pos := range positions {
+		if i != pos {
+			return false
+		}
+	}
+	return true
+}
+
+func describeProjection(shape *client.ScanShape) string {
+
+	if shape.Projection == nil || shape.GroupAggr {
+		return "all keys"
+	}
+	if len(shape.Projection) == 0 {
+		return "no key"
+	}
+	return fmt.Sprintf("keys %v", shape.Projection)
+}
+
+// servedByIndex returns true if an index has the keys of defn as prefix.
+func servedByIndex(defn *common.IndexDefn, scans map[common.IndexDefnId]*indexScans) bool {
+
+	for _, other := range scans {
+		if common.IsPrefixIndex(defn, other.defn) {
+			return true
+		}
+	}
+	return false
+}
+
+// recommendRedundant reports an index whose keys are a prefix of the
+// keys of another index.
+func recommendRedundant(is *indexScans, scans map[common.IndexDefnId]*indexScans,
+	sizing planner.SizingMethod) []*client.IndexRecommendation {
+
+	for _, other := range scans {
+		if other == is || !common.IsPrefixIndex(is.defn, other.defn) {
+			continue
+		}
+
+		// keep the equivalent index with more scans, or the older one
+		if common.IsEquivalentIndex(is.defn, other.defn) {
+			if is.total > other.total || (is.total == other.total && is.defn.DefnId < other.defn.DefnId) {
+				continue
+			}
+		}
+
+		share := float64(0)
+		if is.total+other.total != 0 {
+			share = float64(is.total) / float64(is.total+other.total)
+		}
+
+		memUsage, dataSize := estimateIndexSize(sizing, is.usages, 1, 1)
+		return []*client.IndexRecommendation{&client.IndexRecommendation{
+			Type:      client.RECOMMEND_REDUNDANT,
+			Bucket:    is.defn.Bucket,
+			Name:      is.defn.Name,
+			DefnId:    is.defn.DefnId,
+			Statement: fmt.Sprintf("DROP INDEX `%v`.`%v`", is.defn.Bucket, is.defn.Name),
+			Reason:    fmt.Sprintf("index %v can serve its scans", other.defn.Name),
+			ScanShare: share,
+			MemUsage:  memUsage,
+			DataSize:  dataSize,
+		}}
+	}
+
+	return nil
+}
+
+// recommendReplicas reports replicas serving a negligible share of the
+// scans of their index.
+func recommendReplicas(is *indexScans, params *recommendationParams,
+	sizing planner.SizingMethod) []*client.IndexRecommendation {
+
+	if len(is.replicas) < 2 || is.total == 0 || is.total < params.minScans {
+		return nil
+	}
+
+	replicaIds := make([]int, 0, len(is.replicas))
+	for replicaId := range is.replicas {
+		replicaIds = append(replicaIds, replicaId)
+	}
+	sort.Ints(replicaIds)
+
+	var recommendations []*client.IndexRecommendation
+	for _, replicaId := range replicaIds {
+		usages := is.replicas[replicaId]
+
+		var count uint64
+		counted := make(map[common.IndexInstId]bool)
+		for _, usage := range usages {
+			if !counted[usage.InstId] {
+				counted[usage.InstId] = true
+				count += is.insts[usage.InstId]
+			}
+		}
+
+		share := float64(count) / float64(is.total)
+		if share >= params.replicaShare {
+			continue
+		}
+
+		memUsage, dataSize := estimateIndexSize(sizing, usages, 1, 1)
+		recommendations = append(recommendations, &client.IndexRecommendation{
+			Type:      client.RECOMMEND_REPLICA,
+			Bucket:    is.defn.Bucket,
+			Name:      is.defn.Name,
+			DefnId:    is.defn.DefnId,
+			ReplicaId: replicaId,
+			Reason: fmt.Sprintf("replica %v serves %.1f%% of scans, num_replica can be lowered",
+				replicaId, share*100),
+			ScanShare: share,
+			MemUsage:  memUsage,
+			DataSize:  dataSize,
+		})
+	}
+
+	return recommendations
+}
+
+// estimateIndexSize estimates the memory usage and data size of an
+// index with numKeys keys, from the partitions of an index with srcKeys
+// keys.
+func estimateIndexSize(sizing planner.SizingMethod, usages []*planner.IndexUsage,
+	numKeys int, srcKeys int) (uint64, uint64) {
+
+	scale := func(size uint64) uint64 {
+		if srcKeys == 0 {
+			return size
+		}
+		return size * uint64(numKeys) / uint64(srcKeys)
+	}
+
+	var memUsage, dataSize uint64
+	for _, u := range usages {
+		numDocs := u.NumOfDocs
+		if numDocs == 0 {
+			numDocs = u.ActualNumDocs
+		}
+
+		estimate := &planner.IndexUsage{
+			IsPrimary:     u.IsPrimary,
+			StorageMode:   u.StorageMode,
+			AvgSecKeySize: scale(u.AvgSecKeySize),
+			AvgDocKeySize: u.AvgDocKeySize,
+			AvgArrSize:    u.AvgArrSize,
+			AvgArrKeySize: scale(u.AvgArrKeySize),
+			NumOfDocs:     numDocs,
+			ResidentRatio: u.ResidentRatio,
+			MutationRate:  u.MutationRate,
+			ScanRate:      u.ScanRate,
+			ActualKeySize: scale(u.ActualKeySize),
+			ActualNumDocs: u.ActualNumDocs,
+		}
+		sizing.ComputeIndexSize(estimate)
+
+		memUsage += estimate.MemUsage
+		dataSize += estimate.DataSize
+	}
+
+	return memUsage, dataSize
+}
@@ -48,6 +48,8 @@ type LifecycleMgr struct {
 	builder       *builder
 	janitor       *janitor
 	updator       *updator
+	buildQueue    *buildQueue
+	history       *ddlHistory
 	requestServer RequestServer
 	prepareLock   *client.PrepareCreateRequest
 }
@@ -76,6 +78,12 @@ type dropInstance struct {
 	Cleanup bool             `json:"cleanup,omitempty"`
 }
 
+type swapIndexInst struct {
+	DefnId    uint64 `json:"defnId,omitempty"`
+	InstId    uint64 `json:"instId,omitempty"`
+	NewInstId uint64 `json:"newInstId,omitempty"`
+}
+
 type mergePartition struct {
 	DefnId         uint64   `json:"defnId,omitempty"`
 	SrcInstId      uint64   `json:"srcInstId,omitempty"`
@@ -87,11 +95,12 @@ type mergePartition struct {
 }
 
 type builder struct {
-	manager   *LifecycleMgr
-	pendings  map[string][]uint64
-	notifych  chan *common.IndexDefn
-	batchSize int32
-	disable   int32
+	manager       *LifecycleMgr
+	pendings      map[string][]uint64
+	notifych      chan *common.IndexDefn
+	batchSize     int32
+	maxConcurrent int32
+	disable       int32
 }
 
 type janitor struct {
@@ -130,6 +139,8 @@ func NewLifecycleMgr(notifier MetadataNotifier, clusterURL string) (*LifecycleMg
 	mgr.builder = newBuilder(mgr)
 	mgr.janitor = newJanitor(mgr)
 	mgr.updator = newUpdator(mgr)
+	mgr.buildQueue = newBuildQueue(mgr)
+	mgr.history = newDDLHistory(mgr)
 
 	return mgr, nil
 }
@@ -174,6 +185,9 @@ func (m *LifecycleMgr) OnNewRequest(fid string, request protocol.RequestMsg) {
 		// allow background build to go through
 		go m.builder.run()
 
+		// dispatch indexes queued for build
+		go m.buildQueue.run()
+
 		// detect if there is any change to indexer info (e.g. serverGroup)
 		go m.updator.run()
 
@@ -203,6 +217,7 @@ func (m *LifecycleMgr) OnNewRequest(fid string, request protocol.RequestMsg) {
 		if op == client.OPCODE_UPDATE_INDEX_INST ||
 			op == client.OPCODE_DROP_OR_PRUNE_INSTANCE ||
 			op == client.OPCODE_MERGE_PARTITION ||
+			op == client.OPCODE_SWAP_INDEX_INST ||
 			op == client.OPCODE_PREPARE_CREATE_INDEX ||
 			op == client.OPCODE_COMMIT_CREATE_INDEX ||
 			op == client.OPCODE_REBALANCE_RUNNING {
@@ -310,6 +325,8 @@ func (m *LifecycleMgr) dispatchRequest(request *requestHolder, factory *message.
 	var err error = nil
 	var result []byte = nil
 
+	event := m.history.begin(op, key, content, fid)
+
 	switch op {
 	case client.OPCODE_CREATE_INDEX:
 		err = m.handleCreateIndexScheduledBuild(key, content, common.NewUserRequestContext())
@@ -353,7 +370,21 @@ func (m *LifecycleMgr) dispatchRequest(request *requestHolder, factory *message.
 		err = m.handleRebalanceRunning(content)
 	case client.OPCODE_CREATE_INDEX_DEFER_BUILD:
 		err = m.handleCreateIndex(key, content, common.NewUserRequestContext())
-	}
+	case client.OPCODE_BUILD_QUEUE:
+		result, err = m.buildQueue.handleRequest(content)
+	case client.OPCODE_UPDATE_AGGREGATE:
+		err = m.handleUpdateAggregate(content)
+	case client.OPCODE_CREATE_INDEX_REBUILD:
+		err = m.handleCreateIndex(key, content, common.NewRebuildRequestContext())
+	case client.OPCODE_SWAP_INDEX_INST:
+		err = m.handleSwapIndexInstance(content)
+	case client.OPCODE_UPDATE_MEM_QUOTA:
+		err = m.handleUpdateMemQuota(content)
+	case client.OPCODE_DDL_REQUESTER:
+		err = m.history.handleRequester(content)
+	}
+
+	m.history.end(event, err)
 
 	logging.Debugf("LifecycleMgr.dispatchRequest () : send response for requestId %d, op %d, len(result) %d", reqId, op, len(result))
 
@@ -626,6 +657,18 @@ func (m *LifecycleMgr) CreateIndexOrInstance(defn *common.IndexDefn, scheduled b
 
 	hasIndex := existDefn != nil && (defn.DefnId == existDefn.DefnId)
 	isPartitioned := common.IsPartitioned(defn.PartitionScheme)
+	isRebuild := reqCtx.ReqSource == common.DDLRequestSourceRebuild
+
+	// The instance of an index being rebuilt is created next to the existing
+	// instances of the index on this node.
+	if isRebuild {
+		if !hasIndex {
+			err := fmt.Errorf("Index %s.%s does not exist", defn.Bucket, defn.Name)
+			logging.Errorf("LifecycleMgr.handleCreateIndex() : createIndex fails. Reason = %v", err)
+			return err
+		}
+		return m.CreateIndexInstance(defn, scheduled, reqCtx)
+	}
 
 	if isPartitioned && hasIndex {
 		return m.CreateIndexInstance(defn, scheduled, reqCtx)
@@ -897,6 +940,11 @@ func (m *LifecycleMgr) verifyDuplicateDefn(defn *common.IndexDefn, reqCtx *commo
 		return nil, err
 	}
 
+	// An index being rebuilt has an instance on this node.
+	if existDefn != nil && reqCtx.ReqSource == common.DDLRequestSourceRebuild && existDefn.DefnId == defn.DefnId {
+		return existDefn, nil
+	}
+
 	if existDefn != nil {
 
 		topology, err := m.repo.GetTopologyByBucket(existDefn.Bucket)
@@ -1486,6 +1534,8 @@ func (m *LifecycleMgr) handleBroadcastStats(buf []byte) {
 		stats := make(common.Statistics)
 		if err := json.Unmarshal(buf, &stats); err == nil {
 
+			m.buildQueue.updateProgress(stats)
+
 			filtered := make(common.Statistics)
 			for key, value := range stats {
 				if strings.Contains(key, "num_docs_pending") ||
@@ -1598,6 +1648,122 @@ func (m *LifecycleMgr) handleConfigUpdate(content []byte) error {
 	}
 
 	m.builder.configUpdate(config)
+	m.history.configUpdate(config)
+	return nil
+}
+
+//-----------------------------------------------------------
+// Index Aggregates
+//-----------------------------------------------------------
+
+func (m *LifecycleMgr) handleUpdateAggregate(content []byte) error {
+
+	request, err := client.UnmarshallAggregateRequest(content)
+	if err != nil {
+		return err
+	}
+
+	defn, err := m.repo.GetIndexDefnById(request.DefnId)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.handleUpdateAggregate() : Failed to find index definition %v: %v", request.DefnId, err)
+		return err
+	}
+
+	if defn == nil {
+		return fmt.Errorf("Index Definition %v not found", request.DefnId)
+	}
+
+	var aggregates []*common.IndexAggregate
+	for _, aggr := range defn.Aggregates {
+		if aggr.Name != request.Name {
+			aggregates = append(aggregates, aggr)
+		}
+	}
+
+	switch request.Op {
+	case client.AGGREGATE_CREATE:
+		if len(aggregates) != len(defn.Aggregates) {
+			return fmt.Errorf("Aggregate %v already exists on index %v", request.Name, defn.Name)
+		}
+		if request.Aggregate == nil {
+			return fmt.Errorf("Aggregate is not specified")
+		}
+		if err := request.Aggregate.Validate(defn); err != nil {
+			return err
+		}
+		aggregates = append(aggregates, request.Aggregate)
+
+	case client.AGGREGATE_DROP:
+		if len(aggregates) == len(defn.Aggregates) {
+			return fmt.Errorf("Aggregate %v does not exist on index %v", request.Name, defn.Name)
+		}
+
+	default:
+		return fmt.Errorf("Unknown aggregate operation %v", request.Op)
+	}
+
+	newDefn := defn.Clone()
+	newDefn.Aggregates = aggregates
+	if err := m.repo.UpdateIndex(newDefn); err != nil {
+		logging.Errorf("LifecycleMgr.handleUpdateAggregate() : Failed to update index definition %v: %v", request.DefnId, err)
+		return err
+	}
+
+	logging.Infof("LifecycleMgr.handleUpdateAggregate() : %v aggregate %v of index %v", request.Op, request.Name, defn.DefnId)
+
+	if m.notifier != nil {
+		if err := m.notifier.OnIndexAggregates(defn.DefnId, aggregates); err != nil {
+			logging.Errorf("LifecycleMgr.handleUpdateAggregate() : Failed to notify indexer for index %v: %v", request.DefnId, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------
+// Index Memory Quota
+//-----------------------------------------------------------
+
+func (m *LifecycleMgr) handleUpdateMemQuota(content []byte) error {
+
+	request, err := client.UnmarshallMemQuotaRequest(content)
+	if err != nil {
+		return err
+	}
+
+	if !request.Priority.IsValid() {
+		return fmt.Errorf("Invalid index priority %v", request.Priority)
+	}
+
+	defn, err := m.repo.GetIndexDefnById(request.DefnId)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.handleUpdateMemQuota() : Failed to find index definition %v: %v", request.DefnId, err)
+		return err
+	}
+
+	if defn == nil {
+		return fmt.Errorf("Index Definition %v not found", request.DefnId)
+	}
+
+	newDefn := defn.Clone()
+	newDefn.MemQuota = request.MemQuota
+	newDefn.Priority = request.Priority
+	if err := m.repo.UpdateIndex(newDefn); err != nil {
+		logging.Errorf("LifecycleMgr.handleUpdateMemQuota() : Failed to update index definition %v: %v", request.DefnId, err)
+		return err
+	}
+
+	logging.Infof("LifecycleMgr.handleUpdateMemQuota() : index %v memory quota %v priority %v",
+		defn.DefnId, request.MemQuota, request.Priority)
+
+	if m.notifier != nil {
+		if err := m.notifier.OnIndexMemQuota(defn.DefnId, request.MemQuota, request.Priority); err != nil {
+			logging.Errorf("LifecycleMgr.handleUpdateMemQuota() : Failed to notify indexer for index %v: %v", request.DefnId, err)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -1637,6 +1803,14 @@ func (m *LifecycleMgr) CreateIndexInstance(defn *common.IndexDefn, scheduled boo
 
 	partitions, versions, numPartitions := m.setPartition(defn)
 
+	// An index is rebuilt by a proxy of the instance it rebuilds
+	isRebuild := reqCtx.ReqSource == common.DDLRequestSourceRebuild
+	if isRebuild && realInstId == 0 {
+		err := errors.New("Missing real instance id when rebuilding index")
+		logging.Errorf("LifecycleMgr.CreateIndexInstance() : CreateIndexInstance fails. Reason = %v", err)
+		return err
+	}
+
 	if realInstId != 0 {
 		realInst, err := m.FindLocalIndexInst(defn.Bucket, defn.DefnId, realInstId)
 		if err != nil {
@@ -1644,6 +1818,11 @@ func (m *LifecycleMgr) CreateIndexInstance(defn *common.IndexDefn, scheduled boo
 			return err
 		}
 		if realInst == nil {
+			if isRebuild {
+				err := fmt.Errorf("Index instance %v to rebuild does not exist", realInstId)
+				logging.Errorf("LifecycleMgr.CreateIndexInstance() : CreateIndexInstance fails. Reason = %v", err)
+				return err
+			}
 			instId = realInstId
 			realInstId = 0
 		}
@@ -1660,7 +1839,8 @@ func (m *LifecycleMgr) CreateIndexInstance(defn *common.IndexDefn, scheduled boo
 	// It is possible to create index of the same name later, as long as the new index has a different
 	// definition id, since an index is consider valid only if it has both index definiton and index instance.
 	// So the dangling index definition is considered invalid.
-	if err := m.repo.addInstanceToTopology(defn, instId, replicaId, partitions, versions, numPartitions, realInstId, !defn.Deferred && scheduled); err != nil {
+	if err := m.repo.addInstanceToTopology(defn, instId, replicaId, partitions, versions, numPartitions, realInstId, isRebuild,
+		!defn.Deferred && scheduled); err != nil {
 		logging.Errorf("LifecycleMgr.CreateIndexInstance() : CreateIndexInstance fails. Reason = %v", err)
 		return err
 	}
@@ -1973,6 +2153,59 @@ func (m *LifecycleMgr) MergePartition(id common.IndexDefnId, srcInstId common.In
 	return nil
 }
 
+//-----------------------------------------------------------
+// Swap Index Instance
+//-----------------------------------------------------------
+
+func (m *LifecycleMgr) handleSwapIndexInstance(content []byte) error {
+
+	change := new(swapIndexInst)
+	if err := json.Unmarshal(content, change); err != nil {
+		return err
+	}
+
+	return m.SwapIndexInstance(common.IndexDefnId(change.DefnId), common.IndexInstId(change.InstId),
+		common.IndexInstId(change.NewInstId))
+}
+
+//
+// SwapIndexInstance makes the proxy instance newInstId, which has rebuilt
+// instance instId of an index, an active instance of its own in place of
+// instId.  Both instances are updated in a single metadata update, so
+// clients see either one of them but never both or none.  The old instance
+// is left in REBAL_PENDING_DELETE state until it is dropped.
+//
+func (m *LifecycleMgr) SwapIndexInstance(id common.IndexDefnId, instId common.IndexInstId, newInstId common.IndexInstId) error {
+
+	logging.Infof("LifecycleMgr.SwapIndexInstance() : index defnId %v instance %v new instance %v", id, instId, newInstId)
+
+	defn, err := m.repo.GetIndexDefnById(id)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.SwapIndexInstance() : swap index instance fails for index defn %v.  Error = %v.", id, err)
+		return err
+	}
+	if defn == nil {
+		err := fmt.Errorf("Index %v does not exist", id)
+		logging.Errorf("LifecycleMgr.SwapIndexInstance() : swap index instance fails.  Error = %v.", err)
+		return err
+	}
+
+	for _, instId := range []common.IndexInstId{instId, newInstId} {
+		inst, err := m.FindLocalIndexInst(defn.Bucket, id, instId)
+		if err != nil {
+			logging.Errorf("LifecycleMgr.SwapIndexInstance() : Encountered error during swap index instance. Error = %v", err)
+			return err
+		}
+		if inst == nil {
+			err := fmt.Errorf("Index instance %v does not exist", instId)
+			logging.Errorf("LifecycleMgr.SwapIndexInstance() : swap index instance fails.  Error = %v.", err)
+			return err
+		}
+	}
+
+	return m.repo.swapInstanceInTopology(defn.Bucket, id, instId, newInstId)
+}
+
 //-----------------------------------------------------------
 // Prune Partition
 //-----------------------------------------------------------
@@ -2767,6 +3000,9 @@ func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
 func (s *builder) getQuota() (int32, map[string]bool) {
 
 	quota := atomic.LoadInt32(&s.batchSize)
+	if max := s.maxConcurrentBuilds(); max > 0 && (quota < 0 || max < quota) {
+		quota = max
+	}
 	skipList := make(map[string]bool)
 
 	metaIter, err := s.manager.repo.NewIterator()
@@ -2889,6 +3125,9 @@ func (s *builder) configUpdate(config *common.Config) {
 	newBatchSize := int32((*config)["settings.build.batch_size"].Int())
 	atomic.StoreInt32(&s.batchSize, newBatchSize)
 
+	maxConcurrent := int32((*config)["settings.build.max_concurrent"].Int())
+	atomic.StoreInt32(&s.maxConcurrent, maxConcurrent)
+
 	disable := (*config)["build.background.disable"].Bool()
 	if disable {
 		atomic.StoreInt32(&s.disable, int32(1))
@@ -2897,6 +3136,10 @@ func (s *builder) configUpdate(config *common.Config) {
 	}
 }
 
+func (s *builder) maxConcurrentBuilds() int32 {
+	return atomic.LoadInt32(&s.maxConcurrent)
+}
+
 func (s *builder) disableBuild() bool {
 
 	if atomic.LoadInt32(&s.disable) == 1 {
@@ -2909,10 +3152,11 @@ func (s *builder) disableBuild() bool {
 func newBuilder(mgr *LifecycleMgr) *builder {
 
 	builder := &builder{
-		manager:   mgr,
-		pendings:  make(map[string][]uint64),
-		notifych:  make(chan *common.IndexDefn, 10000),
-		batchSize: int32(common.SystemConfig["indexer.settings.build.batch_size"].Int()),
+		manager:       mgr,
+		pendings:      make(map[string][]uint64),
+		notifych:      make(chan *common.IndexDefn, 10000),
+		batchSize:     int32(common.SystemConfig["indexer.settings.build.batch_size"].Int()),
+		maxConcurrent: int32(common.SystemConfig["indexer.settings.build.max_concurrent"].Int()),
 	}
 
 	disable := common.SystemConfig["indexer.build.background.disable"].Bool()
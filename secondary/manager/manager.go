@@ -94,6 +94,8 @@ type MetadataNotifier interface {
 	OnIndexDelete(common.IndexInstId, string, *common.MetadataRequestContext) error
 	OnIndexBuild([]common.IndexInstId, []string, *common.MetadataRequestContext) map[common.IndexInstId]error
 	OnPartitionPrune(common.IndexInstId, []common.PartitionId, *common.MetadataRequestContext) error
+	OnIndexAggregates(common.IndexDefnId, []*common.IndexAggregate) error
+	OnIndexMemQuota(common.IndexDefnId, uint64, common.IndexPriority) error
 	OnFetchStats() error
 }
 
@@ -409,6 +411,22 @@ func (m *IndexManager) HandleCreateIndexDDL(defn *common.IndexDefn, isRebalReq b
 	return nil
 }
 
+//
+// HandleRebuildIndexDDL creates an instance of an existing index on this
+// node, to rebuild the index.  The instance is not visible to clients until
+// it is swapped with the instance it replaces.
+//
+func (m *IndexManager) HandleRebuildIndexDDL(defn *common.IndexDefn) error {
+
+	key := fmt.Sprintf("%d", defn.DefnId)
+	content, err := common.MarshallIndexDefn(defn)
+	if err != nil {
+		return err
+	}
+
+	return m.requestServer.MakeRequest(client.OPCODE_CREATE_INDEX_REBUILD, key, content)
+}
+
 func (m *IndexManager) HandleDeleteIndexDDL(defnId common.IndexDefnId) error {
 
 	key := fmt.Sprintf("%d", defnId)
@@ -545,6 +563,23 @@ func (m *IndexManager) MergePartition(defnId common.IndexDefnId, srcInstId commo
 	return m.requestServer.MakeRequest(client.OPCODE_MERGE_PARTITION, fmt.Sprintf("%v", defnId), buf)
 }
 
+func (m *IndexManager) SwapIndexInstance(defnId common.IndexDefnId, instId common.IndexInstId, newInstId common.IndexInstId) error {
+
+	inst := &swapIndexInst{
+		DefnId:    uint64(defnId),
+		InstId:    uint64(instId),
+		NewInstId: uint64(newInstId),
+	}
+
+	buf, e := json.Marshal(&inst)
+	if e != nil {
+		return e
+	}
+
+	logging.Debugf("IndexManager.SwapIndexInstance(): making request for swap index instance")
+	return m.requestServer.MakeRequest(client.OPCODE_SWAP_INDEX_INST, fmt.Sprintf("%v", defnId), buf)
+}
+
 func (m *IndexManager) ResetIndex(index common.IndexInst) error {
 
 	index.Pc = nil
@@ -1106,7 +1106,8 @@ func (m *MetadataRepo) addIndexToTopology(defn *common.IndexDefn, instId common.
 // Add Index to Topology
 //
 func (m *MetadataRepo) addInstanceToTopology(defn *common.IndexDefn, instId common.IndexInstId, replicaId int,
-	partitions []common.PartitionId, versions []int, numPartitions uint32, realInstId common.IndexInstId, scheduled bool) error {
+	partitions []common.PartitionId, versions []int, numPartitions uint32, realInstId common.IndexInstId, rebuild bool,
+	scheduled bool) error {
 
 	// get existing topology
 	topology, err := m.CloneTopologyByBucket(defn.Bucket)
@@ -1141,6 +1142,10 @@ func (m *MetadataRepo) addInstanceToTopology(defn *common.IndexDefn, instId comm
 			numPartitions, scheduled, string(defn.Using), uint64(realInstId))
 	}
 
+	if rebuild {
+		topology.UpdateRebuildForIndexInst(defn.DefnId, instId, true)
+	}
+
 	// Add a reference of the bucket-level topology to the global topology.
 	// If it fails later to create bucket-level topology, it will have
 	// a dangling reference, but it is easier to discover this issue.  Otherwise,
@@ -1229,6 +1234,32 @@ func (m *MetadataRepo) mergePartitionFromTopology(indexerId string, bucket strin
 	return nil
 }
 
+//
+// Swap an index instance with the proxy instance rebuilding it in Topology
+//
+func (m *MetadataRepo) swapInstanceInTopology(bucket string, id common.IndexDefnId, instId common.IndexInstId,
+	newInstId common.IndexInstId) error {
+
+	// get existing topology
+	topology, err := m.CloneTopologyByBucket(bucket)
+	if err != nil {
+		return err
+	}
+	if topology == nil {
+		return nil
+	}
+
+	if !topology.SwapRebuildIndexInst(id, instId, newInstId) {
+		return fmt.Errorf("Index instance %v is not rebuilding index instance %v", newInstId, instId)
+	}
+
+	if err = m.SetTopologyByBucket(topology.Bucket, topology); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 //
 // Split partitions from Topology
 //
@@ -20,8 +20,12 @@ import (
 	mc "github.com/couchbase/indexing/secondary/manager/common"
 	"github.com/couchbase/indexing/secondary/planner"
 	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -74,7 +78,8 @@ type LocalIndexMetadata struct {
 }
 
 type ClusterIndexMetadata struct {
-	Metadata []LocalIndexMetadata `json:"metadata,omitempty"`
+	Metadata []LocalIndexMetadata         `json:"metadata,omitempty"`
+	Data     []common.IndexBackupManifest `json:"data,omitempty"`
 }
 
 type BackupResponse struct {
@@ -85,9 +90,19 @@ type BackupResponse struct {
 }
 
 type RestoreResponse struct {
-	Version uint64 `json:"version,omitempty"`
-	Code    string `json:"code,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Version uint64                `json:"version,omitempty"`
+	Code    string                `json:"code,omitempty"`
+	Error   string                `json:"error,omitempty"`
+	Report  []*RestoreIndexReport `json:"report,omitempty"`
+}
+
+type RestoreDataResponse struct {
+	Version  uint64                `json:"version,omitempty"`
+	Code     string                `json:"code,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Restored []string              `json:"restored,omitempty"`
+	Deferred []string              `json:"deferred,omitempty"`
+	Report   []*RestoreIndexReport `json:"report,omitempty"`
 }
 
 //
@@ -161,16 +176,23 @@ func registerRequestHandler(mgr *IndexManager, clusterUrl string) {
 
 		http.HandleFunc("/createIndex", handlerContext.createIndexRequest)
 		http.HandleFunc("/createIndexRebalance", handlerContext.createIndexRequestRebalance)
+		http.HandleFunc("/createIndexRebuild", handlerContext.createIndexRequestRebuild)
 		http.HandleFunc("/dropIndex", handlerContext.dropIndexRequest)
 		http.HandleFunc("/buildIndex", handlerContext.buildIndexRequest)
 		http.HandleFunc("/getLocalIndexMetadata", handlerContext.handleLocalIndexMetadataRequest)
 		http.HandleFunc("/getIndexMetadata", handlerContext.handleIndexMetadataRequest)
 		http.HandleFunc("/restoreIndexMetadata", handlerContext.handleRestoreIndexMetadataRequest)
+		http.HandleFunc("/backupIndexData", handlerContext.handleBackupIndexDataRequest)
+		http.HandleFunc("/restoreIndexData", handlerContext.handleRestoreIndexDataRequest)
 		http.HandleFunc("/getIndexStatus", handlerContext.handleIndexStatusRequest)
 		http.HandleFunc("/getIndexStatement", handlerContext.handleIndexStatementRequest)
 		http.HandleFunc("/planIndex", handlerContext.handleIndexPlanRequest)
 		http.HandleFunc("/settings/storageMode", handlerContext.handleIndexStorageModeRequest)
 		http.HandleFunc("/settings/planner", handlerContext.handlePlannerRequest)
+		http.HandleFunc("/buildQueue", handlerContext.handleBuildQueueRequest)
+		http.HandleFunc("/getIndexHistory", handlerContext.handleIndexHistoryRequest)
+		http.HandleFunc("/getLocalIndexHistory", handlerContext.handleLocalIndexHistoryRequest)
+		http.HandleFunc("/getIndexRecommendations", handlerContext.handleIndexRecommendationRequest)
 	})
 
 	handlerContext.mgr = mgr
@@ -193,6 +215,42 @@ func (m *requestHandlerContext) createIndexRequestRebalance(w http.ResponseWrite
 
 }
 
+func (m *requestHandlerContext) createIndexRequestRebuild(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	// convert request
+	request := m.convertIndexRequest(r)
+	if request == nil {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Unable to convert request for rebuild index")
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", request.Index.Bucket)
+	if !isAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	indexDefn := request.Index
+	if indexDefn.DefnId == 0 || indexDefn.InstId == 0 {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Missing index defn id or inst id for rebuild index")
+		return
+	}
+
+	defer m.expectDDL([]common.IndexDefnId{indexDefn.DefnId}, creds, r)()
+
+	if err := m.mgr.HandleRebuildIndexDDL(&indexDefn); err == nil {
+		// No error, return success
+		sendIndexResponse(w)
+	} else {
+		// report failure
+		sendIndexResponseWithError(http.StatusInternalServerError, w, fmt.Sprintf("%v", err))
+	}
+}
+
 func (m *requestHandlerContext) doCreateIndex(w http.ResponseWriter, r *http.Request, isRebalReq bool) {
 
 	creds, ok := doAuth(r, w)
@@ -230,6 +288,8 @@ func (m *requestHandlerContext) doCreateIndex(w http.ResponseWriter, r *http.Req
 		}
 	}
 
+	defer m.expectDDL([]common.IndexDefnId{indexDefn.DefnId}, creds, r)()
+
 	// call the index manager to handle the DDL
 	logging.Debugf("RequestHandler::createIndexRequest: invoke IndexManager for create index bucket %s name %s",
 		indexDefn.Bucket, indexDefn.Name)
@@ -265,6 +325,7 @@ func (m *requestHandlerContext) dropIndexRequest(w http.ResponseWriter, r *http.
 
 	// call the index manager to handle the DDL
 	indexDefn := request.Index
+	defer m.expectDDL([]common.IndexDefnId{indexDefn.DefnId}, creds, r)()
 
 	if indexDefn.RealInstId == 0 {
 		if err := m.mgr.HandleDeleteIndexDDL(indexDefn.DefnId); err == nil {
@@ -309,6 +370,12 @@ func (m *requestHandlerContext) buildIndexRequest(w http.ResponseWriter, r *http
 
 	// call the index manager to handle the DDL
 	indexIds := request.IndexIds
+	ids := make([]common.IndexDefnId, len(indexIds.DefnIds))
+	for i, id := range indexIds.DefnIds {
+		ids[i] = common.IndexDefnId(id)
+	}
+	defer m.expectDDL(ids, creds, r)()
+
 	if err := m.mgr.HandleBuildIndexDDL(indexIds); err == nil {
 		// No error, return success
 		sendIndexResponse(w)
@@ -895,6 +962,9 @@ func (m *requestHandlerContext) getLocalIndexMetadata(creds cbauth.Creds, bucket
 // 3) Index defn is deleted or missing in current repository.  Index Defn restored from backup if bucket exists.
 //    - Index defn of the same <bucket, name> exists.   It will rename the index to <index name>_restore_<seqNo>
 //    - Bucket does not exist.   It will restore an index defn with a non-existent bucket.
+// 4) Request parameters can select the indexes to restore, restore them onto another bucket, rename them,
+//    and override their number of replica and placement (see parseRestoreOptions).  With dryRun, the
+//    indexes to be created are reported without creating them.
 //
 func (m *requestHandlerContext) handleRestoreIndexMetadataRequest(w http.ResponseWriter, r *http.Request) {
 
@@ -903,6 +973,12 @@ func (m *requestHandlerContext) handleRestoreIndexMetadataRequest(w http.Respons
 		return
 	}
 
+	options, err := parseRestoreOptions(r.URL.Query())
+	if err != nil {
+		send(http.StatusBadRequest, w, &RestoreResponse{Code: RESP_ERROR, Error: err.Error()})
+		return
+	}
+
 	// convert backup image into runtime data structure
 	image := m.convertIndexMetadataRequest(r)
 	if image == nil {
@@ -910,38 +986,66 @@ func (m *requestHandlerContext) handleRestoreIndexMetadataRequest(w http.Respons
 		return
 	}
 
-	for _, localMeta := range image.Metadata {
-		for _, topology := range localMeta.IndexTopologies {
-			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!create", topology.Bucket)
-			if !isAllowed(creds, []string{permission}, w) {
-				return
-			}
-		}
-
-		for _, defn := range localMeta.IndexDefinitions {
-			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!create", defn.Bucket)
-			if !isAllowed(creds, []string{permission}, w) {
-				return
-			}
-		}
+	if !m.isRestoreAllowed(creds, image, options, w) {
+		return
 	}
 
 	// Restore
-	context := createRestoreContext(image, m.clusterUrl)
+	context := createRestoreContext(image, m.clusterUrl, options)
 	hostIndexMap, err := context.computeIndexLayout()
 	if err != nil {
 		send(http.StatusInternalServerError, w, &RestoreResponse{Code: RESP_ERROR, Error: fmt.Sprintf("Unable to restore metadata.  Error=%v", err)})
+		return
+	}
+
+	report := context.buildReport(hostIndexMap)
+	if options.DryRun {
+		send(http.StatusOK, w, &RestoreResponse{Code: RESP_SUCCESS, Report: report})
+		return
 	}
 
 	for host, indexes := range hostIndexMap {
 		for _, index := range indexes {
 			if !m.makeCreateIndexRequest(*index, host) {
 				send(http.StatusInternalServerError, w, &RestoreResponse{Code: RESP_ERROR, Error: "Unable to restore metadata."})
+				return
 			}
 		}
 	}
 
-	send(http.StatusOK, w, &RestoreResponse{Code: RESP_SUCCESS})
+	send(http.StatusOK, w, &RestoreResponse{Code: RESP_SUCCESS, Report: report})
+}
+
+//
+// Check if the user can create all indexes in the backup image that are
+// selected by restore options, on the bucket they are restored onto.
+//
+func (m *requestHandlerContext) isRestoreAllowed(creds cbauth.Creds, image *ClusterIndexMetadata, options *RestoreOptions,
+	w http.ResponseWriter) bool {
+
+	for _, localMeta := range image.Metadata {
+		for _, topology := range localMeta.IndexTopologies {
+			if !options.selectBucket(topology.Bucket) {
+				continue
+			}
+			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!create", options.targetBucket(topology.Bucket))
+			if !isAllowed(creds, []string{permission}, w) {
+				return false
+			}
+		}
+
+		for _, defn := range localMeta.IndexDefinitions {
+			if !options.selectIndex(&defn) {
+				continue
+			}
+			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!create", options.targetBucket(defn.Bucket))
+			if !isAllowed(creds, []string{permission}, w) {
+				return false
+			}
+		}
+	}
+
+	return true
 }
 
 func (m *requestHandlerContext) makeCreateIndexRequest(defn common.IndexDefn, host string) bool {
@@ -975,6 +1079,353 @@ func (m *requestHandlerContext) makeCreateIndexRequest(defn common.IndexDefn, ho
 	return true
 }
 
+///////////////////////////////////////////////////////
+// Backup / Restore Index Data
+///////////////////////////////////////////////////////
+
+//
+// Backup index metadata, along with the persisted snapshot of each index
+// partition.  Each index node copies its partitions to <dir>/<nodeUUID>
+// on its local disk.  The response is the metadata backup image, with
+// the manifest of the data backed up by each node.
+//
+func (m *requestHandlerContext) handleBackupIndexDataRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		sendHttpError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// data is written to the disk of every index node
+	if !isAllowed(creds, []string{"cluster.settings!write"}, w) {
+		return
+	}
+
+	dir := r.FormValue("dir")
+	if !filepath.IsAbs(dir) {
+		send(http.StatusBadRequest, w, &BackupResponse{Code: RESP_ERROR, Error: "Backup dir must be an absolute path"})
+		return
+	}
+
+	bucket := m.getBucket(r)
+
+	meta, err := m.getIndexMetadata(creds, bucket)
+	if err == nil {
+		meta.Data, err = m.backupIndexData(filepath.Clean(dir), bucket)
+	}
+
+	if err == nil {
+		resp := &BackupResponse{Code: RESP_SUCCESS, Result: *meta}
+		send(http.StatusOK, w, resp)
+	} else {
+		logging.Errorf("RequestHandler::handleBackupIndexDataRequest: err %v", err)
+		resp := &BackupResponse{Code: RESP_ERROR, Error: err.Error()}
+		send(http.StatusInternalServerError, w, resp)
+	}
+}
+
+func (m *requestHandlerContext) backupIndexData(dir string, bucket string) ([]common.IndexBackupManifest, error) {
+
+	cinfo, err := m.mgr.FetchNewClusterInfoCache()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("dir", dir)
+	if len(bucket) != 0 {
+		params.Set("bucket", bucket)
+	}
+
+	// find all nodes that has a index http service
+	nids := cinfo.GetNodesByServiceType(common.INDEX_HTTP_SERVICE)
+
+	manifests := make([]common.IndexBackupManifest, len(nids))
+	errs := make([]error, len(nids))
+
+	var wg sync.WaitGroup
+	for i, nid := range nids {
+
+		addr, err := cinfo.GetServiceAddress(nid, common.INDEX_HTTP_SERVICE)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Fail to retrieve http endpoint for index node"))
+		}
+
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+
+			// backup of large indexes can take long
+			resp, err := postWithAuthTimeout(addr+"/backupLocalIndexData?"+params.Encode(), "text/plain", nil, 0)
+			if err == nil {
+				err = convertDataResponse(resp, &manifests[i])
+			}
+			if err != nil {
+				errs[i] = errors.New(fmt.Sprintf("Fail to backup index data on %v: %v", addr, err))
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return manifests, nil
+}
+
+//
+// Restore index metadata and data from a backup of index data.  Indexes
+// are placed the same way as restoreIndexMetadata.  For each index whose
+// partitions have all been backed up, the destination node installs the
+// backed up snapshots before the index is created.  These indexes are then
+// built, catching up from DCP from the restored snapshots.  Other indexes
+// are restored as deferred indexes.  This takes the same restore options
+// as restoreIndexMetadata.  Indexes restored onto another bucket are built
+// from scratch.
+//
+func (m *requestHandlerContext) handleRestoreIndexDataRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		sendHttpError(w, "Unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAllowed(creds, []string{"cluster.settings!write"}, w) {
+		return
+	}
+
+	options, err := parseRestoreOptions(r.URL.Query())
+	if err != nil {
+		send(http.StatusBadRequest, w, &RestoreDataResponse{Code: RESP_ERROR, Error: err.Error()})
+		return
+	}
+
+	image := m.convertIndexMetadataRequest(r)
+	if image == nil {
+		send(http.StatusBadRequest, w, &RestoreDataResponse{Code: RESP_ERROR, Error: "Unable to process request input"})
+		return
+	}
+
+	if !m.isRestoreAllowed(creds, image, options, w) {
+		return
+	}
+
+	cinfo, err := m.mgr.FetchNewClusterInfoCache()
+	if err != nil {
+		send(http.StatusInternalServerError, w, &RestoreDataResponse{Code: RESP_ERROR, Error: err.Error()})
+		return
+	}
+
+	context := createRestoreContext(image, m.clusterUrl, options)
+	hostIndexMap, err := context.computeIndexLayout()
+	if err != nil {
+		send(http.StatusInternalServerError, w, &RestoreDataResponse{Code: RESP_ERROR, Error: fmt.Sprintf("Unable to restore metadata.  Error=%v", err)})
+		return
+	}
+
+	report := context.buildReport(hostIndexMap)
+	result := &RestoreDataResponse{Code: RESP_SUCCESS, Report: report}
+
+	if options.DryRun {
+		for _, entry := range report {
+			for _, index := range hostIndexMap[entry.Host] {
+				if index.DefnId == entry.DefnId && index.ReplicaId == entry.ReplicaId {
+					defn := *index
+					entry.Data = m.makeRestoreDataRequest(context, image, cinfo, &defn) != nil
+				}
+			}
+		}
+		send(http.StatusOK, w, result)
+		return
+	}
+
+	for host, indexes := range hostIndexMap {
+
+		var defnIds []uint64
+		for _, index := range indexes {
+
+			defn := *index
+			name := fmt.Sprintf("%v:%v (replica %v)", defn.Bucket, defn.Name, defn.ReplicaId)
+
+			request := m.makeRestoreDataRequest(context, image, cinfo, &defn)
+			if request != nil {
+				if !m.makeRestoreDataRequestToHost(request, host, false) {
+					request = nil
+					defn.InstId = 0
+				}
+			}
+
+			if !m.makeCreateIndexRequest(defn, host) {
+				if request != nil {
+					m.makeRestoreDataRequestToHost(request, host, true)
+				}
+				result.Code = RESP_ERROR
+				result.Error = fmt.Sprintf("Unable to restore index %v.", name)
+				send(http.StatusInternalServerError, w, result)
+				return
+			}
+
+			if request != nil {
+				defnIds = append(defnIds, uint64(defn.DefnId))
+				result.Restored = append(result.Restored, name)
+				for _, entry := range report {
+					if entry.Host == host && entry.DefnId == defn.DefnId && entry.ReplicaId == defn.ReplicaId {
+						entry.Data = true
+					}
+				}
+			} else {
+				result.Deferred = append(result.Deferred, name)
+			}
+		}
+
+		if len(defnIds) != 0 && !m.makeBuildIndexRequest(defnIds, host) {
+			result.Code = RESP_ERROR
+			result.Error = fmt.Sprintf("Unable to build restored indexes on %v.", host)
+			send(http.StatusInternalServerError, w, result)
+			return
+		}
+	}
+
+	send(http.StatusOK, w, result)
+}
+
+//
+// Find the backed up data for all partitions of defn on its destination.
+// Return nil if any partition is missing or bucket has been recreated, in
+// which case the index needs to be built from scratch.  This assigns the
+// instance id of the index to create.
+//
+func (m *requestHandlerContext) makeRestoreDataRequest(context *RestoreContext, image *ClusterIndexMetadata,
+	cinfo *common.ClusterInfoCache, defn *common.IndexDefn) *common.IndexRestoreRequest {
+
+	request := &common.IndexRestoreRequest{}
+
+	for _, partnId := range defn.Partitions {
+
+		indexerId, instId, ok := context.findRestoreSource(defn, partnId)
+		if !ok {
+			return nil
+		}
+
+		nodeUUID := ""
+		for _, localMeta := range image.Metadata {
+			if common.IndexerId(localMeta.IndexerId) == indexerId {
+				nodeUUID = localMeta.NodeUUID
+			}
+		}
+
+		var source *common.IndexRestorePartition
+		for _, manifest := range image.Data {
+			if manifest.NodeUUID != nodeUUID {
+				continue
+			}
+			for _, partn := range manifest.Partitions {
+				if partn.InstId == instId && partn.PartnId == partnId {
+					request.StorageMode = manifest.StorageMode
+					source = &common.IndexRestorePartition{NodeUUID: nodeUUID, Dir: manifest.Dir, Partition: partn}
+				}
+			}
+		}
+
+		if source == nil {
+			logging.Infof("RequestHandler::makeRestoreDataRequest: No backup data for index (%v, %v, %v, %v).",
+				defn.Bucket, defn.Name, defn.ReplicaId, partnId)
+			return nil
+		}
+
+		if bucketUUID := cinfo.GetBucketUUID(defn.Bucket); source.Partition.BucketUUID != bucketUUID {
+			logging.Infof("RequestHandler::makeRestoreDataRequest: Bucket %v has changed since backup.  Index %v "+
+				"will be built from scratch.", defn.Bucket, defn.Name)
+			return nil
+		}
+
+		request.Partitions = append(request.Partitions, *source)
+	}
+
+	if len(request.Partitions) == 0 {
+		return nil
+	}
+
+	instId, err := common.NewIndexInstId()
+	if err != nil {
+		logging.Errorf("RequestHandler::makeRestoreDataRequest: fail to generate index instance id %v", err)
+		return nil
+	}
+	defn.InstId = instId
+	request.Defn = *defn
+
+	return request
+}
+
+//
+// Ask the destination node to install (or remove, if cancel) backed up data
+// of an index.
+//
+func (m *requestHandlerContext) makeRestoreDataRequestToHost(request *common.IndexRestoreRequest, host string, cancel bool) bool {
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		logging.Errorf("RequestHandler::makeRestoreDataRequestToHost: cannot marshall restore request %v", err)
+		return false
+	}
+
+	url := host + "/restoreLocalIndexData"
+	if cancel {
+		url += "?cancel=true"
+	}
+
+	resp, err := postWithAuthTimeout(url, "application/json", bytes.NewBuffer(body), 0)
+	if err == nil {
+		err = convertDataResponse(resp, nil)
+	}
+	if err != nil {
+		logging.Errorf("RequestHandler::makeRestoreDataRequestToHost: restore data of index (%v, %v) on %v fails. Error=%v",
+			request.Defn.Bucket, request.Defn.Name, host, err)
+		return false
+	}
+
+	return true
+}
+
+func (m *requestHandlerContext) makeBuildIndexRequest(defnIds []uint64, host string) bool {
+
+	req := IndexRequest{Version: uint64(1), Type: BUILD, IndexIds: client.IndexIdList{DefnIds: defnIds}}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		logging.Errorf("requestHandler.makeBuildIndexRequest(): cannot marshall build index request %v", err)
+		return false
+	}
+
+	resp, err := postWithAuth(host+"/buildIndex", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		logging.Errorf("requestHandler.makeBuildIndexRequest(): build index request fails for %v/buildIndex. Error=%v", host, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	response := new(IndexResponse)
+	status := convertResponse(resp, response)
+	if status == RESP_ERROR || response.Code == RESP_ERROR {
+		logging.Errorf("requestHandler.makeBuildIndexRequest(): build index request fails. Error=%v", response.Error)
+		return false
+	}
+
+	return true
+}
+
 //////////////////////////////////////////////////////
 // Planner
 ///////////////////////////////////////////////////////
@@ -1121,6 +1572,225 @@ func (m *requestHandlerContext) handlePlannerRequest(w http.ResponseWriter, r *h
 	}
 }
 
+///////////////////////////////////////////////////////
+// Build Queue
+///////////////////////////////////////////////////////
+
+//
+// GET lists the build queue of the local indexer, with build progress of
+// the indexes being built.  POST takes a BuildQueueRequest to enqueue,
+// pause, resume, cancel or re-prioritize index builds on the local indexer.
+//
+func (m *requestHandlerContext) handleBuildQueueRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(r.Body); err != nil {
+			sendHttpError(w, "Unable to read request body", http.StatusBadRequest)
+			return
+		}
+
+		request, err := client.UnmarshallBuildQueueRequest(buf.Bytes())
+		if err != nil {
+			sendHttpError(w, "Unable to unmarshall build queue request", http.StatusBadRequest)
+			return
+		}
+
+		permissions := []string{"cluster.settings!write"}
+		if len(request.DefnIds) != 0 {
+			permissions = nil
+			for _, id := range request.DefnIds {
+				defn, err := m.mgr.GetIndexDefnById(common.IndexDefnId(id))
+				if err != nil || defn == nil {
+					sendHttpError(w, fmt.Sprintf("Index %v not found", id), http.StatusBadRequest)
+					return
+				}
+				permissions = append(permissions, fmt.Sprintf("cluster.bucket[%s].n1ql.index!build", defn.Bucket))
+			}
+		}
+		// request must be allowed on every bucket
+		for _, permission := range permissions {
+			if !isAllowed(creds, []string{permission}, w) {
+				return
+			}
+		}
+
+		if err := m.mgr.requestServer.MakeRequest(client.OPCODE_BUILD_QUEUE, "Build Queue", buf.Bytes()); err != nil {
+			sendHttpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	queue := m.mgr.lifecycleMgr.buildQueue
+	queue.load()
+	status := queue.getStatus()
+
+	entries := status.Entries
+	status.Entries = nil
+	for _, entry := range entries {
+		permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!list", entry.Bucket)
+		if isAllowed(creds, []string{permission}, nil) {
+			status.Entries = append(status.Entries, entry)
+		}
+	}
+
+	send(http.StatusOK, w, status)
+}
+
+///////////////////////////////////////////////////////
+// DDL History
+///////////////////////////////////////////////////////
+
+//
+// Register the user of a DDL request, so it is recorded in DDL history
+// of this node.
+//
+func (m *requestHandlerContext) expectDDL(ids []common.IndexDefnId, creds cbauth.Creds, r *http.Request) func() {
+
+	source := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+
+	return m.mgr.lifecycleMgr.history.expect(ids, creds.Name(), source)
+}
+
+//
+// GET returns a page of DDL history from all indexer nodes, newest first.
+// Query parameters bucket, index, defnId and event filter the history.
+// Parameters offset and limit select the page.
+//
+func (m *requestHandlerContext) handleIndexHistoryRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	request, err := client.ParseDDLHistoryRequest(r.URL.Query())
+	if err != nil {
+		sendHttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Limit == 0 {
+		request.Limit = DDL_HISTORY_PAGE_SIZE
+	}
+
+	entries, failedNodes, err := m.getIndexHistory(creds, request)
+	if err != nil {
+		resp := &client.DDLHistoryResponse{Code: RESP_ERROR, Error: err.Error()}
+		send(http.StatusInternalServerError, w, resp)
+		return
+	}
+
+	resp := &client.DDLHistoryResponse{
+		Code:        RESP_SUCCESS,
+		FailedNodes: failedNodes,
+		Total:       len(entries),
+		Offset:      request.Offset,
+		Entries:     pageDDLHistory(entries, request.Offset, request.Limit),
+	}
+	send(http.StatusOK, w, resp)
+}
+
+func (m *requestHandlerContext) getIndexHistory(creds cbauth.Creds,
+	request *client.DDLHistoryRequest) ([]*client.DDLHistoryEntry, []string, error) {
+
+	cinfo := m.mgr.cinfoClient.GetClusterInfoCache()
+	if cinfo == nil {
+		return nil, nil, errors.New("ClusterInfoCache unavailable in IndexManager")
+	}
+
+	cinfo.RLock()
+	defer cinfo.RUnlock()
+
+	// Each node returns its full history matching the filter, since
+	// entries the user cannot list are only removed here.
+	local := *request
+	local.Offset = 0
+	local.Limit = 0
+	query := local.Values().Encode()
+
+	var entries []*client.DDLHistoryEntry
+	failedNodes := make([]string, 0)
+
+	nids := cinfo.GetNodesByServiceType(common.INDEX_HTTP_SERVICE)
+	for _, nid := range nids {
+
+		addr, err := cinfo.GetServiceAddress(nid, common.INDEX_HTTP_SERVICE)
+		if err != nil {
+			logging.Debugf("RequestHandler::getIndexHistory: Error from GetServiceAddress for node id %v. Error = %v", nid, err)
+			continue
+		}
+
+		resp, err := getWithAuth(addr + "/getLocalIndexHistory?" + query)
+		if err != nil {
+			logging.Debugf("RequestHandler::getIndexHistory: Error while retrieving %v with auth %v", addr+"/getLocalIndexHistory", err)
+			failedNodes = append(failedNodes, addr)
+			continue
+		}
+		defer resp.Body.Close()
+
+		localHistory := new(client.DDLHistoryResponse)
+		status := convertResponse(resp, localHistory)
+		if status == RESP_ERROR || localHistory.Code == RESP_ERROR {
+			logging.Debugf("RequestHandler::getIndexHistory: Error from convertResponse for node %v: %v", addr, localHistory.Error)
+			failedNodes = append(failedNodes, addr)
+			continue
+		}
+
+		for _, entry := range localHistory.Entries {
+			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!list", entry.Bucket)
+			if isAllowed(creds, []string{permission}, nil) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	sortDDLHistory(entries)
+
+	return entries, failedNodes, nil
+}
+
+//
+// GET returns a page of DDL history of the local indexer, newest first.
+//
+func (m *requestHandlerContext) handleLocalIndexHistoryRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	request, err := client.ParseDDLHistoryRequest(r.URL.Query())
+	if err != nil {
+		sendHttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []*client.DDLHistoryEntry
+	for _, entry := range m.mgr.lifecycleMgr.history.query(request) {
+		permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!list", entry.Bucket)
+		if isAllowed(creds, []string{permission}, nil) {
+			entries = append(entries, entry)
+		}
+	}
+
+	resp := &client.DDLHistoryResponse{
+		Code:    RESP_SUCCESS,
+		Total:   len(entries),
+		Offset:  request.Offset,
+		Entries: pageDDLHistory(entries, request.Offset, request.Limit),
+	}
+	send(http.StatusOK, w, resp)
+}
+
 ///////////////////////////////////////////////////////
 // Utility
 ///////////////////////////////////////////////////////
@@ -1233,6 +1903,13 @@ func getWithAuth(url string) (*http.Response, error) {
 }
 
 func postWithAuth(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	return postWithAuthTimeout(url, bodyType, body, time.Duration(10*time.Second))
+}
+
+//
+// Post with the given timeout.  There is no timeout if it is 0.
+//
+func postWithAuthTimeout(url string, bodyType string, body io.Reader, timeout time.Duration) (*http.Response, error) {
 
 	if !strings.HasPrefix(url, "http://") {
 		url = "http://" + url
@@ -1245,10 +1922,32 @@ func postWithAuth(url string, bodyType string, body io.Reader) (*http.Response,
 	req.Header.Set("Content-Type", bodyType)
 	cbauth.SetRequestAuthVia(req, nil)
 
-	client := http.Client{Timeout: time.Duration(10 * time.Second)}
+	client := http.Client{Timeout: timeout}
 	return client.Do(req)
 }
 
+//
+// Convert response from the indexer service of an index node, which reports
+// errors in plain text.
+//
+func convertDataResponse(r *http.Response, resp interface{}) error {
+	defer r.Body.Close()
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("%v %s", r.Status, strings.TrimSpace(string(buf))))
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, resp)
+}
+
 func findTopologyByBucket(topologies []IndexTopology, bucket string) *IndexTopology {
 
 	for _, topology := range topologies {
@@ -15,6 +15,11 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/planner"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -29,6 +34,54 @@ type RestoreContext struct {
 	idxFromImage map[common.IndexerId][]*planner.IndexUsage
 	idxToRestore map[common.IndexerId][]*planner.IndexUsage
 	indexerMap   map[common.IndexerId]common.IndexerId
+	sources      map[string]restoreSource
+	options      *RestoreOptions
+	origins      map[*planner.IndexUsage]string
+	excludes     []*planner.IndexerNode
+}
+
+//
+// Index partition in the image that is restored as a partition of a new
+// index definition.
+//
+type restoreSource struct {
+	indexerId common.IndexerId
+	instId    common.IndexInstId
+	origin    string
+}
+
+//
+// Options to select, rename and place the indexes in the image.  Indexes
+// are selected by their bucket, name and tags in the image.
+//
+type RestoreOptions struct {
+	Buckets      []string          // restore indexes of these buckets only
+	IndexPattern *regexp.Regexp    // restore indexes with matching name only
+	Tags         []string          // restore indexes with any of these tags only
+	BucketMap    map[string]string // restore indexes of bucket onto another bucket
+	Rename       map[string]string // rename index
+	Prefix       string            // prefix of restored index names
+	NumReplica   int               // number of replica, or -1 to keep the image
+	Nodes        []string          // place restored indexes on these nodes only
+	StorageMode  map[string]string // index type to create for storage mode in image
+	DryRun       bool              // report restored indexes without creating them
+}
+
+//
+// An index (replica) to be created by restore.
+//
+type RestoreIndexReport struct {
+	Host       string               `json:"host"`
+	DefnId     common.IndexDefnId   `json:"defnId"`
+	Bucket     string               `json:"bucket"`
+	Name       string               `json:"name"`
+	Source     string               `json:"source,omitempty"`
+	ReplicaId  int                  `json:"replicaId"`
+	NumReplica uint32               `json:"numReplica"`
+	Partitions []common.PartitionId `json:"partitions,omitempty"`
+	Using      common.IndexType     `json:"using,omitempty"`
+	Nodes      []string             `json:"nodes,omitempty"`
+	Data       bool                 `json:"data,omitempty"`
 }
 
 //////////////////////////////////////////////////////////////
@@ -38,7 +91,11 @@ type RestoreContext struct {
 //
 // Initialize restore context
 //
-func createRestoreContext(image *ClusterIndexMetadata, clusterUrl string) *RestoreContext {
+func createRestoreContext(image *ClusterIndexMetadata, clusterUrl string, options *RestoreOptions) *RestoreContext {
+
+	if options == nil {
+		options = &RestoreOptions{NumReplica: -1}
+	}
 
 	context := &RestoreContext{
 		clusterUrl:   clusterUrl,
@@ -46,6 +103,9 @@ func createRestoreContext(image *ClusterIndexMetadata, clusterUrl string) *Resto
 		idxFromImage: make(map[common.IndexerId][]*planner.IndexUsage),
 		idxToRestore: make(map[common.IndexerId][]*planner.IndexUsage),
 		indexerMap:   make(map[common.IndexerId]common.IndexerId),
+		sources:      make(map[string]restoreSource),
+		options:      options,
+		origins:      make(map[*planner.IndexUsage]string),
 	}
 
 	return context
@@ -67,6 +127,11 @@ func (m *RestoreContext) computeIndexLayout() (map[string][]*common.IndexDefn, e
 	// cleanse the image
 	m.cleanseBackupMetadata()
 
+	// select, rename and add replica according to restore options
+	if err := m.applyOptions(); err != nil {
+		return nil, err
+	}
+
 	// Fetch the index layout from current cluster
 	current, err := planner.RetrievePlanFromCluster(m.clusterUrl, nil)
 	if err != nil {
@@ -74,6 +139,11 @@ func (m *RestoreContext) computeIndexLayout() (map[string][]*common.IndexDefn, e
 	}
 	m.current = current
 
+	// restrict the nodes that can take restored indexes
+	if err := m.restrictPlacement(); err != nil {
+		return nil, err
+	}
+
 	// find index to restore
 	m.findIndexToRestore()
 
@@ -90,7 +160,8 @@ func (m *RestoreContext) computeIndexLayout() (map[string][]*common.IndexDefn, e
 }
 
 //
-// Convert storage mode of index to cluster storage mode
+// Convert storage mode of index to cluster storage mode, unless restore
+// options map the storage mode of the index in the image to another index type.
 //
 func (m *RestoreContext) convertStorageMode() error {
 
@@ -98,7 +169,19 @@ func (m *RestoreContext) convertStorageMode() error {
 		meta := &m.image.Metadata[i]
 		for j, _ := range meta.IndexDefinitions {
 			defn := &meta.IndexDefinitions[j]
-			defn.Using = "gsi"
+
+			storageMode := meta.StorageMode
+			if len(storageMode) == 0 {
+				storageMode = string(defn.Using)
+			}
+
+			if using, ok := m.options.StorageMode[strings.ToLower(storageMode)]; ok {
+				logging.Infof("RestoreContext:  Restore index (%v, %v) with storage mode %v as %v.",
+					defn.Bucket, defn.Name, storageMode, using)
+				defn.Using = common.IndexType(using)
+			} else {
+				defn.Using = "gsi"
+			}
 		}
 	}
 
@@ -189,6 +272,184 @@ func (m *RestoreContext) cleanseBackupMetadata() {
 	}
 }
 
+//
+// Select the indexes to restore, and restore them onto the bucket and with
+// the name and number of replica given in the restore options.
+//
+func (m *RestoreContext) applyOptions() error {
+
+	targets := make(map[string]common.IndexDefnId)
+
+	for indexerId, indexes := range m.idxFromImage {
+		newIndexes := ([]*planner.IndexUsage)(nil)
+
+		for _, index := range indexes {
+
+			if !m.options.selectIndex(&index.Instance.Defn) {
+				logging.Infof("RestoreContext:  Skip restoring index (%v, %v) not selected by restore options.", index.Bucket, index.Name)
+				continue
+			}
+
+			bucket := m.options.targetBucket(index.Bucket)
+			name := m.options.targetName(index.Name)
+
+			// two indexes in the image cannot be restored as the same index
+			key := fmt.Sprintf("%v %v", bucket, name)
+			if defnId, ok := targets[key]; ok && defnId != index.DefnId {
+				return fmt.Errorf("More than one index in the image would be restored as index %v on bucket %v", name, bucket)
+			}
+			targets[key] = index.DefnId
+
+			if bucket != index.Bucket || name != index.Name {
+				logging.Infof("RestoreContext:  Restore index (%v, %v, %v) as (%v, %v, %v).",
+					index.Bucket, index.Name, index.PartnId, bucket, name, index.PartnId)
+			}
+
+			m.origins[index] = fmt.Sprintf("%v:%v", index.Bucket, index.Name)
+
+			index.Bucket = bucket
+			index.Name = name
+			index.Instance.Defn.Bucket = bucket
+			index.Instance.Defn.Name = name
+
+			// index is pinned to the nodes in the image, unless placed by restore options
+			if len(m.options.Nodes) != 0 {
+				index.Hosts = m.options.Nodes
+				index.Instance.Defn.Nodes = m.options.Nodes
+			}
+
+			newIndexes = append(newIndexes, index)
+		}
+
+		m.idxFromImage[indexerId] = newIndexes
+	}
+
+	if m.options.NumReplica >= 0 {
+		return m.setNumReplica(m.options.NumReplica)
+	}
+
+	return nil
+}
+
+//
+// Restore each index with the given number of replica.  Replica with higher
+// replicaId are not restored.  Missing replica are copied from another
+// replica of the same partition, and put on a new node so that planner
+// would place them.
+//
+func (m *RestoreContext) setNumReplica(numReplica int) error {
+
+	replicas := make(map[string][]*planner.IndexUsage)
+	keys := ([]string)(nil)
+
+	for indexerId, indexes := range m.idxFromImage {
+		newIndexes := ([]*planner.IndexUsage)(nil)
+
+		for _, index := range indexes {
+
+			if index.Instance.ReplicaId > numReplica {
+				logging.Infof("RestoreContext:  Skip restoring index (%v, %v, %v, %v).  Restoring %v replica.",
+					index.Bucket, index.Name, index.PartnId, index.Instance.ReplicaId, numReplica)
+				continue
+			}
+
+			index.Instance.Defn.NumReplica = uint32(numReplica)
+
+			key := fmt.Sprintf("%v %v", index.DefnId, index.PartnId)
+			if _, ok := replicas[key]; !ok {
+				keys = append(keys, key)
+			}
+			replicas[key] = append(replicas[key], index)
+
+			newIndexes = append(newIndexes, index)
+		}
+
+		m.idxFromImage[indexerId] = newIndexes
+	}
+
+	// all partitions of a new replica share the same instance id
+	instIds := make(map[string]common.IndexInstId)
+
+	for _, key := range keys {
+		indexes := replicas[key]
+
+		for replicaId := 0; replicaId <= numReplica; replicaId++ {
+
+			found := false
+			for _, index := range indexes {
+				if index.Instance.ReplicaId == replicaId {
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+
+			source := indexes[0]
+
+			instKey := fmt.Sprintf("%v %v", source.DefnId, replicaId)
+			instId, ok := instIds[instKey]
+			if !ok {
+				var err error
+				if instId, err = common.NewIndexInstId(); err != nil {
+					logging.Errorf("RestoreContext: fail to generate index instance id %v", err)
+					return err
+				}
+				instIds[instKey] = instId
+			}
+
+			index := copyIndexUsage(source)
+			index.InstId = instId
+			index.Instance.InstId = instId
+			index.Instance.ReplicaId = replicaId
+			m.origins[index] = m.origins[source]
+
+			logging.Infof("RestoreContext:  Add replica (%v, %v, %v, %v).", index.Bucket, index.Name, index.PartnId, replicaId)
+
+			indexerId := common.IndexerId(fmt.Sprintf("restore_replica_%v", replicaId))
+			m.idxFromImage[indexerId] = append(m.idxFromImage[indexerId], index)
+		}
+	}
+
+	return nil
+}
+
+//
+// Place restored indexes only on the nodes given in restore options.
+//
+func (m *RestoreContext) restrictPlacement() error {
+
+	if len(m.options.Nodes) == 0 {
+		return nil
+	}
+
+	for _, node := range m.options.Nodes {
+		found := false
+		for _, indexer := range m.current.Placement {
+			if indexer.NodeId == node {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("Index node %v does not exist in the cluster", node)
+		}
+	}
+
+	for _, indexer := range m.current.Placement {
+		if isNodeSelected(m.options.Nodes, indexer.NodeId) {
+			indexer.UnsetExclude()
+		} else {
+			indexer.SetExclude("in")
+			m.excludes = append(m.excludes, indexer)
+		}
+	}
+
+	return nil
+}
+
 //
 // Pick out the indexes that are not yet created in the existing cluster.
 //
@@ -267,8 +528,9 @@ func (m *RestoreContext) findIndexToRestore() {
 //
 func (m *RestoreContext) buildIndexerMapping() {
 
-	// find a match for each indexer node in the image
-	excludes := ([]*planner.IndexerNode)(nil)
+	// find a match for each indexer node in the image, among the nodes
+	// that can take restored indexes
+	excludes := append(([]*planner.IndexerNode)(nil), m.excludes...)
 
 	for indexerId, indexes := range m.idxFromImage {
 
@@ -373,7 +635,7 @@ func (m *RestoreContext) placeIndex() (map[string][]*common.IndexDefn, error) {
 	}
 
 	// If there is enough empty nodes in the current clsuter to do a simple swap rebalance.
-	numEmptyIndexer := findNumEmptyIndexer(m.current.Placement, mappedIndexers)
+	numEmptyIndexer := findNumEmptyIndexer(m.current.Placement, append(mappedIndexers, m.excludes...))
 	if numEmptyIndexer >= len(newNodes) {
 		// place indexes using swap rebalance
 		solution, err := planner.ExecuteSwapWithOptions(m.current, true, "", "", 0, -1, -1, false, newNodeIds)
@@ -402,13 +664,16 @@ func (m *RestoreContext) buildIndexHostMapping(solution *planner.Solution) map[s
 
 	result := make(map[string][]*common.IndexDefn)
 
-	for _, indexes := range m.idxToRestore {
+	for indexerId, indexes := range m.idxToRestore {
 		for _, index := range indexes {
 			if index.Instance != nil {
 				if indexer := solution.FindIndexerWithReplica(index.Name, index.Bucket, index.PartnId, index.Instance.ReplicaId); indexer != nil {
 					logging.Infof("RestoreContext:  Restoring index (%v, %v, %v, %v) at indexer %v",
 						index.Bucket, index.Name, index.PartnId, index.Instance.ReplicaId, indexer.NodeId)
 
+					key := restoreSourceKey(index.Instance.Defn.DefnId, index.Instance.ReplicaId, index.PartnId)
+					m.sources[key] = restoreSource{indexerId: indexerId, instId: index.InstId, origin: m.origins[index]}
+
 					defns := result[indexer.RestUrl]
 					found := false
 					for _, defn := range defns {
@@ -446,10 +711,270 @@ func (m *RestoreContext) buildIndexHostMapping(solution *planner.Solution) map[s
 	return result
 }
 
+//
+// Find the index partition in the image that is restored as partition
+// partnId of defn.  This is available after computeIndexLayout().
+//
+func (m *RestoreContext) findRestoreSource(defn *common.IndexDefn, partnId common.PartitionId) (common.IndexerId, common.IndexInstId, bool) {
+
+	source, ok := m.sources[restoreSourceKey(defn.DefnId, defn.ReplicaId, partnId)]
+	return source.indexerId, source.instId, ok
+}
+
+//
+// Report the indexes to be created on each host.
+//
+func (m *RestoreContext) buildReport(hostIndexMap map[string][]*common.IndexDefn) []*RestoreIndexReport {
+
+	report := ([]*RestoreIndexReport)(nil)
+
+	for host, defns := range hostIndexMap {
+		for _, defn := range defns {
+
+			entry := &RestoreIndexReport{
+				Host:       host,
+				DefnId:     defn.DefnId,
+				Bucket:     defn.Bucket,
+				Name:       defn.Name,
+				ReplicaId:  defn.ReplicaId,
+				NumReplica: defn.NumReplica,
+				Partitions: defn.Partitions,
+				Using:      defn.Using,
+				Nodes:      defn.Nodes,
+			}
+
+			if len(defn.Partitions) != 0 {
+				entry.Source = m.sources[restoreSourceKey(defn.DefnId, defn.ReplicaId, defn.Partitions[0])].origin
+			}
+
+			report = append(report, entry)
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bucket != report[j].Bucket {
+			return report[i].Bucket < report[j].Bucket
+		}
+		if report[i].Name != report[j].Name {
+			return report[i].Name < report[j].Name
+		}
+		return report[i].ReplicaId < report[j].ReplicaId
+	})
+
+	return report
+}
+
+//////////////////////////////////////////////////////////////
+// RestoreOptions
+//////////////////////////////////////////////////////////////
+
+// Parse restore options from request parameters:
+//
+//	buckets=b1,b2          restore indexes of these buckets only
+//	indexPattern=regexp    restore indexes whose name matches only
+//	tags=t1,t2             restore indexes tagged with t1 or t2 only
+//	bucketMap=b1:b3,b2:b4  restore indexes of b1 onto b3, and b2 onto b4
+//	rename=idx1:idx2       restore index idx1 as idx2
+//	prefix=p               prefix the name of restored indexes
+//	numReplica=n           restore n replica of each index
+//	nodes=h1:8091,h2:8091  place restored indexes on these nodes only
+//	storageMode=forestdb:plasma  create indexes of forestdb nodes as plasma
+//	dryRun=true            report restored indexes without creating them
+func parseRestoreOptions(values url.Values) (*RestoreOptions, error) {
+
+	options := &RestoreOptions{
+		Buckets:    splitRestoreList(values.Get("buckets")),
+		Tags:       splitRestoreList(values.Get("tags")),
+		Prefix:     values.Get("prefix"),
+		NumReplica: -1,
+		Nodes:      splitRestoreList(values.Get("nodes")),
+	}
+
+	var err error
+
+	if v := values.Get("indexPattern"); len(v) != 0 {
+		if options.IndexPattern, err = regexp.Compile("^(?:" + v + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid indexPattern %v: %v", v, err)
+		}
+	}
+
+	if options.BucketMap, err = parseRestoreMap("bucketMap", values.Get("bucketMap")); err != nil {
+		return nil, err
+	}
+
+	if options.Rename, err = parseRestoreMap("rename", values.Get("rename")); err != nil {
+		return nil, err
+	}
+
+	storageMode, err := parseRestoreMap("storageMode", values.Get("storageMode"))
+	if err != nil {
+		return nil, err
+	}
+
+	options.StorageMode = make(map[string]string)
+	for from, to := range storageMode {
+		if !common.IsValidIndexType(to) {
+			return nil, fmt.Errorf("Invalid storageMode %v:%v", from, to)
+		}
+		options.StorageMode[strings.ToLower(from)] = strings.ToLower(to)
+	}
+
+	if v := values.Get("numReplica"); len(v) != 0 {
+		numReplica, err := strconv.Atoi(v)
+		if err != nil || numReplica < 0 {
+			return nil, fmt.Errorf("Invalid numReplica %v", v)
+		}
+		options.NumReplica = numReplica
+	}
+
+	if v := values.Get("dryRun"); len(v) != 0 {
+		if options.DryRun, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid dryRun %v", v)
+		}
+	}
+
+	return options, nil
+}
+
+//
+// Is the bucket in the image selected for restore?
+//
+func (o *RestoreOptions) selectBucket(bucket string) bool {
+
+	if len(o.Buckets) == 0 {
+		return true
+	}
+
+	for _, b := range o.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Is the index in the image selected for restore?
+//
+func (o *RestoreOptions) selectIndex(defn *common.IndexDefn) bool {
+
+	if !o.selectBucket(defn.Bucket) {
+		return false
+	}
+
+	if o.IndexPattern != nil && !o.IndexPattern.MatchString(defn.Name) {
+		return false
+	}
+
+	return o.selectTags(defn.Tags)
+}
+
+//
+// Is an index with the given tags selected for restore?
+//
+func (o *RestoreOptions) selectTags(tags []string) bool {
+
+	if len(o.Tags) == 0 {
+		return true
+	}
+
+	for _, t := range o.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//
+// The bucket to restore indexes of a bucket in the image onto.
+//
+func (o *RestoreOptions) targetBucket(bucket string) string {
+
+	if target, ok := o.BucketMap[bucket]; ok {
+		return target
+	}
+
+	return bucket
+}
+
+//
+// The name to restore an index in the image as.
+//
+func (o *RestoreOptions) targetName(name string) string {
+
+	if target, ok := o.Rename[name]; ok {
+		name = target
+	}
+
+	return o.Prefix + name
+}
+
 //////////////////////////////////////////////////////////////
 // Utility
 //////////////////////////////////////////////////////////////
 
+func splitRestoreList(value string) []string {
+
+	result := ([]string)(nil)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+//
+// Parse a list of from:to pairs
+//
+func parseRestoreMap(param string, value string) (map[string]string, error) {
+
+	result := make(map[string]string)
+	for _, item := range splitRestoreList(value) {
+		pair := strings.Split(item, ":")
+		if len(pair) != 2 || len(pair[0]) == 0 || len(pair[1]) == 0 {
+			return nil, fmt.Errorf("Invalid %v %v", param, item)
+		}
+		result[pair[0]] = pair[1]
+	}
+
+	return result, nil
+}
+
+func isNodeSelected(nodes []string, nodeId string) bool {
+
+	for _, node := range nodes {
+		if node == nodeId {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Make a copy of index usage to restore as another replica
+//
+func copyIndexUsage(index *planner.IndexUsage) *planner.IndexUsage {
+
+	r := *index
+
+	inst := *index.Instance
+	r.Instance = &inst
+
+	return &r
+}
+
+func restoreSourceKey(defnId common.IndexDefnId, replicaId int, partnId common.PartitionId) string {
+	return fmt.Sprintf("%v %v %v", defnId, replicaId, partnId)
+}
+
 //
 // Find a higest version index instance with the same definition id and instance id
 //
@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/planner"
+)
+
+func newRestoreIndex(bucket, name string, defnId common.IndexDefnId, instId common.IndexInstId,
+	partnId common.PartitionId, replicaId int, tags ...string) *planner.IndexUsage {
+
+	return &planner.IndexUsage{
+		DefnId:  defnId,
+		InstId:  instId,
+		PartnId: partnId,
+		Name:    name,
+		Bucket:  bucket,
+		Hosts:   []string{"h1:8091"},
+		Instance: &common.IndexInst{
+			InstId:    instId,
+			ReplicaId: replicaId,
+			Defn: common.IndexDefn{
+				DefnId: defnId,
+				Bucket: bucket,
+				Name:   name,
+				Tags:   tags,
+			},
+		},
+	}
+}
+
+func restoredIndexes(m *RestoreContext) []string {
+	result := ([]string)(nil)
+	for _, indexes := range m.idxFromImage {
+		for _, index := range indexes {
+			result = append(result, index.Bucket+":"+index.Name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestParseRestoreOptions(t *testing.T) {
+	cases := []struct {
+		query string
+		err   bool
+		check func(*RestoreOptions) bool
+	}{
+		{"", false, func(o *RestoreOptions) bool {
+			return o.NumReplica == -1 && !o.DryRun && len(o.Buckets) == 0 && o.IndexPattern == nil && len(o.Tags) == 0
+		}},
+		{"buckets=b1,%20b2,,", false, func(o *RestoreOptions) bool {
+			return reflect.DeepEqual(o.Buckets, []string{"b1", "b2"})
+		}},
+		{"tags=t1,t2", false, func(o *RestoreOptions) bool {
+			return reflect.DeepEqual(o.Tags, []string{"t1", "t2"})
+		}},
+		{"indexPattern=idx.*", false, func(o *RestoreOptions) bool {
+			return o.IndexPattern.MatchString("idx1") && !o.IndexPattern.MatchString("my_idx1")
+		}},
+		{"indexPattern=idx(", true, nil},
+		{"bucketMap=b1:b3,b2:b4", false, func(o *RestoreOptions) bool {
+			return reflect.DeepEqual(o.BucketMap, map[string]string{"b1": "b3", "b2": "b4"})
+		}},
+		{"bucketMap=b1", true, nil},
+		{"rename=idx1:idx2&prefix=stg_", false, func(o *RestoreOptions) bool {
+			return o.Rename["idx1"] == "idx2" && o.Prefix == "stg_"
+		}},
+		{"storageMode=ForestDB:Plasma", false, func(o *RestoreOptions) bool {
+			return o.StorageMode["forestdb"] == "plasma"
+		}},
+		{"storageMode=forestdb:unknown", true, nil},
+		{"numReplica=2", false, func(o *RestoreOptions) bool { return o.NumReplica == 2 }},
+		{"numReplica=-1", true, nil},
+		{"numReplica=x", true, nil},
+		{"nodes=h1:8091,h2:8091", false, func(o *RestoreOptions) bool {
+			return reflect.DeepEqual(o.Nodes, []string{"h1:8091", "h2:8091"})
+		}},
+		{"dryRun=true", false, func(o *RestoreOptions) bool { return o.DryRun }},
+		{"dryRun=maybe", true, nil},
+	}
+
+	for _, c := range cases {
+		values, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatalf("%q: %v", c.query, err)
+		}
+
+		options, err := parseRestoreOptions(values)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected error", c.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.query, err)
+			continue
+		}
+		if !c.check(options) {
+			t.Errorf("%q: unexpected options %+v", c.query, options)
+		}
+	}
+}
+
+func TestRestoreApplyOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		options RestoreOptions
+		result  []string
+		err     bool
+	}{
+		{"all", RestoreOptions{NumReplica: -1},
+			[]string{"b1:idx1", "b1:idx2", "b2:idx1"}, false},
+		{"buckets", RestoreOptions{NumReplica: -1, Buckets: []string{"b1"}},
+			[]string{"b1:idx1", "b1:idx2"}, false},
+		{"tags", RestoreOptions{NumReplica: -1, Tags: []string{"t2", "t3"}},
+			[]string{"b1:idx2", "b2:idx1"}, false},
+		{"bucketMap", RestoreOptions{NumReplica: -1, BucketMap: map[string]string{"b1": "b3"}},
+			[]string{"b2:idx1", "b3:idx1", "b3:idx2"}, false},
+		{"rename", RestoreOptions{NumReplica: -1, Rename: map[string]string{"idx2": "idx3"}, Prefix: "stg_"},
+			[]string{"b1:stg_idx1", "b1:stg_idx3", "b2:stg_idx1"}, false},
+		{"conflict", RestoreOptions{NumReplica: -1, BucketMap: map[string]string{"b1": "b2"}},
+			nil, true},
+		{"conflictNotSelected", RestoreOptions{NumReplica: -1, BucketMap: map[string]string{"b1": "b2"}, Tags: []string{"t1"}},
+			[]string{"b2:idx1"}, false},
+	}
+
+	for _, c := range cases {
+		options := c.options
+		m := createRestoreContext(nil, "", &options)
+		m.idxFromImage["n1"] = []*planner.IndexUsage{
+			newRestoreIndex("b1", "idx1", 1, 11, 0, 0, "t1"),
+			newRestoreIndex("b1", "idx2", 2, 12, 0, 0, "t2"),
+		}
+		m.idxFromImage["n2"] = []*planner.IndexUsage{
+			newRestoreIndex("b2", "idx1", 3, 13, 0, 0, "t3"),
+		}
+
+		err := m.applyOptions()
+		if c.err {
+			if err == nil {
+				t.Errorf("%v: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", c.name, err)
+			continue
+		}
+		if result := restoredIndexes(m); !reflect.DeepEqual(result, c.result) {
+			t.Errorf("%v: restored %v, expected %v", c.name, result, c.result)
+		}
+
+		for _, indexes := range m.idxFromImage {
+			for _, index := range indexes {
+				if index.Instance.Defn.Bucket != index.Bucket || index.Instance.Defn.Name != index.Name {
+					t.Errorf("%v: definition of %v:%v not updated", c.name, index.Bucket, index.Name)
+				}
+				if len(m.origins[index]) == 0 {
+					t.Errorf("%v: no origin for %v:%v", c.name, index.Bucket, index.Name)
+				}
+			}
+		}
+	}
+
+	// nodes given in restore options override the placement in the image
+	m := createRestoreContext(nil, "", &RestoreOptions{NumReplica: -1, Nodes: []string{"h2:8091"}})
+	m.idxFromImage["n1"] = []*planner.IndexUsage{newRestoreIndex("b1", "idx1", 1, 11, 0, 0)}
+	if err := m.applyOptions(); err != nil {
+		t.Fatal(err)
+	}
+	index := m.idxFromImage["n1"][0]
+	if !reflect.DeepEqual(index.Hosts, []string{"h2:8091"}) || !reflect.DeepEqual(index.Instance.Defn.Nodes, []string{"h2:8091"}) {
+		t.Errorf("unexpected placement %v %v", index.Hosts, index.Instance.Defn.Nodes)
+	}
+}
+
+func TestRestoreSetNumReplica(t *testing.T) {
+	cases := []struct {
+		numReplica int
+		replicas   map[int]int // replicaId -> number of partitions restored
+	}{
+		{0, map[int]int{0: 2}},
+		{1, map[int]int{0: 2, 1: 2}},
+		{2, map[int]int{0: 2, 1: 2, 2: 2}},
+	}
+
+	for _, c := range cases {
+		m := createRestoreContext(nil, "", &RestoreOptions{NumReplica: c.numReplica})
+
+		// partitioned index with 2 partitions and 1 replica in the image
+		m.idxFromImage["n1"] = []*planner.IndexUsage{
+			newRestoreIndex("b1", "idx1", 1, 11, 1, 0),
+			newRestoreIndex("b1", "idx1", 1, 12, 2, 1),
+		}
+		m.idxFromImage["n2"] = []*planner.IndexUsage{
+			newRestoreIndex("b1", "idx1", 1, 12, 1, 1),
+			newRestoreIndex("b1", "idx1", 1, 11, 2, 0),
+		}
+		for _, indexes := range m.idxFromImage {
+			for _, index := range indexes {
+				m.origins[index] = "b1:idx1"
+			}
+		}
+
+		if err := m.setNumReplica(c.numReplica); err != nil {
+			t.Fatalf("%v: %v", c.numReplica, err)
+		}
+
+		replicas := make(map[int]int)
+		instIds := make(map[int]common.IndexInstId)
+		for _, indexes := range m.idxFromImage {
+			for _, index := range indexes {
+				replicaId := index.Instance.ReplicaId
+				replicas[replicaId]++
+
+				if index.Instance.Defn.NumReplica != uint32(c.numReplica) {
+					t.Errorf("%v: numReplica %v", c.numReplica, index.Instance.Defn.NumReplica)
+				}
+				if index.InstId != index.Instance.InstId {
+					t.Errorf("%v: instance id %v != %v", c.numReplica, index.InstId, index.Instance.InstId)
+				}
+				if m.origins[index] != "b1:idx1" {
+					t.Errorf("%v: origin %v", c.numReplica, m.origins[index])
+				}
+
+				// partitions of the same replica share the instance id
+				if instId, ok := instIds[replicaId]; ok && instId != index.InstId {
+					t.Errorf("%v: replica %v has instance ids %v and %v", c.numReplica, replicaId, instId, index.InstId)
+				}
+				instIds[replicaId] = index.InstId
+			}
+		}
+
+		if !reflect.DeepEqual(replicas, c.replicas) {
+			t.Errorf("%v: restored replicas %v, expected %v", c.numReplica, replicas, c.replicas)
+		}
+
+		seen := make(map[common.IndexInstId]int)
+		for replicaId, instId := range instIds {
+			if other, ok := seen[instId]; ok {
+				t.Errorf("%v: replica %v and %v share instance id %v", c.numReplica, replicaId, other, instId)
+			}
+			seen[instId] = replicaId
+		}
+	}
+}
@@ -49,6 +49,7 @@ type IndexInstDistribution struct {
 	StorageMode    string                  `json:"storageMode,omitempty"`
 	OldStorageMode string                  `json:"oldStorageMode,omitempty"`
 	RealInstId     uint64                  `json:"realInstId,omitempty"`
+	Rebuild        bool                    `json:"rebuild,omitempty"`
 }
 
 type IndexPartDistribution struct {
@@ -317,6 +318,71 @@ func (t *IndexTopology) UpdateRebalanceStateForIndexInst(defnId common.IndexDefn
 	return false
 }
 
+//
+// Mark a proxy instance as rebuilding its real instance
+//
+func (t *IndexTopology) UpdateRebuildForIndexInst(defnId common.IndexDefnId, instId common.IndexInstId, rebuild bool) bool {
+
+	for i, _ := range t.Definitions {
+		if t.Definitions[i].DefnId == uint64(defnId) {
+			for j, _ := range t.Definitions[i].Instances {
+				if t.Definitions[i].Instances[j].InstId == uint64(instId) {
+					if t.Definitions[i].Instances[j].Rebuild != rebuild {
+						t.Definitions[i].Instances[j].Rebuild = rebuild
+						logging.Debugf("IndexTopology.UpdateRebuildForIndexInst(): Update index '%v' inst '%v' rebuild to '%v'",
+							defnId, t.Definitions[i].Instances[j].InstId, t.Definitions[i].Instances[j].Rebuild)
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+//
+// Swap an instance with the proxy rebuilding it.  The proxy becomes an
+// active instance of its own, and the instance it rebuilt is pending delete.
+// Return false if newInstId is not rebuilding (or has not rebuilt) instId.
+//
+func (t *IndexTopology) SwapRebuildIndexInst(defnId common.IndexDefnId, instId common.IndexInstId, newInstId common.IndexInstId) bool {
+
+	for i, _ := range t.Definitions {
+		if t.Definitions[i].DefnId == uint64(defnId) {
+
+			var inst, newInst *IndexInstDistribution
+			for j, _ := range t.Definitions[i].Instances {
+				switch t.Definitions[i].Instances[j].InstId {
+				case uint64(instId):
+					inst = &t.Definitions[i].Instances[j]
+				case uint64(newInstId):
+					newInst = &t.Definitions[i].Instances[j]
+				}
+			}
+
+			if inst == nil || newInst == nil {
+				return false
+			}
+
+			swapped := !newInst.IsProxy() && newInst.RState == uint32(common.REBAL_ACTIVE) &&
+				inst.RState == uint32(common.REBAL_PENDING_DELETE)
+			if !swapped && (newInst.RealInstId != uint64(instId) || !newInst.Rebuild) {
+				return false
+			}
+
+			newInst.RealInstId = 0
+			newInst.Rebuild = false
+			newInst.RState = uint32(common.REBAL_ACTIVE)
+			inst.RState = uint32(common.REBAL_PENDING_DELETE)
+
+			logging.Debugf("IndexTopology.SwapRebuildIndexInst(): Swap index '%v' inst '%v' with inst '%v'",
+				defnId, instId, newInstId)
+			return true
+		}
+	}
+	return false
+}
+
 //
 // Update Storage Mode on instance
 //
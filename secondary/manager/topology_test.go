@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newRebuildTopology() *IndexTopology {
+	return &IndexTopology{
+		Bucket: "b1",
+		Definitions: []IndexDefnDistribution{
+			{
+				Bucket: "b1",
+				Name:   "idx1",
+				DefnId: 1,
+				Instances: []IndexInstDistribution{
+					{InstId: 11, RState: uint32(common.REBAL_ACTIVE)},
+					{InstId: 12, RState: uint32(common.REBAL_PENDING), RealInstId: 11},
+				},
+			},
+		},
+	}
+}
+
+func TestSwapRebuildIndexInst(t *testing.T) {
+	topology := newRebuildTopology()
+
+	// a proxy moved by rebalance cannot be swapped
+	if topology.SwapRebuildIndexInst(1, 11, 12) {
+		t.Fatalf("swapped a proxy not rebuilding its real instance")
+	}
+
+	if !topology.UpdateRebuildForIndexInst(1, 12, true) {
+		t.Fatalf("rebuild flag not updated")
+	}
+	if topology.UpdateRebuildForIndexInst(1, 12, true) {
+		t.Fatalf("rebuild flag updated twice")
+	}
+
+	if topology.SwapRebuildIndexInst(1, 11, 13) || topology.SwapRebuildIndexInst(2, 11, 12) {
+		t.Fatalf("swapped unknown instance")
+	}
+
+	for i := 0; i < 2; i++ {
+		// swap is idempotent
+		if !topology.SwapRebuildIndexInst(1, 11, 12) {
+			t.Fatalf("instances not swapped (%v)", i)
+		}
+
+		inst := topology.GetIndexInstByDefn(1, 11)
+		newInst := topology.GetIndexInstByDefn(1, 12)
+		if inst.RState != uint32(common.REBAL_PENDING_DELETE) {
+			t.Errorf("unexpected state %v of old instance", inst.RState)
+		}
+		if newInst.RState != uint32(common.REBAL_ACTIVE) || newInst.IsProxy() || newInst.Rebuild {
+			t.Errorf("unexpected new instance %+v", newInst)
+		}
+	}
+
+	// an instance cannot be swapped back with the one it replaced
+	if topology.SwapRebuildIndexInst(1, 12, 11) {
+		t.Fatalf("swapped instances back")
+	}
+}
@@ -4900,6 +4900,14 @@ func newGeneralSizingMethod() *GeneralSizingMethod {
 	}
 }
 
+//
+// NewSizingMethod returns the sizing method of the planner, for
+// estimating the size of indexes outside of planning.
+//
+func NewSizingMethod() SizingMethod {
+	return newGeneralSizingMethod()
+}
+
 //
 // Validate
 //
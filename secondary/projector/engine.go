@@ -63,7 +63,12 @@ func (engine *Engine) StreamEndData(
 // TransformRoute data to endpoints.
 func (engine *Engine) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) ([]byte, error) {
+	encodeBuf []byte, ctx c.EvaluatorContext) ([]byte, error) {
 
-	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf)
+	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf, ctx)
+}
+
+// GetStatistics from this engine.
+func (engine *Engine) GetStatistics() map[string]interface{} {
+	return engine.evaluator.GetStatistics()
 }
@@ -1179,6 +1179,14 @@ func (feed *Feed) getStatistics() c.Statistics {
 		endStats.Set(raddr, endpoint.GetStatistics())
 	}
 	stats.Set("endpoints", endStats)
+	engStats, _ := c.NewStatistics(nil)
+	for bucketn, engines := range feed.engines {
+		for uuid, engine := range engines {
+			key := fmt.Sprintf("%v-%v", bucketn, uuid)
+			engStats.Set(key, engine.GetStatistics())
+		}
+	}
+	stats.Set("engine-stats", engStats)
 	return stats
 }
 
@@ -1260,6 +1268,19 @@ func (feed *Feed) openFeeder(
 	if ok {
 		return feeder, nil
 	}
+	if dir := feed.replayDir(); dir != "" {
+		name := newDCPConnectionName(bucketn, feed.topic, uint64(opaque))
+		config := map[string]interface{}{
+			"dataChanSize": feed.config["dcp.dataChanSize"].Int(),
+		}
+		feeder, err := OpenReplayFeed(string(name), bucketn, dir, config)
+		if err != nil {
+			fmsg := "%v ##%x OpenReplayFeed(%q): %v"
+			logging.Errorf(fmsg, feed.logPrefix, opaque, bucketn, err)
+			return nil, projC.ErrorFeeder
+		}
+		return feeder, nil
+	}
 	bucket, err := feed.connectBucket(feed.cluster, pooln, bucketn, opaque)
 	if err != nil {
 		return nil, projC.ErrorFeeder
@@ -1273,11 +1294,13 @@ func (feed *Feed) openFeeder(
 	}
 	name := newDCPConnectionName(bucket.Name, feed.topic, uuid.Uint64())
 	dcpConfig := map[string]interface{}{
-		"genChanSize":    feed.config["dcp.genChanSize"].Int(),
-		"dataChanSize":   feed.config["dcp.dataChanSize"].Int(),
-		"numConnections": feed.config["dcp.numConnections"].Int(),
-		"latencyTick":    feed.config["dcp.latencyTick"].Int(),
-		"activeVbOnly":   feed.config["dcp.activeVbOnly"].Bool(),
+		"genChanSize":       feed.config["dcp.genChanSize"].Int(),
+		"dataChanSize":      feed.config["dcp.dataChanSize"].Int(),
+		"numConnections":    feed.config["dcp.numConnections"].Int(),
+		"latencyTick":       feed.config["dcp.latencyTick"].Int(),
+		"activeVbOnly":      feed.config["dcp.activeVbOnly"].Bool(),
+		"compression":       feed.config["dcp.compression"].Bool(),
+		"deletedUserXattrs": feed.config["dcp.deletedUserXattrs"].Bool(),
 	}
 	kvaddr, err := feed.getLocalKVAddrs(pooln, bucketn, opaque)
 	if err != nil {
@@ -1301,10 +1324,13 @@ func (feed *Feed) bucketFeed(
 
 	pooln, bucketn := reqTs.GetPool(), reqTs.GetBucket()
 
-	vbnos := c.Vbno32to16(reqTs.GetVbnos())
-	_ /*vbuuids*/, err := feed.bucketDetails(pooln, bucketn, opaque, vbnos)
-	if err != nil {
-		return projC.ErrorFeeder
+	var err error
+	if feed.replayDir() == "" { // replayed feeds don't talk to KV.
+		vbnos := c.Vbno32to16(reqTs.GetVbnos())
+		_ /*vbuuids*/, err = feed.bucketDetails(pooln, bucketn, opaque, vbnos)
+		if err != nil {
+			return projC.ErrorFeeder
+		}
 	}
 
 	// stop and start are mutually exclusive
@@ -1405,6 +1431,17 @@ func (feed *Feed) getLocalVbuckets(
 	pooln, bucketn string, opaque uint16) ([]uint16, error) {
 
 	prefix := feed.logPrefix
+	if dir := feed.replayDir(); dir != "" {
+		vbnos, _, err := ReplayVbuckets(dir, bucketn)
+		if err != nil {
+			fmsg := "%v ##%x ReplayVbuckets(`%v`): %v\n"
+			logging.Errorf(fmsg, prefix, opaque, bucketn, err)
+			return nil, projC.ErrorClusterInfo
+		}
+		fmsg := "%v ##%x replay vbmap {%v,%v} - %v\n"
+		logging.Infof(fmsg, prefix, opaque, pooln, bucketn, vbnos)
+		return vbnos, nil
+	}
 	// gather vbnos based on colocation policy.
 	var cinfo *c.ClusterInfoCache
 	url, err := c.ClusterAuthUrl(feed.config["clusterAddr"].String())
@@ -1766,6 +1803,15 @@ func (feed *Feed) watchEndpoint(raddr string, endpoint c.RouterEndpoint) {
 
 //---- local function
 
+// replayDir return the directory to replay mutations from, empty
+// string if feed shall stream mutations from KV.
+func (feed *Feed) replayDir() string {
+	if cv, ok := feed.config["dcp.replayDir"]; ok {
+		return cv.String()
+	}
+	return ""
+}
+
 // connectBucket will instantiate a couchbase-bucket instance with cluster.
 // caller's responsibility to close the bucket.
 func (feed *Feed) connectBucket(
@@ -1814,8 +1860,12 @@ func FeedConfigParams() []string {
 		"dcp.numConnections",
 		"dcp.latencyTick",
 		"dcp.activeVbOnly",
+		"dcp.compression",
+		"dcp.deletedUserXattrs",
+		"dcp.replayDir",
 		// dataport
 		"dataport.remoteBlock",
+		"dataport.compression",
 		"dataport.keyChanSize",
 		"dataport.bufferSize",
 		"dataport.bufferTimeout",
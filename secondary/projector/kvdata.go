@@ -45,6 +45,7 @@ type KVData struct {
 	// misc.
 	syncTimeout time.Duration // in milliseconds
 	kvstatTick  time.Duration // in milliseconds
+	backfill    bool          // throttled as backfill topic
 	logPrefix   string
 	// statistics
 	hbCount     int64
@@ -58,6 +59,9 @@ type KVData struct {
 	ainstCount  int64
 	dinstCount  int64
 	tsCount     int64
+	// backfill throttling
+	throttleDue  time.Duration
+	throttleTime int64 // nanoseconds spent throttled
 }
 
 // NewKVData create a new data-path instance.
@@ -90,6 +94,8 @@ func NewKVData(
 	kvdata.syncTimeout *= time.Millisecond
 	kvdata.kvstatTick = time.Duration(config["kvstatTick"].Int())
 	kvdata.kvstatTick *= time.Millisecond
+	prefix := config["backfillThrottle.topicPrefix"].String()
+	kvdata.backfill = isBackfillTopic(kvdata.topic, prefix)
 	for uuid, engine := range engines {
 		kvdata.engines[uuid] = engine
 	}
@@ -208,7 +214,7 @@ func (kvdata *KVData) runScatter(
 
 	// stats
 	statSince := time.Now()
-	var stitems [16]string
+	var stitems [18]string
 	logstats := func() {
 		snapStat := kvdata.snapStat
 		stitems[0] = `"topic":"` + kvdata.topic + `"`
@@ -227,6 +233,8 @@ func (kvdata *KVData) runScatter(
 		stitems[13] = `"ainstCount":` + strconv.Itoa(int(kvdata.ainstCount))
 		stitems[14] = `"dinstCount":` + strconv.Itoa(int(kvdata.dinstCount))
 		stitems[15] = `"tsCount":` + strconv.Itoa(int(kvdata.tsCount))
+		stitems[16] = `"throttleLevel":` + strconv.Itoa(int(backfillThrottleLevel()))
+		stitems[17] = `"throttleTime":` + strconv.Itoa(int(kvdata.throttleTime))
 		statjson := strings.Join(stitems[:], ",")
 		fmsg := "%v ##%x stats {%v}\n"
 		logging.Infof(fmsg, kvdata.logPrefix, kvdata.opaque, statjson)
@@ -247,6 +255,9 @@ loop:
 			}
 			kvdata.eventCount++
 			vbseqnos[m.VBucket], _ = kvdata.scatterMutation(m, ts)
+			if kvdata.backfill {
+				kvdata.throttle()
+			}
 
 		case <-heartBeat:
 			heartBeat = nil
@@ -343,17 +354,24 @@ loop:
 				stats.Set("addInsts", float64(kvdata.ainstCount))
 				stats.Set("delInsts", float64(kvdata.dinstCount))
 				stats.Set("tsCount", float64(kvdata.tsCount))
+				stats.Set("throttleTime", float64(kvdata.throttleTime))
 				statVbuckets := make(map[string]interface{})
-				for _, worker := range kvdata.workers {
+				statWorkers := make(map[string]interface{})
+				for i, worker := range kvdata.workers {
 					if stats, err := worker.GetStatistics(); err != nil {
 						panic(err)
 					} else {
 						for vbno_s, stat := range stats {
+							if vbno_s == workerEvalStats {
+								statWorkers[strconv.Itoa(i)] = stat
+								continue
+							}
 							statVbuckets[vbno_s] = stat
 						}
 					}
 				}
 				stats.Set("vbuckets", statVbuckets)
+				stats.Set("workers", statWorkers)
 				respch <- []interface{}{map[string]interface{}(stats)}
 
 			case kvCmdResetConfig:
@@ -400,6 +418,25 @@ loop:
 	logstats()
 }
 
+// throttle delays the data-path of backfill topic as per the current
+// backfill throttle, delay is accumulated until it is long enough to
+// sleep for.
+func (kvdata *KVData) throttle() {
+	delay := backfillThrottleDelay()
+	if delay == 0 {
+		kvdata.throttleDue = 0
+		return
+	}
+	kvdata.throttleDue += delay
+	if kvdata.throttleDue < minThrottleSleep {
+		return
+	}
+	start := time.Now()
+	time.Sleep(kvdata.throttleDue)
+	kvdata.throttleDue = 0
+	kvdata.throttleTime += int64(time.Since(start))
+}
+
 func (kvdata *KVData) scatterMutation(
 	m *mc.DcpEvent, ts *protobuf.TsVbuuid) (seqno uint64, err error) {
 
@@ -518,6 +555,8 @@ func (kvdata *KVData) newStats() c.Statistics {
 		"delInsts": float64(0),   // no. of delInsts received
 		"tsCount":  float64(0),   // no. of updateTs received
 		"vbuckets": statVbuckets, // per vbucket statistics
+		// nanoseconds spent throttling backfill
+		"throttleTime": float64(0),
 	}
 	stats, _ := c.NewStatistics(m)
 	return stats
@@ -49,9 +49,14 @@ func NewProjector(maxvbs int, config c.Config) *Projector {
 		pooln:          "default", // TODO: should this be configurable ?
 	}
 
-	// Setup dynamic configuration propagation
-	config, err := c.GetSettingsConfig(config)
-	c.CrashOnError(err)
+	// Setup dynamic configuration propagation, replaying projector
+	// runs without a cluster and hence without metakv settings.
+	replayDir := config["projector.dcp.replayDir"].String()
+	if replayDir == "" {
+		var err error
+		config, err = c.GetSettingsConfig(config)
+		c.CrashOnError(err)
+	}
 
 	pconfig := config.SectionConfig("projector.", true /*trim*/)
 	p.name = pconfig["name"].String()
@@ -86,13 +91,19 @@ func NewProjector(maxvbs int, config c.Config) *Projector {
 	go c.MemstatLogger(int64(config["projector.memstatTick"].Int()))
 	go p.mainAdminPort(reqch)
 	go p.watcherDameon(watchInterval, staleTimeout)
+	go p.runBackfillThrottle()
 
 	callb := func(cfg c.Config) {
 		logging.Infof("%v settings notifier from metakv\n", p.logPrefix)
 		cfg.LogConfig(p.logPrefix)
 		p.ResetConfig(cfg)
 	}
-	c.SetupSettingsNotifier(callb, make(chan struct{}))
+	if replayDir == "" {
+		c.SetupSettingsNotifier(callb, make(chan struct{}))
+	} else {
+		fmsg := "%v replaying from %v, settings notifier disabled\n"
+		logging.Infof(fmsg, p.logPrefix, replayDir)
+	}
 
 	logging.Infof("%v started ...\n", p.logPrefix)
 	return p
@@ -271,6 +282,24 @@ func (p *Projector) doVbmapRequest(
 	logging.Infof(fmsg, prefix, pooln, bucketn, kvaddrs, opaque)
 	defer logging.Infof("%v ##%x doVbmapRequest() returns ...\n", prefix, opaque)
 
+	// replayed buckets are hosted by the first kv-node in the request.
+	config := p.GetConfig()
+	if dir := config["projector.dcp.replayDir"].String(); dir != "" {
+		vbnos, _, err := ReplayVbuckets(dir, bucketn)
+		if err != nil {
+			logging.Errorf("%v ##%x ReplayVbuckets(): %v\n", prefix, opaque, err)
+			response.Err = protobuf.NewError(err)
+			return response
+		}
+		if len(kvaddrs) > 0 {
+			response.Kvaddrs = []string{kvaddrs[0]}
+			response.Kvvbnos = []*protobuf.Vbuckets{
+				&protobuf.Vbuckets{Vbnos: c.Vbno16to32(vbnos)},
+			}
+		}
+		return response
+	}
+
 	// get vbmap from bucket connection.
 	bucket, err := c.ConnectBucket(p.clusterAddr, pooln, bucketn)
 	if err != nil {
@@ -315,6 +344,29 @@ func (p *Projector) doFailoverLog(
 	logging.Infof(fmsg, prefix, opaque, pooln, bucketn, vbuckets)
 	defer logging.Infof("%v ##%x doFailoverLog() returns ...\n", prefix, opaque)
 
+	config := p.GetConfig()
+	if dir := config["projector.dcp.replayDir"].String(); dir != "" {
+		_, vbuuids, err := ReplayVbuckets(dir, bucketn)
+		if err != nil {
+			logging.Errorf("%v ##%x ReplayVbuckets(): %v\n", prefix, opaque, err)
+			response.Err = protobuf.NewError(err)
+			return response
+		}
+		response.Logs = make([]*protobuf.FailoverLog, 0, len(vbuckets))
+		for _, vbno := range vbuckets {
+			vbuuid, ok := vbuuids[uint16(vbno)]
+			if !ok {
+				continue
+			}
+			response.Logs = append(response.Logs, &protobuf.FailoverLog{
+				Vbno:    proto.Uint32(vbno),
+				Vbuuids: []uint64{vbuuid},
+				Seqnos:  []uint64{0},
+			})
+		}
+		return response
+	}
+
 	bucket, err := c.ConnectBucket(p.clusterAddr, pooln, bucketn)
 	if err != nil {
 		logging.Errorf("%v ##%x ConnectBucket(): %v\n", prefix, opaque, err)
@@ -323,7 +375,6 @@ func (p *Projector) doFailoverLog(
 	}
 	defer bucket.Close()
 
-	config := p.GetConfig()
 	protoFlogs := make([]*protobuf.FailoverLog, 0, len(vbuckets))
 	vbnos := c.Vbno32to16(vbuckets)
 	dcpConfig := map[string]interface{}{
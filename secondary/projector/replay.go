@@ -0,0 +1,527 @@
+// Replay DCP source, a BucketFeeder that reads mutations from a file
+// instead of streaming them from KV.
+//
+// When `projector.dcp.replayDir` is configured, feeds replay a bucket
+// from "<replayDir>/<bucket>.jsonl" or "<replayDir>/<bucket>.dcp",
+// whichever is found first. This is useful for testing index builds
+// without a KV cluster, and for backfilling indexes from a capture.
+// The projector binary sets it with `-replayDir`, in which case metakv
+// settings are not read either.
+//
+// JSON lines format, one event per line, events of a vbucket ordered
+// by seqno:
+//
+//   {"op":"snapshot","vb":0,"vbuuid":10,"start":1,"end":2,"type":1}
+//   {"op":"mutation","vb":0,"vbuuid":10,"seqno":1,"key":"k1","value":{}}
+//   {"op":"deletion","vb":0,"vbuuid":10,"seqno":2,"key":"k2"}
+//
+// "op" can also be "expiration". Mutations can optionally carry
+// "revseqno", "cas", "flags", "expiry", "xattrs" and "raw", a base64
+// encoded non-JSON value, in place of "value".
+//
+// Binary format is a sequence of memcached packets as sent by a DCP
+// producer, DCP_SNAPSHOT, DCP_MUTATION, DCP_DELETION and DCP_EXPIRATION
+// requests. DCP_STREAMREQ responses, if present, supply the failover
+// log, hence the vbuuid, for vbucket in the 16 LSB of its opaque.
+//
+// A stream-request for a vbucket is served by replaying its events
+// with seqno greater than the requested start seqno. Streams are left
+// open at the end of the file, like a quiet vbucket.
+
+package projector
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+import projC "github.com/couchbase/indexing/secondary/projector/client"
+
+// ErrorReplayFile for missing or malformed replay file.
+var ErrorReplayFile = errors.New("projector.replayFile")
+
+const replayDatatypeJSON = uint8(0x1)
+const replayDatatypeXATTR = uint8(0x4)
+
+// replayRecord is a single event in JSON lines replay file.
+type replayRecord struct {
+	Op       string                 `json:"op"`
+	Vbno     uint16                 `json:"vb"`
+	Vbuuid   uint64                 `json:"vbuuid"`
+	Seqno    uint64                 `json:"seqno"`
+	RevSeqno uint64                 `json:"revseqno"`
+	Start    uint64                 `json:"start"`
+	End      uint64                 `json:"end"`
+	Type     uint32                 `json:"type"`
+	Key      string                 `json:"key"`
+	Value    json.RawMessage        `json:"value"`
+	Raw      []byte                 `json:"raw"`
+	Cas      uint64                 `json:"cas"`
+	Flags    uint32                 `json:"flags"`
+	Expiry   uint32                 `json:"expiry"`
+	Xattrs   map[string]interface{} `json:"xattrs"`
+}
+
+// replayReader iterate on events from a replay file, returns io.EOF
+// at the end of file.
+type replayReader interface {
+	next() (*mc.DcpEvent, error)
+	close() error
+}
+
+// ReplayFile return the replay file for bucket under `dir`, returns
+// ErrorReplayFile if there is none.
+func ReplayFile(dir, bucketn string) (string, error) {
+	for _, ext := range []string{".jsonl", ".dcp"} {
+		path := filepath.Join(dir, bucketn+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", ErrorReplayFile
+}
+
+func openReplayReader(path string) (replayReader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(fd, 64*1024)
+	if filepath.Ext(path) == ".dcp" {
+		return &binReplayReader{fd: fd, r: r, vbuuids: make(map[uint16]uint64)}, nil
+	}
+	return &jsonReplayReader{fd: fd, r: r}, nil
+}
+
+//---- JSON lines reader
+
+type jsonReplayReader struct {
+	fd     *os.File
+	r      *bufio.Reader
+	lineno int
+}
+
+func (jr *jsonReplayReader) next() (*mc.DcpEvent, error) {
+	for {
+		line, err := jr.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		jr.lineno++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var rec replayRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("line %v: %v", jr.lineno, err)
+		}
+		rq, err := rec.toRequest()
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", jr.lineno, err)
+		}
+		return mc.DecodeDcpEvent(rq, rec.Vbno, rec.Vbuuid), nil
+	}
+}
+
+func (jr *jsonReplayReader) close() error {
+	return jr.fd.Close()
+}
+
+// toRequest compose the DCP packet for this record, as a producer
+// would have sent it.
+func (rec *replayRecord) toRequest() (*mcd.MCRequest, error) {
+	rq := &mcd.MCRequest{
+		VBucket: rec.Vbno,
+		Key:     []byte(rec.Key),
+		Cas:     rec.Cas,
+	}
+	switch rec.Op {
+	case "snapshot":
+		rq.Opcode = mcd.DCP_SNAPSHOT
+		rq.Extras = make([]byte, 20)
+		binary.BigEndian.PutUint64(rq.Extras[0:], rec.Start)
+		binary.BigEndian.PutUint64(rq.Extras[8:], rec.End)
+		binary.BigEndian.PutUint32(rq.Extras[16:], rec.Type)
+		return rq, nil
+
+	case "mutation":
+		rq.Opcode = mcd.DCP_MUTATION
+		rq.Extras = make([]byte, 31)
+		binary.BigEndian.PutUint32(rq.Extras[16:], rec.Flags)
+		binary.BigEndian.PutUint32(rq.Extras[20:], rec.Expiry)
+		if len(rec.Value) > 0 {
+			rq.Datatype |= replayDatatypeJSON
+			rq.Body = []byte(rec.Value)
+		} else {
+			rq.Body = rec.Raw
+		}
+
+	case "deletion":
+		rq.Opcode = mcd.DCP_DELETION
+		rq.Extras = make([]byte, 18)
+
+	case "expiration":
+		rq.Opcode = mcd.DCP_EXPIRATION
+		rq.Extras = make([]byte, 18)
+
+	default:
+		return nil, fmt.Errorf("unknown op %q", rec.Op)
+	}
+	binary.BigEndian.PutUint64(rq.Extras[0:], rec.Seqno)
+	binary.BigEndian.PutUint64(rq.Extras[8:], rec.RevSeqno)
+
+	if len(rec.Xattrs) > 0 && rq.Opcode != mcd.DCP_EXPIRATION {
+		xattrs, err := encodeXattrs(rec.Xattrs)
+		if err != nil {
+			return nil, err
+		}
+		rq.Datatype |= replayDatatypeXATTR
+		rq.Body = append(xattrs, rq.Body...)
+	}
+	return rq, nil
+}
+
+// encodeXattrs in the wire format of DCP, a 4 byte total length
+// followed by {4 byte length, key, 0x00, value, 0x00} for each pair.
+func encodeXattrs(xattrs map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(xattrs))
+	for key := range xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := make([]byte, 4)
+	for _, key := range keys {
+		val, err := json.Marshal(xattrs[key])
+		if err != nil {
+			return nil, err
+		}
+		var pairlen [4]byte
+		binary.BigEndian.PutUint32(pairlen[:], uint32(len(key)+len(val)+2))
+		out = append(out, pairlen[:]...)
+		out = append(out, key...)
+		out = append(out, 0)
+		out = append(out, val...)
+		out = append(out, 0)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	return out, nil
+}
+
+//---- binary capture reader
+
+type binReplayReader struct {
+	fd      *os.File
+	r       *bufio.Reader
+	hdr     [mcd.HDR_LEN]byte
+	vbuuids map[uint16]uint64 // learnt from STREAMREQ responses
+}
+
+func (br *binReplayReader) next() (*mc.DcpEvent, error) {
+	for {
+		rq := &mcd.MCRequest{}
+		if _, err := rq.Receive(br.r, br.hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF // truncated capture
+			}
+			return nil, err
+		}
+		switch rq.Opcode {
+		case mcd.DCP_STREAMREQ:
+			// for responses, vbucket field carries the status.
+			if br.hdr[0] != mcd.RES_MAGIC || mcd.Status(rq.VBucket) != mcd.SUCCESS {
+				continue
+			}
+			flog, err := mc.DecodeFailoverLog(rq.Body)
+			if err != nil {
+				return nil, err
+			}
+			if vbuuid, _, err := flog.Latest(); err == nil {
+				br.vbuuids[uint16(rq.Opaque&0xFFFF)] = vbuuid
+			}
+
+		case mcd.DCP_SNAPSHOT, mcd.DCP_MUTATION, mcd.DCP_DELETION,
+			mcd.DCP_EXPIRATION:
+			if br.hdr[0] != mcd.REQ_MAGIC {
+				continue
+			}
+			vbuuid := br.vbuuids[rq.VBucket]
+			return mc.DecodeDcpEvent(rq, rq.VBucket, vbuuid), nil
+		}
+	}
+}
+
+func (br *binReplayReader) close() error {
+	return br.fd.Close()
+}
+
+//---- replay index
+
+// replayIndex summarizes a replay file, vbuckets found in the file,
+// their vbuuid and high seqno.
+type replayIndex struct {
+	vbuuids map[uint16]uint64
+	seqnos  map[uint16]uint64
+}
+
+func scanReplayFile(path string) (*replayIndex, error) {
+	rr, err := openReplayReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.close()
+
+	index := &replayIndex{
+		vbuuids: make(map[uint16]uint64),
+		seqnos:  make(map[uint16]uint64),
+	}
+	for {
+		m, err := rr.next()
+		if err == io.EOF {
+			return index, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := index.vbuuids[m.VBucket]; !ok || m.VBuuid != 0 {
+			index.vbuuids[m.VBucket] = m.VBuuid
+		}
+		if m.Opcode != mcd.DCP_SNAPSHOT && m.Seqno > index.seqnos[m.VBucket] {
+			index.seqnos[m.VBucket] = m.Seqno
+		}
+	}
+}
+
+// vbuckets found in replay file, in sort order.
+func (index *replayIndex) vbuckets() []uint16 {
+	vbnos := make([]uint16, 0, len(index.vbuuids))
+	for vbno := range index.vbuuids {
+		vbnos = append(vbnos, vbno)
+	}
+	sort.Sort(c.Vbuckets(vbnos))
+	return vbnos
+}
+
+// ReplayVbuckets return vbuckets, in sort order, and their vbuuids,
+// found in the replay file for bucket under `dir`.
+func ReplayVbuckets(
+	dir, bucketn string) (vbnos []uint16, vbuuids map[uint16]uint64, err error) {
+
+	path, err := ReplayFile(dir, bucketn)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := scanReplayFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return index.vbuckets(), index.vbuuids, nil
+}
+
+//---- replay feeder
+
+// replayFeeder implements BucketFeeder{} interface.
+type replayFeeder struct {
+	bucketn   string
+	path      string
+	index     *replayIndex
+	mutch     chan *mc.DcpEvent
+	finch     chan bool
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	streams   map[uint16]*replayStream // active streams
+	logPrefix string
+}
+
+type replayStream struct {
+	opaque uint16
+	vbuuid uint64
+	start  uint64
+}
+
+// OpenReplayFeed opens a feeder for bucket, replaying mutations from
+// replay file under `dir`.
+func OpenReplayFeed(
+	name, bucketn, dir string,
+	config map[string]interface{}) (BucketFeeder, error) {
+
+	path, err := ReplayFile(dir, bucketn)
+	if err != nil {
+		return nil, err
+	}
+	index, err := scanReplayFile(path)
+	if err != nil {
+		return nil, err
+	}
+	feeder := &replayFeeder{
+		bucketn:   bucketn,
+		path:      path,
+		index:     index,
+		mutch:     make(chan *mc.DcpEvent, config["dataChanSize"].(int)),
+		finch:     make(chan bool),
+		streams:   make(map[uint16]*replayStream),
+		logPrefix: fmt.Sprintf("REPLAY[<-%v<-%v]", bucketn, name),
+	}
+	fmsg := "%v replaying %v, %v vbuckets\n"
+	logging.Infof(fmsg, feeder.logPrefix, path, len(index.vbuuids))
+	return feeder, nil
+}
+
+// GetChannel implements Feeder{} interface.
+func (feeder *replayFeeder) GetChannel() (mutch <-chan *mc.DcpEvent) {
+	return feeder.mutch
+}
+
+// StartVbStreams implements Feeder{} interface.
+func (feeder *replayFeeder) StartVbStreams(
+	opaque uint16, reqTs *protobuf.TsVbuuid) error {
+
+	vbnos := c.Vbno32to16(reqTs.GetVbnos())
+	vbuuids, seqnos := reqTs.GetVbuuids(), reqTs.GetSeqnos()
+
+	streams := make(map[uint16]*replayStream)
+	feeder.mu.Lock()
+	for i, vbno := range vbnos {
+		m := &mc.DcpEvent{
+			Opcode:  mcd.DCP_STREAMREQ,
+			VBucket: vbno,
+			Opaque:  opaque,
+			Seqno:   seqnos[i],
+			Ctime:   time.Now().UnixNano(),
+		}
+		vbuuid, ok := feeder.index.vbuuids[vbno]
+		switch {
+		case !ok:
+			m.Status = mcd.NOT_MY_VBUCKET
+		case seqnos[i] > 0 && vbuuids[i] != vbuuid:
+			m.Status, m.Seqno = mcd.ROLLBACK, 0
+		case seqnos[i] > feeder.index.seqnos[vbno]:
+			m.Status, m.Seqno = mcd.ROLLBACK, feeder.index.seqnos[vbno]
+		default:
+			m.Status, m.VBuuid = mcd.SUCCESS, vbuuid
+			m.FailoverLog = &mc.FailoverLog{{vbuuid, 0}}
+			stream := &replayStream{opaque: opaque, vbuuid: vbuuid, start: seqnos[i]}
+			feeder.streams[vbno], streams[vbno] = stream, stream
+		}
+		if !feeder.send(m) {
+			feeder.mu.Unlock()
+			return projC.ErrorFeeder
+		}
+	}
+	feeder.mu.Unlock()
+
+	if len(streams) > 0 {
+		feeder.wg.Add(1)
+		go feeder.replay(streams)
+	}
+	return nil
+}
+
+// EndVbStreams implements Feeder{} interface.
+func (feeder *replayFeeder) EndVbStreams(
+	opaque uint16, ts *protobuf.TsVbuuid) error {
+
+	feeder.mu.Lock()
+	defer feeder.mu.Unlock()
+
+	for _, vbno := range c.Vbno32to16(ts.GetVbnos()) {
+		m := &mc.DcpEvent{
+			Opcode:  mcd.DCP_STREAMEND,
+			Status:  mcd.SUCCESS,
+			VBucket: vbno,
+			Opaque:  opaque,
+			Ctime:   time.Now().UnixNano(),
+		}
+		if _, ok := feeder.streams[vbno]; !ok {
+			m.Status = mcd.KEY_ENOENT
+		}
+		delete(feeder.streams, vbno)
+		if !feeder.send(m) {
+			return projC.ErrorFeeder
+		}
+	}
+	return nil
+}
+
+// CloseFeed implements Feeder{} interface.
+func (feeder *replayFeeder) CloseFeed() error {
+	close(feeder.finch)
+	feeder.wg.Wait()
+	close(feeder.mutch)
+	logging.Infof("%v closed\n", feeder.logPrefix)
+	return nil
+}
+
+// replay events from file for `streams`, events for a vbucket whose
+// stream has ended, or restarted, are skipped.
+func (feeder *replayFeeder) replay(streams map[uint16]*replayStream) {
+	defer feeder.wg.Done()
+
+	rr, err := openReplayReader(feeder.path)
+	if err != nil {
+		logging.Errorf("%v openReplayReader(): %v\n", feeder.logPrefix, err)
+		return
+	}
+	defer rr.close()
+
+	count := 0
+	for {
+		m, err := rr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logging.Errorf("%v replay: %v\n", feeder.logPrefix, err)
+			break
+		}
+		stream, ok := streams[m.VBucket]
+		if !ok {
+			continue
+		} else if m.Opcode == mcd.DCP_SNAPSHOT && m.SnapendSeq <= stream.start {
+			continue
+		} else if m.Opcode != mcd.DCP_SNAPSHOT && m.Seqno <= stream.start {
+			continue
+		}
+		m.Opaque, m.VBuuid = stream.opaque, stream.vbuuid
+
+		feeder.mu.Lock()
+		if feeder.streams[m.VBucket] != stream { // stream ended
+			delete(streams, m.VBucket)
+			feeder.mu.Unlock()
+			if len(streams) == 0 {
+				break
+			}
+			continue
+		}
+		ok = feeder.send(m)
+		feeder.mu.Unlock()
+		if !ok {
+			return
+		}
+		count++
+	}
+	fmsg := "%v replayed %v events for %v vbuckets\n"
+	logging.Infof(fmsg, feeder.logPrefix, count, len(streams))
+}
+
+// send event downstream, return false if feeder is closed.
+func (feeder *replayFeeder) send(m *mc.DcpEvent) bool {
+	select {
+	case feeder.mutch <- m:
+		return true
+	case <-feeder.finch:
+		return false
+	}
+}
@@ -0,0 +1,233 @@
+package projector
+
+import "bytes"
+import "encoding/binary"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import "github.com/couchbase/indexing/secondary/logging"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+
+var replayTestEvents = `
+{"op":"snapshot","vb":0,"vbuuid":10,"start":1,"end":3,"type":1}
+{"op":"mutation","vb":0,"vbuuid":10,"seqno":1,"key":"k1","value":{"a":1},"xattrs":{"_sync":{"rev":"1-a"}}}
+
+{"op":"mutation","vb":1,"vbuuid":20,"seqno":1,"key":"k3","raw":"AAE="}
+{"op":"deletion","vb":0,"vbuuid":10,"seqno":2,"key":"k2","revseqno":4}
+{"op":"expiration","vb":0,"vbuuid":10,"seqno":3,"key":"k1"}
+`
+
+func writeReplayFile(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readReplayEvents(t *testing.T, path string) []*mc.DcpEvent {
+	rr, err := openReplayReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.close()
+
+	events := make([]*mc.DcpEvent, 0)
+	for {
+		m, err := rr.next()
+		if err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, m)
+	}
+}
+
+func TestReplayJSONReader(t *testing.T) {
+	dir := writeReplayFile(t, "default.jsonl", replayTestEvents)
+	defer os.RemoveAll(dir)
+
+	path, err := ReplayFile(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readReplayEvents(t, path)
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %v", len(events))
+	}
+
+	snap := events[0]
+	if snap.Opcode != mcd.DCP_SNAPSHOT || snap.SnapstartSeq != 1 ||
+		snap.SnapendSeq != 3 || snap.SnapshotType != 1 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+	m := events[1]
+	if m.Opcode != mcd.DCP_MUTATION || m.Seqno != 1 || m.VBuuid != 10 ||
+		string(m.Key) != "k1" || string(m.Value) != `{"a":1}` {
+		t.Errorf("unexpected mutation %+v", m)
+	}
+	if !m.IsJSON() || !m.HasXATTR() {
+		t.Errorf("expected JSON value with xattrs, datatype %v", m.Datatype)
+	}
+	if sync, ok := m.XATTR["_sync"].(map[string]interface{}); !ok || sync["rev"] != "1-a" {
+		t.Errorf("unexpected xattrs %v", m.XATTR)
+	}
+	if raw := events[2]; raw.VBucket != 1 || raw.IsJSON() ||
+		!bytes.Equal(raw.Value, []byte{0, 1}) {
+		t.Errorf("unexpected raw mutation %+v", raw)
+	}
+	if del := events[3]; del.Opcode != mcd.DCP_DELETION || del.RevSeqno != 4 {
+		t.Errorf("unexpected deletion %+v", del)
+	}
+	if exp := events[4]; exp.Opcode != mcd.DCP_EXPIRATION || exp.Seqno != 3 {
+		t.Errorf("unexpected expiration %+v", exp)
+	}
+
+	// malformed line
+	dir2 := writeReplayFile(t, "default.jsonl", `{"op":"unknown","vb":0}`)
+	defer os.RemoveAll(dir2)
+	rr, err := openReplayReader(filepath.Join(dir2, "default.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.close()
+	if _, err := rr.next(); err == nil {
+		t.Errorf("expected error for unknown op")
+	}
+}
+
+func TestReplayBinaryReader(t *testing.T) {
+	var buf bytes.Buffer
+
+	// stream-request response for vbucket 3 supplies its vbuuid.
+	flog := make([]byte, 16)
+	binary.BigEndian.PutUint64(flog, 30)
+	resp := (&mcd.MCRequest{Opcode: mcd.DCP_STREAMREQ, Opaque: 3, Body: flog}).Bytes()
+	resp[0] = mcd.RES_MAGIC
+	buf.Write(resp)
+
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint64(extras, 7)
+	buf.Write((&mcd.MCRequest{
+		Opcode: mcd.DCP_MUTATION, VBucket: 3, Key: []byte("k"),
+		Extras: extras, Body: []byte(`{}`), Datatype: replayDatatypeJSON,
+	}).Bytes())
+	// truncated packet at the end of capture.
+	buf.Write([]byte{mcd.REQ_MAGIC, byte(mcd.DCP_MUTATION), 0})
+
+	dir := writeReplayFile(t, "default.dcp", buf.String())
+	defer os.RemoveAll(dir)
+
+	events := readReplayEvents(t, filepath.Join(dir, "default.dcp"))
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %v", len(events))
+	}
+	m := events[0]
+	if m.Opcode != mcd.DCP_MUTATION || m.VBucket != 3 || m.VBuuid != 30 ||
+		m.Seqno != 7 || string(m.Value) != `{}` {
+		t.Errorf("unexpected mutation %+v", m)
+	}
+}
+
+func TestReplayVbuckets(t *testing.T) {
+	dir := writeReplayFile(t, "default.jsonl", replayTestEvents)
+	defer os.RemoveAll(dir)
+
+	vbnos, vbuuids, err := ReplayVbuckets(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vbnos) != 2 || vbnos[0] != 0 || vbnos[1] != 1 {
+		t.Errorf("unexpected vbuckets %v", vbnos)
+	}
+	if vbuuids[0] != 10 || vbuuids[1] != 20 {
+		t.Errorf("unexpected vbuuids %v", vbuuids)
+	}
+	if _, _, err := ReplayVbuckets(dir, "missing"); err != ErrorReplayFile {
+		t.Errorf("expected %v, got %v", ErrorReplayFile, err)
+	}
+}
+
+func receiveEvent(t *testing.T, mutch <-chan *mc.DcpEvent) *mc.DcpEvent {
+	select {
+	case m := <-mutch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return nil
+}
+
+func TestReplayFeed(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	dir := writeReplayFile(t, "default.jsonl", replayTestEvents)
+	defer os.RemoveAll(dir)
+
+	config := map[string]interface{}{"dataChanSize": 100}
+	feeder, err := OpenReplayFeed("test", "default", dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutch := feeder.GetChannel()
+
+	// vbucket 0 from seqno 1, vbucket 1 on another branch, vbucket 2
+	// not in the file.
+	opaque := uint16(0xAB)
+	reqTs := protobuf.NewTsVbuuid("default", "default", 1024)
+	reqTs.Append(0, 1, 10, 1, 1)
+	reqTs.Append(1, 1, 99, 1, 1)
+	reqTs.Append(2, 0, 0, 0, 0)
+	if err := feeder.StartVbStreams(opaque, reqTs); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := []mcd.Status{mcd.SUCCESS, mcd.ROLLBACK, mcd.NOT_MY_VBUCKET}
+	for vbno, status := range statuses {
+		m := receiveEvent(t, mutch)
+		if m.Opcode != mcd.DCP_STREAMREQ || m.VBucket != uint16(vbno) ||
+			m.Status != status || m.Opaque != opaque {
+			t.Fatalf("unexpected stream-request response %+v", m)
+		}
+	}
+
+	// events of vbucket 0 after seqno 1.
+	for _, seqno := range []uint64{0, 2, 3} {
+		m := receiveEvent(t, mutch)
+		if m.VBucket != 0 || m.Opaque != opaque || m.VBuuid != 10 {
+			t.Fatalf("unexpected event %+v", m)
+		} else if seqno == 0 && m.Opcode != mcd.DCP_SNAPSHOT {
+			t.Fatalf("expected snapshot, got %v", m.Opcode)
+		} else if seqno != 0 && m.Seqno != seqno {
+			t.Fatalf("expected seqno %v, got %v", seqno, m.Seqno)
+		}
+	}
+
+	endTs := protobuf.NewTsVbuuid("default", "default", 1024)
+	endTs.Append(0, 0, 0, 0, 0)
+	if err := feeder.EndVbStreams(opaque, endTs); err != nil {
+		t.Fatal(err)
+	}
+	if m := receiveEvent(t, mutch); m.Opcode != mcd.DCP_STREAMEND ||
+		m.Status != mcd.SUCCESS {
+		t.Fatalf("unexpected stream-end %+v", m)
+	}
+
+	if err := feeder.CloseFeed(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-mutch; ok {
+		t.Errorf("expected channel to be closed")
+	}
+}
@@ -0,0 +1,92 @@
+package projector
+
+import "runtime"
+import "strings"
+import "sync/atomic"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/couchbase/indexing/secondary/system"
+
+// Backfill throttling.
+//
+// Topics used for initial index builds (backfill) stream the whole
+// bucket from DCP and can starve maintenance topics of projector cpu.
+// Projector samples its cpu utilization periodically and, when above
+// the configured ceiling, delays every DCP event of backfill topics in
+// proportion to the pressure. Delaying the KVData routine of a topic
+// fills up its DCP buffer and slows down the backfill from KV for that
+// connection alone, events of other topics are never delayed.
+
+// pressure starts at this fraction of the ceiling and reaches full
+// throttling at the ceiling.
+const throttleRampStart = 0.75
+
+// minimum delay accumulated by KVData before it sleeps.
+const minThrottleSleep = time.Millisecond
+
+var backfillThrottle struct {
+	level int64 // in percent, 0 is not throttled
+	delay int64 // in nanoseconds per event
+}
+
+func backfillThrottleLevel() int64 {
+	return atomic.LoadInt64(&backfillThrottle.level)
+}
+
+func backfillThrottleDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&backfillThrottle.delay))
+}
+
+// isBackfillTopic return whether `topic` is throttled as backfill.
+func isBackfillTopic(topic, prefix string) bool {
+	return prefix != "" && strings.HasPrefix(topic, prefix)
+}
+
+// runBackfillThrottle samples projector cpu and updates the backfill
+// throttle, for the life time of the process.
+func (p *Projector) runBackfillThrottle() {
+	stats, err := system.NewSystemStats()
+	if err != nil {
+		fmsg := "%v backfill throttle disabled, cpu stats not available: %v\n"
+		logging.Errorf(fmsg, p.logPrefix, err)
+		return
+	}
+	defer stats.Close()
+	stats.ProcessCpuPercent() // skip the first sample
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config := p.GetConfig().SectionConfig("projector.backfillThrottle.", true)
+		_, percent, err := stats.ProcessCpuPercent()
+		if err != nil {
+			logging.Debugf("%v cpu percent: %v\n", p.logPrefix, err)
+			continue
+		}
+
+		var level int64
+		ceiling := config["cpuHighMark"].Float64()
+		cpu := percent / float64(100*runtime.GOMAXPROCS(0))
+		if start := ceiling * throttleRampStart; ceiling > 0 && cpu > start {
+			if cpu >= ceiling {
+				level = 100
+			} else {
+				level = int64((cpu-start)/(ceiling-start)*100 + 0.5)
+			}
+		}
+		maxDelay := time.Duration(config["maxEventDelay"].Int()) * time.Microsecond
+		delay := maxDelay * time.Duration(level) / 100
+
+		prevLevel := backfillThrottleLevel()
+		atomic.StoreInt64(&backfillThrottle.level, level)
+		atomic.StoreInt64(&backfillThrottle.delay, int64(delay))
+		if level != 0 && prevLevel == 0 {
+			fmsg := "%v throttling backfill, cpu %.2f%% level %v\n"
+			logging.Infof(fmsg, p.logPrefix, percent, level)
+		} else if level == 0 && prevLevel != 0 {
+			logging.Infof("%v stopped throttling backfill\n", p.logPrefix)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import "strconv"
 import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
 import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 import "github.com/couchbase/indexing/secondary/logging"
 
 // VbucketWorker is immutable structure defined for each vbucket.
@@ -44,10 +45,20 @@ type VbucketWorker struct {
 	reqch chan []interface{}
 	finch chan bool
 	// config params
-	logPrefix   string
-	mutChanSize int
+	logPrefix     string
+	mutChanSize   int
+	evalBatchSize int
 
 	encodeBuf []byte
+	// shared by engines while evaluating a mutation
+	evalCtx *protobuf.EvalContext
+	// events of the current batch, and data transformed from them
+	// for each endpoint, sent once per batch.
+	events    []*mc.DcpEvent
+	batchData map[string][]*c.DataportKeyVersions
+	// stats
+	evalBatches uint64
+	evalEvents  uint64
 }
 
 // NewVbucketWorker creates a new routine to handle this vbucket stream.
@@ -57,6 +68,10 @@ func NewVbucketWorker(
 
 	mutChanSize := config["mutationChanSize"].Int()
 	encodeBufSize := config["encodeBufSize"].Int()
+	evalBatchSize := config["evalBatchSize"].Int()
+	if evalBatchSize < 1 {
+		evalBatchSize = 1
+	}
 
 	worker := &VbucketWorker{
 		id:        id,
@@ -72,14 +87,21 @@ func NewVbucketWorker(
 		reqch:     make(chan []interface{}, mutChanSize),
 		finch:     make(chan bool),
 		encodeBuf: make([]byte, 0, encodeBufSize),
+		evalCtx:   protobuf.NewEvalContext(),
+		events:    make([]*mc.DcpEvent, 0, evalBatchSize),
+		batchData: make(map[string][]*c.DataportKeyVersions),
 	}
 	fmsg := "WRKR[%v<-%v<-%v #%v]"
 	worker.logPrefix = fmt.Sprintf(fmsg, id, bucket, feed.cluster, feed.topic)
 	worker.mutChanSize = mutChanSize
+	worker.evalBatchSize = evalBatchSize
 	go worker.run(worker.reqch)
 	return worker
 }
 
+// key for worker's evaluation stats, other keys are vbucket numbers.
+const workerEvalStats = "eval"
+
 // commands to server
 const (
 	vwCmdEvent byte = iota + 1
@@ -195,114 +217,192 @@ func (worker *VbucketWorker) run(reqch chan []interface{}) {
 		logging.Infof("%v ##%x ... stopped\n", logPrefix, worker.opaque)
 	}()
 
+	var pending []interface{} // command received while batching events
 loop:
 	for {
-		select {
-		case msg := <-reqch:
-			cmd := msg[0].(byte)
-			switch cmd {
-			case vwCmdSyncPulse:
-				for _, v := range worker.vbuckets {
-					if data := v.makeSyncData(worker.engines); data != nil {
-						v.syncCount++
-						fmsg := "%v ##%x sync count %v\n"
-						logging.Tracef(fmsg, v.logPrefix, v.opaque, v.syncCount)
-						worker.broadcast2Endpoints(data)
-
-					} else {
-						fmsg := "%v ##%x Sync NOT PUBLISHED for %v\n"
-						logging.Errorf(fmsg, logPrefix, worker.opaque, v.vbno)
-					}
+		var msg []interface{}
+		if pending != nil {
+			msg, pending = pending, nil
+		} else {
+			msg = <-reqch
+		}
+		cmd := msg[0].(byte)
+		switch cmd {
+		case vwCmdSyncPulse:
+			for _, v := range worker.vbuckets {
+				if data := v.makeSyncData(worker.engines); data != nil {
+					v.syncCount++
+					fmsg := "%v ##%x sync count %v\n"
+					logging.Tracef(fmsg, v.logPrefix, v.opaque, v.syncCount)
+					worker.broadcast2Endpoints(data)
+
+				} else {
+					fmsg := "%v ##%x Sync NOT PUBLISHED for %v\n"
+					logging.Errorf(fmsg, logPrefix, worker.opaque, v.vbno)
 				}
+			}
 
-			case vwCmdGetVbuckets:
-				vbuckets := make([]*Vbucket, 0, len(worker.vbuckets))
-				for _, v := range worker.vbuckets {
-					vbuckets = append(vbuckets, v)
-				}
-				respch := msg[1].(chan []interface{})
-				respch <- []interface{}{vbuckets}
-
-			case vwCmdAddEngines:
-				worker.engines = make(map[uint64]*Engine)
-				opaque := msg[1].(uint16)
-				if msg[2] != nil {
-					fmsg := "%v ##%x AddEngine %v\n"
-					for uuid, engine := range msg[2].(map[uint64]*Engine) {
-						worker.engines[uuid] = engine
-						logging.Tracef(fmsg, logPrefix, opaque, uuid)
-					}
-					worker.printCtrl(worker.engines)
-				}
-				if msg[3] != nil {
-					endpoints := msg[3].(map[string]c.RouterEndpoint)
-					worker.endpoints = worker.updateEndpoints(opaque, endpoints)
-					worker.printCtrl(worker.endpoints)
-				}
-				cseqnos := make(map[uint16]uint64)
-				for _, v := range worker.vbuckets {
-					cseqnos[v.vbno] = v.seqno
-				}
-				respch := msg[4].(chan []interface{})
-				respch <- []interface{}{cseqnos}
-
-			case vwCmdDelEngines:
-				opaque := msg[1].(uint16)
-				fmsg := "%v ##%x vwCmdDeleteEngines\n"
-				logging.Tracef(fmsg, logPrefix, opaque)
-				engineKeys := msg[2].([]uint64)
-				fmsg = "%v ##%x DelEngine %v\n"
-				for _, uuid := range engineKeys {
-					delete(worker.engines, uuid)
+		case vwCmdGetVbuckets:
+			vbuckets := make([]*Vbucket, 0, len(worker.vbuckets))
+			for _, v := range worker.vbuckets {
+				vbuckets = append(vbuckets, v)
+			}
+			respch := msg[1].(chan []interface{})
+			respch <- []interface{}{vbuckets}
+
+		case vwCmdAddEngines:
+			worker.engines = make(map[uint64]*Engine)
+			opaque := msg[1].(uint16)
+			if msg[2] != nil {
+				fmsg := "%v ##%x AddEngine %v\n"
+				for uuid, engine := range msg[2].(map[uint64]*Engine) {
+					worker.engines[uuid] = engine
 					logging.Tracef(fmsg, logPrefix, opaque, uuid)
 				}
-				fmsg = "%v ##%x deleted engines %v\n"
-				logging.Tracef(fmsg, logPrefix, opaque, engineKeys)
-				respch := msg[3].(chan []interface{})
-				respch <- []interface{}{nil}
-
-			case vwCmdGetStats:
-				logging.Tracef("%v vwCmdStatistics\n", worker.logPrefix)
-				stats := make(map[string]interface{})
-				for vbno, v := range worker.vbuckets {
-					stats[strconv.Itoa(int(vbno))] = map[string]interface{}{
-						"syncs":     float64(v.syncCount),
-						"snapshots": float64(v.sshotCount),
-						"mutations": float64(v.mutationCount),
-					}
+				worker.printCtrl(worker.engines)
+			}
+			if msg[3] != nil {
+				endpoints := msg[3].(map[string]c.RouterEndpoint)
+				worker.endpoints = worker.updateEndpoints(opaque, endpoints)
+				worker.printCtrl(worker.endpoints)
+			}
+			cseqnos := make(map[uint16]uint64)
+			for _, v := range worker.vbuckets {
+				cseqnos[v.vbno] = v.seqno
+			}
+			respch := msg[4].(chan []interface{})
+			respch <- []interface{}{cseqnos}
+
+		case vwCmdDelEngines:
+			opaque := msg[1].(uint16)
+			fmsg := "%v ##%x vwCmdDeleteEngines\n"
+			logging.Tracef(fmsg, logPrefix, opaque)
+			engineKeys := msg[2].([]uint64)
+			fmsg = "%v ##%x DelEngine %v\n"
+			for _, uuid := range engineKeys {
+				delete(worker.engines, uuid)
+				logging.Tracef(fmsg, logPrefix, opaque, uuid)
+			}
+			fmsg = "%v ##%x deleted engines %v\n"
+			logging.Tracef(fmsg, logPrefix, opaque, engineKeys)
+			respch := msg[3].(chan []interface{})
+			respch <- []interface{}{nil}
+
+		case vwCmdGetStats:
+			logging.Tracef("%v vwCmdStatistics\n", worker.logPrefix)
+			stats := make(map[string]interface{})
+			hits, misses := worker.evalCtx.Stats()
+			stats[workerEvalStats] = map[string]interface{}{
+				"batches":    float64(worker.evalBatches),
+				"events":     float64(worker.evalEvents),
+				"memoHits":   float64(hits),
+				"memoMisses": float64(misses),
+			}
+			for vbno, v := range worker.vbuckets {
+				stats[strconv.Itoa(int(vbno))] = map[string]interface{}{
+					"syncs":     float64(v.syncCount),
+					"snapshots": float64(v.sshotCount),
+					"mutations": float64(v.mutationCount),
 				}
-				respch := msg[1].(chan []interface{})
-				respch <- []interface{}{stats}
-
-			case vwCmdResetConfig:
-				_, respch := msg[1].(c.Config), msg[2].(chan []interface{})
-				respch <- []interface{}{nil}
-
-			case vwCmdEvent:
-				m := msg[1].(*mc.DcpEvent)
-				v := worker.handleEvent(m)
-				if v == nil {
-					fmsg := "%v ##%x nil vbucket %v for %v"
-					logging.Fatalf(fmsg, logPrefix, m.Opaque, m.VBucket, m.Opcode)
-
-				} else if m.Opcode == mcd.DCP_STREAMEND {
-					delete(worker.vbuckets, v.vbno)
-
-				} else if m.Opaque != v.opaque {
-					fmsg := "%v ##%x mismatch with vbucket.##%x %v"
-					logging.Fatalf(fmsg, logPrefix, m.Opaque, v.opaque, m.Opcode)
+			}
+			respch := msg[1].(chan []interface{})
+			respch <- []interface{}{stats}
+
+		case vwCmdResetConfig:
+			_, respch := msg[1].(c.Config), msg[2].(chan []interface{})
+			respch <- []interface{}{nil}
+
+		case vwCmdEvent:
+			// queued up events are processed as a batch, any other
+			// command is handled once the batch is done.
+			events := append(worker.events, msg[1].(*mc.DcpEvent))
+		batch:
+			for len(events) < worker.evalBatchSize {
+				select {
+				case next := <-reqch:
+					if next[0].(byte) != vwCmdEvent {
+						pending = next
+						break batch
+					}
+					events = append(events, next[1].(*mc.DcpEvent))
+				default:
+					break batch
 				}
-
-			case vwCmdClose:
-				logging.Infof("%v ##%x closed\n", logPrefix, worker.opaque)
-				respch := msg[1].(chan []interface{})
-				respch <- []interface{}{nil}
-				break loop
 			}
+			worker.processBatch(events)
+			for i := range events {
+				events[i] = nil
+			}
+			worker.events = events[:0]
+
+		case vwCmdClose:
+			logging.Infof("%v ##%x closed\n", logPrefix, worker.opaque)
+			respch := msg[1].(chan []interface{})
+			respch <- []interface{}{nil}
+			break loop
 		}
 	}
 }
 
+// processBatch handles a batch of events in order.  Data transformed from
+// the mutations is gathered for each endpoint and sent to it in a single
+// message, before broadcasting any other event of the batch, so that
+// endpoints see the events in the order received.
+func (worker *VbucketWorker) processBatch(events []*mc.DcpEvent) {
+	worker.evalBatches++
+	for _, m := range events {
+		switch m.Opcode {
+		case mcd.DCP_MUTATION, mcd.DCP_DELETION, mcd.DCP_EXPIRATION:
+		default:
+			worker.sendBatch()
+		}
+		worker.processEvent(m)
+	}
+	worker.sendBatch()
+}
+
+// sendBatch sends data gathered for each endpoint in the current batch.
+func (worker *VbucketWorker) sendBatch() {
+	for raddr, batch := range worker.batchData {
+		delete(worker.batchData, raddr)
+		endpoint, ok := worker.endpoints[raddr]
+		if !ok {
+			continue
+		}
+		var data interface{} = batch
+		if len(batch) == 1 {
+			data = batch[0]
+		}
+		// FIXME: without the coordinator doing shared topic
+		// management, we will allow the feed to block.
+		// Otherwise, send might fail due to ErrorChannelFull
+		// or ErrorClosed
+		if err := endpoint.Send(data); err != nil {
+			fmsg := "%v ##%x endpoint(%q).Send() failed: %v"
+			logging.Debugf(fmsg, worker.logPrefix, worker.opaque, raddr, err)
+			endpoint.Close()
+			delete(worker.endpoints, raddr)
+		}
+	}
+}
+
+func (worker *VbucketWorker) processEvent(m *mc.DcpEvent) {
+	logPrefix := worker.logPrefix
+	worker.evalEvents++
+	v := worker.handleEvent(m)
+	if v == nil {
+		fmsg := "%v ##%x nil vbucket %v for %v"
+		logging.Fatalf(fmsg, logPrefix, m.Opaque, m.VBucket, m.Opcode)
+
+	} else if m.Opcode == mcd.DCP_STREAMEND {
+		delete(worker.vbuckets, v.vbno)
+
+	} else if m.Opaque != v.opaque {
+		fmsg := "%v ##%x mismatch with vbucket.##%x %v"
+		logging.Fatalf(fmsg, logPrefix, m.Opaque, v.opaque, m.Opcode)
+	}
+}
+
 // only endpoints that host engines defined on this vbucket.
 func (worker *VbucketWorker) updateEndpoints(
 	opaque uint16,
@@ -384,8 +484,11 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 		dataForEndpoints := make(map[string]interface{})
 		// for each engine distribute transformations to endpoints.
 		fmsg := "%v ##%x TransformRoute: %v\n"
+		// document is parsed once and shared across engines.
+		worker.evalCtx.Reset()
 		for _, engine := range worker.engines {
-			newBuf, err := engine.TransformRoute(v.vbuuid, m, dataForEndpoints, worker.encodeBuf)
+			newBuf, err := engine.TransformRoute(
+				v.vbuuid, m, dataForEndpoints, worker.encodeBuf, worker.evalCtx)
 			if err != nil {
 				logging.Errorf(fmsg, logPrefix, m.Opaque, err)
 			}
@@ -394,19 +497,11 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 				worker.encodeBuf = newBuf[:0]
 			}
 		}
-		// send data to corresponding endpoint.
+		// gather data for corresponding endpoint, sent with the batch.
 		for raddr, data := range dataForEndpoints {
-			if endpoint, ok := worker.endpoints[raddr]; ok {
-				// FIXME: without the coordinator doing shared topic
-				// management, we will allow the feed to block.
-				// Otherwise, send might fail due to ErrorChannelFull
-				// or ErrorClosed
-				if err := endpoint.Send(data); err != nil {
-					fmsg := "%v ##%x endpoint(%q).Send() failed: %v"
-					logging.Debugf(fmsg, logPrefix, worker.opaque, raddr, err)
-					endpoint.Close()
-					delete(worker.endpoints, raddr)
-				}
+			if _, ok := worker.endpoints[raddr]; ok {
+				dkv := data.(*c.DataportKeyVersions)
+				worker.batchData[raddr] = append(worker.batchData[raddr], dkv)
 			}
 		}
 
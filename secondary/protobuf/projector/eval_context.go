@@ -0,0 +1,117 @@
+package protobuf
+
+import qexpr "github.com/couchbase/query/expression"
+import qvalue "github.com/couchbase/query/value"
+
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+
+// EvalContext is shared by all IndexEvaluators of a bucket while
+// evaluating a single DCP mutation. It is owned by a vbucket-worker
+// and hence not thread-safe.
+//
+// The document and its old value, if any, are parsed once and the
+// parsed values are shared across evaluators. Results of index-key,
+// partition-key and where expressions are memoized by their canonical
+// string form, so that expressions common to more than one index are
+// evaluated once per document.
+type EvalContext struct {
+	m       *mc.DcpEvent
+	meta    map[string]interface{}
+	context qexpr.Context
+	docs    [2]qvalue.AnnotatedValue // new and old document
+	memo    [2]map[string]*evalResult
+
+	// stats
+	hits   uint64
+	misses uint64
+}
+
+type evalResult struct {
+	scalar qvalue.Value
+	vector qvalue.Values
+	err    error
+}
+
+// NewEvalContext create a new evaluation context for vbucket-worker.
+func NewEvalContext() *EvalContext {
+	return &EvalContext{
+		context: qexpr.NewIndexContext(),
+		memo: [2]map[string]*evalResult{
+			make(map[string]*evalResult),
+			make(map[string]*evalResult),
+		},
+	}
+}
+
+// Reset implement EvaluatorContext{} interface.
+func (ctx *EvalContext) Reset() {
+	ctx.m, ctx.meta = nil, nil
+	ctx.docs[0], ctx.docs[1] = nil, nil
+	for _, memo := range ctx.memo {
+		for key := range memo {
+			delete(memo, key)
+		}
+	}
+}
+
+// Stats return number of memoized expression hits and misses.
+func (ctx *EvalContext) Stats() (hits, misses uint64) {
+	return ctx.hits, ctx.misses
+}
+
+// bind the context to mutation `m`, implicitly resets the context
+// if it was previously used for a different mutation. Revision id is
+// added to meta() once an evaluator that refers to it binds.
+func (ctx *EvalContext) bind(m *mc.DcpEvent, revid bool) {
+	if ctx.m != m {
+		ctx.Reset()
+		ctx.m, ctx.meta = m, dcpEvent2Meta(m, revid)
+	} else if _, ok := ctx.meta["revid"]; revid && !ok {
+		ctx.meta["revid"] = dcpEventRevid(m)
+	}
+}
+
+func docIndex(old bool) int {
+	if old {
+		return 1
+	}
+	return 0
+}
+
+// docValue return the parsed document, parsing it only on first use.
+func (ctx *EvalContext) docValue(doc []byte, old bool) qvalue.AnnotatedValue {
+	i := docIndex(old)
+	if ctx.docs[i] == nil {
+		docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(doc, true))
+		docval.SetAttachment("meta", ctx.meta)
+		ctx.docs[i] = docval
+	}
+	return ctx.docs[i]
+}
+
+// evaluate expression `expr`, identified by `key`, on new or old
+// document.
+func (ctx *EvalContext) evaluate(
+	expr qexpr.Expression, key string,
+	docval qvalue.AnnotatedValue, old bool) (qvalue.Value, qvalue.Values, error) {
+
+	memo := ctx.memo[docIndex(old)]
+	if r, ok := memo[key]; ok {
+		ctx.hits++
+		return r.scalar, r.vector, r.err
+	}
+	ctx.misses++
+	scalar, vector, err := expr.EvaluateForIndex(docval, ctx.context)
+	memo[key] = &evalResult{scalar: scalar, vector: vector, err: err}
+	return scalar, vector, err
+}
+
+// exprKeys return canonical string form of compiled expressions,
+// used as memoization key.
+func exprKeys(cExprs []interface{}) []string {
+	keys := make([]string, 0, len(cExprs))
+	for _, cExpr := range cExprs {
+		keys = append(keys, qexpr.NewStringer().Visit(cExpr.(qexpr.Expression)))
+	}
+	return keys
+}
@@ -0,0 +1,98 @@
+package protobuf
+
+import "bytes"
+import "testing"
+
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+
+func TestEvalContextMemoize(t *testing.T) {
+	cExprs1, err := CompileN1QLExpression([]string{`city`, `age`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cExprs2, err := CompileN1QLExpression([]string{`age`, `gender`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys1, keys2 := exprKeys(cExprs1), exprKeys(cExprs2)
+
+	m := &mc.DcpEvent{Key: []byte("docid"), Value: doc150}
+	ctx := NewEvalContext()
+	ctx.bind(m, false)
+
+	testcases := []struct {
+		cExprs []interface{}
+		keys   []string
+	}{{cExprs1, keys1}, {cExprs2, keys2}}
+
+	for _, tc := range testcases {
+		cExprs, keys := tc.cExprs, tc.keys
+		out1, _, err := n1qlTransformContext(
+			ctx, m.Key, m.Value, false, cExprs, keys, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out2, _, err := N1QLTransform(
+			m.Key, m.Value, cExprs, ctx.meta, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out1, out2) {
+			t.Errorf("expected %v, got %v", out2, out1)
+		}
+	}
+
+	if hits, misses := ctx.Stats(); hits != 1 || misses != 3 {
+		t.Errorf("expected 1 hit and 3 misses, got %v %v", hits, misses)
+	}
+
+	// a new mutation should not see memoized values.
+	ctx.bind(&mc.DcpEvent{Key: []byte("docid2"), Value: doc150}, false)
+	if len(ctx.memo[0]) != 0 || ctx.docs[0] != nil {
+		t.Errorf("expected context to be reset for new mutation")
+	}
+}
+
+func TestMetaFields(t *testing.T) {
+	cExprs, err := CompileN1QLExpression([]string{
+		"meta().`revid`", "meta().`deleted`", "meta().`xattrs`.`_sync`.`rev`",
+		"meta().`xattrs`.`txn`",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mc.DcpEvent{
+		Key:      []byte("docid"),
+		Value:    doc150,
+		RevSeqno: 1,
+		Cas:      5,
+		Expiry:   100,
+		XATTR: map[string]interface{}{
+			"_sync": map[string]interface{}{"rev": "2-abc"},
+			"txn":   "pending",
+		},
+	}
+	out, _, err := N1QLTransform(m.Key, m.Value, cExprs, dcpEvent2Meta(m, true), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := `["1-00000000000000050000006400000000",false,"2-abc","pending"]`
+	if string(out) != ref {
+		t.Errorf("expected %v, got %v", ref, string(out))
+	}
+
+	// revid is formatted only for expressions that refer to it.
+	if !refersRevid(exprKeys(cExprs)) || refersRevid(exprKeys(cExprs[1:])) {
+		t.Errorf("unexpected reference to revid in %v", exprKeys(cExprs))
+	}
+	if _, ok := dcpEvent2Meta(m, false)["revid"]; ok {
+		t.Errorf("expected no revid in meta()")
+	}
+	ctx := NewEvalContext()
+	ctx.bind(m, false)
+	ctx.bind(m, true)
+	if revid := ctx.meta["revid"]; revid != "1-00000000000000050000006400000000" {
+		t.Errorf("expected revid to be added on bind, got %v", revid)
+	}
+}
@@ -1,6 +1,9 @@
 package protobuf
 
 import "fmt"
+import "strings"
+import "sync/atomic"
+import "time"
 
 import "github.com/couchbase/indexing/secondary/logging"
 import c "github.com/couchbase/indexing/secondary/common"
@@ -92,11 +95,22 @@ func (instance *IndexInst) GetPartitionObject() Partition {
 // IndexEvaluator implements `Evaluator` interface for protobuf
 // definition of an index instance.
 type IndexEvaluator struct {
-	skExprs  []interface{} // compiled expression
-	pkExprs  []interface{} // compiled expression
-	whExpr   interface{}   // compiled expression
-	instance *IndexInst
-	version  FeedVersion
+	// stats, accessed atomically, must be 64-bit aligned.
+	prefilterEvals uint64 // mutations checked against pre-filter
+	prefilterSkips uint64 // mutations skipped by pre-filter
+	evalCount      uint64 // mutations transformed
+	evalDuration   uint64 // cumulative time spent in transform, in nS
+
+	skExprs   []interface{} // compiled expression
+	pkExprs   []interface{} // compiled expression
+	whExpr    interface{}   // compiled expression
+	skKeys    []string      // memoization keys for skExprs
+	pkKeys    []string      // memoization keys for pkExprs
+	whKeys    []string      // memoization key for whExpr
+	prefilter *docPrefilter // fast-path derived from where clause
+	revid     bool          // expressions refer to meta().revid
+	instance  *IndexInst
+	version   FeedVersion
 }
 
 // NewIndexEvaluator returns a reference to a new instance
@@ -118,6 +132,7 @@ func NewIndexEvaluator(instance *IndexInst,
 		if err != nil {
 			return nil, err
 		}
+		ie.skKeys = exprKeys(ie.skExprs)
 		// expression to evaluate partition key
 		exprs = defn.GetPartnExpressions()
 		if len(exprs) > 0 {
@@ -126,6 +141,7 @@ func NewIndexEvaluator(instance *IndexInst,
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.pkExprs = cExprs
+				ie.pkKeys = exprKeys(ie.pkExprs)
 			}
 		}
 		// expression to evaluate where clause
@@ -136,8 +152,11 @@ func NewIndexEvaluator(instance *IndexInst,
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.whExpr = cExprs[0]
+				ie.whKeys = exprKeys(cExprs[:1])
+				ie.prefilter = newDocPrefilter(ie.whExpr)
 			}
 		}
+		ie.revid = refersRevid(ie.skKeys, ie.pkKeys, ie.whKeys)
 
 	default:
 		logging.Errorf("invalid expression type %v\n", exprtype)
@@ -191,15 +210,43 @@ func (ie *IndexEvaluator) StreamEndData(
 	return &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
 }
 
+// GetStatistics implement Evaluator{} interface.
+func (ie *IndexEvaluator) GetStatistics() map[string]interface{} {
+	evals := atomic.LoadUint64(&ie.prefilterEvals)
+	skips := atomic.LoadUint64(&ie.prefilterSkips)
+	skipRate := float64(0)
+	if evals > 0 {
+		skipRate = float64(skips) / float64(evals)
+	}
+	count := atomic.LoadUint64(&ie.evalCount)
+	duration := atomic.LoadUint64(&ie.evalDuration)
+	avgLatency := float64(0)
+	if count > 0 {
+		avgLatency = float64(duration) / float64(count)
+	}
+	return map[string]interface{}{
+		"prefilter":          ie.prefilter != nil,
+		"prefilterEvaluated": float64(evals),
+		"prefilterSkipped":   float64(skips),
+		"prefilterSkipRate":  skipRate,
+		"evalCount":          float64(count),
+		"evalDuration":       float64(duration),
+		"evalAvgLatency":     avgLatency,
+	}
+}
+
 // TransformRoute implement Evaluator{} interface.
 func (ie *IndexEvaluator) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) ([]byte, error) {
+	encodeBuf []byte, ectx c.EvaluatorContext) ([]byte, error) {
 	var err error
+	start := time.Now()
 	defer func() { // panic safe
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%v", r)
 		}
+		atomic.AddUint64(&ie.evalCount, 1)
+		atomic.AddUint64(&ie.evalDuration, uint64(time.Since(start)))
 	}()
 
 	if ie.version < FeedVersion_watson {
@@ -220,25 +267,32 @@ func (ie *IndexEvaluator) TransformRoute(
 		opcode = mcd.DCP_MUTATION
 	}
 
-	meta := dcpEvent2Meta(m)
-	where, err := ie.wherePredicate(m, m.Value, meta, encodeBuf)
+	var meta map[string]interface{}
+	ctx, _ := ectx.(*EvalContext)
+	if ctx != nil {
+		ctx.bind(m, ie.revid)
+		meta = ctx.meta
+	} else {
+		meta = dcpEvent2Meta(m, ie.revid)
+	}
+	where, err := ie.wherePredicate(ctx, m, m.Value, meta, encodeBuf)
 	if err != nil {
 		return nil, err
 	}
 
 	if where && (len(m.Value) > 0 || retainDelete) { // project new secondary key
-		if npkey, err = ie.partitionKey(m, m.Key, m.Value, meta, encodeBuf); err != nil {
+		if npkey, err = ie.partitionKey(ctx, m, m.Value, false, meta); err != nil {
 			return nil, err
 		}
-		if nkey, newBuf, err = ie.evaluate(m, m.Key, m.Value, meta, encodeBuf); err != nil {
+		if nkey, newBuf, err = ie.evaluate(ctx, m, m.Value, false, meta, encodeBuf); err != nil {
 			return nil, err
 		}
 	}
 	if len(m.OldValue) > 0 { // project old secondary key
-		if opkey, err = ie.partitionKey(m, m.Key, m.OldValue, meta, encodeBuf); err != nil {
+		if opkey, err = ie.partitionKey(ctx, m, m.OldValue, true, meta); err != nil {
 			return nil, err
 		}
-		if okey, newBuf, err = ie.evaluate(m, m.Key, m.OldValue, meta, encodeBuf); err != nil {
+		if okey, newBuf, err = ie.evaluate(ctx, m, m.OldValue, true, meta, encodeBuf); err != nil {
 			return nil, err
 		}
 	}
@@ -325,9 +379,10 @@ func (ie *IndexEvaluator) TransformRoute(
 }
 
 func (ie *IndexEvaluator) evaluate(
-	m *mc.DcpEvent, docid, doc []byte,
+	ctx *EvalContext, m *mc.DcpEvent, doc []byte, old bool,
 	meta map[string]interface{}, encodeBuf []byte) ([]byte, []byte, error) {
 
+	docid := m.Key
 	defn := ie.instance.GetDefinition()
 	if defn.GetIsPrimary() { // primary index supported !!
 		return []byte(`["` + string(docid) + `"]`), nil, nil
@@ -340,14 +395,18 @@ func (ie *IndexEvaluator) evaluate(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
+		if ctx != nil {
+			return n1qlTransformContext(
+				ctx, docid, doc, old, ie.skExprs, ie.skKeys, encodeBuf)
+		}
 		return N1QLTransform(docid, doc, ie.skExprs, meta, encodeBuf)
 	}
 	return nil, nil, nil
 }
 
 func (ie *IndexEvaluator) partitionKey(
-	m *mc.DcpEvent, docid, doc []byte,
-	meta map[string]interface{}, encodeBuf []byte) ([]byte, error) {
+	ctx *EvalContext, m *mc.DcpEvent, doc []byte, old bool,
+	meta map[string]interface{}) ([]byte, error) {
 
 	defn := ie.instance.GetDefinition()
 	if ie.pkExprs == nil { // no partition key
@@ -360,14 +419,19 @@ func (ie *IndexEvaluator) partitionKey(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
-		out, _, err := N1QLTransform(docid, doc, ie.pkExprs, meta, nil)
+		if ctx != nil {
+			out, _, err := n1qlTransformContext(
+				ctx, m.Key, doc, old, ie.pkExprs, ie.pkKeys, nil)
+			return out, err
+		}
+		out, _, err := N1QLTransform(m.Key, doc, ie.pkExprs, meta, nil)
 		return out, err
 	}
 	return nil, nil
 }
 
 func (ie *IndexEvaluator) wherePredicate(
-	m *mc.DcpEvent, doc []byte,
+	ctx *EvalContext, m *mc.DcpEvent, doc []byte,
 	meta map[string]interface{}, encodeBuf []byte) (bool, error) {
 
 	// if where predicate is not supplied - always evaluate to `true`
@@ -375,6 +439,15 @@ func (ie *IndexEvaluator) wherePredicate(
 		return true, nil
 	}
 
+	// skip documents that cannot match without parsing them.
+	if ie.prefilter != nil {
+		atomic.AddUint64(&ie.prefilterEvals, 1)
+		if ie.prefilter.Skip(m.Key, doc, m.IsJSON()) {
+			atomic.AddUint64(&ie.prefilterSkips, 1)
+			return false, nil
+		}
+	}
+
 	if m.IsJSON() == false {
 		return false, nil
 	}
@@ -384,7 +457,15 @@ func (ie *IndexEvaluator) wherePredicate(
 	switch exprType {
 	case ExprType_N1QL:
 		// TODO: can be optimized by using a custom N1QL-evaluator.
-		out, _, err := N1QLTransform(nil, doc, []interface{}{ie.whExpr}, meta, encodeBuf)
+		var out []byte
+		var err error
+		cExprs := []interface{}{ie.whExpr}
+		if ctx != nil {
+			out, _, err = n1qlTransformContext(
+				ctx, nil, doc, false, cExprs, ie.whKeys, encodeBuf)
+		} else {
+			out, _, err = N1QLTransform(nil, doc, cExprs, meta, encodeBuf)
+		}
 		if out == nil { // missing is treated as false
 			return false, err
 		} else if err != nil { // errors are treated as false
@@ -398,8 +479,14 @@ func (ie *IndexEvaluator) wherePredicate(
 }
 
 // helper functions
-func dcpEvent2Meta(m *mc.DcpEvent) map[string]interface{} {
-	return map[string]interface{}{
+
+// dcpEvent2Meta return the meta() object of a document, all fields are
+// available in the DCP packet. User and system xattrs of deleted
+// documents are available only when requested from producer. Revision
+// id is formatted only if `revid` is true.
+func dcpEvent2Meta(m *mc.DcpEvent, revid bool) map[string]interface{} {
+	deleted := m.Opcode == mcd.DCP_DELETION || m.Opcode == mcd.DCP_EXPIRATION
+	meta := map[string]interface{}{
 		"id":         string(m.Key),
 		"byseqno":    m.Seqno,
 		"revseqno":   m.RevSeqno,
@@ -408,6 +495,31 @@ func dcpEvent2Meta(m *mc.DcpEvent) map[string]interface{} {
 		"locktime":   m.LockTime,
 		"nru":        m.Nru,
 		"cas":        m.Cas,
+		"deleted":    deleted,
+		"deletetime": m.DeleteTime,
 		"xattrs":     m.XATTR,
 	}
+	if revid {
+		meta["revid"] = dcpEventRevid(m)
+	}
+	return meta
+}
+
+// refersRevid return whether any of the expressions, by memoization
+// key, may refer to meta().revid.
+func refersRevid(keys ...[]string) bool {
+	for _, exprKeys := range keys {
+		for _, key := range exprKeys {
+			if strings.Contains(key, "revid") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dcpEventRevid return the revision id of a document, in the same
+// format as KV, <revseqno>-<cas><expiry><flags> in hex.
+func dcpEventRevid(m *mc.DcpEvent) string {
+	return fmt.Sprintf("%d-%016x%08x%08x", m.RevSeqno, m.Cas, m.Expiry, m.Flags)
 }
@@ -34,14 +34,41 @@ func N1QLTransform(
 	docid, doc []byte, cExprs []interface{},
 	meta map[string]interface{}, encodeBuf []byte) ([]byte, []byte, error) {
 
-	arrValue := make([]interface{}, 0, len(cExprs))
 	context := qexpr.NewIndexContext()
-	skip := true
 	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(doc, true))
 	docval.SetAttachment("meta", meta)
-	for _, cExpr := range cExprs {
+	eval := func(i int, expr qexpr.Expression) (qvalue.Value, qvalue.Values, error) {
+		return expr.EvaluateForIndex(docval, context)
+	}
+	return n1qlTransform(docid, cExprs, eval, encodeBuf)
+}
+
+// n1qlTransformContext is same as N1QLTransform, but parsed document
+// and evaluated expressions are shared via `ctx` across evaluators.
+// `keys` identify each of the compiled expression in `cExprs`.
+func n1qlTransformContext(
+	ctx *EvalContext, docid, doc []byte, old bool,
+	cExprs []interface{}, keys []string,
+	encodeBuf []byte) ([]byte, []byte, error) {
+
+	docval := ctx.docValue(doc, old)
+	eval := func(i int, expr qexpr.Expression) (qvalue.Value, qvalue.Values, error) {
+		return ctx.evaluate(expr, keys[i], docval, old)
+	}
+	return n1qlTransform(docid, cExprs, eval, encodeBuf)
+}
+
+type evalFunc func(i int, expr qexpr.Expression) (qvalue.Value, qvalue.Values, error)
+
+func n1qlTransform(
+	docid []byte, cExprs []interface{}, eval evalFunc,
+	encodeBuf []byte) ([]byte, []byte, error) {
+
+	arrValue := make([]interface{}, 0, len(cExprs))
+	skip := true
+	for i, cExpr := range cExprs {
 		expr := cExpr.(qexpr.Expression)
-		scalar, vector, err := expr.EvaluateForIndex(docval, context)
+		scalar, vector, err := eval(i, expr)
 		if err != nil {
 			exprstr := qexpr.NewStringer().Visit(expr)
 			fmsg := "EvaluateForIndex(%q) for docid %v, err: %v skip document"
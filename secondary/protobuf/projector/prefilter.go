@@ -0,0 +1,345 @@
+package protobuf
+
+import "bytes"
+import "encoding/json"
+import "strconv"
+import "strings"
+
+import qexpr "github.com/couchbase/query/expression"
+import qvalue "github.com/couchbase/query/value"
+
+// docPrefilter is a fast-path check derived from an index's WHERE clause.
+// It captures simple conjunctive predicates,
+//      meta().id LIKE "prefix%"
+//      meta().id = "docid"
+//      field = constant     (top-level field, scalar constant)
+// and is used to skip documents that can never satisfy the WHERE clause,
+// without parsing them. Documents that pass the pre-filter, or for which
+// pre-filter cannot decide, are evaluated using the full expression.
+type docPrefilter struct {
+	keyPrefix []byte         // docid should start with this prefix
+	keyExact  bool           // docid should be exactly keyPrefix
+	fields    []*fieldFilter // top-level fields with constant value
+}
+
+type fieldFilter struct {
+	name  string
+	value interface{} // string, float64, bool or nil (json null)
+}
+
+var metaId = qexpr.NewField(qexpr.NewMeta(), qexpr.NewFieldName("id", false))
+var metaSelfId = qexpr.NewField(
+	qexpr.NewMeta(qexpr.NewIdentifier("self")), qexpr.NewFieldName("id", false))
+
+// newDocPrefilter extracts pre-filter predicates from compiled WHERE
+// expression, returns nil if no predicate can be used for pre-filtering.
+func newDocPrefilter(whExpr interface{}) *docPrefilter {
+	expr, ok := whExpr.(qexpr.Expression)
+	if !ok || expr == nil {
+		return nil
+	}
+
+	pf := &docPrefilter{}
+	for _, term := range conjuncts(expr, nil) {
+		switch e := term.(type) {
+		case *qexpr.Like:
+			pf.addKeyLike(e.First(), e.Second())
+
+		case *qexpr.Eq:
+			if !pf.addKeyEq(e.First(), e.Second()) &&
+				!pf.addKeyEq(e.Second(), e.First()) &&
+				!pf.addFieldEq(e.First(), e.Second()) {
+				pf.addFieldEq(e.Second(), e.First())
+			}
+		}
+	}
+	if pf.keyPrefix == nil && len(pf.fields) == 0 {
+		return nil
+	}
+	return pf
+}
+
+// flatten nested AND expressions into a list of terms.
+func conjuncts(expr qexpr.Expression, terms []qexpr.Expression) []qexpr.Expression {
+	if and, ok := expr.(*qexpr.And); ok {
+		for _, op := range and.Operands() {
+			terms = conjuncts(op, terms)
+		}
+		return terms
+	}
+	return append(terms, expr)
+}
+
+func isMetaId(expr qexpr.Expression) bool {
+	return expr.EquivalentTo(metaId) || expr.EquivalentTo(metaSelfId)
+}
+
+func constantString(expr qexpr.Expression) (string, bool) {
+	val := expr.Value()
+	if val == nil || val.Type() != qvalue.STRING {
+		return "", false
+	}
+	s, ok := val.Actual().(string)
+	return s, ok
+}
+
+func (pf *docPrefilter) addKeyLike(first, second qexpr.Expression) bool {
+	if !isMetaId(first) || pf.keyPrefix != nil {
+		return false
+	}
+	pattern, ok := constantString(second)
+	if !ok {
+		return false
+	}
+	// literal prefix upto the first wildcard or escape character.
+	n := strings.IndexAny(pattern, `%_\`)
+	if n < 0 {
+		pf.keyPrefix, pf.keyExact = []byte(pattern), true
+	} else if n > 0 {
+		pf.keyPrefix = []byte(pattern[:n])
+	}
+	return pf.keyPrefix != nil
+}
+
+func (pf *docPrefilter) addKeyEq(first, second qexpr.Expression) bool {
+	if !isMetaId(first) || pf.keyPrefix != nil {
+		return false
+	}
+	docid, ok := constantString(second)
+	if !ok {
+		return false
+	}
+	pf.keyPrefix, pf.keyExact = []byte(docid), true
+	return true
+}
+
+func (pf *docPrefilter) addFieldEq(first, second qexpr.Expression) bool {
+	ident, ok := first.(*qexpr.Identifier)
+	if !ok {
+		return false
+	}
+	val := second.Value()
+	if val == nil {
+		return false
+	}
+	switch val.Type() {
+	case qvalue.STRING, qvalue.BOOLEAN, qvalue.NULL:
+	case qvalue.NUMBER:
+		// numbers are compared as float64, avoid precision loss.
+		var f float64
+		switch n := val.Actual().(type) {
+		case float64:
+			f = n
+		case int64:
+			f = float64(n)
+		default:
+			return false
+		}
+		if f > (1<<53) || f < -(1<<53) {
+			return false
+		}
+		pf.fields = append(pf.fields, &fieldFilter{ident.Identifier(), f})
+		return true
+	default:
+		return false
+	}
+	pf.fields = append(pf.fields, &fieldFilter{ident.Identifier(), val.Actual()})
+	return true
+}
+
+// Skip returns true if document identified by `docid` and `doc` can
+// never satisfy the WHERE clause this pre-filter was derived from.
+func (pf *docPrefilter) Skip(docid, doc []byte, isJSON bool) bool {
+	if pf.keyPrefix != nil {
+		if pf.keyExact && !bytes.Equal(docid, pf.keyPrefix) {
+			return true
+		} else if !bytes.HasPrefix(docid, pf.keyPrefix) {
+			return true
+		}
+	}
+	if len(pf.fields) == 0 || !isJSON {
+		return false
+	}
+	for _, ff := range pf.fields {
+		if match, decided := ff.match(doc); decided && !match {
+			return true
+		}
+	}
+	return false
+}
+
+// match top-level field against constant value by scanning raw
+// document. `decided` is false if raw scan cannot conclude, like,
+// escaped strings, duplicate fields or malformed document.
+func (ff *fieldFilter) match(doc []byte) (match, decided bool) {
+	raw, found, ok := lookupTopField(doc, ff.name)
+	if !ok {
+		return false, false
+	} else if !found { // MISSING is never equal to a constant
+		return false, true
+	}
+
+	switch v := ff.value.(type) {
+	case string:
+		if raw[0] != '"' {
+			return false, true
+		}
+		s := raw[1 : len(raw)-1]
+		if bytes.IndexByte(s, '\\') >= 0 {
+			return false, false
+		}
+		return string(s) == v, true
+
+	case float64:
+		if raw[0] != '-' && (raw[0] < '0' || raw[0] > '9') {
+			return false, true
+		}
+		f, err := strconv.ParseFloat(string(raw), 64)
+		if err != nil {
+			return false, false
+		}
+		return f == v, true
+
+	case bool:
+		if v {
+			return string(raw) == "true", true
+		}
+		return string(raw) == "false", true
+
+	case nil:
+		return string(raw) == "null", true
+	}
+	return false, false
+}
+
+// lookupTopField scans a JSON object for top-level member `name` and
+// returns its raw value. `ok` is false if document could not be scanned
+// with certainty.
+func lookupTopField(doc []byte, name string) (raw []byte, found, ok bool) {
+	i := skipSpace(doc, 0)
+	if i >= len(doc) || doc[i] != '{' {
+		return nil, false, false
+	}
+	i = skipSpace(doc, i+1)
+	if i < len(doc) && doc[i] == '}' {
+		return nil, false, true
+	}
+	for i < len(doc) {
+		if doc[i] != '"' {
+			return nil, false, false
+		}
+		end, escaped := scanString(doc, i)
+		if end < 0 {
+			return nil, false, false
+		}
+		var key string
+		if escaped {
+			if err := json.Unmarshal(doc[i:end], &key); err != nil {
+				return nil, false, false
+			}
+		} else {
+			key = string(doc[i+1 : end-1])
+		}
+		i = skipSpace(doc, end)
+		if i >= len(doc) || doc[i] != ':' {
+			return nil, false, false
+		}
+		start := skipSpace(doc, i+1)
+		end = skipValue(doc, start)
+		if end < 0 {
+			return nil, false, false
+		}
+		if key == name {
+			if found { // duplicate member, leave it to the parser.
+				return nil, false, false
+			}
+			raw, found = doc[start:end], true
+		}
+		i = skipSpace(doc, end)
+		if i >= len(doc) {
+			return nil, false, false
+		} else if doc[i] == '}' {
+			return raw, found, true
+		} else if doc[i] != ',' {
+			return nil, false, false
+		}
+		i = skipSpace(doc, i+1)
+	}
+	return nil, false, false
+}
+
+func skipSpace(doc []byte, i int) int {
+	for i < len(doc) {
+		switch doc[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scanString returns the offset after the closing quote of string
+// starting at doc[i], and whether the string has escape sequences.
+func scanString(doc []byte, i int) (int, bool) {
+	escaped := false
+	for i++; i < len(doc); i++ {
+		switch doc[i] {
+		case '\\':
+			escaped = true
+			i++
+		case '"':
+			return i + 1, escaped
+		}
+	}
+	return -1, escaped
+}
+
+// skipValue returns the offset after JSON value starting at doc[i].
+func skipValue(doc []byte, i int) int {
+	if i >= len(doc) {
+		return -1
+	}
+	switch doc[i] {
+	case '"':
+		end, _ := scanString(doc, i)
+		return end
+
+	case '{', '[':
+		depth := 0
+		for i < len(doc) {
+			switch doc[i] {
+			case '"':
+				end, _ := scanString(doc, i)
+				if end < 0 {
+					return -1
+				}
+				i = end
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return -1
+	}
+	// number, true, false, null
+	start := i
+	for i < len(doc) {
+		switch doc[i] {
+		case ',', '}', ']', ' ', '\t', '\n', '\r':
+			if i == start {
+				return -1
+			}
+			return i
+		}
+		i++
+	}
+	return -1
+}
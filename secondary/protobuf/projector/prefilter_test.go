@@ -0,0 +1,48 @@
+package protobuf
+
+import "testing"
+
+func TestDocPrefilter(t *testing.T) {
+	compile := func(where string) *docPrefilter {
+		cExprs, err := CompileN1QLExpression([]string{where})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newDocPrefilter(cExprs[0])
+	}
+
+	testcases := []struct {
+		where string
+		docid string
+		doc   string
+		skip  bool
+	}{
+		{`meta().id LIKE "order::%"`, "order::1", `{}`, false},
+		{`meta().id LIKE "order::%"`, "user::1", `{}`, true},
+		{`meta().id = "order::1"`, "order::10", `{}`, true},
+		{`type = "order"`, "k1", `{"type": "order", "age": 10}`, false},
+		{`type = "order"`, "k1", `{"age": {"type": "order"}, "type":"user"}`, true},
+		{`type = "order"`, "k1", `{"age": 10}`, true},
+		{`type = "order"`, "k1", `{"type": "order"}`, false},
+		{`"order" = type AND age = 10`, "k1", `{"type":"order","age":1e1}`, false},
+		{`type = "order" AND age = 10`, "k1", `{"type":"order","age":11}`, true},
+		{`active = true`, "k1", `{"active": false}`, true},
+		{`type = "order" OR age = 10`, "k1", `{"age": 11}`, false},
+	}
+
+	for _, tc := range testcases {
+		pf := compile(tc.where)
+		skip := false
+		if pf != nil {
+			skip = pf.Skip([]byte(tc.docid), []byte(tc.doc), true)
+		}
+		if skip != tc.skip {
+			t.Errorf("%v on %v %v: expected skip %v, got %v",
+				tc.where, tc.docid, tc.doc, tc.skip, skip)
+		}
+	}
+
+	if pf := compile(`type = "order" OR age = 10`); pf != nil {
+		t.Errorf("expected no pre-filter for disjunction")
+	}
+}
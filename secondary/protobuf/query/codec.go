@@ -58,6 +58,15 @@ func ProtobufEncodeInBuf(payload interface{}, buf []byte) (data []byte, err erro
 	case *HeloResponse:
 		pl.HeloResponse = val
 
+	case *SessionRequest:
+		pl.SessionRequest = val
+
+	case *SessionResponse:
+		pl.SessionResponse = val
+
+	case *CreditRequest:
+		pl.CreditRequest = val
+
 	default:
 		return nil, ErrorMissingPayload
 	}
@@ -110,6 +119,12 @@ func ProtobufDecode(data []byte) (value interface{}, err error) {
 		return val, nil
 	} else if val := pl.GetHeloResponse(); val != nil {
 		return val, nil
+	} else if val := pl.GetSessionRequest(); val != nil {
+		return val, nil
+	} else if val := pl.GetSessionResponse(); val != nil {
+		return val, nil
+	} else if val := pl.GetCreditRequest(); val != nil {
+		return val, nil
 	}
 	return nil, ErrorMissingPayload
 }
@@ -6,6 +6,21 @@ import json "github.com/couchbase/indexing/secondary/common/json"
 import c "github.com/couchbase/indexing/secondary/common"
 import "github.com/golang/protobuf/proto"
 
+// Scan features supported by indexer, advertised as bits of
+// HeloResponse.Features, older indexers advertise none. Clients
+// shall not use a feature that is not advertised.
+const (
+	// FeatureFlowControl for CreditRequest and credits in ScanRequest.
+	FeatureFlowControl uint32 = 1 << iota
+	// FeatureIndexFilter for Filter in ScanRequest.
+	FeatureIndexFilter
+	// FeaturePatternFilter for Pattern in CompositeElementFilter.
+	FeaturePatternFilter
+)
+
+// ScanFeatures supported by this indexer.
+const ScanFeatures = FeatureFlowControl | FeatureIndexFilter | FeaturePatternFilter
+
 // GetEntries implements queryport.client.ResponseReader{} method.
 func (r *ResponseStream) GetEntries() ([]c.SecondaryKey, [][]byte, error) {
 	entries := r.GetIndexEntries()
@@ -119,6 +119,9 @@ type QueryPayload struct {
 	StreamEnd         *StreamEndResponse  `protobuf:"bytes,10,opt,name=streamEnd" json:"streamEnd,omitempty"`
 	HeloRequest       *HeloRequest        `protobuf:"bytes,11,opt,name=heloRequest" json:"heloRequest,omitempty"`
 	HeloResponse      *HeloResponse       `protobuf:"bytes,12,opt,name=heloResponse" json:"heloResponse,omitempty"`
+	SessionRequest    *SessionRequest     `protobuf:"bytes,13,opt,name=sessionRequest" json:"sessionRequest,omitempty"`
+	SessionResponse   *SessionResponse    `protobuf:"bytes,14,opt,name=sessionResponse" json:"sessionResponse,omitempty"`
+	CreditRequest     *CreditRequest      `protobuf:"bytes,15,opt,name=creditRequest" json:"creditRequest,omitempty"`
 	XXX_unrecognized  []byte              `json:"-"`
 }
 
@@ -210,6 +213,27 @@ func (m *QueryPayload) GetHeloResponse() *HeloResponse {
 	return nil
 }
 
+func (m *QueryPayload) GetSessionRequest() *SessionRequest {
+	if m != nil {
+		return m.SessionRequest
+	}
+	return nil
+}
+
+func (m *QueryPayload) GetSessionResponse() *SessionResponse {
+	if m != nil {
+		return m.SessionResponse
+	}
+	return nil
+}
+
+func (m *QueryPayload) GetCreditRequest() *CreditRequest {
+	if m != nil {
+		return m.CreditRequest
+	}
+	return nil
+}
+
 // Get current server version/capabilities
 type HeloRequest struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
@@ -229,6 +253,7 @@ func (m *HeloRequest) GetVersion() uint32 {
 
 type HeloResponse struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Features         *uint32 `protobuf:"varint,2,opt,name=features" json:"features,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -243,6 +268,137 @@ func (m *HeloResponse) GetVersion() uint32 {
 	return 0
 }
 
+func (m *HeloResponse) GetFeatures() uint32 {
+	if m != nil && m.Features != nil {
+		return *m.Features
+	}
+	return 0
+}
+
+// Pin snapshot of index for read session, subsequent requests carrying
+// the session id read the pinned snapshot.
+type SessionRequest struct {
+	SessionId        *string        `protobuf:"bytes,1,req,name=sessionId" json:"sessionId,omitempty"`
+	DefnID           *uint64        `protobuf:"varint,2,opt,name=defnID" json:"defnID,omitempty"`
+	Ttl              *uint32        `protobuf:"varint,3,opt,name=ttl" json:"ttl,omitempty"`
+	Cons             *uint32        `protobuf:"varint,4,opt,name=cons" json:"cons,omitempty"`
+	Vector           *TsConsistency `protobuf:"bytes,5,opt,name=vector" json:"vector,omitempty"`
+	RequestId        *string        `protobuf:"bytes,6,opt,name=requestId" json:"requestId,omitempty"`
+	RollbackTime     *int64         `protobuf:"varint,7,opt,name=rollbackTime" json:"rollbackTime,omitempty"`
+	PartitionIds     []uint64       `protobuf:"varint,8,rep,name=partitionIds" json:"partitionIds,omitempty"`
+	Close            *bool          `protobuf:"varint,9,opt,name=close" json:"close,omitempty"`
+	XXX_unrecognized []byte         `json:"-"`
+}
+
+func (m *SessionRequest) Reset()         { *m = SessionRequest{} }
+func (m *SessionRequest) String() string { return proto.CompactTextString(m) }
+func (*SessionRequest) ProtoMessage()    {}
+
+func (m *SessionRequest) GetSessionId() string {
+	if m != nil && m.SessionId != nil {
+		return *m.SessionId
+	}
+	return ""
+}
+
+func (m *SessionRequest) GetDefnID() uint64 {
+	if m != nil && m.DefnID != nil {
+		return *m.DefnID
+	}
+	return 0
+}
+
+func (m *SessionRequest) GetTtl() uint32 {
+	if m != nil && m.Ttl != nil {
+		return *m.Ttl
+	}
+	return 0
+}
+
+func (m *SessionRequest) GetCons() uint32 {
+	if m != nil && m.Cons != nil {
+		return *m.Cons
+	}
+	return 0
+}
+
+func (m *SessionRequest) GetVector() *TsConsistency {
+	if m != nil {
+		return m.Vector
+	}
+	return nil
+}
+
+func (m *SessionRequest) GetRequestId() string {
+	if m != nil && m.RequestId != nil {
+		return *m.RequestId
+	}
+	return ""
+}
+
+func (m *SessionRequest) GetRollbackTime() int64 {
+	if m != nil && m.RollbackTime != nil {
+		return *m.RollbackTime
+	}
+	return 0
+}
+
+func (m *SessionRequest) GetPartitionIds() []uint64 {
+	if m != nil {
+		return m.PartitionIds
+	}
+	return nil
+}
+
+func (m *SessionRequest) GetClose() bool {
+	if m != nil && m.Close != nil {
+		return *m.Close
+	}
+	return false
+}
+
+type SessionResponse struct {
+	Err              *Error `protobuf:"bytes,1,opt,name=err" json:"err,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *SessionResponse) Reset()         { *m = SessionResponse{} }
+func (m *SessionResponse) String() string { return proto.CompactTextString(m) }
+func (*SessionResponse) ProtoMessage()    {}
+
+func (m *SessionResponse) GetErr() *Error {
+	if m != nil {
+		return m.Err
+	}
+	return nil
+}
+
+// Grant more credits to the response stream of a scan request, sent
+// by client while receiving the stream.
+type CreditRequest struct {
+	Rows             *uint32 `protobuf:"varint,1,opt,name=rows" json:"rows,omitempty"`
+	Bytes            *uint64 `protobuf:"varint,2,opt,name=bytes" json:"bytes,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *CreditRequest) Reset()         { *m = CreditRequest{} }
+func (m *CreditRequest) String() string { return proto.CompactTextString(m) }
+func (*CreditRequest) ProtoMessage()    {}
+
+func (m *CreditRequest) GetRows() uint32 {
+	if m != nil && m.Rows != nil {
+		return *m.Rows
+	}
+	return 0
+}
+
+func (m *CreditRequest) GetBytes() uint64 {
+	if m != nil && m.Bytes != nil {
+		return *m.Bytes
+	}
+	return 0
+}
+
 // Get Index statistics. StatisticsResponse is returned back from indexer.
 type StatisticsRequest struct {
 	DefnID           *uint64 `protobuf:"varint,1,req,name=defnID" json:"defnID,omitempty"`
@@ -317,6 +473,13 @@ type ScanRequest struct {
 	PartitionIds     []uint64         `protobuf:"varint,13,rep,name=partitionIds" json:"partitionIds,omitempty"`
 	GroupAggr        *GroupAggr       `protobuf:"bytes,14,opt,name=groupAggr" json:"groupAggr,omitempty"`
 	Sorted           *bool            `protobuf:"varint,15,opt,name=sorted" json:"sorted,omitempty"`
+	Resumable        *bool            `protobuf:"varint,16,opt,name=resumable" json:"resumable,omitempty"`
+	ResumeToken      []byte           `protobuf:"bytes,17,opt,name=resumeToken" json:"resumeToken,omitempty"`
+	SameSnapshot     *bool            `protobuf:"varint,18,opt,name=sameSnapshot" json:"sameSnapshot,omitempty"`
+	SessionId        *string          `protobuf:"bytes,19,opt,name=sessionId" json:"sessionId,omitempty"`
+	RowCredits       *uint32          `protobuf:"varint,20,opt,name=rowCredits" json:"rowCredits,omitempty"`
+	ByteCredits      *uint64          `protobuf:"varint,21,opt,name=byteCredits" json:"byteCredits,omitempty"`
+	Filter           *IndexFilter     `protobuf:"bytes,22,opt,name=filter" json:"filter,omitempty"`
 	XXX_unrecognized []byte           `json:"-"`
 }
 
@@ -429,6 +592,55 @@ func (m *ScanRequest) GetSorted() bool {
 	return false
 }
 
+func (m *ScanRequest) GetResumable() bool {
+	if m != nil && m.Resumable != nil {
+		return *m.Resumable
+	}
+	return false
+}
+
+func (m *ScanRequest) GetResumeToken() []byte {
+	if m != nil {
+		return m.ResumeToken
+	}
+	return nil
+}
+
+func (m *ScanRequest) GetSameSnapshot() bool {
+	if m != nil && m.SameSnapshot != nil {
+		return *m.SameSnapshot
+	}
+	return false
+}
+
+func (m *ScanRequest) GetSessionId() string {
+	if m != nil && m.SessionId != nil {
+		return *m.SessionId
+	}
+	return ""
+}
+
+func (m *ScanRequest) GetRowCredits() uint32 {
+	if m != nil && m.RowCredits != nil {
+		return *m.RowCredits
+	}
+	return 0
+}
+
+func (m *ScanRequest) GetByteCredits() uint64 {
+	if m != nil && m.ByteCredits != nil {
+		return *m.ByteCredits
+	}
+	return 0
+}
+
+func (m *ScanRequest) GetFilter() *IndexFilter {
+	if m != nil {
+		return m.Filter
+	}
+	return nil
+}
+
 // Full table scan request from indexer.
 type ScanAllRequest struct {
 	DefnID           *uint64        `protobuf:"varint,1,req,name=defnID" json:"defnID,omitempty"`
@@ -530,6 +742,7 @@ func (m *ResponseStream) GetErr() *Error {
 // Last response packet sent by server to end query results.
 type StreamEndResponse struct {
 	Err              *Error `protobuf:"bytes,1,opt,name=err" json:"err,omitempty"`
+	ResumeToken      []byte `protobuf:"bytes,2,opt,name=resumeToken" json:"resumeToken,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -544,6 +757,13 @@ func (m *StreamEndResponse) GetErr() *Error {
 	return nil
 }
 
+func (m *StreamEndResponse) GetResumeToken() []byte {
+	if m != nil {
+		return m.ResumeToken
+	}
+	return nil
+}
+
 // Count request to indexer.
 type CountRequest struct {
 	DefnID           *uint64        `protobuf:"varint,1,req,name=defnID" json:"defnID,omitempty"`
@@ -555,6 +775,7 @@ type CountRequest struct {
 	Scans            []*Scan        `protobuf:"bytes,7,rep,name=scans" json:"scans,omitempty"`
 	RollbackTime     *int64         `protobuf:"varint,8,opt,name=rollbackTime" json:"rollbackTime,omitempty"`
 	PartitionIds     []uint64       `protobuf:"varint,9,rep,name=partitionIds" json:"partitionIds,omitempty"`
+	SessionId        *string        `protobuf:"bytes,10,opt,name=sessionId" json:"sessionId,omitempty"`
 	XXX_unrecognized []byte         `json:"-"`
 }
 
@@ -625,6 +846,13 @@ func (m *CountRequest) GetPartitionIds() []uint64 {
 	return nil
 }
 
+func (m *CountRequest) GetSessionId() string {
+	if m != nil && m.SessionId != nil {
+		return *m.SessionId
+	}
+	return ""
+}
+
 // total number of entries in index.
 type CountResponse struct {
 	Count            *int64 `protobuf:"varint,1,req,name=count" json:"count,omitempty"`
@@ -710,6 +938,8 @@ type CompositeElementFilter struct {
 	Low              []byte  `protobuf:"bytes,1,opt,name=low" json:"low,omitempty"`
 	High             []byte  `protobuf:"bytes,2,opt,name=high" json:"high,omitempty"`
 	Inclusion        *uint32 `protobuf:"varint,3,req,name=inclusion" json:"inclusion,omitempty"`
+	Pattern          []byte  `protobuf:"bytes,4,opt,name=pattern" json:"pattern,omitempty"`
+	PatternType      *uint32 `protobuf:"varint,5,opt,name=patternType" json:"patternType,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -738,6 +968,20 @@ func (m *CompositeElementFilter) GetInclusion() uint32 {
 	return 0
 }
 
+func (m *CompositeElementFilter) GetPattern() []byte {
+	if m != nil {
+		return m.Pattern
+	}
+	return nil
+}
+
+func (m *CompositeElementFilter) GetPatternType() uint32 {
+	if m != nil && m.PatternType != nil {
+		return *m.PatternType
+	}
+	return 0
+}
+
 type Scan struct {
 	Filters          []*CompositeElementFilter `protobuf:"bytes,1,rep,name=filters" json:"filters,omitempty"`
 	Equals           [][]byte                  `protobuf:"bytes,2,rep,name=equals" json:"equals,omitempty"`
@@ -979,5 +1223,39 @@ func (m *GroupAggr) GetIndexKeyNames() [][]byte {
 	return nil
 }
 
+// N1QL expression over index keys, rows for which expression does not
+// evaluate to true are not returned.
+type IndexFilter struct {
+	Expr               []byte   `protobuf:"bytes,1,req,name=expr" json:"expr,omitempty"`
+	DependsOnIndexKeys []int32  `protobuf:"varint,2,rep,name=dependsOnIndexKeys" json:"dependsOnIndexKeys,omitempty"`
+	IndexKeyNames      [][]byte `protobuf:"bytes,3,rep,name=indexKeyNames" json:"indexKeyNames,omitempty"`
+	XXX_unrecognized   []byte   `json:"-"`
+}
+
+func (m *IndexFilter) Reset()         { *m = IndexFilter{} }
+func (m *IndexFilter) String() string { return proto.CompactTextString(m) }
+func (*IndexFilter) ProtoMessage()    {}
+
+func (m *IndexFilter) GetExpr() []byte {
+	if m != nil {
+		return m.Expr
+	}
+	return nil
+}
+
+func (m *IndexFilter) GetDependsOnIndexKeys() []int32 {
+	if m != nil {
+		return m.DependsOnIndexKeys
+	}
+	return nil
+}
+
+func (m *IndexFilter) GetIndexKeyNames() [][]byte {
+	if m != nil {
+		return m.IndexKeyNames
+	}
+	return nil
+}
+
 func init() {
 }
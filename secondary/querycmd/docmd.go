@@ -43,7 +43,13 @@ type Command struct {
 	With      string
 	WithPlan  map[string]interface{}
 	// options for build index
-	Bindexes []string
+	Bindexes      []string
+	BuildOp       string
+	BuildPriority int
+	BuildWindow   string
+	// options for DDL history
+	Offset int
+	Event  string
 	// options for Range, Statistics, Count
 	Low         c.SecondaryKey
 	High        c.SecondaryKey
@@ -73,7 +79,7 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.StringVar(&cmdOptions.Server, "server", "127.0.0.1:8091", "Cluster server address")
 	fset.StringVar(&cmdOptions.Auth, "auth", "", "Auth user and password")
 	fset.StringVar(&cmdOptions.Bucket, "bucket", "", "Bucket name")
-	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|count|nodes|create|build|move|drop|list|config")
+	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|count|nodes|create|build|move|rebuild|drop|list|config|history")
 	fset.StringVar(&cmdOptions.IndexName, "index", "", "Index name")
 	// options for create-index
 	fset.StringVar(&cmdOptions.WhereStr, "where", "", "where clause for create index")
@@ -82,6 +88,12 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.StringVar(&cmdOptions.With, "with", "", "index specific properties")
 	// options for build-indexes, move-indexes, drop-indexes
 	fset.StringVar(&bindexes, "indexes", "", "csv list of bucket:index to build")
+	fset.StringVar(&cmdOptions.BuildOp, "buildop", "", "Build queue: enqueue|pause|resume|cancel|priority|list")
+	fset.IntVar(&cmdOptions.BuildPriority, "priority", 0, "Build queue: priority of indexes, higher builds first")
+	fset.StringVar(&cmdOptions.BuildWindow, "window", "", "Build queue: build only between HH:MM-HH:MM")
+	// options for DDL history
+	fset.IntVar(&cmdOptions.Offset, "offset", 0, "History: number of newest entries to skip")
+	fset.StringVar(&cmdOptions.Event, "event", "", "History: create|build|drop|move|alter|rebuild")
 	// options for Range, Statistics, Count
 	fset.StringVar(&low, "low", "[]", "Span.Range: [low]")
 	fset.StringVar(&high, "high", "[]", "Span.Range: [high]")
@@ -242,7 +254,11 @@ func HandleCommand(
 				break
 			}
 		}
-		if err == nil {
+		if err == nil && cmd.BuildOp != "" {
+			err = handleBuildQueue(client, cmd, defnIDs, w)
+		} else if err == nil && len(defnIDs) == 0 {
+			err = fmt.Errorf("buildIndexes(): required field indexes missing")
+		} else if err == nil {
 			err = client.BuildIndexes(defnIDs)
 			fmt.Fprintf(w, "Index building for: %v\n", defnIDs)
 		}
@@ -261,6 +277,18 @@ func HandleCommand(
 			}
 		}
 
+	case "rebuild":
+		index, ok := GetIndex(client, cmd.Bucket, cmd.IndexName)
+		if !ok {
+			return fmt.Errorf("invalid index specified : %v", cmd.IndexName)
+		}
+
+		fmt.Fprintf(w, "Rebuilding Index for: %v\n", index.Definition.DefnId)
+		err = client.RebuildIndex(uint64(index.Definition.DefnId))
+		if err == nil {
+			fmt.Fprintf(w, "Rebuild Index has started. Check Indexes UI for progress and Logs UI for any error\n")
+		}
+
 	case "drop":
 		index, ok := GetIndex(client, cmd.Bucket, cmd.IndexName)
 		if !ok {
@@ -376,6 +404,20 @@ func HandleCommand(
 			}
 		}
 
+	case "history":
+		request := &mclient.DDLHistoryRequest{
+			Bucket: bucket,
+			Name:   iname,
+			Event:  mclient.DDLEvent(cmd.Event),
+			Offset: cmd.Offset,
+			Limit:  int(limit),
+		}
+		resp, err := client.IndexHistory(request)
+		if err != nil {
+			return err
+		}
+		printDDLHistory(w, resp)
+
 	case "config":
 		nodes, err := client.Nodes()
 		if err != nil {
@@ -453,6 +495,75 @@ func HandleCommand(
 	return err
 }
 
+func handleBuildQueue(
+	client *qclient.GsiClient, cmd *Command, defnIDs []uint64, w io.Writer) error {
+
+	request := &mclient.BuildQueueRequest{
+		Op:       mclient.BuildQueueOp(cmd.BuildOp),
+		DefnIds:  defnIDs,
+		Priority: cmd.BuildPriority,
+	}
+	if cmd.BuildWindow != "" {
+		window, err := mclient.ParseBuildWindow(cmd.BuildWindow)
+		if err != nil {
+			return err
+		}
+		request.Window = window
+	}
+
+	queues, err := client.UpdateBuildQueue(request)
+	for _, queue := range queues {
+		printBuildQueue(w, queue)
+	}
+	return err
+}
+
+func printBuildQueue(w io.Writer, queue *mclient.BuildQueueStatus) {
+	fmt.Fprintf(w, "Build queue of %v, Paused:%v, MaxConcurrent:%v\n",
+		queue.NodeAddr, queue.Paused, queue.MaxConcurrent)
+	for _, entry := range queue.Entries {
+		fmt.Fprintf(w, "    Index:%s/%s, Id:%v, Priority:%v, Window:%v, State:%s, Paused:%v",
+			entry.Bucket, entry.Name, entry.DefnId, entry.Priority, entry.Window,
+			entry.State, entry.Paused)
+		if entry.State == "building" {
+			fmt.Fprintf(w, ", Progress:%v%%", entry.Progress)
+		}
+		if entry.Error != "" {
+			fmt.Fprintf(w, ", Attempts:%v, Error:%s", entry.Attempts, entry.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func printDDLHistory(w io.Writer, resp *mclient.DDLHistoryResponse) {
+	fmt.Fprintf(w, "DDL history: %v to %v of %v entries\n",
+		resp.Offset+1, resp.Offset+len(resp.Entries), resp.Total)
+	if len(resp.FailedNodes) != 0 {
+		fmt.Fprintf(w, "    Failed nodes: %v\n", resp.FailedNodes)
+	}
+	for _, entry := range resp.Entries {
+		fmt.Fprintf(w, "%v %s Index:%s/%s, Id:%v, Node:%s",
+			time.Unix(0, entry.Timestamp).Format(time.RFC3339), entry.Event,
+			entry.Bucket, entry.Name, entry.DefnId, entry.Node)
+		if entry.User != "" {
+			fmt.Fprintf(w, ", User:%s, Source:%s", entry.User, entry.Source)
+		}
+		if entry.RequesterId != "" {
+			fmt.Fprintf(w, ", Requester:%s", entry.RequesterId)
+		}
+		if entry.Error != "" {
+			fmt.Fprintf(w, ", Error:%s", entry.Error)
+		}
+		fmt.Fprintln(w)
+		if entry.Before != nil {
+			fmt.Fprintf(w, "    Before: %v\n", entry.Before)
+		}
+		if entry.After != nil {
+			fmt.Fprintf(w, "    After: %v\n", entry.After)
+		}
+	}
+}
+
 func printIndexInfo(w io.Writer, index *mclient.IndexMetadata) {
 	defn := index.Definition
 	fmt.Fprintf(w, "Index:%s/%s, Id:%v, Using:%s, Exprs:%v, isPrimary:%v\n",
@@ -564,13 +675,17 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		dont = []string{"h", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
 
 	case "build":
-		have = []string{"type", "server", "auth", "indexes"}
+		have = []string{"type", "server", "auth"}
 		dont = []string{"h", "index", "bucket", "where", "fields", "primary", "with", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
 
 	case "move":
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "indexes", "where", "fields", "primary", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
 
+	case "rebuild":
+		have = []string{"type", "server", "auth", "index", "bucket"}
+		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
+
 	case "drop":
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
@@ -591,6 +706,10 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "ckey", "cval"}
 
+	case "history":
+		have = []string{"type", "server", "auth"}
+		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "distinct", "ckey", "cval"}
+
 	case "config":
 		have = []string{"type", "server", "auth"}
 		dont = []string{"h", "index", "bucket", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct"}
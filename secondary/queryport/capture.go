@@ -0,0 +1,452 @@
+package queryport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/golang/protobuf/proto"
+)
+
+// CaptureFile is the name of the capture file in the capture directory,
+// rotated files are suffixed with .1, .2 and so on, .1 being the latest.
+const CaptureFile = "scan_capture.log"
+
+// captureQueueSize is the number of requests queued for the capture
+// writer, requests are dropped when the queue is full.
+const captureQueueSize = 1024
+
+// CapturedRequest is a request received by the server, as recorded in a
+// capture file, one JSON document per line.
+type CapturedRequest struct {
+	Time      int64  // unix nanoseconds when the request was received
+	Elapsed   int64  // nanoseconds taken to serve the request
+	Client    string // remote address of the client connection
+	RequestId string
+	Type      string // scan, count or stats
+	DefnId    uint64
+	Bucket    string `json:",omitempty"`
+	Index     string `json:",omitempty"`
+	Redacted  bool   `json:",omitempty"`
+	Request   []byte // encoded by protobuf.ProtobufEncode
+}
+
+// Decode returns the captured *ScanRequest, *CountRequest or
+// *StatisticsRequest.
+func (r *CapturedRequest) Decode() (interface{}, error) {
+	return protobuf.ProtobufDecode(r.Request)
+}
+
+// CaptureConfig for capturing incoming requests.
+type CaptureConfig struct {
+	Dir         string
+	MaxFileSize int64 // bytes, at which the capture file is rotated
+	MaxFiles    int   // number of rotated files to keep
+	RedactKeys  bool
+}
+
+// IndexResolver returns the bucket and name of an index definition, empty
+// strings if the definition is not known.
+type IndexResolver func(defnID uint64) (bucket, name string)
+
+type capturedEntry struct {
+	req      interface{}
+	client   string
+	received time.Time
+	elapsed  time.Duration
+}
+
+type requestCapture struct {
+	config    CaptureConfig
+	resolver  IndexResolver
+	logPrefix string
+
+	queue   chan capturedEntry
+	finch   chan bool
+	donech  chan bool
+	dropped uint64 // requests dropped with the queue full
+
+	mu   sync.Mutex
+	file *os.File // nil once closed
+	size int64
+}
+
+func newRequestCapture(config CaptureConfig, resolver IndexResolver,
+	logPrefix string) (*requestCapture, error) {
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	rc := &requestCapture{
+		config:    config,
+		resolver:  resolver,
+		logPrefix: logPrefix,
+		queue:     make(chan capturedEntry, captureQueueSize),
+		finch:     make(chan bool),
+		donech:    make(chan bool),
+	}
+	if err := rc.open(); err != nil {
+		return nil, err
+	}
+	go rc.writer()
+	return rc, nil
+}
+
+// capture queues a request served for client to be recorded by the
+// writer, without blocking, dropping it if the queue is full.
+func (rc *requestCapture) capture(
+	req interface{}, client string, received time.Time, elapsed time.Duration) {
+
+	entry := capturedEntry{req: req, client: client, received: received, elapsed: elapsed}
+	select {
+	case rc.queue <- entry:
+	default:
+		atomic.AddUint64(&rc.dropped, 1)
+	}
+}
+
+// writer records queued requests until the capture is closed, draining
+// the queue before it exits.
+func (rc *requestCapture) writer() {
+	defer close(rc.donech)
+
+	write := func(e capturedEntry) {
+		if err := rc.record(e.req, e.client, e.received, e.elapsed); err != nil {
+			logging.Errorf("%v failed capturing request: %v\n", rc.logPrefix, err)
+		}
+	}
+
+	for {
+		select {
+		case e := <-rc.queue:
+			write(e)
+		case <-rc.finch:
+			for {
+				select {
+				case e := <-rc.queue:
+					write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (rc *requestCapture) path() string {
+	return filepath.Join(rc.config.Dir, CaptureFile)
+}
+
+func (rc *requestCapture) open() error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	file, err := os.OpenFile(rc.path(), flags, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rc.file, rc.size = file, fi.Size()
+	return nil
+}
+
+// rotate the capture file, dropping the oldest rotated file beyond
+// MaxFiles.
+func (rc *requestCapture) rotate() error {
+	rc.file.Close()
+	rc.file = nil
+
+	path := rc.path()
+	if rc.config.MaxFiles <= 0 {
+		os.Remove(path)
+		return rc.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", path, rc.config.MaxFiles))
+	for i := rc.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+	return rc.open()
+}
+
+// record a request served for client, ignoring requests other than
+// scan, count and statistics.
+func (rc *requestCapture) record(
+	req interface{}, client string, received time.Time, elapsed time.Duration) error {
+
+	r := &CapturedRequest{
+		Time:    received.UnixNano(),
+		Elapsed: elapsed.Nanoseconds(),
+		Client:  client,
+	}
+	switch val := req.(type) {
+	case *protobuf.ScanRequest:
+		r.Type, r.DefnId, r.RequestId = "scan", val.GetDefnID(), val.GetRequestId()
+	case *protobuf.CountRequest:
+		r.Type, r.DefnId, r.RequestId = "count", val.GetDefnID(), val.GetRequestId()
+	case *protobuf.StatisticsRequest:
+		r.Type, r.DefnId, r.RequestId = "stats", val.GetDefnID(), val.GetRequestId()
+	default:
+		return nil
+	}
+	if rc.resolver != nil {
+		r.Bucket, r.Index = rc.resolver(r.DefnId)
+	}
+	if rc.config.RedactKeys {
+		req, r.Redacted = RedactRequest(req), true
+	}
+
+	var err error
+	if r.Request, err = protobuf.ProtobufEncode(req); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.file == nil {
+		return nil
+	}
+	if rc.size > 0 && rc.size+int64(len(line)) > rc.config.MaxFileSize {
+		if err := rc.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rc.file.Write(line)
+	rc.size += int64(n)
+	return err
+}
+
+// close stops the writer, once it has recorded the queued requests, and
+// closes the capture file.
+func (rc *requestCapture) close() {
+	close(rc.finch)
+	<-rc.donech
+
+	if dropped := atomic.LoadUint64(&rc.dropped); dropped > 0 {
+		logging.Warnf("%v dropped %v requests with the capture queue full\n",
+			rc.logPrefix, dropped)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.file != nil {
+		rc.file.Close()
+		rc.file = nil
+	}
+}
+
+// RedactRequest returns a copy of a scan, count or statistics request with
+// its keys redacted.  In JSON keys strings are replaced by as many 'x' and
+// numbers by 0, keeping booleans, nulls, object field names and the shape
+// of arrays, so that a replay scans keys of the same type and size.  Keys
+// that are not JSON, like document ids of primary index scans, and the
+// literals in patterns are replaced by 'x' too.  String and number
+// literals in the N1QL expressions of filters, group keys and aggregates
+// are redacted the same way, keeping identifiers.  Other requests are
+// returned as is.
+func RedactRequest(req interface{}) interface{} {
+	switch val := req.(type) {
+	case *protobuf.ScanRequest:
+		r := proto.Clone(val).(*protobuf.ScanRequest)
+		redactSpan(r.GetSpan())
+		redactScans(r.GetScans())
+		if filter := r.GetFilter(); filter != nil {
+			filter.Expr = redactExpr(filter.Expr)
+		}
+		for _, key := range r.GetGroupAggr().GetGroupKeys() {
+			key.Expr = redactExpr(key.Expr)
+		}
+		for _, aggr := range r.GetGroupAggr().GetAggrs() {
+			aggr.Expr = redactExpr(aggr.Expr)
+		}
+		return r
+	case *protobuf.CountRequest:
+		r := proto.Clone(val).(*protobuf.CountRequest)
+		redactSpan(r.GetSpan())
+		redactScans(r.GetScans())
+		return r
+	case *protobuf.StatisticsRequest:
+		r := proto.Clone(val).(*protobuf.StatisticsRequest)
+		redactSpan(r.GetSpan())
+		return r
+	}
+	return req
+}
+
+func redactSpan(span *protobuf.Span) {
+	if span == nil {
+		return
+	}
+	if rng := span.GetRange(); rng != nil {
+		rng.Low, rng.High = redactKey(rng.Low), redactKey(rng.High)
+	}
+	for i, key := range span.Equals {
+		span.Equals[i] = redactKey(key)
+	}
+}
+
+func redactScans(scans []*protobuf.Scan) {
+	for _, scan := range scans {
+		for _, filter := range scan.GetFilters() {
+			filter.Low, filter.High = redactKey(filter.Low), redactKey(filter.High)
+			if filter.Pattern != nil {
+				filter.Pattern = redactPattern(filter.Pattern)
+			}
+		}
+		for i, key := range scan.Equals {
+			scan.Equals[i] = redactKey(key)
+		}
+	}
+}
+
+func redactKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(key))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil || dec.More() {
+		return bytes.Repeat([]byte("x"), len(key))
+	}
+	data, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return bytes.Repeat([]byte("x"), len(key))
+	}
+	return data
+}
+
+func redactValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case string:
+		return string(bytes.Repeat([]byte("x"), len(val)))
+	case json.Number:
+		return json.Number("0")
+	case []interface{}:
+		for i, v := range val {
+			val[i] = redactValue(v)
+		}
+	case map[string]interface{}:
+		for k, v := range val {
+			val[k] = redactValue(v)
+		}
+	}
+	return value
+}
+
+// redactPattern replaces letters and digits in a LIKE or regular expression
+// pattern, except those escaped by \, keeping wildcards and operators.
+func redactPattern(pattern []byte) []byte {
+	var buf bytes.Buffer
+	escaped := false
+	for _, r := range string(pattern) {
+		if !escaped && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			buf.WriteByte('x')
+		} else {
+			buf.WriteRune(r)
+		}
+		escaped = !escaped && r == '\\'
+	}
+	return buf.Bytes()
+}
+
+// redactExpr replaces the characters of string literals in a N1QL
+// expression by 'x' and the digits of number literals by 0, keeping
+// identifiers, escaped identifiers and operators, so that the expression
+// still parses.
+func redactExpr(expr []byte) []byte {
+	if expr == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	var quote, prev rune // quote is the open quote, 0 outside quotes
+	escaped, number := false, false
+	for _, r := range string(expr) {
+		switch {
+		case quote == '`':
+			buf.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case quote != 0:
+			if !escaped && r == quote {
+				buf.WriteRune(r)
+				quote = 0
+			} else {
+				buf.WriteByte('x')
+			}
+			escaped = !escaped && r == '\\'
+		case r == '"' || r == '\'' || r == '`':
+			buf.WriteRune(r)
+			quote, number = r, false
+		case unicode.IsDigit(r) && (number || !isIdentRune(prev)):
+			buf.WriteByte('0')
+			number = true
+		default:
+			buf.WriteRune(r)
+			number = number && (r == '.' || r == 'e' || r == 'E' ||
+				((r == '+' || r == '-') && (prev == 'e' || prev == 'E')))
+		}
+		prev = r
+	}
+	return buf.Bytes()
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// SetCapture starts capturing incoming requests as per config, or stops it
+// if config is nil.  A capture in progress with the same config continues.
+func (s *Server) SetCapture(config *CaptureConfig, resolver IndexResolver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rc := s.getCapture(); rc != nil {
+		if config != nil && *config == rc.config {
+			return nil
+		}
+		atomic.StorePointer(&s.capture, nil)
+		rc.close()
+		logging.Infof("%v stopped capturing requests\n", s.logPrefix)
+	}
+	if config == nil {
+		return nil
+	}
+
+	rc, err := newRequestCapture(*config, resolver, s.logPrefix)
+	if err != nil {
+		logging.Errorf("%v failed capturing requests in %v: %v\n",
+			s.logPrefix, config.Dir, err)
+		return err
+	}
+	atomic.StorePointer(&s.capture, unsafe.Pointer(rc))
+	logging.Infof("%v capturing requests in %v\n", s.logPrefix, config.Dir)
+	return nil
+}
+
+func (s *Server) getCapture() *requestCapture {
+	return (*requestCapture)(atomic.LoadPointer(&s.capture))
+}
@@ -0,0 +1,185 @@
+package queryport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestRedactRequest(t *testing.T) {
+	req := &protobuf.ScanRequest{
+		DefnID: proto.Uint64(1),
+		Scans: []*protobuf.Scan{
+			{
+				Filters: []*protobuf.CompositeElementFilter{
+					{
+						Low:         []byte(`"abc"`),
+						High:        []byte(`[1234,true,{"k":"v"}]`),
+						Pattern:     []byte(`ab\%c_%`),
+						PatternType: proto.Uint32(1),
+					},
+					{High: []byte(`"z"`)}, // unbounded low
+				},
+				Equals: [][]byte{[]byte(`"secret"`)},
+			},
+		},
+		Filter: &protobuf.IndexFilter{
+			Expr: []byte("cover ((`b`.`age1`)) > 21.5e+1 AND cover ((meta(`b`).`id`)) LIKE \"user\\\"%\" OR 'it''s' = x2"),
+		},
+		GroupAggr: &protobuf.GroupAggr{
+			GroupKeys: []*protobuf.GroupKey{{KeyPos: proto.Int32(0), Expr: []byte("substr(cover ((`b`.`name`)), 0, 3)")}},
+			Aggrs:     []*protobuf.Aggregate{{AggrFunc: proto.Uint32(0), KeyPos: proto.Int32(0)}},
+		},
+	}
+
+	r := RedactRequest(req).(*protobuf.ScanRequest)
+	filter := r.Scans[0].Filters[0]
+	if s := string(filter.Low); s != `"xxx"` {
+		t.Errorf("expected low \"xxx\", got %v", s)
+	}
+	if s := string(filter.High); s != `[0,true,{"k":"x"}]` {
+		t.Errorf("expected high [0,true,{\"k\":\"x\"}], got %v", s)
+	}
+	if s := string(filter.Pattern); s != `xx\%x_%` {
+		t.Errorf("expected pattern xx\\%%x_%%, got %v", s)
+	}
+	if s := string(r.Scans[0].Equals[0]); s != `"xxxxxx"` {
+		t.Errorf("expected equals \"xxxxxx\", got %v", s)
+	}
+	if r.Scans[0].Filters[1].Low != nil {
+		t.Errorf("expected unbounded low to be kept")
+	}
+	expected := "cover ((`b`.`age1`)) > 00.0e+0 AND cover ((meta(`b`).`id`)) LIKE \"xxxxxxx\" OR 'xx''x' = x2"
+	if s := string(r.Filter.Expr); s != expected {
+		t.Errorf("expected filter %v, got %v", expected, s)
+	}
+	expected = "substr(cover ((`b`.`name`)), 0, 0)"
+	if s := string(r.GroupAggr.GroupKeys[0].Expr); s != expected {
+		t.Errorf("expected group key %v, got %v", expected, s)
+	}
+	if r.GroupAggr.Aggrs[0].Expr != nil {
+		t.Errorf("expected empty aggregate expression to be kept")
+	}
+	if _, err := protobuf.ProtobufEncode(r); err != nil {
+		t.Errorf("redacted request not encoded: %v", err)
+	}
+	if s := string(redactKey([]byte("doc::1"))); s != "xxxxxx" {
+		t.Errorf("expected docid xxxxxx, got %v", s)
+	}
+	if s := string(req.Scans[0].Filters[0].Low); s != `"abc"` {
+		t.Errorf("request modified by redaction, low %v", s)
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := CaptureConfig{Dir: dir, MaxFileSize: 512, MaxFiles: 2}
+	resolver := func(defnID uint64) (string, string) { return "default", "idx" }
+	rc, err := newRequestCapture(config, resolver, "[test]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &protobuf.CountRequest{
+		DefnID:    proto.Uint64(10),
+		RequestId: proto.String("req"),
+		Span:      &protobuf.Span{Equals: [][]byte{[]byte(`["a"]`)}},
+	}
+	for i := 0; i < 20; i++ {
+		if err := rc.record(req, "127.0.0.1:1234", time.Now(), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc.close()
+
+	path := filepath.Join(dir, CaptureFile)
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 rotated files")
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		} else if fi.Size() > config.MaxFileSize {
+			t.Errorf("%v size %v exceeds %v", name, fi.Size(), config.MaxFileSize)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("expected captured request")
+	}
+	var r CapturedRequest
+	if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != "count" || r.DefnId != 10 || r.Index != "idx" || r.Elapsed != int64(time.Millisecond) {
+		t.Errorf("unexpected captured request %+v", r)
+	}
+	msg, err := r.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, ok := msg.(*protobuf.CountRequest); !ok || count.GetRequestId() != "req" {
+		t.Errorf("unexpected decoded request %v", msg)
+	}
+}
+
+func TestCaptureQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := CaptureConfig{Dir: dir, MaxFileSize: 1 << 20}
+	rc, err := newRequestCapture(config, nil, "[test]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block the writer so that requests beyond the queue size are dropped
+	rc.mu.Lock()
+	req := &protobuf.CountRequest{DefnID: proto.Uint64(10), RequestId: proto.String("req")}
+	for i := 0; i < captureQueueSize+10; i++ {
+		rc.capture(req, "127.0.0.1:1234", time.Now(), time.Millisecond)
+	}
+	rc.mu.Unlock()
+	rc.close()
+
+	// the writer could have taken one request off the queue before blocking
+	if dropped := atomic.LoadUint64(&rc.dropped); dropped != 9 && dropped != 10 {
+		t.Errorf("unexpected %v requests dropped", dropped)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, CaptureFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Count(data, []byte("\n"))
+	if uint64(lines)+rc.dropped != captureQueueSize+10 {
+		t.Errorf("queued requests not recorded, %v recorded %v dropped", lines, rc.dropped)
+	}
+
+	// requests are ignored once the capture is closed
+	rc.capture(req, "127.0.0.1:1234", time.Now(), time.Millisecond)
+}
@@ -179,16 +179,73 @@ func (b *cbqClient) CreateIndex(
 	return 0, err
 }
 
+// CreateIndexWithRequester implement BridgeAccessor{} interface.
+// cbq does not record DDL history, requester is ignored.
+func (b *cbqClient) CreateIndexWithRequester(
+	requester *mclient.DDLRequester,
+	name, bucket, using, exprType, whereExpr string,
+	secExprs []string, desc []bool, isPrimary bool,
+	scheme common.PartitionScheme, partitionKeys []string,
+	with []byte) (defnID uint64, err error) {
+
+	return b.CreateIndex(name, bucket, using, exprType, whereExpr,
+		secExprs, desc, isPrimary, scheme, partitionKeys, with)
+}
+
 // BuildIndexes implement BridgeAccessor{} interface.
 func (b *cbqClient) BuildIndexes(defnID []uint64) error {
 	panic("cbqClient does not implement build-indexes")
 }
 
+// BuildIndexesWithRequester implement BridgeAccessor{} interface.
+func (b *cbqClient) BuildIndexesWithRequester(
+	requester *mclient.DDLRequester, defnID []uint64) error {
+
+	panic("cbqClient does not implement build-indexes")
+}
+
+// DropIndexWithRequester implement BridgeAccessor{} interface.
+// cbq does not record DDL history, requester is ignored.
+func (b *cbqClient) DropIndexWithRequester(
+	requester *mclient.DDLRequester, defnID uint64) error {
+
+	return b.DropIndex(defnID)
+}
+
+// UpdateBuildQueue implement BridgeAccessor{} interface.
+func (b *cbqClient) UpdateBuildQueue(
+	request *mclient.BuildQueueRequest) ([]*mclient.BuildQueueStatus, error) {
+
+	panic("cbqClient does not implement build queue")
+}
+
+// UpdateAggregate implement BridgeAccessor{} interface.
+func (b *cbqClient) UpdateAggregate(request *mclient.AggregateRequest) error {
+	panic("cbqClient does not implement aggregates")
+}
+
+// IndexHistory implement BridgeAccessor{} interface.
+func (b *cbqClient) IndexHistory(
+	request *mclient.DDLHistoryRequest) (*mclient.DDLHistoryResponse, error) {
+
+	panic("cbqClient does not implement index history")
+}
+
+// UpdateMemQuota implement BridgeAccessor{} interface.
+func (b *cbqClient) UpdateMemQuota(defnID uint64, with map[string]interface{}) error {
+	panic("cbqClient does not implement memory quota")
+}
+
 // MoveIndex implement BridgeAccessor{} interface.
 func (b *cbqClient) MoveIndex(defnID uint64, plan map[string]interface{}) error {
 	panic("cbqClient does not implement move index")
 }
 
+// RebuildIndex implement BridgeAccessor{} interface.
+func (b *cbqClient) RebuildIndex(defnID uint64) error {
+	panic("cbqClient does not implement rebuild index")
+}
+
 // DropIndex implement BridgeAccessor{} interface.
 func (b *cbqClient) DropIndex(defnID uint64) error {
 	var resp *http.Response
@@ -12,6 +12,7 @@ import "time"
 import "unsafe"
 import "io"
 import "net"
+import "sync"
 import "sync/atomic"
 import "fmt"
 
@@ -80,6 +81,15 @@ type CompositeElementFilter struct {
 	Low       interface{}
 	High      interface{}
 	Inclusion Inclusion
+
+	// Pattern, LIKE or regular expression on string values, is applied
+	// by indexer to rows within Low and High. As a pattern matches only
+	// strings, nil Low and High of a pattern filter are unbounded, like
+	// common.MinUnbounded and common.MaxUnbounded, rather than null. If
+	// both are unbounded, indexer derives them from the literal prefix
+	// of Pattern.
+	Pattern     string
+	PatternType common.PatternType
 }
 
 type IndexProjection struct {
@@ -110,6 +120,16 @@ type GroupAggr struct {
 	IndexKeyNames      []string     // Index key names used in expressions
 }
 
+// IndexFilter is a N1QL expression over index keys evaluated by
+// indexer, rows for which it does not evaluate to true are not returned.
+// Like GroupAggr expressions, index keys are referred to as covers, eg.
+// cover ((`default`.`age`)), named by IndexKeyNames.
+type IndexFilter struct {
+	Expr               string   // filter expression
+	DependsOnIndexKeys []int32  // index key positions used in Expr
+	IndexKeyNames      []string // index key names used in Expr
+}
+
 type IndexKeyOrder struct {
 	KeyPos []int
 	Desc   []bool
@@ -169,18 +189,52 @@ type BridgeAccessor interface {
 		scheme common.PartitionScheme, partitionKeys []string,
 		with []byte) (defnID uint64, err error)
 
+	// CreateIndexWithRequester is CreateIndex on behalf of `requester`,
+	// who is recorded in DDL history of indexer nodes.
+	CreateIndexWithRequester(
+		requester *mclient.DDLRequester,
+		name, bucket, using, exprType, whereExpr string,
+		secExprs []string, desc []bool, isPrimary bool,
+		scheme common.PartitionScheme, partitionKeys []string,
+		with []byte) (defnID uint64, err error)
+
 	// BuildIndexes to build a deferred set of indexes. This call implies
 	// that indexes specified are already created.
 	BuildIndexes(defnIDs []uint64) error
 
+	// BuildIndexesWithRequester is BuildIndexes on behalf of `requester`.
+	BuildIndexesWithRequester(requester *mclient.DDLRequester, defnIDs []uint64) error
+
 	// MoveIndex to move a set of indexes to different node.
 	MoveIndex(defnID uint64, with map[string]interface{}) error
 
+	// RebuildIndex to rebuild an index online, on the nodes hosting it.
+	RebuildIndex(defnID uint64) error
+
+	// UpdateBuildQueue to enqueue, pause, resume, cancel or list index
+	// builds in the build queue of indexers.
+	UpdateBuildQueue(request *mclient.BuildQueueRequest) ([]*mclient.BuildQueueStatus, error)
+
+	// UpdateAggregate to create or drop a precomputed group aggregate
+	// of index specified by `request.DefnId`.
+	UpdateAggregate(request *mclient.AggregateRequest) error
+
+	// UpdateMemQuota to set the memory quota and priority, given by
+	// `memory_quota` and `priority` in `with`, of index `defnID`.
+	UpdateMemQuota(defnID uint64, with map[string]interface{}) error
+
+	// IndexHistory to get a page of DDL history of indexes, newest
+	// first.
+	IndexHistory(request *mclient.DDLHistoryRequest) (*mclient.DDLHistoryResponse, error)
+
 	// DropIndex to drop index specified by `defnID`.
 	// - if index is in deferred build state, it shall be removed
 	//   from deferred list.
 	DropIndex(defnID uint64) error
 
+	// DropIndexWithRequester is DropIndex on behalf of `requester`.
+	DropIndexWithRequester(requester *mclient.DDLRequester, defnID uint64) error
+
 	// GetScanports shall return list of queryports for all indexer in
 	// the cluster.
 	GetScanports() (queryports []string)
@@ -365,6 +419,9 @@ type GsiClient struct {
 	metaCh       chan bool      // listen to metadata changes
 	settings     *ClientSettings
 	killch       chan bool
+
+	sessionMu sync.Mutex
+	sessions  map[string]*readSession // read session id -> session
 }
 
 // NewGsiClient returns client to access GSI cluster.
@@ -486,6 +543,18 @@ func (c *GsiClient) CreateIndex3(
 	scheme common.PartitionScheme, partitionKeys []string,
 	with []byte) (defnID uint64, err error) {
 
+	return c.CreateIndexWithRequester(nil, name, bucket, using, exprType,
+		whereExpr, secExprs, desc, isPrimary, scheme, partitionKeys, with)
+}
+
+// CreateIndexWithRequester implements BridgeAccessor{} interface.
+func (c *GsiClient) CreateIndexWithRequester(
+	requester *mclient.DDLRequester,
+	name, bucket, using, exprType, whereExpr string,
+	secExprs []string, desc []bool, isPrimary bool,
+	scheme common.PartitionScheme, partitionKeys []string,
+	with []byte) (defnID uint64, err error) {
+
 	err = common.IsValidIndexName(name)
 	if err != nil {
 		return 0, err
@@ -495,7 +564,7 @@ func (c *GsiClient) CreateIndex3(
 		return defnID, ErrorClientUninitialized
 	}
 	begin := time.Now()
-	defnID, err = c.bridge.CreateIndex(
+	defnID, err = c.bridge.CreateIndexWithRequester(requester,
 		name, bucket, using, exprType, whereExpr,
 		secExprs, desc, isPrimary, scheme, partitionKeys, with)
 	fmsg := "CreateIndex %v %v/%v using:%v exprType:%v " +
@@ -509,16 +578,75 @@ func (c *GsiClient) CreateIndex3(
 
 // BuildIndexes implements BridgeAccessor{} interface.
 func (c *GsiClient) BuildIndexes(defnIDs []uint64) error {
+	return c.BuildIndexesWithRequester(nil, defnIDs)
+}
+
+// BuildIndexesWithRequester implements BridgeAccessor{} interface.
+func (c *GsiClient) BuildIndexesWithRequester(
+	requester *mclient.DDLRequester, defnIDs []uint64) error {
+
 	if c.bridge == nil {
 		return ErrorClientUninitialized
 	}
 	begin := time.Now()
-	err := c.bridge.BuildIndexes(defnIDs)
+	err := c.bridge.BuildIndexesWithRequester(requester, defnIDs)
 	fmsg := "BuildIndexes %v - elapsed(%v), err(%v)"
 	logging.Infof(fmsg, defnIDs, time.Since(begin), err)
 	return err
 }
 
+// UpdateBuildQueue implements BridgeAccessor{} interface.
+func (c *GsiClient) UpdateBuildQueue(
+	request *mclient.BuildQueueRequest) ([]*mclient.BuildQueueStatus, error) {
+
+	if c.bridge == nil {
+		return nil, ErrorClientUninitialized
+	}
+	begin := time.Now()
+	status, err := c.bridge.UpdateBuildQueue(request)
+	fmsg := "UpdateBuildQueue %v %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, request.Op, request.DefnIds, time.Since(begin), err)
+	return status, err
+}
+
+// UpdateAggregate implements BridgeAccessor{} interface.
+func (c *GsiClient) UpdateAggregate(request *mclient.AggregateRequest) error {
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+	begin := time.Now()
+	err := c.bridge.UpdateAggregate(request)
+	fmsg := "UpdateAggregate %v %v %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, request.Op, request.DefnId, request.Name, time.Since(begin), err)
+	return err
+}
+
+// IndexHistory implements BridgeAccessor{} interface.
+func (c *GsiClient) IndexHistory(
+	request *mclient.DDLHistoryRequest) (*mclient.DDLHistoryResponse, error) {
+
+	if c.bridge == nil {
+		return nil, ErrorClientUninitialized
+	}
+	begin := time.Now()
+	resp, err := c.bridge.IndexHistory(request)
+	fmsg := "IndexHistory %v/%v %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, request.Bucket, request.Name, request.DefnId, time.Since(begin), err)
+	return resp, err
+}
+
+// UpdateMemQuota implements BridgeAccessor{} interface.
+func (c *GsiClient) UpdateMemQuota(defnID uint64, with map[string]interface{}) error {
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+	begin := time.Now()
+	err := c.bridge.UpdateMemQuota(defnID, with)
+	fmsg := "UpdateMemQuota %v %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, defnID, with, time.Since(begin), err)
+	return err
+}
+
 // MoveIndex implements BridgeAccessor{} interface.
 func (c *GsiClient) MoveIndex(defnID uint64, with map[string]interface{}) error {
 	if c.bridge == nil {
@@ -531,13 +659,32 @@ func (c *GsiClient) MoveIndex(defnID uint64, with map[string]interface{}) error
 	return err
 }
 
+// RebuildIndex implements BridgeAccessor{} interface.
+func (c *GsiClient) RebuildIndex(defnID uint64) error {
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+	begin := time.Now()
+	err := c.bridge.RebuildIndex(defnID)
+	fmsg := "RebuildIndex %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, defnID, time.Since(begin), err)
+	return err
+}
+
 // DropIndex implements BridgeAccessor{} interface.
 func (c *GsiClient) DropIndex(defnID uint64) error {
+	return c.DropIndexWithRequester(nil, defnID)
+}
+
+// DropIndexWithRequester implements BridgeAccessor{} interface.
+func (c *GsiClient) DropIndexWithRequester(
+	requester *mclient.DDLRequester, defnID uint64) error {
+
 	if c.bridge == nil {
 		return ErrorClientUninitialized
 	}
 	begin := time.Now()
-	err := c.bridge.DropIndex(defnID)
+	err := c.bridge.DropIndexWithRequester(requester, defnID)
 	fmsg := "DropIndex %v - elapsed(%v), err(%v)"
 	logging.Infof(fmsg, defnID, time.Since(begin), err)
 	return err
@@ -967,12 +1114,14 @@ func (c *GsiClient) MultiScanCountInternal(
 		}
 		if c.bridge.IsPrimary(uint64(index.DefnId)) {
 			count, err = qc.MultiScanCountPrimary(
-				uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions)
+				uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions,
+				broker.GetSession())
 			return count, err, false
 		}
 
 		count, err = qc.MultiScanCount(
-			uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions)
+			uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions,
+			broker.GetSession())
 		return count, err, false
 	}
 
@@ -997,6 +1146,45 @@ func (c *GsiClient) Scan3(
 		projection, offset, limit, groupAggr, indexOrder, cons, vector, broker)
 }
 
+// FilterScan3 is Scan3 returning only the rows for which `filter`
+// evaluates to true, filter is evaluated by indexer before offset,
+// limit and aggregates are applied.
+func (c *GsiClient) FilterScan3(
+	defnID uint64, requestId string, scans Scans, reverse,
+	distinct bool, projection *IndexProjection, offset, limit int64,
+	groupAggr *GroupAggr, indexOrder *IndexKeyOrder, filter *IndexFilter,
+	cons common.Consistency, vector *TsConsistency,
+	callb ResponseHandler) (err error) {
+
+	broker := makeDefaultRequestBroker(callb)
+	broker.SetFilter(filter)
+	return c.Scan3Internal(defnID, requestId, scans, reverse, distinct,
+		projection, offset, limit, groupAggr, indexOrder, cons, vector, broker)
+}
+
+// Scan3Resume scans upto `limit` rows after the rows returned for
+// resume `token`, nil token starts the scan from the beginning. It
+// returns the token to resume with, or nil if the scan is exhausted.
+// If `sameSnapshot` is true, the scan is resumed on the snapshot of
+// `token`. Returned token is valid only if callb did not stop the scan.
+func (c *GsiClient) Scan3Resume(
+	defnID uint64, requestId string, scans Scans,
+	distinct bool, projection *IndexProjection, limit int64,
+	indexOrder *IndexKeyOrder,
+	cons common.Consistency, vector *TsConsistency,
+	token []byte, sameSnapshot bool,
+	callb ResponseHandler) (next []byte, err error) {
+
+	broker := makeDefaultRequestBroker(callb)
+	broker.SetCursor(token, sameSnapshot)
+	err = c.Scan3Internal(defnID, requestId, scans, false, distinct,
+		projection, 0, limit, nil, indexOrder, cons, vector, broker)
+	if err != nil {
+		return nil, err
+	}
+	return broker.GetResumeToken(), nil
+}
+
 func (c *GsiClient) Scan3Internal(
 	defnID uint64, requestId string, scans Scans, reverse,
 	distinct bool, projection *IndexProjection, offset, limit int64,
@@ -1027,12 +1215,14 @@ func (c *GsiClient) Scan3Internal(
 		if c.bridge.IsPrimary(uint64(index.DefnId)) {
 			return qc.Scan3Primary(
 				uint64(index.DefnId), requestId, scans, reverse, distinct,
-				projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions)
+				projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions,
+				broker.GetCursor(), broker.GetSession(), broker.GetFilter())
 		}
 
 		return qc.Scan3(
 			uint64(index.DefnId), requestId, scans, reverse, distinct,
-			projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions)
+			projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions,
+			broker.GetCursor(), broker.GetSession(), broker.GetFilter())
 	}
 
 	broker.SetScanRequestHandler(handler)
@@ -1194,6 +1384,10 @@ func (c *GsiClient) updateExcludes(defnID uint64, excludes map[common.IndexDefnI
 
 func (c *GsiClient) doScan(defnID uint64, requestId string, broker *RequestBroker) (int64, error) {
 
+	if broker.GetSession() != "" {
+		return c.doSessionScan(defnID, requestId, broker)
+	}
+
 	var excludes map[common.IndexDefnId]map[common.PartitionId]map[uint64]bool
 	var err error
 
@@ -27,6 +27,15 @@ var ErrorInvalidConsistency = errors.New("queryport.invalidConsistency")
 // ErrorExpectedTimestamp
 var ErrorExpectedTimestamp = errors.New("queryport.expectedTimestamp")
 
+// ErrorResumeNotSupported
+var ErrorResumeNotSupported = errors.New("queryport.resumeNotSupported")
+
+// ErrorFilterNotSupported
+var ErrorFilterNotSupported = errors.New("queryport.filterNotSupported")
+
+// ErrorPatternNotSupported
+var ErrorPatternNotSupported = errors.New("queryport.patternNotSupported")
+
 // These error strings need to be in sync with common.ErrIndexNotFound
 // and common.ErrIndexNotReady.
 var ErrIndexNotFound = fmt.Errorf("Index not found")
@@ -41,6 +50,9 @@ var errorDescriptions = map[string]string{
 	ErrorNotImplemented.Error():      "client API not implemented",
 	ErrorInvalidConsistency.Error():  "supplied consistency is invalid",
 	ErrorExpectedTimestamp.Error():   "consistency timestamp is expected",
+	ErrorResumeNotSupported.Error():  "resumable scan is not supported for index scanned from multiple indexers",
+	ErrorFilterNotSupported.Error():  "index filter is not supported by indexer, all indexer nodes must be upgraded",
+	ErrorPatternNotSupported.Error(): "pattern filter is not supported by indexer, all indexer nodes must be upgraded",
 	ErrIndexNotFound.Error():         "index is deleted or node hosting index is down",
 	ErrIndexNotReady.Error():         ErrIndexNotReady.Error(),
 }
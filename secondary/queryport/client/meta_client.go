@@ -187,6 +187,18 @@ func (b *metadataClient) CreateIndex(
 	scheme common.PartitionScheme, partitionKeys []string,
 	planJSON []byte) (uint64, error) {
 
+	return b.CreateIndexWithRequester(nil, indexName, bucket, using, exprType,
+		whereExpr, secExprs, desc, isPrimary, scheme, partitionKeys, planJSON)
+}
+
+// CreateIndexWithRequester implements BridgeAccessor{} interface.
+func (b *metadataClient) CreateIndexWithRequester(
+	requester *mclient.DDLRequester,
+	indexName, bucket, using, exprType, whereExpr string,
+	secExprs []string, desc []bool, isPrimary bool,
+	scheme common.PartitionScheme, partitionKeys []string,
+	planJSON []byte) (uint64, error) {
+
 	plan := make(map[string]interface{})
 	if planJSON != nil && len(planJSON) > 0 {
 		err := json.Unmarshal(planJSON, &plan)
@@ -197,9 +209,9 @@ func (b *metadataClient) CreateIndex(
 
 	refreshCnt := 0
 RETRY:
-	defnID, err, needRefresh := b.mdClient.CreateIndexWithPlan(
+	defnID, err, needRefresh := b.mdClient.CreateIndexWithRequester(
 		indexName, bucket, using, exprType, whereExpr,
-		secExprs, desc, isPrimary, scheme, partitionKeys, plan)
+		secExprs, desc, isPrimary, scheme, partitionKeys, plan, requester)
 
 	if needRefresh && refreshCnt == 0 {
 		fmsg := "GsiClient: Indexer Node List is out-of-date.  Require refresh."
@@ -216,6 +228,13 @@ RETRY:
 
 // BuildIndexes implements BridgeAccessor{} interface.
 func (b *metadataClient) BuildIndexes(defnIDs []uint64) error {
+	return b.BuildIndexesWithRequester(nil, defnIDs)
+}
+
+// BuildIndexesWithRequester implements BridgeAccessor{} interface.
+func (b *metadataClient) BuildIndexesWithRequester(
+	requester *mclient.DDLRequester, defnIDs []uint64) error {
+
 	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
 
 	for _, defnId := range defnIDs {
@@ -228,7 +247,43 @@ func (b *metadataClient) BuildIndexes(defnIDs []uint64) error {
 	for i, id := range defnIDs {
 		ids[i] = common.IndexDefnId(id)
 	}
-	return b.mdClient.BuildIndexes(ids)
+	return b.mdClient.BuildIndexesWithRequester(ids, requester)
+}
+
+// UpdateBuildQueue implements BridgeAccessor{} interface.
+func (b *metadataClient) UpdateBuildQueue(
+	request *mclient.BuildQueueRequest) ([]*mclient.BuildQueueStatus, error) {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	for _, defnId := range request.DefnIds {
+		if _, ok := currmeta.defns[common.IndexDefnId(defnId)]; !ok {
+			return nil, ErrorIndexNotFound
+		}
+	}
+	return b.mdClient.UpdateBuildQueue(request)
+}
+
+// UpdateAggregate implements BridgeAccessor{} interface.
+func (b *metadataClient) UpdateAggregate(request *mclient.AggregateRequest) error {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	if _, ok := currmeta.defns[request.DefnId]; !ok {
+		return ErrorIndexNotFound
+	}
+	return b.mdClient.UpdateAggregate(request)
+}
+
+// UpdateMemQuota implements BridgeAccessor{} interface.
+func (b *metadataClient) UpdateMemQuota(defnID uint64, with map[string]interface{}) error {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	if _, ok := currmeta.defns[common.IndexDefnId(defnID)]; !ok {
+		return ErrorIndexNotFound
+	}
+	return b.mdClient.UpdateMemQuota(common.IndexDefnId(defnID), with)
 }
 
 // MoveIndex implements BridgeAccessor{} interface.
@@ -283,9 +338,108 @@ func (b *metadataClient) MoveIndex(defnID uint64, planJSON map[string]interface{
 	return nil
 }
 
+// RebuildIndex implements BridgeAccessor{} interface.
+func (b *metadataClient) RebuildIndex(defnID uint64) error {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	index, ok := currmeta.defns[common.IndexDefnId(defnID)]
+	if !ok {
+		return ErrorIndexNotFound
+	}
+
+	var httpport string
+	for indexerId, _ := range currmeta.topology {
+		var err error
+		if _, _, httpport, err = b.mdClient.FindServiceForIndexer(indexerId); err == nil {
+			break
+		}
+	}
+
+	if httpport == "" {
+		return ErrorNoHost
+	}
+
+	timeout := time.Duration(0 * time.Second)
+
+	idList := IndexIdList{DefnIds: []uint64{defnID}}
+	ir := IndexRequest{Index: *index.Definition, IndexIds: idList}
+	body, err := json.Marshal(&ir)
+	if err != nil {
+		return err
+	}
+
+	bodybuf := bytes.NewBuffer(body)
+
+	url := "/rebuildIndexInternal"
+	resp, err := postWithAuth(httpport+url, "application/json", bodybuf, timeout)
+	if err != nil {
+		errStr := fmt.Sprintf("Error communicating with index node %v. Reason %v", httpport, err)
+		return errors.New(errStr)
+	}
+	defer resp.Body.Close()
+
+	response := new(IndexResponse)
+	bytes, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(bytes, &response); err != nil {
+		return err
+	}
+	if response.Code == RESP_ERROR {
+		return errors.New(response.Error)
+	}
+
+	return nil
+}
+
+// IndexHistory implements BridgeAccessor{} interface.
+func (b *metadataClient) IndexHistory(
+	request *mclient.DDLHistoryRequest) (*mclient.DDLHistoryResponse, error) {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	// any indexer returns history of all indexers.
+	var httpport string
+	for indexerId, _ := range currmeta.topology {
+		var err error
+		if _, _, httpport, err = b.mdClient.FindServiceForIndexer(indexerId); err == nil {
+			break
+		}
+	}
+
+	if httpport == "" {
+		return nil, ErrorNoHost
+	}
+
+	url := "/getIndexHistory?" + request.Values().Encode()
+	resp, err := getWithAuth(httpport+url, time.Duration(0))
+	if err != nil {
+		errStr := fmt.Sprintf("Error communicating with index node %v. Reason %v", httpport, err)
+		return nil, errors.New(errStr)
+	}
+	defer resp.Body.Close()
+
+	response := new(mclient.DDLHistoryResponse)
+	bytes, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(bytes, &response); err != nil {
+		return nil, err
+	}
+	if response.Code == RESP_ERROR {
+		return nil, errors.New(response.Error)
+	}
+
+	return response, nil
+}
+
 // DropIndex implements BridgeAccessor{} interface.
 func (b *metadataClient) DropIndex(defnID uint64) error {
-	err := b.mdClient.DropIndex(common.IndexDefnId(defnID))
+	return b.DropIndexWithRequester(nil, defnID)
+}
+
+// DropIndexWithRequester implements BridgeAccessor{} interface.
+func (b *metadataClient) DropIndexWithRequester(
+	requester *mclient.DDLRequester, defnID uint64) error {
+
+	err := b.mdClient.DropIndexWithRequester(common.IndexDefnId(defnID), requester)
 	if err == nil { // cleanup index local cache.
 		b.safeupdate(nil, false /*force*/)
 	}
@@ -1841,6 +1995,26 @@ func (b *metadataClient) watchClusterChanges() {
 	}
 }
 
+func getWithAuth(url string, timeout time.Duration) (*http.Response, error) {
+
+	if !strings.HasPrefix(url, "http://") {
+		url = "http://" + url
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = cbauth.SetRequestAuthVia(req, nil)
+	if err != nil {
+		logging.Errorf("Error setting auth %v", err)
+		return nil, err
+	}
+
+	client := http.Client{Timeout: timeout}
+	return client.Do(req)
+}
+
 func postWithAuth(url string, bodyType string, body io.Reader, timeout time.Duration) (*http.Response, error) {
 
 	if !strings.HasPrefix(url, "http://") {
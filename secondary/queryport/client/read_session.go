@@ -0,0 +1,204 @@
+package client
+
+import "errors"
+import "fmt"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/common"
+import "github.com/couchbase/indexing/secondary/logging"
+
+// ErrorSessionNotFound
+var ErrorSessionNotFound = errors.New("queryport.sessionNotFound")
+
+// ErrorSessionIndex
+var ErrorSessionIndex = errors.New("queryport.sessionIndexNotPinned")
+
+// readSession pins the snapshots of indexes on the indexers chosen
+// when the session was opened, scans in the session are routed to the
+// same indexers and instances.
+type readSession struct {
+	plans      map[uint64]*sessionPlan // requested defnID -> plan
+	queryports map[string]bool
+}
+
+type sessionPlan struct {
+	queryports    []string
+	targetDefnID  uint64
+	targetInstIds []uint64
+	rollbackTimes []int64
+	partitions    [][]common.PartitionId
+	numPartitions uint32
+}
+
+// OpenReadSession pins the current snapshot of indexes `defnIDs` on
+// each indexer hosting them, for `ttl`. Scans issued with SessionScan3
+// and SessionMultiScanCount for `sessionId` read the pinned snapshots,
+// until the session is closed or expired by indexers.
+func (c *GsiClient) OpenReadSession(
+	sessionId string, defnIDs []uint64, ttl time.Duration,
+	cons common.Consistency, vector *TsConsistency) (err error) {
+
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+
+	c.sessionMu.Lock()
+	if _, ok := c.sessions[sessionId]; ok {
+		c.sessionMu.Unlock()
+		return fmt.Errorf("read session %v is already open", sessionId)
+	}
+	c.sessionMu.Unlock()
+
+	session := &readSession{
+		plans:      make(map[uint64]*sessionPlan),
+		queryports: make(map[string]bool),
+	}
+	defer func() {
+		if err != nil {
+			c.closeReadSession(sessionId, session)
+		}
+	}()
+
+	ttlSec := uint32(ttl / time.Second)
+	for _, defnID := range defnIDs {
+		if _, err = c.bridge.IndexState(defnID); err != nil {
+			return err
+		}
+
+		queryports, targetDefnID, targetInstIds, rollbackTimes, partitions, numPartitions, ok :=
+			c.bridge.GetScanport(defnID, nil, nil)
+		if !ok {
+			return ErrorNoHost
+		}
+		index := c.bridge.GetIndexDefn(targetDefnID)
+		if index == nil {
+			return ErrorIndexNotFound
+		}
+		qcs, ok := c.getScanClients(queryports)
+		if !ok {
+			return ErrorNoHost
+		}
+
+		for i, qc := range qcs {
+			if len(partitions[i]) == 0 {
+				continue
+			}
+			var vec *TsConsistency
+			if vec, err = c.getConsistency(qc, cons, vector, index.Bucket); err != nil {
+				return err
+			}
+			session.queryports[queryports[i]] = true
+			err = qc.OpenSession(sessionId, targetDefnID, sessionId, ttlSec, cons, vec,
+				rollbackTimes[i], partitions[i])
+			if err != nil {
+				logging.Errorf("OpenReadSession %v: failed to pin index %v on %v: %v",
+					sessionId, targetDefnID, queryports[i], err)
+				return err
+			}
+		}
+
+		session.plans[defnID] = &sessionPlan{
+			queryports:    queryports,
+			targetDefnID:  targetDefnID,
+			targetInstIds: targetInstIds,
+			rollbackTimes: rollbackTimes,
+			partitions:    partitions,
+			numPartitions: numPartitions,
+		}
+	}
+
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*readSession)
+	}
+	c.sessions[sessionId] = session
+	return nil
+}
+
+// CloseReadSession releases the snapshots pinned for `sessionId`.
+func (c *GsiClient) CloseReadSession(sessionId string) error {
+	c.sessionMu.Lock()
+	session, ok := c.sessions[sessionId]
+	delete(c.sessions, sessionId)
+	c.sessionMu.Unlock()
+
+	if !ok {
+		return ErrorSessionNotFound
+	}
+	return c.closeReadSession(sessionId, session)
+}
+
+func (c *GsiClient) closeReadSession(sessionId string, session *readSession) (err error) {
+	for queryport := range session.queryports {
+		qcs, ok := c.getScanClients([]string{queryport})
+		if !ok {
+			continue
+		}
+		if err1 := qcs[0].CloseSession(sessionId); err1 != nil {
+			logging.Errorf("CloseReadSession %v: failed on %v: %v", sessionId, queryport, err1)
+			err = err1
+		}
+	}
+	return err
+}
+
+// SessionScan3 is Scan3 reading the snapshot pinned by read session
+// `sessionId`.
+func (c *GsiClient) SessionScan3(
+	sessionId string, defnID uint64, requestId string, scans Scans, reverse,
+	distinct bool, projection *IndexProjection, offset, limit int64,
+	groupAggr *GroupAggr, indexOrder *IndexKeyOrder,
+	callb ResponseHandler) (err error) {
+
+	broker := makeDefaultRequestBroker(callb)
+	broker.SetSession(sessionId)
+	return c.Scan3Internal(defnID, requestId, scans, reverse, distinct,
+		projection, offset, limit, groupAggr, indexOrder, common.AnyConsistency, nil, broker)
+}
+
+// SessionMultiScanCount is MultiScanCount reading the snapshot pinned
+// by read session `sessionId`.
+func (c *GsiClient) SessionMultiScanCount(
+	sessionId string, defnID uint64, requestId string,
+	scans Scans, distinct bool) (count int64, err error) {
+
+	broker := makeDefaultRequestBroker(nil)
+	broker.SetSession(sessionId)
+	return c.MultiScanCountInternal(defnID, requestId, scans, distinct,
+		common.AnyConsistency, nil, broker)
+}
+
+// doSessionScan scatters the request to the instances pinned by read
+// session, there is no retry with other replicas.
+func (c *GsiClient) doSessionScan(defnID uint64, requestId string,
+	broker *RequestBroker) (int64, error) {
+
+	c.sessionMu.Lock()
+	session, ok := c.sessions[broker.GetSession()]
+	c.sessionMu.Unlock()
+	if !ok {
+		return 0, ErrorSessionNotFound
+	}
+	plan, ok := session.plans[defnID]
+	if !ok {
+		return 0, ErrorSessionIndex
+	}
+
+	index := c.bridge.GetIndexDefn(plan.targetDefnID)
+	if index == nil {
+		return 0, ErrorIndexNotFound
+	}
+	qcs, ok := c.getScanClients(plan.queryports)
+	if !ok {
+		return 0, ErrorNoHost
+	}
+
+	broker.SetResponseTimer(c.bridge.Timeit)
+	count, scan_errs, _ := broker.scatter(qcs, index, plan.targetInstIds, plan.rollbackTimes,
+		plan.partitions, plan.numPartitions, c.settings)
+	if c.isTimeit(scan_errs) {
+		return count, getScanError(scan_errs)
+	}
+	return 0, fmt.Errorf("%v from %v", getScanError(scan_errs), plan.queryports)
+}
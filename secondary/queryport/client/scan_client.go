@@ -24,6 +24,13 @@ import protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
 import "github.com/couchbase/indexing/secondary/transport"
 import "github.com/golang/protobuf/proto"
 
+// scanCursor to resume a scan after the rows returned by a previous
+// scan request.
+type scanCursor struct {
+	token        []byte
+	sameSnapshot bool
+}
+
 // GsiScanClient for scan operations.
 type GsiScanClient struct {
 	queryport string
@@ -37,8 +44,56 @@ type GsiScanClient struct {
 	cpTimeout          time.Duration
 	cpAvailWaitTimeout time.Duration
 	logPrefix          string
+	flowRows           uint64 // flow control window, 0 to disable
+	flowBytes          uint64
+
+	serverVersion  uint32
+	serverFeatures uint32 // protobuf.ScanFeatures supported by server
+}
+
+// creditWindow of a flow controlled scan stream, counts the rows
+// consumed by application and returns them as credits to server.
+type creditWindow struct {
+	rows, bytes         uint64
+	usedRows, usedBytes uint64
+}
+
+func (c *GsiScanClient) newCreditWindow() *creditWindow {
+	if c.flowRows == 0 && c.flowBytes == 0 {
+		return nil
+	}
+	// older servers close the connection on CreditRequest.
+	if !c.hasFeature(protobuf.FeatureFlowControl) {
+		return nil
+	}
+	return &creditWindow{rows: c.flowRows, bytes: c.flowBytes}
+}
 
-	serverVersion uint32
+func (w *creditWindow) wrap(callb ResponseHandler) ResponseHandler {
+	return func(resp ResponseReader) bool {
+		if streamResp, ok := resp.(*protobuf.ResponseStream); ok {
+			for _, entry := range streamResp.GetIndexEntries() {
+				w.usedRows++
+				w.usedBytes += uint64(len(entry.GetEntryKey()) + len(entry.GetPrimaryKey()))
+			}
+		}
+		return callb(resp)
+	}
+}
+
+// due when application has consumed half of the window.
+func (w *creditWindow) due() bool {
+	return (w.rows > 0 && w.usedRows >= w.rows/2) ||
+		(w.bytes > 0 && w.usedBytes >= w.bytes/2)
+}
+
+func (w *creditWindow) grant() *protobuf.CreditRequest {
+	req := &protobuf.CreditRequest{
+		Rows:  proto.Uint32(uint32(w.usedRows)),
+		Bytes: proto.Uint64(w.usedBytes),
+	}
+	w.usedRows, w.usedBytes = 0, 0
+	return req
 }
 
 func NewGsiScanClient(queryport string, config common.Config) (*GsiScanClient, error) {
@@ -53,6 +108,8 @@ func NewGsiScanClient(queryport string, config common.Config) (*GsiScanClient, e
 		cpTimeout:          time.Duration(config["connPoolTimeout"].Int()),
 		cpAvailWaitTimeout: t,
 		logPrefix:          fmt.Sprintf("[GsiScanClient:%q]", queryport),
+		flowRows:           uint64(config["scan.flowControl.rows"].Int()),
+		flowBytes:          uint64(config["scan.flowControl.bytes"].Int()),
 	}
 	c.pool = newConnectionPool(
 		queryport, c.poolSize, c.poolOverflow, c.maxPayload, c.cpTimeout,
@@ -79,6 +136,12 @@ func (c *GsiScanClient) RefreshServerVersion() {
 	}
 }
 
+// hasFeature return whether server supports scan `feature`, as per
+// protobuf.ScanFeatures.
+func (c *GsiScanClient) hasFeature(feature uint32) bool {
+	return atomic.LoadUint32(&c.serverFeatures)&feature == feature
+}
+
 func (c *GsiScanClient) NeedSessionConsVector() bool {
 	return atomic.LoadUint32(&c.serverVersion) == 0
 }
@@ -93,9 +156,65 @@ func (c *GsiScanClient) Helo() (uint32, error) {
 		return 0, err
 	}
 	heloResp := resp.(*protobuf.HeloResponse)
+	atomic.StoreUint32(&c.serverFeatures, heloResp.GetFeatures())
 	return heloResp.GetVersion(), nil
 }
 
+// OpenSession pins the snapshot of index for read session `sessionId`
+// on this indexer, for `ttl` seconds.
+func (c *GsiScanClient) OpenSession(
+	sessionId string, defnID uint64, requestId string, ttl uint32,
+	cons common.Consistency, vector *TsConsistency,
+	rollbackTime int64, partitions []common.PartitionId) error {
+
+	partnIds := make([]uint64, len(partitions))
+	for i, partnId := range partitions {
+		partnIds[i] = uint64(partnId)
+	}
+
+	req := &protobuf.SessionRequest{
+		SessionId:    proto.String(sessionId),
+		DefnID:       proto.Uint64(defnID),
+		Ttl:          proto.Uint32(ttl),
+		Cons:         proto.Uint32(uint32(cons)),
+		RequestId:    proto.String(requestId),
+		RollbackTime: proto.Int64(rollbackTime),
+		PartitionIds: partnIds,
+	}
+	if vector != nil {
+		req.Vector = protobuf.NewTsConsistency(
+			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+	}
+	return c.doSessionRequest(req, requestId)
+}
+
+// CloseSession releases snapshots pinned for read session `sessionId`
+// on this indexer.
+func (c *GsiScanClient) CloseSession(sessionId string) error {
+	req := &protobuf.SessionRequest{
+		SessionId: proto.String(sessionId),
+		Close:     proto.Bool(true),
+	}
+	return c.doSessionRequest(req, "")
+}
+
+func (c *GsiScanClient) doSessionRequest(
+	req *protobuf.SessionRequest, requestId string) error {
+
+	resp, err := c.doRequestResponse(req, requestId)
+	if err != nil {
+		return err
+	}
+	sessionResp, ok := resp.(*protobuf.SessionResponse)
+	if !ok {
+		return ErrorProtocol
+	}
+	if sessionResp.GetErr() != nil {
+		return errors.New(sessionResp.GetErr().GetError())
+	}
+	return nil
+}
+
 // LookupStatistics for a single secondary-key.
 func (c *GsiScanClient) LookupStatistics(
 	defnID uint64, value common.SecondaryKey) (common.IndexStatistics, error) {
@@ -447,6 +566,10 @@ func (c *GsiScanClient) MultiScan(
 	cons common.Consistency, vector *TsConsistency,
 	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
 
+	if err := c.checkPatterns(scans); err != nil {
+		return err, false
+	}
+
 	// serialize scans
 	protoScans := make([]*protobuf.Scan, len(scans))
 	for i, scan := range scans {
@@ -487,6 +610,7 @@ func (c *GsiScanClient) MultiScan(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters[j] = fl
 					}
@@ -579,6 +703,10 @@ func (c *GsiScanClient) MultiScanPrimary(
 	cons common.Consistency, vector *TsConsistency,
 	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
 
+	if err := c.checkPatterns(scans); err != nil {
+		return err, false
+	}
+
 	var what string
 	// serialize scans
 	protoScans := make([]*protobuf.Scan, 0)
@@ -617,6 +745,7 @@ func (c *GsiScanClient) MultiScanPrimary(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters = append(filters, fl)
 					}
@@ -878,7 +1007,12 @@ func (c *GsiScanClient) CountRangePrimary(
 
 func (c *GsiScanClient) MultiScanCount(
 	defnID uint64, requestId string, scans Scans, distinct bool,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	sessionId string) (int64, error) {
+
+	if err := c.checkPatterns(scans); err != nil {
+		return 0, err
+	}
 
 	// serialize scans
 	protoScans := make([]*protobuf.Scan, len(scans))
@@ -919,6 +1053,7 @@ func (c *GsiScanClient) MultiScanCount(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters[j] = fl
 					}
@@ -954,6 +1089,9 @@ func (c *GsiScanClient) MultiScanCount(
 		req.Vector = protobuf.NewTsConsistency(
 			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
 	}
+	if sessionId != "" {
+		req.SessionId = proto.String(sessionId)
+	}
 
 	resp, err := c.doRequestResponse(req, requestId)
 	if err != nil {
@@ -969,7 +1107,12 @@ func (c *GsiScanClient) MultiScanCount(
 
 func (c *GsiScanClient) MultiScanCountPrimary(
 	defnID uint64, requestId string, scans Scans, distinct bool,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	sessionId string) (int64, error) {
+
+	if err := c.checkPatterns(scans); err != nil {
+		return 0, err
+	}
 
 	var what string
 	// serialize scans
@@ -1009,6 +1152,7 @@ func (c *GsiScanClient) MultiScanCountPrimary(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters = append(filters, fl)
 					}
@@ -1052,6 +1196,9 @@ func (c *GsiScanClient) MultiScanCountPrimary(
 		req.Vector = protobuf.NewTsConsistency(
 			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
 	}
+	if sessionId != "" {
+		req.SessionId = proto.String(sessionId)
+	}
 
 	resp, err := c.doRequestResponse(req, requestId)
 	if err != nil {
@@ -1070,7 +1217,16 @@ func (c *GsiScanClient) Scan3(
 	reverse, distinct bool, projection *IndexProjection, offset, limit int64,
 	groupAggr *GroupAggr, sorted bool,
 	cons common.Consistency, vector *TsConsistency,
-	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
+	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId,
+	cursor *scanCursor, sessionId string, filter *IndexFilter) (error, bool) {
+
+	// older servers ignore the filter and return all rows.
+	if filter != nil && !c.hasFeature(protobuf.FeatureIndexFilter) {
+		return ErrorFilterNotSupported, false
+	}
+	if err := c.checkPatterns(scans); err != nil {
+		return err, false
+	}
 
 	// serialize scans
 	protoScans := make([]*protobuf.Scan, len(scans))
@@ -1111,6 +1267,7 @@ func (c *GsiScanClient) Scan3(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters[j] = fl
 					}
@@ -1214,6 +1371,23 @@ func (c *GsiScanClient) Scan3(
 		req.Vector = protobuf.NewTsConsistency(
 			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
 	}
+	if cursor != nil {
+		req.Resumable = proto.Bool(true)
+		req.ResumeToken = cursor.token
+		req.SameSnapshot = proto.Bool(cursor.sameSnapshot)
+	}
+	if sessionId != "" {
+		req.SessionId = proto.String(sessionId)
+	}
+	if filter != nil {
+		req.Filter = protoIndexFilter(filter)
+	}
+	window := c.newCreditWindow()
+	if window != nil {
+		req.RowCredits = proto.Uint32(uint32(window.rows))
+		req.ByteCredits = proto.Uint64(window.bytes)
+		callb = window.wrap(callb)
+	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
 		fmsg := "%v Range(%v) request transport failed `%v`\n"
@@ -1232,6 +1406,14 @@ func (c *GsiScanClient) Scan3(
 		} else { // partial succeeded
 			partial = true
 		}
+		if cont && window != nil && window.due() {
+			// ---> protobuf.CreditRequest
+			if err = c.sendRequest(conn, pkt, window.grant()); err != nil {
+				fmsg := "%v Scans(%v) credit request transport failed `%v`\n"
+				logging.Errorf(fmsg, c.logPrefix, requestId, err)
+				cont, healthy, closeStream = false, false, false
+			}
+		}
 	}
 	return err, partial
 }
@@ -1241,7 +1423,16 @@ func (c *GsiScanClient) Scan3Primary(
 	reverse, distinct bool, projection *IndexProjection, offset, limit int64,
 	groupAggr *GroupAggr, sorted bool,
 	cons common.Consistency, vector *TsConsistency,
-	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
+	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId,
+	cursor *scanCursor, sessionId string, filter *IndexFilter) (error, bool) {
+
+	// older servers ignore the filter and return all rows.
+	if filter != nil && !c.hasFeature(protobuf.FeatureIndexFilter) {
+		return ErrorFilterNotSupported, false
+	}
+	if err := c.checkPatterns(scans); err != nil {
+		return err, false
+	}
 
 	var what string
 	// serialize scans
@@ -1286,6 +1477,7 @@ func (c *GsiScanClient) Scan3Primary(
 						fl := &protobuf.CompositeElementFilter{
 							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
 						}
+						setFilterPattern(fl, f)
 
 						filters[j] = fl
 					}
@@ -1389,6 +1581,23 @@ func (c *GsiScanClient) Scan3Primary(
 		req.Vector = protobuf.NewTsConsistency(
 			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
 	}
+	if cursor != nil {
+		req.Resumable = proto.Bool(true)
+		req.ResumeToken = cursor.token
+		req.SameSnapshot = proto.Bool(cursor.sameSnapshot)
+	}
+	if sessionId != "" {
+		req.SessionId = proto.String(sessionId)
+	}
+	if filter != nil {
+		req.Filter = protoIndexFilter(filter)
+	}
+	window := c.newCreditWindow()
+	if window != nil {
+		req.RowCredits = proto.Uint32(uint32(window.rows))
+		req.ByteCredits = proto.Uint64(window.bytes)
+		callb = window.wrap(callb)
+	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
 		fmsg := "%v Range(%v) request transport failed `%v`\n"
@@ -1407,10 +1616,63 @@ func (c *GsiScanClient) Scan3Primary(
 		} else { // partial succeeded
 			partial = true
 		}
+		if cont && window != nil && window.due() {
+			// ---> protobuf.CreditRequest
+			if err = c.sendRequest(conn, pkt, window.grant()); err != nil {
+				fmsg := "%v Scans(%v) credit request transport failed `%v`\n"
+				logging.Errorf(fmsg, c.logPrefix, requestId, err)
+				cont, healthy, closeStream = false, false, false
+			}
+		}
 	}
 	return err, partial
 }
 
+// setFilterPattern of filter `f` in `fl`, nil Low and High of pattern
+// filter are unbounded.
+func setFilterPattern(fl *protobuf.CompositeElementFilter, f *CompositeElementFilter) {
+	if f.PatternType != common.PATTERN_NONE {
+		fl.Pattern = []byte(f.Pattern)
+		fl.PatternType = proto.Uint32(uint32(f.PatternType))
+		if f.Low == nil {
+			fl.Low = nil
+		}
+		if f.High == nil {
+			fl.High = nil
+		}
+	}
+}
+
+// checkPatterns fails scans with pattern filters if server does not
+// support them, older servers ignore patterns and return all rows.
+func (c *GsiScanClient) checkPatterns(scans Scans) error {
+	if c.hasFeature(protobuf.FeaturePatternFilter) {
+		return nil
+	}
+	for _, scan := range scans {
+		if scan == nil {
+			continue
+		}
+		for _, f := range scan.Filter {
+			if f != nil && f.PatternType != common.PATTERN_NONE {
+				return ErrorPatternNotSupported
+			}
+		}
+	}
+	return nil
+}
+
+func protoIndexFilter(filter *IndexFilter) *protobuf.IndexFilter {
+	protoFilter := &protobuf.IndexFilter{
+		Expr:               []byte(filter.Expr),
+		DependsOnIndexKeys: filter.DependsOnIndexKeys,
+	}
+	for _, name := range filter.IndexKeyNames {
+		protoFilter.IndexKeyNames = append(protoFilter.IndexKeyNames, []byte(name))
+	}
+	return protoFilter
+}
+
 func (c *GsiScanClient) Close() error {
 	return c.pool.Close()
 }
@@ -1502,6 +1764,13 @@ func (c *GsiScanClient) streamResponse(
 		callb(&protobuf.StreamEndResponse{}) // callback most likely return true
 		cont, healthy = false, true
 
+	} else if endResp, ok := resp.(*protobuf.StreamEndResponse); ok {
+		// resumable scans end with a resume token.
+		if err = endResp.Error(); err == nil {
+			cont = callb(endResp)
+		}
+		healthy = true
+
 	} else {
 		streamResp := resp.(*protobuf.ResponseStream)
 		if err = streamResp.Error(); err == nil {
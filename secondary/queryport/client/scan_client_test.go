@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+)
+
+func TestSetFilterPattern(t *testing.T) {
+	marshal := func(key interface{}) []byte {
+		data, err := json.Marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// nil bounds of a pattern filter are unbounded.
+	f := &CompositeElementFilter{Pattern: "ab%", PatternType: common.PATTERN_LIKE}
+	fl := &protobuf.CompositeElementFilter{Low: marshal(f.Low), High: marshal(f.High)}
+	setFilterPattern(fl, f)
+	if fl.Low != nil || fl.High != nil {
+		t.Errorf("expected unbounded range, got %s %s", fl.Low, fl.High)
+	}
+	if string(fl.Pattern) != "ab%" || fl.GetPatternType() != uint32(common.PATTERN_LIKE) {
+		t.Errorf("unexpected pattern %s of type %v", fl.Pattern, fl.GetPatternType())
+	}
+
+	f = &CompositeElementFilter{High: "b", Pattern: "a.*", PatternType: common.PATTERN_REGEX}
+	fl = &protobuf.CompositeElementFilter{Low: marshal(f.Low), High: marshal(f.High)}
+	setFilterPattern(fl, f)
+	if fl.Low != nil || string(fl.High) != `"b"` {
+		t.Errorf("expected range (unbounded, \"b\"), got %s %s", fl.Low, fl.High)
+	}
+
+	// nil bounds without a pattern are null.
+	f = &CompositeElementFilter{}
+	fl = &protobuf.CompositeElementFilter{Low: marshal(f.Low), High: marshal(f.High)}
+	setFilterPattern(fl, f)
+	if string(fl.Low) != "null" || string(fl.High) != "null" || fl.PatternType != nil {
+		t.Errorf("expected range (null, null) with no pattern, got %s %s %v",
+			fl.Low, fl.High, fl.GetPatternType())
+	}
+}
+
+func TestCheckPatterns(t *testing.T) {
+	scans := Scans{
+		nil,
+		&Scan{Filter: []*CompositeElementFilter{{Low: "a", High: "b"}}},
+	}
+	c := &GsiScanClient{}
+	if err := c.checkPatterns(scans); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	scans = append(scans, &Scan{Filter: []*CompositeElementFilter{
+		{Pattern: "a%", PatternType: common.PATTERN_LIKE},
+	}})
+	if err := c.checkPatterns(scans); err != ErrorPatternNotSupported {
+		t.Errorf("expected %v, got %v", ErrorPatternNotSupported, err)
+	}
+
+	c.serverFeatures = protobuf.ScanFeatures
+	if err := c.checkPatterns(scans); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
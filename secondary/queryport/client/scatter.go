@@ -15,6 +15,7 @@ import (
 	"github.com/couchbase/indexing/secondary/collatejson"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
 	"github.com/couchbase/query/value"
 	"math"
 	"reflect"
@@ -82,6 +83,10 @@ type RequestBroker struct {
 	indexOrder     *IndexKeyOrder
 	projDesc       []bool
 	distinct       bool
+	cursor         *scanCursor
+	resumeToken    []byte
+	sessionId      string
+	filter         *IndexFilter
 
 	// stats
 	sendCount    int64
@@ -250,6 +255,73 @@ func (b *RequestBroker) SetIndexOrder(indexOrder *IndexKeyOrder) {
 	b.indexOrder = indexOrder
 }
 
+//
+// Set cursor to resume scan from
+//
+func (b *RequestBroker) SetCursor(token []byte, sameSnapshot bool) {
+
+	b.cursor = &scanCursor{token: token, sameSnapshot: sameSnapshot}
+}
+
+//
+// Get cursor to resume scan from
+//
+func (b *RequestBroker) GetCursor() *scanCursor {
+
+	return b.cursor
+}
+
+//
+// Set read session to scan in
+//
+func (b *RequestBroker) SetSession(sessionId string) {
+
+	b.sessionId = sessionId
+}
+
+//
+// Get read session to scan in
+//
+func (b *RequestBroker) GetSession() string {
+
+	return b.sessionId
+}
+
+//
+// Set filter to be evaluated by indexer
+//
+func (b *RequestBroker) SetFilter(filter *IndexFilter) {
+
+	b.filter = filter
+}
+
+//
+// Get filter to be evaluated by indexer
+//
+func (b *RequestBroker) GetFilter() *IndexFilter {
+
+	return b.filter
+}
+
+func (b *RequestBroker) setResumeToken(token []byte) {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.resumeToken = token
+}
+
+//
+// Get token to resume scan, nil if scan is exhausted
+//
+func (b *RequestBroker) GetResumeToken() []byte {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.resumeToken
+}
+
 //
 // Close the broker on error
 //
@@ -425,6 +497,7 @@ func (b *RequestBroker) reset() {
 	b.bGather = false
 	b.errMap = make(map[common.PartitionId]map[uint64]error)
 	b.partial = 0 // false
+	b.resumeToken = nil
 
 	// backfill
 	b.backfills = nil
@@ -462,6 +535,13 @@ func (c *RequestBroker) scatter(client []*GsiScanClient, index *common.IndexDefn
 
 	partition = c.filterPartitions(index, partition, numPartition)
 	client, rollback, partition = filterClients(client, rollback, partition)
+
+	// resume token is generated by indexer, rows gathered from multiple
+	// indexers cannot be resumed.
+	if c.cursor != nil && len(client) > 1 {
+		return 0, c.makeErrorMap(targetInstId, partition, ErrorResumeNotSupported), false
+	}
+
 	c.analyzeOrderBy(partition, numPartition, index)
 	c.analyzeProjection(partition, numPartition, index)
 	c.changePushdownParams(partition, numPartition, index)
@@ -1140,6 +1220,10 @@ func makeDefaultResponseHandler(id ResponseHandlerId, broker *RequestBroker, ins
 			broker.Error(err, instId, partitions)
 			return false
 		}
+		if endResp, ok := resp.(*protobuf.StreamEndResponse); ok && endResp.GetResumeToken() != nil {
+			broker.setResumeToken(endResp.GetResumeToken())
+			return true
+		}
 		skeys, pkeys, err := resp.GetEntries()
 		if err != nil {
 			logging.Errorf("defaultResponseHandler: %v", err)
@@ -23,6 +23,7 @@ type ClientSettings struct {
 	numReplica     int32
 	numPartition   int32
 	backfillLimit  int32
+	backfillCrypt  int32
 	scanLagPercent uint64
 	scanLagItem    uint64
 	prune_replica  int32
@@ -122,6 +123,12 @@ func (s *ClientSettings) handleSettings(config common.Config) {
 		logging.Errorf("ClientSettings: invalid setting value for backfillLimit=%v", backfillLimit)
 	}
 
+	if config["queryport.client.settings.backfillEncryption"].Bool() {
+		atomic.StoreInt32(&s.backfillCrypt, int32(1))
+	} else {
+		atomic.StoreInt32(&s.backfillCrypt, int32(0))
+	}
+
 	scanLagPercent := config["queryport.client.scanLagPercent"].Float64()
 	if scanLagPercent >= 0 {
 		atomic.StoreUint64(&s.scanLagPercent, math.Float64bits(scanLagPercent))
@@ -186,6 +193,10 @@ func (s *ClientSettings) BackfillLimit() int32 {
 	return atomic.LoadInt32(&s.backfillLimit)
 }
 
+func (s *ClientSettings) BackfillEncryption() bool {
+	return atomic.LoadInt32(&s.backfillCrypt) == 1
+}
+
 func (s *ClientSettings) ScanLagPercent() float64 {
 	bits := atomic.LoadUint64(&s.scanLagPercent)
 	return math.Float64frombits(bits)
@@ -0,0 +1,236 @@
+package queryport
+
+import "errors"
+import "net"
+import "sync"
+import "time"
+
+// Flow control.
+//
+// Client can open a scan with a window of rows and bytes it is willing
+// to buffer. Server consumes the window as it writes response batches
+// and stops writing when the window is exhausted, client replenishes
+// the window by sending CreditRequest after consuming the rows. Time
+// between a batch sent and credits returned for it is measured as the
+// round trip time of the stream, which is used to size the response
+// batches adaptively.
+
+// ErrorCreditTimeout is returned when client did not grant credits
+// within the configured timeout.
+var ErrorCreditTimeout = errors.New("queryport.creditTimeout")
+
+// ErrorCreditClosed is returned when the connection is closed while
+// waiting for credits.
+var ErrorCreditClosed = errors.New("queryport.creditClosed")
+
+// ErrorCreditQuit is returned when client ends the stream while server
+// is waiting for credits.
+var ErrorCreditQuit = errors.New("queryport.creditQuit")
+
+const (
+	minBatchBytes = 4 * 1024
+	rttAlpha      = 0.25 // weight of a new sample in moving averages
+)
+
+// Credits of a single response stream.
+type Credits struct {
+	mu          sync.Mutex
+	windowRows  int64
+	windowBytes int64
+	rows        int64 // available credits
+	bytes       int64
+	closed      bool
+	notify      chan struct{}
+
+	sentAt    time.Time // first batch not yet acknowledged
+	lastGrant time.Time
+	rtt       time.Duration // moving average
+	rate      float64       // moving average of bytes acknowledged per sec.
+	rowSize   float64       // moving average of row size
+}
+
+// NewCredits with initial window of `rows` and `bytes`, 0 for no limit
+// on either.
+func NewCredits(rows, bytes uint64) *Credits {
+	return &Credits{
+		windowRows:  int64(rows),
+		windowBytes: int64(bytes),
+		rows:        int64(rows),
+		bytes:       int64(bytes),
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// FlowControlled connections carry credits of the current request.
+type FlowControlled interface {
+	Credits() *Credits
+}
+
+type creditConn struct {
+	net.Conn
+	credits *Credits
+}
+
+func (c *creditConn) Credits() *Credits {
+	return c.credits
+}
+
+// Acquire credits for a batch of `rows` and `bytes`, blocks until
+// client grants enough credits, `timeout` expires or `quitch` is
+// closed. A batch larger than the window is allowed once all credits
+// are returned. Returns the time spent waiting.
+func (c *Credits) Acquire(
+	rows, bytes int64, timeout time.Duration,
+	quitch <-chan bool) (blocked time.Duration, err error) {
+
+	var tm <-chan time.Time
+	start := time.Now()
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return time.Since(start), ErrorCreditClosed
+		}
+		if c.available(rows, bytes) {
+			c.consume(rows, bytes)
+			c.mu.Unlock()
+			return time.Since(start), nil
+		}
+		c.mu.Unlock()
+
+		if tm == nil && timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			tm = timer.C
+		}
+		select {
+		case <-c.notify:
+		case <-tm:
+			return time.Since(start), ErrorCreditTimeout
+		case <-quitch:
+			return time.Since(start), ErrorCreditQuit
+		}
+	}
+}
+
+func (c *Credits) available(rows, bytes int64) bool {
+	okRows := c.windowRows == 0 || c.rows >= rows || c.rows >= c.windowRows
+	okBytes := c.windowBytes == 0 || c.bytes >= bytes || c.bytes >= c.windowBytes
+	return okRows && okBytes
+}
+
+func (c *Credits) consume(rows, bytes int64) {
+	if c.sentAt.IsZero() {
+		c.sentAt = time.Now()
+	}
+	c.rows -= rows
+	c.bytes -= bytes
+	if rows > 0 {
+		sample := float64(bytes) / float64(rows)
+		if c.rowSize == 0 {
+			c.rowSize = sample
+		} else {
+			c.rowSize += rttAlpha * (sample - c.rowSize)
+		}
+	}
+}
+
+// Grant credits returned by client.
+func (c *Credits) Grant(rows, bytes uint64) {
+	c.mu.Lock()
+	now := time.Now()
+	c.rows += int64(rows)
+	c.bytes += int64(bytes)
+	if !c.sentAt.IsZero() {
+		sample := now.Sub(c.sentAt)
+		if c.rtt == 0 {
+			c.rtt = sample
+		} else {
+			c.rtt += time.Duration(rttAlpha * float64(sample-c.rtt))
+		}
+		c.sentAt = time.Time{}
+		if c.rows < c.windowRows || c.bytes < c.windowBytes {
+			c.sentAt = now // there are batches still in flight
+		}
+	}
+	if !c.lastGrant.IsZero() && bytes > 0 {
+		if elapsed := now.Sub(c.lastGrant).Seconds(); elapsed > 0 {
+			sample := float64(bytes) / elapsed
+			if c.rate == 0 {
+				c.rate = sample
+			} else {
+				c.rate += rttAlpha * (sample - c.rate)
+			}
+		}
+	}
+	c.lastGrant = now
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Close wakes up the waiting writer, no more credits are granted.
+func (c *Credits) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// BatchSize return the number of rows and bytes to accumulate before
+// sending a response batch, `maxBytes` being the largest batch writer
+// can buffer. Batches are sized to send about 4 batches per round trip
+// at the rate client is consuming, so that client is not idle while
+// credits are in flight, and never exceed half the window, even if that
+// is smaller than minBatchBytes, so that the next batch is sent while the
+// previous one is acknowledged.
+func (c *Credits) BatchSize(maxBytes int64) (rows, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bytes = maxBytes
+	if c.rtt > 0 && c.rate > 0 {
+		bytes = int64(c.rate * c.rtt.Seconds() / 4)
+	} else if c.rtt == 0 {
+		bytes = minBatchBytes // first batch, get rows to client early
+	}
+	if bytes < minBatchBytes {
+		bytes = minBatchBytes
+	}
+	if c.windowBytes > 0 && bytes > c.windowBytes/2 {
+		bytes = c.windowBytes / 2
+	}
+	if bytes > maxBytes {
+		bytes = maxBytes
+	}
+	if bytes < 1 {
+		bytes = 1
+	}
+
+	if c.windowRows > 0 {
+		rows = c.windowRows / 2
+		if rows < 1 {
+			rows = 1
+		}
+		if c.rowSize > 0 {
+			if n := int64(float64(bytes) / c.rowSize); n >= 1 && n < rows {
+				rows = n
+			}
+		}
+	}
+	return rows, bytes
+}
+
+// RTT return the measured round trip time of the stream.
+func (c *Credits) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
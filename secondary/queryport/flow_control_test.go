@@ -0,0 +1,98 @@
+package queryport
+
+import "testing"
+import "time"
+
+func TestCreditsAcquire(t *testing.T) {
+	credits := NewCredits(10, 0)
+	quitch := make(chan bool)
+
+	if _, err := credits.Acquire(6, 600, time.Second, quitch); err != nil {
+		t.Fatal(err)
+	}
+	// 4 credits left, next batch of 6 rows blocks until granted.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		credits.Grant(6, 600)
+	}()
+	blocked, err := credits.Acquire(6, 600, time.Second, quitch)
+	if err != nil {
+		t.Fatal(err)
+	} else if blocked < 10*time.Millisecond {
+		t.Fatalf("expected to block for credits, blocked %v", blocked)
+	}
+	if credits.RTT() == 0 {
+		t.Fatal("expected round trip time to be measured")
+	}
+
+	// timeout
+	if _, err := credits.Acquire(6, 600, 10*time.Millisecond, quitch); err != ErrorCreditTimeout {
+		t.Fatalf("expected %v, got %v", ErrorCreditTimeout, err)
+	}
+
+	// batch larger than window is allowed on a full window.
+	credits.Grant(6, 600)
+	if _, err := credits.Acquire(20, 2000, time.Second, quitch); err != nil {
+		t.Fatal(err)
+	}
+
+	// client ends the stream.
+	close(quitch)
+	if _, err := credits.Acquire(6, 600, time.Second, quitch); err != ErrorCreditQuit {
+		t.Fatalf("expected %v, got %v", ErrorCreditQuit, err)
+	}
+
+	credits.Close()
+	if _, err := credits.Acquire(6, 600, time.Second, nil); err != ErrorCreditClosed {
+		t.Fatalf("expected %v, got %v", ErrorCreditClosed, err)
+	}
+}
+
+func TestCreditsBatchSize(t *testing.T) {
+	credits := NewCredits(1000, 1024*1024)
+
+	// first batch is small.
+	rows, bytes := credits.BatchSize(64 * 1024)
+	if bytes != minBatchBytes {
+		t.Fatalf("expected first batch of %v bytes, got %v", minBatchBytes, bytes)
+	} else if rows != 500 {
+		t.Fatalf("expected batch of half the window rows, got %v", rows)
+	}
+
+	credits.Acquire(100, 100*100, 0, nil)
+	time.Sleep(10 * time.Millisecond)
+	credits.Grant(100, 100*100)
+	credits.Acquire(100, 100*100, 0, nil)
+	time.Sleep(10 * time.Millisecond)
+	credits.Grant(100, 100*100)
+
+	rows, bytes = credits.BatchSize(64 * 1024)
+	if bytes < minBatchBytes || bytes > 64*1024 {
+		t.Fatalf("batch of %v bytes out of bounds", bytes)
+	}
+	if expected := bytes / 100; expected < 500 && rows != expected {
+		t.Fatalf("expected rows sized by row size, got %v rows for %v bytes", rows, bytes)
+	}
+}
+
+func TestCreditsBatchSizeSmallWindow(t *testing.T) {
+	credits := NewCredits(0, 6*1024)
+
+	// batches of half the window, so that the next batch is not held
+	// until all credits are returned.
+	_, bytes := credits.BatchSize(64 * 1024)
+	if bytes != 3*1024 {
+		t.Fatalf("expected batch of half the window, got %v bytes", bytes)
+	}
+	quitch := make(chan bool)
+	for i := 0; i < 2; i++ {
+		if _, err := credits.Acquire(1, bytes, 10*time.Millisecond, quitch); err != nil {
+			t.Fatalf("batch %v: %v", i, err)
+		}
+	}
+
+	credits.Grant(2, uint64(2*bytes))
+	if _, bytes = credits.BatchSize(64 * 1024); bytes != 3*1024 {
+		t.Fatalf("expected batch of half the window, got %v bytes", bytes)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2019 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an "AS IS"
+// BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+// or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package n1ql
+
+import "bytes"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "encoding/binary"
+import "encoding/gob"
+import "fmt"
+import "io"
+import "sync"
+import "sync/atomic"
+
+import c "github.com/couchbase/indexing/secondary/common"
+import "github.com/golang/snappy"
+
+// Backfill files.
+//
+// Rows that cannot be consumed by cbq-engine as fast as they are
+// received from indexers are spilled to backfill files. Spilled rows
+// are framed as
+//
+//     | len (4 bytes) | payload |
+//
+// where payload is the snappy compressed gob encoding of a batch of
+// rows, sealed with an ephemeral per-request AES-GCM key when backfill
+// encryption is enabled. All requests in the process share the disk
+// budget configured for backfill, each spilling request is allowed a
+// fair share of the budget.
+
+// backfillBudget accounts bytes spilled by all requests in the process.
+type backfillBudget struct {
+	mu       sync.Mutex
+	used     int64
+	requests map[string]*backfillStats // requestId -> stats
+}
+
+// backfillStats for spills of a single request.
+type backfillStats struct {
+	files     int64
+	records   int64
+	rawBytes  int64 // encoded bytes before compression
+	diskBytes int64 // bytes written to backfill files
+}
+
+var gBackfillBudget = &backfillBudget{
+	requests: make(map[string]*backfillStats),
+}
+
+// reserve `n` bytes for request `requestId` under `limit` bytes of
+// disk budget.
+func (b *backfillBudget) reserve(requestId string, n, limit int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.requests[requestId]
+	if !ok {
+		st = &backfillStats{}
+		b.requests[requestId] = st
+	}
+
+	share := limit / int64(len(b.requests))
+	if b.used+n > limit || st.diskBytes+n > share {
+		fmsg := "%q backfill exceeded disk budget, request spilled %v bytes, " +
+			"fair share %v bytes of %v bytes limit for %v spilling requests, " +
+			"total spilled %v bytes"
+		return fmt.Errorf(fmsg, requestId, st.diskBytes, share, limit,
+			len(b.requests), b.used)
+	}
+	b.used += n
+	st.diskBytes += n
+	return nil
+}
+
+func (b *backfillBudget) addStats(requestId string, files, records, rawBytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.requests[requestId]
+	if !ok {
+		st = &backfillStats{}
+		b.requests[requestId] = st
+	}
+	st.files += files
+	st.records += records
+	st.rawBytes += rawBytes
+}
+
+// release budget held by request `requestId`, on removing its backfill
+// files, return spill stats of the request.
+func (b *backfillBudget) release(requestId string) *backfillStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.requests[requestId]
+	if !ok {
+		return nil
+	}
+	b.used -= st.diskBytes
+	delete(b.requests, requestId)
+	return st
+}
+
+// get a copy of spill stats of request `requestId` in progress, nil if
+// the request has not spilled any rows.
+func (b *backfillBudget) get(requestId string) *backfillStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if st, ok := b.requests[requestId]; ok {
+		stcopy := *st
+		return &stcopy
+	}
+	return nil
+}
+
+func (st *backfillStats) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"files":      st.files,
+		"records":    st.records,
+		"bytes":      st.rawBytes,
+		"disk_bytes": st.diskBytes,
+	}
+}
+
+// backfillHistorySize is the number of completed requests per keyspace
+// whose spill stats can be looked up.
+const backfillHistorySize = 256
+
+// backfillHistory keeps spill stats of the last `max` completed requests
+// that spilled rows.
+type backfillHistory struct {
+	mu    sync.Mutex
+	max   int
+	stats map[string]*backfillStats // requestId -> stats
+	order []string                  // oldest first
+}
+
+func newBackfillHistory(max int) *backfillHistory {
+	return &backfillHistory{max: max, stats: make(map[string]*backfillStats)}
+}
+
+func (h *backfillHistory) add(requestId string, st *backfillStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.stats[requestId]; !ok {
+		h.order = append(h.order, requestId)
+	}
+	h.stats[requestId] = st
+	for len(h.order) > h.max {
+		delete(h.stats, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+func (h *backfillHistory) get(requestId string) *backfillStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.stats[requestId]
+}
+
+// backfillCodec is shared by all response handlers of a request.
+type backfillCodec struct {
+	encrypt bool
+	once    sync.Once
+	aead    cipher.AEAD
+	err     error
+	nonce   uint64
+}
+
+func newBackfillCodec(encrypt bool) *backfillCodec {
+	return &backfillCodec{encrypt: encrypt}
+}
+
+// init generates the ephemeral key of request, key is never persisted
+// and spilled rows cannot be read once the request is done.
+func (bc *backfillCodec) init() error {
+	bc.once.Do(func() {
+		if !bc.encrypt {
+			return
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			bc.err = err
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			bc.err = err
+			return
+		}
+		bc.aead, bc.err = cipher.NewGCM(block)
+	})
+	return bc.err
+}
+
+func (bc *backfillCodec) seal(data []byte) []byte {
+	if bc.aead == nil {
+		return data
+	}
+	nonce := make([]byte, bc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, atomic.AddUint64(&bc.nonce, 1))
+	return bc.aead.Seal(nonce, nonce, data, nil)
+}
+
+func (bc *backfillCodec) open(data []byte) ([]byte, error) {
+	if bc.aead == nil {
+		return data, nil
+	}
+	ns := bc.aead.NonceSize()
+	if len(data) < ns {
+		return nil, fmt.Errorf("backfill frame too short")
+	}
+	return bc.aead.Open(nil, data[:ns], data[ns:], nil)
+}
+
+// backfillWriter spills batches of rows to backfill file.
+type backfillWriter struct {
+	requestId string
+	codec     *backfillCodec
+	w         io.Writer
+	limit     int64 // disk budget in bytes
+	buf       bytes.Buffer
+	enc       *gob.Encoder
+}
+
+func newBackfillWriter(
+	requestId string, codec *backfillCodec, w io.Writer,
+	limit int64) *backfillWriter {
+
+	bw := &backfillWriter{requestId: requestId, codec: codec, w: w, limit: limit}
+	bw.enc = gob.NewEncoder(&bw.buf)
+	return bw
+}
+
+func (bw *backfillWriter) writeEntries(skeys []c.SecondaryKey, pkeys [][]byte) error {
+	bw.buf.Reset()
+	if err := bw.enc.Encode(skeys); err != nil {
+		return err
+	}
+	if err := bw.enc.Encode(pkeys); err != nil {
+		return err
+	}
+	rawBytes := int64(bw.buf.Len())
+
+	payload := bw.codec.seal(snappy.Encode(nil, bw.buf.Bytes()))
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	err := gBackfillBudget.reserve(bw.requestId, int64(len(frame)), bw.limit)
+	if err != nil {
+		return err
+	}
+	// frame is written in one call, reader is signalled after.
+	if _, err := bw.w.Write(frame); err != nil {
+		return err
+	}
+	gBackfillBudget.addStats(bw.requestId, 0, 1, rawBytes)
+	return nil
+}
+
+// backfillReader reads back batches of rows spilled by backfillWriter.
+type backfillReader struct {
+	codec *backfillCodec
+	r     io.Reader
+	buf   bytes.Buffer
+	dec   *gob.Decoder
+	hdr   [4]byte
+}
+
+func newBackfillReader(codec *backfillCodec, r io.Reader) *backfillReader {
+	br := &backfillReader{codec: codec, r: r}
+	br.dec = gob.NewDecoder(&br.buf)
+	return br
+}
+
+func (br *backfillReader) readEntries() ([]c.SecondaryKey, [][]byte, error) {
+	if _, err := io.ReadFull(br.r, br.hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(br.hdr[:]))
+	if _, err := io.ReadFull(br.r, payload); err != nil {
+		return nil, nil, err
+	}
+	payload, err := br.codec.open(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := snappy.Decode(nil, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	br.buf.Write(data)
+
+	skeys := make([]c.SecondaryKey, 0)
+	if err := br.dec.Decode(&skeys); err != nil {
+		return nil, nil, err
+	}
+	pkeys := make([][]byte, 0)
+	if err := br.dec.Decode(&pkeys); err != nil {
+		return nil, nil, err
+	}
+	return skeys, pkeys, nil
+}
@@ -0,0 +1,111 @@
+package n1ql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+)
+
+func TestBackfillCodec(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		codec := newBackfillCodec(encrypt)
+		if err := codec.init(); err != nil {
+			t.Fatal(err)
+		}
+
+		requestId := "backfill-codec-test"
+		var file bytes.Buffer
+		w := newBackfillWriter(requestId, codec, &file, 1024*1024)
+		batches := [][]c.SecondaryKey{
+			{{"aaaa", 10}, {"bbbb", 20}},
+			{{"cccc", 30}},
+		}
+		pkeys := [][][]byte{
+			{[]byte("doc1"), []byte("doc2")},
+			{[]byte("doc3")},
+		}
+		for i := range batches {
+			if err := w.writeEntries(batches[i], pkeys[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if encrypt && bytes.Contains(file.Bytes(), []byte("doc1")) {
+			t.Errorf("expected spilled rows to be encrypted")
+		}
+
+		written := int64(file.Len())
+		r := newBackfillReader(codec, &file)
+		for i := range batches {
+			skeys, pks, err := r.readEntries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pks, pkeys[i]) || len(skeys) != len(batches[i]) {
+				t.Errorf("batch %v: expected %v %v, got %v %v", i, batches[i], pkeys[i], skeys, pks)
+			}
+		}
+
+		st := gBackfillBudget.release(requestId)
+		if st == nil || st.records != 2 || st.diskBytes != written {
+			t.Errorf("unexpected backfill stats %+v", st)
+		}
+	}
+}
+
+func TestBackfillBudget(t *testing.T) {
+	b := &backfillBudget{requests: make(map[string]*backfillStats)}
+
+	if err := b.reserve("req1", 1500, 2000); err != nil {
+		t.Fatal(err)
+	}
+	// req2 is within its fair share, but total budget is exhausted.
+	if err := b.reserve("req2", 600, 2000); err == nil {
+		t.Errorf("expected budget to be exhausted")
+	}
+	if err := b.reserve("req2", 500, 2000); err != nil {
+		t.Fatal(err)
+	}
+	// req1 is over its fair share of 1000 bytes.
+	if err := b.reserve("req1", 100, 2000); err == nil {
+		t.Errorf("expected request to exceed its fair share")
+	}
+
+	b.release("req1")
+	if err := b.reserve("req2", 1000, 2000); err != nil {
+		t.Errorf("expected reservation after release to succeed, %v", err)
+	}
+}
+
+func TestBackfillStats(t *testing.T) {
+	gsi := &gsiKeyspace{backfills: newBackfillHistory(2)}
+
+	gBackfillBudget.addStats("req1", 1, 10, 1000)
+	if err := gBackfillBudget.reserve("req1", 400, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"files": int64(1), "records": int64(10), "bytes": int64(1000), "disk_bytes": int64(400),
+	}
+	if st := gsi.BackfillStats("req1"); !reflect.DeepEqual(st, expected) {
+		t.Errorf("expected in progress stats %v, got %v", expected, st)
+	}
+
+	// stats of completed requests remain available, up to history size.
+	gsi.backfills.add("req1", gBackfillBudget.release("req1"))
+	if st := gsi.BackfillStats("req1"); !reflect.DeepEqual(st, expected) {
+		t.Errorf("expected completed stats %v, got %v", expected, st)
+	}
+	gsi.backfills.add("req2", &backfillStats{files: 1})
+	gsi.backfills.add("req3", &backfillStats{files: 1})
+	if st := gsi.BackfillStats("req1"); st != nil {
+		t.Errorf("expected oldest stats to be dropped, got %v", st)
+	}
+	if st := gsi.BackfillStats("req3"); st == nil || st["files"] != int64(1) {
+		t.Errorf("unexpected stats %v", st)
+	}
+	if stats := gsi.Stats(); stats["gsi_totalbackfills"] != int64(0) {
+		t.Errorf("unexpected keyspace stats %v", stats)
+	}
+}
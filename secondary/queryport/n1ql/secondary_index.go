@@ -83,7 +83,10 @@ type gsiKeyspace struct {
 	totalscans     int64
 	backfillSize   int64
 	totalbackfills int64
+	backfillBytes  int64 // bytes spilled before compression
+	backfillDisk   int64 // bytes written to backfill files
 
+	backfills      *backfillHistory
 	rw             sync.RWMutex
 	clusterURL     string
 	namespace      string // aka pool
@@ -113,6 +116,7 @@ func NewGSIIndexer(
 		keyspace:       keyspace,
 		indexes:        make(map[uint64]datastore.Index), // defnID -> index
 		primaryIndexes: make(map[uint64]datastore.PrimaryIndex),
+		backfills:      newBackfillHistory(backfillHistorySize),
 	}
 	tm := time.Now().UnixNano()
 	gsi.logPrefix = fmt.Sprintf("GSIC[%s/%s-%v]", namespace, keyspace, tm)
@@ -620,19 +624,20 @@ func (gsi *gsiKeyspace) getPrimaryIndexFromVersion(index *secondaryIndex,
 // secondaryIndex to hold meta data information, network-address for
 // a single secondary-index.
 type secondaryIndex struct {
-	gsi       *gsiKeyspace // back-reference to container.
-	bucketn   string
-	name      string // name of the index
-	defnID    uint64
-	isPrimary bool
-	using     c.IndexType
-	partnExpr expression.Expressions
-	secExprs  expression.Expressions
-	desc      []bool
-	whereExpr expression.Expression
-	state     datastore.IndexState
-	err       string
-	deferred  bool
+	gsi        *gsiKeyspace // back-reference to container.
+	bucketn    string
+	name       string // name of the index
+	defnID     uint64
+	isPrimary  bool
+	using      c.IndexType
+	partnExpr  expression.Expressions
+	secExprs   expression.Expressions
+	desc       []bool
+	whereExpr  expression.Expression
+	state      datastore.IndexState
+	err        string
+	deferred   bool
+	aggregates []*c.IndexAggregate
 }
 
 // for metadata-provider.
@@ -659,6 +664,8 @@ func newSecondaryIndexFromMetaData(
 		deferred:  indexDefn.Deferred,
 	}
 
+	si.aggregates = indexDefn.Aggregates
+
 	if indexDefn.SecExprs != nil {
 		exprs := make(expression.Expressions, 0, len(indexDefn.SecExprs))
 		for _, secExpr := range indexDefn.SecExprs {
@@ -833,6 +840,15 @@ func (si *secondaryIndex) cleanupBackfillFile(requestId string, broker *qclient.
 			}
 			atomic.AddInt64(&si.gsi.totalbackfills, 1)
 		}
+		if st := gBackfillBudget.release(requestId); st != nil {
+			fmsg := "%v request(%v) backfill stats {\"files\":%v,\"records\":%v," +
+				"\"bytes\":%v,\"disk_bytes\":%v}\n"
+			l.Infof(fmsg, si.gsi.logPrefix, requestId, st.files, st.records,
+				st.rawBytes, st.diskBytes)
+			atomic.AddInt64(&si.gsi.backfillBytes, st.rawBytes)
+			atomic.AddInt64(&si.gsi.backfillDisk, st.diskBytes)
+			si.gsi.backfills.add(requestId, st)
+		}
 	}
 }
 
@@ -1051,15 +1067,60 @@ type secondaryIndex3 struct {
 // CreateAggregate implement Index3 interface.
 func (si *secondaryIndex3) CreateAggregate(requestId string, groupAggs *datastore.IndexGroupAggregates,
 	with value.Value) errors.Error {
-	return errors.NewError(fmt.Errorf("Create Aggregate not supported"), "")
+
+	if si == nil {
+		return ErrorIndexEmpty
+	}
+	client := si.gsi.gsiClient
+
+	aggregate, e := n1qlaggregatetogsi(groupAggs)
+	if e != nil {
+		return errors.NewError(e, "")
+	}
+
+	request := &mclient.AggregateRequest{
+		Op:        mclient.AGGREGATE_CREATE,
+		DefnId:    c.IndexDefnId(si.defnID),
+		Name:      aggregate.Name,
+		Aggregate: aggregate,
+	}
+	if e := client.UpdateAggregate(request); e != nil {
+		return errors.NewError(e, "")
+	}
+	return nil
 }
 
+// DropAggregate implement Index3 interface.
 func (si *secondaryIndex3) DropAggregate(requestId, name string) errors.Error {
-	return errors.NewError(fmt.Errorf("Drops Aggregate not supported"), "")
+
+	if si == nil {
+		return ErrorIndexEmpty
+	}
+	client := si.gsi.gsiClient
+
+	request := &mclient.AggregateRequest{
+		Op:     mclient.AGGREGATE_DROP,
+		DefnId: c.IndexDefnId(si.defnID),
+		Name:   name,
+	}
+	if e := client.UpdateAggregate(request); e != nil {
+		return errors.NewError(e, "")
+	}
+	return nil
 }
 
+// Aggregates implement Index3 interface.
 func (si *secondaryIndex3) Aggregates() ([]datastore.IndexGroupAggregates, errors.Error) {
-	return nil, errors.NewError(fmt.Errorf("Precomputed Aggregates not supported"), "")
+
+	if si == nil {
+		return nil, ErrorIndexEmpty
+	}
+
+	result := make([]datastore.IndexGroupAggregates, 0, len(si.aggregates))
+	for _, aggregate := range si.aggregates {
+		result = append(result, gsiaggregateton1ql(aggregate, si.secExprs))
+	}
+	return result, nil
 }
 
 func (si *secondaryIndex3) PartitionKeys() (*datastore.IndexPartition, errors.Error) {
@@ -1174,6 +1235,20 @@ func (si *secondaryIndex3) Alter(requestId string, with value.Value) (
 			return nil, errors.NewError(e, "GSI AlterIndex()")
 		}
 		return datastore.Index(si), nil
+	case "rebuild":
+		client := si.gsi.gsiClient
+		e := client.RebuildIndex(si.defnID)
+		if e != nil {
+			return nil, errors.NewError(e, "GSI AlterIndex()")
+		}
+		return datastore.Index(si), nil
+	case "memory":
+		client := si.gsi.gsiClient
+		e := client.UpdateMemQuota(si.defnID, withMap)
+		if e != nil {
+			return nil, errors.NewError(e, "GSI AlterIndex()")
+		}
+		return datastore.Index(si), nil
 	default:
 		return nil, errors.NewError(fmt.Errorf(ErrorUnsupportedAction), "")
 	}
@@ -1216,9 +1291,10 @@ func makeRequestBroker(
 	size int) *qclient.RequestBroker {
 
 	broker := qclient.NewRequestBroker(requestId, int64(size))
+	codec := newBackfillCodec(client.Settings().BackfillEncryption())
 
 	factory := func(id qclient.ResponseHandlerId, instId uint64, partitions []c.PartitionId) qclient.ResponseHandler {
-		return makeResponsehandler(id, requestId, si, client, conn, broker, config, waitGroup, backfillSync, instId, partitions)
+		return makeResponsehandler(id, requestId, si, client, conn, broker, config, waitGroup, backfillSync, instId, partitions, codec)
 	}
 
 	sender := func(pkey []byte, value []value.Value, skey c.SecondaryKey) bool {
@@ -1242,12 +1318,13 @@ func makeResponsehandler(
 	waitGroup *sync.WaitGroup,
 	backfillSync *int64,
 	instId uint64,
-	partitions []c.PartitionId) qclient.ResponseHandler {
+	partitions []c.PartitionId,
+	codec *backfillCodec) qclient.ResponseHandler {
 
 	entryChannel := conn.EntryChannel()
 
-	var enc *gob.Encoder
-	var dec *gob.Decoder
+	var enc *backfillWriter
+	var dec *backfillReader
 	var readfd *os.File
 	var backfillFin, backfillEntries int64
 
@@ -1302,25 +1379,9 @@ func makeResponsehandler(
 				time.Sleep(1 * time.Millisecond)
 				continue
 			}
-			cummsize := atomic.LoadInt64(&si.gsi.backfillSize) / (1024 * 1024)
-			if cummsize > backfillLimit {
-				fmsg := "%q backfill exceeded limit %v, %v"
-				err := fmt.Errorf(fmsg, requestId, backfillLimit, cummsize)
-				conn.Error(n1qlError(client, err))
-				broker.Error(err, instId, partitions)
-				return
-			}
 
-			skeys := make([]c.SecondaryKey, 0)
-			if err := dec.Decode(&skeys); err != nil {
-				fmsg := "%v %q decoding from backfill %v: %v\n"
-				l.Errorf(fmsg, lprefix, requestId, name, err)
-				conn.Error(n1qlError(client, err))
-				broker.Error(err, instId, partitions)
-				return
-			}
-			pkeys := make([][]byte, 0)
-			if err := dec.Decode(&pkeys); err != nil {
+			skeys, pkeys, err := dec.readEntries()
+			if err != nil {
 				fmsg := "%v %q decoding from backfill %v: %v\n"
 				l.Errorf(fmsg, lprefix, requestId, name, err)
 				conn.Error(n1qlError(client, err))
@@ -1400,6 +1461,13 @@ func makeResponsehandler(
 		}
 
 		if backfillLimit > 0 && tmpfile == nil && ((cp - ln) < len(skeys)) {
+			if err := codec.init(); err != nil {
+				fmsg := "%v %q initializing backfill encryption: %v\n"
+				l.Errorf(fmsg, lprefix, requestId, err)
+				conn.Error(n1qlError(client, err))
+				broker.Error(err, instId, partitions)
+				return false
+			}
 			prefix := BACKFILLPREFIX + strconv.Itoa(os.Getpid())
 			tmpfile, err = ioutil.TempFile(si.gsi.getTmpSpaceDir(), prefix)
 			name := ""
@@ -1418,8 +1486,10 @@ func makeResponsehandler(
 				fmsg := "%v %v new backfill file ... %v\n"
 				l.Infof(fmsg, lprefix, requestId, name)
 				broker.AddBackfill(tmpfile)
+				gBackfillBudget.addStats(requestId, 1, 0, 0)
 				// encoder
-				enc = gob.NewEncoder(tmpfile)
+				limit := backfillLimit * 1024 * 1024
+				enc = newBackfillWriter(requestId, codec, tmpfile, limit)
 				readfd, err = os.OpenFile(name, os.O_RDONLY, 0666)
 				if err != nil {
 					fmsg := "%v %v reading backfill file %v: %v\n"
@@ -1429,33 +1499,19 @@ func makeResponsehandler(
 					return false
 				}
 				// decoder
-				dec = gob.NewDecoder(readfd)
+				dec = newBackfillReader(codec, readfd)
 				waitGroup.Add(1)
 				go backfill()
 			}
 		}
 
 		if tmpfile != nil {
-			// whether temp-file is exhausted the limit.
-			cummsize := atomic.LoadInt64(&si.gsi.backfillSize) / (1024 * 1024)
-			if cummsize > backfillLimit {
-				fmsg := "%q backfill exceeded limit %v, %v"
-				err := fmt.Errorf(fmsg, requestId, backfillLimit, cummsize)
-				conn.Error(n1qlError(client, err))
-				broker.Error(err, instId, partitions)
-				return false
-			}
-
 			l.Tracef("%v backfill %v entries\n", lprefix, len(skeys))
 			if atomic.LoadInt64(&backfillFin) > 0 {
 				return false
 			}
-			if err := enc.Encode(skeys); err != nil {
-				conn.Error(n1qlError(client, err))
-				broker.Error(err, instId, partitions)
-				return false
-			}
-			if err := enc.Encode(pkeys); err != nil {
+			// fails if request exceeds its share of disk budget.
+			if err := enc.writeEntries(skeys, pkeys); err != nil {
 				conn.Error(n1qlError(client, err))
 				broker.Error(err, instId, partitions)
 				return false
@@ -1698,6 +1754,35 @@ func sendEntry(broker *qclient.RequestBroker, si *secondaryIndex, pkey []byte, v
 	return true
 }
 
+// Stats return statistics of scans made by this keyspace, as
+// periodically logged.
+func (gsi *gsiKeyspace) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"gsi_scan_count":          atomic.LoadInt64(&gsi.totalscans),
+		"gsi_scan_duration":       atomic.LoadInt64(&gsi.scandur),
+		"gsi_throttle_duration":   atomic.LoadInt64(&gsi.throttledur),
+		"gsi_prime_duration":      atomic.LoadInt64(&gsi.primedur),
+		"gsi_blocked_duration":    atomic.LoadInt64(&gsi.blockeddur),
+		"gsi_totalbackfills":      atomic.LoadInt64(&gsi.totalbackfills),
+		"gsi_backfill_size":       atomic.LoadInt64(&gsi.backfillSize),
+		"gsi_backfill_bytes":      atomic.LoadInt64(&gsi.backfillBytes),
+		"gsi_backfill_disk_bytes": atomic.LoadInt64(&gsi.backfillDisk),
+	}
+}
+
+// BackfillStats return backfill stats of request `requestId`, in
+// progress or among the last completed requests, as {"files", "records",
+// "bytes", "disk_bytes"}. Return nil if the request did not spill rows.
+func (gsi *gsiKeyspace) BackfillStats(requestId string) map[string]interface{} {
+	if st := gBackfillBudget.get(requestId); st != nil {
+		return st.toMap()
+	}
+	if st := gsi.backfills.get(requestId); st != nil {
+		return st.toMap()
+	}
+	return nil
+}
+
 func (gsi *gsiKeyspace) logstats(logtick time.Duration) {
 	tick := time.NewTicker(logtick)
 	defer func() {
@@ -1713,15 +1798,19 @@ func (gsi *gsiKeyspace) logstats(logtick time.Duration) {
 		primedur := atomic.LoadInt64(&gsi.primedur)
 		totalscans := atomic.LoadInt64(&gsi.totalscans)
 		totalbackfills := atomic.LoadInt64(&gsi.totalbackfills)
+		backfillBytes := atomic.LoadInt64(&gsi.backfillBytes)
+		backfillDisk := atomic.LoadInt64(&gsi.backfillDisk)
 		if totalscans > sofar {
 			fmsg := `%v logstats %q {` +
 				`"gsi_scan_count":%v,"gsi_scan_duration":%v,` +
 				`"gsi_throttle_duration":%v,` +
 				`"gsi_prime_duration":%v,"gsi_blocked_duration":%v,` +
-				`"gsi_totalbackfills":%v}`
+				`"gsi_totalbackfills":%v,"gsi_backfill_bytes":%v,` +
+				`"gsi_backfill_disk_bytes":%v}`
 			l.Infof(
 				fmsg, gsi.logPrefix, gsi.keyspace, totalscans, scandur,
-				throttledur, primedur, blockeddur, totalbackfills)
+				throttledur, primedur, blockeddur, totalbackfills,
+				backfillBytes, backfillDisk)
 		}
 		sofar = totalscans
 	}
@@ -1862,6 +1951,89 @@ func n1qlgroupaggrtogsi(groupAggs *datastore.IndexGroupAggregates) *qclient.Grou
 	return ga
 }
 
+// n1qlaggregatetogsi converts the group/aggregates of a precomputed
+// aggregate.  Only index keys can be grouped and aggregated.  COUNT of
+// a constant, i.e. COUNT(*), is always maintained by indexer.
+func n1qlaggregatetogsi(groupAggs *datastore.IndexGroupAggregates) (*c.IndexAggregate, error) {
+	if groupAggs == nil {
+		return nil, fmt.Errorf("Aggregate is not specified")
+	}
+
+	aggregate := &c.IndexAggregate{Name: groupAggs.Name}
+
+	for _, grp := range groupAggs.Group {
+		if grp.KeyPos < 0 {
+			return nil, fmt.Errorf("Group by %v is not an index key", grp.Expr)
+		}
+		aggregate.Group = append(aggregate.Group, int32(grp.KeyPos))
+	}
+
+	for _, aggr := range groupAggs.Aggregates {
+		if aggr.Distinct {
+			return nil, fmt.Errorf("DISTINCT aggregates are not supported")
+		}
+
+		typ := n1qlaggrtypetogsi(aggr.Operation)
+		if aggr.KeyPos < 0 {
+			if typ == c.AGG_COUNT && aggr.Expr != nil && aggr.Expr.Value() != nil {
+				continue
+			}
+			return nil, fmt.Errorf("Aggregate on %v is not an index key", aggr.Expr)
+		}
+		aggregate.Aggrs = append(aggregate.Aggrs,
+			c.AggregateKey{AggrFunc: typ, KeyPos: int32(aggr.KeyPos)})
+	}
+
+	return aggregate, nil
+}
+
+func gsiaggregateton1ql(aggregate *c.IndexAggregate,
+	secExprs expression.Expressions) datastore.IndexGroupAggregates {
+
+	keyExpr := func(pos int32) expression.Expression {
+		if int(pos) < len(secExprs) {
+			return secExprs[pos]
+		}
+		return nil
+	}
+
+	groupAggs := datastore.IndexGroupAggregates{Name: aggregate.Name}
+
+	for i, pos := range aggregate.Group {
+		groupAggs.Group = append(groupAggs.Group, &datastore.IndexGroupKey{
+			EntryKeyId: i,
+			KeyPos:     int(pos),
+			Expr:       keyExpr(pos),
+		})
+	}
+
+	for i, ak := range aggregate.Aggrs {
+		groupAggs.Aggregates = append(groupAggs.Aggregates, &datastore.IndexAggregate{
+			Operation:  gsiaggrtypeton1ql(ak.AggrFunc),
+			EntryKeyId: len(aggregate.Group) + i,
+			KeyPos:     int(ak.KeyPos),
+			Expr:       keyExpr(ak.KeyPos),
+		})
+	}
+
+	return groupAggs
+}
+
+func gsiaggrtypeton1ql(aggrType c.AggrFuncType) datastore.AggregateType {
+	switch aggrType {
+	case c.AGG_MIN:
+		return datastore.AGG_MIN
+	case c.AGG_MAX:
+		return datastore.AGG_MAX
+	case c.AGG_SUM:
+		return datastore.AGG_SUM
+	case c.AGG_COUNTN:
+		return datastore.AGG_COUNTN
+	default:
+		return datastore.AGG_COUNT
+	}
+}
+
 func n1qlindexordertogsi(indexOrders datastore.IndexKeyOrders) *qclient.IndexKeyOrder {
 
 	if len(indexOrders) == 0 {
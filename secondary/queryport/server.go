@@ -7,6 +7,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/couchbase/indexing/secondary/logging"
 
@@ -24,13 +25,22 @@ type RequestHandler func(
 	req interface{}, conn net.Conn, quitch <-chan bool)
 
 type request struct {
-	r      interface{}
-	quitch chan bool
+	r        interface{}
+	quitch   chan bool
+	credits  *Credits // nil if request is not flow controlled
+	received time.Time
 }
 
 func newRequest(r interface{}) (req request) {
 	req.r = r
+	req.received = time.Now()
 	req.quitch = make(chan bool)
+	if scanReq, ok := r.(*protobuf.ScanRequest); ok {
+		rows, bytes := scanReq.GetRowCredits(), scanReq.GetByteCredits()
+		if rows > 0 || bytes > 0 {
+			req.credits = NewCredits(uint64(rows), bytes)
+		}
+	}
 	return
 }
 
@@ -49,6 +59,7 @@ type Server struct {
 	streamChanSize    int
 	logPrefix         string
 	nConnections      int64
+	capture           unsafe.Pointer // *requestCapture, nil if not capturing
 }
 
 type ServerStats struct {
@@ -160,8 +171,17 @@ func (s *Server) handleConnection(conn net.Conn) {
 	go s.doReceive(conn, rcvch)
 
 	for req := range rcvch {
-		s.callb(req.r, conn, req.quitch) // blocking call
+		if req.credits != nil {
+			fconn := &creditConn{Conn: conn, credits: req.credits}
+			s.callb(req.r, fconn, req.quitch) // blocking call
+		} else {
+			s.callb(req.r, conn, req.quitch) // blocking call
+		}
 		transport.SendResponseEnd(conn)
+
+		if rc := s.getCapture(); rc != nil {
+			rc.capture(req.r, raddr.String(), req.received, time.Since(req.received))
+		}
 	}
 }
 
@@ -201,10 +221,19 @@ loop:
 			format := "%v connection %s client requested quit"
 			logging.Debugf(format, s.logPrefix, raddr)
 			close(currRequest.quitch)
+		} else if creditReq, yes := reqMsg.(*protobuf.CreditRequest); yes {
+			// credits for the stream of a prior request.
+			if currRequest.credits != nil {
+				currRequest.credits.Grant(
+					uint64(creditReq.GetRows()), creditReq.GetBytes())
+			}
 		} else {
 			currRequest = newRequest(reqMsg)
 			rcvch <- currRequest
 		}
 	}
+	if currRequest.credits != nil {
+		currRequest.credits.Close()
+	}
 	close(rcvch)
 }
@@ -34,6 +34,36 @@ func randString(n int) string {
 	return string(bytes)
 }
 
+// DocId returns the id of the document numbered n.
+func DocId(cfg Config, n int) string {
+	docid := fmt.Sprintf("doc-%0*d", cfg.DocIdLen, n+cfg.DocNumOffset)
+	if cfg.UseRandDocID {
+		key := md5.Sum([]byte(docid))
+		docid = string(key[:])
+	}
+	return docid
+}
+
+// GenerateDoc returns a random document with a string "field", and
+// "junk" and "arr" fields if configured.
+func GenerateDoc(cfg Config) map[string]interface{} {
+	value := make(map[string]interface{})
+	value["field"] = randString(cfg.FieldSize)
+	if cfg.JunkFieldSize != 0 {
+		value["junk"] = fmt.Sprintf("%0*d", cfg.JunkFieldSize, 0)
+	}
+
+	if cfg.ArrayLen > 0 {
+		seed := rnd.Int() % 1000000
+		val := []int{}
+		for i := 0; i < cfg.ArrayLen; i++ {
+			val = append(val, seed+i)
+		}
+		value["arr"] = val
+	}
+	return value
+}
+
 func Run(cfg Config) error {
 	runtime.GOMAXPROCS(cfg.Threads)
 
@@ -50,27 +80,8 @@ func Run(cfg Config) error {
 			go func(offset int) {
 				defer wg.Done()
 				for i := 0; i < cfg.NumDocs/cfg.Threads; i++ {
-					docid := fmt.Sprintf("doc-%0*d", cfg.DocIdLen, i+offset+cfg.DocNumOffset)
-					if cfg.UseRandDocID {
-						key := md5.Sum([]byte(docid))
-						docid = string(key[:])
-					}
-
-					value := make(map[string]interface{})
-					value["field"] = randString(cfg.FieldSize)
-					if cfg.JunkFieldSize != 0 {
-						value["junk"] = fmt.Sprintf("%0*d", cfg.JunkFieldSize, 0)
-					}
-
-					if cfg.ArrayLen > 0 {
-						seed := rnd.Int() % 1000000
-						val := []int{}
-						for i := 0; i < cfg.ArrayLen; i++ {
-							val = append(val, seed+i)
-						}
-						value["arr"] = val
-					}
-
+					docid := DocId(cfg, i+offset)
+					value := GenerateDoc(cfg)
 					localErr := b.Set(docid, 0, value)
 					if localErr != nil {
 						fmt.Println(err)
@@ -11,6 +11,7 @@ package transport
 import "errors"
 import "net"
 import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/golang/snappy"
 
 // error codes
 
@@ -26,6 +27,9 @@ var ErrorEncoderUnknown = errors.New("transport.encoderUnknown")
 // ErrorDecoderUnknown for unknown decoder.
 var ErrorDecoderUnknown = errors.New("transport.decoderUnknown")
 
+// ErrorCompressionUnknown for unsupported compression.
+var ErrorCompressionUnknown = errors.New("transport.compressionUnknown")
+
 //ErrorChecksumMismatch for mismatch in checksum
 var ErrorChecksumMismatch = errors.New("transport.checksumUnknown")
 
@@ -51,6 +55,7 @@ type transporter interface { // facilitates unit testing
 type TransportPacket struct {
 	flags    TransportFlag
 	buf      []byte
+	zbuf     []byte // reused for compression
 	encoders map[byte]Encoder
 	decoders map[byte]Decoder
 }
@@ -102,11 +107,16 @@ func (pkt *TransportPacket) Send(conn transporter, payload interface{}) (err err
 		return
 	}
 	// compress
-	if data, err = pkt.compress(data); err != nil {
-		return
+	flags := pkt.flags
+	if small, err := pkt.compress(data); err != nil {
+		return err
+	} else if len(small) < len(data) {
+		data = small
+	} else { // not compressible, send as is.
+		flags = flags & TransportFlag(0xFFF0)
 	}
 
-	err = Send(conn, pkt.buf, pkt.flags, data, true)
+	err = Send(conn, pkt.buf, flags, data, true)
 	return
 }
 
@@ -169,6 +179,11 @@ func (pkt *TransportPacket) compress(big []byte) (small []byte, err error) {
 	switch pkt.flags.GetCompression() {
 	case CompressionNone:
 		small = big
+	case CompressionSnappy:
+		pkt.zbuf = snappy.Encode(pkt.zbuf[:cap(pkt.zbuf)], big)
+		small = pkt.zbuf
+	default:
+		err = ErrorCompressionUnknown
 	}
 	return
 }
@@ -178,6 +193,10 @@ func (pkt *TransportPacket) decompress(small []byte) (big []byte, err error) {
 	switch pkt.flags.GetCompression() {
 	case CompressionNone:
 		big = small
+	case CompressionSnappy:
+		big, err = snappy.Decode(nil, small)
+	default:
+		err = ErrorCompressionUnknown
 	}
 	return
 }